@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Amount rule outcomes
+const (
+	amountRuleDecline        = "decline"
+	amountRuleRequiresAction = "requires_action"
+)
+
+var amountRulesMatchedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_amount_rules_matched_total",
+		Help: "Total number of authorizations whose outcome was forced by an amount rule",
+	},
+	[]string{"processor", "outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(amountRulesMatchedTotal)
+}
+
+var amountRuleCentsPattern = regexp.MustCompile(`^[0-9]{2}$`)
+
+// AmountRule forces the outcome of authorizations whose amount matches it,
+// like test cards but keyed on the amount, so suites can provoke a path
+// with any card. Every condition set must match; at least one is required.
+type AmountRule struct {
+	// Cents matches amounts whose two decimals are these, e.g. "13" for 10.13
+	Cents string `yaml:"cents" json:"cents,omitempty"`
+	// Above and Below match amounts strictly greater or smaller
+	Above *float64 `yaml:"above" json:"above,omitempty"`
+	Below *float64 `yaml:"below" json:"below,omitempty"`
+	// Outcome is decline or requires_action (a 3DS challenge)
+	Outcome string `yaml:"outcome" json:"outcome"`
+	// DeclineReason is the reason for decline outcomes, default card_declined
+	DeclineReason string `yaml:"decline_reason" json:"decline_reason,omitempty"`
+}
+
+func (r AmountRule) matches(amount float64) bool {
+	if r.Cents != "" {
+		formatted := fmt.Sprintf("%.2f", amount)
+		if formatted[len(formatted)-2:] != r.Cents {
+			return false
+		}
+	}
+	if r.Above != nil && amount <= *r.Above {
+		return false
+	}
+	if r.Below != nil && amount >= *r.Below {
+		return false
+	}
+	return true
+}
+
+func (r AmountRule) declineReason() string {
+	if r.DeclineReason == "" {
+		return "card_declined"
+	}
+	return r.DeclineReason
+}
+
+// matchAmountRule returns the first rule matching amount: the processor's
+// amount_rules, then the top-level ones. An empty processor only checks
+// the top-level rules.
+func (c *RuntimeConfig) matchAmountRule(processor string, amount float64) (AmountRule, bool) {
+	rules := c.AmountRules
+	if p, ok := c.Processors[processor]; ok {
+		rules = append(append([]AmountRule(nil), p.AmountRules...), rules...)
+	}
+	for _, rule := range rules {
+		if rule.matches(amount) {
+			return rule, true
+		}
+	}
+	return AmountRule{}, false
+}
+
+// validateAmountRules checks an amount_rules list; field is its path in
+// the config, e.g. "processors.adyen.amount_rules"
+func validateAmountRules(field string, rules []AmountRule) []FieldViolation {
+	var violations []FieldViolation
+	for i, r := range rules {
+		prefix := fmt.Sprintf("%s[%d]", field, i)
+		if r.Cents == "" && r.Above == nil && r.Below == nil {
+			violations = append(violations, FieldViolation{prefix, "needs at least one of cents, above or below"})
+		}
+		if r.Cents != "" && !amountRuleCentsPattern.MatchString(r.Cents) {
+			violations = append(violations, FieldViolation{prefix + ".cents", "must be two digits, e.g. \"13\""})
+		}
+		if r.Above != nil && *r.Above < 0 {
+			violations = append(violations, FieldViolation{prefix + ".above", "must not be negative"})
+		}
+		if r.Below != nil && *r.Below <= 0 {
+			violations = append(violations, FieldViolation{prefix + ".below", "must be a positive number"})
+		}
+		switch r.Outcome {
+		case amountRuleDecline:
+			if r.DeclineReason != "" && !testDeclineReasonPattern.MatchString(r.DeclineReason) {
+				violations = append(violations, FieldViolation{prefix + ".decline_reason", "must be lowercase letters, digits and '_', starting with a letter"})
+			}
+		case amountRuleRequiresAction:
+			if r.DeclineReason != "" {
+				violations = append(violations, FieldViolation{prefix + ".decline_reason", "only applies to decline outcomes"})
+			}
+		default:
+			violations = append(violations, FieldViolation{prefix + ".outcome", "must be decline or requires_action"})
+		}
+	}
+	return violations
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Artifact stores selectable with ARTIFACT_STORE
+const (
+	artifactStoreDir = "dir"
+	artifactStoreS3  = "s3"
+	artifactStoreGCS = "gcs"
+)
+
+// Kinds of artifact written to the store
+const (
+	artifactSettlement = "settlement"
+	artifactExport     = "export"
+	artifactAudit      = "audit"
+	artifactSnapshot   = "snapshot"
+)
+
+// errArtifactNotFound is returned when reading a key that isn't stored
+var errArtifactNotFound = errors.New("artifact not found")
+
+// gcsEndpoint is the XML API of Cloud Storage, which speaks the S3 protocol
+// when authenticated with HMAC keys
+const gcsEndpoint = "https://storage.googleapis.com"
+
+var (
+	artifactUploadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_artifact_uploads_total",
+			Help: "Total number of files written to the artifact store by kind and result (uploaded or failed, after retries)",
+		},
+		[]string{"store", "kind", "result"},
+	)
+
+	artifactUploadAttemptsFailed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_artifact_upload_attempts_failed_total",
+			Help: "Total number of failed attempts to write a file to the artifact store, retried or not, by kind",
+		},
+		[]string{"store", "kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(artifactUploadsTotal)
+	prometheus.MustRegister(artifactUploadAttemptsFailed)
+}
+
+// objectStore is a bucket or directory files can be written to and read
+// back from
+type objectStore interface {
+	// put writes body under key, replacing any file already there
+	put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error
+	// get opens the file stored under key, errArtifactNotFound if none
+	get(ctx context.Context, key string) (io.ReadCloser, error)
+	// location returns where key is stored, as a path or URL
+	location(key string) string
+	// ping checks the bucket or directory is still there
+	ping(ctx context.Context) error
+}
+
+// dirStore writes files below a local directory
+type dirStore struct{ dir string }
+
+func (s dirStore) put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	dest := s.location(key)
+	if err := os.MkdirAll(filepath.Dir(dest), 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary name first so readers never see half a file
+	tmp := dest + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, body); err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dest)
+}
+
+func (s dirStore) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.location(key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errArtifactNotFound
+	}
+	return f, err
+}
+
+func (s dirStore) ping(ctx context.Context) error {
+	info, err := os.Stat(s.dir)
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", s.dir)
+	}
+	return err
+}
+
+func (s dirStore) location(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+// bucketStore uploads files to an S3 bucket, or a Cloud Storage bucket
+// through its S3-compatible XML API. The client doesn't retry by itself;
+// artifactStore.upload does.
+type bucketStore struct {
+	client *s3.Client
+	bucket string
+	scheme string
+}
+
+func (s bucketStore) put(ctx context.Context, key string, body io.ReadSeeker, contentType string) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        body,
+		ContentType: aws.String(contentType),
+	})
+	return err
+}
+
+func (s bucketStore) get(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	var missing *types.NoSuchKey
+	if errors.As(err, &missing) {
+		return nil, errArtifactNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+func (s bucketStore) ping(ctx context.Context) error {
+	_, err := s.client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(s.bucket)})
+	return err
+}
+
+func (s bucketStore) location(key string) string {
+	return s.scheme + "://" + s.bucket + "/" + key
+}
+
+// artifactStore writes settlement files, exports, audit archives and
+// snapshots, retrying failed uploads
+type artifactStore struct {
+	name   string
+	store  objectStore
+	prefix string
+	// attempts is how many times an upload is tried before it fails
+	attempts int
+	// backoff is the wait before the first retry; it doubles after each
+	backoff time.Duration
+}
+
+// artifacts is nil unless ARTIFACT_STORE is set
+var artifacts *artifactStore
+
+// getArtifactUploadAttempts returns how many times an upload is tried
+func getArtifactUploadAttempts() int {
+	n, err := strconv.Atoi(getEnv("ARTIFACT_UPLOAD_ATTEMPTS", "3"))
+	if err != nil || n <= 0 {
+		return 3
+	}
+	return n
+}
+
+// loadArtifactStore builds the store named by ARTIFACT_STORE:
+//
+//	dir  ARTIFACT_DIR, a local directory
+//	s3   ARTIFACT_BUCKET, with credentials and region from the usual AWS
+//	     variables and files; AWS_ENDPOINT_URL targets LocalStack
+//	gcs  ARTIFACT_BUCKET, with the HMAC key GCS_HMAC_ACCESS_ID and
+//	     GCS_HMAC_SECRET of a service account
+//
+// ARTIFACT_PREFIX is prepended to every key, e.g. "voyager/".
+func loadArtifactStore() (*artifactStore, error) {
+	name := os.Getenv("ARTIFACT_STORE")
+	a := &artifactStore{
+		name:     name,
+		prefix:   os.Getenv("ARTIFACT_PREFIX"),
+		attempts: getArtifactUploadAttempts(),
+		backoff:  500 * time.Millisecond,
+	}
+	bucket := os.Getenv("ARTIFACT_BUCKET")
+	switch name {
+	case "":
+		return nil, nil
+	case artifactStoreDir:
+		dir := os.Getenv("ARTIFACT_DIR")
+		if dir == "" {
+			return nil, fmt.Errorf("ARTIFACT_DIR is required with ARTIFACT_STORE=dir")
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, fmt.Errorf("creating ARTIFACT_DIR: %w", err)
+		}
+		a.store = dirStore{dir: dir}
+	case artifactStoreS3:
+		if bucket == "" {
+			return nil, fmt.Errorf("ARTIFACT_BUCKET is required with ARTIFACT_STORE=s3")
+		}
+		cfg, err := awsconfig.LoadDefaultConfig(context.Background())
+		if err != nil {
+			return nil, fmt.Errorf("loading AWS config: %w", err)
+		}
+		client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+			// Emulators don't resolve bucket subdomains
+			o.UsePathStyle = os.Getenv("AWS_ENDPOINT_URL") != ""
+			o.Retryer = aws.NopRetryer{}
+		})
+		a.store = bucketStore{client: client, bucket: bucket, scheme: "s3"}
+	case artifactStoreGCS:
+		accessID, secret := os.Getenv("GCS_HMAC_ACCESS_ID"), os.Getenv("GCS_HMAC_SECRET")
+		if bucket == "" || accessID == "" || secret == "" {
+			return nil, fmt.Errorf("ARTIFACT_BUCKET, GCS_HMAC_ACCESS_ID and GCS_HMAC_SECRET are required with ARTIFACT_STORE=gcs")
+		}
+		client := s3.New(s3.Options{
+			Region:       "auto",
+			BaseEndpoint: aws.String(gcsEndpoint),
+			Credentials:  credentials.NewStaticCredentialsProvider(accessID, secret, ""),
+			UsePathStyle: true,
+			Retryer:      aws.NopRetryer{},
+		})
+		a.store = bucketStore{client: client, bucket: bucket, scheme: "gs"}
+	default:
+		return nil, fmt.Errorf("unknown ARTIFACT_STORE %q, expected dir, s3 or gcs", name)
+	}
+	return a, nil
+}
+
+// describe returns where artifacts go, for logs
+func (a *artifactStore) describe() string {
+	return a.store.location(a.prefix)
+}
+
+// upload writes body under the prefixed key, retrying with exponential
+// backoff, and returns its location
+func (a *artifactStore) upload(ctx context.Context, kind, key string, body io.ReadSeeker, contentType string) (string, error) {
+	key = a.prefix + key
+	backoff := a.backoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		if _, err = body.Seek(0, io.SeekStart); err != nil {
+			break
+		}
+		if err = a.store.put(ctx, key, body, contentType); err == nil {
+			artifactUploadsTotal.WithLabelValues(a.name, kind, "uploaded").Inc()
+			return a.store.location(key), nil
+		}
+		artifactUploadAttemptsFailed.WithLabelValues(a.name, kind).Inc()
+		if attempt == a.attempts {
+			break
+		}
+		log.Printf("Upload of %s failed (attempt %d of %d), retrying in %s: %v", key, attempt, a.attempts, backoff, err)
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(backoff):
+			backoff *= 2
+			continue
+		}
+		break
+	}
+	artifactUploadsTotal.WithLabelValues(a.name, kind, "failed").Inc()
+	return "", fmt.Errorf("uploading %s: %w", key, err)
+}
+
+// download opens the file stored under the prefixed key
+func (a *artifactStore) download(ctx context.Context, key string) (io.ReadCloser, error) {
+	return a.store.get(ctx, a.prefix+key)
+}
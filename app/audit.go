@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Audited actions
+const (
+	auditAuthorizationCreated     = "authorization.created"
+	auditAuthorizationConfirmed   = "authorization.confirmed"
+	auditTransactionCaptured      = "transaction.captured"
+	auditTransactionRefunded      = "transaction.refunded"
+	auditAuthorizationExpired     = "authorization.expired"
+	auditAuthorizationIncremented = "authorization.incremented"
+	auditConfigUpdated            = "config.updated"
+	auditConfigCleared            = "config.cleared"
+	auditMerchantCreated          = "merchant.created"
+	auditMerchantUpdated          = "merchant.updated"
+	auditMerchantDisabled         = "merchant.disabled"
+	auditMerchantEnabled          = "merchant.enabled"
+	auditMerchantDeleted          = "merchant.deleted"
+	auditAPIKeyRotated            = "merchant.api_key_rotated"
+	auditInstanceDrained          = "instance.drained"
+	auditInstanceUndrained        = "instance.undrained"
+	auditFlagUpdated              = "flag.updated"
+	auditFlagCleared              = "flag.cleared"
+	auditTenantCreated            = "tenant.created"
+	auditTenantDeleted            = "tenant.deleted"
+	auditJobTriggered             = "job.triggered"
+	auditDataPurged               = "data.purged"
+	auditSnapshotSaved            = "snapshot.saved"
+	auditSnapshotRestored         = "snapshot.restored"
+)
+
+// Actors recorded for changes not made by a merchant's API key
+const (
+	actorAdmin     = "admin"
+	actorSystem    = "system"
+	actorAnonymous = "anonymous"
+	actorLoadGen   = "loadgen"
+	actorReplay    = "replay"
+)
+
+const (
+	defaultAuditPageSize = 100
+	maxAuditPageSize     = 1000
+	// maxAuditBacklog caps the entries held for archiving while the
+	// artifact store is unreachable; the oldest are dropped beyond it
+	maxAuditBacklog = 100000
+)
+
+// AuditEntry records one state-changing operation. Entries are only ever
+// appended.
+type AuditEntry struct {
+	AuditID string `json:"audit_id"`
+	Action  string `json:"action"`
+	// Actor made the change: merchant:<id> for an API key, admin for the
+	// admin token, system for background jobs, or anonymous
+	Actor        string `json:"actor"`
+	ResourceType string `json:"resource_type"`
+	ResourceID   string `json:"resource_id"`
+	MerchantID   string `json:"merchant_id,omitempty"`
+	RequestID    string `json:"request_id,omitempty"`
+	// ClientIP is the address the request came from; see clientAddr
+	ClientIP string `json:"client_ip,omitempty"`
+	// BeforeStatus and AfterStatus are the resource's status around the
+	// change, where it has one
+	BeforeStatus string `json:"before_status,omitempty"`
+	AfterStatus  string `json:"after_status,omitempty"`
+	CreatedAt    string `json:"created_at"`
+}
+
+// AuditLog is one page of GET /admin/audit. Pass the last audit_id as
+// starting_after to get the next.
+type AuditLog struct {
+	Data    []AuditEntry `json:"data"`
+	HasMore bool         `json:"has_more"`
+}
+
+// AuditFilter narrows an audit listing. Zero values match everything.
+type AuditFilter struct {
+	Action     string
+	Actor      string
+	ResourceID string
+	MerchantID string
+	RequestID  string
+	// CreatedFrom and CreatedTo bound created_at, inclusive
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// StartingAfter lists only entries older than this audit ID
+	StartingAfter string
+	Limit         int
+}
+
+func (f AuditFilter) matches(e AuditEntry) bool {
+	return (f.Action == "" || e.Action == f.Action) &&
+		(f.Actor == "" || e.Actor == f.Actor) &&
+		(f.ResourceID == "" || e.ResourceID == f.ResourceID) &&
+		(f.MerchantID == "" || e.MerchantID == f.MerchantID) &&
+		(f.RequestID == "" || e.RequestID == f.RequestID) &&
+		(f.CreatedFrom.IsZero() || e.CreatedAt >= formatTimestamp(f.CreatedFrom)) &&
+		(f.CreatedTo.IsZero() || e.CreatedAt <= formatTimestamp(f.CreatedTo)) &&
+		(f.StartingAfter == "" || e.AuditID < f.StartingAfter)
+}
+
+// newAuditID starts with the creation time, so IDs sort entries in the
+// order they were recorded
+func newAuditID() string {
+	return newTimeOrderedID("aud_")
+}
+
+// auditOrigin is who asked for a change, from where, and in which request
+type auditOrigin struct {
+	actor     string
+	requestID string
+	clientIP  string
+}
+
+// auditOriginOf returns the origin of changes made by r
+func auditOriginOf(r *http.Request) auditOrigin {
+	origin := auditOrigin{actor: actorAnonymous, requestID: requestIDFromContext(r.Context()), clientIP: clientIP(r)}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		origin.actor = "merchant:" + merchantID
+	} else if strings.HasPrefix(r.URL.Path, "/admin/") {
+		origin.actor = actorAdmin
+	}
+	return origin
+}
+
+// recordAudit appends an entry to the audit trail, logging rather than
+// failing the change it records. A zero origin is a background job.
+func recordAudit(origin auditOrigin, e AuditEntry) {
+	e.AuditID = newAuditID()
+	e.Actor = origin.actor
+	if e.Actor == "" {
+		e.Actor = actorSystem
+	}
+	e.RequestID = origin.requestID
+	e.ClientIP = origin.clientIP
+	e.CreatedAt = formatTimestamp(time.Now())
+	e.ResourceID = sanitizeText(e.ResourceID)
+	e.RequestID = sanitizeText(e.RequestID)
+
+	ctx, cancel := storageContext()
+	defer cancel()
+	if err := storage.createAuditEntry(ctx, e); err != nil {
+		storageErrorsTotal.WithLabelValues("create_audit_entry").Inc()
+		log.Printf("Failed to record %s audit entry for %s: %v", e.Action, e.ResourceID, err)
+		return
+	}
+	queueAuditArchive(e)
+}
+
+// recordTransactionAudit audits a change of a transaction's status
+func recordTransactionAudit(origin auditOrigin, action string, txn Transaction, from string) {
+	recordAudit(origin, AuditEntry{
+		Action:       action,
+		ResourceType: "transaction",
+		ResourceID:   txn.TransactionID,
+		MerchantID:   txn.MerchantID,
+		BeforeStatus: from,
+		AfterStatus:  txn.Status,
+	})
+}
+
+// recordAuthorizationAudit audits an authorization's outcome. Rejected
+// authorizations change nothing and aren't audited.
+func recordAuthorizationAudit(origin auditOrigin, action, merchantID string, response AuthorizationResponse, from string) {
+	recordAudit(origin, AuditEntry{
+		Action:       action,
+		ResourceType: "transaction",
+		ResourceID:   response.TransactionID,
+		MerchantID:   merchantID,
+		BeforeStatus: from,
+		AfterStatus:  response.Status,
+	})
+}
+
+// recordMerchantAudit audits an admin change to a merchant
+func recordMerchantAudit(r *http.Request, action, merchantID, from, to string) {
+	recordAudit(auditOriginOf(r), AuditEntry{
+		Action:       action,
+		ResourceType: "merchant",
+		ResourceID:   merchantID,
+		MerchantID:   merchantID,
+		BeforeStatus: from,
+		AfterStatus:  to,
+	})
+}
+
+// merchantStatus is a merchant's status in the audit trail
+func merchantStatus(m Merchant) string {
+	if m.Disabled {
+		return "disabled"
+	}
+	return "active"
+}
+
+// parseAuditFilter reads the GET /admin/audit query parameters
+func parseAuditFilter(r *http.Request) (AuditFilter, []FieldViolation) {
+	q := r.URL.Query()
+	filter := AuditFilter{
+		Action:        q.Get("action"),
+		Actor:         q.Get("actor"),
+		ResourceID:    q.Get("resource_id"),
+		MerchantID:    q.Get("merchant_id"),
+		RequestID:     q.Get("request_id"),
+		StartingAfter: q.Get("starting_after"),
+		Limit:         defaultAuditPageSize,
+	}
+	var violations []FieldViolation
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{{"created_from", &filter.CreatedFrom}, {"created_to", &filter.CreatedTo}} {
+		if v := q.Get(param.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				violations = append(violations, FieldViolation{param.name, "must be an RFC 3339 timestamp"})
+			}
+			*param.dest = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxAuditPageSize {
+			violations = append(violations, FieldViolation{"limit", fmt.Sprintf("must be between 1 and %d", maxAuditPageSize)})
+		}
+		filter.Limit = n
+	}
+	if format := q.Get("format"); format != "" && format != "ndjson" {
+		violations = append(violations, FieldViolation{"format", "must be ndjson"})
+	}
+	return filter, violations
+}
+
+// handleAuditLog lists audit entries newest first (GET /admin/audit),
+// filtered by action, actor, resource_id, merchant_id, request_id and
+// created_from/created_to. With format=ndjson every matching entry is
+// streamed, one per line, ignoring limit.
+func handleAuditLog(w http.ResponseWriter, r *http.Request) {
+	filter, violations := parseAuditFilter(r)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	if r.URL.Query().Get("format") == "ndjson" {
+		exportAuditLog(w, r, filter)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+
+	// One extra row tells whether another page follows
+	pageSize := filter.Limit
+	filter.Limit++
+	entries, err := storage.auditEntries(ctx, filter)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_audit_entries").Inc()
+		log.Printf("Failed to list audit entries: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	page := AuditLog{Data: entries, HasMore: len(entries) > pageSize}
+	if page.HasMore {
+		page.Data = entries[:pageSize]
+	}
+	if page.Data == nil {
+		page.Data = []AuditEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+// exportAuditLog streams every entry matching filter as NDJSON, a page at
+// a time like GET /transactions/export
+func exportAuditLog(w http.ResponseWriter, r *http.Request, filter AuditFilter) {
+	filter.Limit = exportPageSize
+	page, err := auditPage(r.Context(), filter)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_audit_entries").Inc()
+		log.Printf("Failed to export audit entries: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="audit-`+time.Now().UTC().Format("20060102T150405Z")+`.ndjson"`)
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for {
+		for _, e := range page {
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if len(page) < exportPageSize {
+			return
+		}
+		filter.StartingAfter = page[len(page)-1].AuditID
+		if page, err = auditPage(r.Context(), filter); err != nil {
+			// The response has started, so the export just ends short
+			storageErrorsTotal.WithLabelValues("list_audit_entries").Inc()
+			log.Printf("Failed to export audit entries after %s: %v", filter.StartingAfter, err)
+			return
+		}
+	}
+}
+
+func auditPage(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	return storage.auditEntries(ctx, filter)
+}
+
+// auditBacklog holds the audit entries this replica recorded and hasn't
+// archived yet
+var auditBacklog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// queueAuditArchive keeps an entry for the next audit archive
+func queueAuditArchive(e AuditEntry) {
+	if artifacts == nil {
+		return
+	}
+	auditBacklog.mu.Lock()
+	defer auditBacklog.mu.Unlock()
+	auditBacklog.entries = append(auditBacklog.entries, e)
+	if over := len(auditBacklog.entries) - maxAuditBacklog; over > 0 {
+		auditBacklog.entries = auditBacklog.entries[over:]
+	}
+}
+
+// getAuditArchiveInterval returns how often audit entries are archived
+func getAuditArchiveInterval() time.Duration {
+	interval, err := parseDelay(getEnv("AUDIT_ARCHIVE_INTERVAL", "1h"))
+	if err != nil || interval < time.Minute {
+		return time.Hour
+	}
+	return interval
+}
+
+// watchAuditArchive archives the audit trail every AUDIT_ARCHIVE_INTERVAL
+func watchAuditArchive() {
+	if artifacts == nil {
+		return
+	}
+	interval := getAuditArchiveInterval()
+	for {
+		time.Sleep(interval)
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		archiveAuditLog(ctx)
+		cancel()
+	}
+}
+
+// archiveAuditLog writes the queued audit entries to the artifact store as
+// one NDJSON file. Entries that fail to upload are kept for the next run.
+func archiveAuditLog(ctx context.Context) {
+	if artifacts == nil {
+		return
+	}
+	auditBacklog.mu.Lock()
+	entries := auditBacklog.entries
+	auditBacklog.entries = nil
+	auditBacklog.mu.Unlock()
+	if len(entries) == 0 {
+		return
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, e := range entries {
+		_ = enc.Encode(e)
+	}
+	first, _ := time.Parse(time.RFC3339, entries[0].CreatedAt)
+	last, _ := time.Parse(time.RFC3339, entries[len(entries)-1].CreatedAt)
+	key := path.Join("audit", "date="+first.Format("2006-01-02"),
+		fmt.Sprintf("audit_%s_%s.ndjson", first.Format("20060102T150405Z"), last.Format("20060102T150405Z")))
+	location, err := artifacts.upload(ctx, artifactAudit, key, bytes.NewReader(body.Bytes()), "application/x-ndjson")
+	if err != nil {
+		log.Printf("Failed to archive %d audit entries: %v", len(entries), err)
+		auditBacklog.mu.Lock()
+		auditBacklog.entries = append(entries, auditBacklog.entries...)
+		if over := len(auditBacklog.entries) - maxAuditBacklog; over > 0 {
+			auditBacklog.entries = auditBacklog.entries[over:]
+		}
+		auditBacklog.mu.Unlock()
+		return
+	}
+	log.Printf("Archived %d audit entries to %s", len(entries), location)
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// apiKeyHeader carries the merchant API key on authenticated requests
+const apiKeyHeader = "X-API-Key"
+
+var authFailuresTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_auth_failures_total",
+		Help: "Total number of rejected API key authentications",
+	},
+	[]string{"reason"},
+)
+
+func init() {
+	prometheus.MustRegister(authFailuresTotal)
+}
+
+// apiKeyStore maps API keys to the merchant they were issued to.
+// Keys are stored as SHA-256 digests so lookups don't leak timing
+// information about the raw key and the raw keys never sit in memory
+// longer than loading takes.
+type apiKeyStore struct {
+	keys map[[32]byte]string
+	// retired are keys rotated out of API_KEYS or API_KEYS_FILE that work
+	// until their grace period ends
+	retired map[[32]byte]retiredCredential
+}
+
+// apiKeys holds nil when no keys are configured, which disables
+// authentication
+var apiKeys atomic.Pointer[apiKeyStore]
+
+// loadAPIKeys builds the key store from API_KEYS and API_KEYS_FILE.
+//
+// API_KEYS is a comma separated list of key=merchant_id pairs.
+// API_KEYS_FILE points at a JSON object mapping keys to merchant IDs.
+// Both sources are merged; it returns nil if neither yields any key.
+func loadAPIKeys() (*apiKeyStore, error) {
+	store := &apiKeyStore{keys: make(map[[32]byte]string)}
+
+	for _, pair := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		key, merchantID, ok := strings.Cut(pair, "=")
+		if !ok || key == "" || merchantID == "" {
+			return nil, fmt.Errorf("invalid API_KEYS entry %q, expected key=merchant_id", pair)
+		}
+		store.add(key, merchantID)
+	}
+
+	if path := os.Getenv("API_KEYS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading API_KEYS_FILE: %w", err)
+		}
+		var entries map[string]string
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("parsing API_KEYS_FILE: %w", err)
+		}
+		for key, merchantID := range entries {
+			if key == "" || merchantID == "" {
+				return nil, fmt.Errorf("API_KEYS_FILE contains an empty key or merchant_id")
+			}
+			store.add(key, merchantID)
+		}
+	}
+
+	if len(store.keys) == 0 {
+		return nil, nil
+	}
+	return store, nil
+}
+
+func (s *apiKeyStore) add(key, merchantID string) {
+	s.keys[sha256.Sum256([]byte(key))] = merchantID
+}
+
+// lookup returns the merchant a key was issued to
+func (s *apiKeyStore) lookup(key string) (string, bool) {
+	digest := sha256.Sum256([]byte(key))
+	if merchantID, ok := s.keys[digest]; ok {
+		return merchantID, true
+	}
+	if r, ok := s.retired[digest]; ok && time.Now().Before(r.until) {
+		retiredCredentialUsesTotal.WithLabelValues("api_key").Inc()
+		return r.value, true
+	}
+	return "", false
+}
+
+// count returns how many current keys the store holds
+func (s *apiKeyStore) count() int {
+	if s == nil {
+		return 0
+	}
+	return len(s.keys)
+}
+
+// retire keeps the keys of previous that s no longer has, and those still
+// in their grace period, working until until
+func (s *apiKeyStore) retire(previous *apiKeyStore, until time.Time) {
+	if previous == nil {
+		return
+	}
+	s.retired = make(map[[32]byte]retiredCredential)
+	now := time.Now()
+	for digest, r := range previous.retired {
+		if _, current := s.keys[digest]; !current && now.Before(r.until) {
+			s.retired[digest] = r
+		}
+	}
+	if !until.After(now) {
+		return
+	}
+	for digest, merchantID := range previous.keys {
+		if _, current := s.keys[digest]; !current {
+			s.retired[digest] = retiredCredential{value: merchantID, until: until}
+		}
+	}
+}
+
+// lookupAPIKey checks the configured keys, then those issued through
+// /admin/merchants
+func lookupAPIKey(key string) (string, bool) {
+	if keys := apiKeys.Load(); keys != nil {
+		if merchantID, ok := keys.lookup(key); ok {
+			return merchantID, true
+		}
+	}
+	if onboarded := onboardedKeys.Load(); onboarded != nil {
+		return onboarded.lookup(key)
+	}
+	return "", false
+}
+
+// apiKeyScopes are what an API key grants: every merchant operation, but
+// not the admin API
+var apiKeyScopes = map[string]bool{scopePaymentsRead: true, scopePaymentsWrite: true}
+
+type merchantContextKey struct{}
+
+type scopesContextKey struct{}
+
+// merchantFromContext returns the authenticated merchant for a request, if any
+func merchantFromContext(ctx context.Context) (string, bool) {
+	merchantID, ok := ctx.Value(merchantContextKey{}).(string)
+	return merchantID, ok
+}
+
+// withIdentity stores the authenticated merchant and its scopes
+func withIdentity(r *http.Request, merchantID string, scopes map[string]bool) *http.Request {
+	ctx := context.WithValue(r.Context(), merchantContextKey{}, merchantID)
+	return r.WithContext(context.WithValue(ctx, scopesContextKey{}, scopes))
+}
+
+// requireScope rejects authenticated requests whose credentials don't
+// grant scope with 403. It runs after requireAPIKey; requests let through
+// while authentication is disabled carry no scopes and pass.
+func requireScope(scope string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			scopes, authenticated := r.Context().Value(scopesContextKey{}).(map[string]bool)
+			if authenticated && !scopes[scope] {
+				writeMissingScope(w, r, scope)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
+
+// writeMissingScope responds 403 naming the scope the credentials lack
+func writeMissingScope(w http.ResponseWriter, r *http.Request, scope string) {
+	authFailuresTotal.WithLabelValues("insufficient_scope").Inc()
+	writeError(w, r, http.StatusForbidden, errCodeForbidden, "Credentials lack the "+scope+" scope",
+		map[string]string{"required_scope": scope})
+}
+
+// requireAdminToken rejects requests without "Authorization: Bearer
+// <ADMIN_TOKEN>" or, when JWT_JWKS_URL is set, a Bearer JWT with the admin
+// scope. Without either configured the route is disabled. Every request,
+// allowed or not, gets an audit log entry.
+func requireAdminToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() { auditAdminAction(r, rec.code()) }()
+
+		token := os.Getenv("ADMIN_TOKEN")
+		if token == "" && jwtAuth == nil {
+			writeError(rec, r, http.StatusForbidden, errCodeForbidden, "Admin API is disabled; set ADMIN_TOKEN to enable it", nil)
+			return
+		}
+		bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if ok && token != "" && subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) == 1 {
+			next(rec, r)
+			return
+		}
+		if ok && jwtAuth != nil && strings.Count(bearer, ".") == 2 {
+			identity, err := jwtAuth.verify(r.Context(), bearer)
+			if err == nil {
+				if !identity.scopes[scopeAdmin] {
+					writeMissingScope(rec, r, scopeAdmin)
+					return
+				}
+				next(rec, r)
+				return
+			}
+			log.Printf("Rejected admin request with invalid JWT from %s: %v", clientIP(r), err)
+		}
+		authFailuresTotal.WithLabelValues("invalid_admin_token").Inc()
+		writeError(rec, r, http.StatusUnauthorized, errCodeUnauthorized, "Missing or invalid admin token", nil)
+	}
+}
+
+// auditAdminAction logs an admin request and its outcome. It is written
+// regardless of ACCESS_LOG so that changes to a running gateway can always
+// be traced back to a caller.
+func auditAdminAction(r *http.Request, status string) {
+	log.Printf("audit: %s %s status=%s client=%s request_id=%s", r.Method, r.URL.Path, status,
+		clientIP(r), requestIDFromContext(r.Context()))
+}
+
+// requireAPIKey rejects requests without a valid merchant API key or
+// Bearer JWT and stores the authenticated merchant in the request context.
+// It lets everything through until a key is configured or issued, or a
+// JWKS is configured.
+func requireAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if apiKeys.Load() == nil && onboardedKeys.Load() == nil && jwtAuth == nil {
+			next(w, r)
+			return
+		}
+
+		if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && jwtAuth != nil {
+			identity, err := jwtAuth.verify(r.Context(), token)
+			if err == nil && identity.merchantID == "" {
+				err = fmt.Errorf("token has no %s claim", jwtAuth.merchantClaim)
+			}
+			if err != nil {
+				authFailuresTotal.WithLabelValues("invalid_token").Inc()
+				log.Printf("Rejected request with invalid JWT from %s: %v", clientIP(r), err)
+				writeError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "Invalid bearer token", nil)
+				return
+			}
+			next(w, withIdentity(r, identity.merchantID, identity.scopes))
+			return
+		}
+
+		key := r.Header.Get(apiKeyHeader)
+		if key == "" {
+			authFailuresTotal.WithLabelValues("missing_key").Inc()
+			message := "Missing API key"
+			if jwtAuth != nil {
+				message = "Missing API key or bearer token"
+			}
+			writeError(w, r, http.StatusUnauthorized, errCodeUnauthorized, message, nil)
+			return
+		}
+
+		merchantID, ok := lookupAPIKey(key)
+		if !ok {
+			authFailuresTotal.WithLabelValues("invalid_key").Inc()
+			log.Printf("Rejected request with invalid API key from %s", clientIP(r))
+			writeError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "Invalid API key", nil)
+			return
+		}
+
+		next(w, withIdentity(r, merchantID, apiKeyScopes))
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// authorizationBody is approved by the test card without any simulated
+// latency, so the benchmarks measure the gateway's own work
+var authorizationBody = []byte(`{"merchant_id":"merchant_bench","amount_minor":1999,"currency":"USD","card_token":"tok_approve"}`)
+
+// authorizationAllocBudget is the most allocations an approved
+// authorization may make in handleAuthorization. It was 75 before the hot
+// path was trimmed; raise it only for allocations that pay for themselves.
+const authorizationAllocBudget = 32
+
+// discardWriter is a ResponseWriter that keeps nothing, so only the
+// handler's allocations are counted
+type discardWriter struct {
+	header http.Header
+	status int
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *discardWriter) WriteHeader(status int)      { w.status = status }
+
+// authorizationCall replays one authorization request, reusing the request
+// and writer between calls
+type authorizationCall struct {
+	w    *discardWriter
+	r    *http.Request
+	body *bytes.Reader
+}
+
+func newAuthorizationCall() *authorizationCall {
+	c := &authorizationCall{w: &discardWriter{header: make(http.Header)}, body: bytes.NewReader(nil)}
+	c.r = httptest.NewRequest(http.MethodPost, "/authorize", nil)
+	c.r.Body = io.NopCloser(c.body)
+	return c
+}
+
+func (c *authorizationCall) serve(tb testing.TB) {
+	c.body.Reset(authorizationBody)
+	for k := range c.w.header {
+		delete(c.w.header, k)
+	}
+	handleAuthorization(c.w, c.r)
+	if c.w.status != http.StatusOK {
+		tb.Fatalf("status %d, want 200", c.w.status)
+	}
+}
+
+func BenchmarkHandleAuthorization(b *testing.B) {
+	c := newAuthorizationCall()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.serve(b)
+	}
+}
+
+func BenchmarkHandleAuthorizationParallel(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		c := newAuthorizationCall()
+		for pb.Next() {
+			c.serve(b)
+		}
+	})
+}
+
+func TestHandleAuthorizationAllocations(t *testing.T) {
+	if testing.Short() {
+		t.Skip("allocation counts need a full run")
+	}
+	if raceEnabled {
+		t.Skip("the race detector allocates on its own")
+	}
+	c := newAuthorizationCall()
+	c.serve(t)
+	allocs := testing.AllocsPerRun(200, func() { c.serve(t) })
+	if allocs > authorizationAllocBudget {
+		t.Errorf("handleAuthorization made %.0f allocations, budget is %d", allocs, authorizationAllocBudget)
+	}
+}
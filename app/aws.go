@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// awsCredentials are read from the standard AWS_* environment variables,
+// which is also how IRSA and ECS task roles can be exported into the pod
+type awsCredentials struct {
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	region          string
+}
+
+func loadAWSCredentials() (awsCredentials, error) {
+	creds := awsCredentials{
+		accessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		region:          getEnv("AWS_REGION", os.Getenv("AWS_DEFAULT_REGION")),
+	}
+	if creds.accessKeyID == "" || creds.secretAccessKey == "" {
+		return creds, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	if creds.region == "" {
+		return creds, fmt.Errorf("AWS_REGION is required")
+	}
+	return creds, nil
+}
+
+// awsEndpoint returns the service endpoint, or AWS_ENDPOINT_URL when
+// pointing at LocalStack or another emulator
+func awsEndpoint(service, region string) string {
+	if endpoint := os.Getenv("AWS_ENDPOINT_URL"); endpoint != "" {
+		return strings.TrimRight(endpoint, "/") + "/"
+	}
+	return fmt.Sprintf("https://%s.%s.amazonaws.com/", service, region)
+}
+
+// signAWSRequest signs req with AWS Signature Version 4
+func signAWSRequest(req *http.Request, body []byte, service string, creds awsCredentials, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	payloadHash := sha256Hex(body)
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.ReplaceAll(req.URL.Query().Encode(), "+", "%20"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/%s/aws4_request", date, creds.region, service)
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+creds.secretAccessKey), date)
+	key = hmacSHA256(key, creds.region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.accessKeyID, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsQueryClient calls AWS services that speak the form-encoded query
+// protocol, which SQS and SNS both do
+type awsQueryClient struct {
+	service  string
+	version  string
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+func newAWSQueryClient(service, version string) (*awsQueryClient, error) {
+	creds, err := loadAWSCredentials()
+	if err != nil {
+		return nil, err
+	}
+	return &awsQueryClient{
+		service:  service,
+		version:  version,
+		endpoint: awsEndpoint(service, creds.region),
+		creds:    creds,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// call invokes action with params and returns an error for non-2xx replies
+func (c *awsQueryClient) call(ctx context.Context, action string, params url.Values) error {
+	params.Set("Action", action)
+	params.Set("Version", c.version)
+	body := []byte(params.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, strings.NewReader(string(body)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(req, body, c.service, c.creds, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s returned %d: %s", c.service, action, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// sqsPublisher sends each transaction event as an SQS message. FIFO queues
+// get the transaction ID as message group, preserving per-transaction order.
+type sqsPublisher struct {
+	client   *awsQueryClient
+	queueURL string
+	fifo     bool
+}
+
+// newSQSPublisher sends to SQS_QUEUE_URL
+func newSQSPublisher() (*sqsPublisher, error) {
+	queueURL := os.Getenv("SQS_QUEUE_URL")
+	if queueURL == "" {
+		return nil, fmt.Errorf("SQS_QUEUE_URL is required")
+	}
+	client, err := newAWSQueryClient("sqs", "2012-11-05")
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Publishing transaction events to SQS queue %s", queueURL)
+	return &sqsPublisher{client: client, queueURL: queueURL, fifo: strings.HasSuffix(queueURL, ".fifo")}, nil
+}
+
+func (p *sqsPublisher) Publish(ctx context.Context, event TransactionEvent) error {
+	body, err := json.Marshal(event)
+	if err == nil {
+		params := url.Values{
+			"QueueUrl":                             {p.queueURL},
+			"MessageBody":                          {string(body)},
+			"MessageAttribute.1.Name":              {"event_type"},
+			"MessageAttribute.1.Value.DataType":    {"String"},
+			"MessageAttribute.1.Value.StringValue": {event.EventType},
+		}
+		if p.fifo {
+			params.Set("MessageGroupId", event.TransactionID)
+			params.Set("MessageDeduplicationId", event.EventID)
+		}
+		err = p.client.call(ctx, "SendMessage", params)
+	}
+	recordPublish(sinkSQS, event.EventType, err)
+	return err
+}
+
+func (p *sqsPublisher) Close() error {
+	return nil
+}
+
+// Ping reads the queue's ARN, which fails if the queue is gone or the
+// credentials can't reach it
+func (p *sqsPublisher) Ping(ctx context.Context) error {
+	return p.client.call(ctx, "GetQueueAttributes", url.Values{"QueueUrl": {p.queueURL}, "AttributeName.1": {"QueueArn"}})
+}
+
+// snsPublisher publishes each transaction event to an SNS topic with an
+// event_type attribute subscribers can filter on
+type snsPublisher struct {
+	client   *awsQueryClient
+	topicARN string
+	fifo     bool
+}
+
+// newSNSPublisher publishes to SNS_TOPIC_ARN
+func newSNSPublisher() (*snsPublisher, error) {
+	topicARN := os.Getenv("SNS_TOPIC_ARN")
+	if topicARN == "" {
+		return nil, fmt.Errorf("SNS_TOPIC_ARN is required")
+	}
+	client, err := newAWSQueryClient("sns", "2010-03-31")
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Publishing transaction events to SNS topic %s", topicARN)
+	return &snsPublisher{client: client, topicARN: topicARN, fifo: strings.HasSuffix(topicARN, ".fifo")}, nil
+}
+
+func (p *snsPublisher) Publish(ctx context.Context, event TransactionEvent) error {
+	body, err := json.Marshal(event)
+	if err == nil {
+		params := url.Values{
+			"TopicArn":                       {p.topicARN},
+			"Message":                        {string(body)},
+			"MessageAttributes.entry.1.Name": {"event_type"},
+			"MessageAttributes.entry.1.Value.DataType":    {"String"},
+			"MessageAttributes.entry.1.Value.StringValue": {event.EventType},
+		}
+		if p.fifo {
+			params.Set("MessageGroupId", event.TransactionID)
+			params.Set("MessageDeduplicationId", event.EventID)
+		}
+		err = p.client.call(ctx, "Publish", params)
+	}
+	recordPublish(sinkSNS, event.EventType, err)
+	return err
+}
+
+func (p *snsPublisher) Close() error {
+	return nil
+}
+
+// Ping reads the topic's attributes
+func (p *snsPublisher) Ping(ctx context.Context) error {
+	return p.client.call(ctx, "GetTopicAttributes", url.Values{"TopicArn": {p.topicARN}})
+}
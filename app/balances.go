@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// ReserveConfig holds back part of a merchant's captured funds before they
+// can be paid out. Durations are Go durations or days ("2d").
+type ReserveConfig struct {
+	// SettlementDelay is how long captured funds stay pending
+	SettlementDelay string `yaml:"settlement_delay" json:"settlement_delay,omitempty"`
+	// Percent of each capture kept in the rolling reserve once it settles
+	Percent float64 `yaml:"percent" json:"percent,omitempty"`
+	// Period is how long a capture's reserve is held; required with Percent
+	Period string `yaml:"period" json:"period,omitempty"`
+
+	// settlementDelay and period are SettlementDelay and Period parsed
+	settlementDelay, period time.Duration
+}
+
+// insufficientBalance fails payouts larger than the merchant's available
+// balance, before they reach the rail
+var insufficientBalance = payoutFailure{
+	Code:    "insufficient_balance",
+	Stage:   payoutPending,
+	Message: "The merchant's available balance is lower than the payout",
+}
+
+// payoutBalanceMu makes checking the available balance and debiting a
+// payout from it atomic within this replica
+var payoutBalanceMu sync.Mutex
+
+// validateReserve checks a reserve section, prefixing violated fields with
+// prefix, and parses its durations
+func validateReserve(prefix string, c *ReserveConfig) []FieldViolation {
+	if c == nil {
+		return nil
+	}
+	var violations []FieldViolation
+	for _, d := range []struct {
+		field, value string
+		parsed       *time.Duration
+	}{{"settlement_delay", c.SettlementDelay, &c.settlementDelay}, {"period", c.Period, &c.period}} {
+		if d.value == "" {
+			continue
+		}
+		parsed, err := parseDelay(d.value)
+		if err == nil && parsed < 0 {
+			err = fmt.Errorf("%q must not be negative", d.value)
+		}
+		if err != nil {
+			violations = append(violations, FieldViolation{prefix + d.field, err.Error()})
+			continue
+		}
+		*d.parsed = parsed
+	}
+	if c.Percent < 0 || c.Percent > 100 {
+		violations = append(violations, FieldViolation{prefix + "percent", "must be between 0 and 100"})
+	}
+	if c.Percent > 0 && c.Period == "" {
+		violations = append(violations, FieldViolation{prefix + "period", "is required with a reserve percent"})
+	}
+	return violations
+}
+
+// reserveTerms returns the merchant's reserve section, else the global
+// one. Without either, captured funds are available right away.
+func reserveTerms(merchantID string) ReserveConfig {
+	cfg := currentConfig()
+	if profile, ok := cfg.merchantProfile(merchantID); ok && profile.Reserve != nil {
+		return *profile.Reserve
+	}
+	if cfg.Reserve != nil {
+		return *cfg.Reserve
+	}
+	return ReserveConfig{}
+}
+
+// merchantBalancesAt returns a merchant's ledger balances with
+// merchant_balance split into pending, reserved and available funds at now.
+// Captures and their fees are pending for the settlement delay; then
+// Percent of each is reserved for Period.
+func merchantBalancesAt(ctx context.Context, merchantID string, now time.Time) ([]MerchantBalance, error) {
+	totals, err := storage.ledgerTotals(ctx, LedgerFilter{MerchantID: merchantID})
+	if err != nil {
+		return nil, err
+	}
+	balances := merchantBalances(totals)
+
+	terms := reserveTerms(merchantID)
+	settledBy := now.Add(-terms.settlementDelay)
+	pending := map[string]int64{}
+	if terms.settlementDelay > 0 {
+		totals, err := storage.ledgerTotals(ctx, LedgerFilter{MerchantID: merchantID,
+			Types: []string{entryCapture, entryFee}, CreatedFrom: settledBy})
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range totals {
+			if t.Account == ledgerMerchantBalance {
+				pending[t.Currency] = t.CreditMinor - t.DebitMinor
+			}
+		}
+	}
+	reserved := map[string]int64{}
+	if terms.Percent > 0 {
+		filter := LedgerFilter{MerchantID: merchantID, Types: []string{entryCapture},
+			CreatedFrom: settledBy.Add(-terms.period)}
+		if terms.settlementDelay > 0 {
+			// Captures from the settlement second on are still pending
+			filter.CreatedTo = settledBy.Add(-time.Second)
+		}
+		totals, err := storage.ledgerTotals(ctx, filter)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range totals {
+			if t.Account == ledgerMerchantBalance {
+				reserved[t.Currency] = int64(math.Round(float64(t.CreditMinor) * terms.Percent / 100))
+			}
+		}
+	}
+
+	for i := range balances {
+		b := &balances[i]
+		b.PendingMinor = pending[b.Currency]
+		b.ReservedMinor = reserved[b.Currency]
+		b.AvailableMinor = b.BalanceMinor - b.PendingMinor - b.ReservedMinor
+		b.Pending = fromMinorUnits(b.PendingMinor, b.Currency)
+		b.Reserved = fromMinorUnits(b.ReservedMinor, b.Currency)
+		b.Available = fromMinorUnits(b.AvailableMinor, b.Currency)
+	}
+	return balances, nil
+}
+
+// availableBalance returns what a merchant can pay out in currency at now
+func availableBalance(ctx context.Context, merchantID, currency string, now time.Time) (int64, error) {
+	balances, err := merchantBalancesAt(ctx, merchantID, now)
+	if err != nil {
+		return 0, err
+	}
+	for _, b := range balances {
+		if b.Currency == currency {
+			return b.AvailableMinor, nil
+		}
+	}
+	return 0, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var batchSize = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Name:    "voyager_authorization_batch_size",
+		Help:    "Number of authorizations per batch request",
+		Buckets: []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000},
+	},
+)
+
+func init() {
+	prometheus.MustRegister(batchSize)
+}
+
+// getBatchMaxSize returns the most authorizations accepted in one batch
+func getBatchMaxSize() int {
+	n, err := strconv.Atoi(getEnv("BATCH_MAX_SIZE", "100"))
+	if err != nil || n <= 0 {
+		return 100
+	}
+	return n
+}
+
+// getMaxBatchBodyBytes returns the largest batch body: MAX_REQUEST_BODY_BYTES
+// for each of BATCH_MAX_SIZE items
+func getMaxBatchBodyBytes() int64 {
+	return getMaxRequestBodyBytes() * int64(getBatchMaxSize())
+}
+
+// getBatchWorkers returns how many workers run batch items' gateway checks,
+// shared by all batches
+func getBatchWorkers() int {
+	n, err := strconv.Atoi(getEnv("BATCH_WORKERS", "10"))
+	if err != nil || n <= 0 {
+		return 10
+	}
+	return n
+}
+
+// batchPool runs batch items on BATCH_WORKERS goroutines shared by all
+// batches. A worker only runs an item's checks and hands simulated processor
+// calls to a timer, so it is free again well before the item completes and
+// in-flight items don't each hold a goroutine.
+var batchPool struct {
+	once  sync.Once
+	tasks chan func()
+}
+
+// runBatchTask queues task on the batch workers, starting them first
+func runBatchTask(task func()) {
+	batchPool.once.Do(func() {
+		workers := getBatchWorkers()
+		batchPool.tasks = make(chan func(), workers)
+		for i := 0; i < workers; i++ {
+			go func() {
+				for task := range batchPool.tasks {
+					task()
+				}
+			}()
+		}
+	})
+	batchPool.tasks <- task
+}
+
+// BatchAuthorizationRequest is the body of POST /authorize/batch
+type BatchAuthorizationRequest struct {
+	Requests []AuthorizationRequest `json:"requests"`
+}
+
+// BatchItemResult is the outcome of one item, in request order. Exactly one
+// of Authorization and Error is set.
+type BatchItemResult struct {
+	Index         int                    `json:"index"`
+	StatusCode    int                    `json:"status_code"`
+	Authorization *AuthorizationResponse `json:"authorization,omitempty"`
+	Error         *ErrorResponse         `json:"error,omitempty"`
+}
+
+// BatchSummary counts batch results by outcome
+type BatchSummary struct {
+	Total          int     `json:"total"`
+	Approved       int     `json:"approved"`
+	Declined       int     `json:"declined"`
+	RequiresAction int     `json:"requires_action"`
+	Rejected       int     `json:"rejected"`
+	ProcessingTime float64 `json:"processing_time_ms"`
+}
+
+// BatchAuthorizationResponse is returned by POST /authorize/batch
+type BatchAuthorizationResponse struct {
+	Results []BatchItemResult `json:"results"`
+	Summary BatchSummary      `json:"summary"`
+}
+
+// handleAuthorizationBatch authorizes many requests in one call on the
+// batch workers. The batch itself succeeds with 200 whenever it is well
+// formed; each item carries its own status code. Each item counts as an
+// active request and takes its own MAX_CONCURRENT_REQUESTS slot, as if it
+// had been sent alone; an item that can't get one is shed with 503.
+func handleAuthorizationBatch(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+
+	var batch BatchAuthorizationRequest
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON batch authorization request"}})
+		return
+	}
+	if len(batch.Requests) == 0 {
+		writeValidationError(w, r, []FieldViolation{{"requests", "must contain at least one authorization"}})
+		return
+	}
+	if max := getBatchMaxSize(); len(batch.Requests) > max {
+		writeValidationError(w, r, []FieldViolation{{"requests", fmt.Sprintf("must contain at most %d authorizations", max)}})
+		return
+	}
+	batchSize.Observe(float64(len(batch.Requests)))
+
+	merchantID, authenticated := merchantFromContext(r.Context())
+	requestID := requestIDFromContext(r.Context())
+	exemplar := requestExemplar(r)
+	origin := auditOriginOf(r)
+	tenant := tenantFromContext(r.Context())
+
+	activeRequests.Add(float64(len(batch.Requests)))
+	inFlightAuthorizations.Add(int64(len(batch.Requests)))
+	results := make([]BatchItemResult, len(batch.Requests))
+	var wg sync.WaitGroup
+	wg.Add(len(batch.Requests))
+	finish := func(result BatchItemResult) {
+		results[result.Index] = result
+		activeRequests.Dec()
+		inFlightAuthorizations.Add(-1)
+		wg.Done()
+	}
+	for idx := range batch.Requests {
+		if authLimiter != nil {
+			if ok, reason := authLimiter.acquire(r); !ok {
+				loadShedTotal.WithLabelValues(reason).Inc()
+				finish(BatchItemResult{
+					Index:      idx,
+					StatusCode: http.StatusServiceUnavailable,
+					Error: &ErrorResponse{
+						Code:      errCodeOverloaded,
+						Message:   "Service overloaded, retry later",
+						RequestID: requestID,
+					},
+				})
+				continue
+			}
+		}
+		runBatchTask(func() {
+			req := batch.Requests[idx]
+			if authenticated {
+				req.MerchantID = merchantID
+			}
+			req.exemplar = exemplar
+			req.origin = origin
+			req.tenant = tenant
+			authorizeBatchItem(idx, req, requestID, func(result BatchItemResult) {
+				if authLimiter != nil {
+					authLimiter.release()
+				}
+				finish(result)
+			})
+		})
+	}
+	wg.Wait()
+
+	summary := BatchSummary{Total: len(results)}
+	for _, res := range results {
+		if res.Error != nil {
+			summary.Rejected++
+			continue
+		}
+		switch res.Authorization.Status {
+		case "approved":
+			summary.Approved++
+		case "requires_action":
+			summary.RequiresAction++
+		default:
+			summary.Declined++
+		}
+	}
+	summary.ProcessingTime = float64(time.Since(startTime).Milliseconds())
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Version", getVersion())
+	_ = json.NewEncoder(w).Encode(BatchAuthorizationResponse{Results: results, Summary: summary})
+}
+
+// authorizeBatchItem authorizes one batch item, mapping the outcome to the
+// status code the single-item endpoint would have returned. then may run
+// after authorizeBatchItem returns, once the processor answers.
+func authorizeBatchItem(idx int, req AuthorizationRequest, requestID string, then func(BatchItemResult)) {
+	authorizeDeferred(req, time.Now(), func(response AuthorizationResponse, rejection *authorizationRejection) {
+		if rejection != nil {
+			then(BatchItemResult{
+				Index:      idx,
+				StatusCode: rejection.Status,
+				Error: &ErrorResponse{
+					Code:      rejection.Code,
+					Message:   rejection.Message,
+					Details:   rejection.Details,
+					RequestID: requestID,
+				},
+			})
+			return
+		}
+		then(BatchItemResult{Index: idx, StatusCode: authorizationStatusCode(response.Status), Authorization: &response})
+	})
+}
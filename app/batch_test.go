@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestAuthorizationBatchShedsItems checks that every batch item needs its
+// own concurrency slot, and that a batch body may be larger than a single
+// authorization's
+func TestAuthorizationBatchShedsItems(t *testing.T) {
+	previous := authLimiter
+	t.Cleanup(func() { authLimiter = previous })
+	// Every slot is taken and nothing queues
+	authLimiter = &concurrencyLimiter{slots: make(chan struct{}, 1)}
+	authLimiter.slots <- struct{}{}
+
+	item := `{"merchant_id": "merchant_batch", "amount": 10, "currency": "USD"}`
+	padding := strings.Repeat(" ", int(getMaxRequestBodyBytes()))
+	body := `{"requests": [` + item + `,` + padding + item + `]}`
+	r := httptest.NewRequest(http.MethodPost, "/authorize/batch", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	limitBodyTo("POST /authorize/batch", getMaxBatchBodyBytes)(handleAuthorizationBatch)(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	var resp BatchAuthorizationResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 2 {
+		t.Fatalf("%d results, want 2", len(resp.Results))
+	}
+	for _, res := range resp.Results {
+		if res.StatusCode != http.StatusServiceUnavailable || res.Error == nil || res.Error.Code != errCodeOverloaded {
+			t.Errorf("item %d: status %d, error %+v, want 503 %s", res.Index, res.StatusCode, res.Error, errCodeOverloaded)
+		}
+	}
+	if inFlight := inFlightAuthorizations.Load(); inFlight != 0 {
+		t.Errorf("%d authorizations in flight after the batch, want 0", inFlight)
+	}
+}
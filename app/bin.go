@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Card funding types
+const (
+	fundingCredit = "credit"
+	fundingDebit  = "debit"
+)
+
+var binLookupsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_card_bin_lookups_total",
+		Help: "Total number of authorizations whose card_token carried a simulated BIN, by brand and funding",
+	},
+	[]string{"brand", "funding"},
+)
+
+func init() {
+	prometheus.MustRegister(binLookupsTotal)
+}
+
+// cardBrands are the brands cardBrand can derive, which routing rules may
+// name
+var cardBrands = []string{"visa", "mastercard", "amex", "discover", "jcb", "diners", "unknown"}
+
+// BINInfo is what the simulation derives from a card_token's BIN
+type BINInfo struct {
+	BIN     string `json:"bin"`
+	Brand   string `json:"brand"`
+	Country string `json:"country"`
+	Funding string `json:"funding"`
+}
+
+// knownBINs pins the issuer country and funding of the test cards
+// processors document, so suites using them see what they expect
+var knownBINs = map[string]BINInfo{
+	"411111": {Country: "US", Funding: fundingCredit},
+	"424242": {Country: "US", Funding: fundingCredit},
+	"400005": {Country: "US", Funding: fundingDebit},
+	"400007": {Country: "BR", Funding: fundingCredit},
+	"555555": {Country: "US", Funding: fundingCredit},
+	"520082": {Country: "US", Funding: fundingDebit},
+	"222300": {Country: "US", Funding: fundingCredit},
+	"378282": {Country: "US", Funding: fundingCredit},
+	"371449": {Country: "US", Funding: fundingCredit},
+	"503143": {Country: "MX", Funding: fundingDebit},
+	"545454": {Country: "AR", Funding: fundingCredit},
+}
+
+// binCountries are the issuer countries other BINs are spread over
+var binCountries = []string{"US", "BR", "MX", "AR", "CO", "CL", "PE", "GB", "DE", "ES", "FR", "CA"}
+
+// tokenBIN returns the leading digits of a card token, up to eight, which
+// the simulation treats as the card's BIN
+func tokenBIN(token string) string {
+	end := 0
+	for end < len(token) && end < 8 && token[end] >= '0' && token[end] <= '9' {
+		end++
+	}
+	return token[:end]
+}
+
+// lookupBIN derives the brand, issuer country and funding of a card token
+// starting with at least six digits. Unknown BINs get a country and
+// funding derived from their digits, so the same BIN always gets the same
+// ones. It returns nil for tokens without a BIN.
+func lookupBIN(token string) *BINInfo {
+	bin := tokenBIN(token)
+	if len(bin) < 6 {
+		return nil
+	}
+	bin = bin[:6]
+	info, ok := knownBINs[bin]
+	if !ok {
+		n := 0
+		for _, c := range bin[1:5] {
+			n = n*10 + int(c-'0')
+		}
+		info.Country = binCountries[n%len(binCountries)]
+		info.Funding = fundingCredit
+		if (bin[5]-'0')%2 == 0 {
+			info.Funding = fundingDebit
+		}
+	}
+	info.BIN = bin
+	info.Brand = cardBrand(bin)
+	binLookupsTotal.WithLabelValues(info.Brand, info.Funding).Inc()
+	return &info
+}
+
+// country is the payer's country: the request's, else the issuer country
+// of the card's BIN
+func (req AuthorizationRequest) country() string {
+	if req.Country == "" && req.bin != nil {
+		return req.bin.Country
+	}
+	return req.Country
+}
+
+// brand is the card's brand, empty when the card token has no BIN
+func (req AuthorizationRequest) brand() string {
+	if req.bin == nil {
+		return ""
+	}
+	return req.bin.Brand
+}
+
+// acceptsBrand reports whether a processor may be routed cards of brand.
+// Cards without a BIN have no brand and go anywhere.
+func (p ProcessorConfig) acceptsBrand(brand string) bool {
+	return brand == "" || !slices.Contains(p.ExcludeBrands, brand)
+}
+
+// validateExcludeBrands checks a processor's exclude_brands, normalizing
+// them to lower case
+func validateExcludeBrands(field string, brands []string) []FieldViolation {
+	var violations []FieldViolation
+	for i, brand := range brands {
+		brands[i] = strings.ToLower(brand)
+		if !slices.Contains(cardBrands, brands[i]) {
+			violations = append(violations, FieldViolation{field, fmt.Sprintf("%q is not one of %s", brand, strings.Join(cardBrands, ", "))})
+		}
+	}
+	return violations
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Blocklist entry types
+const (
+	blockCardToken = "card_token"
+	blockMerchant  = "merchant"
+	blockBINPrefix = "bin_prefix"
+)
+
+var blocklistHitsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_blocklist_hits_total",
+		Help: "Total number of authorizations declined by the blocklist by entry type",
+	},
+	[]string{"type"},
+)
+
+func init() {
+	prometheus.MustRegister(blocklistHitsTotal)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "voyager_blocklist_entries",
+			Help: "Number of entries on the blocklist",
+		},
+		func() float64 { return float64(len(blocklist.list())) },
+	))
+}
+
+// BlocklistEntry blocks the card token, merchant or BIN prefix in Value
+type BlocklistEntry struct {
+	ID        string `json:"id"`
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	Reason    string `json:"reason,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// blocklistStore holds the blocklist in memory
+type blocklistStore struct {
+	mu      sync.RWMutex
+	entries []BlocklistEntry
+}
+
+var blocklist = &blocklistStore{}
+
+// validate checks an entry definition and fills in its timestamp
+func (e *BlocklistEntry) validate(now time.Time) []FieldViolation {
+	var violations []FieldViolation
+	e.Value = strings.TrimSpace(e.Value)
+	switch e.Type {
+	case blockCardToken:
+		if e.Value == "" {
+			violations = append(violations, FieldViolation{"value", "is required"})
+		}
+	case blockMerchant:
+		if !merchantIDPattern.MatchString(e.Value) {
+			violations = append(violations, FieldViolation{"value", "must be 1-64 characters of letters, digits, '_' or '-'"})
+		}
+	case blockBINPrefix:
+		if !binPrefixPattern.MatchString(e.Value) {
+			violations = append(violations, FieldViolation{"value", "must be 1-8 digits"})
+		}
+	default:
+		violations = append(violations, FieldViolation{"type", "must be one of card_token, merchant, bin_prefix"})
+	}
+	if len(e.Reason) > 200 {
+		violations = append(violations, FieldViolation{"reason", "must be at most 200 characters"})
+	}
+	e.CreatedAt = formatTimestamp(now)
+	return violations
+}
+
+// add puts e on the blocklist under a new ID. An entry with the same type
+// and value is returned instead of being added twice.
+func (b *blocklistStore) add(e BlocklistEntry) (BlocklistEntry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, existing := range b.entries {
+		if existing.Type == e.Type && existing.Value == e.Value {
+			return existing, false
+		}
+	}
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	e.ID = "block_" + hex.EncodeToString(id)
+	b.entries = append(b.entries, e)
+	log.Printf("Blocklist entry %s added: type=%s", e.ID, e.Type)
+	return e, true
+}
+
+// remove takes an entry off the blocklist
+func (b *blocklistStore) remove(id string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, e := range b.entries {
+		if e.ID == id {
+			b.entries = append(b.entries[:i], b.entries[i+1:]...)
+			log.Printf("Blocklist entry %s removed", id)
+			return true
+		}
+	}
+	return false
+}
+
+func (b *blocklistStore) list() []BlocklistEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return append(make([]BlocklistEntry, 0, len(b.entries)), b.entries...)
+}
+
+// match returns the type of the first entry blocking req, if any
+func (b *blocklistStore) match(req AuthorizationRequest) (string, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	bin := tokenBIN(req.CardToken)
+	for _, e := range b.entries {
+		switch {
+		case e.Type == blockCardToken && e.Value == req.CardToken,
+			e.Type == blockMerchant && e.Value == req.MerchantID,
+			e.Type == blockBINPrefix && strings.HasPrefix(bin, e.Value):
+			return e.Type, true
+		}
+	}
+	return "", false
+}
+
+// checkBlocklist reports whether req is blocked, counting the hit
+func checkBlocklist(req AuthorizationRequest) bool {
+	entryType, blocked := blocklist.match(req)
+	if blocked {
+		blocklistHitsTotal.WithLabelValues(entryType).Inc()
+	}
+	return blocked
+}
+
+// handleBlocklistList lists the blocklist (GET /admin/blocklist)
+func handleBlocklistList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(blocklist.list())
+}
+
+// handleBlocklistAdd blocks a card token, merchant or BIN prefix (POST
+// /admin/blocklist). Adding an existing entry returns it with 200.
+func handleBlocklistAdd(w http.ResponseWriter, r *http.Request) {
+	var e BlocklistEntry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON blocklist entry"}})
+		return
+	}
+	if violations := e.validate(time.Now()); len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	entry, added := blocklist.add(e)
+
+	w.Header().Set("Content-Type", "application/json")
+	if added {
+		w.WriteHeader(http.StatusCreated)
+	}
+	_ = json.NewEncoder(w).Encode(entry)
+}
+
+// handleBlocklistRemove unblocks an entry (DELETE /admin/blocklist/{id})
+func handleBlocklistRemove(w http.ResponseWriter, r *http.Request) {
+	if !blocklist.remove(r.PathValue("id")) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Blocklist entry not found", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+var (
+	cacheRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_cache_requests_total",
+			Help: "Total number of cache lookups by cache and result (hit, miss or error)",
+		},
+		[]string{"cache", "result"},
+	)
+
+	cacheEvictionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_cache_evictions_total",
+			Help: "Total number of in-memory cache entries evicted by cache and reason (expired or capacity)",
+		},
+		[]string{"cache", "reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(cacheRequestsTotal)
+	prometheus.MustRegister(cacheEvictionsTotal)
+}
+
+// cacheSweepInterval is how often expired entries are dropped from the
+// in-memory caches
+const cacheSweepInterval = time.Minute
+
+// cacheSweepChunk is how many entries a sweep looks at before letting
+// lookups waiting on the cache in
+const cacheSweepChunk = 1000
+
+// ttlCache is a concurrent cache whose entries expire after their TTL.
+// In memory it holds at most maxEntries, evicting the least recently used
+// first, and the caches job drops expired ones. A shared cache keeps its
+// entries in Redis too when REDIS_URL is set, JSON encoded and expired by
+// Redis. Writes also go to memory, and lookups Redis fails or has no entry
+// for are answered from it, so entries written on this replica while Redis
+// was down still resolve here.
+type ttlCache[V any] struct {
+	name       string
+	maxEntries int
+	shared     bool
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// order has the most recently used entry at the front
+	order *list.List
+}
+
+// expiringCache is a ttlCache of any value type, so the caches job can
+// sweep them all
+type expiringCache interface {
+	dropExpired(now time.Time) int
+}
+
+// caches are the caches created so far
+var caches struct {
+	sync.Mutex
+	all []expiringCache
+}
+
+type cacheEntry[V any] struct {
+	key   string
+	value V
+	// expiresAt is zero for entries that never expire
+	expiresAt time.Time
+}
+
+// newTTLCache returns an empty cache reporting its size as
+// voyager_cache_entries{cache="name"}
+func newTTLCache[V any](name string, maxEntries int, shared bool) *ttlCache[V] {
+	c := &ttlCache[V]{
+		name:       name,
+		maxEntries: maxEntries,
+		shared:     shared,
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+	}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "voyager_cache_entries",
+			Help:        "Number of entries held in memory by a cache",
+			ConstLabels: prometheus.Labels{"cache": name},
+		},
+		func() float64 { return float64(c.len()) },
+	))
+	caches.Lock()
+	caches.all = append(caches.all, c)
+	caches.Unlock()
+	return c
+}
+
+// remote returns the Redis client when the cache is shared, else nil
+func (c *ttlCache[V]) remote() *redis.Client {
+	if !c.shared {
+		return nil
+	}
+	return sharedRedis.Load()
+}
+
+func (c *ttlCache[V]) redisKey(key string) string {
+	return "voyager:" + c.name + ":" + key
+}
+
+// get returns the value cached for key, if it hasn't expired
+func (c *ttlCache[V]) get(key string) (V, bool) {
+	var value V
+	if client := c.remote(); client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		data, err := client.Get(ctx, c.redisKey(key)).Bytes()
+		if err == nil {
+			err = json.Unmarshal(data, &value)
+		}
+		switch {
+		case err == nil:
+			cacheRequestsTotal.WithLabelValues(c.name, "hit").Inc()
+			return value, true
+		case err != redis.Nil:
+			c.remoteError("get", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if ok && c.expired(elem, time.Now()) {
+		c.evict(elem, "expired")
+		ok = false
+	}
+	if !ok {
+		cacheRequestsTotal.WithLabelValues(c.name, "miss").Inc()
+		return value, false
+	}
+	c.order.MoveToFront(elem)
+	cacheRequestsTotal.WithLabelValues(c.name, "hit").Inc()
+	return elem.Value.(*cacheEntry[V]).value, true
+}
+
+// set caches value for key, for ttl or forever when ttl is 0
+func (c *ttlCache[V]) set(key string, value V, ttl time.Duration) {
+	c.setLocal(key, value, ttl)
+	if client := c.remote(); client != nil {
+		data, err := json.Marshal(value)
+		if err != nil {
+			c.remoteError("set", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := client.Set(ctx, c.redisKey(key), data, ttl).Err(); err != nil {
+			c.remoteError("set", err)
+		}
+	}
+}
+
+// setLocal caches value for key in memory only
+func (c *ttlCache[V]) setLocal(key string, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.evict(elem, "")
+	}
+	c.insert(key, value, ttl)
+}
+
+// add caches value for key unless a live entry is already there, and
+// reports whether it did. Concurrent adds of a key only succeed once, on
+// every replica sharing Redis too. While Redis fails they only succeed
+// once on this replica, so replayed signatures and duplicate idempotency
+// keys are still caught when they come back to it.
+func (c *ttlCache[V]) add(key string, value V, ttl time.Duration) bool {
+	if client := c.remote(); client != nil {
+		data, err := json.Marshal(value)
+		if err == nil {
+			ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+			defer cancel()
+			var added bool
+			if added, err = client.SetNX(ctx, c.redisKey(key), data, ttl).Result(); err == nil {
+				if added {
+					c.setLocal(key, value, ttl)
+				}
+				return added
+			}
+		}
+		c.remoteError("add", err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		if !c.expired(elem, time.Now()) {
+			return false
+		}
+		c.evict(elem, "expired")
+	}
+	c.insert(key, value, ttl)
+	return true
+}
+
+// delete drops key from the cache
+func (c *ttlCache[V]) delete(key string) {
+	if client := c.remote(); client != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+		defer cancel()
+		if err := client.Del(ctx, c.redisKey(key)).Err(); err != nil {
+			c.remoteError("delete", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.evict(elem, "")
+	}
+}
+
+// len counts the entries held in memory, expired ones included until they
+// are evicted
+func (c *ttlCache[V]) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries)
+}
+
+// dropExpired evicts the expired entries held in memory and returns how
+// many it evicted. Lookups only evict the entries they find expired, and
+// an entry moved to the front or given a longer TTL keeps expired ones
+// behind it from reaching the cold end, so without this they would stay
+// until the cache filled up. It walks from the cold end cacheSweepChunk
+// entries at a time, releasing c.mu in between so a cache of a million
+// signatures doesn't stall lookups, and looks at no more entries than the
+// cache held when it started.
+func (c *ttlCache[V]) dropExpired(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := 0
+	budget := len(c.entries)
+	elem := c.order.Back()
+	for elem != nil && budget > 0 {
+		for n := 0; elem != nil && n < cacheSweepChunk && budget > 0; n++ {
+			prev := elem.Prev()
+			if c.expired(elem, now) {
+				c.evict(elem, "expired")
+				dropped++
+			}
+			elem = prev
+			budget--
+		}
+		if elem == nil || budget == 0 {
+			break
+		}
+		cursor := elem.Value.(*cacheEntry[V]).key
+		c.mu.Unlock()
+		runtime.Gosched()
+		c.mu.Lock()
+		// The entry to go on from may have been evicted or replaced
+		// meanwhile; the walk then starts over from the cold end
+		if current, ok := c.entries[cursor]; !ok || current != elem {
+			elem = c.order.Back()
+		}
+	}
+	return dropped
+}
+
+// sweepCaches drops the expired entries of every in-memory cache. The
+// caches job runs it on every replica.
+func sweepCaches(ctx context.Context, now time.Time) error {
+	caches.Lock()
+	all := append([]expiringCache(nil), caches.all...)
+	caches.Unlock()
+	for _, c := range all {
+		c.dropExpired(now)
+	}
+	return nil
+}
+
+// insert adds a new entry, first evicting the least recently used one when
+// the cache is full. c.mu must be held.
+func (c *ttlCache[V]) insert(key string, value V, ttl time.Duration) {
+	now := time.Now()
+	for c.maxEntries > 0 && len(c.entries) >= c.maxEntries {
+		oldest := c.order.Back()
+		reason := "capacity"
+		if c.expired(oldest, now) {
+			reason = "expired"
+		}
+		c.evict(oldest, reason)
+	}
+	entry := &cacheEntry[V]{key: key, value: value}
+	if ttl > 0 {
+		entry.expiresAt = now.Add(ttl)
+	}
+	c.entries[key] = c.order.PushFront(entry)
+}
+
+func (c *ttlCache[V]) expired(elem *list.Element, now time.Time) bool {
+	expiresAt := elem.Value.(*cacheEntry[V]).expiresAt
+	return !expiresAt.IsZero() && !now.Before(expiresAt)
+}
+
+// evict removes an entry, counting it under reason unless reason is empty,
+// as when the entry is replaced or deleted. c.mu must be held.
+func (c *ttlCache[V]) evict(elem *list.Element, reason string) {
+	c.order.Remove(elem)
+	delete(c.entries, elem.Value.(*cacheEntry[V]).key)
+	if reason != "" {
+		cacheEvictionsTotal.WithLabelValues(c.name, reason).Inc()
+	}
+}
+
+// remoteError records a failed Redis call, after which the cache falls
+// back to its entries in memory
+func (c *ttlCache[V]) remoteError(op string, err error) {
+	cacheRequestsTotal.WithLabelValues(c.name, "error").Inc()
+	redisFallback(c.name, fmt.Errorf("%s: %w", op, err))
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestCache returns a cache that isn't registered as a metric, so each
+// test can have its own
+func newTestCache(maxEntries int) *ttlCache[int] {
+	return &ttlCache[int]{name: "test", maxEntries: maxEntries, entries: make(map[string]*list.Element), order: list.New()}
+}
+
+func TestTTLCacheAdd(t *testing.T) {
+	c := newTestCache(10)
+	if !c.add("k", 1, time.Minute) {
+		t.Fatal("first add: false, want true")
+	}
+	if c.add("k", 2, time.Minute) {
+		t.Error("second add: true, want false")
+	}
+	if v, ok := c.get("k"); !ok || v != 1 {
+		t.Errorf("get: %d, %v, want the first value", v, ok)
+	}
+}
+
+// TestTTLCacheDropExpired checks that the sweep drops expired entries the
+// cold-end eviction can't reach: those behind an entry a lookup moved to
+// the front, or one with a longer TTL
+func TestTTLCacheDropExpired(t *testing.T) {
+	cases := []struct {
+		name string
+		// fill adds the entries; those named short* expire
+		fill        func(c *ttlCache[int])
+		wantDropped int
+		wantKept    []string
+	}{
+		{"all expired", func(c *ttlCache[int]) {
+			c.set("short1", 1, time.Millisecond)
+			c.set("short2", 2, time.Millisecond)
+		}, 2, nil},
+		{"behind a longer TTL", func(c *ttlCache[int]) {
+			c.set("long", 1, time.Hour)
+			c.set("short1", 2, time.Millisecond)
+			c.set("short2", 3, time.Millisecond)
+			c.set("forever", 4, 0)
+		}, 2, []string{"long", "forever"}},
+		{"behind a recently used entry", func(c *ttlCache[int]) {
+			c.set("short1", 1, time.Millisecond)
+			c.set("live", 2, time.Hour)
+			c.set("short2", 3, time.Millisecond)
+			c.get("live")
+		}, 2, []string{"live"}},
+		{"over several chunks", func(c *ttlCache[int]) {
+			for i := 0; i < 2*cacheSweepChunk+10; i++ {
+				c.set(fmt.Sprintf("short%d", i), i, time.Millisecond)
+			}
+			c.set("live", 0, time.Hour)
+		}, 2*cacheSweepChunk + 10, []string{"live"}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			c := newTestCache(10 * cacheSweepChunk)
+			tc.fill(c)
+			if dropped := c.dropExpired(time.Now().Add(time.Second)); dropped != tc.wantDropped {
+				t.Errorf("dropped %d, want %d", dropped, tc.wantDropped)
+			}
+			if c.len() != len(tc.wantKept) {
+				t.Errorf("holding %d entries, want %d", c.len(), len(tc.wantKept))
+			}
+			for _, key := range tc.wantKept {
+				if _, ok := c.get(key); !ok {
+					t.Errorf("%s was dropped", key)
+				}
+			}
+		})
+	}
+}
+
+func TestTTLCacheCapacity(t *testing.T) {
+	c := newTestCache(2)
+	c.set("a", 1, 0)
+	c.set("b", 2, 0)
+	c.get("a")
+	c.set("c", 3, 0)
+	if _, ok := c.get("b"); ok {
+		t.Error("b, the least recently used entry, wasn't evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := c.get(key); !ok {
+			t.Errorf("%s was evicted", key)
+		}
+	}
+}
+
+// useRedisDown shares state through a Redis that refuses every connection
+// for the test
+func useRedisDown(t *testing.T) {
+	t.Helper()
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1", MaxRetries: -1})
+	previous := sharedRedis.Load()
+	t.Cleanup(func() { sharedRedis.Store(previous); client.Close() })
+	sharedRedis.Store(client)
+}
+
+// TestTTLCacheRedisDown checks that a shared cache answers from memory
+// while Redis fails
+func TestTTLCacheRedisDown(t *testing.T) {
+	useRedisDown(t)
+	c := newTestCache(10)
+	c.shared = true
+	c.set("k", 1, time.Minute)
+	if v, ok := c.get("k"); !ok || v != 1 {
+		t.Errorf("get: %d, %v, want the value set while Redis was down", v, ok)
+	}
+	c.delete("k")
+	if _, ok := c.get("k"); ok {
+		t.Error("get after delete: found")
+	}
+	if !c.add("a", 1, time.Minute) {
+		t.Error("first add: false, want true")
+	}
+	if c.add("a", 2, time.Minute) {
+		t.Error("second add: true, want false while Redis is down")
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// versionDegradation makes an instance running a known-bad version fail
+// and slow down on purpose, so canary analysis has a regression to catch.
+// The same BAD_VERSIONS can be set on stable and canary: only the
+// instances whose APP_VERSION is listed degrade.
+type versionDegradation struct {
+	badVersions []string
+	active      bool
+	// failureRate is the share of otherwise approved authorizations that
+	// are declined
+	failureRate  float64
+	extraLatency time.Duration
+}
+
+var degradation = loadVersionDegradation()
+
+// loadVersionDegradation reads BAD_VERSIONS, a comma separated list of
+// versions that degrade, and how badly: BAD_VERSION_FAILURE_RATE (default
+// 0.3) and BAD_VERSION_LATENCY_MS (default 400)
+func loadVersionDegradation() *versionDegradation {
+	d := &versionDegradation{}
+	for _, version := range strings.Split(getEnv("BAD_VERSIONS", ""), ",") {
+		if version = strings.TrimSpace(version); version != "" {
+			d.badVersions = append(d.badVersions, version)
+			d.active = d.active || version == getVersion()
+		}
+	}
+	rate, err := strconv.ParseFloat(getEnv("BAD_VERSION_FAILURE_RATE", "0.3"), 64)
+	if err != nil || rate < 0 || rate > 1 {
+		rate = 0.3
+	}
+	ms, err := strconv.Atoi(getEnv("BAD_VERSION_LATENCY_MS", "400"))
+	if err != nil || ms < 0 {
+		ms = 400
+	}
+	d.failureRate, d.extraLatency = rate, time.Duration(ms)*time.Millisecond
+	return d
+}
+
+func init() {
+	version := prometheus.Labels{"version": getVersion()}
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "voyager_version_degraded",
+			Help:        "1 while this instance's version is listed in BAD_VERSIONS and degrades on purpose",
+			ConstLabels: version,
+		},
+		func() float64 {
+			if degradation.active {
+				return 1
+			}
+			return 0
+		},
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "voyager_version_degradation_failure_rate",
+			Help:        "Share of authorizations a bad version declines on top of the configured failure rate; 0 unless degraded",
+			ConstLabels: version,
+		},
+		func() float64 { return degradation.effectiveFailureRate() },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name:        "voyager_version_degradation_latency_seconds",
+			Help:        "Latency a bad version adds to every processor call; 0 unless degraded",
+			ConstLabels: version,
+		},
+		func() float64 { return degradation.effectiveLatency().Seconds() },
+	))
+}
+
+func (d *versionDegradation) effectiveFailureRate() float64 {
+	if !d.active {
+		return 0
+	}
+	return d.failureRate
+}
+
+func (d *versionDegradation) effectiveLatency() time.Duration {
+	if !d.active {
+		return 0
+	}
+	return d.extraLatency
+}
+
+// apply returns the failure rate and latency of a processor call made by
+// a bad version; a good version's are returned unchanged
+func (d *versionDegradation) apply(failureRate float64, latency time.Duration) (float64, time.Duration) {
+	if !d.active {
+		return failureRate, latency
+	}
+	return failureRate + (1-failureRate)*d.failureRate, latency + d.extraLatency
+}
+
+// VersionDegradation is the synthetic degradation reported by /version
+type VersionDegradation struct {
+	Active         bool     `json:"active"`
+	BadVersions    []string `json:"bad_versions"`
+	FailureRate    float64  `json:"failure_rate"`
+	ExtraLatencyMs int64    `json:"extra_latency_ms"`
+}
+
+// VersionInfo is the body of GET /version
+type VersionInfo struct {
+	Version     string             `json:"version"`
+	Service     string             `json:"service"`
+	Degradation VersionDegradation `json:"degradation"`
+}
+
+// handleVersion returns the current version and whether it is one of
+// BAD_VERSIONS
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(VersionInfo{
+		Version: getVersion(),
+		Service: "voyager-gateway",
+		Degradation: VersionDegradation{
+			Active:         degradation.active,
+			BadVersions:    append([]string{}, degradation.badVersions...),
+			FailureRate:    degradation.failureRate,
+			ExtraLatencyMs: degradation.extraLatency.Milliseconds(),
+		},
+	})
+}
+
+// withVersionLabel labels a histogram with the running version, so canary
+// analysis can compare stable and canary
+func withVersionLabel(opts prometheus.HistogramOpts) prometheus.HistogramOpts {
+	opts.ConstLabels = prometheus.Labels{"version": getVersion()}
+	return opts
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Chaos experiment types
+const (
+	chaosProcessorOutage = "processor_outage"
+	chaosLatency         = "latency"
+	chaosErrorRate       = "error_rate"
+	chaosDropRequests    = "drop_requests"
+	chaosFXOutage        = "fx_outage"
+)
+
+// maxChaosTTL bounds how long a single experiment may run so a forgotten
+// experiment can't degrade an environment indefinitely
+const maxChaosTTL = 24 * time.Hour
+
+var chaosInjectionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_chaos_injections_total",
+		Help: "Total number of requests affected by chaos experiments by type",
+	},
+	[]string{"type"},
+)
+
+func init() {
+	prometheus.MustRegister(chaosInjectionsTotal)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "voyager_chaos_experiments_active",
+			Help: "Number of chaos experiments currently active",
+		},
+		func() float64 { return float64(len(chaos.active())) },
+	))
+}
+
+// ChaosExperiment is a fault injected at runtime until it expires
+type ChaosExperiment struct {
+	ID         string  `json:"id"`
+	Type       string  `json:"type"`
+	Processor  string  `json:"processor,omitempty"`
+	LatencyMs  int     `json:"latency_ms,omitempty"`
+	ErrorRate  float64 `json:"error_rate,omitempty"`
+	Percentage float64 `json:"percentage,omitempty"`
+	TTLSeconds int     `json:"ttl_seconds"`
+	Source     string  `json:"source,omitempty"`
+	CreatedAt  string  `json:"created_at"`
+	ExpiresAt  string  `json:"expires_at"`
+
+	expiresAt time.Time
+}
+
+// chaosEngine holds the active experiments
+type chaosEngine struct {
+	mu          sync.Mutex
+	experiments []*ChaosExperiment
+}
+
+var chaos = &chaosEngine{}
+
+// validate checks an experiment definition and fills in its timestamps
+func (e *ChaosExperiment) validate(now time.Time) []FieldViolation {
+	var violations []FieldViolation
+
+	if e.Processor != "" && !isKnownProcessor(e.Processor) {
+		violations = append(violations, FieldViolation{"processor", fmt.Sprintf("must be one of %s", strings.Join(processors.names(), ", "))})
+	}
+
+	switch e.Type {
+	case chaosProcessorOutage:
+		if e.Processor == "" {
+			violations = append(violations, FieldViolation{"processor", "is required for processor_outage"})
+		}
+	case chaosLatency:
+		if e.LatencyMs <= 0 {
+			violations = append(violations, FieldViolation{"latency_ms", "must be positive"})
+		}
+	case chaosErrorRate:
+		if e.ErrorRate < 0 || e.ErrorRate > 1 {
+			violations = append(violations, FieldViolation{"error_rate", "must be between 0 and 1"})
+		}
+	case chaosDropRequests:
+		if e.Percentage <= 0 || e.Percentage > 100 {
+			violations = append(violations, FieldViolation{"percentage", "must be between 0 (exclusive) and 100"})
+		}
+		if e.Processor != "" {
+			violations = append(violations, FieldViolation{"processor", "is not supported for drop_requests"})
+		}
+	case chaosFXOutage:
+		if e.Processor != "" {
+			violations = append(violations, FieldViolation{"processor", "is not supported for fx_outage"})
+		}
+	default:
+		violations = append(violations, FieldViolation{"type", "must be one of processor_outage, latency, error_rate, drop_requests, fx_outage"})
+	}
+
+	ttl := time.Duration(e.TTLSeconds) * time.Second
+	if ttl <= 0 || ttl > maxChaosTTL {
+		violations = append(violations, FieldViolation{"ttl_seconds", fmt.Sprintf("must be between 1 and %d", int(maxChaosTTL.Seconds()))})
+	}
+
+	e.expiresAt = now.Add(ttl)
+	e.CreatedAt = now.UTC().Format(time.RFC3339)
+	e.ExpiresAt = e.expiresAt.UTC().Format(time.RFC3339)
+	return violations
+}
+
+// isKnownProcessor reports whether name is a configured processor
+func isKnownProcessor(name string) bool {
+	_, ok := processors.get(name)
+	return ok
+}
+
+// add starts an experiment
+func (c *chaosEngine) add(e *ChaosExperiment) {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	e.ID = "chaos_" + hex.EncodeToString(b)
+
+	c.mu.Lock()
+	c.experiments = append(c.experiments, e)
+	c.mu.Unlock()
+
+	log.Printf("Chaos experiment %s started: type=%s processor=%s ttl=%ds", e.ID, e.Type, e.Processor, e.TTLSeconds)
+	emitEvent("", eventChaosStarted, *e)
+}
+
+// removeBySource stops every experiment started by source
+func (c *chaosEngine) removeBySource(source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	live := c.experiments[:0]
+	for _, e := range c.experiments {
+		if e.Source != source {
+			live = append(live, e)
+		} else {
+			emitEvent("", eventChaosStopped, *e)
+		}
+	}
+	c.experiments = live
+}
+
+// replace stops every experiment and starts experiments instead, keeping
+// their IDs
+func (c *chaosEngine) replace(experiments []*ChaosExperiment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, e := range c.experiments {
+		emitEvent("", eventChaosStopped, *e)
+	}
+	c.experiments = experiments
+	for _, e := range experiments {
+		log.Printf("Chaos experiment %s restored: type=%s processor=%s ttl=%ds", e.ID, e.Type, e.Processor, e.TTLSeconds)
+		emitEvent("", eventChaosStarted, *e)
+	}
+}
+
+// remove stops an experiment before it expires
+func (c *chaosEngine) remove(id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i, e := range c.experiments {
+		if e.ID == id {
+			c.experiments = append(c.experiments[:i], c.experiments[i+1:]...)
+			log.Printf("Chaos experiment %s stopped", id)
+			emitEvent("", eventChaosStopped, *e)
+			return true
+		}
+	}
+	return false
+}
+
+// active returns the experiments that have not expired, dropping the rest
+func (c *chaosEngine) active() []ChaosExperiment {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	live := c.experiments[:0]
+	result := make([]ChaosExperiment, 0, len(c.experiments))
+	for _, e := range c.experiments {
+		if now.Before(e.expiresAt) {
+			live = append(live, e)
+			result = append(result, *e)
+		} else {
+			log.Printf("Chaos experiment %s expired", e.ID)
+			emitEvent("", eventChaosExpired, *e)
+		}
+	}
+	c.experiments = live
+	return result
+}
+
+// chaosEffects is the combined effect of active experiments on one
+// processor call
+type chaosEffects struct {
+	outage       bool
+	extraLatency time.Duration
+	errorRate    float64
+	hasErrorRate bool
+	// maintenanceLatency is added by a maintenance window in latency mode
+	maintenanceLatency time.Duration
+}
+
+// effectsFor combines the experiments that target a processor. Experiments
+// without a processor apply to every processor.
+func (c *chaosEngine) effectsFor(processor string) chaosEffects {
+	var fx chaosEffects
+	for _, e := range c.active() {
+		if e.Processor != "" && e.Processor != processor {
+			continue
+		}
+		switch e.Type {
+		case chaosProcessorOutage:
+			fx.outage = true
+		case chaosLatency:
+			fx.extraLatency += time.Duration(e.LatencyMs) * time.Millisecond
+		case chaosErrorRate:
+			if !fx.hasErrorRate || e.ErrorRate > fx.errorRate {
+				fx.errorRate = e.ErrorRate
+			}
+			fx.hasErrorRate = true
+		}
+	}
+	return fx
+}
+
+// shouldDrop reports whether a drop_requests experiment claims this request
+func (c *chaosEngine) shouldDrop() bool {
+	var percentage float64
+	for _, e := range c.active() {
+		if e.Type == chaosDropRequests && e.Percentage > percentage {
+			percentage = e.Percentage
+		}
+	}
+	if percentage > 0 && rng.Float64()*100 < percentage {
+		chaosInjectionsTotal.WithLabelValues(chaosDropRequests).Inc()
+		return true
+	}
+	return false
+}
+
+// dropConnection simulates a dropped request by closing the connection
+// without writing a response
+func dropConnection(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if ok {
+		if conn, _, err := hijacker.Hijack(); err == nil {
+			conn.Close()
+			return
+		}
+	}
+	writeError(w, r, http.StatusServiceUnavailable, errCodeProcessorUnavailable, "Request dropped by chaos experiment", nil)
+}
+
+// handleChaosList lists active chaos experiments (GET /admin/chaos), those
+// of the tenant X-Tenant-ID names if any
+func handleChaosList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(tenantFromContext(r.Context()).chaosEngine().active())
+}
+
+// handleChaosStart starts a chaos experiment (POST /admin/chaos). With
+// X-Tenant-ID, it only affects that tenant's requests.
+func handleChaosStart(w http.ResponseWriter, r *http.Request) {
+	var e ChaosExperiment
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON chaos experiment"}})
+		return
+	}
+	e.Source = "admin_api"
+	if violations := e.validate(time.Now()); len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	tenantFromContext(r.Context()).chaosEngine().add(&e)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(e)
+}
+
+// handleChaosStop stops an experiment early (DELETE /admin/chaos/{id})
+func handleChaosStop(w http.ResponseWriter, r *http.Request) {
+	if !tenantFromContext(r.Context()).chaosEngine().remove(r.PathValue("id")) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Chaos experiment not found", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
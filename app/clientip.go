@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the peers whose X-Forwarded-For and X-Real-IP are
+// believed
+var trustedProxies []netip.Prefix
+
+// loadTrustedProxies reads TRUSTED_PROXIES, the comma separated CIDRs or
+// addresses of the load balancers and proxies in front of the gateway
+func loadTrustedProxies() error {
+	proxies, err := parsePrefixes("TRUSTED_PROXIES")
+	if err != nil {
+		return err
+	}
+	trustedProxies = proxies
+	return nil
+}
+
+// clientAddr returns the address a request came from. When the peer is a
+// trusted proxy it is the rightmost X-Forwarded-For entry that is not
+// itself a trusted proxy, since entries further left are set by the client
+// and can't be believed, or X-Real-IP when there is no X-Forwarded-For.
+// Otherwise it is the peer, whatever the headers say.
+func clientAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	if !containsAddr(trustedProxies, addr) {
+		return addr, true
+	}
+
+	var hops []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	if len(hops) == 0 {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			hops = []string{realIP}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		addr = hop.Unmap()
+		if !containsAddr(trustedProxies, addr) {
+			return addr, true
+		}
+	}
+	// Every hop is a trusted proxy, so the request started inside
+	return addr, true
+}
+
+// clientIP is clientAddr for logs, audit entries and rate limiting: the
+// address as text, or the raw peer address when it can't be parsed
+func clientIP(r *http.Request) string {
+	if addr, ok := clientAddr(r); ok {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Content codings the gateway can compress responses with, in order of
+// preference when a client accepts several equally
+const (
+	encodingZstd = "zstd"
+	encodingGzip = "gzip"
+)
+
+var (
+	compressedResponsesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_compressed_responses_total",
+			Help: "Total number of compressed responses by route and content coding",
+		},
+		[]string{"route", "encoding"},
+	)
+
+	compressionBytesSaved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_compression_bytes_saved_total",
+			Help: "Total bytes saved by compressing responses, uncompressed minus compressed size, by route and content coding",
+		},
+		[]string{"route", "encoding"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(compressedResponsesTotal)
+	prometheus.MustRegister(compressionBytesSaved)
+}
+
+var (
+	gzipWriters = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	zstdWriters = sync.Pool{New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+		return w
+	}}
+)
+
+// compressionSettings are the COMPRESSION and COMPRESSION_MIN_BYTES
+// settings
+type compressionSettings struct {
+	// encodings are the enabled content codings, most preferred first
+	encodings []string
+	// minBytes is the smallest response worth compressing
+	minBytes int
+}
+
+// getCompressionSettings reads the response compression settings:
+//
+//	COMPRESSION             enabled codings, "zstd,gzip" by default; "off" disables
+//	COMPRESSION_MIN_BYTES   smallest response compressed, default 1024
+func getCompressionSettings() compressionSettings {
+	s := compressionSettings{minBytes: 1024}
+	if n, err := strconv.Atoi(getEnv("COMPRESSION_MIN_BYTES", "1024")); err == nil && n >= 0 {
+		s.minBytes = n
+	}
+	for _, encoding := range strings.Split(getEnv("COMPRESSION", "zstd,gzip"), ",") {
+		switch encoding = strings.TrimSpace(strings.ToLower(encoding)); encoding {
+		case encodingZstd, encodingGzip:
+			s.encodings = append(s.encodings, encoding)
+		}
+	}
+	return s
+}
+
+// negotiateEncoding picks the coding to compress with from an
+// Accept-Encoding header: the enabled one with the highest q-value,
+// earlier enabled ones winning ties, or "" for none
+func negotiateEncoding(header string, enabled []string) string {
+	if header == "" {
+		return ""
+	}
+	accepted := map[string]float64{}
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+				q = parsed
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+	best, bestQ := "", 0.0
+	for _, encoding := range enabled {
+		q, ok := accepted[encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressible reports whether a content type is worth compressing: text,
+// JSON, CSV, XML and YAML. Images and archives are compressed already.
+func compressible(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	mediaType = strings.TrimSpace(strings.ToLower(mediaType))
+	return strings.HasPrefix(mediaType, "text/") ||
+		strings.Contains(mediaType, "json") ||
+		strings.Contains(mediaType, "xml") ||
+		strings.Contains(mediaType, "yaml")
+}
+
+// withCompression compresses responses of at least COMPRESSION_MIN_BYTES
+// with the best coding the client accepts. Smaller responses, ones that
+// aren't text and ones the handler encoded itself are sent as they are.
+func withCompression(pattern string) middleware {
+	settings := getCompressionSettings()
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		if len(settings.encodings) == 0 {
+			return next
+		}
+		return func(w http.ResponseWriter, r *http.Request) {
+			encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), settings.encodings)
+			if encoding == "" || r.Method == http.MethodHead {
+				next(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minBytes: settings.minBytes, pattern: pattern}
+			defer cw.close()
+			next(cw, r)
+		}
+	}
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// to compress it: once minBytes have been written, or the handler flushes
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minBytes int
+	pattern  string
+
+	// status is the status the handler wrote, held back with buf
+	status int
+	buf    []byte
+	// decided is set once the response is either compressing or passing
+	// through; enc is non-nil when compressing
+	decided bool
+	enc     io.WriteCloser
+	// in and out count bytes before and after compression
+	in  int64
+	out countingWriter
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided {
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if w.status != 0 {
+		return
+	}
+	w.status = status
+	// Informational, empty and already encoded responses pass through
+	if status < 200 || status == http.StatusNoContent || status == http.StatusNotModified ||
+		w.Header().Get("Content-Encoding") != "" {
+		w.passThrough()
+	}
+}
+
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if w.decided {
+		if w.enc == nil {
+			return w.ResponseWriter.Write(b)
+		}
+		w.in += int64(len(b))
+		return w.enc.Write(b)
+	}
+	w.buf = append(w.buf, b...)
+	if len(w.buf) >= w.minBytes {
+		if err := w.decide(); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// decide starts compressing if the content type allows, else passes the
+// held back response through
+func (w *compressWriter) decide() error {
+	h := w.Header()
+	if h.Get("Content-Type") == "" {
+		h.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+	if h.Get("Content-Encoding") != "" || !compressible(h.Get("Content-Type")) {
+		return w.passThrough()
+	}
+	h.Add("Vary", "Accept-Encoding")
+	h.Set("Content-Encoding", w.encoding)
+	h.Del("Content-Length")
+	w.decided = true
+	w.out.w = w.ResponseWriter
+	if w.encoding == encodingZstd {
+		enc := zstdWriters.Get().(*zstd.Encoder)
+		enc.Reset(&w.out)
+		w.enc = enc
+	} else {
+		enc := gzipWriters.Get().(*gzip.Writer)
+		enc.Reset(&w.out)
+		w.enc = enc
+	}
+	w.writeStatus()
+	buf := w.buf
+	w.buf = nil
+	w.in += int64(len(buf))
+	_, err := w.enc.Write(buf)
+	return err
+}
+
+// passThrough sends the held back status and body uncompressed
+func (w *compressWriter) passThrough() error {
+	w.decided = true
+	w.writeStatus()
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	_, err := w.ResponseWriter.Write(buf)
+	return err
+}
+
+func (w *compressWriter) writeStatus() {
+	if w.status != 0 {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+// Flush compresses whatever has been written so far, so streamed
+// responses reach the client as they are produced
+func (w *compressWriter) Flush() {
+	if !w.decided && (w.status != 0 || len(w.buf) > 0) {
+		_ = w.decide()
+	}
+	if flusher, ok := w.enc.(interface{ Flush() error }); ok {
+		_ = flusher.Flush()
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// close finishes the response: a short one goes out uncompressed, a
+// compressed one gets its trailer and is counted
+func (w *compressWriter) close() {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			return
+		}
+		_ = w.passThrough()
+		return
+	}
+	if w.enc == nil {
+		return
+	}
+	_ = w.enc.Close()
+	switch enc := w.enc.(type) {
+	case *zstd.Encoder:
+		enc.Reset(nil)
+		zstdWriters.Put(enc)
+	case *gzip.Writer:
+		enc.Reset(nil)
+		gzipWriters.Put(enc)
+	}
+	compressedResponsesTotal.WithLabelValues(w.pattern, w.encoding).Inc()
+	compressionBytesSaved.WithLabelValues(w.pattern, w.encoding).Add(float64(max(w.in-w.out.n, 0)))
+}
@@ -0,0 +1,818 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+var configReloadsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_config_reloads_total",
+		Help: "Total number of configuration file loads by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(configReloadsTotal)
+}
+
+// RuntimeConfig is the simulation configuration read from CONFIG_FILE. Any
+// setting it leaves out falls back to the environment. For example:
+//
+//	failure_rate: 0.05
+//	base_latency_ms: 40
+//	processors:
+//	  stripe:
+//	    weight: 3
+//	    latency: lognormal:120:60
+//	  adyen:
+//	    weight: 1
+//	    failure_rate: 0.2
+//	rate_limits:
+//	  rps: 100
+//	  merchants:
+//	    merchant_big: {rps: 1000, burst: 2000}
+//	merchants:
+//	  merchant_big: {name: Big Shop}
+type RuntimeConfig struct {
+	FailureRate   *float64                   `yaml:"failure_rate" json:"failure_rate,omitempty"`
+	BaseLatencyMs *int                       `yaml:"base_latency_ms" json:"base_latency_ms,omitempty"`
+	Processors    map[string]ProcessorConfig `yaml:"processors" json:"processors,omitempty"`
+	RateLimits    *RateLimitConfig           `yaml:"rate_limits" json:"rate_limits,omitempty"`
+	// Merchants, when not empty, is the registry of merchants allowed to
+	// authorize; any other merchant_id fails validation
+	Merchants map[string]MerchantConfig `yaml:"merchants" json:"merchants,omitempty"`
+	// DeclineReasons replaces the default decline taxonomy
+	DeclineReasons []DeclineReasonConfig `yaml:"decline_reasons" json:"decline_reasons,omitempty"`
+	// AmountRules apply to every processor, after each processor's own
+	AmountRules []AmountRule `yaml:"amount_rules" json:"amount_rules,omitempty"`
+	// Fraud configures the velocity checks, off when unset
+	Fraud *FraudConfig `yaml:"fraud" json:"fraud,omitempty"`
+	// Risk configures the risk engine, off when unset
+	Risk *RiskConfig `yaml:"risk" json:"risk,omitempty"`
+	// Routing picks how processors are chosen, weighted when unset
+	Routing *RoutingConfig `yaml:"routing" json:"routing,omitempty"`
+	// Dunning schedules the retries of failed subscription cycles, every
+	// 1d, 3d and 7d when unset
+	Dunning *DunningConfig `yaml:"dunning" json:"dunning,omitempty"`
+	// Reserve sets when merchants' captured funds can be paid out,
+	// right away when unset
+	Reserve *ReserveConfig `yaml:"reserve" json:"reserve,omitempty"`
+	// Flags override FEATURE_FLAGS by name; see GET /admin/flags
+	Flags map[string]FeatureFlag `yaml:"flags" json:"flags,omitempty"`
+	// TokenUplifts override defaultTokenUplifts by token type
+	TokenUplifts map[string]float64 `yaml:"token_uplifts" json:"token_uplifts,omitempty"`
+	// CardVerification weighs the simulated AVS and CVV results
+	CardVerification *CardVerificationConfig `yaml:"card_verification" json:"card_verification,omitempty"`
+
+	// latencies are the parsed Processors[].Latency specs
+	latencies map[string]latencyDistribution
+}
+
+// ProcessorConfig tunes one simulated processor
+type ProcessorConfig struct {
+	// Weight is the processor's share of routing relative to the others'.
+	// Processors without a weight count as 1; 0 takes one out of rotation.
+	Weight      *float64 `yaml:"weight" json:"weight,omitempty"`
+	FailureRate *float64 `yaml:"failure_rate" json:"failure_rate,omitempty"`
+	// Latency is kind[:mean[:param]], as in LATENCY_DISTRIBUTIONS
+	Latency string `yaml:"latency" json:"latency,omitempty"`
+	// AmountRules force outcomes for amounts routed to this processor
+	AmountRules []AmountRule `yaml:"amount_rules" json:"amount_rules,omitempty"`
+	// ExcludeBrands are card brands never routed to this processor
+	ExcludeBrands []string `yaml:"exclude_brands" json:"exclude_brands,omitempty"`
+	// Fees replace the processor's default fee schedule; see
+	// defaultProcessorFees
+	Fees *ProcessorFees `yaml:"fees" json:"fees,omitempty"`
+	// Maintenance schedules downtime windows; see MaintenanceWindow
+	Maintenance []MaintenanceWindow `yaml:"maintenance" json:"maintenance,omitempty"`
+	// MultiCapture lets the processor's authorizations be captured in
+	// several parts, as for split shipments. Without it, the first capture
+	// is final.
+	MultiCapture *bool `yaml:"multi_capture" json:"multi_capture,omitempty"`
+	// IncrementalAuthorization lets open authorizations be raised through
+	// POST /authorize/{id}/increment, as hotels and taxis do
+	IncrementalAuthorization *bool `yaml:"incremental_authorization" json:"incremental_authorization,omitempty"`
+	// NetworkTokens says whether the processor takes network tokens,
+	// overriding defaultNetworkTokenSupport
+	NetworkTokens *bool `yaml:"network_tokens" json:"network_tokens,omitempty"`
+}
+
+// RateLimitConfig replaces RATE_LIMIT_RPS, RATE_LIMIT_BURST and RATE_LIMITS
+type RateLimitConfig struct {
+	RPS       float64              `yaml:"rps" json:"rps"`
+	Burst     int                  `yaml:"burst" json:"burst,omitempty"`
+	Merchants map[string]rateLimit `yaml:"merchants" json:"merchants,omitempty"`
+}
+
+// MerchantConfig is one entry of the merchant registry: the merchant's
+// profile, enforced on every authorization it makes
+type MerchantConfig struct {
+	Name string `yaml:"name" json:"name,omitempty"`
+	// Disabled merchants are refused with 403 merchant_disabled
+	Disabled bool `yaml:"disabled" json:"disabled,omitempty"`
+	// Currencies the merchant may authorize in; any when empty
+	Currencies []string `yaml:"currencies" json:"currencies,omitempty"`
+	// MaxAmount caps a single authorization
+	MaxAmount *float64 `yaml:"max_amount" json:"max_amount,omitempty"`
+	// Processors the merchant may be routed to; any when empty
+	Processors []string `yaml:"processors" json:"processors,omitempty"`
+	// FailureRate overrides the global and per-processor failure rates
+	FailureRate *float64 `yaml:"failure_rate" json:"failure_rate,omitempty"`
+	// RateLimit overrides the merchant's entry in rate_limits
+	RateLimit *rateLimit `yaml:"rate_limit" json:"rate_limit,omitempty"`
+	// WebhookURL receives the merchant's webhooks unless one is registered
+	// through POST /webhooks
+	WebhookURL string `yaml:"webhook_url" json:"webhook_url,omitempty"`
+	// Reserve overrides the reserve section for the merchant
+	Reserve *ReserveConfig `yaml:"reserve" json:"reserve,omitempty"`
+	// DeclineOnAVSMismatch declines authorizations whose billing_zip the
+	// issuer didn't match, with avs_mismatch
+	DeclineOnAVSMismatch bool `yaml:"decline_on_avs_mismatch" json:"decline_on_avs_mismatch,omitempty"`
+}
+
+// runtimeConfig is empty until a config file is loaded
+var runtimeConfig atomic.Pointer[RuntimeConfig]
+
+func init() {
+	runtimeConfig.Store(&RuntimeConfig{})
+}
+
+// currentConfig returns the configuration in effect
+func currentConfig() *RuntimeConfig {
+	return runtimeConfig.Load()
+}
+
+// parseRuntimeConfig decodes YAML or JSON and validates it. Unknown keys are
+// rejected so typos don't silently fall back to defaults.
+func parseRuntimeConfig(data []byte) (*RuntimeConfig, []FieldViolation) {
+	var cfg RuntimeConfig
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, []FieldViolation{{"config", fmt.Sprintf("must be valid YAML or JSON: %v", err)}}
+	}
+	normalizeVerificationCodes(cfg.Risk)
+	if violations := cfg.validate(); len(violations) > 0 {
+		return nil, violations
+	}
+	return &cfg, nil
+}
+
+// validate checks every setting and parses the latency specs
+func (c *RuntimeConfig) validate() []FieldViolation {
+	var violations []FieldViolation
+	if c.FailureRate != nil && (*c.FailureRate < 0 || *c.FailureRate > 1) {
+		violations = append(violations, FieldViolation{"failure_rate", "must be between 0 and 1"})
+	}
+	if c.BaseLatencyMs != nil && *c.BaseLatencyMs < 0 {
+		violations = append(violations, FieldViolation{"base_latency_ms", "must not be negative"})
+	}
+
+	c.latencies = map[string]latencyDistribution{}
+	for _, name := range sortedKeys(c.Processors) {
+		p := c.Processors[name]
+		field := "processors." + name
+		if !isKnownProcessor(name) {
+			violations = append(violations, FieldViolation{field, "is not a known processor"})
+			continue
+		}
+		if p.Weight != nil && *p.Weight < 0 {
+			violations = append(violations, FieldViolation{field + ".weight", "must not be negative"})
+		}
+		if p.FailureRate != nil && (*p.FailureRate < 0 || *p.FailureRate > 1) {
+			violations = append(violations, FieldViolation{field + ".failure_rate", "must be between 0 and 1"})
+		}
+		if p.Latency != "" {
+			dist, err := parseLatencySpec(p.Latency)
+			if err != nil {
+				violations = append(violations, FieldViolation{field + ".latency", err.Error()})
+				continue
+			}
+			c.latencies[name] = dist
+		}
+		violations = append(violations, validateAmountRules(field+".amount_rules", p.AmountRules)...)
+		violations = append(violations, validateExcludeBrands(field+".exclude_brands", p.ExcludeBrands)...)
+		violations = append(violations, validateFees(field+".fees", p.Fees)...)
+		violations = append(violations, validateMaintenance(field+".maintenance", p.Maintenance)...)
+		if p.MultiCapture != nil && *p.MultiCapture {
+			if proc, _ := processors.get(name); isStripeAPI(proc) {
+				violations = append(violations, FieldViolation{field + ".multi_capture", "is not supported by the Stripe API processor"})
+			}
+		}
+		if p.IncrementalAuthorization != nil && *p.IncrementalAuthorization {
+			if proc, ok := processors.get(name); ok {
+				if _, ok := proc.(incrementalAuthorizer); !ok {
+					violations = append(violations, FieldViolation{field + ".incremental_authorization", "is not supported by this processor"})
+				}
+			}
+		}
+	}
+	if c.weighted() {
+		routable := false
+		for _, name := range processors.names() {
+			routable = routable || c.processorWeight(name) > 0
+		}
+		if !routable {
+			violations = append(violations, FieldViolation{"processors", "at least one processor needs a positive weight"})
+		}
+	}
+
+	if rl := c.RateLimits; rl != nil {
+		if rl.RPS < 0 {
+			violations = append(violations, FieldViolation{"rate_limits.rps", "must not be negative"})
+		}
+		if rl.Burst < 0 {
+			violations = append(violations, FieldViolation{"rate_limits.burst", "must not be negative"})
+		}
+		for _, merchantID := range sortedKeys(rl.Merchants) {
+			limit := rl.Merchants[merchantID]
+			field := "rate_limits.merchants." + merchantID
+			if limit.RPS <= 0 {
+				violations = append(violations, FieldViolation{field + ".rps", "must be a positive number"})
+			}
+			if limit.Burst < 0 {
+				violations = append(violations, FieldViolation{field + ".burst", "must not be negative"})
+			}
+		}
+	}
+
+	for _, merchantID := range sortedKeys(c.Merchants) {
+		field := "merchants." + merchantID
+		if !merchantIDPattern.MatchString(merchantID) {
+			violations = append(violations, FieldViolation{field, "must be 1-64 characters of letters, digits, '_' or '-'"})
+			continue
+		}
+		violations = append(violations, c.validateMerchant(field+".", c.Merchants[merchantID])...)
+	}
+	violations = append(violations, validateDeclineReasons(c.DeclineReasons)...)
+	violations = append(violations, validateAmountRules("amount_rules", c.AmountRules)...)
+	violations = append(violations, validateFraud(c.Fraud)...)
+	violations = append(violations, validateRisk(c.Risk)...)
+	violations = append(violations, validateRouting(c.Routing)...)
+	violations = append(violations, validateDunning(c.Dunning)...)
+	violations = append(violations, validateReserve("reserve.", c.Reserve)...)
+	violations = append(violations, validateFlags(c.Flags)...)
+	violations = append(violations, validateTokenUplifts(c.TokenUplifts)...)
+	violations = append(violations, validateCardVerification(c.CardVerification)...)
+	return violations
+}
+
+// validateMerchant checks one merchant profile, prefixing violated fields
+// with prefix. Currencies are normalized to upper case.
+func (c *RuntimeConfig) validateMerchant(prefix string, m MerchantConfig) []FieldViolation {
+	var violations []FieldViolation
+	for i, currency := range m.Currencies {
+		m.Currencies[i] = strings.ToUpper(currency)
+		if !iso4217Currencies[m.Currencies[i]] {
+			violations = append(violations, FieldViolation{prefix + "currencies", fmt.Sprintf("%q is not a valid ISO 4217 currency code", currency)})
+		}
+	}
+	if m.MaxAmount != nil && !(*m.MaxAmount > 0) {
+		violations = append(violations, FieldViolation{prefix + "max_amount", "must be a positive number"})
+	}
+	known, routable := false, false
+	for _, name := range m.Processors {
+		if !isKnownProcessor(name) {
+			violations = append(violations, FieldViolation{prefix + "processors", fmt.Sprintf("%q is not a known processor", name)})
+			continue
+		}
+		known = true
+		routable = routable || c.processorWeight(name) > 0
+	}
+	if known && !routable {
+		violations = append(violations, FieldViolation{prefix + "processors", "at least one allowed processor needs a positive weight"})
+	}
+	if m.FailureRate != nil && (*m.FailureRate < 0 || *m.FailureRate > 1) {
+		violations = append(violations, FieldViolation{prefix + "failure_rate", "must be between 0 and 1"})
+	}
+	if m.RateLimit != nil {
+		if m.RateLimit.RPS <= 0 {
+			violations = append(violations, FieldViolation{prefix + "rate_limit.rps", "must be a positive number"})
+		}
+		if m.RateLimit.Burst < 0 {
+			violations = append(violations, FieldViolation{prefix + "rate_limit.burst", "must not be negative"})
+		}
+	}
+	if m.WebhookURL != "" {
+		if err := validateWebhookURL(m.WebhookURL); err != nil {
+			violations = append(violations, FieldViolation{prefix + "webhook_url", err.Error()})
+		}
+	}
+	violations = append(violations, validateReserve(prefix+"reserve.", m.Reserve)...)
+	return violations
+}
+
+// sortedKeys returns a map's keys in order so validation errors are stable
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// processorWeight returns a processor's routing weight, 1 unless configured
+func (c *RuntimeConfig) processorWeight(name string) float64 {
+	if p, ok := c.Processors[name]; ok && p.Weight != nil {
+		return *p.Weight
+	}
+	return 1
+}
+
+// weighted reports whether any routing weight is configured
+func (c *RuntimeConfig) weighted() bool {
+	for _, p := range c.Processors {
+		if p.Weight != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// multiCapture reports whether the processor takes several captures per
+// authorization
+func (c *RuntimeConfig) multiCapture(name string) bool {
+	p, ok := c.Processors[name]
+	return ok && p.MultiCapture != nil && *p.MultiCapture
+}
+
+// incrementalAuthorization reports whether the processor's open
+// authorizations can be raised
+func (c *RuntimeConfig) incrementalAuthorization(name string) bool {
+	p, ok := c.Processors[name]
+	return ok && p.IncrementalAuthorization != nil && *p.IncrementalAuthorization
+}
+
+// isRegisteredMerchant reports whether merchantID may authorize; every
+// merchant may when the registry is empty
+func (c *RuntimeConfig) isRegisteredMerchant(merchantID string) bool {
+	if len(c.Merchants) == 0 {
+		return true
+	}
+	_, ok := c.Merchants[merchantID]
+	return ok
+}
+
+// merchantProfile returns the registry entry for merchantID
+func (c *RuntimeConfig) merchantProfile(merchantID string) (MerchantConfig, bool) {
+	m, ok := c.Merchants[merchantID]
+	return m, ok
+}
+
+// allowsProcessor reports whether the merchant may be routed to name
+func (m MerchantConfig) allowsProcessor(name string) bool {
+	return len(m.Processors) == 0 || slices.Contains(m.Processors, name)
+}
+
+// merchantRateLimits returns the rate limits set in merchant profiles
+func (c *RuntimeConfig) merchantRateLimits() map[string]rateLimit {
+	limits := make(map[string]rateLimit)
+	for merchantID, m := range c.Merchants {
+		if m.RateLimit != nil {
+			limits[merchantID] = *m.RateLimit
+		}
+	}
+	return limits
+}
+
+// sameRateLimits reports whether two configs describe the same limiter
+func (c *RuntimeConfig) sameRateLimits(other *RuntimeConfig) bool {
+	return reflect.DeepEqual(c.RateLimits, other.RateLimits) &&
+		reflect.DeepEqual(c.merchantRateLimits(), other.merchantRateLimits())
+}
+
+// rateLimiter builds the limiter the config describes, or returns false to
+// keep the one from the environment. Merchant profile limits are layered
+// over rate_limits, or over the environment's limits when it is unset.
+func (c *RuntimeConfig) rateLimiter() (*rateLimiter, bool) {
+	profileLimits := c.merchantRateLimits()
+	rl := c.RateLimits
+	if rl == nil && len(profileLimits) == 0 {
+		return nil, false
+	}
+
+	var defaultLimit rateLimit
+	overrides := make(map[string]rateLimit)
+	if rl != nil {
+		defaultLimit = rateLimit{RPS: rl.RPS, Burst: rl.Burst}
+		for merchantID, limit := range rl.Merchants {
+			overrides[merchantID] = limit
+		}
+	} else if envRateLimiter != nil {
+		defaultLimit = envRateLimiter.defaultLimit
+		for merchantID, limit := range envRateLimiter.overrides {
+			overrides[merchantID] = limit
+		}
+	}
+	for merchantID, limit := range profileLimits {
+		overrides[merchantID] = limit
+	}
+
+	if defaultLimit.Burst == 0 {
+		defaultLimit.Burst = defaultBurst(defaultLimit.RPS)
+	}
+	for merchantID, limit := range overrides {
+		if limit.Burst == 0 {
+			limit.Burst = defaultBurst(limit.RPS)
+			overrides[merchantID] = limit
+		}
+	}
+	return newRateLimiter(defaultLimit, overrides), true
+}
+
+// ConfigStatus reports the last attempt to load CONFIG_FILE
+type ConfigStatus struct {
+	Path          string           `json:"path,omitempty"`
+	Loaded        bool             `json:"loaded"`
+	Checksum      string           `json:"checksum,omitempty"`
+	LoadedAt      string           `json:"loaded_at,omitempty"`
+	LastAttemptAt string           `json:"last_attempt_at,omitempty"`
+	LastError     string           `json:"last_error,omitempty"`
+	Errors        []FieldViolation `json:"errors,omitempty"`
+	Reloads       int              `json:"reloads"`
+	Config        *RuntimeConfig   `json:"config"`
+}
+
+// configWatcher loads CONFIG_FILE and reloads it on SIGHUP or when its
+// content changes. A file that fails validation is reported and ignored;
+// the previous configuration stays in effect.
+type configWatcher struct {
+	mu     sync.Mutex
+	path   string
+	status ConfigStatus
+	// rejected is the checksum of the last invalid content, so polling
+	// doesn't report the same error every interval
+	rejected string
+}
+
+var configFile = &configWatcher{}
+
+// loadConfigFile loads CONFIG_FILE, if set, and starts watching it
+func loadConfigFile() error {
+	path := os.Getenv("CONFIG_FILE")
+	if path == "" {
+		return nil
+	}
+	configFile.path = path
+	configFile.status.Path = path
+	if err := configFile.reload(); err != nil {
+		return err
+	}
+	go configFile.watch(getConfigPollInterval())
+	return nil
+}
+
+// getConfigPollInterval returns how often CONFIG_FILE is checked for changes
+func getConfigPollInterval() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("CONFIG_POLL_INTERVAL_SECONDS", "5"))
+	if err != nil || seconds <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// reload reads and applies the file unless its content is unchanged
+func (c *configWatcher) reload() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.status.LastAttemptAt = time.Now().UTC().Format(time.RFC3339)
+
+	data, err := os.ReadFile(c.path)
+	if err != nil {
+		configReloadsTotal.WithLabelValues("error").Inc()
+		c.status.LastError = err.Error()
+		c.status.Errors = nil
+		return fmt.Errorf("reading CONFIG_FILE: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	checksum := hex.EncodeToString(sum[:])
+	if (c.status.Loaded && checksum == c.status.Checksum) || checksum == c.rejected {
+		return nil
+	}
+
+	cfg, violations := parseRuntimeConfig(data)
+	if len(violations) == 0 {
+		violations = configLayers.setFile(cfg)
+	}
+	if len(violations) > 0 {
+		configReloadsTotal.WithLabelValues("invalid").Inc()
+		c.rejected = checksum
+		c.status.LastError = fmt.Sprintf("invalid config in %s", c.path)
+		c.status.Errors = violations
+		return fmt.Errorf("invalid config in %s: %s %s", c.path, violations[0].Field, violations[0].Message)
+	}
+
+	if c.status.Loaded {
+		c.status.Reloads++
+	}
+	c.status.Loaded = true
+	c.status.Checksum = checksum
+	c.status.LoadedAt = c.status.LastAttemptAt
+	c.status.LastError = ""
+	c.status.Errors = nil
+	configReloadsTotal.WithLabelValues("success").Inc()
+	log.Printf("Loaded config from %s (sha256 %s)", c.path, checksum[:12])
+	return nil
+}
+
+// watch reloads on SIGHUP and whenever a poll sees the content change.
+// Polling rather than inotify also catches Kubernetes ConfigMap updates,
+// which swap a symlink instead of writing the file.
+func (c *configWatcher) watch(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading %s", c.path)
+		case <-ticker.C:
+		}
+		if err := c.reload(); err != nil {
+			log.Printf("Config reload failed, keeping previous config: %v", err)
+		}
+	}
+}
+
+// layeredConfig is merged into the config in effect: the file first, then
+// the overrides set through PUT /admin/config, which survive file reloads
+type layeredConfig struct {
+	mu    sync.Mutex
+	file  *RuntimeConfig
+	admin *RuntimeConfig
+	// onboarded are the merchants created through /admin/merchants, which
+	// override same-named entries of both layers
+	onboarded map[string]MerchantConfig
+}
+
+var configLayers = &layeredConfig{file: &RuntimeConfig{}, admin: &RuntimeConfig{}}
+
+func (l *layeredConfig) setFile(cfg *RuntimeConfig) []FieldViolation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.apply(cfg, l.admin)
+}
+
+// updateAdmin replaces the admin overrides with what update makes of a copy
+// of them. The lock is held from read to write, so concurrent changes to
+// different settings don't undo each other. It returns the overrides now
+// in effect.
+func (l *layeredConfig) updateAdmin(update func(overrides *RuntimeConfig)) (*RuntimeConfig, []FieldViolation) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	overrides := *l.admin
+	update(&overrides)
+	if violations := l.apply(l.file, &overrides); len(violations) > 0 {
+		return nil, violations
+	}
+	return &overrides, nil
+}
+
+func (l *layeredConfig) setOnboarded(merchants map[string]MerchantConfig) []FieldViolation {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	previous := l.onboarded
+	l.onboarded = merchants
+	violations := l.apply(l.file, l.admin)
+	if len(violations) > 0 {
+		l.onboarded = previous
+	}
+	return violations
+}
+
+func (l *layeredConfig) adminOverrides() *RuntimeConfig {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.admin
+}
+
+func (l *layeredConfig) fileAndAdmin() (file, admin *RuntimeConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file, l.admin
+}
+
+// apply merges the layers and, if the result is valid, puts it in effect
+func (l *layeredConfig) apply(file, admin *RuntimeConfig) []FieldViolation {
+	merged := mergeConfig(file, admin)
+	if len(l.onboarded) > 0 {
+		merchants := make(map[string]MerchantConfig, len(merged.Merchants)+len(l.onboarded))
+		for id, m := range merged.Merchants {
+			merchants[id] = m
+		}
+		for id, m := range l.onboarded {
+			merchants[id] = m
+		}
+		merged.Merchants = merchants
+	}
+	if violations := merged.validate(); len(violations) > 0 {
+		return violations
+	}
+	l.file, l.admin = file, admin
+
+	previous := runtimeConfig.Swap(merged)
+	// Rebuilding the limiter resets every bucket, so only do it when the
+	// limits changed
+	if !merged.sameRateLimits(previous) {
+		if limiter, ok := merged.rateLimiter(); ok {
+			setRateLimiter(limiter)
+		} else {
+			setRateLimiter(envRateLimiter)
+		}
+	}
+	return nil
+}
+
+// mergeConfig overlays over on base. Set fields of over win; processors
+// are merged field by field and flags by name, rate limits and merchants
+// replaced whole.
+func mergeConfig(base, over *RuntimeConfig) *RuntimeConfig {
+	merged := *base
+	if over.FailureRate != nil {
+		merged.FailureRate = over.FailureRate
+	}
+	if over.BaseLatencyMs != nil {
+		merged.BaseLatencyMs = over.BaseLatencyMs
+	}
+	if over.RateLimits != nil {
+		merged.RateLimits = over.RateLimits
+	}
+	if over.Merchants != nil {
+		merged.Merchants = over.Merchants
+	}
+	if over.DeclineReasons != nil {
+		merged.DeclineReasons = over.DeclineReasons
+	}
+	if over.AmountRules != nil {
+		merged.AmountRules = over.AmountRules
+	}
+	if over.Fraud != nil {
+		merged.Fraud = over.Fraud
+	}
+	if over.Risk != nil {
+		merged.Risk = over.Risk
+	}
+	if over.Routing != nil {
+		merged.Routing = over.Routing
+	}
+	if over.Dunning != nil {
+		merged.Dunning = over.Dunning
+	}
+	if over.Reserve != nil {
+		merged.Reserve = over.Reserve
+	}
+	if over.CardVerification != nil {
+		merged.CardVerification = over.CardVerification
+	}
+	if len(over.Flags) > 0 {
+		merged.Flags = make(map[string]FeatureFlag, len(base.Flags)+len(over.Flags))
+		for name, f := range base.Flags {
+			merged.Flags[name] = f
+		}
+		for name, f := range over.Flags {
+			merged.Flags[name] = f
+		}
+	}
+	if len(over.TokenUplifts) > 0 {
+		merged.TokenUplifts = make(map[string]float64, len(base.TokenUplifts)+len(over.TokenUplifts))
+		for tokenType, u := range base.TokenUplifts {
+			merged.TokenUplifts[tokenType] = u
+		}
+		for tokenType, u := range over.TokenUplifts {
+			merged.TokenUplifts[tokenType] = u
+		}
+	}
+	if len(over.Processors) > 0 {
+		merged.Processors = make(map[string]ProcessorConfig, len(base.Processors)+len(over.Processors))
+		for name, p := range base.Processors {
+			merged.Processors[name] = p
+		}
+		for name, o := range over.Processors {
+			p := merged.Processors[name]
+			if o.Weight != nil {
+				p.Weight = o.Weight
+			}
+			if o.FailureRate != nil {
+				p.FailureRate = o.FailureRate
+			}
+			if o.Latency != "" {
+				p.Latency = o.Latency
+			}
+			if o.AmountRules != nil {
+				p.AmountRules = o.AmountRules
+			}
+			if o.ExcludeBrands != nil {
+				p.ExcludeBrands = o.ExcludeBrands
+			}
+			if o.Fees != nil {
+				p.Fees = o.Fees
+			}
+			if o.Maintenance != nil {
+				p.Maintenance = o.Maintenance
+			}
+			if o.MultiCapture != nil {
+				p.MultiCapture = o.MultiCapture
+			}
+			if o.IncrementalAuthorization != nil {
+				p.IncrementalAuthorization = o.IncrementalAuthorization
+			}
+			if o.NetworkTokens != nil {
+				p.NetworkTokens = o.NetworkTokens
+			}
+			merged.Processors[name] = p
+		}
+	}
+	return &merged
+}
+
+// AdminConfig is the body of GET and PUT /admin/config
+type AdminConfig struct {
+	// Overrides are the settings changed through the admin API
+	Overrides *RuntimeConfig `json:"overrides"`
+	// Effective is the config in effect after merging file and overrides
+	Effective *RuntimeConfig `json:"effective"`
+}
+
+func writeAdminConfig(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(AdminConfig{Overrides: configLayers.adminOverrides(), Effective: currentConfig()})
+}
+
+// handleAdminConfigGet shows the admin overrides and the config in effect
+// (GET /admin/config)
+func handleAdminConfigGet(w http.ResponseWriter, r *http.Request) {
+	writeAdminConfig(w)
+}
+
+// handleAdminConfigPut replaces the admin overrides with the body, a JSON
+// object in the config file's format (PUT /admin/config). Only the settings
+// it names override the file and environment.
+func handleAdminConfigPut(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "could not be read"}})
+		return
+	}
+	cfg, violations := parseRuntimeConfig(data)
+	if len(violations) == 0 {
+		_, violations = configLayers.updateAdmin(func(overrides *RuntimeConfig) { *overrides = *cfg })
+	}
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	log.Printf("Runtime config overrides updated via admin API")
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditConfigUpdated, ResourceType: "config", ResourceID: "admin_overrides"})
+	emitEvent("", eventConfigUpdated, cfg)
+	writeAdminConfig(w)
+}
+
+// handleAdminConfigDelete drops the admin overrides (DELETE /admin/config)
+func handleAdminConfigDelete(w http.ResponseWriter, r *http.Request) {
+	if _, violations := configLayers.updateAdmin(func(overrides *RuntimeConfig) { *overrides = RuntimeConfig{} }); len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	log.Printf("Runtime config overrides cleared via admin API")
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditConfigCleared, ResourceType: "config", ResourceID: "admin_overrides"})
+	emitEvent("", eventConfigUpdated, &RuntimeConfig{})
+	writeAdminConfig(w)
+}
+
+// handleConfigStatus reports the config file's load state and the
+// configuration in effect (GET /config/status)
+func handleConfigStatus(w http.ResponseWriter, r *http.Request) {
+	configFile.mu.Lock()
+	status := configFile.status
+	configFile.mu.Unlock()
+	status.Config = currentConfig()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(status)
+}
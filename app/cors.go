@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// corsExposedHeaders are the response headers browsers may read besides
+// the safelisted ones
+var corsExposedHeaders = strings.Join([]string{requestIDHeader, "Retry-After", "Idempotent-Replayed", "X-Processor"}, ", ")
+
+// corsPolicy says which browser origins may call the public API
+type corsPolicy struct {
+	// anyOrigin is set by "*"
+	anyOrigin bool
+	origins   map[string]bool
+	// suffixes hold the wildcard origins, "https://*.example.com" as
+	// scheme "https://" and suffix ".example.com"
+	suffixes []corsWildcard
+	methods  map[string]bool
+	headers  map[string]bool
+
+	allowMethods string
+	allowHeaders string
+	maxAge       string
+}
+
+type corsWildcard struct {
+	scheme string
+	suffix string
+}
+
+// cors is nil unless CORS_ALLOWED_ORIGINS is set
+var cors *corsPolicy
+
+// loadCORSPolicy reads the policy, returning nil without allowed origins:
+//
+//	CORS_ALLOWED_ORIGINS     comma separated origins such as
+//	                         https://shop.example.com, https://*.example.com
+//	                         for any subdomain, or * for any origin
+//	CORS_ALLOWED_METHODS     default GET,POST
+//	CORS_ALLOWED_HEADERS     request headers browsers may send; default the
+//	                         ones the API reads
+//	CORS_MAX_AGE_SECONDS     how long browsers cache a preflight, default 600
+func loadCORSPolicy() (*corsPolicy, error) {
+	origins := splitList(os.Getenv("CORS_ALLOWED_ORIGINS"))
+	if len(origins) == 0 {
+		return nil, nil
+	}
+	p := &corsPolicy{origins: make(map[string]bool), methods: make(map[string]bool), headers: make(map[string]bool)}
+	for _, origin := range origins {
+		switch scheme, host, ok := strings.Cut(origin, "://"); {
+		case origin == "*":
+			p.anyOrigin = true
+		case !ok || (scheme != "http" && scheme != "https") || host == "" || strings.ContainsAny(host, "/?#"):
+			return nil, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS entry %q, expected scheme://host[:port]", origin)
+		case strings.HasPrefix(host, "*."):
+			p.suffixes = append(p.suffixes, corsWildcard{scheme: scheme + "://", suffix: strings.ToLower(host[1:])})
+		case strings.Contains(host, "*"):
+			return nil, fmt.Errorf("invalid CORS_ALLOWED_ORIGINS entry %q, a wildcard must be the first label", origin)
+		default:
+			p.origins[strings.ToLower(origin)] = true
+		}
+	}
+
+	methods := splitList(getEnv("CORS_ALLOWED_METHODS", "GET,POST"))
+	for i, method := range methods {
+		methods[i] = strings.ToUpper(method)
+		p.methods[methods[i]] = true
+	}
+	p.allowMethods = strings.Join(methods, ", ")
+
+	defaultHeaders := strings.Join([]string{"Content-Type", "Authorization", apiKeyHeader, idempotencyKeyHeader,
+		requestIDHeader, signatureHeader, signatureTimestampHeader}, ",")
+	headers := splitList(getEnv("CORS_ALLOWED_HEADERS", defaultHeaders))
+	for _, header := range headers {
+		p.headers[strings.ToLower(header)] = true
+	}
+	p.allowHeaders = strings.Join(headers, ", ")
+
+	maxAge, err := strconv.Atoi(getEnv("CORS_MAX_AGE_SECONDS", "600"))
+	if err != nil || maxAge < 0 {
+		return nil, fmt.Errorf("invalid CORS_MAX_AGE_SECONDS %q", os.Getenv("CORS_MAX_AGE_SECONDS"))
+	}
+	p.maxAge = strconv.Itoa(maxAge)
+	return p, nil
+}
+
+// splitList splits a comma separated setting, dropping blank entries
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (p *corsPolicy) allowsOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+	for _, w := range p.suffixes {
+		if host, ok := strings.CutPrefix(origin, w.scheme); ok && strings.HasSuffix(host, w.suffix) && len(host) > len(w.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsPreflight reports whether the method and headers a preflight asks
+// for are all allowed
+func (p *corsPolicy) allowsPreflight(r *http.Request) bool {
+	if !p.methods[r.Header.Get("Access-Control-Request-Method")] {
+		return false
+	}
+	for _, header := range splitList(r.Header.Get("Access-Control-Request-Headers")) {
+		if !p.headers[strings.ToLower(header)] {
+			return false
+		}
+	}
+	return true
+}
+
+// withCORS lets the browser origins in CORS_ALLOWED_ORIGINS call the public
+// API. It answers preflights itself, since the routes only match their own
+// methods, and marks responses to allowed origins readable. Requests from
+// other origins pass through without CORS headers, so browsers block them.
+func withCORS(next http.HandlerFunc) http.HandlerFunc {
+	if cors == nil {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+		if preflight {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+		}
+		if !cors.allowsOrigin(origin) {
+			next(w, r)
+			return
+		}
+
+		if cors.anyOrigin {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+			next(w, r)
+			return
+		}
+		if cors.allowsPreflight(r) {
+			h.Set("Access-Control-Allow-Methods", cors.allowMethods)
+			h.Set("Access-Control-Allow-Headers", cors.allowHeaders)
+			h.Set("Access-Control-Max-Age", cors.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
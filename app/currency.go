@@ -0,0 +1,101 @@
+package main
+
+import (
+	"math"
+)
+
+// currencyExponents lists the ISO 4217 currencies whose minor unit is not
+// a hundredth: amount_minor 1000 is JPY 1000, USD 10.00 and BHD 1.000
+var currencyExponents = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "UYI": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0,
+	"XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+	"CLF": 4, "UYW": 4,
+}
+
+// currencyExponent returns the number of decimals in currency's minor unit
+func currencyExponent(currency string) int {
+	if exp, ok := currencyExponents[currency]; ok {
+		return exp
+	}
+	return 2
+}
+
+// fromMinorUnits converts an integer amount in minor units to the decimal
+// amount used internally
+func fromMinorUnits(minor int64, currency string) float64 {
+	return float64(minor) / math.Pow10(currencyExponent(currency))
+}
+
+// toMinorUnits converts a decimal amount to minor units. It fails if the
+// amount has more decimals than the currency allows, e.g. JPY 10.5.
+func toMinorUnits(amount float64, currency string) (int64, bool) {
+	scaled := amount * math.Pow10(currencyExponent(currency))
+	minor := math.Round(scaled)
+	// Tolerate float noise such as 0.29*100 = 28.999999999999996
+	if math.Abs(scaled-minor) > 1e-6*math.Max(1, math.Abs(scaled)) {
+		return 0, false
+	}
+	return int64(minor), true
+}
+
+// roundAmount rounds to the currency's minor unit so repeated partial
+// refunds don't drift
+func roundAmount(amount float64, currency string) float64 {
+	scale := math.Pow10(currencyExponent(currency))
+	return math.Round(amount*scale) / scale
+}
+
+// getFloatAmountsEnabled reports whether requests may still send decimal
+// amount fields instead of amount_minor (FLOAT_AMOUNTS_ENABLED, default
+// true while clients migrate)
+func getFloatAmountsEnabled() bool {
+	return getEnv("FLOAT_AMOUNTS_ENABLED", "true") == "true"
+}
+
+// resolveAmount validates a request's amount_minor or, with float amounts
+// enabled, its legacy decimal amount, and returns the amount in both forms.
+// field is the decimal field's name, e.g. "amount"; the minor unit field is
+// field+"_minor". optional requests, like partial captures, may omit both.
+func resolveAmount(field string, minor *int64, amount float64, currency string, optional bool) (float64, int64, []FieldViolation) {
+	switch {
+	case minor != nil:
+		if *minor <= 0 {
+			return 0, 0, []FieldViolation{{field + "_minor", "must be a positive integer"}}
+		}
+		if amount != 0 {
+			if !getFloatAmountsEnabled() {
+				return 0, 0, []FieldViolation{{field, "is no longer accepted; send " + field + "_minor"}}
+			}
+			if converted, ok := toMinorUnits(amount, currency); !ok || converted != *minor {
+				return 0, 0, []FieldViolation{{field, "does not match " + field + "_minor"}}
+			}
+		}
+		return fromMinorUnits(*minor, currency), *minor, nil
+	case amount != 0:
+		if !getFloatAmountsEnabled() {
+			return 0, 0, []FieldViolation{{field, "is no longer accepted; send " + field + "_minor"}}
+		}
+		if math.IsNaN(amount) || math.IsInf(amount, 0) || amount <= 0 {
+			return 0, 0, []FieldViolation{{field, "must be a positive number"}}
+		}
+		converted, ok := toMinorUnits(amount, currency)
+		if !ok {
+			return 0, 0, []FieldViolation{{field, "has more decimals than the currency allows"}}
+		}
+		return amount, converted, nil
+	case optional:
+		return 0, 0, nil
+	default:
+		return 0, 0, []FieldViolation{{field + "_minor", "is required"}}
+	}
+}
+
+// withMinorUnits returns txn with its amounts also set in minor units
+func (txn Transaction) withMinorUnits() Transaction {
+	txn.AmountMinor, _ = toMinorUnits(txn.Amount, txn.Currency)
+	txn.CapturedAmountMinor, _ = toMinorUnits(txn.CapturedAmount, txn.Currency)
+	txn.RefundedAmountMinor, _ = toMinorUnits(txn.RefundedAmount, txn.Currency)
+	return txn
+}
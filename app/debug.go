@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// RuntimeStats is the body of GET /debug/runtime: a quick look at the heap
+// and the garbage collector without taking a profile
+type RuntimeStats struct {
+	Goroutines    int     `json:"goroutines"`
+	HeapAllocMB   float64 `json:"heap_alloc_mb"`
+	HeapInuseMB   float64 `json:"heap_inuse_mb"`
+	HeapObjects   uint64  `json:"heap_objects"`
+	SysMB         float64 `json:"sys_mb"`
+	NextGCMB      float64 `json:"next_gc_mb"`
+	NumGC         uint32  `json:"num_gc"`
+	LastGC        string  `json:"last_gc,omitempty"`
+	LastPauseMs   float64 `json:"last_pause_ms"`
+	PauseTotalMs  float64 `json:"pause_total_ms"`
+	GCCPUFraction float64 `json:"gc_cpu_fraction"`
+	GOGC          string  `json:"gogc"`
+	GOMAXPROCS    int     `json:"gomaxprocs"`
+	// MemoryLimitMB is the GOMEMLIMIT soft limit, if one is set
+	MemoryLimitMB float64 `json:"memory_limit_mb,omitempty"`
+}
+
+// loadAdminServer returns the internal listener on ADMIN_PORT, default
+// 8081. Operator endpoints, including the debug ones, are only served there.
+func loadAdminServer(publicPort string, settings serverSettings) (*http.Server, error) {
+	port := getEnv("ADMIN_PORT", "8081")
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return nil, fmt.Errorf("invalid ADMIN_PORT %q", port)
+	}
+	if port == publicPort {
+		return nil, fmt.Errorf("ADMIN_PORT must differ from PORT (%s)", publicPort)
+	}
+
+	adminRoute("GET /debug/pprof/", pprof.Index)
+	adminRoute("GET /debug/pprof/cmdline", pprof.Cmdline)
+	adminRoute("GET /debug/pprof/profile", pprof.Profile)
+	adminRoute("GET /debug/pprof/symbol", pprof.Symbol)
+	adminRoute("POST /debug/pprof/symbol", pprof.Symbol)
+	adminRoute("GET /debug/pprof/trace", pprof.Trace)
+	adminRoute("GET /debug/vars", expvar.Handler().ServeHTTP)
+	adminRoute("GET /debug/runtime", handleRuntimeStats)
+
+	return newServer(":"+port, newRouter(adminMux), settings, "admin"), nil
+}
+
+// handleRuntimeStats reports heap and GC statistics (GET /debug/runtime).
+// ReadMemStats stops the world briefly, so don't poll it in a tight loop.
+func handleRuntimeStats(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	const mb = 1 << 20
+
+	stats := RuntimeStats{
+		Goroutines:    runtime.NumGoroutine(),
+		HeapAllocMB:   float64(m.HeapAlloc) / mb,
+		HeapInuseMB:   float64(m.HeapInuse) / mb,
+		HeapObjects:   m.HeapObjects,
+		SysMB:         float64(m.Sys) / mb,
+		NextGCMB:      float64(m.NextGC) / mb,
+		NumGC:         m.NumGC,
+		PauseTotalMs:  float64(m.PauseTotalNs) / 1e6,
+		GCCPUFraction: m.GCCPUFraction,
+		GOGC:          getEnv("GOGC", "100"),
+		GOMAXPROCS:    runtime.GOMAXPROCS(0),
+	}
+	if m.NumGC > 0 {
+		stats.LastGC = time.Unix(0, int64(m.LastGC)).UTC().Format(time.RFC3339Nano)
+		stats.LastPauseMs = float64(m.PauseNs[(m.NumGC+255)%256]) / 1e6
+	}
+	if limit := debug.SetMemoryLimit(-1); limit != math.MaxInt64 {
+		stats.MemoryLimitMB = float64(limit) / mb
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(stats)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// Decline classes. A soft decline may be approved if retried later or on
+// another processor; a hard decline won't be, whatever the retry.
+const (
+	declineSoft = "soft"
+	declineHard = "hard"
+)
+
+// DeclineReasonConfig is one entry of the decline taxonomy: how often the
+// simulation picks reason when it declines, and how the decline is classed
+type DeclineReasonConfig struct {
+	Reason string `yaml:"reason" json:"reason"`
+	// Weight is the reason's share of simulated declines relative to the
+	// others'
+	Weight float64 `yaml:"weight" json:"weight"`
+	Class  string  `yaml:"class" json:"class"`
+	// RetryAfterMs is how long a client should wait before retrying a
+	// soft decline; 0 means straight away, e.g. on another processor
+	RetryAfterMs int `yaml:"retry_after_ms" json:"retry_after_ms,omitempty"`
+}
+
+// defaultDeclineReasons roughly follow card-network decline mixes
+var defaultDeclineReasons = []DeclineReasonConfig{
+	{Reason: "insufficient_funds", Weight: 40, Class: declineSoft, RetryAfterMs: 3600000},
+	{Reason: "do_not_honor", Weight: 25, Class: declineSoft, RetryAfterMs: 60000},
+	{Reason: "fraud_suspected", Weight: 10, Class: declineHard},
+	{Reason: "expired_card", Weight: 7, Class: declineHard},
+	{Reason: "invalid_card", Weight: 6, Class: declineHard},
+	{Reason: "incorrect_cvc", Weight: 5, Class: declineHard},
+	{Reason: "processor_timeout", Weight: 4, Class: declineSoft},
+	{Reason: "card_declined", Weight: 3, Class: declineSoft, RetryAfterMs: 60000},
+}
+
+// declineHints class the reasons that don't come from the taxonomy: the
+// gateway's own declines, test cards and real processors' codes
+var declineHints = map[string]DeclineReasonConfig{
+	"processor_unavailable":    {Class: declineSoft},
+	"processor_timeout":        {Class: declineSoft},
+	"card_declined":            {Class: declineSoft, RetryAfterMs: 60000},
+	"authentication_required":  {Class: declineSoft},
+	"authentication_failed":    {Class: declineHard},
+	"unknown_token":            {Class: declineHard},
+	"velocity_exceeded":        {Class: declineSoft, RetryAfterMs: 60000},
+	"blocked":                  {Class: declineHard},
+	"risk_declined":            {Class: declineHard},
+	"avs_mismatch":             {Class: declineHard},
+	"card_brand_not_supported": {Class: declineHard},
+	"lost_card":                {Class: declineHard},
+	"stolen_card":              {Class: declineHard},
+	"capture_failed":           {Class: declineSoft, RetryAfterMs: 1000},
+	"refund_failed":            {Class: declineSoft, RetryAfterMs: 1000},
+}
+
+// declineReasons is the taxonomy in effect: decline_reasons from the
+// config, else the defaults
+func (c *RuntimeConfig) declineReasons() []DeclineReasonConfig {
+	if len(c.DeclineReasons) > 0 {
+		return c.DeclineReasons
+	}
+	return defaultDeclineReasons
+}
+
+// drawDeclineReason picks a reason from the taxonomy by weight, drawing from
+// rnd
+func drawDeclineReason(rnd *rand.Rand) string {
+	reasons := currentConfig().declineReasons()
+	total := 0.0
+	for _, d := range reasons {
+		total += d.Weight
+	}
+	pick := rnd.Float64() * total
+	for _, d := range reasons {
+		if pick < d.Weight {
+			return d.Reason
+		}
+		pick -= d.Weight
+	}
+	return reasons[len(reasons)-1].Reason
+}
+
+// declineHint returns reason's class and retry delay. Reasons nobody
+// classed are hard, so clients don't retry what can't succeed.
+func declineHint(reason string) DeclineReasonConfig {
+	for _, d := range currentConfig().declineReasons() {
+		if d.Reason == reason {
+			return d
+		}
+	}
+	if hint, ok := declineHints[reason]; ok {
+		return hint
+	}
+	return DeclineReasonConfig{Class: declineHard}
+}
+
+// setDeclineHints fills in the decline fields of a declined response
+func (r *AuthorizationResponse) setDeclineHints() {
+	hint := declineHint(r.DeclineReason)
+	retriable := hint.Class == declineSoft
+	r.DeclineClass = hint.Class
+	r.Retriable = &retriable
+	if retriable {
+		r.RetryAfterMs = &hint.RetryAfterMs
+	}
+}
+
+// validateDeclineReasons checks the decline_reasons section of the config
+func validateDeclineReasons(reasons []DeclineReasonConfig) []FieldViolation {
+	var violations []FieldViolation
+	seen := make(map[string]bool, len(reasons))
+	total := 0.0
+	for i, d := range reasons {
+		field := fmt.Sprintf("decline_reasons[%d]", i)
+		if !testDeclineReasonPattern.MatchString(d.Reason) {
+			violations = append(violations, FieldViolation{field + ".reason", "must be lowercase letters, digits and '_', starting with a letter"})
+		} else if seen[d.Reason] {
+			violations = append(violations, FieldViolation{field + ".reason", "is listed more than once"})
+		}
+		seen[d.Reason] = true
+		if d.Weight < 0 {
+			violations = append(violations, FieldViolation{field + ".weight", "must not be negative"})
+		} else {
+			total += d.Weight
+		}
+		if d.Class != declineSoft && d.Class != declineHard {
+			violations = append(violations, FieldViolation{field + ".class", "must be soft or hard"})
+		}
+		if d.RetryAfterMs < 0 {
+			violations = append(violations, FieldViolation{field + ".retry_after_ms", "must not be negative"})
+		} else if d.RetryAfterMs > 0 && d.Class == declineHard {
+			violations = append(violations, FieldViolation{field + ".retry_after_ms", "only applies to soft declines"})
+		}
+	}
+	if len(reasons) > 0 && total == 0 {
+		violations = append(violations, FieldViolation{"decline_reasons", "at least one reason needs a positive weight"})
+	}
+	return violations
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Dispute statuses: opened, then evidence_submitted, then won or lost. An
+// opened dispute is lost if its evidence is not in by evidence_due_by or
+// the merchant accepts it.
+const (
+	disputeOpened            = "opened"
+	disputeEvidenceSubmitted = "evidence_submitted"
+	disputeWon               = "won"
+	disputeLost              = "lost"
+)
+
+// Dispute webhook event types
+const (
+	eventDisputeOpened            = "dispute.opened"
+	eventDisputeEvidenceSubmitted = "dispute.evidence_submitted"
+	eventDisputeWon               = "dispute.won"
+	eventDisputeLost              = "dispute.lost"
+)
+
+// disputeSweepInterval is how often due disputes are lost or resolved
+const disputeSweepInterval = time.Second
+
+// maxDisputeEvidence caps the evidence text
+const maxDisputeEvidence = 5000
+
+// disputeReasons are the card-network reasons a simulated dispute draws
+var disputeReasons = []string{"fraudulent", "product_not_received", "duplicate", "credit_not_processed", "unrecognized"}
+
+var disputesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_disputes_total",
+		Help: "Total number of dispute transitions by resulting status",
+	},
+	[]string{"status"},
+)
+
+func init() {
+	prometheus.MustRegister(disputesTotal)
+}
+
+// Dispute is a chargeback against a captured transaction
+type Dispute struct {
+	DisputeID     string  `json:"dispute_id"`
+	TransactionID string  `json:"transaction_id"`
+	MerchantID    string  `json:"merchant_id"`
+	Status        string  `json:"status"`
+	Reason        string  `json:"reason"`
+	Amount        float64 `json:"amount"`
+	AmountMinor   int64   `json:"amount_minor"`
+	Currency      string  `json:"currency"`
+	Evidence      string  `json:"evidence,omitempty"`
+	EvidenceDueBy string  `json:"evidence_due_by"`
+	// ResolvesAt is when the network decides a dispute with evidence
+	ResolvesAt string `json:"resolves_at,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	UpdatedAt  string `json:"updated_at"`
+}
+
+// DisputeFilter narrows a disputes listing. Zero values match everything.
+type DisputeFilter struct {
+	MerchantID    string
+	TransactionID string
+	Status        string
+}
+
+func (f DisputeFilter) matches(d Dispute) bool {
+	return (f.MerchantID == "" || d.MerchantID == f.MerchantID) &&
+		(f.TransactionID == "" || d.TransactionID == f.TransactionID) &&
+		(f.Status == "" || d.Status == f.Status)
+}
+
+// oldestFirst orders disputes by created_at then ID
+func oldestFirst(disputes []Dispute) {
+	sort.Slice(disputes, func(i, j int) bool {
+		if disputes[i].CreatedAt != disputes[j].CreatedAt {
+			return disputes[i].CreatedAt < disputes[j].CreatedAt
+		}
+		return disputes[i].DisputeID < disputes[j].DisputeID
+	})
+}
+
+// DisputeEvidenceRequest is the body of POST /disputes/{id}/evidence
+type DisputeEvidenceRequest struct {
+	Evidence string `json:"evidence"`
+}
+
+// getDisputeRate returns the fraction of captures that are later disputed
+func getDisputeRate() float64 {
+	rate, err := strconv.ParseFloat(getEnv("DISPUTE_RATE", "0"), 64)
+	if err != nil {
+		return 0
+	}
+	return rate
+}
+
+// getDisputeDelay returns how long after a capture a dispute opens, and
+// how long the network takes to decide once evidence is submitted
+func getDisputeDelay() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("DISPUTE_DELAY_SECONDS", "60"))
+	if err != nil || seconds < 0 {
+		return time.Minute
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// getDisputeEvidenceWindow returns how long a merchant has to submit
+// evidence before the dispute is lost
+func getDisputeEvidenceWindow() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("DISPUTE_EVIDENCE_WINDOW_SECONDS", "600"))
+	if err != nil || seconds <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// getDisputeWinRate returns the probability that a dispute with evidence is
+// won
+func getDisputeWinRate() float64 {
+	rate, err := strconv.ParseFloat(getEnv("DISPUTE_WIN_RATE", "0.5"), 64)
+	if err != nil {
+		return 0.5
+	}
+	return rate
+}
+
+func newDisputeID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "dp_" + hex.EncodeToString(b)
+}
+
+func (d Dispute) withMinorUnits() Dispute {
+	d.AmountMinor, _ = toMinorUnits(d.Amount, d.Currency)
+	return d
+}
+
+// maybeDispute decides, with DISPUTE_RATE, whether a capture will be
+// disputed, and opens the dispute DISPUTE_DELAY_SECONDS later. A pending
+// dispute is lost if the gateway restarts before it opens.
+func maybeDispute(txn Transaction) {
+	rate := getDisputeRate()
+	if rate <= 0 || rng.Float64() >= rate {
+		return
+	}
+	reason := disputeReasons[rng.Intn(len(disputeReasons))]
+	time.AfterFunc(getDisputeDelay(), func() { openDispute(txn, reason) })
+}
+
+// openDispute opens a dispute for the captured amount of txn
+func openDispute(txn Transaction, reason string) {
+	now := time.Now()
+	d := Dispute{
+		DisputeID:     newDisputeID(),
+		TransactionID: txn.TransactionID,
+		MerchantID:    txn.MerchantID,
+		Status:        disputeOpened,
+		Reason:        reason,
+		Amount:        txn.CapturedAmount,
+		Currency:      txn.Currency,
+		EvidenceDueBy: formatTimestamp(now.Add(getDisputeEvidenceWindow())),
+		CreatedAt:     formatTimestamp(now),
+		UpdatedAt:     formatTimestamp(now),
+	}
+
+	ctx, cancel := storageContext()
+	defer cancel()
+	if err := storage.createDispute(ctx, d); err != nil {
+		storageErrorsTotal.WithLabelValues("create_dispute").Inc()
+		log.Printf("Failed to open dispute for %s: %v", txn.TransactionID, err)
+		return
+	}
+	disputesTotal.WithLabelValues(disputeOpened).Inc()
+	emitEvent(d.MerchantID, eventDisputeOpened, d.withMinorUnits())
+}
+
+// transitionDispute moves d from status from to d.Status and emits the
+// matching event. It returns errStatusConflict if another request or
+// replica moved the dispute first.
+func transitionDispute(ctx context.Context, d *Dispute, from, eventType string) error {
+	d.UpdatedAt = formatTimestamp(time.Now())
+	if err := storage.updateDispute(ctx, *d, from); err != nil {
+		return err
+	}
+	disputesTotal.WithLabelValues(d.Status).Inc()
+	emitEvent(d.MerchantID, eventType, d.withMinorUnits())
+	return nil
+}
+
+// sweepDisputes loses opened disputes past their evidence deadline and
+// decides disputes whose review is over. The disputes job runs it.
+func sweepDisputes(ctx context.Context, now time.Time) error {
+	for _, status := range []string{disputeOpened, disputeEvidenceSubmitted} {
+		disputes, err := storage.disputes(ctx, DisputeFilter{Status: status})
+		if err != nil {
+			storageErrorsTotal.WithLabelValues("list_disputes").Inc()
+			return fmt.Errorf("listing %s disputes: %w", status, err)
+		}
+		for _, d := range disputes {
+			eventType := eventDisputeLost
+			switch {
+			case status == disputeOpened && d.EvidenceDueBy <= formatTimestamp(now):
+				d.Status = disputeLost
+			case status == disputeEvidenceSubmitted && d.ResolvesAt <= formatTimestamp(now):
+				d.Status = disputeLost
+				if rng.Float64() < getDisputeWinRate() {
+					d.Status, eventType = disputeWon, eventDisputeWon
+				}
+			default:
+				continue
+			}
+			if err := transitionDispute(ctx, &d, status, eventType); err != nil && err != errStatusConflict {
+				storageErrorsTotal.WithLabelValues("update_dispute").Inc()
+				log.Printf("Failed to resolve dispute %s: %v", d.DisputeID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// loadDispute fetches a dispute visible to the caller, writing the error
+// response and returning false when there is none
+func loadDispute(ctx context.Context, w http.ResponseWriter, r *http.Request) (Dispute, bool) {
+	d, err := storage.dispute(ctx, r.PathValue("id"))
+	if err == errRecordNotFound {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Dispute not found", nil)
+		return Dispute{}, false
+	}
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("get_dispute").Inc()
+		log.Printf("Failed to load dispute %s: %v", r.PathValue("id"), err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return Dispute{}, false
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok && d.MerchantID != merchantID {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Dispute not found", nil)
+		return Dispute{}, false
+	}
+	return d, true
+}
+
+// handleDisputeList lists disputes, oldest first (GET /disputes). Filters:
+// merchant_id, transaction_id and status. Authenticated merchants only see
+// their own.
+func handleDisputeList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := DisputeFilter{MerchantID: q.Get("merchant_id"), TransactionID: q.Get("transaction_id"), Status: q.Get("status")}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		filter.MerchantID = merchantID
+	}
+	switch filter.Status {
+	case "", disputeOpened, disputeEvidenceSubmitted, disputeWon, disputeLost:
+	default:
+		writeValidationError(w, r, []FieldViolation{{"status", "must be one of opened, evidence_submitted, won, lost"}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	disputes, err := storage.disputes(ctx, filter)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_disputes").Inc()
+		log.Printf("Failed to list disputes: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	result := make([]Dispute, 0, len(disputes))
+	for _, d := range disputes {
+		result = append(result, d.withMinorUnits())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// handleDisputeGet returns a dispute (GET /disputes/{id})
+func handleDisputeGet(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	d, ok := loadDispute(ctx, w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d.withMinorUnits())
+}
+
+// handleDisputeEvidence submits evidence for an opened dispute, which the
+// network decides DISPUTE_DELAY_SECONDS later (POST /disputes/{id}/evidence)
+func handleDisputeEvidence(w http.ResponseWriter, r *http.Request) {
+	var req DisputeEvidenceRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON evidence submission"}})
+		return
+	}
+	if req.Evidence == "" || len(req.Evidence) > maxDisputeEvidence {
+		writeValidationError(w, r, []FieldViolation{{"evidence", fmt.Sprintf("must be 1-%d characters", maxDisputeEvidence)}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	d, ok := loadDispute(ctx, w, r)
+	if !ok {
+		return
+	}
+	d.Status = disputeEvidenceSubmitted
+	d.Evidence = req.Evidence
+	d.ResolvesAt = formatTimestamp(time.Now().Add(getDisputeDelay()))
+	respondToDispute(ctx, w, r, d, disputeOpened, eventDisputeEvidenceSubmitted)
+}
+
+// handleDisputeAccept concedes an opened dispute, which is then lost (POST
+// /disputes/{id}/accept)
+func handleDisputeAccept(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	d, ok := loadDispute(ctx, w, r)
+	if !ok {
+		return
+	}
+	d.Status = disputeLost
+	respondToDispute(ctx, w, r, d, disputeOpened, eventDisputeLost)
+}
+
+// respondToDispute stores a merchant's response to a dispute that must
+// still be in status from
+func respondToDispute(ctx context.Context, w http.ResponseWriter, r *http.Request, d Dispute, from, eventType string) {
+	switch err := transitionDispute(ctx, &d, from, eventType); err {
+	case nil:
+	case errStatusConflict:
+		writeError(w, r, http.StatusConflict, errCodeInvalidDisputeState,
+			fmt.Sprintf("Only opened disputes can be responded to; dispute %s is no longer opened", d.DisputeID), nil)
+		return
+	case errRecordNotFound:
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Dispute not found", nil)
+		return
+	default:
+		storageErrorsTotal.WithLabelValues("update_dispute").Inc()
+		log.Printf("Failed to update dispute %s: %v", d.DisputeID, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(d.withMinorUnits())
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// inFlightAuthorizations counts the requests trackActive is holding and the
+// batch items in flight, so a drain can report when the last one finished
+var inFlightAuthorizations atomic.Int64
+
+// drainState is whether the instance refuses new authorizations ahead of
+// maintenance. It is per instance and not persisted: a restart serves again.
+type drainState struct {
+	mu    sync.Mutex
+	since time.Time
+	// draining mirrors !since.IsZero() for the request path
+	draining atomic.Bool
+}
+
+var drain = &drainState{}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "voyager_draining",
+			Help: "1 while the instance is in drain mode and refuses new authorizations",
+		},
+		func() float64 {
+			if drain.draining.Load() {
+				return 1
+			}
+			return 0
+		},
+	))
+}
+
+// DrainStatus is the body of the /admin/drain endpoints
+type DrainStatus struct {
+	Draining bool   `json:"draining"`
+	Since    string `json:"since,omitempty"`
+	// InFlight is how many authorizations are still running; a drained
+	// instance is safe to stop once it reaches 0
+	InFlight int64 `json:"in_flight"`
+}
+
+// set turns drain mode on or off, reporting whether it changed
+func (d *drainState) set(on bool) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if on == !d.since.IsZero() {
+		return false
+	}
+	d.since = time.Time{}
+	if on {
+		d.since = time.Now()
+	}
+	d.draining.Store(on)
+	return true
+}
+
+func (d *drainState) status() DrainStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := DrainStatus{Draining: !d.since.IsZero(), InFlight: inFlightAuthorizations.Load()}
+	if s.Draining {
+		s.Since = d.since.UTC().Format(time.RFC3339)
+	}
+	return s
+}
+
+// rejectWhileDraining answers new authorizations with 503 maintenance
+// while the instance drains; requests already running finish normally
+func rejectWhileDraining(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if drain.draining.Load() {
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, errCodeMaintenance, "Instance is draining for maintenance, retry on another instance", nil)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// instanceID names this instance in the audit trail
+func instanceID() string {
+	if pod := os.Getenv("POD_NAME"); pod != "" {
+		return pod
+	}
+	host, _ := os.Hostname()
+	return host
+}
+
+// handleDrain puts the instance into drain mode (POST /admin/drain)
+func handleDrain(w http.ResponseWriter, r *http.Request) {
+	if drain.set(true) {
+		log.Printf("Drain mode on: refusing new authorizations, %d in flight", inFlightAuthorizations.Load())
+		recordAudit(auditOriginOf(r), AuditEntry{
+			Action: auditInstanceDrained, ResourceType: "instance", ResourceID: instanceID(),
+			BeforeStatus: "serving", AfterStatus: "draining",
+		})
+	}
+	writeDrainStatus(w)
+}
+
+// handleUndrain takes the instance out of drain mode (POST /admin/undrain)
+func handleUndrain(w http.ResponseWriter, r *http.Request) {
+	if drain.set(false) {
+		log.Printf("Drain mode off: serving authorizations again")
+		recordAudit(auditOriginOf(r), AuditEntry{
+			Action: auditInstanceUndrained, ResourceType: "instance", ResourceID: instanceID(),
+			BeforeStatus: "draining", AfterStatus: "serving",
+		})
+	}
+	writeDrainStatus(w)
+}
+
+// handleDrainStatus reports drain mode and the authorizations still
+// running (GET /admin/drain)
+func handleDrainStatus(w http.ResponseWriter, r *http.Request) {
+	writeDrainStatus(w)
+}
+
+func writeDrainStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(drain.status())
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Dunning retry statuses
+const (
+	retryScheduled = "scheduled"
+	retrySucceeded = "succeeded"
+	retryFailed    = "failed"
+	retryCanceled  = "canceled"
+)
+
+// Dunning webhook event types, one per retried charge
+const (
+	eventSubscriptionRetrySucceeded = "subscription.retry_succeeded"
+	eventSubscriptionRetryFailed    = "subscription.retry_failed"
+)
+
+// defaultDunningSchedule retries a failed cycle one, three and seven days
+// later unless the config says otherwise
+var defaultDunningSchedule = []time.Duration{24 * time.Hour, 72 * time.Hour, 168 * time.Hour}
+
+var (
+	dunningRetriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_dunning_retries_total",
+			Help: "Total number of retried subscription charges by result",
+		},
+		[]string{"result"},
+	)
+
+	dunningOutcomesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_dunning_outcomes_total",
+			Help: "Total number of failed cycles whose retries ended, by outcome (recovered or exhausted)",
+		},
+		[]string{"outcome"},
+	)
+
+	// dunningRecovered and dunningExhausted back the recovery rate gauge
+	dunningRecovered, dunningExhausted int64
+)
+
+func init() {
+	prometheus.MustRegister(dunningRetriesTotal)
+	prometheus.MustRegister(dunningOutcomesTotal)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "voyager_dunning_recovery_rate",
+			Help: "Share of failed cycles whose retries ended that a retry recovered",
+		},
+		func() float64 {
+			recovered := atomic.LoadInt64(&dunningRecovered)
+			total := recovered + atomic.LoadInt64(&dunningExhausted)
+			if total == 0 {
+				return 0
+			}
+			return float64(recovered) / float64(total)
+		},
+	))
+}
+
+// DunningConfig is the dunning section of the config file. Delays are Go
+// durations, plus "d" for days, counted from the failed cycle.
+type DunningConfig struct {
+	// Schedule replaces the default 1d, 3d, 7d; empty turns retries off
+	Schedule []string `yaml:"schedule" json:"schedule"`
+	// Reasons give decline reasons their own schedule, empty for none.
+	// Without one, hard declines aren't retried.
+	Reasons map[string][]string `yaml:"reasons" json:"reasons,omitempty"`
+
+	// schedule and reasons are Schedule and Reasons parsed
+	schedule []time.Duration
+	reasons  map[string][]time.Duration
+}
+
+// DunningRetry is one scheduled retry of a failed subscription cycle
+type DunningRetry struct {
+	Attempt       int    `json:"attempt"`
+	ScheduledAt   string `json:"scheduled_at"`
+	Status        string `json:"status"`
+	TransactionID string `json:"transaction_id,omitempty"`
+	DeclineReason string `json:"decline_reason,omitempty"`
+}
+
+// SubscriptionRetries is the body of GET /subscriptions/{id}/retries
+type SubscriptionRetries struct {
+	SubscriptionID string `json:"subscription_id"`
+	// Cycle is the failed cycle the retries are for
+	Cycle   int            `json:"cycle"`
+	Retries []DunningRetry `json:"retries"`
+}
+
+// parseDelay parses a Go duration or a whole number of days such as "3d"
+func parseDelay(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a duration", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a duration", s)
+	}
+	return d, nil
+}
+
+// parseRetrySchedule parses increasing, positive retry delays
+func parseRetrySchedule(field string, delays []string) ([]time.Duration, []FieldViolation) {
+	schedule := make([]time.Duration, 0, len(delays))
+	for _, s := range delays {
+		d, err := parseDelay(s)
+		switch {
+		case err != nil:
+			return nil, []FieldViolation{{field, err.Error()}}
+		case d <= 0:
+			return nil, []FieldViolation{{field, fmt.Sprintf("%q must be positive", s)}}
+		case len(schedule) > 0 && d <= schedule[len(schedule)-1]:
+			return nil, []FieldViolation{{field, "delays must be increasing"}}
+		}
+		schedule = append(schedule, d)
+	}
+	return schedule, nil
+}
+
+// validateDunning checks the dunning section of the config and parses its
+// schedules
+func validateDunning(c *DunningConfig) []FieldViolation {
+	if c == nil {
+		return nil
+	}
+	schedule, violations := parseRetrySchedule("dunning.schedule", c.Schedule)
+	c.schedule = schedule
+	c.reasons = make(map[string][]time.Duration, len(c.Reasons))
+	for _, reason := range sortedKeys(c.Reasons) {
+		field := "dunning.reasons." + reason
+		if !testDeclineReasonPattern.MatchString(reason) {
+			violations = append(violations, FieldViolation{field, "must be lowercase letters, digits and '_', starting with a letter"})
+			continue
+		}
+		schedule, reasonViolations := parseRetrySchedule(field, c.Reasons[reason])
+		violations = append(violations, reasonViolations...)
+		c.reasons[reason] = schedule
+	}
+	return violations
+}
+
+// retrySchedule returns the delays after which a cycle that failed with
+// response (nil if the gateway rejected it) is retried. A reason's own
+// schedule wins; otherwise hard declines aren't retried, and soft ones
+// wait at least their retry_after_ms.
+func retrySchedule(response *AuthorizationResponse) []time.Duration {
+	schedule := defaultDunningSchedule
+	if c := currentConfig().Dunning; c != nil {
+		schedule = c.schedule
+		if response != nil && hasRetrySchedule(response.DeclineReason) {
+			return c.reasons[response.DeclineReason]
+		}
+	}
+	if response == nil || response.Retriable == nil {
+		return schedule
+	}
+	if !*response.Retriable {
+		return nil
+	}
+	minimum := time.Duration(0)
+	if response.RetryAfterMs != nil {
+		minimum = time.Duration(*response.RetryAfterMs) * time.Millisecond
+	}
+	delays := make([]time.Duration, 0, len(schedule))
+	for _, d := range schedule {
+		if d < minimum {
+			d = minimum
+		}
+		if len(delays) == 0 || d > delays[len(delays)-1] {
+			delays = append(delays, d)
+		}
+	}
+	return delays
+}
+
+// hasRetrySchedule reports whether the config gives reason its own schedule
+func hasRetrySchedule(reason string) bool {
+	c := currentConfig().Dunning
+	if c == nil {
+		return false
+	}
+	_, ok := c.reasons[reason]
+	return ok
+}
+
+// planRetries replaces s's retries with those of a cycle that failed at
+// failedAt
+func (s *Subscription) planRetries(response *AuthorizationResponse, failedAt time.Time) {
+	s.cancelRetries()
+	s.Retries = nil
+	for i, d := range retrySchedule(response) {
+		s.Retries = append(s.Retries, DunningRetry{
+			Attempt:     i + 1,
+			ScheduledAt: formatTimestamp(failedAt.Add(d)),
+			Status:      retryScheduled,
+		})
+	}
+	s.RetriesCycle = s.Cycle
+	s.setNextRetry()
+}
+
+// cancelRetries cancels the retries that haven't run yet
+func (s *Subscription) cancelRetries() {
+	for i := range s.Retries {
+		if s.Retries[i].Status == retryScheduled && s.Retries[i].TransactionID == "" {
+			s.Retries[i].Status = retryCanceled
+		}
+	}
+	s.NextRetryAt = ""
+}
+
+// setNextRetry points NextRetryAt at the first retry that hasn't run yet
+func (s *Subscription) setNextRetry() {
+	s.NextRetryAt = ""
+	for _, r := range s.Retries {
+		if r.Status == retryScheduled && r.TransactionID == "" {
+			s.NextRetryAt = r.ScheduledAt
+			return
+		}
+	}
+}
+
+// retrySubscription claims s's due retry and authorizes it
+func retrySubscription(s Subscription, now time.Time) {
+	ctx, cancel := storageContext()
+	defer cancel()
+
+	i := -1
+	for j, r := range s.Retries {
+		if r.Status == retryScheduled && r.TransactionID == "" {
+			i = j
+			break
+		}
+	}
+	if i < 0 {
+		return
+	}
+	txnID := newTransactionID()
+	s.Retries[i].TransactionID = txnID
+	s.LastTransactionID = txnID
+	s.setNextRetry()
+	s.UpdatedAt = formatTimestamp(now)
+	// Claiming the retry first keeps another replica from running it too
+	if err := storage.updateSubscription(ctx, s); err != nil {
+		if err != errStatusConflict {
+			storageErrorsTotal.WithLabelValues("update_subscription").Inc()
+			log.Printf("Failed to claim retry of subscription %s: %v", s.SubscriptionID, err)
+		}
+		return
+	}
+	s.version++
+
+	response, charge := authorizeSubscription(s, txnID)
+	status := chargeStatus(response, charge)
+	dunningRetriesTotal.WithLabelValues(status).Inc()
+
+	eventType := eventSubscriptionRetryFailed
+	outcome := ""
+	apply := func(stored *Subscription) {
+		stored.LastChargeStatus = status
+		for j := range stored.Retries {
+			if stored.Retries[j].TransactionID != txnID {
+				continue
+			}
+			if status == "approved" {
+				stored.Retries[j].Status = retrySucceeded
+			} else {
+				stored.Retries[j].Status = retryFailed
+				stored.Retries[j].DeclineReason = response.DeclineReason
+			}
+		}
+		switch {
+		case status == "approved":
+			stored.FailedCycles = 0
+			stored.cancelRetries()
+		case response.Retriable != nil && !*response.Retriable && !hasRetrySchedule(response.DeclineReason):
+			// A hard decline won't be approved by retrying
+			stored.cancelRetries()
+		}
+		stored.setNextRetry()
+	}
+	apply(&s)
+	switch {
+	case status == "approved":
+		eventType, outcome = eventSubscriptionRetrySucceeded, "recovered"
+		atomic.AddInt64(&dunningRecovered, 1)
+	case s.NextRetryAt == "":
+		outcome = "exhausted"
+		atomic.AddInt64(&dunningExhausted, 1)
+	}
+	if outcome != "" {
+		dunningOutcomesTotal.WithLabelValues(outcome).Inc()
+	}
+
+	if err := recordSubscriptionCharge(ctx, s, apply); err != nil {
+		storageErrorsTotal.WithLabelValues("update_subscription").Inc()
+		log.Printf("Failed to record retry of subscription %s: %v", s.SubscriptionID, err)
+	}
+	charge.Subscription = s.withMinorUnits()
+	charge.Retry = &s.Retries[i]
+	emitEvent(s.MerchantID, eventType, charge)
+}
+
+// handleSubscriptionRetries lists the retries of a subscription's latest
+// failed cycle (GET /subscriptions/{id}/retries)
+func handleSubscriptionRetries(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	s, ok := loadSubscription(ctx, w, r)
+	if !ok {
+		return
+	}
+	retries := SubscriptionRetries{SubscriptionID: s.SubscriptionID, Cycle: s.RetriesCycle, Retries: s.Retries}
+	if retries.Retries == nil {
+		retries.Retries = []DunningRetry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(retries)
+}
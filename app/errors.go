@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes returned in the "code" field of ErrorResponse. Clients should
+// branch on the code, never on the human-readable message.
+const (
+	// 400: the request body or a field failed validation; details lists
+	// the offending fields
+	errCodeValidation = "validation_error"
+	// 401: missing or invalid API key
+	errCodeUnauthorized = "unauthorized"
+	// 401: missing, stale, replayed or invalid request signature
+	errCodeInvalidSignature = "invalid_signature"
+	// 402: the processor declined a capture or refund; details carries the
+	// decline_reason
+	errCodeProcessorDeclined = "processor_declined"
+	// 403: authenticated, but not allowed to perform the operation
+	errCodeForbidden = "forbidden"
+	// 403: the merchant was disabled through /admin/merchants or its profile
+	errCodeMerchantDisabled = "merchant_disabled"
+	// 404: the route or resource does not exist
+	errCodeNotFound = "not_found"
+	// 405: the route exists but not for this method
+	errCodeMethodNotAllowed = "method_not_allowed"
+	// 409: a transaction with the same transaction_id was already processed
+	errCodeDuplicateTransaction = "duplicate_transaction"
+	// 409: a merchant with the same merchant_id is already onboarded
+	errCodeDuplicateMerchant = "duplicate_merchant"
+	// 409: a 3DS challenge was completed twice or confirmed before completion
+	errCodeInvalidChallengeState = "invalid_challenge_state"
+	// 409: the transaction's status doesn't allow the capture or refund
+	errCodeInvalidTransactionState = "invalid_transaction_state"
+	// 409: the authorization expired before it was captured
+	errCodeAuthorizationExpired = "authorization_expired"
+	// 409: the dispute is no longer open to a response
+	errCodeInvalidDisputeState = "invalid_dispute_state"
+	// 409: the subscription's status doesn't allow the change
+	errCodeInvalidSubscriptionState = "invalid_subscription_state"
+	// 409: the payment link is paid, expired or being paid
+	errCodeInvalidPaymentLinkState = "invalid_payment_link_state"
+	// 409: a request with the same Idempotency-Key is still in flight
+	errCodeIdempotencyKeyInUse = "idempotency_key_in_use"
+	// 409: the background job triggered is already running
+	errCodeJobRunning = "job_running"
+	// 413: the request body exceeds MAX_REQUEST_BODY_BYTES; details carries
+	// max_bytes
+	errCodePayloadTooLarge = "payload_too_large"
+	// 422: the transaction's processor doesn't support incremental
+	// authorization
+	errCodeIncrementUnsupported = "incremental_authorization_unsupported"
+	// 422: the Idempotency-Key was first used with a different request
+	errCodeIdempotencyKeyReused = "idempotency_key_reused"
+	// 429: the merchant exceeded its rate limit; honour Retry-After
+	errCodeRateLimited = "rate_limited"
+	// 502/503: the selected payment processor could not be reached
+	errCodeProcessorUnavailable = "processor_unavailable"
+	// 503: the gateway is shedding load; honour Retry-After
+	errCodeOverloaded = "service_overloaded"
+	// 503: the instance is draining for maintenance; retry, which the load
+	// balancer sends to another instance
+	errCodeMaintenance = "maintenance"
+	// 503: the transaction store could not be reached
+	errCodeStorageUnavailable = "storage_unavailable"
+	// 503: the FX rate feed is down, so settlement_currency can't be honoured
+	errCodeFXUnavailable = "fx_unavailable"
+	// 503: Parquet export is not configured or its destination failed
+	errCodeExportUnavailable = "export_unavailable"
+	// 503: snapshots need the memory backend, and saved ones an artifact
+	// store that could be reached
+	errCodeSnapshotUnavailable = "snapshot_unavailable"
+	// 500: unexpected failure inside the gateway
+	errCodeInternal = "internal_error"
+)
+
+// requestIDHeader carries the request ID in both directions so callers can
+// correlate their logs with ours
+const requestIDHeader = "X-Request-ID"
+
+// ErrorResponse is the JSON envelope for every error returned by the gateway
+type ErrorResponse struct {
+	Code      string      `json:"code"`
+	Message   string      `json:"message"`
+	Details   interface{} `json:"details,omitempty"`
+	RequestID string      `json:"request_id"`
+}
+
+type requestIDContextKey struct{}
+
+// requestIDFromContext returns the ID assigned to the current request
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// newRequestID returns a random hex request identifier
+func newRequestID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// withRequestID assigns every request an ID, reusing the caller's
+// X-Request-ID when present, and echoes it on the response
+func withRequestID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if id == "" || len(id) > 128 {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		ctx := context.WithValue(r.Context(), requestIDContextKey{}, id)
+		next(w, r.WithContext(ctx))
+	}
+}
+
+// writeError responds with the standard error envelope
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string, details interface{}) {
+	body, _ := json.Marshal(ErrorResponse{
+		Code:      code,
+		Message:   message,
+		Details:   details,
+		RequestID: requestIDFromContext(r.Context()),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	// Messages and details can echo request values, so card data is masked
+	_, _ = w.Write(append(sanitizeJSON(body), '\n'))
+}
+
+// handleNotFound answers any path no route matched
+func handleNotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusNotFound, errCodeNotFound, "Route not found", nil)
+}
+
+// handleMethodNotAllowed answers a path whose routes don't accept the
+// method. The Allow header is already set by the mux.
+func handleMethodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusMethodNotAllowed, errCodeMethodNotAllowed, "Method not allowed", nil)
+}
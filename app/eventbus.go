@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Event sinks selectable with EVENT_SINK
+const (
+	sinkKafka  = "kafka"
+	sinkNATS   = "nats"
+	sinkSQS    = "sqs"
+	sinkSNS    = "sns"
+	sinkStdout = "stdout"
+	sinkNoop   = "noop"
+)
+
+var (
+	eventsPublishedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_events_published_total",
+			Help: "Total number of transaction events handed to the event sink by result",
+		},
+		[]string{"sink", "event", "result"},
+	)
+
+	eventsDroppedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "voyager_events_dropped_total",
+			Help: "Total number of transaction events dropped because the publish queue was full",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(eventsPublishedTotal)
+	prometheus.MustRegister(eventsDroppedTotal)
+}
+
+// EventPublisher delivers transaction events to a message broker.
+// Publishers report each delivery with recordPublish, since some of them
+// only learn the outcome asynchronously.
+type EventPublisher interface {
+	// Publish sends one event. It may return before delivery completes.
+	Publish(ctx context.Context, event TransactionEvent) error
+	// Close flushes anything buffered and releases connections
+	Close() error
+	// Ping checks the broker can be reached, for the readiness probe
+	Ping(ctx context.Context) error
+}
+
+// transactionEventSchemaVersion is bumped on any incompatible change to
+// TransactionEvent so consumers can branch on it
+const transactionEventSchemaVersion = 1
+
+// TransactionEvent is the stable schema published for every authorization,
+// capture and refund. Fields are only ever added.
+type TransactionEvent struct {
+	SchemaVersion int     `json:"schema_version"`
+	EventID       string  `json:"event_id"`
+	EventType     string  `json:"event_type"`
+	TransactionID string  `json:"transaction_id"`
+	MerchantID    string  `json:"merchant_id"`
+	Status        string  `json:"status"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	Processor     string  `json:"processor,omitempty"`
+	DeclineReason string  `json:"decline_reason,omitempty"`
+	OccurredAt    string  `json:"occurred_at"`
+}
+
+// newTransactionEvent maps an event onto the transaction schema. It returns
+// false for events that are not about a transaction.
+func newTransactionEvent(event WebhookEvent) (TransactionEvent, bool) {
+	txn := TransactionEvent{
+		SchemaVersion: transactionEventSchemaVersion,
+		EventID:       event.ID,
+		EventType:     event.Type,
+		MerchantID:    event.MerchantID,
+		OccurredAt:    event.CreatedAt,
+	}
+	switch data := event.Data.(type) {
+	case AuthorizationResponse:
+		txn.TransactionID = data.TransactionID
+		txn.Status = data.Status
+		txn.Amount = data.Amount
+		txn.Currency = data.Currency
+		txn.Processor = data.Processor
+		txn.DeclineReason = data.DeclineReason
+	case Transaction:
+		// Captures report the captured rather than the authorized amount
+		txn.TransactionID = data.TransactionID
+		txn.Status = data.Status
+		txn.Amount = data.CapturedAmount
+		txn.Currency = data.Currency
+		txn.Processor = data.Processor
+	case Refund:
+		txn.TransactionID = data.TransactionID
+		txn.Status = statusRefunded
+		txn.Amount = data.Amount
+		txn.Currency = data.Currency
+		txn.Processor = data.Processor
+	default:
+		return TransactionEvent{}, false
+	}
+	return txn, true
+}
+
+// recordPublish counts a delivery attempt for a sink
+func recordPublish(sink, eventType string, err error) {
+	result := "delivered"
+	if err != nil {
+		result = "failed"
+	}
+	eventsPublishedTotal.WithLabelValues(sink, eventType, result).Inc()
+}
+
+// eventBus queues transaction events and publishes them from background
+// workers so a slow broker never adds latency to an authorization
+type eventBus struct {
+	sink      string
+	publisher EventPublisher
+	queue     chan TransactionEvent
+	wg        sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// eventSink is nil when EVENT_SINK is noop
+var eventSink *eventBus
+
+// getEventQueueSize returns how many events may wait for a worker
+func getEventQueueSize() int {
+	n, err := strconv.Atoi(getEnv("EVENT_QUEUE_SIZE", "10000"))
+	if err != nil || n <= 0 {
+		return 10000
+	}
+	return n
+}
+
+// getEventPublishWorkers returns how many events are published concurrently
+func getEventPublishWorkers() int {
+	n, err := strconv.Atoi(getEnv("EVENT_PUBLISH_WORKERS", "4"))
+	if err != nil || n <= 0 {
+		return 4
+	}
+	return n
+}
+
+// loadEventBus builds the publisher named by EVENT_SINK. When EVENT_SINK is
+// unset, Kafka is used if KAFKA_BROKERS is configured.
+func loadEventBus() (*eventBus, error) {
+	sink := os.Getenv("EVENT_SINK")
+	if sink == "" {
+		sink = sinkNoop
+		if os.Getenv("KAFKA_BROKERS") != "" {
+			sink = sinkKafka
+		}
+	}
+
+	var publisher EventPublisher
+	var err error
+	switch sink {
+	case sinkNoop:
+		return nil, nil
+	case sinkStdout:
+		publisher = &stdoutPublisher{encoder: json.NewEncoder(os.Stdout)}
+	case sinkKafka:
+		publisher, err = newKafkaPublisher()
+	case sinkNATS:
+		publisher, err = newNATSPublisher()
+	case sinkSQS:
+		publisher, err = newSQSPublisher()
+	case sinkSNS:
+		publisher, err = newSNSPublisher()
+	default:
+		return nil, fmt.Errorf("unknown EVENT_SINK %q, expected kafka, nats, sqs, sns, stdout or noop", sink)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("configuring %s event sink: %w", sink, err)
+	}
+
+	b := &eventBus{
+		sink:      sink,
+		publisher: publisher,
+		queue:     make(chan TransactionEvent, getEventQueueSize()),
+	}
+	for i := 0; i < getEventPublishWorkers(); i++ {
+		b.wg.Add(1)
+		go b.worker()
+	}
+	return b, nil
+}
+
+// publish queues a transaction event; other events are ignored
+func (b *eventBus) publish(event WebhookEvent) {
+	txn, ok := newTransactionEvent(event)
+	if !ok {
+		return
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		eventsDroppedTotal.Inc()
+		return
+	}
+	select {
+	case b.queue <- txn:
+	default:
+		eventsDroppedTotal.Inc()
+	}
+}
+
+func (b *eventBus) worker() {
+	defer b.wg.Done()
+	for txn := range b.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		if err := b.publisher.Publish(ctx, txn); err != nil {
+			log.Printf("Failed to publish %s for %s to %s: %v", txn.EventType, txn.TransactionID, b.sink, err)
+		}
+		cancel()
+	}
+}
+
+// close publishes the events still queued and then closes the publisher.
+// Events emitted afterwards are dropped.
+func (b *eventBus) close() error {
+	b.mu.Lock()
+	b.closed = true
+	close(b.queue)
+	b.mu.Unlock()
+
+	b.wg.Wait()
+	return b.publisher.Close()
+}
+
+// stdoutPublisher writes one JSON event per line, for local development
+// and log-based pipelines
+type stdoutPublisher struct {
+	mu      sync.Mutex
+	encoder *json.Encoder
+}
+
+func (p *stdoutPublisher) Publish(ctx context.Context, event TransactionEvent) error {
+	p.mu.Lock()
+	err := p.encoder.Encode(event)
+	p.mu.Unlock()
+	recordPublish(sinkStdout, event.EventType, err)
+	return err
+}
+
+func (p *stdoutPublisher) Close() error {
+	return nil
+}
+
+func (p *stdoutPublisher) Ping(ctx context.Context) error {
+	return nil
+}
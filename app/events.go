@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Chaos lifecycle, maintenance and config events. They have no merchant
+// and reach every stream subscriber.
+const (
+	eventChaosStarted       = "chaos.started"
+	eventChaosStopped       = "chaos.stopped"
+	eventChaosExpired       = "chaos.expired"
+	eventConfigUpdated      = "config.updated"
+	eventMaintenanceStarted = "maintenance.started"
+	eventMaintenanceEnded   = "maintenance.ended"
+)
+
+// eventStreamBuffer is how many events a slow subscriber may fall behind
+// before events are dropped for it
+const eventStreamBuffer = 256
+
+var (
+	eventStreamSubscribers = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "voyager_event_stream_subscribers",
+			Help: "Number of clients connected to GET /events",
+		},
+	)
+
+	eventStreamDroppedTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "voyager_event_stream_dropped_total",
+			Help: "Total number of events dropped for subscribers that fell behind",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(eventStreamSubscribers)
+	prometheus.MustRegister(eventStreamDroppedTotal)
+}
+
+// emitEvent records a transaction or system event: it is broadcast to
+// /events subscribers and queued for the merchant's webhook
+func emitEvent(merchantID, eventType string, data interface{}) {
+	event := WebhookEvent{
+		ID:         newEventID(),
+		Type:       eventType,
+		MerchantID: merchantID,
+		CreatedAt:  formatTimestamp(time.Now()),
+		Data:       data,
+	}
+	eventStream.publish(event)
+	if eventSink != nil {
+		eventSink.publish(event)
+	}
+	deliverWebhook(event)
+}
+
+func newEventID() string {
+	var b [12]byte
+	_, _ = rand.Read(b[:])
+	var buf [28]byte
+	return string(hex.AppendEncode(append(buf[:0], "evt_"...), b[:]))
+}
+
+// eventBroker fans events out to stream subscribers
+type eventBroker struct {
+	mu          sync.RWMutex
+	subscribers map[chan WebhookEvent]string
+}
+
+var eventStream = &eventBroker{subscribers: make(map[chan WebhookEvent]string)}
+
+// subscribe registers a subscriber for merchantID's events, or every
+// merchant's when merchantID is empty
+func (b *eventBroker) subscribe(merchantID string) chan WebhookEvent {
+	ch := make(chan WebhookEvent, eventStreamBuffer)
+	b.mu.Lock()
+	b.subscribers[ch] = merchantID
+	b.mu.Unlock()
+	eventStreamSubscribers.Inc()
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan WebhookEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[ch]; ok {
+		delete(b.subscribers, ch)
+		eventStreamSubscribers.Dec()
+	}
+}
+
+// closeAll ends every stream so shutdown isn't held up by open connections
+func (b *eventBroker) closeAll() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subscribers {
+		close(ch)
+		delete(b.subscribers, ch)
+		eventStreamSubscribers.Dec()
+	}
+}
+
+// publish never blocks: subscribers that are full miss the event
+func (b *eventBroker) publish(event WebhookEvent) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for ch, merchantID := range b.subscribers {
+		if merchantID != "" && event.MerchantID != "" && event.MerchantID != merchantID {
+			continue
+		}
+		select {
+		case ch <- event:
+		default:
+			eventStreamDroppedTotal.Inc()
+		}
+	}
+}
+
+// handleEvents streams events as Server-Sent Events. ?merchant_id= limits
+// the stream to one merchant; authenticated merchants only ever see their
+// own events. System events such as chaos changes are always included.
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Streaming is not supported", nil)
+		return
+	}
+
+	merchantID := r.URL.Query().Get("merchant_id")
+	if authenticated, ok := merchantFromContext(r.Context()); ok {
+		merchantID = authenticated
+	}
+	if merchantID != "" && !merchantIDPattern.MatchString(merchantID) {
+		writeValidationError(w, r, []FieldViolation{{"merchant_id", "must be 1-64 characters of letters, digits, '_' or '-'"}})
+		return
+	}
+
+	events := eventStream.subscribe(merchantID)
+	defer eventStream.unsubscribe(events)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	// Comments keep idle connections from being closed by proxies
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			flusher.Flush()
+		}
+	}
+}
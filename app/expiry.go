@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// authorizationExpirySweepInterval is how often open authorizations past
+// the expiry window are expired
+const authorizationExpirySweepInterval = time.Minute
+
+var authorizationsExpiredTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "voyager_authorizations_expired_total",
+		Help: "Total number of authorizations expired before they were captured in full",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(authorizationsExpiredTotal)
+}
+
+// authorizationExpiry is how long an approved authorization can be
+// captured, as card networks hold funds for a limited time. Zero keeps
+// authorizations open forever.
+var authorizationExpiry time.Duration
+
+// loadAuthorizationExpiry reads AUTHORIZATION_EXPIRY_HOURS, 168 (7 days)
+// by default
+func loadAuthorizationExpiry() (time.Duration, error) {
+	hours, err := strconv.Atoi(getEnv("AUTHORIZATION_EXPIRY_HOURS", "168"))
+	if err != nil || hours < 0 {
+		return 0, fmt.Errorf("invalid AUTHORIZATION_EXPIRY_HOURS, expected a number of at least 0")
+	}
+	return time.Duration(hours) * time.Hour, nil
+}
+
+// expirableStatuses are the statuses of open authorizations, which still
+// hold funds until they are captured in full or expire
+var expirableStatuses = []string{"approved", statusPartiallyCaptured}
+
+// authorizationExpired reports whether txn is an open authorization that
+// has outlived authorizationExpiry at now
+func authorizationExpired(txn Transaction, now time.Time) bool {
+	if !containsString(expirableStatuses, txn.Status) || authorizationExpiry <= 0 {
+		return false
+	}
+	created, err := time.Parse(time.RFC3339, txn.CreatedAt)
+	return err == nil && !now.Before(created.Add(authorizationExpiry))
+}
+
+// expireAuthorization voids txn, an open authorization in store, releasing
+// its hold and notifying the merchant. A partially captured one becomes
+// captured, keeping what was captured and voiding the rest. It returns
+// errStatusConflict if txn was captured meanwhile, or already expired by
+// another replica.
+func expireAuthorization(ctx context.Context, store transactionStore, txn Transaction, now time.Time) error {
+	from := txn.Status
+	txn.Status = statusExpired
+	if from == statusPartiallyCaptured {
+		txn.Status = statusCaptured
+	}
+	txn.UpdatedAt = formatTimestamp(now)
+	if err := store.UpdateStatus(ctx, txn, from); err != nil {
+		return err
+	}
+	txn = txn.withMinorUnits()
+	authorizationsExpiredTotal.Inc()
+	recordTransactionAudit(auditOrigin{}, auditAuthorizationExpired, txn, from)
+	recordExpiryEntry(txn)
+	emitEvent(txn.MerchantID, eventAuthorizationExpired, txn)
+	if txn.Status == statusCaptured {
+		maybeDispute(txn)
+	}
+	return nil
+}
+
+// authorizationOpen reports whether txn hasn't expired, writing 409
+// authorization_expired otherwise. An authorization past its window is
+// expired on the spot when the sweep hasn't got to it yet.
+func authorizationOpen(ctx context.Context, w http.ResponseWriter, r *http.Request, txn Transaction) bool {
+	if now := time.Now(); authorizationExpired(txn, now) {
+		if err := expireAuthorization(ctx, tenantStore(ctx), txn, now); err != nil && err != errStatusConflict {
+			log.Printf("Failed to expire authorization %s: %v", txn.TransactionID, err)
+		}
+	} else if txn.Status != statusExpired {
+		return true
+	}
+	writeError(w, r, http.StatusConflict, errCodeAuthorizationExpired,
+		"The authorization expired before it was captured in full; authorize the payment again", nil)
+	return false
+}
+
+// sweepAuthorizations expires the open authorizations created more than
+// authorizationExpiry ago, in the tenants' stores and the default one. The
+// authorizations job runs it.
+func sweepAuthorizations(ctx context.Context, now time.Time) error {
+	if authorizationExpiry <= 0 {
+		return nil
+	}
+	expired := 0
+	for _, store := range append(tenants.stores(), storage) {
+		var txns []Transaction
+		for _, status := range expirableStatuses {
+			found, err := store.List(ctx, TransactionFilter{Status: status, CreatedTo: now.Add(-authorizationExpiry)})
+			if err != nil {
+				storageErrorsTotal.WithLabelValues("list_transactions").Inc()
+				return fmt.Errorf("listing %s authorizations: %w", status, err)
+			}
+			txns = append(txns, found...)
+		}
+		for _, txn := range txns {
+			err := expireAuthorization(ctx, store, txn, now)
+			switch {
+			case err == errStatusConflict:
+			case err != nil:
+				storageErrorsTotal.WithLabelValues("update_transaction").Inc()
+				log.Printf("Failed to expire authorization %s: %v", txn.TransactionID, err)
+			default:
+				expired++
+			}
+		}
+	}
+	if expired > 0 {
+		log.Printf("Expired %d authorizations not captured in full within %s", expired, authorizationExpiry)
+	}
+	return nil
+}
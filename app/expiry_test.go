@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestSweepAuthorizations(t *testing.T) {
+	now := time.Now()
+	old := formatTimestamp(now.Add(-200 * time.Hour))
+	cases := []struct {
+		name         string
+		status       string
+		captured     float64
+		createdAt    string
+		wantStatus   string
+		wantCaptured float64
+		// wantEntries are the ledger entry types expected for the
+		// transaction
+		wantEntries []string
+	}{
+		{"approved", "approved", 0, old, statusExpired, 0, []string{entryAuthorizationExpired}},
+		{"partially captured", statusPartiallyCaptured, 40, old, statusCaptured, 40, []string{entryAuthorizationExpired, entryFee}},
+		{"recent", "approved", 0, formatTimestamp(now), "approved", 0, nil},
+		{"captured", statusCaptured, 100, old, statusCaptured, 100, nil},
+	}
+
+	defer func(s transactionStore, expiry time.Duration) { storage, authorizationExpiry = s, expiry }(storage, authorizationExpiry)
+	authorizationExpiry = 168 * time.Hour
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			storage = newMemoryStore()
+			ctx := context.Background()
+			txn := Transaction{
+				TransactionID:  "txn_expiry",
+				MerchantID:     "merchant_expiry",
+				Status:         tc.status,
+				Amount:         100,
+				CapturedAmount: tc.captured,
+				Currency:       "USD",
+				Processor:      "stripe",
+				CreatedAt:      tc.createdAt,
+				UpdatedAt:      tc.createdAt,
+			}
+			if err := storage.Create(ctx, txn); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := sweepAuthorizations(ctx, now); err != nil {
+				t.Fatalf("sweepAuthorizations: %v", err)
+			}
+			got, err := storage.Get(ctx, txn.TransactionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tc.wantStatus || got.CapturedAmount != tc.wantCaptured {
+				t.Errorf("got %s with %g captured, want %s with %g", got.Status, got.CapturedAmount, tc.wantStatus, tc.wantCaptured)
+			}
+			entries, err := storage.ledgerEntries(ctx, LedgerFilter{ReferenceID: txn.TransactionID})
+			if err != nil {
+				t.Fatal(err)
+			}
+			types := map[string]bool{}
+			for _, e := range entries {
+				types[e.Type] = true
+			}
+			if len(types) != len(tc.wantEntries) {
+				t.Errorf("got ledger entries %v, want %v", types, tc.wantEntries)
+			}
+			for _, want := range tc.wantEntries {
+				if !types[want] {
+					t.Errorf("missing %s ledger entry, got %v", want, types)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// FeeRate is a percentage of the amount plus a fixed fee per transaction
+type FeeRate struct {
+	Percent float64 `yaml:"percent" json:"percent"`
+	// Fixed is in the transaction currency
+	Fixed float64 `yaml:"fixed" json:"fixed"`
+}
+
+// ProcessorFees is a processor's fee schedule: its default rate, and rates
+// for the currencies it prices differently
+type ProcessorFees struct {
+	FeeRate    `yaml:",inline"`
+	Currencies map[string]FeeRate `yaml:"currencies" json:"currencies,omitempty"`
+}
+
+// defaultProcessorFees are the fee schedules of the simulated processors,
+// used unless the config sets a processor's fees
+var defaultProcessorFees = map[string]ProcessorFees{
+	"stripe": {FeeRate: FeeRate{Percent: 2.9, Fixed: 0.30}},
+	"adyen":  {FeeRate: FeeRate{Percent: 2.6, Fixed: 0.12}},
+	"mercadopago": {
+		FeeRate: FeeRate{Percent: 3.49, Fixed: 0.25},
+		Currencies: map[string]FeeRate{
+			"BRL": {Percent: 3.99, Fixed: 0.40},
+			"MXN": {Percent: 3.49, Fixed: 4},
+			"ARS": {Percent: 4.49},
+		},
+	},
+}
+
+// otherProcessorFees apply to processors without a default schedule
+var otherProcessorFees = ProcessorFees{FeeRate: FeeRate{Percent: 2.9, Fixed: 0.30}}
+
+// rate returns the rate charged on transactions in currency
+func (f ProcessorFees) rate(currency string) FeeRate {
+	if r, ok := f.Currencies[currency]; ok {
+		return r
+	}
+	return f.FeeRate
+}
+
+// fee returns the fee on an amount in minor units, in minor units
+func (f ProcessorFees) fee(amountMinor int64, currency string) int64 {
+	r := f.rate(currency)
+	fixed := math.Round(r.Fixed * math.Pow10(currencyExponent(currency)))
+	return int64(math.Round(float64(amountMinor)*r.Percent/100 + fixed))
+}
+
+// processorFees returns a processor's configured fee schedule, else its
+// default one
+func (c *RuntimeConfig) processorFees(name string) ProcessorFees {
+	if p, ok := c.Processors[name]; ok && p.Fees != nil {
+		return *p.Fees
+	}
+	if f, ok := defaultProcessorFees[name]; ok {
+		return f
+	}
+	return otherProcessorFees
+}
+
+// setFee sets the fee the processor will charge on the authorized amount
+// once it is captured and settled
+func (r *AuthorizationResponse) setFee(fees ProcessorFees) {
+	r.FeeAmountMinor = fees.fee(r.AmountMinor, r.Currency)
+	r.FeeAmount = fromMinorUnits(r.FeeAmountMinor, r.Currency)
+}
+
+// validateFees checks a processor's fee schedule, normalizing currencies
+// to upper case
+func validateFees(field string, f *ProcessorFees) []FieldViolation {
+	if f == nil {
+		return nil
+	}
+	violations := validateFeeRate(field, f.FeeRate)
+	for _, currency := range sortedKeys(f.Currencies) {
+		r := f.Currencies[currency]
+		upper := strings.ToUpper(currency)
+		if !iso4217Currencies[upper] {
+			violations = append(violations, FieldViolation{field + ".currencies", fmt.Sprintf("%q is not a valid ISO 4217 currency code", currency)})
+			continue
+		}
+		delete(f.Currencies, currency)
+		f.Currencies[upper] = r
+		violations = append(violations, validateFeeRate(field+".currencies."+upper, r)...)
+	}
+	return violations
+}
+
+func validateFeeRate(field string, r FeeRate) []FieldViolation {
+	var violations []FieldViolation
+	if r.Percent < 0 || r.Percent > 100 {
+		violations = append(violations, FieldViolation{field + ".percent", "must be between 0 and 100"})
+	}
+	if r.Fixed < 0 {
+		violations = append(violations, FieldViolation{field + ".fixed", "must not be negative"})
+	}
+	return violations
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Feature flags gating behaviors that can be rolled out progressively
+const (
+	// flagAsyncMode lets deferred authorizations (batch items, the load
+	// generator) wait on a timer rather than a goroutine
+	flagAsyncMode = "async_mode"
+	// flagSmartRouting lets routing.mode: cost pick processors by expected
+	// cost; off, the merchant is routed by weight
+	flagSmartRouting = "smart_routing"
+	// flagFraudEngine runs the velocity checks and the risk engine
+	flagFraudEngine = "fraud_engine"
+)
+
+// knownFlags describes every flag. All default to on, the behavior before
+// flags existed.
+var knownFlags = map[string]string{
+	flagAsyncMode:    "Deferred authorizations wait on timers instead of goroutines",
+	flagSmartRouting: "Cost-based routing when routing.mode is cost",
+	flagFraudEngine:  "Velocity checks and the risk engine",
+}
+
+// FeatureFlag is one flag of the flags section of the config file. A flag
+// is on for a merchant when it is enabled and the merchant is listed or
+// falls in the rollout percentage.
+type FeatureFlag struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// Rollout is the percentage (0-100) of merchants the flag is on for,
+	// 100 when unset. Merchants stay in or out as it grows.
+	Rollout *float64 `yaml:"rollout" json:"rollout,omitempty"`
+	// Merchants always get the flag while it is enabled
+	Merchants []string `yaml:"merchants" json:"merchants,omitempty"`
+}
+
+// validateFlags checks the flags section of the config
+func validateFlags(flags map[string]FeatureFlag) []FieldViolation {
+	var violations []FieldViolation
+	for _, name := range sortedKeys(flags) {
+		if _, ok := knownFlags[name]; !ok {
+			violations = append(violations, FieldViolation{"flags." + name, "is not a known feature flag"})
+			continue
+		}
+		violations = append(violations, validateFlag("flags."+name+".", flags[name])...)
+	}
+	return violations
+}
+
+// validateFlag checks one flag, prefixing violated fields with prefix
+func validateFlag(prefix string, f FeatureFlag) []FieldViolation {
+	var violations []FieldViolation
+	if f.Rollout != nil && (*f.Rollout < 0 || *f.Rollout > 100) {
+		violations = append(violations, FieldViolation{prefix + "rollout", "must be between 0 and 100"})
+	}
+	for i, merchantID := range f.Merchants {
+		if !merchantIDPattern.MatchString(merchantID) {
+			violations = append(violations, FieldViolation{fmt.Sprintf("%smerchants[%d]", prefix, i), "must be 1-64 characters of letters, digits, '_' or '-'"})
+		}
+	}
+	return violations
+}
+
+// envFlags are the flags set by FEATURE_FLAGS, below the config file
+var envFlags = loadEnvFlags()
+
+// loadEnvFlags reads FEATURE_FLAGS, a comma separated list of
+// name=on|off|<rollout percentage>, e.g. smart_routing=off,fraud_engine=25
+func loadEnvFlags() map[string]FeatureFlag {
+	flags := make(map[string]FeatureFlag)
+	for _, entry := range strings.Split(os.Getenv("FEATURE_FLAGS"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(entry), "=")
+		if name == "" {
+			continue
+		}
+		var f FeatureFlag
+		switch value {
+		case "on", "true":
+			f.Enabled = true
+		case "off", "false":
+		default:
+			rollout, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+			if err != nil {
+				log.Printf("Ignoring FEATURE_FLAGS entry %q: expected on, off or a percentage", entry)
+				continue
+			}
+			f.Enabled, f.Rollout = true, &rollout
+		}
+		if _, ok := knownFlags[name]; !ok {
+			log.Printf("Ignoring FEATURE_FLAGS entry %q: not a known feature flag", entry)
+			continue
+		}
+		if violations := validateFlag("", f); len(violations) > 0 {
+			log.Printf("Ignoring FEATURE_FLAGS entry %q: %s %s", entry, violations[0].Field, violations[0].Message)
+			continue
+		}
+		flags[name] = f
+	}
+	return flags
+}
+
+// flag returns the flag in effect: the config's (file merged with admin
+// overrides), else FEATURE_FLAGS', else on for everyone
+func (c *RuntimeConfig) flag(name string) FeatureFlag {
+	if f, ok := c.Flags[name]; ok {
+		return f
+	}
+	if f, ok := envFlags[name]; ok {
+		return f
+	}
+	return FeatureFlag{Enabled: true}
+}
+
+// flagEnabled reports whether the flag is on for the merchant
+func (c *RuntimeConfig) flagEnabled(name, merchantID string) bool {
+	return c.flag(name).enabledFor(name, merchantID)
+}
+
+func (f FeatureFlag) enabledFor(name, merchantID string) bool {
+	if !f.Enabled {
+		return false
+	}
+	if f.Rollout == nil || *f.Rollout >= 100 {
+		return true
+	}
+	for _, m := range f.Merchants {
+		if m == merchantID {
+			return true
+		}
+	}
+	return float64(rolloutBucket(name, merchantID)) < *f.Rollout*100
+}
+
+// rolloutBucket places a merchant in one of 10000 buckets per flag with
+// FNV-1a, so each flag rolls out to a different, stable set of merchants
+func rolloutBucket(name, merchantID string) uint32 {
+	h := uint32(2166136261)
+	for _, s := range [...]string{name, ":", merchantID} {
+		for i := 0; i < len(s); i++ {
+			h ^= uint32(s[i])
+			h *= 16777619
+		}
+	}
+	return h % 10000
+}
+
+// FlagStatus is a flag as listed by GET /admin/flags
+type FlagStatus struct {
+	FeatureFlag
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Source is where the flag in effect comes from: admin, file, env or
+	// default
+	Source string `json:"source"`
+}
+
+// flagStatuses lists every known flag by name
+func flagStatuses() []FlagStatus {
+	file, admin := configLayers.fileAndAdmin()
+	statuses := make([]FlagStatus, 0, len(knownFlags))
+	for _, name := range sortedKeys(knownFlags) {
+		status := FlagStatus{Name: name, Description: knownFlags[name], FeatureFlag: currentConfig().flag(name), Source: "default"}
+		if _, ok := admin.Flags[name]; ok {
+			status.Source = "admin"
+		} else if _, ok := file.Flags[name]; ok {
+			status.Source = "file"
+		} else if _, ok := envFlags[name]; ok {
+			status.Source = "env"
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// FlagList is the body of the /admin/flags endpoints
+type FlagList struct {
+	Data []FlagStatus `json:"data"`
+}
+
+// handleFlagList lists the feature flags in effect (GET /admin/flags)
+func handleFlagList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(FlagList{Data: flagStatuses()})
+}
+
+// handleFlagPut overrides one flag at runtime (PUT /admin/flags/{name}).
+// The override is part of the /admin/config overrides and outlives config
+// file reloads.
+func handleFlagPut(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := knownFlags[name]; !ok {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Feature flag not found", nil)
+		return
+	}
+	var f FeatureFlag
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON feature flag"}})
+		return
+	}
+	if violations := validateFlag("", f); len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	if !setFlagOverride(w, r, name, &f) {
+		return
+	}
+	log.Printf("Feature flag %s set via admin API: enabled=%t", name, f.Enabled)
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditFlagUpdated, ResourceType: "flag", ResourceID: name})
+	handleFlagList(w, r)
+}
+
+// handleFlagDelete drops a flag's runtime override, falling back to the
+// file, FEATURE_FLAGS or the default (DELETE /admin/flags/{name})
+func handleFlagDelete(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	if _, ok := configLayers.adminOverrides().Flags[name]; !ok {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Feature flag has no override", nil)
+		return
+	}
+	if !setFlagOverride(w, r, name, nil) {
+		return
+	}
+	log.Printf("Feature flag %s override cleared via admin API", name)
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditFlagCleared, ResourceType: "flag", ResourceID: name})
+	handleFlagList(w, r)
+}
+
+// setFlagOverride replaces the admin overrides with a copy whose flag is
+// set to f, or removed when f is nil
+func setFlagOverride(w http.ResponseWriter, r *http.Request, name string, f *FeatureFlag) bool {
+	overrides, violations := configLayers.updateAdmin(func(overrides *RuntimeConfig) {
+		flags := make(map[string]FeatureFlag, len(overrides.Flags)+1)
+		for n, existing := range overrides.Flags {
+			flags[n] = existing
+		}
+		if f != nil {
+			flags[name] = *f
+		} else {
+			delete(flags, name)
+		}
+		overrides.Flags = flags
+		if len(flags) == 0 {
+			overrides.Flags = nil
+		}
+	})
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return false
+	}
+	emitEvent("", eventConfigUpdated, overrides)
+	return true
+}
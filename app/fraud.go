@@ -0,0 +1,205 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Velocity scopes and the limits checked in each
+const (
+	velocityCard     = "card"
+	velocityMerchant = "merchant"
+
+	velocityTransactionsPerMinute = "transactions_per_minute"
+	velocityAmountPerHour         = "amount_per_hour"
+)
+
+var (
+	fraudChecksTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_fraud_checks_total",
+			Help: "Total number of authorizations screened by the fraud module by result",
+		},
+		[]string{"result"},
+	)
+
+	fraudVelocityExceededTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_fraud_velocity_exceeded_total",
+			Help: "Total number of authorizations declined for velocity by scope and limit",
+		},
+		[]string{"scope", "limit"},
+	)
+
+	fraudTrackedKeys = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "voyager_fraud_velocity_tracked_keys",
+			Help: "Card tokens and merchants with authorizations in the last hour",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(fraudChecksTotal)
+	prometheus.MustRegister(fraudVelocityExceededTotal)
+	prometheus.MustRegister(fraudTrackedKeys)
+}
+
+// FraudConfig is the fraud section of the config file
+type FraudConfig struct {
+	// Velocity limits how fast a card token or merchant may authorize
+	Velocity VelocityConfig `yaml:"velocity" json:"velocity"`
+}
+
+// VelocityConfig holds the limits per card token and per merchant
+type VelocityConfig struct {
+	Card     *VelocityLimit `yaml:"card" json:"card,omitempty"`
+	Merchant *VelocityLimit `yaml:"merchant" json:"merchant,omitempty"`
+}
+
+// VelocityLimit caps authorizations over sliding windows; 0 leaves a
+// window unlimited
+type VelocityLimit struct {
+	TransactionsPerMinute int `yaml:"transactions_per_minute" json:"transactions_per_minute,omitempty"`
+	// AmountPerHour is in the FX base currency, USD by default
+	AmountPerHour float64 `yaml:"amount_per_hour" json:"amount_per_hour,omitempty"`
+}
+
+// validateFraud checks the fraud section of the config
+func validateFraud(f *FraudConfig) []FieldViolation {
+	if f == nil {
+		return nil
+	}
+	var violations []FieldViolation
+	check := func(scope string, limit *VelocityLimit) {
+		if limit == nil {
+			return
+		}
+		field := "fraud.velocity." + scope
+		if limit.TransactionsPerMinute < 0 {
+			violations = append(violations, FieldViolation{field + ".transactions_per_minute", "must not be negative"})
+		}
+		if limit.AmountPerHour < 0 {
+			violations = append(violations, FieldViolation{field + ".amount_per_hour", "must not be negative"})
+		}
+	}
+	check(velocityCard, f.Velocity.Card)
+	check(velocityMerchant, f.Velocity.Merchant)
+	return violations
+}
+
+// velocityEntry is one authorization attempt in a velocity window
+type velocityEntry struct {
+	at     time.Time
+	amount float64
+}
+
+// velocityTracker keeps the last hour of attempts per card token and per
+// merchant. Keys are dropped once their window is empty.
+type velocityTracker struct {
+	mu        sync.Mutex
+	entries   map[string][]velocityEntry
+	lastSweep time.Time
+}
+
+var velocity = &velocityTracker{entries: make(map[string][]velocityEntry)}
+
+// record adds an attempt under key and returns the attempts of the last
+// minute and the amount of the last hour, this one included
+func (t *velocityTracker) record(key string, amount float64, now time.Time) (int, float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if now.Sub(t.lastSweep) > time.Minute {
+		t.sweep(now)
+	}
+	window := append(pruneVelocity(t.entries[key], now), velocityEntry{at: now, amount: amount})
+	t.entries[key] = window
+	fraudTrackedKeys.Set(float64(len(t.entries)))
+
+	count, total := 0, 0.0
+	for _, e := range window {
+		total += e.amount
+		if now.Sub(e.at) < time.Minute {
+			count++
+		}
+	}
+	return count, total
+}
+
+// sweep drops keys nobody used in the last hour
+func (t *velocityTracker) sweep(now time.Time) {
+	for key, window := range t.entries {
+		if window = pruneVelocity(window, now); len(window) == 0 {
+			delete(t.entries, key)
+		} else {
+			t.entries[key] = window
+		}
+	}
+	t.lastSweep = now
+}
+
+// pruneVelocity drops the entries older than an hour; window is oldest first
+func pruneVelocity(window []velocityEntry, now time.Time) []velocityEntry {
+	i := 0
+	for i < len(window) && now.Sub(window[i].at) >= time.Hour {
+		i++
+	}
+	return window[i:]
+}
+
+// baseAmount converts an amount to the FX base currency so merchants'
+// amounts in several currencies add up. Currencies without a rate count at
+// face value.
+func baseAmount(amount float64, currency string) float64 {
+	if rate := fxFeed.table().Rates[currency]; rate > 0 {
+		return amount / rate
+	}
+	return amount
+}
+
+// checkVelocity records the authorization against its card token and
+// merchant and reports whether it exceeds a limit. Declined attempts count
+// too, so a card that keeps retrying stays blocked.
+func checkVelocity(req AuthorizationRequest) bool {
+	limits := currentConfig().Fraud
+	if limits == nil || (limits.Velocity.Card == nil && limits.Velocity.Merchant == nil) {
+		return false
+	}
+	now := time.Now()
+	amount := baseAmount(req.Amount, req.Currency)
+	scopes := []struct {
+		name  string
+		key   string
+		limit *VelocityLimit
+	}{
+		{velocityCard, "card:" + req.CardToken, limits.Velocity.Card},
+		{velocityMerchant, "merchant:" + req.MerchantID, limits.Velocity.Merchant},
+	}
+
+	exceeded, scope, limit := false, "", ""
+	for _, s := range scopes {
+		if s.limit == nil {
+			continue
+		}
+		count, total := velocity.record(s.key, amount, now)
+		if exceeded {
+			continue
+		}
+		switch {
+		case s.limit.TransactionsPerMinute > 0 && count > s.limit.TransactionsPerMinute:
+			exceeded, scope, limit = true, s.name, velocityTransactionsPerMinute
+		case s.limit.AmountPerHour > 0 && total > s.limit.AmountPerHour:
+			exceeded, scope, limit = true, s.name, velocityAmountPerHour
+		}
+	}
+	if exceeded {
+		fraudChecksTotal.WithLabelValues("velocity_exceeded").Inc()
+		fraudVelocityExceededTotal.WithLabelValues(scope, limit).Inc()
+	} else {
+		fraudChecksTotal.WithLabelValues("passed").Inc()
+	}
+	return exceeded
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+var fxConversionsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_fx_conversions_total",
+		Help: "Total number of authorizations converted to a settlement currency by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(fxConversionsTotal)
+}
+
+// FXRates is a rate table: how many units of each currency one unit of
+// Base buys. It is the body of GET and PUT /fx/rates.
+type FXRates struct {
+	Base      string             `yaml:"base" json:"base"`
+	Rates     map[string]float64 `yaml:"rates" json:"rates"`
+	Source    string             `yaml:"-" json:"source"`
+	UpdatedAt string             `yaml:"-" json:"updated_at"`
+}
+
+// FXConversion is the settlement side of an authorization made with a
+// settlement_currency
+type FXConversion struct {
+	Currency    string  `json:"currency"`
+	Amount      float64 `json:"amount"`
+	AmountMinor int64   `json:"amount_minor"`
+	// Rate converts the authorization currency into Currency
+	Rate float64 `json:"rate"`
+}
+
+// defaultFXRates is a static snapshot of USD rates, good enough for a
+// simulation; load real ones from FX_RATES_FILE
+var defaultFXRates = FXRates{
+	Base: "USD",
+	Rates: map[string]float64{
+		"USD": 1, "EUR": 0.92, "GBP": 0.79, "CHF": 0.88, "CAD": 1.36, "AUD": 1.52,
+		"JPY": 150, "CNY": 7.2, "INR": 83, "BRL": 5.0, "MXN": 17, "ARS": 850,
+		"CLP": 950, "COP": 3900, "PEN": 3.7, "UYU": 39, "BHD": 0.376, "KWD": 0.307,
+	},
+	Source: "default",
+}
+
+// fxService holds the rate table in effect
+type fxService struct {
+	mu    sync.RWMutex
+	rates FXRates
+}
+
+var fxFeed = &fxService{rates: defaultFXRates}
+
+// loadFXRates replaces the default rates with FX_RATES_FILE, if set
+func loadFXRates() error {
+	path := os.Getenv("FX_RATES_FILE")
+	if path == "" {
+		fxFeed.set(defaultFXRates, "default")
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading FX_RATES_FILE: %w", err)
+	}
+	rates, violations := parseFXRates(data)
+	if len(violations) > 0 {
+		return fmt.Errorf("invalid FX_RATES_FILE: %s %s", violations[0].Field, violations[0].Message)
+	}
+	fxFeed.set(rates, path)
+	return nil
+}
+
+// parseFXRates decodes a YAML or JSON rate table and validates it
+func parseFXRates(data []byte) (FXRates, []FieldViolation) {
+	var rates FXRates
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&rates); err != nil && !errors.Is(err, io.EOF) {
+		return FXRates{}, []FieldViolation{{"body", fmt.Sprintf("must be a valid YAML or JSON rate table: %v", err)}}
+	}
+
+	var violations []FieldViolation
+	rates.Base = strings.ToUpper(rates.Base)
+	if !iso4217Currencies[rates.Base] {
+		violations = append(violations, FieldViolation{"base", "must be a valid ISO 4217 currency code"})
+	}
+	normalized := make(map[string]float64, len(rates.Rates)+1)
+	for currency, rate := range rates.Rates {
+		currency = strings.ToUpper(currency)
+		if !iso4217Currencies[currency] {
+			violations = append(violations, FieldViolation{"rates." + currency, "is not a valid ISO 4217 currency code"})
+		} else if math.IsNaN(rate) || math.IsInf(rate, 0) || rate <= 0 {
+			violations = append(violations, FieldViolation{"rates." + currency, "must be a positive number"})
+		}
+		normalized[currency] = rate
+	}
+	sort.Slice(violations, func(i, j int) bool { return violations[i].Field < violations[j].Field })
+	if rate, ok := normalized[rates.Base]; ok && rate != 1 {
+		violations = append(violations, FieldViolation{"rates." + rates.Base, "must be 1 for the base currency"})
+	}
+	normalized[rates.Base] = 1
+	rates.Rates = normalized
+	return rates, violations
+}
+
+func (s *fxService) set(rates FXRates, source string) {
+	rates.Source = source
+	rates.UpdatedAt = formatTimestamp(time.Now())
+	s.mu.Lock()
+	s.rates = rates
+	s.mu.Unlock()
+}
+
+func (s *fxService) table() FXRates {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.rates
+}
+
+// supports reports whether the table has a rate for currency
+func (s *fxService) supports(currency string) bool {
+	_, ok := s.table().Rates[currency]
+	return ok
+}
+
+// convert quotes minor units of from in to. The rate is rounded to six
+// decimals before it is applied, so the response shows the rate used.
+func (s *fxService) convert(minor int64, from, to string) FXConversion {
+	table := s.table()
+	rate := math.Round(table.Rates[to]/table.Rates[from]*1e6) / 1e6
+	amount := roundAmount(fromMinorUnits(minor, from)*rate, to)
+	converted, _ := toMinorUnits(amount, to)
+	return FXConversion{Currency: to, Amount: amount, AmountMinor: converted, Rate: rate}
+}
+
+// fxUnavailable reports whether an fx_outage chaos experiment has taken
+// the rate feed down
+func fxUnavailable() bool {
+	for _, e := range chaos.active() {
+		if e.Type == chaosFXOutage {
+			return true
+		}
+	}
+	return false
+}
+
+// convertSettlement quotes req's settlement amount, rejecting it while the
+// rate feed is down
+func convertSettlement(req *AuthorizationRequest) *authorizationRejection {
+	if req.SettlementCurrency == "" || req.SettlementCurrency == req.Currency {
+		return nil
+	}
+	if fxUnavailable() {
+		chaosInjectionsTotal.WithLabelValues(chaosFXOutage).Inc()
+		fxConversionsTotal.WithLabelValues("unavailable").Inc()
+		return &authorizationRejection{
+			Status: http.StatusServiceUnavailable, Code: errCodeFXUnavailable,
+			Message: "FX rates are unavailable; retry later or authorize without settlement_currency",
+		}
+	}
+	conversion := fxFeed.convert(*req.AmountMinor, req.Currency, req.SettlementCurrency)
+	req.settlement = &conversion
+	fxConversionsTotal.WithLabelValues("converted").Inc()
+	return nil
+}
+
+// handleFXRates returns the rate table in effect (GET /fx/rates)
+func handleFXRates(w http.ResponseWriter, r *http.Request) {
+	if fxUnavailable() {
+		chaosInjectionsTotal.WithLabelValues(chaosFXOutage).Inc()
+		writeError(w, r, http.StatusServiceUnavailable, errCodeFXUnavailable, "FX rates are unavailable", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(fxFeed.table())
+}
+
+// handleFXRatesPut replaces the rate table (PUT /admin/fx/rates)
+func handleFXRatesPut(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "could not be read"}})
+		return
+	}
+	rates, violations := parseFXRates(data)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	fxFeed.set(rates, "admin")
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(fxFeed.table())
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	graphql "github.com/graph-gophers/graphql-go"
+)
+
+// graphqlMaxDepth caps how deeply selections nest, so a query can't walk
+// merchant -> transactions -> merchant -> ... without end
+const graphqlMaxDepth = 8
+
+// graphqlSchemaSource is the read-only schema served at /graphql. Amounts
+// are decimal, in the currency's major unit.
+const graphqlSchemaSource = `
+schema {
+	query: Query
+}
+
+type Query {
+	transaction(id: ID!): Transaction
+	transactions(merchantId: String, status: String, createdFrom: String, createdTo: String, first: Int = 50, after: ID): TransactionPage!
+	merchant(id: ID!): Merchant
+	merchants: [Merchant!]!
+	settlement(id: ID!): Settlement
+	settlements(merchantId: String, processor: String): [Settlement!]!
+	dispute(id: ID!): Dispute
+	disputes(merchantId: String, transactionId: String, status: String): [Dispute!]!
+}
+
+type TransactionPage {
+	data: [Transaction!]!
+	hasMore: Boolean!
+}
+
+type Transaction {
+	id: ID!
+	merchantId: String!
+	merchant: Merchant!
+	status: String!
+	amount: Float!
+	currency: String!
+	processor: String
+	authCode: String
+	processorReference: String
+	declineReason: String
+	capturedAmount: Float!
+	refundedAmount: Float!
+	createdAt: String!
+	updatedAt: String!
+	refunds: [Refund!]!
+	disputes: [Dispute!]!
+}
+
+type Refund {
+	id: ID!
+	status: String!
+	amount: Float!
+	currency: String!
+	reason: String
+	createdAt: String!
+}
+
+type Merchant {
+	id: ID!
+	name: String
+	disabled: Boolean!
+	balances: [Balance!]!
+	transactions(status: String, createdFrom: String, createdTo: String, first: Int = 50, after: ID): TransactionPage!
+	settlements(processor: String): [Settlement!]!
+	disputes(status: String): [Dispute!]!
+}
+
+type Balance {
+	currency: String!
+	balance: Float!
+	pending: Float!
+	reserved: Float!
+	available: Float!
+}
+
+type Settlement {
+	id: ID!
+	processor: String!
+	merchantId: String!
+	merchant: Merchant!
+	currency: String!
+	transactionCount: Int!
+	grossAmount: Float!
+	refundedAmount: Float!
+	feeAmount: Float!
+	netAmount: Float!
+	createdAt: String!
+	items: [SettlementItem!]!
+}
+
+type SettlementItem {
+	transactionId: String!
+	transaction: Transaction
+	processorReference: String
+	capturedAmount: Float!
+	refundedAmount: Float!
+	feeAmount: Float!
+	netAmount: Float!
+}
+
+type Dispute {
+	id: ID!
+	transactionId: String!
+	transaction: Transaction
+	merchantId: String!
+	merchant: Merchant!
+	status: String!
+	reason: String!
+	amount: Float!
+	currency: String!
+	evidence: String
+	evidenceDueBy: String!
+	resolvesAt: String
+	createdAt: String!
+	updatedAt: String!
+}
+`
+
+var graphqlSchema = graphql.MustParseSchema(graphqlSchemaSource, &graphqlResolver{}, graphql.MaxDepth(graphqlMaxDepth))
+
+// GraphQLRequest is the body of POST /graphql
+type GraphQLRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName,omitempty"`
+	Variables     map[string]interface{} `json:"variables,omitempty"`
+}
+
+// handleGraphQL runs a read-only GraphQL query (GET or POST /graphql).
+// GET takes query, operationName and variables (JSON) parameters. Like the
+// REST endpoints, an authenticated merchant only sees its own data.
+func handleGraphQL(w http.ResponseWriter, r *http.Request) {
+	var req GraphQLRequest
+	if r.Method == http.MethodGet {
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				writeValidationError(w, r, []FieldViolation{{"variables", "must be a JSON object"}})
+				return
+			}
+		}
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON GraphQL request"}})
+		return
+	}
+	if req.Query == "" {
+		writeValidationError(w, r, []FieldViolation{{"query", "is required"}})
+		return
+	}
+
+	response := graphqlSchema.Exec(r.Context(), req.Query, req.OperationName, req.Variables)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// errGraphQLStorage is the error a field resolves to when storage fails;
+// the cause is logged rather than shown
+var errGraphQLStorage = errors.New("storage unavailable")
+
+// graphqlStorageError counts and logs a failed storage operation
+func graphqlStorageError(op string, err error) error {
+	storageErrorsTotal.WithLabelValues(op).Inc()
+	log.Printf("GraphQL %s failed: %v", op, err)
+	return errGraphQLStorage
+}
+
+// visibleTo reports whether the caller of ctx may see merchantID's data
+func visibleTo(ctx context.Context, merchantID string) bool {
+	caller, ok := merchantFromContext(ctx)
+	return !ok || caller == merchantID
+}
+
+// scopedMerchant returns the merchant a listing is restricted to: the
+// authenticated merchant if any, else the requested one
+func scopedMerchant(ctx context.Context, requested *string) string {
+	if caller, ok := merchantFromContext(ctx); ok {
+		return caller
+	}
+	return deref(requested)
+}
+
+// deref returns the value of an optional argument, "" when absent
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+// optional returns nil for "", so empty fields resolve to null
+func optional(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+// graphqlResolver resolves the Query type
+type graphqlResolver struct{}
+
+type transactionArgs struct {
+	MerchantID  *string
+	Status      *string
+	CreatedFrom *string
+	CreatedTo   *string
+	First       int32
+	After       *graphql.ID
+}
+
+// filter turns the arguments into a transaction filter, as GET
+// /transactions does its query parameters
+func (a transactionArgs) filter() (TransactionFilter, error) {
+	if a.First < 1 || a.First > maxTransactionPageSize {
+		return TransactionFilter{}, fmt.Errorf("first must be between 1 and %d", maxTransactionPageSize)
+	}
+	filter := TransactionFilter{MerchantID: deref(a.MerchantID), Status: deref(a.Status), Limit: int(a.First)}
+	if a.After != nil {
+		filter.StartingAfter = string(*a.After)
+	}
+	for _, bound := range []struct {
+		name  string
+		value *string
+		dest  *time.Time
+	}{{"createdFrom", a.CreatedFrom, &filter.CreatedFrom}, {"createdTo", a.CreatedTo, &filter.CreatedTo}} {
+		if bound.value == nil {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, *bound.value)
+		if err != nil {
+			return TransactionFilter{}, fmt.Errorf("%s must be an RFC 3339 timestamp", bound.name)
+		}
+		*bound.dest = t
+	}
+	return filter, nil
+}
+
+// listTransactions loads one page of transactions
+func listTransactions(ctx context.Context, filter TransactionFilter) (*transactionPageResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+
+	// One extra row tells whether another page follows
+	pageSize := filter.Limit
+	filter.Limit++
+	txns, err := tenantStore(ctx).List(ctx, filter)
+	if err == errRecordNotFound {
+		return nil, errors.New("after must be the ID of a listed transaction")
+	}
+	if err != nil {
+		return nil, graphqlStorageError("list_transactions", err)
+	}
+	page := &transactionPageResolver{hasMore: len(txns) > pageSize}
+	if page.hasMore {
+		txns = txns[:pageSize]
+	}
+	for _, txn := range txns {
+		page.data = append(page.data, &transactionResolver{txn.withMinorUnits()})
+	}
+	return page, nil
+}
+
+// loadGraphQLTransaction returns the transaction, or nil if it doesn't
+// exist or belongs to another merchant
+func loadGraphQLTransaction(ctx context.Context, id string) (*transactionResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	txn, err := tenantStore(ctx).Get(ctx, id)
+	if err == errRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlStorageError("get_transaction", err)
+	}
+	if !visibleTo(ctx, txn.MerchantID) {
+		return nil, nil
+	}
+	return &transactionResolver{txn.withMinorUnits()}, nil
+}
+
+func listSettlements(ctx context.Context, filter SettlementFilter) ([]*settlementResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	settlements, err := storage.settlements(ctx, filter)
+	if err != nil {
+		return nil, graphqlStorageError("list_settlements", err)
+	}
+	result := make([]*settlementResolver, 0, len(settlements))
+	for _, s := range settlements {
+		result = append(result, &settlementResolver{s.withMinorUnits()})
+	}
+	return result, nil
+}
+
+func listDisputes(ctx context.Context, filter DisputeFilter) ([]*disputeResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	disputes, err := storage.disputes(ctx, filter)
+	if err != nil {
+		return nil, graphqlStorageError("list_disputes", err)
+	}
+	result := make([]*disputeResolver, 0, len(disputes))
+	for _, d := range disputes {
+		result = append(result, &disputeResolver{d})
+	}
+	return result, nil
+}
+
+func (graphqlResolver) Transaction(ctx context.Context, args struct{ ID graphql.ID }) (*transactionResolver, error) {
+	return loadGraphQLTransaction(ctx, string(args.ID))
+}
+
+func (graphqlResolver) Transactions(ctx context.Context, args transactionArgs) (*transactionPageResolver, error) {
+	filter, err := args.filter()
+	if err != nil {
+		return nil, err
+	}
+	filter.MerchantID = scopedMerchant(ctx, args.MerchantID)
+	return listTransactions(ctx, filter)
+}
+
+func (graphqlResolver) Merchant(ctx context.Context, args struct{ ID graphql.ID }) *merchantResolver {
+	if !visibleTo(ctx, string(args.ID)) {
+		return nil
+	}
+	return &merchantResolver{id: string(args.ID)}
+}
+
+// Merchants lists the registered merchants, or just the caller's own
+func (graphqlResolver) Merchants(ctx context.Context) []*merchantResolver {
+	if caller, ok := merchantFromContext(ctx); ok {
+		return []*merchantResolver{{id: caller}}
+	}
+	ids := sortedKeys(currentConfig().Merchants)
+	merchants := make([]*merchantResolver, 0, len(ids))
+	for _, id := range ids {
+		merchants = append(merchants, &merchantResolver{id: id})
+	}
+	return merchants
+}
+
+func (graphqlResolver) Settlement(ctx context.Context, args struct{ ID graphql.ID }) (*settlementResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	s, err := storage.settlement(ctx, string(args.ID))
+	if err == errRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlStorageError("get_settlement", err)
+	}
+	if !visibleTo(ctx, s.MerchantID) {
+		return nil, nil
+	}
+	return &settlementResolver{s.withMinorUnits()}, nil
+}
+
+func (graphqlResolver) Settlements(ctx context.Context, args struct{ MerchantID, Processor *string }) ([]*settlementResolver, error) {
+	return listSettlements(ctx, SettlementFilter{MerchantID: scopedMerchant(ctx, args.MerchantID), Processor: deref(args.Processor)})
+}
+
+func (graphqlResolver) Dispute(ctx context.Context, args struct{ ID graphql.ID }) (*disputeResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	d, err := storage.dispute(ctx, string(args.ID))
+	if err == errRecordNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, graphqlStorageError("get_dispute", err)
+	}
+	if !visibleTo(ctx, d.MerchantID) {
+		return nil, nil
+	}
+	return &disputeResolver{d}, nil
+}
+
+func (graphqlResolver) Disputes(ctx context.Context, args struct{ MerchantID, TransactionID, Status *string }) ([]*disputeResolver, error) {
+	return listDisputes(ctx, DisputeFilter{
+		MerchantID:    scopedMerchant(ctx, args.MerchantID),
+		TransactionID: deref(args.TransactionID),
+		Status:        deref(args.Status),
+	})
+}
+
+type transactionPageResolver struct {
+	data    []*transactionResolver
+	hasMore bool
+}
+
+func (p *transactionPageResolver) Data() []*transactionResolver {
+	if p.data == nil {
+		return []*transactionResolver{}
+	}
+	return p.data
+}
+
+func (p *transactionPageResolver) HasMore() bool { return p.hasMore }
+
+type transactionResolver struct{ txn Transaction }
+
+func (t *transactionResolver) ID() graphql.ID     { return graphql.ID(t.txn.TransactionID) }
+func (t *transactionResolver) MerchantID() string { return t.txn.MerchantID }
+func (t *transactionResolver) Merchant() *merchantResolver {
+	return &merchantResolver{id: t.txn.MerchantID}
+}
+func (t *transactionResolver) Status() string              { return t.txn.Status }
+func (t *transactionResolver) Amount() float64             { return t.txn.Amount }
+func (t *transactionResolver) Currency() string            { return t.txn.Currency }
+func (t *transactionResolver) Processor() *string          { return optional(t.txn.Processor) }
+func (t *transactionResolver) AuthCode() *string           { return optional(t.txn.AuthCode) }
+func (t *transactionResolver) ProcessorReference() *string { return optional(t.txn.ProcessorReference) }
+func (t *transactionResolver) DeclineReason() *string      { return optional(t.txn.DeclineReason) }
+func (t *transactionResolver) CapturedAmount() float64     { return t.txn.CapturedAmount }
+func (t *transactionResolver) RefundedAmount() float64     { return t.txn.RefundedAmount }
+func (t *transactionResolver) CreatedAt() string           { return t.txn.CreatedAt }
+func (t *transactionResolver) UpdatedAt() string           { return t.txn.UpdatedAt }
+func (t *transactionResolver) Disputes(ctx context.Context) ([]*disputeResolver, error) {
+	return listDisputes(ctx, DisputeFilter{TransactionID: t.txn.TransactionID})
+}
+
+func (t *transactionResolver) Refunds(ctx context.Context) ([]*refundResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	refunds, err := tenantStore(ctx).refunds(ctx, t.txn.TransactionID)
+	if err != nil {
+		return nil, graphqlStorageError("list_refunds", err)
+	}
+	result := make([]*refundResolver, 0, len(refunds))
+	for _, refund := range refunds {
+		result = append(result, &refundResolver{refund})
+	}
+	return result, nil
+}
+
+type refundResolver struct{ refund Refund }
+
+func (r *refundResolver) ID() graphql.ID    { return graphql.ID(r.refund.RefundID) }
+func (r *refundResolver) Status() string    { return r.refund.Status }
+func (r *refundResolver) Amount() float64   { return r.refund.Amount }
+func (r *refundResolver) Currency() string  { return r.refund.Currency }
+func (r *refundResolver) Reason() *string   { return optional(r.refund.Reason) }
+func (r *refundResolver) CreatedAt() string { return r.refund.CreatedAt }
+
+// merchantResolver resolves any merchant ID, registered or not, since
+// transactions aren't limited to registered merchants
+type merchantResolver struct{ id string }
+
+func (m *merchantResolver) ID() graphql.ID { return graphql.ID(m.id) }
+
+func (m *merchantResolver) Name() *string {
+	profile, _ := currentConfig().merchantProfile(m.id)
+	return optional(profile.Name)
+}
+
+func (m *merchantResolver) Disabled() bool {
+	profile, _ := currentConfig().merchantProfile(m.id)
+	return profile.Disabled
+}
+
+func (m *merchantResolver) Balances(ctx context.Context) ([]*balanceResolver, error) {
+	ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+	defer cancel()
+	balances, err := merchantBalancesAt(ctx, m.id, time.Now())
+	if err != nil {
+		return nil, graphqlStorageError("ledger_totals", err)
+	}
+	result := make([]*balanceResolver, 0, len(balances))
+	for _, b := range balances {
+		result = append(result, &balanceResolver{b})
+	}
+	return result, nil
+}
+
+func (m *merchantResolver) Transactions(ctx context.Context, args transactionArgs) (*transactionPageResolver, error) {
+	filter, err := args.filter()
+	if err != nil {
+		return nil, err
+	}
+	filter.MerchantID = m.id
+	return listTransactions(ctx, filter)
+}
+
+func (m *merchantResolver) Settlements(ctx context.Context, args struct{ Processor *string }) ([]*settlementResolver, error) {
+	return listSettlements(ctx, SettlementFilter{MerchantID: m.id, Processor: deref(args.Processor)})
+}
+
+func (m *merchantResolver) Disputes(ctx context.Context, args struct{ Status *string }) ([]*disputeResolver, error) {
+	return listDisputes(ctx, DisputeFilter{MerchantID: m.id, Status: deref(args.Status)})
+}
+
+type balanceResolver struct{ b MerchantBalance }
+
+func (b *balanceResolver) Currency() string   { return b.b.Currency }
+func (b *balanceResolver) Balance() float64   { return b.b.Balance }
+func (b *balanceResolver) Pending() float64   { return b.b.Pending }
+func (b *balanceResolver) Reserved() float64  { return b.b.Reserved }
+func (b *balanceResolver) Available() float64 { return b.b.Available }
+
+type settlementResolver struct{ s Settlement }
+
+func (s *settlementResolver) ID() graphql.ID     { return graphql.ID(s.s.SettlementID) }
+func (s *settlementResolver) Processor() string  { return s.s.Processor }
+func (s *settlementResolver) MerchantID() string { return s.s.MerchantID }
+func (s *settlementResolver) Merchant() *merchantResolver {
+	return &merchantResolver{id: s.s.MerchantID}
+}
+func (s *settlementResolver) Currency() string        { return s.s.Currency }
+func (s *settlementResolver) TransactionCount() int32 { return int32(s.s.TransactionCount) }
+func (s *settlementResolver) GrossAmount() float64    { return s.s.GrossAmount }
+func (s *settlementResolver) RefundedAmount() float64 { return s.s.RefundedAmount }
+func (s *settlementResolver) FeeAmount() float64      { return s.s.FeeAmount }
+func (s *settlementResolver) NetAmount() float64      { return s.s.NetAmount }
+func (s *settlementResolver) CreatedAt() string       { return s.s.CreatedAt }
+
+// Items loads the batch's items, which settlement listings leave out
+func (s *settlementResolver) Items(ctx context.Context) ([]*settlementItemResolver, error) {
+	items := s.s.Items
+	if items == nil && s.s.TransactionCount > 0 {
+		ctx, cancel := context.WithTimeout(ctx, storageTimeout)
+		defer cancel()
+		full, err := storage.settlement(ctx, s.s.SettlementID)
+		if err != nil {
+			return nil, graphqlStorageError("get_settlement", err)
+		}
+		items = full.Items
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].TransactionID < items[j].TransactionID })
+	result := make([]*settlementItemResolver, 0, len(items))
+	for _, item := range items {
+		result = append(result, &settlementItemResolver{item})
+	}
+	return result, nil
+}
+
+type settlementItemResolver struct{ item SettlementItem }
+
+func (i *settlementItemResolver) TransactionID() string { return i.item.TransactionID }
+func (i *settlementItemResolver) ProcessorReference() *string {
+	return optional(i.item.ProcessorReference)
+}
+func (i *settlementItemResolver) CapturedAmount() float64 { return i.item.CapturedAmount }
+func (i *settlementItemResolver) RefundedAmount() float64 { return i.item.RefundedAmount }
+func (i *settlementItemResolver) FeeAmount() float64      { return i.item.FeeAmount }
+func (i *settlementItemResolver) NetAmount() float64      { return i.item.NetAmount }
+func (i *settlementItemResolver) Transaction(ctx context.Context) (*transactionResolver, error) {
+	return loadGraphQLTransaction(ctx, i.item.TransactionID)
+}
+
+type disputeResolver struct{ d Dispute }
+
+func (d *disputeResolver) ID() graphql.ID              { return graphql.ID(d.d.DisputeID) }
+func (d *disputeResolver) TransactionID() string       { return d.d.TransactionID }
+func (d *disputeResolver) MerchantID() string          { return d.d.MerchantID }
+func (d *disputeResolver) Merchant() *merchantResolver { return &merchantResolver{id: d.d.MerchantID} }
+func (d *disputeResolver) Status() string              { return d.d.Status }
+func (d *disputeResolver) Reason() string              { return d.d.Reason }
+func (d *disputeResolver) Amount() float64             { return d.d.Amount }
+func (d *disputeResolver) Currency() string            { return d.d.Currency }
+func (d *disputeResolver) Evidence() *string           { return optional(d.d.Evidence) }
+func (d *disputeResolver) EvidenceDueBy() string       { return d.d.EvidenceDueBy }
+func (d *disputeResolver) ResolvesAt() *string         { return optional(d.d.ResolvesAt) }
+func (d *disputeResolver) CreatedAt() string           { return d.d.CreatedAt }
+func (d *disputeResolver) UpdatedAt() string           { return d.d.UpdatedAt }
+func (d *disputeResolver) Transaction(ctx context.Context) (*transactionResolver, error) {
+	return loadGraphQLTransaction(ctx, d.d.TransactionID)
+}
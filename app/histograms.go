@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultLatencyBuckets suit the default simulated latencies; chaos tests
+// with seconds of injected latency need LATENCY_BUCKETS
+var defaultLatencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5}
+
+// latencyHistogramOpts are the options shared by the authorization and
+// processor latency histograms: classic buckets from LATENCY_BUCKETS and,
+// with NATIVE_HISTOGRAMS=true, a native histogram alongside them.
+// Invalid settings fall back to the defaults here; loadHistogramConfig
+// reports them at startup.
+func latencyHistogramOpts(name, help string) prometheus.HistogramOpts {
+	opts := prometheus.HistogramOpts{Name: name, Help: help, Buckets: defaultLatencyBuckets}
+	if buckets, err := parseLatencyBuckets(os.Getenv("LATENCY_BUCKETS")); err == nil && buckets != nil {
+		opts.Buckets = buckets
+	}
+	if getEnv("NATIVE_HISTOGRAMS", "false") == "true" {
+		opts.NativeHistogramBucketFactor = getNativeHistogramBucketFactor()
+		opts.NativeHistogramMaxBucketNumber = 160
+		opts.NativeHistogramMinResetDuration = time.Hour
+	}
+	return opts
+}
+
+// parseLatencyBuckets parses a comma separated list of upper bounds in
+// seconds, which must be increasing. Empty means the defaults (nil).
+func parseLatencyBuckets(spec string) ([]float64, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+	var buckets []float64
+	for _, field := range strings.Split(spec, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || bound <= 0 {
+			return nil, fmt.Errorf("bucket %q must be a positive number of seconds", field)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("buckets must be in increasing order")
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
+
+// getNativeHistogramBucketFactor returns NATIVE_HISTOGRAM_BUCKET_FACTOR,
+// default 1.1: each bucket is at most 10% wider than the previous one
+func getNativeHistogramBucketFactor() float64 {
+	factor, err := strconv.ParseFloat(getEnv("NATIVE_HISTOGRAM_BUCKET_FACTOR", "1.1"), 64)
+	if err != nil || factor <= 1 {
+		return 1.1
+	}
+	return factor
+}
+
+// loadHistogramConfig rejects an invalid LATENCY_BUCKETS, which the
+// histograms, created before main runs, silently replaced with defaults
+func loadHistogramConfig() error {
+	if _, err := parseLatencyBuckets(os.Getenv("LATENCY_BUCKETS")); err != nil {
+		return fmt.Errorf("invalid LATENCY_BUCKETS: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// idempotencyKeyHeader lets a client retry a POST safely: the first
+// response for a key is stored and replayed for every retry
+const idempotencyKeyHeader = "Idempotency-Key"
+
+var idempotentRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_idempotent_requests_total",
+		Help: "Total number of requests carrying an Idempotency-Key by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(idempotentRequestsTotal)
+}
+
+// idempotencyInFlight holds keys whose first request is still running, so
+// a retry sent too early gets a 409 instead of a second payment. It is
+// shared, so with CACHE_BACKEND=redis the retry can't slip through on
+// another replica. Keys expire after the request timeout in case the
+// replica holding one dies.
+var idempotencyInFlight = newTTLCache[bool]("idempotency_in_flight", 100000, true)
+
+// recordingResponseWriter keeps a copy of the status and body written
+type recordingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.body.Write(b)
+	return w.ResponseWriter.Write(b)
+}
+
+// withIdempotency replays the stored response when a POST repeats an
+// Idempotency-Key. Keys are scoped to the authenticated merchant and bound
+// to the request they were first used with.
+func withIdempotency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" || r.Method != http.MethodPost {
+			next(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeValidationError(w, r, []FieldViolation{{idempotencyKeyHeader, "must be at most 255 characters"}})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeValidationError(w, r, []FieldViolation{{"body", "could not be read"}})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		merchantID, _ := merchantFromContext(r.Context())
+		hash := sha256.Sum256(append([]byte(r.Method+" "+r.URL.Path+"\n"), body...))
+		requestHash := hex.EncodeToString(hash[:])
+
+		// Tenant and merchant IDs can't contain ':'
+		scopedKey := tenantFromContext(r.Context()).label() + ":" + merchantID + ":" + key
+		if !idempotencyInFlight.add(scopedKey, true, getRequestTimeout()) {
+			idempotentRequestsTotal.WithLabelValues("in_progress").Inc()
+			writeError(w, r, http.StatusConflict, errCodeIdempotencyKeyInUse,
+				"A request with this Idempotency-Key is still being processed", nil)
+			return
+		}
+		defer idempotencyInFlight.delete(scopedKey)
+
+		ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+		defer cancel()
+		store := tenantStore(ctx)
+		rec, shared := sharedIdempotencyRecord(ctx, scopedKey)
+		if !shared {
+			rec, err = store.idempotencyRecord(ctx, merchantID, key)
+		}
+		switch {
+		case err == errRecordNotFound || (err == nil && time.Since(rec.CreatedAt) > getIdempotencyKeyTTL()):
+		case err != nil:
+			storageErrorsTotal.WithLabelValues("get_idempotency_key").Inc()
+			log.Printf("Failed to look up idempotency key: %v", err)
+			writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+			return
+		case rec.RequestHash != requestHash:
+			idempotentRequestsTotal.WithLabelValues("mismatch").Inc()
+			writeError(w, r, http.StatusUnprocessableEntity, errCodeIdempotencyKeyReused,
+				"Idempotency-Key was already used with a different request", nil)
+			return
+		default:
+			idempotentRequestsTotal.WithLabelValues("replayed").Inc()
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rec.StatusCode)
+			_, _ = w.Write(rec.Body)
+			return
+		}
+
+		recorder := &recordingResponseWriter{ResponseWriter: w}
+		next(recorder, r)
+		idempotentRequestsTotal.WithLabelValues("processed").Inc()
+
+		// Transient failures are not stored so the client can retry them
+		if recorder.status >= 500 || recorder.status == http.StatusTooManyRequests || recorder.status == http.StatusConflict {
+			return
+		}
+		rec = idempotencyRecord{
+			MerchantID:  merchantID,
+			Key:         key,
+			RequestHash: requestHash,
+			StatusCode:  recorder.status,
+			Body:        recorder.body.Bytes(),
+			CreatedAt:   time.Now(),
+		}
+		shareIdempotencyRecord(scopedKey, rec)
+		if err = store.saveIdempotencyRecord(context.Background(), rec); err != nil {
+			storageErrorsTotal.WithLabelValues("save_idempotency_key").Inc()
+			log.Printf("Failed to save idempotency key: %v", err)
+		}
+	}
+}
+
+// purgeIdempotencyRecords deletes the idempotency records older than
+// IDEMPOTENCY_KEY_TTL_HOURS from every store, since they are never
+// replayed again, and returns how many it deleted
+func purgeIdempotencyRecords(ctx context.Context, now time.Time) (int64, error) {
+	cutoff := now.Add(-getIdempotencyKeyTTL())
+	var purged int64
+	for _, store := range append([]transactionStore{storage}, tenants.stores()...) {
+		n, err := store.purgeIdempotencyRecords(ctx, cutoff)
+		if err != nil {
+			storageErrorsTotal.WithLabelValues("purge_idempotency").Inc()
+			return purged, fmt.Errorf("purging idempotency keys: %w", err)
+		}
+		purged += n
+	}
+	return purged, nil
+}
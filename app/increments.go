@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Incremental authorization results, the result label of
+// voyager_authorization_increments_total
+const (
+	incrementApproved    = "approved"
+	incrementDeclined    = "declined"
+	incrementUnsupported = "unsupported"
+	incrementError       = "error"
+	// incrementReversed increments were approved but couldn't be recorded,
+	// and were given back to the processor
+	incrementReversed = "reversed"
+)
+
+var authorizationIncrementsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_authorization_increments_total",
+		Help: "Total number of incremental authorization attempts by processor and result (approved, declined, unsupported, error or reversed)",
+	},
+	[]string{"processor", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(authorizationIncrementsTotal)
+}
+
+// IncrementRequest is the body of POST /authorize/{id}/increment: the
+// amount to add to the authorization, in minor units or legacy decimal
+// form
+type IncrementRequest struct {
+	AmountMinor *int64  `json:"amount_minor,omitempty"`
+	Amount      float64 `json:"amount,omitempty"`
+	// SettlementCurrency asks for the raised authorization to be quoted in
+	// another currency, as on POST /authorize
+	SettlementCurrency string `json:"settlement_currency,omitempty"`
+}
+
+// AuthorizationIncrement is a raise of an open authorization, returned
+// with the transaction as it stands after it
+type AuthorizationIncrement struct {
+	IncrementID   string  `json:"increment_id"`
+	TransactionID string  `json:"transaction_id"`
+	Amount        float64 `json:"amount"`
+	AmountMinor   int64   `json:"amount_minor"`
+	Currency      string  `json:"currency"`
+	AuthCode      string  `json:"auth_code,omitempty"`
+	// Settlement is the raised authorized amount in settlement_currency
+	Settlement *FXConversion `json:"settlement,omitempty"`
+	// FeeAmount is what the processor will charge on the raised authorized
+	// amount once it is captured and settled
+	FeeAmount      float64     `json:"fee_amount"`
+	FeeAmountMinor int64       `json:"fee_amount_minor"`
+	CreatedAt      string      `json:"created_at"`
+	Transaction    Transaction `json:"transaction"`
+}
+
+func newIncrementID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "inc_" + hex.EncodeToString(b)
+}
+
+// handleAuthorizationIncrement raises the authorized amount of an approved
+// or partially captured transaction (POST /authorize/{id}/increment), as a
+// hotel does when a stay is extended. Only processors configured with
+// incremental_authorization take it; the issuer may decline it.
+func handleAuthorizationIncrement(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req IncrementRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON increment request"}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	txn, ok := loadTransaction(ctx, w, r, id)
+	if !ok {
+		return
+	}
+	if !authorizationOpen(ctx, w, r, txn) {
+		return
+	}
+	if txn.Status != "approved" && txn.Status != statusPartiallyCaptured {
+		writeError(w, r, http.StatusConflict, errCodeInvalidTransactionState,
+			fmt.Sprintf("Only approved or partially captured authorizations can be incremented; this one is %s", txn.Status), nil)
+		return
+	}
+	amount, amountMinor, violations := resolveAmount("amount", req.AmountMinor, req.Amount, txn.Currency, false)
+	violations = append(violations, validateIncrementSettlement(&req, txn.Currency)...)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	if violation, ok := incrementWithinMaxAmount(txn, amount); !ok {
+		writeValidationError(w, r, []FieldViolation{violation})
+		return
+	}
+	if req.SettlementCurrency != "" && fxUnavailable() {
+		chaosInjectionsTotal.WithLabelValues(chaosFXOutage).Inc()
+		fxConversionsTotal.WithLabelValues("unavailable").Inc()
+		writeError(w, r, http.StatusServiceUnavailable, errCodeFXUnavailable,
+			"FX rates are unavailable; retry later or increment without settlement_currency", nil)
+		return
+	}
+
+	p, ok := processors.get(txn.Processor)
+	incrementer, supported := p.(incrementalAuthorizer)
+	if !ok || !supported || !currentConfig().incrementalAuthorization(txn.Processor) {
+		authorizationIncrementsTotal.WithLabelValues(txn.Processor, incrementUnsupported).Inc()
+		writeError(w, r, http.StatusUnprocessableEntity, errCodeIncrementUnsupported,
+			fmt.Sprintf("Processor %s doesn't support incremental authorization", txn.Processor), nil)
+		return
+	}
+	// The issuer may take as long as an authorization, which the storage
+	// deadline isn't meant for
+	callCtx, cancelCall := context.WithTimeout(r.Context(), getRequestTimeout())
+	defer cancelCall()
+	result, err := incrementer.IncrementAuthorization(callCtx, txn, amount)
+	if err != nil {
+		authorizationIncrementsTotal.WithLabelValues(txn.Processor, incrementError).Inc()
+		writeError(w, r, http.StatusBadGateway, errCodeProcessorUnavailable,
+			fmt.Sprintf("Processor %s could not process the increment: %v", txn.Processor, err), nil)
+		return
+	}
+	if !result.Approved {
+		authorizationIncrementsTotal.WithLabelValues(txn.Processor, incrementDeclined).Inc()
+		writeError(w, r, http.StatusPaymentRequired, errCodeProcessorDeclined,
+			fmt.Sprintf("Processor %s declined the increment", txn.Processor),
+			map[string]string{"decline_reason": result.DeclineReason})
+		return
+	}
+
+	// The issuer approved the increment, so it is recorded on top of
+	// whatever captures or increments got in meanwhile. One that can't be
+	// recorded any more, because the authorization closed, is reversed
+	// rather than left approved at the issuer only.
+	saveCtx, cancelSave := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancelSave()
+	now := formatTimestamp(time.Now())
+	current := txn
+	for attempt := 1; ; attempt++ {
+		raised := current
+		raised.Amount = roundAmount(current.Amount+amount, current.Currency)
+		raised.UpdatedAt = now
+		err := tenantStore(saveCtx).incrementAmount(saveCtx, raised, current.Amount, "approved", statusPartiallyCaptured)
+		if err == nil {
+			txn = raised
+			break
+		}
+		if err == errStatusConflict && attempt < maxSaveAttempts {
+			var latest Transaction
+			if latest, err = tenantStore(saveCtx).Get(saveCtx, id); err == nil {
+				if _, fits := incrementWithinMaxAmount(latest, amount); fits && !authorizationExpired(latest, time.Now()) &&
+					(latest.Status == "approved" || latest.Status == statusPartiallyCaptured) {
+					current = latest
+					continue
+				}
+				err = errStatusConflict
+			}
+		}
+		// The reversal is for the authorization the processor approved
+		// the increment on, whatever the store holds now
+		reverseIncrement(r, incrementer, txn, amount)
+		writeUpdateError(w, r, "increment", id, err)
+		return
+	}
+	authorizationIncrementsTotal.WithLabelValues(txn.Processor, incrementApproved).Inc()
+	txn = txn.withMinorUnits()
+	inc := AuthorizationIncrement{
+		IncrementID:    newIncrementID(),
+		TransactionID:  txn.TransactionID,
+		Amount:         amount,
+		AmountMinor:    amountMinor,
+		Currency:       txn.Currency,
+		AuthCode:       result.AuthCode,
+		FeeAmountMinor: currentConfig().processorFees(txn.Processor).fee(txn.AmountMinor, txn.Currency),
+		CreatedAt:      txn.UpdatedAt,
+		Transaction:    txn,
+	}
+	inc.FeeAmount = fromMinorUnits(inc.FeeAmountMinor, txn.Currency)
+	if req.SettlementCurrency != "" {
+		conversion := fxFeed.convert(txn.AmountMinor, txn.Currency, req.SettlementCurrency)
+		inc.Settlement = &conversion
+		fxConversionsTotal.WithLabelValues("converted").Inc()
+	}
+	recordTransactionAudit(auditOriginOf(r), auditAuthorizationIncremented, txn, txn.Status)
+	recordIncrementEntry(txn.MerchantID, inc)
+	emitEvent(txn.MerchantID, eventAuthorizationIncremented, inc)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(inc)
+}
+
+// validateIncrementSettlement checks an increment's settlement_currency as
+// validateAuthorization does, clearing it when it is the transaction's own
+func validateIncrementSettlement(req *IncrementRequest, currency string) []FieldViolation {
+	req.SettlementCurrency = strings.ToUpper(req.SettlementCurrency)
+	switch {
+	case req.SettlementCurrency == "" || req.SettlementCurrency == currency:
+		req.SettlementCurrency = ""
+	case !iso4217Currencies[req.SettlementCurrency]:
+		return []FieldViolation{{"settlement_currency", "must be a valid ISO 4217 currency code"}}
+	case !fxFeed.supports(req.SettlementCurrency):
+		return []FieldViolation{{"settlement_currency", "has no FX rate"}}
+	case !fxFeed.supports(currency):
+		return []FieldViolation{{"settlement_currency", "can't be converted to from the transaction's currency"}}
+	}
+	return nil
+}
+
+// incrementWithinMaxAmount reports whether raising txn by amount keeps it
+// within the merchant's max_amount, with the violation to return if not
+func incrementWithinMaxAmount(txn Transaction, amount float64) (FieldViolation, bool) {
+	raised := roundAmount(txn.Amount+amount, txn.Currency)
+	if profile, ok := currentConfig().merchantProfile(txn.MerchantID); ok && profile.MaxAmount != nil && raised > *profile.MaxAmount {
+		return FieldViolation{"amount", fmt.Sprintf("must not raise the authorization above %g for this merchant", *profile.MaxAmount)}, false
+	}
+	return FieldViolation{}, true
+}
+
+// reverseIncrement gives an approved increment that couldn't be recorded
+// back to the processor, so the cardholder isn't held for it. It runs
+// past the request's cancellation, since the client gets its answer
+// either way.
+func reverseIncrement(r *http.Request, incrementer incrementalAuthorizer, txn Transaction, amount float64) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), getRequestTimeout())
+	defer cancel()
+	result, err := incrementer.ReverseIncrement(ctx, txn, amount)
+	if err == nil && !result.Approved {
+		err = fmt.Errorf("declined: %s", result.DeclineReason)
+	}
+	if err != nil {
+		authorizationIncrementsTotal.WithLabelValues(txn.Processor, incrementError).Inc()
+		log.Printf("Failed to reverse an increment of %g on %s: %v", amount, txn.TransactionID, err)
+		return
+	}
+	authorizationIncrementsTotal.WithLabelValues(txn.Processor, incrementReversed).Inc()
+}
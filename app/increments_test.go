@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useIncrements stores a config letting stripe, the processor of
+// openAuthorization, take increments and captures, with extra settings
+// for stripe and extra top-level ones
+func useIncrements(t *testing.T, stripe, extra string, replacements ...Processor) {
+	t.Helper()
+	useConfig(t, parseTestConfig(t, `
+failure_rate: 0
+processors:
+  stripe: {incremental_authorization: true, multi_capture: true`+stripe+`}
+`+extra), replacements...)
+}
+
+// serveIncrement posts body to POST /authorize/{id}/increment
+func serveIncrement(id, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/authorize/"+id+"/increment", strings.NewReader(body))
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	handleAuthorizationIncrement(w, r)
+	return w
+}
+
+func TestHandleAuthorizationIncrement(t *testing.T) {
+	cases := []struct {
+		name   string
+		stripe string
+		extra  string
+		// prepare changes the stored authorization of 100 USD
+		prepare    func(t *testing.T, txn Transaction)
+		body       string
+		wantStatus int
+		wantCode   string
+		wantAmount float64
+	}{
+		{"approved", "", "", nil, `{"amount_minor": 5000}`, 200, "", 150},
+		{"partially captured", "", "", func(t *testing.T, txn Transaction) {
+			txn.Status, txn.CapturedAmount = statusPartiallyCaptured, 40
+			if err := storage.UpdateStatus(context.Background(), txn, "approved"); err != nil {
+				t.Fatal(err)
+			}
+		}, `{"amount": 25}`, 200, "", 125},
+		{"unsupported", "", "", func(t *testing.T, txn Transaction) {
+			txn.Processor = "adyen"
+			replaceTransaction(t, txn)
+		}, `{"amount": 10}`, 422, errCodeIncrementUnsupported, 100},
+		{"declined", ", failure_rate: 1", "", nil, `{"amount": 10}`, 402, errCodeProcessorDeclined, 100},
+		{"declined for a vault token", ", failure_rate: 1", "token_uplifts: {network_token: 1}", func(t *testing.T, txn Transaction) {
+			txn.TokenType = tokenTypeVault
+			replaceTransaction(t, txn)
+		}, `{"amount": 10}`, 402, errCodeProcessorDeclined, 100},
+		{"approved with the network token uplift", ", failure_rate: 1", "token_uplifts: {network_token: 1}", func(t *testing.T, txn Transaction) {
+			txn.TokenType = tokenTypeNetwork
+			replaceTransaction(t, txn)
+		}, `{"amount": 10}`, 200, "", 110},
+		{"over max_amount", "", "merchants: {merchant_capture: {max_amount: 120}}", nil, `{"amount": 30}`, 400, errCodeValidation, 100},
+		{"captured", "", "", func(t *testing.T, txn Transaction) {
+			txn.Status, txn.CapturedAmount = statusCaptured, 100
+			if err := storage.UpdateStatus(context.Background(), txn, "approved"); err != nil {
+				t.Fatal(err)
+			}
+		}, `{"amount": 10}`, 409, errCodeInvalidTransactionState, 100},
+		{"expired", "", "", func(t *testing.T, txn Transaction) {
+			previous := authorizationExpiry
+			t.Cleanup(func() { authorizationExpiry = previous })
+			authorizationExpiry = 168 * time.Hour
+			txn.CreatedAt = formatTimestamp(time.Now().Add(-authorizationExpiry - time.Hour))
+			replaceTransaction(t, txn)
+		}, `{"amount": 10}`, 409, errCodeAuthorizationExpired, 100},
+		{"unknown settlement currency", "", "", nil, `{"amount": 10, "settlement_currency": "XXX"}`, 400, errCodeValidation, 100},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useIncrements(t, tc.stripe, tc.extra)
+			useMemoryStore(t)
+			txn := openAuthorization(t, "txn_increment", 100)
+			if tc.prepare != nil {
+				tc.prepare(t, txn)
+			}
+			w := serveIncrement(txn.TransactionID, tc.body)
+			if w.Code != tc.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if tc.wantCode != "" && !strings.Contains(w.Body.String(), `"`+tc.wantCode+`"`) {
+				t.Errorf("body %s, want code %s", w.Body, tc.wantCode)
+			}
+			got, err := storage.Get(context.Background(), txn.TransactionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Amount != tc.wantAmount {
+				t.Errorf("authorized %g, want %g", got.Amount, tc.wantAmount)
+			}
+		})
+	}
+}
+
+// replaceTransaction stores txn over the stored transaction of the same ID
+func replaceTransaction(t *testing.T, txn Transaction) {
+	t.Helper()
+	storage.(*memoryStore).mu.Lock()
+	defer storage.(*memoryStore).mu.Unlock()
+	storage.(*memoryStore).transactions[txn.TransactionID] = txn
+}
+
+// TestAuthorizationIncrementAmounts checks that the fee and settlement
+// amounts are those of the raised authorization, not of the increment
+func TestAuthorizationIncrementAmounts(t *testing.T) {
+	useIncrements(t, "", "")
+	useMemoryStore(t)
+	txn := openAuthorization(t, "txn_increment_amounts", 100)
+
+	w := serveIncrement(txn.TransactionID, `{"amount_minor": 5000, "settlement_currency": "EUR"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var inc AuthorizationIncrement
+	if err := json.NewDecoder(w.Body).Decode(&inc); err != nil {
+		t.Fatal(err)
+	}
+	if want := currentConfig().processorFees("stripe").fee(15000, "USD"); inc.FeeAmountMinor != want {
+		t.Errorf("fee %d, want %d, the fee on 150 USD", inc.FeeAmountMinor, want)
+	}
+	if inc.Settlement == nil {
+		t.Fatal("no settlement")
+	}
+	if want := fxFeed.convert(15000, "USD", "EUR"); inc.Settlement.AmountMinor != want.AmountMinor {
+		t.Errorf("settlement %d, want %d, 150 USD in EUR", inc.Settlement.AmountMinor, want.AmountMinor)
+	}
+}
+
+// TestConcurrentIncrements checks that increments racing for the same
+// authorization, and with captures, are all recorded
+func TestConcurrentIncrements(t *testing.T) {
+	useIncrements(t, "", "")
+	useMemoryStore(t)
+	txn := openAuthorization(t, "txn_concurrent_increment", 100)
+
+	const increments = 8
+	var wg sync.WaitGroup
+	statuses := make([]int, increments)
+	for i := 0; i < increments; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = serveIncrement(txn.TransactionID, `{"amount": 10}`).Code
+		}(i)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if w := serveCapture(txn.TransactionID, `{"amount": 50, "final_capture": false}`); w.Code != http.StatusOK {
+			t.Errorf("capture: status %d: %s", w.Code, w.Body)
+		}
+	}()
+	wg.Wait()
+
+	accepted := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			accepted++
+		case http.StatusConflict:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	got, err := storage.Get(context.Background(), txn.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 100 + 10*float64(accepted); got.Amount != want || got.CapturedAmount != 50 {
+		t.Errorf("authorized %g with %g captured, want %g with 50 after %d increments", got.Amount, got.CapturedAmount, want, accepted)
+	}
+}
+
+// approvingProcessor approves every increment and records the
+// authorizations increments were reversed on
+type approvingProcessor struct {
+	*simulatedProcessor
+	reversed []Transaction
+}
+
+func (p *approvingProcessor) IncrementAuthorization(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	return ProcessorResult{Approved: true, AuthCode: "AUTH1"}, nil
+}
+
+func (p *approvingProcessor) ReverseIncrement(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	p.reversed = append(p.reversed, txn)
+	return ProcessorResult{Approved: true}, nil
+}
+
+// closingProcessor approves increments but captures the authorization in
+// full while doing so, as a capture racing the issuer would
+type closingProcessor struct {
+	approvingProcessor
+}
+
+func (p *closingProcessor) IncrementAuthorization(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	txn.Status, txn.CapturedAmount = statusCaptured, txn.Amount
+	if err := storage.UpdateStatus(ctx, txn, "approved"); err != nil {
+		return ProcessorResult{}, err
+	}
+	return p.approvingProcessor.IncrementAuthorization(ctx, txn, amount)
+}
+
+// useProcessor registers p in place of the processor of the same name for
+// the test
+func useProcessor(t *testing.T, p Processor) {
+	t.Helper()
+	original, _ := processors.get(p.Name())
+	t.Cleanup(func() { processors.register(original) })
+	processors.register(p)
+}
+
+// TestAuthorizationIncrementReversed checks that an increment the issuer
+// approved is reversed, on the authorization it was approved on, when it
+// can't be recorded
+func TestAuthorizationIncrementReversed(t *testing.T) {
+	cases := []struct {
+		name string
+		// closing captures the authorization while the issuer approves
+		closing bool
+		// store fails or conflicts the saves
+		store      func(transactionStore) transactionStore
+		wantStatus int
+	}{
+		{"authorization closed meanwhile", true, nil, http.StatusConflict},
+		{"conflicts on every attempt", false, func(s transactionStore) transactionStore {
+			return &faultyStore{transactionStore: s, conflicts: true, getsLeft: -1}
+		}, http.StatusConflict},
+		{"reload failing after a conflict", false, func(s transactionStore) transactionStore {
+			return &faultyStore{transactionStore: s, conflicts: true, getsLeft: 1}
+		}, http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			approving := &approvingProcessor{simulatedProcessor: newSimulatedProcessor("stripe", rng)}
+			var p Processor = approving
+			if tc.closing {
+				closing := &closingProcessor{approvingProcessor{simulatedProcessor: newSimulatedProcessor("stripe", rng)}}
+				p, approving = closing, &closing.approvingProcessor
+			}
+			useIncrements(t, "", "", p)
+			useMemoryStore(t)
+			txn := openAuthorization(t, "txn_increment_reversed", 100)
+			if tc.store != nil {
+				storage = tc.store(storage)
+			}
+
+			if w := serveIncrement(txn.TransactionID, `{"amount": 10}`); w.Code != tc.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if len(approving.reversed) != 1 {
+				t.Fatalf("reversed %d increments, want 1", len(approving.reversed))
+			}
+			if reversed := approving.reversed[0]; reversed.TransactionID != txn.TransactionID ||
+				reversed.Processor != "stripe" || reversed.Amount != 100 {
+				t.Errorf("reversed on %s at %s for %g, want %s at stripe for 100",
+					reversed.TransactionID, reversed.Processor, reversed.Amount, txn.TransactionID)
+			}
+			got, err := storage.Get(context.Background(), txn.TransactionID)
+			if err == nil && got.Amount != 100 {
+				t.Errorf("authorized %g, want 100", got.Amount)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var ipBlockedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_ip_blocked_requests_total",
+		Help: "Total number of requests rejected by the IP allowlist or denylist, by route group and reason",
+	},
+	[]string{"group", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(ipBlockedTotal)
+}
+
+// ipFilter holds the CIDR lists of a route group. A denied address is
+// always rejected; with an allowlist only addresses on it get through.
+type ipFilter struct {
+	allow []netip.Prefix
+	deny  []netip.Prefix
+}
+
+// ipFilters are the filters by route group, "public" or "admin"; groups
+// without lists are absent
+var ipFilters = map[string]*ipFilter{}
+
+// loadIPFilters reads the lists, each a comma separated set of CIDRs or
+// single addresses:
+//
+//	PUBLIC_IP_ALLOWLIST, PUBLIC_IP_DENYLIST   applied to PORT
+//	ADMIN_IP_ALLOWLIST, ADMIN_IP_DENYLIST     applied to ADMIN_PORT
+//
+// Clients are identified by clientAddr, so TRUSTED_PROXIES applies.
+func loadIPFilters() error {
+	for _, group := range []string{"public", "admin"} {
+		prefix := strings.ToUpper(group) + "_IP_"
+		allow, err := parsePrefixes(prefix + "ALLOWLIST")
+		if err != nil {
+			return err
+		}
+		deny, err := parsePrefixes(prefix + "DENYLIST")
+		if err != nil {
+			return err
+		}
+		if allow != nil || deny != nil {
+			ipFilters[group] = &ipFilter{allow: allow, deny: deny}
+		}
+	}
+	return nil
+}
+
+func parsePrefixes(key string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(os.Getenv(key), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s entry %q: %v", key, entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s entry %q: %v", key, entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func containsAddr(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether addr may reach the group, and why not
+func (f *ipFilter) allows(addr netip.Addr, ok bool) (bool, string) {
+	if !ok {
+		if f.allow != nil {
+			return false, "unknown_address"
+		}
+		return true, ""
+	}
+	if containsAddr(f.deny, addr) {
+		return false, "denylist"
+	}
+	if f.allow != nil && !containsAddr(f.allow, addr) {
+		return false, "not_allowlisted"
+	}
+	return true, ""
+}
+
+// withIPFilter rejects requests from addresses the group's lists exclude
+// with 403
+func withIPFilter(group string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			filter := ipFilters[group]
+			if filter == nil {
+				next(w, r)
+				return
+			}
+			if allowed, reason := filter.allows(clientAddr(r)); !allowed {
+				ipBlockedTotal.WithLabelValues(group, reason).Inc()
+				writeError(w, r, http.StatusForbidden, errCodeForbidden, "Requests from this address are not allowed", nil)
+				return
+			}
+			next(w, r)
+		}
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Job run triggers and outcomes
+const (
+	jobTriggerSchedule = "schedule"
+	jobTriggerManual   = "manual"
+
+	jobSuccess = "success"
+	jobError   = "error"
+)
+
+var (
+	jobRunsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_job_runs_total",
+			Help: "Total number of background job runs by job and status (success or error)",
+		},
+		[]string{"job", "status"},
+	)
+
+	jobDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "voyager_job_duration_seconds",
+			Help:    "Background job run duration in seconds",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"job"},
+	)
+
+	jobLastSuccess = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "voyager_job_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful run of a background job",
+		},
+		[]string{"job"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(jobRunsTotal)
+	prometheus.MustRegister(jobDuration)
+	prometheus.MustRegister(jobLastSuccess)
+}
+
+// cronDescriptors are the shorthands cron accepts for common schedules
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// parseJobSchedule parses a cron expression in UTC (see
+// parseCronSchedule), one of cronDescriptors or "@every <duration>", which
+// returns the interval instead
+func parseJobSchedule(spec string) (*cronSchedule, time.Duration, error) {
+	if text, ok := strings.CutPrefix(spec, "@every "); ok {
+		interval, err := time.ParseDuration(strings.TrimSpace(text))
+		if err != nil || interval < time.Second {
+			return nil, 0, fmt.Errorf("%q must be a duration of at least 1s", text)
+		}
+		return nil, interval, nil
+	}
+	if expr, ok := cronDescriptors[spec]; ok {
+		spec = expr
+	}
+	cron, err := parseCronSchedule(spec)
+	return cron, 0, err
+}
+
+// JobRun is the outcome of one run of a background job
+type JobRun struct {
+	Trigger    string  `json:"trigger"`
+	StartedAt  string  `json:"started_at"`
+	DurationMs float64 `json:"duration_ms"`
+	Status     string  `json:"status"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// JobStatus describes a background job in GET /admin/jobs and
+// /health/ready
+type JobStatus struct {
+	Name string `json:"name"`
+	// Schedule is empty for jobs that only run when triggered
+	Schedule   string  `json:"schedule,omitempty"`
+	LeaderOnly bool    `json:"leader_only"`
+	Running    bool    `json:"running"`
+	NextRunAt  string  `json:"next_run_at,omitempty"`
+	LastRun    *JobRun `json:"last_run,omitempty"`
+}
+
+// job is a background task run on a schedule or through /admin/jobs
+type job struct {
+	name string
+	spec string
+	// cron or interval is set when the job runs on a schedule
+	cron     *cronSchedule
+	interval time.Duration
+	// leaderOnly jobs are skipped on schedule by replicas that aren't the
+	// leader (see leader.go); triggering one runs it anyway
+	leaderOnly bool
+	timeout    time.Duration
+	run        func(ctx context.Context, now time.Time) error
+
+	mu      sync.Mutex
+	running bool
+	nextRun time.Time
+	lastRun *JobRun
+}
+
+// jobScheduler runs the background jobs, and one-shot delayed calls such
+// as webhook retries
+type jobScheduler struct {
+	mu   sync.RWMutex
+	jobs map[string]*job
+	// delayed runs the one-shot calls on its own workers rather than
+	// sharing simulatedCalls', whose completions write to storage. The
+	// calls must not block, or the ones behind them are held up.
+	delayed *callScheduler
+}
+
+var jobs = &jobScheduler{jobs: make(map[string]*job), delayed: newCallScheduler(4)}
+
+// registerJobs sets up the background jobs. Each job's schedule can be
+// replaced with JOB_<NAME>_SCHEDULE, or set to off so the job only runs
+// when triggered.
+func registerJobs() error {
+	settlementSpec := ""
+	if hour, enabled := getSettlementHour(); enabled {
+		settlementSpec = fmt.Sprintf("0 %d * * *", hour)
+	}
+	every := func(d time.Duration) string { return "@every " + d.String() }
+	for _, j := range []*job{
+		{name: "settlement", spec: settlementSpec, leaderOnly: true, timeout: storageTimeout,
+			run: func(ctx context.Context, now time.Time) error {
+				_, err := settle(ctx, now)
+				return err
+			}},
+		{name: "subscriptions", spec: every(subscriptionSweepInterval), leaderOnly: true, timeout: storageTimeout,
+			run: sweepSubscriptions},
+		{name: "disputes", spec: every(disputeSweepInterval), leaderOnly: true, timeout: storageTimeout,
+			run: sweepDisputes},
+		{name: "payouts", spec: every(payoutSweepInterval), leaderOnly: true, timeout: storageTimeout,
+			run: sweepPayouts},
+		{name: "retention", spec: "@hourly", timeout: time.Minute,
+			run: enforceRetention},
+		{name: "authorizations", spec: every(authorizationExpirySweepInterval), timeout: time.Minute,
+			run: sweepAuthorizations},
+		{name: "rate_limits", spec: every(rateLimitSweepInterval), timeout: time.Minute,
+			run: sweepRateLimits},
+		{name: "caches", spec: every(cacheSweepInterval), timeout: time.Minute,
+			run: sweepCaches},
+	} {
+		if spec := getEnv("JOB_"+strings.ToUpper(j.name)+"_SCHEDULE", j.spec); spec != "off" {
+			j.spec = spec
+		} else {
+			j.spec = ""
+		}
+		if j.spec != "" {
+			var err error
+			if j.cron, j.interval, err = parseJobSchedule(j.spec); err != nil {
+				return fmt.Errorf("job %s: %w", j.name, err)
+			}
+		}
+		jobs.register(j)
+	}
+	return nil
+}
+
+func (s *jobScheduler) register(j *job) {
+	s.mu.Lock()
+	s.jobs[j.name] = j
+	s.mu.Unlock()
+	if j.cron != nil || j.interval > 0 {
+		go j.loop()
+	}
+}
+
+func (s *jobScheduler) get(name string) (*job, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	j, ok := s.jobs[name]
+	return j, ok
+}
+
+// list returns the jobs' status sorted by name
+func (s *jobScheduler) list() []JobStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]JobStatus, 0, len(s.jobs))
+	for _, name := range sortedKeys(s.jobs) {
+		list = append(list, s.jobs[name].status())
+	}
+	return list
+}
+
+// after runs fn once d has passed
+func (s *jobScheduler) after(d time.Duration, fn func()) {
+	s.delayed.after(d, fn)
+}
+
+// check describes the jobs whose last run failed, for /health/ready
+func (s *jobScheduler) check() error {
+	var failed []string
+	for _, status := range s.list() {
+		if status.LastRun != nil && status.LastRun.Status == jobError {
+			failed = append(failed, fmt.Sprintf("%s: %s", status.Name, status.LastRun.Error))
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("last run failed for %s", strings.Join(failed, "; "))
+	}
+	return nil
+}
+
+// loop runs the job whenever its schedule is due
+func (j *job) loop() {
+	for {
+		next, ok := j.nextAfter(time.Now())
+		if !ok {
+			log.Printf("Job %s: schedule %q never runs again", j.name, j.spec)
+			return
+		}
+		j.mu.Lock()
+		j.nextRun = next
+		j.mu.Unlock()
+
+		time.Sleep(time.Until(next))
+		if j.leaderOnly && !leadership.leading() {
+			continue
+		}
+		j.execute(jobTriggerSchedule)
+	}
+}
+
+// nextAfter returns the job's first scheduled run after t. A cron
+// schedule matching no day in the next five years, such as February 30th,
+// has none.
+func (j *job) nextAfter(t time.Time) (time.Time, bool) {
+	if j.interval > 0 {
+		return t.Add(j.interval), true
+	}
+	return j.cron.next(t, t.AddDate(5, 0, 0))
+}
+
+// execute runs the job now, unless a run is already in progress, and
+// reports the run
+func (j *job) execute(trigger string) (JobRun, bool) {
+	j.mu.Lock()
+	if j.running {
+		j.mu.Unlock()
+		return JobRun{}, false
+	}
+	j.running = true
+	j.mu.Unlock()
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), j.timeout)
+	err := j.run(ctx, start)
+	cancel()
+	elapsed := time.Since(start)
+
+	run := JobRun{
+		Trigger:    trigger,
+		StartedAt:  formatTimestamp(start),
+		DurationMs: math.Round(float64(elapsed.Microseconds())/10) / 100,
+		Status:     jobSuccess,
+	}
+	if err != nil {
+		run.Status, run.Error = jobError, err.Error()
+		log.Printf("Job %s failed: %v", j.name, err)
+	} else {
+		jobLastSuccess.WithLabelValues(j.name).SetToCurrentTime()
+	}
+	jobRunsTotal.WithLabelValues(j.name, run.Status).Inc()
+	jobDuration.WithLabelValues(j.name).Observe(elapsed.Seconds())
+
+	j.mu.Lock()
+	j.running, j.lastRun = false, &run
+	j.mu.Unlock()
+	return run, true
+}
+
+func (j *job) status() JobStatus {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	status := JobStatus{Name: j.name, Schedule: j.spec, LeaderOnly: j.leaderOnly, Running: j.running, LastRun: j.lastRun}
+	if !j.nextRun.IsZero() {
+		status.NextRunAt = formatTimestamp(j.nextRun)
+	}
+	return status
+}
+
+// JobList is the body of GET /admin/jobs
+type JobList struct {
+	Data []JobStatus `json:"data"`
+}
+
+// handleJobList lists the background jobs with their last run
+// (GET /admin/jobs)
+func handleJobList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(JobList{Data: jobs.list()})
+}
+
+// handleJobRun runs a job now and returns the run (POST
+// /admin/jobs/{name}/run). It runs even on a replica that isn't the
+// leader.
+func handleJobRun(w http.ResponseWriter, r *http.Request) {
+	j, ok := jobs.get(r.PathValue("name"))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Job not found", nil)
+		return
+	}
+	run, ok := j.execute(jobTriggerManual)
+	if !ok {
+		writeError(w, r, http.StatusConflict, errCodeJobRunning, "Job is already running", nil)
+		return
+	}
+	log.Printf("Job %s triggered via admin API: %s in %.2fms", j.name, run.Status, run.DurationMs)
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditJobTriggered, ResourceType: "job", ResourceID: j.name, AfterStatus: run.Status})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(run)
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Scopes routes require; see requireScope
+const (
+	scopePaymentsRead  = "payments:read"
+	scopePaymentsWrite = "payments:write"
+	scopeAdmin         = "admin"
+)
+
+// jwtAlgorithms are the asymmetric algorithms accepted; HMAC is refused so a
+// public JWKS key can never be used as a shared secret
+var jwtAlgorithms = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+
+var jwksRefreshesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_jwks_refreshes_total",
+		Help: "Total number of JWKS fetches by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(jwksRefreshesTotal)
+}
+
+// jwtAuthenticator verifies Bearer JWTs against a JWKS
+type jwtAuthenticator struct {
+	keys          *jwksCache
+	parser        *jwt.Parser
+	merchantClaim string
+	scopeClaim    string
+}
+
+// jwtAuth is nil unless JWT_JWKS_URL is set
+var jwtAuth *jwtAuthenticator
+
+// loadJWTAuthenticator reads the JWT settings, returning nil without a JWKS:
+//
+//	JWT_JWKS_URL            where the signing keys are published
+//	JWT_ISSUER              required iss, optional
+//	JWT_AUDIENCE            required aud, optional
+//	JWT_MERCHANT_CLAIM      claim holding the merchant ID, default merchant_id
+//	JWT_SCOPE_CLAIM         claim holding the scopes, default scope; a space
+//	                        separated string or an array
+//	JWT_LEEWAY              clock skew allowed on exp, nbf and iat, default 30s
+//	JWKS_REFRESH_INTERVAL   how long fetched keys are cached, default 1h
+func loadJWTAuthenticator() (*jwtAuthenticator, error) {
+	jwksURL := os.Getenv("JWT_JWKS_URL")
+	if jwksURL == "" {
+		return nil, nil
+	}
+	if u, err := url.Parse(jwksURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("invalid JWT_JWKS_URL %q: must be an http or https URL", jwksURL)
+	}
+	ttl, err := parseDelay(getEnv("JWKS_REFRESH_INTERVAL", "1h"))
+	if err != nil || ttl < time.Minute {
+		return nil, fmt.Errorf("invalid JWKS_REFRESH_INTERVAL %q: must be a duration of at least 1m", os.Getenv("JWKS_REFRESH_INTERVAL"))
+	}
+	leeway, err := time.ParseDuration(getEnv("JWT_LEEWAY", "30s"))
+	if err != nil || leeway < 0 {
+		return nil, fmt.Errorf("invalid JWT_LEEWAY %q", os.Getenv("JWT_LEEWAY"))
+	}
+
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods(jwtAlgorithms),
+		jwt.WithExpirationRequired(),
+		jwt.WithLeeway(leeway),
+	}
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		options = append(options, jwt.WithIssuer(issuer))
+	}
+	if audience := os.Getenv("JWT_AUDIENCE"); audience != "" {
+		options = append(options, jwt.WithAudience(audience))
+	}
+	return &jwtAuthenticator{
+		keys: &jwksCache{
+			url:    jwksURL,
+			client: &http.Client{Timeout: 5 * time.Second},
+			ttl:    ttl,
+			// An unknown kid usually means the keys rotated; refetching is
+			// rate limited so bogus kids can't hammer the JWKS endpoint
+			minInterval: 30 * time.Second,
+		},
+		parser:        jwt.NewParser(options...),
+		merchantClaim: getEnv("JWT_MERCHANT_CLAIM", "merchant_id"),
+		scopeClaim:    getEnv("JWT_SCOPE_CLAIM", "scope"),
+	}, nil
+}
+
+// jwtIdentity is what a verified token grants. Admin tokens may have no
+// merchant.
+type jwtIdentity struct {
+	merchantID string
+	scopes     map[string]bool
+}
+
+// verify checks a token's signature and registered claims and extracts the
+// merchant, if any, and scopes
+func (a *jwtAuthenticator) verify(ctx context.Context, raw string) (jwtIdentity, error) {
+	token, err := a.parser.Parse(raw, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return a.keys.key(ctx, kid)
+	})
+	if err != nil {
+		return jwtIdentity{}, err
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	merchantID, _ := claims[a.merchantClaim].(string)
+	identity := jwtIdentity{merchantID: merchantID, scopes: make(map[string]bool)}
+	switch scopes := claims[a.scopeClaim].(type) {
+	case string:
+		for _, scope := range strings.Fields(scopes) {
+			identity.scopes[scope] = true
+		}
+	case []interface{}:
+		for _, scope := range scopes {
+			if s, ok := scope.(string); ok {
+				identity.scopes[s] = true
+			}
+		}
+	}
+	return identity, nil
+}
+
+// jwksCache holds the public keys of a JWKS by key ID
+type jwksCache struct {
+	url         string
+	client      *http.Client
+	ttl         time.Duration
+	minInterval time.Duration
+
+	mu          sync.Mutex
+	keys        map[string]interface{}
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// key returns the key with the given ID, refetching the set when it is
+// older than the TTL or doesn't have the key. A token without a kid
+// matches a set holding a single key.
+func (c *jwksCache) key(ctx context.Context, kid string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key, ok := c.lookup(kid)
+	stale := time.Since(c.fetchedAt) > c.ttl
+	if (!ok || stale) && time.Since(c.attemptedAt) >= c.minInterval {
+		if err := c.refresh(ctx); err != nil && !ok {
+			return nil, err
+		}
+		key, ok = c.lookup(kid)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+func (c *jwksCache) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(c.keys) == 1 {
+		for _, key := range c.keys {
+			return key, true
+		}
+	}
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+// jsonWebKey is the subset of RFC 7517 fields the gateway reads
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// refresh fetches the key set. Keys of unsupported types are skipped; a
+// failed fetch keeps the previous keys.
+func (c *jwksCache) refresh(ctx context.Context) error {
+	c.attemptedAt = time.Now()
+	keys, err := c.fetch(ctx)
+	if err != nil {
+		jwksRefreshesTotal.WithLabelValues("error").Inc()
+		return fmt.Errorf("fetching JWKS: %w", err)
+	}
+	jwksRefreshesTotal.WithLabelValues("success").Inc()
+	c.keys = keys
+	c.fetchedAt = c.attemptedAt
+	return nil
+}
+
+func (c *jwksCache) fetch(ctx context.Context) (map[string]interface{}, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", resp.StatusCode)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]interface{}, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		if key, err := jwk.publicKey(); err == nil {
+			keys[jwk.Kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no usable signing keys")
+	}
+	return keys, nil
+}
+
+// publicKey decodes an RSA, EC or Ed25519 public key
+func (k jsonWebKey) publicKey() (interface{}, error) {
+	decode := base64.RawURLEncoding.DecodeString
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		exponent := new(big.Int).SetBytes(e)
+		if !exponent.IsInt64() || exponent.Int64() < 3 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return key, nil
+	case "OKP":
+		x, err := decode(k.X)
+		if err != nil || k.Crv != "Ed25519" || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+)
+
+// kafkaPublisher writes transaction events to a Kafka topic asynchronously,
+// keyed by transaction ID so every event of a transaction lands on the same
+// partition in order
+type kafkaPublisher struct {
+	writer  *kafka.Writer
+	brokers []string
+}
+
+// newKafkaPublisher connects to KAFKA_BROKERS, a comma separated list of
+// host:port addresses, and publishes to KAFKA_TOPIC
+func newKafkaPublisher() (*kafkaPublisher, error) {
+	raw := os.Getenv("KAFKA_BROKERS")
+	var brokers []string
+	for _, b := range strings.Split(raw, ",") {
+		if b = strings.TrimSpace(b); b != "" {
+			brokers = append(brokers, b)
+		}
+	}
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("invalid KAFKA_BROKERS %q", raw)
+	}
+
+	topic := getEnv("KAFKA_TOPIC", "voyager.transactions")
+	log.Printf("Publishing transaction events to Kafka topic %s at %s", topic, raw)
+
+	return &kafkaPublisher{brokers: brokers, writer: &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		BatchTimeout: 10 * time.Millisecond,
+		RequiredAcks: kafka.RequireAll,
+		Async:        true,
+		Completion: func(messages []kafka.Message, err error) {
+			if err != nil {
+				log.Printf("Kafka delivery of %d events failed: %v", len(messages), err)
+			}
+			for _, m := range messages {
+				recordPublish(sinkKafka, kafkaEventType(m), err)
+			}
+		},
+	}}, nil
+}
+
+// Publish queues the event in the writer's buffer; delivery is reported
+// from the writer's completion callback
+func (p *kafkaPublisher) Publish(ctx context.Context, event TransactionEvent) error {
+	value, err := json.Marshal(event)
+	if err != nil {
+		recordPublish(sinkKafka, event.EventType, err)
+		return err
+	}
+
+	err = p.writer.WriteMessages(ctx, kafka.Message{
+		Key:     []byte(event.TransactionID),
+		Value:   value,
+		Headers: []kafka.Header{{Key: "event_type", Value: []byte(event.EventType)}},
+	})
+	if err != nil {
+		recordPublish(sinkKafka, event.EventType, err)
+	}
+	return err
+}
+
+// Close flushes buffered events and closes the connections
+func (p *kafkaPublisher) Close() error {
+	return p.writer.Close()
+}
+
+// Ping reads the topic's partitions from the first broker that answers
+func (p *kafkaPublisher) Ping(ctx context.Context) error {
+	var err error
+	for _, broker := range p.brokers {
+		var conn *kafka.Conn
+		if conn, err = kafka.DialContext(ctx, "tcp", broker); err != nil {
+			continue
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			_ = conn.SetDeadline(deadline)
+		}
+		_, err = conn.ReadPartitions(p.writer.Topic)
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+func kafkaEventType(m kafka.Message) string {
+	for _, h := range m.Headers {
+		if h.Key == "event_type" {
+			return string(h.Value)
+		}
+	}
+	return "unknown"
+}
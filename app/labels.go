@@ -0,0 +1,80 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherMerchantLabel replaces merchant IDs past the label cap
+const otherMerchantLabel = "other"
+
+var droppedLabelValuesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_metric_label_values_dropped_total",
+		Help: "Total number of observations whose label value was replaced by \"other\" to bound cardinality",
+	},
+	[]string{"label"},
+)
+
+func init() {
+	prometheus.MustRegister(droppedLabelValuesTotal)
+}
+
+// labelLimiter bounds the distinct values of a caller-supplied label.
+// The first max values seen keep their own series; later ones share
+// "other". Values admitted once stay admitted until restart.
+type labelLimiter struct {
+	mu    sync.Mutex
+	label string
+	max   int
+	seen  map[string]struct{}
+	// allowed values are always admitted and don't count towards max
+	allowed func(value string) bool
+}
+
+// merchantLabels bounds merchant_id, which comes from request bodies.
+// Merchants in the merchant registry always get their own series.
+var merchantLabels = &labelLimiter{
+	label: "merchant_id",
+	max:   getMetricsMaxMerchants(),
+	seen:  make(map[string]struct{}),
+	allowed: func(merchantID string) bool {
+		_, ok := currentConfig().merchantProfile(merchantID)
+		return ok
+	},
+}
+
+// getMetricsMaxMerchants returns METRICS_MAX_MERCHANTS, default 100. Zero
+// puts every merchant outside the registry under "other".
+func getMetricsMaxMerchants() int {
+	n, err := strconv.Atoi(getEnv("METRICS_MAX_MERCHANTS", "100"))
+	if err != nil || n < 0 {
+		return 100
+	}
+	return n
+}
+
+// value returns v if it may have its own series, otherwise "other"
+func (l *labelLimiter) value(v string) string {
+	if l.allowed != nil && l.allowed(v) {
+		return v
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, ok := l.seen[v]; ok {
+		return v
+	}
+	if len(l.seen) < l.max {
+		l.seen[v] = struct{}{}
+		return v
+	}
+	droppedLabelValuesTotal.WithLabelValues(l.label).Inc()
+	return otherMerchantLabel
+}
+
+// merchantLabel is the merchant_id label value to record for merchantID
+func merchantLabel(merchantID string) string {
+	return merchantLabels.value(merchantID)
+}
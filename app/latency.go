@@ -0,0 +1,290 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Latency distribution kinds accepted by LATENCY_DISTRIBUTION
+const (
+	latencyUniform   = "uniform"
+	latencyNormal    = "normal"
+	latencyLognormal = "lognormal"
+	latencyPareto    = "pareto"
+)
+
+// latencyDistribution draws simulated processor latencies
+type latencyDistribution interface {
+	sample(r *rand.Rand) time.Duration
+	String() string
+}
+
+// uniformLatency is the original model: BASE_LATENCY_MS plus up to 50ms of
+// uniform jitter
+type uniformLatency struct{}
+
+func (uniformLatency) sample(r *rand.Rand) time.Duration {
+	return time.Duration(getLatencyMs()+r.Intn(50)) * time.Millisecond
+}
+
+func (uniformLatency) String() string {
+	return fmt.Sprintf("uniform(%d-%dms)", getLatencyMs(), getLatencyMs()+50)
+}
+
+// normalLatency is a gaussian around meanMs, truncated at zero
+type normalLatency struct {
+	meanMs, stddevMs float64
+}
+
+func (d normalLatency) sample(r *rand.Rand) time.Duration {
+	return msToDuration(d.meanMs + r.NormFloat64()*d.stddevMs)
+}
+
+func (d normalLatency) String() string {
+	return fmt.Sprintf("normal(mean=%.0fms, stddev=%.0fms)", d.meanMs, d.stddevMs)
+}
+
+// lognormalLatency is parameterized by the mean and standard deviation of
+// the latency itself rather than of its logarithm, so it can be tuned from
+// observed processor stats
+type lognormalLatency struct {
+	meanMs, stddevMs float64
+	mu, sigma        float64
+}
+
+func newLognormalLatency(meanMs, stddevMs float64) lognormalLatency {
+	sigma2 := math.Log(1 + (stddevMs*stddevMs)/(meanMs*meanMs))
+	return lognormalLatency{
+		meanMs:   meanMs,
+		stddevMs: stddevMs,
+		mu:       math.Log(meanMs) - sigma2/2,
+		sigma:    math.Sqrt(sigma2),
+	}
+}
+
+func (d lognormalLatency) sample(r *rand.Rand) time.Duration {
+	return msToDuration(math.Exp(d.mu + d.sigma*r.NormFloat64()))
+}
+
+func (d lognormalLatency) String() string {
+	return fmt.Sprintf("lognormal(mean=%.0fms, stddev=%.0fms)", d.meanMs, d.stddevMs)
+}
+
+// paretoLatency is heavy tailed: most calls are close to the minimum but a
+// few take many times the mean. Lower alpha means a heavier tail; at
+// alpha <= 2 the variance is unbounded.
+type paretoLatency struct {
+	meanMs, alpha float64
+	minMs         float64
+}
+
+func newParetoLatency(meanMs, alpha float64) paretoLatency {
+	return paretoLatency{meanMs: meanMs, alpha: alpha, minMs: meanMs * (alpha - 1) / alpha}
+}
+
+func (d paretoLatency) sample(r *rand.Rand) time.Duration {
+	return msToDuration(d.minMs / math.Pow(1-r.Float64(), 1/d.alpha))
+}
+
+func (d paretoLatency) String() string {
+	return fmt.Sprintf("pareto(mean=%.0fms, alpha=%.2f)", d.meanMs, d.alpha)
+}
+
+func msToDuration(ms float64) time.Duration {
+	if ms < 0 {
+		ms = 0
+	}
+	return time.Duration(ms * float64(time.Millisecond))
+}
+
+// latencyModel picks the distribution for each processor and applies the
+// optional heavy tail and the overall cap
+type latencyModel struct {
+	defaultDist     latencyDistribution
+	perProcessor    map[string]latencyDistribution
+	tailProbability float64
+	tailLatency     time.Duration
+	max             time.Duration
+}
+
+// latencies defaults to the uniform model until loadLatencyModel runs
+var latencies = &latencyModel{defaultDist: uniformLatency{}}
+
+// sample draws the simulated latency of one call to processor
+func (m *latencyModel) sample(r *rand.Rand, processor string) time.Duration {
+	// A config file latency overrides LATENCY_DISTRIBUTIONS
+	dist, ok := currentConfig().latencies[processor]
+	if !ok {
+		dist, ok = m.perProcessor[processor]
+	}
+	if !ok {
+		dist = m.defaultDist
+	}
+	latency := dist.sample(r)
+
+	// Only draw when a tail is configured so seeded runs without one keep
+	// the same sequence of decisions
+	if m.tailProbability > 0 && r.Float64() < m.tailProbability {
+		latency += m.tailLatency
+	}
+	if m.max > 0 && latency > m.max {
+		latency = m.max
+	}
+	return latency
+}
+
+// loadLatencyModel reads the latency configuration:
+//
+//	LATENCY_DISTRIBUTION       uniform (default), normal, lognormal or pareto
+//	LATENCY_MEAN_MS            mean latency, defaults to BASE_LATENCY_MS + 25
+//	LATENCY_STDDEV_MS          standard deviation for normal and lognormal (15)
+//	LATENCY_PARETO_ALPHA       tail index for pareto, must be > 1 (1.8)
+//	LATENCY_DISTRIBUTIONS      per-processor overrides, processor=kind:mean:param
+//	                           where param is the stddev, or alpha for pareto
+//	LATENCY_TAIL_PROBABILITY   chance a call gets LATENCY_TAIL_MS added (0)
+//	LATENCY_TAIL_MS            extra latency for tail calls (5000)
+//	LATENCY_MAX_MS             cap on any single simulated latency (30000)
+func loadLatencyModel() (*latencyModel, error) {
+	mean, err := parseLatencyFloat("LATENCY_MEAN_MS", float64(getLatencyMs()+25))
+	if err != nil {
+		return nil, err
+	}
+	stddev, err := parseLatencyFloat("LATENCY_STDDEV_MS", 15)
+	if err != nil {
+		return nil, err
+	}
+	alpha, err := parseLatencyFloat("LATENCY_PARETO_ALPHA", 1.8)
+	if err != nil {
+		return nil, err
+	}
+
+	kind := getEnv("LATENCY_DISTRIBUTION", latencyUniform)
+	param := stddev
+	if kind == latencyPareto {
+		param = alpha
+	}
+	defaultDist, err := newLatencyDistribution(kind, mean, param)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LATENCY_DISTRIBUTION: %w", err)
+	}
+
+	m := &latencyModel{defaultDist: defaultDist, perProcessor: map[string]latencyDistribution{}}
+	for _, pair := range strings.Split(os.Getenv("LATENCY_DISTRIBUTIONS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		processor, spec, ok := strings.Cut(pair, "=")
+		if !ok || !isKnownProcessor(processor) {
+			return nil, fmt.Errorf("invalid LATENCY_DISTRIBUTIONS entry %q, expected processor=kind:mean:param", pair)
+		}
+		dist, err := parseLatencySpec(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LATENCY_DISTRIBUTIONS entry %q: %w", pair, err)
+		}
+		m.perProcessor[processor] = dist
+	}
+
+	if m.tailProbability, err = parseLatencyFloat("LATENCY_TAIL_PROBABILITY", 0); err != nil {
+		return nil, err
+	}
+	if m.tailProbability > 1 {
+		return nil, fmt.Errorf("invalid LATENCY_TAIL_PROBABILITY %v, must be between 0 and 1", m.tailProbability)
+	}
+	tailMs, err := parseLatencyFloat("LATENCY_TAIL_MS", 5000)
+	if err != nil {
+		return nil, err
+	}
+	maxMs, err := parseLatencyFloat("LATENCY_MAX_MS", 30000)
+	if err != nil {
+		return nil, err
+	}
+	m.tailLatency = msToDuration(tailMs)
+	m.max = msToDuration(maxMs)
+	return m, nil
+}
+
+// parseLatencySpec parses kind[:mean[:param]] as used by LATENCY_DISTRIBUTIONS
+func parseLatencySpec(spec string) (latencyDistribution, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("too many fields")
+	}
+	kind := parts[0]
+	mean := float64(getLatencyMs() + 25)
+	param := 15.0
+	if kind == latencyPareto {
+		param = 1.8
+	}
+
+	values := []*float64{&mean, &param}
+	for i, raw := range parts[1:] {
+		v, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", raw)
+		}
+		*values[i] = v
+	}
+	return newLatencyDistribution(kind, mean, param)
+}
+
+// newLatencyDistribution builds a distribution; param is the standard
+// deviation for normal and lognormal and the tail index for pareto
+func newLatencyDistribution(kind string, meanMs, param float64) (latencyDistribution, error) {
+	if kind != latencyUniform && meanMs <= 0 {
+		return nil, fmt.Errorf("mean must be positive")
+	}
+
+	switch kind {
+	case latencyUniform:
+		return uniformLatency{}, nil
+	case latencyNormal:
+		if param < 0 {
+			return nil, fmt.Errorf("stddev must not be negative")
+		}
+		return normalLatency{meanMs: meanMs, stddevMs: param}, nil
+	case latencyLognormal:
+		if param < 0 {
+			return nil, fmt.Errorf("stddev must not be negative")
+		}
+		return newLognormalLatency(meanMs, param), nil
+	case latencyPareto:
+		if param <= 1 {
+			return nil, fmt.Errorf("pareto alpha must be greater than 1")
+		}
+		return newParetoLatency(meanMs, param), nil
+	default:
+		return nil, fmt.Errorf("unknown distribution %q, expected uniform, normal, lognormal or pareto", kind)
+	}
+}
+
+func parseLatencyFloat(key string, defaultValue float64) (float64, error) {
+	raw := os.Getenv(key)
+	if raw == "" {
+		return defaultValue, nil
+	}
+	v, err := strconv.ParseFloat(raw, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a non-negative number", key, raw)
+	}
+	return v, nil
+}
+
+// describe summarizes the model for the startup log
+func (m *latencyModel) describe() string {
+	parts := []string{m.defaultDist.String()}
+	for _, p := range processors.names() {
+		if d, ok := m.perProcessor[p]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%s", p, d))
+		}
+	}
+	if m.tailProbability > 0 {
+		parts = append(parts, fmt.Sprintf("tail %.2f%% +%s", m.tailProbability*100, m.tailLatency))
+	}
+	return strings.Join(parts, ", ")
+}
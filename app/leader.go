@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// Leader election backends, chosen by LEADER_ELECTION
+const (
+	leaderNone       = "none"
+	leaderRedis      = "redis"
+	leaderKubernetes = "kubernetes"
+)
+
+var (
+	leaderGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "voyager_leader",
+		Help: "1 when this replica is the leader running the singleton background jobs, 0 otherwise",
+	})
+
+	leaderTransitionsTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "voyager_leader_transitions_total",
+		Help: "Total number of times this replica became or stopped being the leader",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(leaderGauge)
+	prometheus.MustRegister(leaderTransitionsTotal)
+}
+
+// leaseLock is a lock held for a TTL by one replica at a time
+type leaseLock interface {
+	// acquire takes the lock for identity, or renews it when identity
+	// already holds it, and reports whether identity holds it now
+	acquire(ctx context.Context, identity string, ttl time.Duration) (bool, error)
+	// release gives the lock up if identity holds it
+	release(ctx context.Context, identity string) error
+	describe() string
+}
+
+// leaderElector decides which replica runs settlement batching,
+// subscription charges, the dispute and payout sweeps, scheduled exports
+// and scenario playback. Without a lock every replica leads, as a single
+// replica should.
+type leaderElector struct {
+	lock     leaseLock
+	identity string
+	ttl      time.Duration
+
+	leader atomic.Bool
+	stop   context.CancelFunc
+	done   chan struct{}
+
+	mu sync.Mutex
+	// watchers are told whenever leadership changes
+	watchers []func(leading bool)
+}
+
+var leadership = &leaderElector{}
+
+func init() {
+	leadership.setLeader(true)
+}
+
+// loadLeaderElection reads LEADER_ELECTION: none (the default), redis,
+// locking voyager:leader in the shared Redis, or kubernetes, holding a
+// coordination.k8s.io Lease named LEADER_LEASE_NAME (default
+// voyager-gateway) in the pod's namespace. LEADER_LEASE_SECONDS is how
+// long leadership outlives a leader that stopped renewing it.
+func loadLeaderElection(client *redis.Client) (*leaderElector, error) {
+	backend := getEnv("LEADER_ELECTION", leaderNone)
+	seconds, err := strconv.Atoi(getEnv("LEADER_LEASE_SECONDS", "15"))
+	if err != nil || seconds < 3 {
+		return nil, fmt.Errorf("invalid LEADER_LEASE_SECONDS, expected at least 3")
+	}
+	e := &leaderElector{identity: instanceID(), ttl: time.Duration(seconds) * time.Second}
+	switch backend {
+	case leaderNone:
+		return nil, nil
+	case leaderRedis:
+		if client == nil {
+			return nil, fmt.Errorf("LEADER_ELECTION=redis requires REDIS_URL")
+		}
+		e.lock = &redisLeaseLock{client: client, key: "voyager:leader"}
+	case leaderKubernetes:
+		lock, err := loadKubernetesLease(getEnv("LEADER_LEASE_NAME", "voyager-gateway"))
+		if err != nil {
+			return nil, err
+		}
+		e.lock = lock
+	default:
+		return nil, fmt.Errorf("invalid LEADER_ELECTION %q, expected %s, %s or %s", backend, leaderNone, leaderRedis, leaderKubernetes)
+	}
+	if e.identity == "" {
+		return nil, fmt.Errorf("leader election needs POD_NAME or a hostname to identify this replica")
+	}
+	return e, nil
+}
+
+// leading reports whether this replica should run the singleton jobs
+func (e *leaderElector) leading() bool {
+	return e.leader.Load()
+}
+
+// watch calls fn with the current leadership and again whenever it changes
+func (e *leaderElector) watch(fn func(leading bool)) {
+	e.mu.Lock()
+	e.watchers = append(e.watchers, fn)
+	leading := e.leading()
+	e.mu.Unlock()
+	fn(leading)
+}
+
+func (e *leaderElector) setLeader(leading bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leader.Swap(leading) == leading {
+		return
+	}
+	if leading {
+		leaderGauge.Set(1)
+	} else {
+		leaderGauge.Set(0)
+	}
+	for _, fn := range e.watchers {
+		fn(leading)
+	}
+}
+
+// start takes part in the election until resign is called. The lock is
+// renewed every third of its TTL; a replica that can't renew it stops
+// leading at once, before the lock expires and another one takes over.
+func (e *leaderElector) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	e.stop, e.done = cancel, make(chan struct{})
+	leaderGauge.Set(0)
+	go e.run(ctx)
+}
+
+func (e *leaderElector) run(ctx context.Context) {
+	defer close(e.done)
+	ticker := time.NewTicker(e.ttl / 3)
+	defer ticker.Stop()
+	for {
+		acquireCtx, cancel := context.WithTimeout(ctx, e.ttl/3)
+		acquired, err := e.lock.acquire(acquireCtx, e.identity, e.ttl)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Printf("Leader election failed: %v", err)
+		}
+		if acquired != e.leading() {
+			leaderTransitionsTotal.Inc()
+			if acquired {
+				log.Printf("Leader election: %s is now the leader", e.identity)
+			} else {
+				log.Printf("Leader election: %s is no longer the leader", e.identity)
+			}
+			e.setLeader(acquired)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// resign leaves the election on shutdown, releasing the lock so another
+// replica takes over without waiting for it to expire
+func (e *leaderElector) resign(ctx context.Context) {
+	if e.stop == nil {
+		return
+	}
+	e.stop()
+	<-e.done
+	if !e.leading() {
+		return
+	}
+	e.setLeader(false)
+	if err := e.lock.release(ctx, e.identity); err != nil {
+		log.Printf("Failed to release leadership: %v", err)
+		return
+	}
+	log.Printf("Leader election: %s released leadership", e.identity)
+}
+
+// acquireLeaderScript takes voyager:leader when it is free and extends it
+// when ARGV[1] already holds it
+var acquireLeaderScript = redis.NewScript(`
+local holder = redis.call('GET', KEYS[1])
+if holder == ARGV[1] then
+  redis.call('PEXPIRE', KEYS[1], ARGV[2])
+  return 1
+end
+if holder then
+  return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+return 1
+`)
+
+var releaseLeaderScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+  return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// redisLeaseLock is a lock key in Redis expiring after its TTL
+type redisLeaseLock struct {
+	client *redis.Client
+	key    string
+}
+
+func (l *redisLeaseLock) acquire(ctx context.Context, identity string, ttl time.Duration) (bool, error) {
+	held, err := acquireLeaderScript.Run(ctx, l.client, []string{l.key}, identity, ttl.Milliseconds()).Int()
+	return held == 1, err
+}
+
+func (l *redisLeaseLock) release(ctx context.Context, identity string) error {
+	return releaseLeaderScript.Run(ctx, l.client, []string{l.key}, identity).Err()
+}
+
+func (l *redisLeaseLock) describe() string {
+	return "Redis key " + l.key
+}
+
+// serviceAccountDir holds the credentials Kubernetes mounts into pods
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// kubernetesLease is a coordination.k8s.io/v1 Lease, updated with the
+// API server's optimistic concurrency so two replicas can't both take it.
+// The service account needs get, create and update on leases.
+type kubernetesLease struct {
+	client    *http.Client
+	url       string
+	name      string
+	namespace string
+	token     string
+}
+
+// leaseObject is the part of a Lease the election reads and writes
+type leaseObject struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int    `json:"leaseDurationSeconds,omitempty"`
+	AcquireTime          string `json:"acquireTime,omitempty"`
+	RenewTime            string `json:"renewTime,omitempty"`
+	LeaseTransitions     int    `json:"leaseTransitions"`
+}
+
+// leaseTimeFormat is the MicroTime format of Lease timestamps
+const leaseTimeFormat = "2006-01-02T15:04:05.000000Z07:00"
+
+// loadKubernetesLease configures the Lease from the in-cluster service
+// account, the way client-go does
+func loadKubernetesLease(name string) (*kubernetesLease, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("LEADER_ELECTION=kubernetes must run inside a cluster (KUBERNETES_SERVICE_HOST is not set)")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("reading service account token: %w", err)
+	}
+	namespace, err := os.ReadFile(serviceAccountDir + "/namespace")
+	if err != nil {
+		return nil, fmt.Errorf("reading service account namespace: %w", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("reading cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	ns := strings.TrimSpace(string(namespace))
+	return &kubernetesLease{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		url:       fmt.Sprintf("https://%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", net.JoinHostPort(host, port), ns),
+		name:      name,
+		namespace: ns,
+		token:     strings.TrimSpace(string(token)),
+	}, nil
+}
+
+func (l *kubernetesLease) acquire(ctx context.Context, identity string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	lease, found, err := l.get(ctx)
+	if err != nil {
+		return false, err
+	}
+	if !found {
+		lease = leaseObject{Metadata: leaseMetadata{Name: l.name, Namespace: l.namespace}}
+	} else if lease.Spec.HolderIdentity != identity && !lease.expired(now) {
+		return false, nil
+	}
+
+	if lease.Spec.HolderIdentity != identity {
+		lease.Spec.HolderIdentity = identity
+		lease.Spec.AcquireTime = now.Format(leaseTimeFormat)
+		if found {
+			lease.Spec.LeaseTransitions++
+		}
+	}
+	lease.Spec.LeaseDurationSeconds = int(ttl / time.Second)
+	lease.Spec.RenewTime = now.Format(leaseTimeFormat)
+	if found {
+		return l.write(ctx, http.MethodPut, l.url+"/"+l.name, lease)
+	}
+	return l.write(ctx, http.MethodPost, l.url, lease)
+}
+
+func (l *kubernetesLease) release(ctx context.Context, identity string) error {
+	lease, found, err := l.get(ctx)
+	if err != nil || !found || lease.Spec.HolderIdentity != identity {
+		return err
+	}
+	lease.Spec.HolderIdentity = ""
+	lease.Spec.RenewTime = ""
+	_, err = l.write(ctx, http.MethodPut, l.url+"/"+l.name, lease)
+	return err
+}
+
+func (l *kubernetesLease) describe() string {
+	return fmt.Sprintf("Kubernetes Lease %s/%s", l.namespace, l.name)
+}
+
+// expired reports whether the holder stopped renewing the lease in time
+func (o leaseObject) expired(now time.Time) bool {
+	if o.Spec.HolderIdentity == "" {
+		return true
+	}
+	renewed, err := time.Parse(leaseTimeFormat, o.Spec.RenewTime)
+	if err != nil {
+		return true
+	}
+	return now.After(renewed.Add(time.Duration(o.Spec.LeaseDurationSeconds) * time.Second))
+}
+
+func (l *kubernetesLease) get(ctx context.Context) (leaseObject, bool, error) {
+	var lease leaseObject
+	resp, err := l.do(ctx, http.MethodGet, l.url+"/"+l.name, nil)
+	if err != nil {
+		return lease, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return lease, false, nil
+	default:
+		return lease, false, fmt.Errorf("getting lease %s: status %d", l.name, resp.StatusCode)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&lease); err != nil {
+		return lease, false, fmt.Errorf("decoding lease %s: %w", l.name, err)
+	}
+	return lease, true, nil
+}
+
+// write creates or updates the lease. A conflict means another replica
+// wrote it first, which loses the election rather than failing it.
+func (l *kubernetesLease) write(ctx context.Context, method, url string, lease leaseObject) (bool, error) {
+	lease.APIVersion, lease.Kind = "coordination.k8s.io/v1", "Lease"
+	body, err := json.Marshal(lease)
+	if err != nil {
+		return false, err
+	}
+	resp, err := l.do(ctx, method, url, body)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusCreated:
+		return true, nil
+	case http.StatusConflict:
+		return false, nil
+	default:
+		return false, fmt.Errorf("writing lease %s: status %d", l.name, resp.StatusCode)
+	}
+}
+
+func (l *kubernetesLease) do(ctx context.Context, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+l.token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return l.client.Do(req)
+}
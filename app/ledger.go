@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Ledger accounts, kept per merchant and currency. Asset accounts grow
+// with debits, the others with credits.
+const (
+	// ledgerCardHolds and ledgerAuthorized track authorized funds not yet
+	// captured, a memo pair that moves no money
+	ledgerCardHolds  = "card_holds"
+	ledgerAuthorized = "authorized"
+	// ledgerProcessorReceivable is what processors owe for captures
+	ledgerProcessorReceivable = "processor_receivable"
+	// ledgerMerchantBalance is what the gateway owes the merchant
+	ledgerMerchantBalance = "merchant_balance"
+	// ledgerProcessorFees is what the merchant owes processors in fees
+	ledgerProcessorFees = "processor_fees"
+	// ledgerPayoutsInTransit is paid out funds that haven't arrived
+	ledgerPayoutsInTransit = "payouts_in_transit"
+	// ledgerPaidOut is what payouts have delivered to merchants
+	ledgerPaidOut = "paid_out"
+)
+
+// ledgerAssetAccounts are the debit-normal accounts
+var ledgerAssetAccounts = map[string]bool{ledgerCardHolds: true, ledgerProcessorReceivable: true}
+
+// Ledger entry types; with the reference ID they identify an entry, so
+// recording one twice is a no-op
+const (
+	entryAuthorization        = "authorization"
+	entryAuthorizationExpired = "authorization_expired"
+	entryIncrement            = "authorization_increment"
+	entryCapture              = "capture"
+	entryFee                  = "fee"
+	entryRefund               = "refund"
+	entryPayout               = "payout"
+	entryPayoutPaid           = "payout_paid"
+	entryPayoutFailed         = "payout_failed"
+)
+
+// Page sizes for GET /merchants/{id}/ledger
+const (
+	defaultLedgerPageSize = 100
+	maxLedgerPageSize     = 1000
+)
+
+// LedgerLine debits or credits one account, in minor units
+type LedgerLine struct {
+	Account     string `json:"account"`
+	DebitMinor  int64  `json:"debit_minor,omitempty"`
+	CreditMinor int64  `json:"credit_minor,omitempty"`
+}
+
+// LedgerEntry is a balanced set of lines recording one money movement
+type LedgerEntry struct {
+	EntryID    string `json:"entry_id"`
+	MerchantID string `json:"merchant_id"`
+	Currency   string `json:"currency"`
+	Type       string `json:"type"`
+	// ReferenceID is the transaction, capture, refund or payout the entry
+	// records
+	ReferenceID string       `json:"reference_id"`
+	Lines       []LedgerLine `json:"lines"`
+	CreatedAt   string       `json:"created_at"`
+}
+
+// LedgerFilter narrows a ledger listing. Zero values match everything.
+type LedgerFilter struct {
+	MerchantID  string
+	Currency    string
+	ReferenceID string
+	// Types are the entry types to match
+	Types []string
+	// CreatedFrom and CreatedTo bound created_at, inclusive
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	Limit       int
+}
+
+func (f LedgerFilter) matches(e LedgerEntry) bool {
+	return (f.MerchantID == "" || e.MerchantID == f.MerchantID) &&
+		(f.Currency == "" || e.Currency == f.Currency) &&
+		(f.ReferenceID == "" || e.ReferenceID == f.ReferenceID) &&
+		(len(f.Types) == 0 || slices.Contains(f.Types, e.Type)) &&
+		(f.CreatedFrom.IsZero() || e.CreatedAt >= formatTimestamp(f.CreatedFrom)) &&
+		(f.CreatedTo.IsZero() || e.CreatedAt <= formatTimestamp(f.CreatedTo))
+}
+
+// LedgerAccountTotal sums an account's lines in one currency
+type LedgerAccountTotal struct {
+	Currency    string
+	Account     string
+	DebitMinor  int64
+	CreditMinor int64
+}
+
+// MerchantBalance is a merchant's balances in one currency
+type MerchantBalance struct {
+	Currency string `json:"currency"`
+	// Balance is merchant_balance, split into Pending funds still within
+	// the settlement delay, Reserved funds held by the rolling reserve and
+	// the Available rest, which payouts can draw on
+	Balance        float64 `json:"balance"`
+	BalanceMinor   int64   `json:"balance_minor"`
+	Pending        float64 `json:"pending"`
+	PendingMinor   int64   `json:"pending_minor"`
+	Reserved       float64 `json:"reserved"`
+	ReservedMinor  int64   `json:"reserved_minor"`
+	Available      float64 `json:"available"`
+	AvailableMinor int64   `json:"available_minor"`
+	// Accounts has every account's balance on its normal side
+	Accounts map[string]int64 `json:"accounts"`
+}
+
+// MerchantBalances is the body of GET /merchants/{id}/balance
+type MerchantBalances struct {
+	MerchantID string            `json:"merchant_id"`
+	Balances   []MerchantBalance `json:"balances"`
+}
+
+// newLedgerEntryID starts with the creation time, so IDs order entries
+// created within the same second
+func newLedgerEntryID() string {
+	return newTimeOrderedID("le_")
+}
+
+// transfer returns the lines moving minor units from debit to credit
+func transfer(debit, credit string, minor int64) []LedgerLine {
+	return []LedgerLine{{Account: debit, DebitMinor: minor}, {Account: credit, CreditMinor: minor}}
+}
+
+// newestEntriesFirst orders ledger entries by created_at then ID, newest
+// first
+func newestEntriesFirst(entries []LedgerEntry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].CreatedAt != entries[j].CreatedAt {
+			return entries[i].CreatedAt > entries[j].CreatedAt
+		}
+		return entries[i].EntryID > entries[j].EntryID
+	})
+}
+
+// recordLedgerEntry stores a balanced entry, logging rather than failing
+// the money movement it records. Zero amount lines are dropped.
+func recordLedgerEntry(merchantID, currency, entryType, referenceID string, lines ...[]LedgerLine) {
+	e := LedgerEntry{
+		EntryID:     newLedgerEntryID(),
+		MerchantID:  merchantID,
+		Currency:    currency,
+		Type:        entryType,
+		ReferenceID: referenceID,
+		CreatedAt:   formatTimestamp(time.Now()),
+	}
+	n := 0
+	for _, pair := range lines {
+		n += len(pair)
+	}
+	e.Lines = make([]LedgerLine, 0, n)
+	var debits, credits int64
+	for _, pair := range lines {
+		for _, l := range pair {
+			if l.DebitMinor == 0 && l.CreditMinor == 0 {
+				continue
+			}
+			debits += l.DebitMinor
+			credits += l.CreditMinor
+			e.Lines = append(e.Lines, l)
+		}
+	}
+	if debits != credits {
+		log.Printf("Refusing unbalanced %s ledger entry for %s: debits %d, credits %d", entryType, referenceID, debits, credits)
+		return
+	}
+	if len(e.Lines) == 0 {
+		return
+	}
+
+	ctx, cancel := storageContext()
+	defer cancel()
+	if err := storage.createLedgerEntry(ctx, e); err != nil && err != errDuplicateRecord {
+		storageErrorsTotal.WithLabelValues("create_ledger_entry").Inc()
+		log.Printf("Failed to record %s ledger entry for %s: %v", entryType, referenceID, err)
+	}
+}
+
+// recordAuthorizationEntry holds an approved authorization's amount
+func recordAuthorizationEntry(merchantID string, response AuthorizationResponse) {
+	recordLedgerEntry(merchantID, response.Currency, entryAuthorization, response.TransactionID,
+		transfer(ledgerCardHolds, ledgerAuthorized, response.AmountMinor))
+}
+
+// recordIncrementEntry holds the amount an authorization was raised by
+func recordIncrementEntry(merchantID string, inc AuthorizationIncrement) {
+	recordLedgerEntry(merchantID, inc.Currency, entryIncrement, inc.IncrementID,
+		transfer(ledgerCardHolds, ledgerAuthorized, inc.AmountMinor))
+}
+
+// recordExpiryEntry releases the hold of an authorization that expired
+// before it was captured in full
+func recordExpiryEntry(txn Transaction) {
+	txn = txn.withMinorUnits()
+	recordLedgerEntry(txn.MerchantID, txn.Currency, entryAuthorizationExpired, txn.TransactionID,
+		transfer(ledgerAuthorized, ledgerCardHolds, txn.AmountMinor))
+	// A partially captured authorization is closed as its final capture
+	// would have, charging the fee on what was captured
+	if txn.CapturedAmountMinor > 0 {
+		recordLedgerEntry(txn.MerchantID, txn.Currency, entryFee, txn.TransactionID,
+			transfer(ledgerMerchantBalance, ledgerProcessorFees, currentConfig().processorFees(txn.Processor).fee(txn.CapturedAmountMinor, txn.Currency)))
+	}
+}
+
+// recordCaptureEntries credits the merchant with a capture of txn. The
+// final capture also releases the authorization hold and charges the
+// processor's fee on everything captured, as settlements do.
+func recordCaptureEntries(txn Transaction, capture Capture) {
+	txn = txn.withMinorUnits()
+	var release, fee int64
+	if capture.Final {
+		release = txn.AmountMinor
+		fee = currentConfig().processorFees(txn.Processor).fee(txn.CapturedAmountMinor, txn.Currency)
+	}
+	recordLedgerEntry(txn.MerchantID, txn.Currency, entryCapture, capture.CaptureID,
+		transfer(ledgerAuthorized, ledgerCardHolds, release),
+		transfer(ledgerProcessorReceivable, ledgerMerchantBalance, capture.AmountMinor))
+	recordLedgerEntry(txn.MerchantID, txn.Currency, entryFee, capture.CaptureID,
+		transfer(ledgerMerchantBalance, ledgerProcessorFees, fee))
+}
+
+// recordRefundEntry debits the merchant with a refund
+func recordRefundEntry(merchantID string, refund Refund) {
+	recordLedgerEntry(merchantID, refund.Currency, entryRefund, refund.RefundID,
+		transfer(ledgerMerchantBalance, ledgerProcessorReceivable, refund.AmountMinor))
+}
+
+// recordPayoutEntry moves a payout's amount out of the merchant's balance
+// when it is created, out of the gateway once paid, and back if it fails
+func recordPayoutEntry(p Payout) {
+	p = p.withMinorUnits()
+	switch p.Status {
+	case payoutPending:
+		recordLedgerEntry(p.MerchantID, p.Currency, entryPayout, p.PayoutID,
+			transfer(ledgerMerchantBalance, ledgerPayoutsInTransit, p.AmountMinor))
+	case payoutPaid:
+		recordLedgerEntry(p.MerchantID, p.Currency, entryPayoutPaid, p.PayoutID,
+			transfer(ledgerPayoutsInTransit, ledgerPaidOut, p.AmountMinor))
+	case payoutFailed:
+		recordLedgerEntry(p.MerchantID, p.Currency, entryPayoutFailed, p.PayoutID,
+			transfer(ledgerPayoutsInTransit, ledgerMerchantBalance, p.AmountMinor))
+	}
+}
+
+// merchantBalances turns account totals into balances per currency
+func merchantBalances(totals []LedgerAccountTotal) []MerchantBalance {
+	byCurrency := map[string]*MerchantBalance{}
+	var currencies []string
+	for _, t := range totals {
+		b, ok := byCurrency[t.Currency]
+		if !ok {
+			b = &MerchantBalance{Currency: t.Currency, Accounts: map[string]int64{}}
+			byCurrency[t.Currency] = b
+			currencies = append(currencies, t.Currency)
+		}
+		balance := t.CreditMinor - t.DebitMinor
+		if ledgerAssetAccounts[t.Account] {
+			balance = -balance
+		}
+		b.Accounts[t.Account] += balance
+	}
+	sort.Strings(currencies)
+	balances := make([]MerchantBalance, 0, len(currencies))
+	for _, currency := range currencies {
+		b := byCurrency[currency]
+		b.BalanceMinor = b.Accounts[ledgerMerchantBalance]
+		b.Balance = fromMinorUnits(b.BalanceMinor, currency)
+		balances = append(balances, *b)
+	}
+	return balances
+}
+
+// merchantPathID returns the {id} merchant, writing a 404 if an
+// authenticated merchant asks for another one's data
+func merchantPathID(w http.ResponseWriter, r *http.Request) (string, bool) {
+	id := r.PathValue("id")
+	if merchantID, ok := merchantFromContext(r.Context()); ok && id != merchantID {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Merchant not found", nil)
+		return "", false
+	}
+	return id, true
+}
+
+// handleMerchantBalance returns a merchant's ledger balances per currency
+// (GET /merchants/{id}/balance)
+func handleMerchantBalance(w http.ResponseWriter, r *http.Request) {
+	merchantID, ok := merchantPathID(w, r)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	balances, err := merchantBalancesAt(ctx, merchantID, time.Now())
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("ledger_totals").Inc()
+		log.Printf("Failed to total the ledger of %s: %v", merchantID, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(MerchantBalances{MerchantID: merchantID, Balances: balances})
+}
+
+// handleMerchantLedger lists a merchant's ledger entries, newest first
+// (GET /merchants/{id}/ledger). Filters: currency and reference_id; limit
+// caps the page.
+func handleMerchantLedger(w http.ResponseWriter, r *http.Request) {
+	merchantID, ok := merchantPathID(w, r)
+	if !ok {
+		return
+	}
+	q := r.URL.Query()
+	filter := LedgerFilter{MerchantID: merchantID, Currency: strings.ToUpper(q.Get("currency")), ReferenceID: q.Get("reference_id"), Limit: defaultLedgerPageSize}
+	if raw := q.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit < 1 || limit > maxLedgerPageSize {
+			writeValidationError(w, r, []FieldViolation{{"limit", fmt.Sprintf("must be between 1 and %d", maxLedgerPageSize)}})
+			return
+		}
+		filter.Limit = limit
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	entries, err := storage.ledgerEntries(ctx, filter)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_ledger_entries").Inc()
+		log.Printf("Failed to list the ledger of %s: %v", merchantID, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	if entries == nil {
+		entries = []LedgerEntry{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,484 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Load generator limits, so a typo can't take the gateway down for a day
+const (
+	maxLoadGenRPS      = 10000
+	maxLoadGenDuration = time.Hour
+	maxLoadGenInFlight = 100000
+	// loadGenTick is how often the generator sends the requests that fell
+	// due since the last tick
+	loadGenTick = 10 * time.Millisecond
+	// loadGenSamples is how many latencies the percentiles are taken from
+	loadGenSamples = 10000
+)
+
+// Amount distributions of the load generator
+const (
+	loadGenAmountFixed     = "fixed"
+	loadGenAmountUniform   = "uniform"
+	loadGenAmountLognormal = "lognormal"
+)
+
+// defaultLoadGenCardTokens are test cards of the two biggest brands, which
+// every simulated processor accepts
+var defaultLoadGenCardTokens = []string{"4111111111111111", "5555555555554444"}
+
+var loadGenRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_loadgen_requests_total",
+		Help: "Total number of authorizations sent by the built-in load generator, by outcome",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(loadGenRequestsTotal)
+}
+
+// LoadGenMerchant is a merchant in the generated traffic, drawn in
+// proportion to its weight
+type LoadGenMerchant struct {
+	MerchantID string  `json:"merchant_id"`
+	Weight     float64 `json:"weight,omitempty"`
+}
+
+// LoadGenAmounts is the distribution amounts are drawn from, in minor
+// units: fixed at mean_minor, uniform between min_minor and max_minor, or
+// lognormal around mean_minor with stddev_minor, capped at max_minor if set
+type LoadGenAmounts struct {
+	Distribution string `json:"distribution"`
+	MinMinor     int64  `json:"min_minor,omitempty"`
+	MaxMinor     int64  `json:"max_minor,omitempty"`
+	MeanMinor    int64  `json:"mean_minor,omitempty"`
+	StddevMinor  int64  `json:"stddev_minor,omitempty"`
+}
+
+// LoadGenRequest is the body of POST /admin/loadgen
+type LoadGenRequest struct {
+	RPS      float64 `json:"rps"`
+	Duration string  `json:"duration"`
+	// Merchants default to a single loadgen merchant
+	Merchants []LoadGenMerchant `json:"merchants,omitempty"`
+	// Amounts default to uniform between 1.00 and 500.00
+	Amounts    *LoadGenAmounts `json:"amounts,omitempty"`
+	Currencies []string        `json:"currencies,omitempty"`
+	CardTokens []string        `json:"card_tokens,omitempty"`
+	// MaxInFlight caps the authorizations awaiting a result; requests due
+	// beyond it are counted as dropped rather than queued, default 10000
+	MaxInFlight int `json:"max_in_flight,omitempty"`
+}
+
+// LoadGenLatency summarizes the latency of completed authorizations, from
+// when they were sent until their result
+type LoadGenLatency struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// LoadGenStatus is the running or last load generator run
+type LoadGenStatus struct {
+	Running        bool             `json:"running"`
+	TargetRPS      float64          `json:"target_rps,omitempty"`
+	StartedAt      string           `json:"started_at,omitempty"`
+	EndsAt         string           `json:"ends_at,omitempty"`
+	ElapsedSeconds float64          `json:"elapsed_seconds"`
+	Sent           int64            `json:"sent"`
+	Completed      int64            `json:"completed"`
+	InFlight       int64            `json:"in_flight"`
+	Dropped        int64            `json:"dropped"`
+	AchievedRPS    float64          `json:"achieved_rps"`
+	Approved       int64            `json:"approved"`
+	Declined       int64            `json:"declined"`
+	RequiresAction int64            `json:"requires_action"`
+	Rejected       int64            `json:"rejected"`
+	Rejections     map[string]int64 `json:"rejections,omitempty"`
+	LatencyMs      LoadGenLatency   `json:"latency_ms"`
+}
+
+// validate checks a run definition and fills in the defaults
+func (req *LoadGenRequest) validate() (time.Duration, []FieldViolation) {
+	var violations []FieldViolation
+	if req.RPS <= 0 || req.RPS > maxLoadGenRPS {
+		violations = append(violations, FieldViolation{"rps", fmt.Sprintf("must be between 0 (exclusive) and %d", maxLoadGenRPS)})
+	}
+	duration, err := time.ParseDuration(req.Duration)
+	if err != nil || duration < time.Second || duration > maxLoadGenDuration {
+		violations = append(violations, FieldViolation{"duration", fmt.Sprintf("must be a duration between 1s and %s", maxLoadGenDuration)})
+	}
+
+	if len(req.Merchants) == 0 {
+		req.Merchants = []LoadGenMerchant{{MerchantID: "loadgen"}}
+	}
+	for i := range req.Merchants {
+		m := &req.Merchants[i]
+		if !merchantIDPattern.MatchString(m.MerchantID) {
+			violations = append(violations, FieldViolation{fmt.Sprintf("merchants[%d].merchant_id", i), "must be 1-64 characters of letters, digits, '_' or '-'"})
+		} else if !currentConfig().isRegisteredMerchant(m.MerchantID) {
+			violations = append(violations, FieldViolation{fmt.Sprintf("merchants[%d].merchant_id", i), "is not a registered merchant"})
+		}
+		if m.Weight < 0 {
+			violations = append(violations, FieldViolation{fmt.Sprintf("merchants[%d].weight", i), "must not be negative"})
+		} else if m.Weight == 0 {
+			m.Weight = 1
+		}
+	}
+
+	if req.Amounts == nil {
+		req.Amounts = &LoadGenAmounts{Distribution: loadGenAmountUniform, MinMinor: 100, MaxMinor: 50000}
+	}
+	violations = append(violations, req.Amounts.validate()...)
+
+	if len(req.Currencies) == 0 {
+		req.Currencies = []string{"USD"}
+	}
+	for i, currency := range req.Currencies {
+		req.Currencies[i] = strings.ToUpper(currency)
+		if !iso4217Currencies[req.Currencies[i]] {
+			violations = append(violations, FieldViolation{fmt.Sprintf("currencies[%d]", i), "must be a valid ISO 4217 currency code"})
+		}
+	}
+
+	if len(req.CardTokens) == 0 {
+		req.CardTokens = defaultLoadGenCardTokens
+	}
+	for i, token := range req.CardTokens {
+		if strings.TrimSpace(token) == "" {
+			violations = append(violations, FieldViolation{fmt.Sprintf("card_tokens[%d]", i), "must not be empty"})
+		}
+	}
+
+	if req.MaxInFlight == 0 {
+		req.MaxInFlight = 10000
+	}
+	if req.MaxInFlight < 1 || req.MaxInFlight > maxLoadGenInFlight {
+		violations = append(violations, FieldViolation{"max_in_flight", fmt.Sprintf("must be between 1 and %d", maxLoadGenInFlight)})
+	}
+	return duration, violations
+}
+
+func (a *LoadGenAmounts) validate() []FieldViolation {
+	var violations []FieldViolation
+	switch a.Distribution {
+	case loadGenAmountFixed:
+		if a.MeanMinor <= 0 {
+			violations = append(violations, FieldViolation{"amounts.mean_minor", "must be positive"})
+		}
+	case loadGenAmountUniform:
+		if a.MinMinor <= 0 || a.MaxMinor < a.MinMinor {
+			violations = append(violations, FieldViolation{"amounts", "needs 0 < min_minor <= max_minor"})
+		}
+	case loadGenAmountLognormal:
+		if a.MeanMinor <= 0 || a.StddevMinor <= 0 {
+			violations = append(violations, FieldViolation{"amounts", "needs positive mean_minor and stddev_minor"})
+		}
+		if a.MaxMinor < 0 {
+			violations = append(violations, FieldViolation{"amounts.max_minor", "must not be negative"})
+		}
+	default:
+		violations = append(violations, FieldViolation{"amounts.distribution", "must be one of fixed, uniform, lognormal"})
+	}
+	return violations
+}
+
+// draw returns an amount in minor units
+func (a *LoadGenAmounts) draw(r *rand.Rand) int64 {
+	switch a.Distribution {
+	case loadGenAmountUniform:
+		return a.MinMinor + r.Int63n(a.MaxMinor-a.MinMinor+1)
+	case loadGenAmountLognormal:
+		mean, stddev := float64(a.MeanMinor), float64(a.StddevMinor)
+		sigma2 := math.Log(1 + stddev*stddev/(mean*mean))
+		minor := int64(math.Round(math.Exp(math.Log(mean) - sigma2/2 + math.Sqrt(sigma2)*r.NormFloat64())))
+		if a.MaxMinor > 0 && minor > a.MaxMinor {
+			minor = a.MaxMinor
+		}
+		return max(minor, 1)
+	default:
+		return a.MeanMinor
+	}
+}
+
+// loadGenRun is one run of the load generator. The counters are updated by
+// the authorizations as they complete, which may be after the run ended.
+type loadGenRun struct {
+	spec      LoadGenRequest
+	startedAt time.Time
+	endsAt    time.Time
+	stop      chan struct{}
+	// rand and weights are only used by the goroutine driving the run
+	rand    *rand.Rand
+	weights []float64
+
+	sent      atomic.Int64
+	completed atomic.Int64
+	inFlight  atomic.Int64
+	dropped   atomic.Int64
+
+	mu             sync.Mutex
+	endedAt        time.Time
+	approved       int64
+	declined       int64
+	requiresAction int64
+	rejections     map[string]int64
+	// samples is a uniform sample of the completed latencies in ms
+	samples []float64
+	maxMs   float64
+}
+
+// loadGenerator runs at most one load generator run at a time and keeps
+// the last one for its stats
+type loadGenerator struct {
+	mu  sync.Mutex
+	run *loadGenRun
+}
+
+var loadGen = &loadGenerator{}
+
+// start replaces any running run with one sending spec's traffic
+func (g *loadGenerator) start(spec LoadGenRequest, duration time.Duration) LoadGenStatus {
+	run := &loadGenRun{
+		spec:       spec,
+		startedAt:  time.Now(),
+		stop:       make(chan struct{}),
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		rejections: make(map[string]int64),
+	}
+	run.endsAt = run.startedAt.Add(duration)
+	total := 0.0
+	for _, m := range spec.Merchants {
+		total += m.Weight
+		run.weights = append(run.weights, total)
+	}
+
+	g.mu.Lock()
+	if g.run != nil {
+		g.run.end()
+	}
+	g.run = run
+	g.mu.Unlock()
+
+	go run.drive(duration)
+	log.Printf("Load generator started: %.0f rps for %s across %d merchants", spec.RPS, duration, len(spec.Merchants))
+	return run.status()
+}
+
+// halt stops the running run, reporting false if none is running
+func (g *loadGenerator) halt() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.run == nil || !g.run.end() {
+		return false
+	}
+	log.Printf("Load generator stopped after %d authorizations", g.run.sent.Load())
+	return true
+}
+
+func (g *loadGenerator) status() LoadGenStatus {
+	g.mu.Lock()
+	run := g.run
+	g.mu.Unlock()
+	if run == nil {
+		return LoadGenStatus{}
+	}
+	return run.status()
+}
+
+// end stops sending, reporting false if the run had already ended
+func (run *loadGenRun) end() bool {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if !run.endedAt.IsZero() {
+		return false
+	}
+	run.endedAt = time.Now()
+	close(run.stop)
+	return true
+}
+
+// drive sends the requests as they fall due until the run ends. Pacing is
+// open loop: a slow gateway doesn't slow the generator down, so the backlog
+// shows up as in-flight and dropped requests instead of a lower rate.
+func (run *loadGenRun) drive(duration time.Duration) {
+	ticker := time.NewTicker(loadGenTick)
+	defer ticker.Stop()
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+	for {
+		select {
+		case <-run.stop:
+			return
+		case <-timer.C:
+			if run.end() {
+				log.Printf("Load generator finished: %d authorizations in %s", run.sent.Load(), duration)
+			}
+			return
+		case now := <-ticker.C:
+			due := int64(run.spec.RPS*now.Sub(run.startedAt).Seconds()) - run.sent.Load() - run.dropped.Load()
+			for ; due > 0; due-- {
+				run.send()
+			}
+		}
+	}
+}
+
+// send starts one authorization through the same path as POST /authorize.
+// It is deferred, so a simulated processor call waits on a timer rather
+// than holding a goroutine.
+func (run *loadGenRun) send() {
+	if run.inFlight.Load() >= int64(run.spec.MaxInFlight) {
+		run.dropped.Add(1)
+		loadGenRequestsTotal.WithLabelValues("dropped").Inc()
+		return
+	}
+	minor := run.spec.Amounts.draw(run.rand)
+	req := AuthorizationRequest{
+		MerchantID:  run.drawMerchant(),
+		AmountMinor: &minor,
+		Currency:    run.spec.Currencies[run.rand.Intn(len(run.spec.Currencies))],
+		CardToken:   run.spec.CardTokens[run.rand.Intn(len(run.spec.CardTokens))],
+		origin:      auditOrigin{actor: actorLoadGen},
+	}
+	run.inFlight.Add(1)
+	run.sent.Add(1)
+	sentAt := time.Now()
+	go authorizeDeferred(req, sentAt, func(response AuthorizationResponse, rejection *authorizationRejection) {
+		run.record(time.Since(sentAt), response, rejection)
+	})
+}
+
+func (run *loadGenRun) drawMerchant() string {
+	total := run.weights[len(run.weights)-1]
+	i := sort.SearchFloat64s(run.weights, run.rand.Float64()*total)
+	if i == len(run.weights) {
+		i--
+	}
+	return run.spec.Merchants[i].MerchantID
+}
+
+// record counts a completed authorization and samples its latency
+func (run *loadGenRun) record(latency time.Duration, response AuthorizationResponse, rejection *authorizationRejection) {
+	outcome := "rejected"
+	if rejection == nil {
+		outcome = response.Status
+	}
+	loadGenRequestsTotal.WithLabelValues(outcome).Inc()
+	ms := float64(latency.Microseconds()) / 1000
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	switch outcome {
+	case "approved":
+		run.approved++
+	case "requires_action":
+		run.requiresAction++
+	case "rejected":
+		run.rejections[rejection.Code]++
+	default:
+		run.declined++
+	}
+	completed := run.completed.Add(1)
+	run.inFlight.Add(-1)
+	run.maxMs = max(run.maxMs, ms)
+	// Reservoir sampling keeps every latency equally likely to be sampled
+	if len(run.samples) < loadGenSamples {
+		run.samples = append(run.samples, ms)
+	} else if i := rand.Int63n(completed); i < loadGenSamples {
+		run.samples[i] = ms
+	}
+}
+
+func (run *loadGenRun) status() LoadGenStatus {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	end := time.Now()
+	if !run.endedAt.IsZero() {
+		end = run.endedAt
+	}
+	elapsed := end.Sub(run.startedAt).Seconds()
+	s := LoadGenStatus{
+		Running:        run.endedAt.IsZero(),
+		TargetRPS:      run.spec.RPS,
+		StartedAt:      run.startedAt.UTC().Format(time.RFC3339),
+		EndsAt:         run.endsAt.UTC().Format(time.RFC3339),
+		ElapsedSeconds: math.Round(elapsed*10) / 10,
+		Sent:           run.sent.Load(),
+		Completed:      run.completed.Load(),
+		InFlight:       run.inFlight.Load(),
+		Dropped:        run.dropped.Load(),
+		Approved:       run.approved,
+		Declined:       run.declined,
+		RequiresAction: run.requiresAction,
+		Rejections:     make(map[string]int64, len(run.rejections)),
+	}
+	for code, n := range run.rejections {
+		s.Rejections[code] = n
+		s.Rejected += n
+	}
+	if elapsed > 0 {
+		s.AchievedRPS = math.Round(float64(s.Completed)/elapsed*10) / 10
+	}
+	if len(run.samples) > 0 {
+		sorted := append([]float64(nil), run.samples...)
+		sort.Float64s(sorted)
+		percentile := func(p float64) float64 {
+			return sorted[int(math.Ceil(p*float64(len(sorted))))-1]
+		}
+		s.LatencyMs = LoadGenLatency{P50: percentile(0.50), P95: percentile(0.95), P99: percentile(0.99), Max: run.maxMs}
+	}
+	return s
+}
+
+// handleLoadGenStart starts the load generator, replacing any run in
+// progress (POST /admin/loadgen)
+func handleLoadGenStart(w http.ResponseWriter, r *http.Request) {
+	var req LoadGenRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON load generator request"}})
+		return
+	}
+	duration, violations := req.validate()
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	status := loadGen.start(req, duration)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// handleLoadGenStatus reports the running or last run
+// (GET /admin/loadgen/status)
+func handleLoadGenStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(loadGen.status())
+}
+
+// handleLoadGenStop stops the running run (DELETE /admin/loadgen)
+func handleLoadGenStop(w http.ResponseWriter, r *http.Request) {
+	if !loadGen.halt() {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "The load generator is not running", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	concurrencyQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "voyager_concurrency_queue_depth",
+			Help: "Number of authorizations waiting for a concurrency slot",
+		},
+	)
+
+	loadShedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_load_shed_total",
+			Help: "Total number of authorizations shed by the concurrency limiter",
+		},
+		[]string{"reason"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(concurrencyQueueDepth)
+	prometheus.MustRegister(loadShedTotal)
+}
+
+// concurrencyLimiter caps in-flight authorizations. Requests beyond the cap
+// wait up to queueTimeout for a slot, with at most maxQueue waiting at once.
+type concurrencyLimiter struct {
+	slots        chan struct{}
+	queued       int64
+	maxQueue     int64
+	queueTimeout time.Duration
+}
+
+// authLimiter is nil when MAX_CONCURRENT_REQUESTS is unset
+var authLimiter *concurrencyLimiter
+
+// loadConcurrencyLimiter reads MAX_CONCURRENT_REQUESTS, MAX_QUEUED_REQUESTS
+// and QUEUE_TIMEOUT_MS. A queue timeout of 0 sheds immediately once all
+// slots are taken.
+func loadConcurrencyLimiter() *concurrencyLimiter {
+	limit, err := strconv.Atoi(getEnv("MAX_CONCURRENT_REQUESTS", "0"))
+	if err != nil || limit <= 0 {
+		return nil
+	}
+	maxQueue, err := strconv.Atoi(getEnv("MAX_QUEUED_REQUESTS", strconv.Itoa(limit)))
+	if err != nil || maxQueue < 0 {
+		maxQueue = limit
+	}
+	timeoutMs, err := strconv.Atoi(getEnv("QUEUE_TIMEOUT_MS", "100"))
+	if err != nil || timeoutMs < 0 {
+		timeoutMs = 100
+	}
+
+	return &concurrencyLimiter{
+		slots:        make(chan struct{}, limit),
+		maxQueue:     int64(maxQueue),
+		queueTimeout: time.Duration(timeoutMs) * time.Millisecond,
+	}
+}
+
+// acquire takes a slot, queueing briefly if none is free. It returns the
+// reason the request was shed when no slot could be obtained.
+func (l *concurrencyLimiter) acquire(r *http.Request) (bool, string) {
+	select {
+	case l.slots <- struct{}{}:
+		return true, ""
+	default:
+	}
+
+	if l.queueTimeout == 0 {
+		return false, "at_capacity"
+	}
+	if atomic.AddInt64(&l.queued, 1) > l.maxQueue {
+		atomic.AddInt64(&l.queued, -1)
+		return false, "queue_full"
+	}
+	concurrencyQueueDepth.Inc()
+	defer func() {
+		atomic.AddInt64(&l.queued, -1)
+		concurrencyQueueDepth.Dec()
+	}()
+
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		return true, ""
+	case <-timer.C:
+		return false, "queue_timeout"
+	case <-r.Context().Done():
+		return false, "client_gone"
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+// limitConcurrency sheds requests with 503 when the gateway is saturated
+func limitConcurrency(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if authLimiter == nil {
+			next(w, r)
+			return
+		}
+
+		ok, reason := authLimiter.acquire(r)
+		if !ok {
+			loadShedTotal.WithLabelValues(reason).Inc()
+			w.Header().Set("Retry-After", "1")
+			writeError(w, r, http.StatusServiceUnavailable, errCodeOverloaded, "Service overloaded, retry later", nil)
+			return
+		}
+		defer authLimiter.release()
+
+		next(w, r)
+	}
+}
@@ -1,18 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 // Metrics for observability
@@ -21,17 +23,22 @@ var (
 		prometheus.CounterOpts{
 			Name: "voyager_authorization_total",
 			Help: "Total number of authorization requests",
+			// version lets canary analysis compare stable and canary
+			ConstLabels: prometheus.Labels{"version": getVersion()},
 		},
-		[]string{"status", "processor", "merchant_id"},
+		[]string{"status", "processor", "merchant_id", "tenant"},
 	)
 
 	authorizationDuration = prometheus.NewHistogramVec(
-		prometheus.HistogramOpts{
-			Name:    "voyager_authorization_duration_seconds",
-			Help:    "Authorization request duration in seconds",
-			Buckets: []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5},
-		},
-		[]string{"processor", "merchant_id"},
+		withVersionLabel(latencyHistogramOpts("voyager_authorization_duration_seconds", "Authorization request duration in seconds")),
+		[]string{"processor", "merchant_id", "tenant"},
+	)
+
+	// processorCallDuration is the part of authorizationDuration spent
+	// waiting on the processor; the rest is gateway overhead
+	processorCallDuration = prometheus.NewHistogramVec(
+		latencyHistogramOpts("voyager_processor_call_duration_seconds", "Processor authorization call duration in seconds"),
+		[]string{"processor"},
 	)
 
 	authorizationSuccessRate = prometheus.NewGaugeVec(
@@ -63,16 +70,60 @@ var (
 	successRequests int64
 )
 
-// Simulated payment processors with their "credentials"
-var processors = []string{"stripe", "adyen", "mercadopago"}
-
 // AuthorizationRequest represents an incoming payment authorization
 type AuthorizationRequest struct {
 	MerchantID    string  `json:"merchant_id"`
-	Amount        float64 `json:"amount"`
+	// AmountMinor is the amount in the currency's minor unit, e.g. cents.
+	// Amount is the legacy decimal form, accepted while
+	// FLOAT_AMOUNTS_ENABLED=true and derived from AmountMinor otherwise.
+	AmountMinor   *int64  `json:"amount_minor,omitempty"`
+	Amount        float64 `json:"amount,omitempty"`
 	Currency      string  `json:"currency"`
+	// SettlementCurrency, when it differs from Currency, asks for the
+	// amount to be converted at the current FX rate
+	SettlementCurrency string `json:"settlement_currency,omitempty"`
 	CardToken     string  `json:"card_token"`
 	TransactionID string  `json:"transaction_id"`
+	// Country is the payer's ISO 3166 alpha-2 country, used by risk rules
+	Country string `json:"country,omitempty"`
+	// BillingZip, when set, has the simulated issuer check it against the
+	// card's billing address, returning avs_result
+	BillingZip string `json:"billing_zip,omitempty"`
+	// CVVPresent says the payer entered the card's CVV, whose simulated
+	// check returns cvv_result. The CVV itself never reaches the gateway.
+	CVVPresent bool `json:"cvv_present,omitempty"`
+
+	// card is the vaulted card behind CardToken, if it was a vault token
+	card *CardMetadata
+	// tokenType is the type of that token as the processor gets it; see
+	// processorTokenType
+	tokenType string
+	// exemplar links the request's latency observations to its trace
+	exemplar prometheus.Labels
+	// settlement is the FX conversion quoted for SettlementCurrency
+	settlement *FXConversion
+	// risk is the risk engine's assessment, nil when it is off
+	risk *riskAssessment
+	// bin is derived from CardToken's leading digits, nil without them
+	bin *BINInfo
+	// avsResult and cvvResult are the simulated card verification
+	// results; see verifyCard
+	avsResult string
+	cvvResult string
+	// challenged is set once the authorization has been through 3DS, so
+	// amount rules don't challenge it again
+	challenged bool
+	// origin is who submitted the authorization, for the audit trail
+	origin auditOrigin
+	// processor pins routing to the processor whose amount rule asked for
+	// the challenge, or to the one X-Force-Processor names
+	processor string
+	// forced is the processor answer X-Force-Outcome asks for, returned
+	// without calling the processor
+	forced *ProcessorResult
+	// tenant is the namespace the authorization is stored and limited in,
+	// nil for the default one
+	tenant *tenant
 }
 
 // AuthorizationResponse represents the authorization result
@@ -83,9 +134,43 @@ type AuthorizationResponse struct {
 	Processor       string  `json:"processor"`
 	ProcessedAt     string  `json:"processed_at"`
 	Amount          float64 `json:"amount"`
+	AmountMinor     int64   `json:"amount_minor"`
 	Currency        string  `json:"currency"`
+	Settlement      *FXConversion `json:"settlement,omitempty"`
 	DeclineReason   string  `json:"decline_reason,omitempty"`
+	// DeclineClass is "soft" when retrying may succeed and "hard" otherwise
+	DeclineClass    string  `json:"decline_class,omitempty"`
+	// Retriable and RetryAfterMs are set on declines: whether a retry, on
+	// this or another processor, may be approved, and how long to wait
+	Retriable       *bool   `json:"retriable,omitempty"`
+	RetryAfterMs    *int    `json:"retry_after_ms,omitempty"`
 	ProcessingTime  float64 `json:"processing_time_ms"`
+	ChallengeToken  string  `json:"challenge_token,omitempty"`
+	ProcessorReference string `json:"processor_reference,omitempty"`
+	Card            *CardMetadata `json:"card,omitempty"`
+	// TokenType is how the card reached the processor: network_token, or
+	// vault_token for a vault token or a network token the processor
+	// doesn't take; unset for other card tokens
+	TokenType string `json:"token_type,omitempty"`
+	// BIN is the simulated issuer data behind a card_token starting with a
+	// BIN
+	BIN *BINInfo `json:"bin,omitempty"`
+	// AVSResult is the simulated address verification result, set when
+	// billing_zip was sent: Z (ZIP matched), N (no match) or U
+	// (unavailable)
+	AVSResult string `json:"avs_result,omitempty"`
+	// CVVResult is the simulated CVV check result, set when cvv_present
+	// was: M (matched), N (no match), P (not processed) or U (unavailable)
+	CVVResult string `json:"cvv_result,omitempty"`
+	// RiskScore (0-100), RiskDecision and the RiskRules that matched are
+	// set when the risk engine is configured
+	RiskScore    *int     `json:"risk_score,omitempty"`
+	RiskDecision string   `json:"risk_decision,omitempty"`
+	RiskRules    []string `json:"risk_rules,omitempty"`
+	// FeeAmount is what the processor will charge on the authorized
+	// amount once it is captured and settled; set on approvals
+	FeeAmount      float64 `json:"fee_amount,omitempty"`
+	FeeAmountMinor int64   `json:"fee_amount_minor,omitempty"`
 }
 
 // HealthResponse represents health check response
@@ -94,6 +179,10 @@ type HealthResponse struct {
 	Version      string            `json:"version"`
 	Uptime       string            `json:"uptime"`
 	Checks       map[string]string `json:"checks"`
+	// Dependencies has each probed dependency's latency and criticality
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+	// Jobs has each background job's schedule and last run
+	Jobs         []JobStatus       `json:"jobs"`
 	SuccessRate  float64           `json:"success_rate"`
 	TotalRequests int64            `json:"total_requests"`
 }
@@ -103,6 +192,7 @@ var startTime = time.Now()
 func init() {
 	prometheus.MustRegister(authorizationTotal)
 	prometheus.MustRegister(authorizationDuration)
+	prometheus.MustRegister(processorCallDuration)
 	prometheus.MustRegister(authorizationSuccessRate)
 	prometheus.MustRegister(activeRequests)
 	prometheus.MustRegister(healthCheckStatus)
@@ -123,6 +213,9 @@ func getVersion() string {
 
 // getFailureRate returns the configured failure rate for testing
 func getFailureRate() float64 {
+	if cfg := currentConfig(); cfg.FailureRate != nil {
+		return *cfg.FailureRate
+	}
 	rate, err := strconv.ParseFloat(getEnv("FAILURE_RATE", "0.02"), 64)
 	if err != nil {
 		return 0.02
@@ -132,6 +225,9 @@ func getFailureRate() float64 {
 
 // getLatencyMs returns the configured base latency
 func getLatencyMs() int {
+	if cfg := currentConfig(); cfg.BaseLatencyMs != nil {
+		return *cfg.BaseLatencyMs
+	}
 	latency, err := strconv.Atoi(getEnv("BASE_LATENCY_MS", "50"))
 	if err != nil {
 		return 50
@@ -139,99 +235,473 @@ func getLatencyMs() int {
 	return latency
 }
 
-// simulateProcessorCall simulates calling a payment processor
-func simulateProcessorCall(processor string) (bool, string, time.Duration) {
-	baseLatency := getLatencyMs()
-	jitter := rand.Intn(50)
-	latency := time.Duration(baseLatency+jitter) * time.Millisecond
-	
-	time.Sleep(latency)
-	
-	failureRate := getFailureRate()
-	if rand.Float64() < failureRate {
-		reasons := []string{"insufficient_funds", "card_declined", "processor_timeout", "invalid_card"}
-		return false, reasons[rand.Intn(len(reasons))], latency
+// selectProcessor intelligently routes to the best processor. It returns
+// nil when no processor accepts the card's brand.
+func selectProcessor(rng *rand.Rand, req AuthorizationRequest) Processor {
+	candidates := processors.all()
+	cfg := currentConfig()
+	if brand := req.brand(); brand != "" {
+		accepting := candidates[:0:0]
+		for _, p := range candidates {
+			if cfg.Processors[p.Name()].acceptsBrand(brand) {
+				accepting = append(accepting, p)
+			}
+		}
+		if len(accepting) == 0 {
+			return nil
+		}
+		candidates = accepting
+	}
+	if profile, ok := cfg.merchantProfile(req.MerchantID); ok && len(profile.Processors) > 0 {
+		allowed := candidates[:0:0]
+		for _, p := range candidates {
+			if profile.allowsProcessor(p.Name()) {
+				allowed = append(allowed, p)
+			}
+		}
+		if len(allowed) > 0 {
+			candidates = allowed
+		}
+	}
+	if cfg.costRouting() && cfg.flagEnabled(flagSmartRouting, req.MerchantID) {
+		return cheapestProcessor(cfg, candidates, req)
+	}
+	if !cfg.weighted() {
+		return candidates[rng.Intn(len(candidates))]
 	}
-	
-	authCode := fmt.Sprintf("AUTH%d", rand.Intn(999999))
-	return true, authCode, latency
-}
 
-// selectProcessor intelligently routes to the best processor
-func selectProcessor(merchantID string, amount float64) string {
-	return processors[rand.Intn(len(processors))]
+	var total float64
+	for _, p := range candidates {
+		total += cfg.processorWeight(p.Name())
+	}
+	pick := rng.Float64() * total
+	for _, p := range candidates {
+		if w := cfg.processorWeight(p.Name()); w > 0 {
+			if pick < w {
+				return p
+			}
+			pick -= w
+		}
+	}
+	// Rounding can leave pick just past the last weight
+	for i := len(candidates) - 1; i >= 0; i-- {
+		if cfg.processorWeight(candidates[i].Name()) > 0 {
+			return candidates[i]
+		}
+	}
+	return candidates[rng.Intn(len(candidates))]
 }
 
 // handleAuthorization processes payment authorization requests
 func handleAuthorization(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	startTime := time.Now()
+	shadowBody, mirrored := shadowTraffic.sample(r)
+
+	var req AuthorizationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON authorization request"}})
 		return
 	}
 
-	activeRequests.Inc()
-	defer activeRequests.Dec()
+	// An authenticated merchant always wins over the body so one merchant
+	// can't submit authorizations on behalf of another
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		req.MerchantID = merchantID
+	}
+	req.exemplar = requestExemplar(r)
+	req.origin = auditOriginOf(r)
+	req.tenant = tenantFromContext(r.Context())
+	if testHeadersEnabled() {
+		if violations := applyTestHeaders(w, r, &req); len(violations) > 0 {
+			writeValidationError(w, r, violations)
+			return
+		}
+	}
 
-	startTime := time.Now()
-	atomic.AddInt64(&totalRequests, 1)
+	response, rejection := authorize(req, startTime)
+	if mirrored {
+		go shadowTraffic.mirror(r.Header.Clone(), shadowBody, requestIDFromContext(r.Context()), primaryAnswer(response, rejection), time.Since(startTime))
+	}
+	if rejection != nil {
+		writeRejection(w, r, rejection)
+		return
+	}
+	writeAuthorizationResponse(w, response)
+}
 
-	var req AuthorizationRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid request body", http.StatusBadRequest)
+// authorizationRejection is an authorization refused before it produced a
+// result, such as a validation failure or a rate limit
+type authorizationRejection struct {
+	Status     int
+	Code       string
+	Message    string
+	Details    interface{}
+	RetryAfter time.Duration
+}
+
+// authorize runs a decoded authorization through validation, rate limiting,
+// the token vault and 3DS, then sends it to a processor
+func authorize(req AuthorizationRequest, startTime time.Time) (AuthorizationResponse, *authorizationRejection) {
+	if rejection := admitAuthorization(&req); rejection != nil {
+		return AuthorizationResponse{}, rejection
+	}
+	response, call, pending := decideAuthorization(req, startTime)
+	if pending {
+		response = call.run()
+	}
+	recordAuthorizationAudit(req.origin, auditAuthorizationCreated, req.MerchantID, response, "")
+	return response, nil
+}
+
+// authorizeDeferred is authorize for callers that don't wait on the
+// result, such as batch items. A processor that can answer asynchronously
+// does, and then runs on another goroutine once it has.
+func authorizeDeferred(req AuthorizationRequest, startTime time.Time, then func(AuthorizationResponse, *authorizationRejection)) {
+	if rejection := admitAuthorization(&req); rejection != nil {
+		then(AuthorizationResponse{}, rejection)
+		return
+	}
+	response, call, pending := decideAuthorization(req, startTime)
+	if !pending {
+		recordAuthorizationAudit(req.origin, auditAuthorizationCreated, req.MerchantID, response, "")
+		then(response, nil)
 		return
 	}
+	call.runAsync(func(response AuthorizationResponse) {
+		recordAuthorizationAudit(req.origin, auditAuthorizationCreated, req.MerchantID, response, "")
+		then(response, nil)
+	})
+}
 
-	if req.MerchantID == "" {
-		req.MerchantID = "default_merchant"
+// admitAuthorization validates, rate limits and records an authorization,
+// or rejects it
+func admitAuthorization(req *AuthorizationRequest) *authorizationRejection {
+	if violations := validateAuthorizationRequest(req); len(violations) > 0 {
+		recordValidationFailures(violations)
+		return &authorizationRejection{
+			Status: http.StatusBadRequest, Code: errCodeValidation, Message: "Request validation failed", Details: violations,
+		}
+	}
+	if profile, ok := currentConfig().merchantProfile(req.MerchantID); ok && profile.Disabled {
+		return &authorizationRejection{
+			Status: http.StatusForbidden, Code: errCodeMerchantDisabled, Message: "Merchant is disabled",
+		}
+	}
+
+	if limiter := req.tenant.rateLimiter(); limiter != nil {
+		if allowed, wait := limiter.allow(req.MerchantID, req.origin.clientIP); !allowed {
+			return &authorizationRejection{
+				Status: http.StatusTooManyRequests, Code: errCodeRateLimited, Message: "Rate limit exceeded", RetryAfter: wait,
+			}
+		}
+	}
+	if rejection := convertSettlement(req); rejection != nil {
+		return rejection
 	}
 	if req.TransactionID == "" {
-		req.TransactionID = fmt.Sprintf("txn_%d", time.Now().UnixNano())
+		req.TransactionID = newTransactionID()
+	}
+	if rejection := createTransaction(*req); rejection != nil {
+		return rejection
+	}
+	return nil
+}
+
+// decideAuthorization declines or challenges a recorded authorization, or
+// routes it to a processor and returns the call still to be made, pending
+func decideAuthorization(req AuthorizationRequest, startTime time.Time) (response AuthorizationResponse, call processorCall, pending bool) {
+	card, ok := resolveCardToken(req)
+	if !ok {
+		return declineWithoutProcessor(req, "unknown_token"), processorCall{}, false
+	}
+	req.card = card
+	if card != nil {
+		req.tokenType = tokenTypeOf(req.CardToken)
+	}
+
+	req.bin = lookupBIN(req.CardToken)
+	if checkBlocklist(req) {
+		return declineWithoutProcessor(req, "blocked"), processorCall{}, false
+	}
+	verifyCard(&req)
+	if req.avsResult == avsNoMatch && currentConfig().declinesOnAVSMismatch(req.MerchantID) {
+		return declineWithoutProcessor(req, "avs_mismatch"), processorCall{}, false
+	}
+	// The fraud_engine flag rolls velocity checks and risk scoring out per
+	// merchant
+	fraudEngine := currentConfig().flagEnabled(flagFraudEngine, req.MerchantID)
+	if fraudEngine && checkVelocity(req) {
+		return declineWithoutProcessor(req, "velocity_exceeded"), processorCall{}, false
+	}
+	if fraudEngine {
+		req.risk = assessRisk(req, time.Now())
+	}
+	if req.risk != nil {
+		switch req.risk.Decision {
+		case riskDecline:
+			return declineWithoutProcessor(req, "risk_declined"), processorCall{}, false
+		case riskChallenge:
+			return challengeResponse(req, challenges.open(req)), processorCall{}, false
+		}
+	}
+
+	if token, ok := maybeRequireChallenge(req); ok {
+		return challengeResponse(req, token), processorCall{}, false
+	}
+
+	return routeAuthorization(req, startTime)
+}
+
+// challengeResponse is the requires_action response for an authorization
+// parked behind the 3DS challenge token
+func challengeResponse(req AuthorizationRequest, token string) AuthorizationResponse {
+	response := AuthorizationResponse{
+		TransactionID:  req.TransactionID,
+		Status:         "requires_action",
+		ProcessedAt:    formatTimestamp(time.Now()),
+		Amount:         req.Amount,
+		AmountMinor:    *req.AmountMinor,
+		Currency:       req.Currency,
+		Settlement:     req.settlement,
+		ChallengeToken: token,
+		Card:           req.card,
+		TokenType:      req.tokenType,
+		BIN:            req.bin,
+		AVSResult:      req.avsResult,
+		CVVResult:      req.cvvResult,
+	}
+	response.setRisk(req.risk)
+	saveAuthorization(req.tenant, response)
+	return response
+}
+
+// lastTransactionID keeps generated IDs unique when several authorizations
+// start within the same nanosecond, as batches do
+var lastTransactionID int64
+
+// newTransactionID returns a txn_<unix nanos> identifier
+func newTransactionID() string {
+	for {
+		last := atomic.LoadInt64(&lastTransactionID)
+		next := time.Now().UnixNano()
+		if next <= last {
+			next = last + 1
+		}
+		if atomic.CompareAndSwapInt64(&lastTransactionID, last, next) {
+			var buf [32]byte
+			return string(strconv.AppendInt(append(buf[:0], "txn_"...), next, 10))
+		}
+	}
+}
+
+// processAuthorization routes an authorization to a processor, records the
+// outcome in metrics and webhooks, and returns the result
+func processAuthorization(req AuthorizationRequest, startTime time.Time) AuthorizationResponse {
+	response, call, pending := routeAuthorization(req, startTime)
+	if pending {
+		return call.run()
+	}
+	return response
+}
+
+// processorCall is an authorization routed to a processor, waiting to be
+// sent
+type processorCall struct {
+	req       AuthorizationRequest
+	selected  Processor
+	startTime time.Time
+}
+
+// routeAuthorization picks the processor and applies its amount rules. An
+// authorization the rules don't settle is returned as a pending call.
+func routeAuthorization(req AuthorizationRequest, startTime time.Time) (response AuthorizationResponse, call processorCall, pending bool) {
+	selected, ok := processors.get(req.processor)
+	if !ok {
+		if selected = selectProcessor(rng, req); selected == nil {
+			return declineWithoutProcessor(req, "card_brand_not_supported"), processorCall{}, false
+		}
+	}
+	processor := selected.Name()
+	req.tokenType = processorTokenType(req.tokenType, processor)
+
+	rule, ruled := currentConfig().matchAmountRule(processor, req.Amount)
+	if ruled && rule.Outcome == amountRuleRequiresAction {
+		if !req.challenged {
+			amountRulesMatchedTotal.WithLabelValues(processor, rule.Outcome).Inc()
+			req.processor = processor
+			return challengeResponse(req, challenges.open(req)), processorCall{}, false
+		}
+		ruled = false
+	}
+
+	// Only requests that reach a processor count towards the success rate;
+	// rejected requests are tracked by their own metrics
+	atomic.AddInt64(&totalRequests, 1)
+
+	if ruled {
+		amountRulesMatchedTotal.WithLabelValues(processor, rule.Outcome).Inc()
+		return finishAuthorization(req, processor, ProcessorResult{DeclineReason: rule.declineReason()}, startTime), processorCall{}, false
 	}
 
-	processor := selectProcessor(req.MerchantID, req.Amount)
-	success, result, latency := simulateProcessorCall(processor)
+	return AuthorizationResponse{}, processorCall{req: req, selected: selected, startTime: startTime}, true
+}
+
+// run sends the call and waits for the processor's answer
+func (c processorCall) run() AuthorizationResponse {
+	callStart := time.Now()
+	if c.req.forced != nil {
+		time.Sleep(c.req.forced.Latency)
+		return c.finish(callStart, *c.req.forced, nil)
+	}
+	result, err := c.selected.Authorize(context.Background(), c.req)
+	return c.finish(callStart, result, err)
+}
+
+// runAsync sends the call and passes the response to then, without holding
+// a goroutine while an asyncAuthorizer processor answers. With async_mode
+// off for the merchant, or a forced outcome, it waits like run.
+func (c processorCall) runAsync(then func(AuthorizationResponse)) {
+	async, ok := c.selected.(asyncAuthorizer)
+	if !ok || c.req.forced != nil || !currentConfig().flagEnabled(flagAsyncMode, c.req.MerchantID) {
+		then(c.run())
+		return
+	}
+	callStart := time.Now()
+	async.AuthorizeAsync(c.req, func(result ProcessorResult, err error) {
+		then(c.finish(callStart, result, err))
+	})
+}
+
+func (c processorCall) finish(callStart time.Time, result ProcessorResult, err error) AuthorizationResponse {
+	processor := c.selected.Name()
+	callDuration := time.Since(callStart)
+	observeWithExemplar(processorCallDuration.WithLabelValues(processor), callDuration.Seconds(), c.req.exemplar)
+	if err != nil {
+		result = ProcessorResult{DeclineReason: errProcessorUnavailable.Error()}
+	}
+	processorOutcomes.record(processor, result.Approved, callDuration)
+	return finishAuthorization(c.req, processor, result, c.startTime)
+}
 
+// finishAuthorization builds the response to a processor's answer and
+// records it in storage, metrics and webhooks
+func finishAuthorization(req AuthorizationRequest, processor string, result ProcessorResult, startTime time.Time) AuthorizationResponse {
 	response := AuthorizationResponse{
 		TransactionID:  req.TransactionID,
 		Processor:      processor,
-		ProcessedAt:    time.Now().UTC().Format(time.RFC3339),
+		ProcessedAt:    formatTimestamp(time.Now()),
 		Amount:         req.Amount,
+		AmountMinor:    *req.AmountMinor,
 		Currency:       req.Currency,
-		ProcessingTime: float64(latency.Milliseconds()),
+		Settlement:     req.settlement,
+		ProcessingTime: float64(result.Latency.Milliseconds()),
+		Card:           req.card,
+		TokenType:      req.tokenType,
+		BIN:            req.bin,
+		AVSResult:      req.avsResult,
+		CVVResult:      req.cvvResult,
 	}
+	response.setRisk(req.risk)
 
-	if success {
+	merchant := merchantLabel(req.MerchantID)
+	eventType := eventAuthorizationApproved
+	if result.Approved {
 		response.Status = "approved"
-		response.AuthCode = result
+		response.AuthCode = result.AuthCode
+		response.ProcessorReference = result.Reference
+		response.setFee(currentConfig().processorFees(processor))
 		atomic.AddInt64(&successRequests, 1)
-		authorizationTotal.WithLabelValues("approved", processor, req.MerchantID).Inc()
+		authorizationTotal.WithLabelValues("approved", processor, merchant, req.tenant.label()).Inc()
 	} else {
+		eventType = eventAuthorizationDeclined
 		response.Status = "declined"
-		response.DeclineReason = result
-		authorizationTotal.WithLabelValues("declined", processor, req.MerchantID).Inc()
+		response.DeclineReason = result.DeclineReason
+		response.setDeclineHints()
+		authorizationTotal.WithLabelValues("declined", processor, merchant, req.tenant.label()).Inc()
+	}
+	saveAuthorization(req.tenant, response)
+	if req.tokenType != "" {
+		tokenAuthorizationsTotal.WithLabelValues(req.tokenType, processor, response.Status).Inc()
 	}
+	if result.Approved {
+		recordAuthorizationEntry(req.MerchantID, response)
+	}
+	emitEvent(req.MerchantID, eventType, response)
 
-	duration := time.Since(startTime).Seconds()
-	authorizationDuration.WithLabelValues(processor, req.MerchantID).Observe(duration)
+	now := time.Now()
+	duration := now.Sub(startTime)
+	observeWithExemplar(authorizationDuration.WithLabelValues(processor, merchant, req.tenant.label()), duration.Seconds(), req.exemplar)
+	authorizationSLO.record(duration, now)
 
 	total := atomic.LoadInt64(&totalRequests)
 	successes := atomic.LoadInt64(&successRequests)
 	if total > 0 {
 		rate := float64(successes) / float64(total) * 100
-		authorizationSuccessRate.WithLabelValues(req.MerchantID).Set(rate)
+		authorizationSuccessRate.WithLabelValues(merchant).Set(rate)
+	}
+
+	return response
+}
+
+// declineWithoutProcessor declines an authorization the gateway rejects on
+// its own, before any processor is called
+func declineWithoutProcessor(req AuthorizationRequest, reason string) AuthorizationResponse {
+	atomic.AddInt64(&totalRequests, 1)
+	authorizationTotal.WithLabelValues("declined", "none", merchantLabel(req.MerchantID), req.tenant.label()).Inc()
+
+	response := AuthorizationResponse{
+		TransactionID: req.TransactionID,
+		Status:        "declined",
+		ProcessedAt:   formatTimestamp(time.Now()),
+		Amount:        req.Amount,
+		AmountMinor:   *req.AmountMinor,
+		Currency:      req.Currency,
+		Settlement:    req.settlement,
+		DeclineReason: reason,
+		Card:          req.card,
+		TokenType:     req.tokenType,
+		BIN:           req.bin,
+		AVSResult:     req.avsResult,
+		CVVResult:     req.cvvResult,
 	}
+	response.setRisk(req.risk)
+	response.setDeclineHints()
+	saveAuthorization(req.tenant, response)
+	emitEvent(req.MerchantID, eventAuthorizationDeclined, response)
+	return response
+}
 
+// writeAuthorizationResponse sends an authorization result with the status
+// code matching its outcome
+func writeAuthorizationResponse(w http.ResponseWriter, response AuthorizationResponse) {
 	w.Header().Set("Content-Type", "application/json")
-	w.Header().Set("X-Processor", processor)
+	if response.Processor != "" {
+		w.Header().Set("X-Processor", response.Processor)
+	}
 	w.Header().Set("X-Version", getVersion())
-	
-	if success {
-		w.WriteHeader(http.StatusOK)
-	} else {
-		w.WriteHeader(http.StatusPaymentRequired)
+
+	w.WriteHeader(authorizationStatusCode(response.Status))
+	_ = encodeJSON(w, response)
+}
+
+// authorizationStatusCode maps an authorization status to its HTTP status
+func authorizationStatusCode(status string) int {
+	switch status {
+	case "approved":
+		return http.StatusOK
+	case "requires_action":
+		return http.StatusAccepted
+	default:
+		return http.StatusPaymentRequired
 	}
-	
-	_ = json.NewEncoder(w).Encode(response)
+}
+
+// writeRejection writes a rejected authorization as an error envelope
+func writeRejection(w http.ResponseWriter, r *http.Request, rejection *authorizationRejection) {
+	if rejection.RetryAfter > 0 {
+		w.Header().Set("Retry-After", retryAfterSeconds(rejection.RetryAfter))
+	}
+	writeError(w, r, rejection.Status, rejection.Code, rejection.Message, rejection.Details)
 }
 
 // handleHealthLive is a shallow health check (liveness probe)
@@ -247,19 +717,57 @@ func handleHealthLive(w http.ResponseWriter, r *http.Request) {
 // handleHealthReady is a deep health check (readiness probe)
 func handleHealthReady(w http.ResponseWriter, r *http.Request) {
 	checks := make(map[string]string)
-	allHealthy := true
+	allHealthy, degraded := true, false
 
-	for _, processor := range processors {
-		secretKey := fmt.Sprintf("%s_API_KEY", processor)
-		if os.Getenv(secretKey) != "" || os.Getenv("SKIP_SECRET_CHECK") == "true" {
-			checks[processor+"_credentials"] = "ok"
+	// Critical dependencies that can't be reached take the replica out of
+	// rotation; the others only mark it degraded
+	dependencies := probeDependencies(r.Context(), readinessDependencies())
+	for name, dep := range dependencies {
+		summary := fmt.Sprintf("%.2fms", dep.LatencyMs)
+		if dep.Detail != "" {
+			summary = dep.Detail + ", " + summary
+		}
+		if dep.Status == "ok" {
+			checks[name] = fmt.Sprintf("ok (%s)", summary)
+			continue
+		}
+		checks[name] = fmt.Sprintf("unavailable (%s: %s)", summary, dep.Error)
+		if dep.Critical {
+			allHealthy = false
 		} else {
-			checks[processor+"_credentials"] = "missing"
+			degraded = true
 		}
 	}
 
-	checks["database"] = "ok"
-	checks["cache"] = "ok"
+	// A replica still warming up or draining takes no traffic
+	if !startup.done() {
+		checks["startup"] = "starting (see /health/startup)"
+		allHealthy = false
+	}
+	if drain.draining.Load() {
+		checks["drain"] = "draining (POST /admin/undrain to resume)"
+		allHealthy = false
+	}
+
+	// Rotated keys must keep arriving; a secret whose file or Vault read
+	// keeps failing takes the replica out of rotation
+	if os.Getenv("SKIP_SECRET_CHECK") == "true" {
+		checks["secrets"] = "skipped"
+	} else if err := processorSecrets.check(); err != nil {
+		checks["secrets"] = fmt.Sprintf("unhealthy (%v)", err)
+		allHealthy = false
+	} else {
+		checks["secrets"] = "ok"
+	}
+
+	// A background job whose last run failed only degrades the replica;
+	// the next run may well succeed
+	if err := jobs.check(); err != nil {
+		checks["jobs"] = fmt.Sprintf("degraded (%v)", err)
+		degraded = true
+	} else {
+		checks["jobs"] = "ok"
+	}
 
 	total := atomic.LoadInt64(&totalRequests)
 	successes := atomic.LoadInt64(&successRequests)
@@ -280,34 +788,32 @@ func handleHealthReady(w http.ResponseWriter, r *http.Request) {
 		Version:       getVersion(),
 		Uptime:        time.Since(startTime).String(),
 		Checks:        checks,
+		Dependencies:  dependencies,
+		Jobs:          jobs.list(),
 		SuccessRate:   successRate,
 		TotalRequests: total,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
 	
-	if allHealthy {
-		response.Status = "ready"
-		healthCheckStatus.Set(1)
-		w.WriteHeader(http.StatusOK)
-	} else {
-		response.Status = "degraded"
+	switch {
+	case !allHealthy:
+		response.Status = readinessNotReady
 		healthCheckStatus.Set(0)
 		w.WriteHeader(http.StatusServiceUnavailable)
+	case degraded:
+		response.Status = readinessDegraded
+		healthCheckStatus.Set(1)
+		w.WriteHeader(http.StatusOK)
+	default:
+		response.Status = readinessReady
+		healthCheckStatus.Set(1)
+		w.WriteHeader(http.StatusOK)
 	}
 	
 	_ = json.NewEncoder(w).Encode(response)
 }
 
-// handleVersion returns the current version
-func handleVersion(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-	_ = json.NewEncoder(w).Encode(map[string]string{
-		"version": getVersion(),
-		"service": "voyager-gateway",
-	})
-}
-
 // handleReset resets metrics (for testing)
 func handleReset(w http.ResponseWriter, r *http.Request) {
 	atomic.StoreInt64(&totalRequests, 0)
@@ -319,27 +825,502 @@ func handleReset(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	// Card data is masked out of every log line
+	log.SetOutput(sanitizingWriter{os.Stderr})
 	port := getEnv("PORT", "8080")
 	
 	log.Printf("Starting voyager-gateway version %s on port %s", getVersion(), port)
 	log.Printf("Failure rate: %.2f%%, Base latency: %dms", getFailureRate()*100, getLatencyMs())
 
-	http.HandleFunc("/authorize", handleAuthorization)
-	http.HandleFunc("/health/live", handleHealthLive)
-	http.HandleFunc("/health/ready", handleHealthReady)
-	http.HandleFunc("/version", handleVersion)
-	http.HandleFunc("/reset", handleReset)
-	http.Handle("/metrics", promhttp.Handler())
+	if err := loadHistogramConfig(); err != nil {
+		log.Fatalf("Failed to configure histograms: %v", err)
+	}
+
+	seed, seeded, err := loadSeed()
+	if err != nil {
+		log.Fatalf("Failed to configure RNG: %v", err)
+	}
+	if seeded {
+		log.Printf("Deterministic mode: RNG seeded with %d", seed)
+	}
+
+	latencies, err = loadLatencyModel()
+	if err != nil {
+		log.Fatalf("Failed to configure latency model: %v", err)
+	}
+	log.Printf("Latency model: %s", latencies.describe())
+
+	payoutLatencies, err = loadPayoutLatency()
+	if err != nil {
+		log.Fatalf("Failed to configure payout latency: %v", err)
+	}
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		log.Fatalf("Failed to load API keys: %v", err)
+	}
+	apiKeys.Store(keys)
+	if keys != nil {
+		log.Printf("API key authentication enabled for %d keys", len(keys.keys))
+	} else {
+		log.Printf("API key authentication disabled (no API_KEYS or API_KEYS_FILE configured)")
+	}
+
+	jwtAuth, err = loadJWTAuthenticator()
+	if err != nil {
+		log.Fatalf("Failed to configure JWT authentication: %v", err)
+	}
+	if jwtAuth != nil {
+		log.Printf("JWT authentication enabled with keys from %s", jwtAuth.keys.url)
+	}
+
+	secrets, err := loadSigningSecrets()
+	if err != nil {
+		log.Fatalf("Failed to load signing secrets: %v", err)
+	}
+	signingSecrets.Store(&signingSecretStore{secrets: secrets})
+	log.Printf("Request signing: %d merchant secrets, required=%s", len(secrets), getEnv("REQUIRE_SIGNATURE", "false"))
+
+	if err := loadTrustedProxies(); err != nil {
+		log.Fatalf("Failed to configure trusted proxies: %v", err)
+	}
+	if err := loadIPFilters(); err != nil {
+		log.Fatalf("Failed to configure IP filtering: %v", err)
+	}
+	for _, group := range []string{"public", "admin"} {
+		if f := ipFilters[group]; f != nil {
+			log.Printf("IP filtering (%s): %d allowed and %d denied ranges", group, len(f.allow), len(f.deny))
+		}
+	}
+	if len(trustedProxies) > 0 {
+		log.Printf("Trusting X-Forwarded-For from %d proxy ranges", len(trustedProxies))
+	}
+
+	cors, err = loadCORSPolicy()
+	if err != nil {
+		log.Fatalf("Failed to configure CORS: %v", err)
+	}
+	if cors != nil {
+		log.Printf("CORS enabled for origins %s", os.Getenv("CORS_ALLOWED_ORIGINS"))
+	}
+
+	if err := loadChallengeRates(); err != nil {
+		log.Fatalf("Failed to load 3DS challenge rates: %v", err)
+	}
+
+	limiter, err := loadRateLimiter()
+	if err != nil {
+		log.Fatalf("Failed to configure rate limiter: %v", err)
+	}
+	envRateLimiter = limiter
+	setRateLimiter(limiter)
+	if limiter != nil {
+		log.Printf("Rate limiting: default %.0f rps (burst %d), %d merchant overrides",
+			limiter.defaultLimit.RPS, limiter.defaultLimit.Burst, len(limiter.overrides))
+	}
+
+	authLimiter = loadConcurrencyLimiter()
+	if authLimiter != nil {
+		log.Printf("Concurrency limit: %d in-flight authorizations, queue %d for up to %s",
+			cap(authLimiter.slots), authLimiter.maxQueue, authLimiter.queueTimeout)
+	}
+
+	var processorNames []string
+	for _, p := range processors.all() {
+		processorNames = append(processorNames, processorSecretName(p.Name()))
+	}
+	processorSecrets, err = loadSecretStore(processorNames)
+	if err != nil {
+		log.Fatalf("Failed to configure secrets: %v", err)
+	}
+	log.Printf("Secrets: %s, refreshed every %s", processorSecrets.describe(), processorSecrets.interval)
+	go watchSecrets()
+	go watchCredentials(getCredentialPollInterval())
+	log.Printf("Credential rotation: reload on SIGHUP or key file change, %s grace period", getCredentialGracePeriod())
+
+	stripe, err := loadStripeProcessor()
+	if err != nil {
+		log.Fatalf("Failed to configure Stripe: %v", err)
+	}
+	if stripe != nil {
+		processors.register(stripe)
+		log.Printf("Processor stripe: Stripe test mode API at %s", stripe.baseURL)
+	}
+	shadowTraffic, err = loadShadowMirror()
+	if err != nil {
+		log.Fatalf("Failed to configure shadow traffic: %v", err)
+	}
+	if shadowTraffic != nil {
+		log.Printf("Shadow traffic: %g%% of /authorize mirrored to %s", shadowTraffic.percentage, shadowTraffic.url)
+	}
+	startup.complete(startupProcessors, strconv.Itoa(len(processors.all()))+" processors")
+
+	if err := loadConfigFile(); err != nil {
+		log.Fatalf("Failed to load config file: %v", err)
+	}
+	startup.complete(startupConfig, "")
+	go watchMaintenance()
+
+	storage, err = loadStorage()
+	if err != nil {
+		log.Fatalf("Failed to open storage: %v", err)
+	}
+	log.Printf("Storage backend: %s", storage.name())
+
+	redisClient, err := loadSharedRedis()
+	if err != nil {
+		log.Fatalf("Failed to configure Redis: %v", err)
+	}
+	if redisClient != nil {
+		sharedRedis.Store(redisClient)
+		go watchSharedOutcomes()
+		log.Printf("Shared state: Redis at %s for caches, idempotency, rate limits and success rates", redisClient.Options().Addr)
+	}
+	elector, err := loadLeaderElection(redisClient)
+	if err != nil {
+		log.Fatalf("Failed to configure leader election: %v", err)
+	}
+	if elector != nil {
+		leadership = elector
+		leadership.start()
+		log.Printf("Leader election: %s as %s, lease %s", elector.lock.describe(), elector.identity, elector.ttl)
+	}
+
+	seedCtx, cancelSeed := storageContext()
+	fixture, err := loadSeedFile(seedCtx)
+	cancelSeed()
+	if err != nil {
+		log.Fatalf("Failed to load SEED_FILE: %v", err)
+	}
+	if fixture != nil {
+		log.Printf("Seed: %d merchants, %d tokens and %d transactions loaded from %s (%d already stored)",
+			fixture.Merchants, fixture.Tokens, fixture.Transactions, os.Getenv("SEED_FILE"), fixture.Skipped)
+	}
+
+	syncCtx, cancelSync := storageContext()
+	onboarded, err := syncMerchants(syncCtx)
+	cancelSync()
+	if err != nil {
+		log.Fatalf("Failed to load merchants: %v", err)
+	}
+	if onboarded > 0 {
+		log.Printf("Merchants: %d onboarded through /admin/merchants", onboarded)
+	}
+	startup.complete(startupStorage, storage.name())
+	go watchMerchants(getMerchantSyncInterval())
+	transactionRetention, err = loadRetentionPolicy()
+	if err != nil {
+		log.Fatalf("Failed to configure retention: %v", err)
+	}
+	if transactionRetention != (RetentionPolicy{}) {
+		log.Printf("Retention: purging %s from memory", transactionRetention.describe())
+	}
+	authorizationExpiry, err = loadAuthorizationExpiry()
+	if err != nil {
+		log.Fatalf("Failed to configure authorization expiry: %v", err)
+	}
+	if err := registerJobs(); err != nil {
+		log.Fatalf("Failed to configure jobs: %v", err)
+	}
+
+	if err := loadWebhookURLs(); err != nil {
+		log.Fatalf("Failed to load webhook URLs: %v", err)
+	}
+
+	scenario, err := loadScenario()
+	if err != nil {
+		log.Fatalf("Failed to load scenario: %v", err)
+	}
+	if scenario != nil {
+		leadership.watch(func(leading bool) {
+			if leading {
+				scenarios.start(scenario)
+			} else {
+				scenarios.halt()
+			}
+		})
+	}
+
+	webhookDeliveries.start(getWebhookWorkers())
+
+	tlsFiles, err = loadTLS()
+	if err != nil {
+		log.Fatalf("Failed to configure TLS: %v", err)
+	}
+	if tlsFiles.mutual() {
+		log.Printf("mTLS: /authorize requires a client certificate signed by %s", tlsFiles.clientCAFile)
+	}
+
+	if err := loadFXRates(); err != nil {
+		log.Fatalf("Failed to load FX rates: %v", err)
+	}
+
+	eventSink, err = loadEventBus()
+	if err != nil {
+		log.Fatalf("Failed to configure event sink: %v", err)
+	}
+	if eventSink != nil {
+		log.Printf("Event sink: %s", eventSink.sink)
+	}
+
+	artifacts, err = loadArtifactStore()
+	if err != nil {
+		log.Fatalf("Failed to configure artifact store: %v", err)
+	}
+	if artifacts != nil {
+		log.Printf("Artifact store: %s (settlement files, exports, audit archives and snapshots)", artifacts.describe())
+	}
+	go watchAuditArchive()
+
+	restored, err := loadStartupSnapshot()
+	if err != nil {
+		log.Fatalf("Failed to restore snapshot: %v", err)
+	}
+	if restored != nil {
+		log.Printf("Snapshot of %s restored: %d transactions, %d merchants, %d chaos experiments",
+			restored.CreatedAt, restored.Transactions, restored.Merchants, restored.ChaosExperiments)
+	}
+
+	parquetExports, err = loadParquetExporter()
+	if err != nil {
+		log.Fatalf("Failed to configure Parquet export: %v", err)
+	}
+	if parquetExports != nil && parquetExports.interval > 0 {
+		log.Printf("Parquet export: every %s", parquetExports.interval)
+	}
+	go watchParquetExports()
+
+	route("POST /authorize", handleAuthorization, rejectWhileDraining, withChaosDrop, trackActive,
+		requireClientCert, requireAPIKey, requireScope(scopePaymentsWrite), limitRequestBody("POST /authorize"),
+		requireSignature, withIdempotency, limitConcurrency)
+	route("POST /authorize/batch", handleAuthorizationBatch, rejectWhileDraining, requireClientCert, requireAPIKey, requireScope(scopePaymentsWrite),
+		limitBodyTo("POST /authorize/batch", getMaxBatchBodyBytes), requireSignature)
+	route("POST /authorize/confirm", handleAuthorizationConfirm, rejectWhileDraining, trackActive, requireClientCert, requireAPIKey, requireScope(scopePaymentsWrite),
+		limitRequestBody("POST /authorize/confirm"), limitConcurrency)
+	route("POST /authorize/{id}/increment", handleAuthorizationIncrement, rejectWhileDraining, trackActive, requireClientCert, requireAPIKey, requireScope(scopePaymentsWrite),
+		limitRequestBody("POST /authorize/{id}/increment"), withIdempotency, limitConcurrency)
+	route("POST /3ds/challenge", handleThreeDSChallenge)
+	adminRoute("GET /admin/chaos", handleChaosList, requireAdminToken)
+	adminRoute("POST /admin/chaos", handleChaosStart, requireAdminToken)
+	adminRoute("DELETE /admin/chaos/{id}", handleChaosStop, requireAdminToken)
+	adminRoute("GET /admin/blocklist", handleBlocklistList, requireAdminToken)
+	adminRoute("POST /admin/blocklist", handleBlocklistAdd, requireAdminToken)
+	adminRoute("DELETE /admin/blocklist/{id}", handleBlocklistRemove, requireAdminToken)
+	adminRoute("GET /admin/scenario", handleScenarioStatus, requireAdminToken)
+	adminRoute("POST /admin/scenario", handleScenarioStart, requireAdminToken)
+	adminRoute("DELETE /admin/scenario", handleScenarioStop, requireAdminToken)
+	adminRoute("POST /admin/loadgen", handleLoadGenStart, requireAdminToken)
+	adminRoute("GET /admin/loadgen/status", handleLoadGenStatus, requireAdminToken)
+	adminRoute("DELETE /admin/loadgen", handleLoadGenStop, requireAdminToken)
+	adminRoute("POST /admin/replay", handleReplayStart, requireAdminToken)
+	adminRoute("GET /admin/replay/status", handleReplayStatus, requireAdminToken)
+	adminRoute("DELETE /admin/replay", handleReplayStop, requireAdminToken)
+	adminRoute("GET /admin/mirror/diffs", handleMirrorDiffs, requireAdminToken)
+	adminRoute("GET /admin/tenants", handleTenantList, requireAdminToken)
+	adminRoute("POST /admin/tenants", handleTenantCreate, requireAdminToken)
+	adminRoute("GET /admin/tenants/{id}", handleTenantGet, requireAdminToken)
+	adminRoute("DELETE /admin/tenants/{id}", handleTenantDelete, requireAdminToken)
+	adminRoute("GET /admin/jobs", handleJobList, requireAdminToken)
+	adminRoute("POST /admin/purge", handlePurge, requireAdminToken)
+	adminRoute("GET /admin/snapshot", handleSnapshotGet, requireAdminToken)
+	adminRoute("PUT /admin/snapshot", handleSnapshotRestore, requireAdminToken)
+	adminRoute("POST /admin/snapshots", handleSnapshotSave, requireAdminToken)
+	adminRoute("POST /admin/snapshots/{name}/restore", handleSnapshotRestoreSaved, requireAdminToken)
+	adminRoute("POST /admin/jobs/{name}/run", handleJobRun, requireAdminToken)
+	adminRoute("DELETE /admin/mirror/diffs", handleMirrorDiffsReset, requireAdminToken)
+	adminRoute("GET /admin/drain", handleDrainStatus, requireAdminToken)
+	adminRoute("POST /admin/drain", handleDrain, requireAdminToken)
+	adminRoute("POST /admin/undrain", handleUndrain, requireAdminToken)
+	adminRoute("GET /admin/flags", handleFlagList, requireAdminToken)
+	adminRoute("PUT /admin/flags/{name}", handleFlagPut, requireAdminToken)
+	adminRoute("DELETE /admin/flags/{name}", handleFlagDelete, requireAdminToken)
+	route("GET /transactions", handleTransactionList, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /transactions/{id}", handleTransactionGet, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /transactions/export", handleTransactionExport, requireAPIKey, requireScope(scopePaymentsRead))
+	route("POST /transactions/{id}/capture", handleTransactionCapture, requireAPIKey, requireScope(scopePaymentsWrite), withIdempotency)
+	route("POST /transactions/{id}/refund", handleTransactionRefund, requireAPIKey, requireScope(scopePaymentsWrite), withIdempotency)
+	route("GET /disputes", handleDisputeList, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /disputes/{id}", handleDisputeGet, requireAPIKey, requireScope(scopePaymentsRead))
+	route("POST /disputes/{id}/evidence", handleDisputeEvidence, requireAPIKey, requireScope(scopePaymentsWrite))
+	route("POST /disputes/{id}/accept", handleDisputeAccept, requireAPIKey, requireScope(scopePaymentsWrite))
+	route("POST /subscriptions", handleSubscriptionCreate, requireAPIKey, requireScope(scopePaymentsWrite), withIdempotency)
+	route("GET /subscriptions", handleSubscriptionList, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /subscriptions/{id}", handleSubscriptionGet, requireAPIKey, requireScope(scopePaymentsRead))
+	route("POST /subscriptions/{id}/pause", handleSubscriptionPause, requireAPIKey, requireScope(scopePaymentsWrite))
+	route("POST /subscriptions/{id}/resume", handleSubscriptionResume, requireAPIKey, requireScope(scopePaymentsWrite))
+	route("POST /subscriptions/{id}/cancel", handleSubscriptionCancel, requireAPIKey, requireScope(scopePaymentsWrite))
+	route("GET /subscriptions/{id}/retries", handleSubscriptionRetries, requireAPIKey, requireScope(scopePaymentsRead))
+	route("POST /payment-links", handlePaymentLinkCreate, requireAPIKey, requireScope(scopePaymentsWrite), withIdempotency)
+	route("GET /payment-links/{id}", handlePaymentLinkGet, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /pay/{id}", handleCheckoutPage)
+	route("POST /pay/{id}", handleCheckoutPay, rejectWhileDraining, trackActive, limitConcurrency)
+	route("POST /payouts", handlePayoutCreate, requireAPIKey, requireScope(scopePaymentsWrite), withIdempotency)
+	route("GET /payouts", handlePayoutList, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /payouts/{id}", handlePayoutGet, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /merchants/{id}/balance", handleMerchantBalance, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /merchants/{id}/ledger", handleMerchantLedger, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /graphql", handleGraphQL, requireAPIKey, requireScope(scopePaymentsRead))
+	route("POST /graphql", handleGraphQL, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /settlements", handleSettlementList, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /settlements/{id}", handleSettlementGet, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /settlements/{id}/reconciliation.csv", handleSettlementReconciliation, requireAPIKey, requireScope(scopePaymentsRead))
+	adminRoute("POST /admin/settle", handleSettle, requireAdminToken)
+	adminRoute("POST /admin/exports/parquet", handleParquetExport, requireAdminToken)
+	adminRoute("GET /admin/audit", handleAuditLog, requireAdminToken)
+	route("POST /tokens", handleTokens, requireAPIKey, requireScope(scopePaymentsWrite))
+	route("GET /webhooks", handleWebhookList, requireAPIKey, requireScope(scopePaymentsRead))
+	route("POST /webhooks", handleWebhookRegister, requireAPIKey, requireScope(scopePaymentsWrite))
+	route("GET /events", handleEvents, requireAPIKey, requireScope(scopePaymentsRead))
+	route("GET /webhooks/dead-letters", handleDeadLetterList, requireAPIKey, requireScope(scopePaymentsRead))
+	route("POST /webhooks/dead-letters/{id}/retry", handleDeadLetterRetry, requireAPIKey, requireScope(scopePaymentsWrite))
+	adminRoute("GET /health/live", handleHealthLive)
+	adminRoute("GET /health/ready", handleHealthReady)
+	adminRoute("GET /health/startup", handleHealthStartup)
+	route("GET /version", handleVersion)
+	route("GET /fx/rates", handleFXRates, requireAPIKey, requireScope(scopePaymentsRead))
+	adminRoute("PUT /admin/fx/rates", handleFXRatesPut, requireAdminToken)
+	adminRoute("GET /config/status", handleConfigStatus)
+	adminRoute("GET /slo/status", handleSLOStatus)
+	adminRoute("GET /maintenance", handleMaintenanceStatus)
+	adminRoute("GET /admin/config", handleAdminConfigGet, requireAdminToken)
+	adminRoute("PUT /admin/config", handleAdminConfigPut, requireAdminToken)
+	adminRoute("DELETE /admin/config", handleAdminConfigDelete, requireAdminToken)
+	adminRoute("GET /admin/merchants", handleMerchantList, requireAdminToken)
+	adminRoute("POST /admin/merchants", handleMerchantCreate, requireAdminToken)
+	adminRoute("GET /admin/merchants/{id}", handleMerchantGet, requireAdminToken)
+	adminRoute("PUT /admin/merchants/{id}", handleMerchantUpdate, requireAdminToken)
+	adminRoute("DELETE /admin/merchants/{id}", handleMerchantDelete, requireAdminToken)
+	adminRoute("POST /admin/merchants/{id}/api-key", handleMerchantRotateKey, requireAdminToken)
+	adminRoute("POST /admin/merchants/{id}/disable", handleMerchantDisable, requireAdminToken)
+	adminRoute("POST /admin/merchants/{id}/enable", handleMerchantEnable, requireAdminToken)
+	route("GET /openapi.json", handleOpenAPI)
+	route("GET /docs", handleDocs)
+	adminRoute("POST /reset", handleReset, requireAdminToken)
+	adminRoute("GET /metrics", metricsHandler().ServeHTTP)
 
 	log.Printf("Endpoints available:")
 	log.Printf("  POST /authorize    - Payment authorization")
+	log.Printf("  POST /authorize/batch - Authorize up to BATCH_MAX_SIZE payments in one call")
+	log.Printf("  POST /authorize/confirm - Finalize a 3DS-challenged authorization")
+	log.Printf("  POST /authorize/{id}/increment - Raise an open authorization")
+	log.Printf("  POST /3ds/challenge - Complete a simulated 3DS challenge")
+	log.Printf("  GET  /version      - Version info")
+	log.Printf("  GET  /transactions - List transactions (filters: merchant_id, status, created_from/to)")
+	log.Printf("  GET  /transactions/export - Stream matching transactions as CSV or NDJSON (format=csv|ndjson)")
+	log.Printf("  GET  /transactions/{id} - Stored transaction with its captures and refunds")
+	log.Printf("  POST /transactions/{id}/capture - Capture an approved authorization (final_capture=false to capture more later)")
+	log.Printf("  POST /transactions/{id}/refund - Refund a captured transaction")
+	log.Printf("  GET  /disputes     - Disputes against captures (filters: merchant_id, transaction_id, status)")
+	log.Printf("  POST /disputes/{id}/evidence - Contest an opened dispute (or /accept to concede it)")
+	log.Printf("  POST /subscriptions - Create a recurring charge (GET to list; /{id}/pause, /resume, /cancel)")
+	log.Printf("  POST /payment-links - Create a payment link with a hosted checkout page at /pay/{id}")
+	log.Printf("  POST /payouts      - Push funds to a destination account (GET to list, /{id} to get)")
+	log.Printf("  GET  /merchants/{id}/balance - Ledger balances per currency (/ledger for entries)")
+	log.Printf("  POST /graphql      - Read-only GraphQL queries over transactions, merchants, settlements and disputes")
+	log.Printf("  GET  /settlements  - Settlement batches (CSV at /settlements/{id}/reconciliation.csv)")
+	log.Printf("  POST /tokens       - Tokenize a card")
+	log.Printf("  POST /webhooks     - Register webhook callback URL")
+	log.Printf("  GET  /events       - Server-Sent Events stream of transaction events")
+	log.Printf("  GET  /webhooks/dead-letters - Failed webhook deliveries")
+	log.Printf("  GET  /fx/rates     - FX rates used for settlement_currency conversion")
+	log.Printf("  GET  /openapi.json - OpenAPI document (Swagger UI at /docs)")
+	log.Printf("Admin endpoints (ADMIN_PORT):")
 	log.Printf("  GET  /health/live  - Liveness probe (shallow)")
 	log.Printf("  GET  /health/ready - Readiness probe (deep)")
-	log.Printf("  GET  /version      - Version info")
+	log.Printf("  GET  /health/startup - Startup probe (passes once warmup completes)")
+	log.Printf("  GET  /config/status - Config file load state and effective config")
+	log.Printf("  GET  /slo/status - Latency SLO burn rates over 5m to 3d windows")
+	log.Printf("  GET  /maintenance - Scheduled processor maintenance windows")
+	log.Printf("  PUT  /admin/config - Override simulation settings at runtime (ADMIN_TOKEN)")
+	log.Printf("  PUT  /admin/fx/rates - Replace the FX rate table (ADMIN_TOKEN)")
+	log.Printf("  POST /admin/merchants - Onboard merchants and issue API keys (ADMIN_TOKEN)")
 	log.Printf("  GET  /metrics      - Prometheus metrics")
-	log.Printf("  POST /reset        - Reset metrics (testing)")
+	log.Printf("  GET  /admin/chaos  - Active chaos experiments (POST to start one, ADMIN_TOKEN)")
+	log.Printf("  GET  /admin/blocklist - Blocked card tokens, merchants and BIN prefixes (POST to add, ADMIN_TOKEN)")
+	log.Printf("  POST /admin/settle - Settle captured transactions now (nightly at SETTLEMENT_HOUR_UTC, ADMIN_TOKEN)")
+	log.Printf("  GET  /admin/audit  - Audit trail of state-changing operations (format=ndjson to export, ADMIN_TOKEN)")
+	log.Printf("  POST /admin/exports/parquet - Write transactions to a Parquet file (ARTIFACT_STORE, ADMIN_TOKEN)")
+	log.Printf("  GET  /admin/scenario - Current scenario phase (POST YAML to play one, ADMIN_TOKEN)")
+	log.Printf("  POST /admin/loadgen - Start the built-in load generator (GET /admin/loadgen/status for stats, ADMIN_TOKEN)")
+	log.Printf("  POST /admin/replay - Re-execute an exported NDJSON/CSV set of transactions (GET /admin/replay/status for stats, ADMIN_TOKEN)")
+	log.Printf("  GET  /admin/mirror/diffs - Primary vs shadow answer mismatches (ADMIN_TOKEN)")
+	log.Printf("  POST /admin/tenants - Create a tenant with isolated transactions, rate limits and chaos (ADMIN_TOKEN)")
+	log.Printf("  POST /admin/purge  - Purge transactions past retention and expired idempotency keys now (ADMIN_TOKEN)")
+	log.Printf("  GET  /admin/snapshot - Download the simulator state (PUT to restore one, POST /admin/snapshots to save to ARTIFACT_STORE, ADMIN_TOKEN)")
+	log.Printf("  GET  /admin/jobs   - Background jobs and their last run (POST /admin/jobs/{name}/run to run one now, ADMIN_TOKEN)")
+	log.Printf("  POST /admin/drain  - Refuse new authorizations for maintenance (POST /admin/undrain to resume, ADMIN_TOKEN)")
+	log.Printf("  GET  /admin/flags  - Feature flags in effect (PUT /admin/flags/{name} to toggle, ADMIN_TOKEN)")
+	log.Printf("  POST /reset        - Reset metrics (testing, ADMIN_TOKEN)")
+
+	settings, err := loadServerSettings()
+	if err != nil {
+		log.Fatalf("Failed to configure HTTP server: %v", err)
+	}
+	log.Printf("HTTP/2: %t (max %d streams per connection), keep-alives: %t, idle timeout %s",
+		settings.http2, settings.maxConcurrentStreams, settings.keepAlives, settings.idleTimeout)
+	adminServer, err := loadAdminServer(port, settings)
+	if err != nil {
+		log.Fatalf("Failed to configure admin listener: %v", err)
+	}
+	log.Printf("Admin listener on %s", adminServer.Addr)
+	go func() {
+		ln, err := listen(adminServer, settings, "admin")
+		if err == nil {
+			err = adminServer.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Admin listener failed to start: %v", err)
+		}
+	}()
+
+	// CORS applies to the public API only; browsers have no business on
+	// the admin listener
+	server := newServer(":"+port, chain(newRouter(publicMux).ServeHTTP, withCORS), settings, "public")
+	server.RegisterOnShutdown(eventStream.closeAll)
+	go func() {
+		ln, err := listen(server, settings, "public")
+		if err == nil && tlsFiles != nil {
+			server.TLSConfig = tlsFiles.config()
+			err = server.ServeTLS(ln, "", "")
+		} else if err == nil {
+			err = server.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Server failed to start: %v", err)
+		}
+	}()
+
+	go runWarmup()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-stop
+
+	log.Printf("Received %s, shutting down", sig)
+	ctx, cancel := context.WithTimeout(context.Background(), getShutdownTimeout())
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Printf("Shutdown did not complete cleanly: %v", err)
+	}
+	_ = adminServer.Shutdown(ctx)
+	leadership.resign(ctx)
+	archiveAuditLog(ctx)
+	if eventSink != nil {
+		if err := eventSink.close(); err != nil {
+			log.Printf("Failed to flush %s events: %v", eventSink.sink, err)
+		}
+	}
+	if err := storage.close(); err != nil {
+		log.Printf("Failed to close storage: %v", err)
+	}
+	log.Printf("Shutdown complete")
+}
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("Server failed to start: %v", err)
+// getShutdownTimeout returns how long in-flight requests get to finish
+func getShutdownTimeout() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("SHUTDOWN_TIMEOUT_SECONDS", "15"))
+	if err != nil || seconds <= 0 {
+		return 15 * time.Second
 	}
+	return time.Duration(seconds) * time.Second
 }
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Maintenance window modes
+const (
+	// maintenanceOutage fails every call to the processor
+	maintenanceOutage = "outage"
+	// maintenanceLatency adds latency_ms to every call
+	maintenanceLatency = "latency"
+)
+
+// maintenanceCheckInterval is how often windows are checked for starting
+// or ending
+const maintenanceCheckInterval = time.Second
+
+// maintenanceLookahead bounds the search for a window's next start
+const maintenanceLookahead = 366 * 24 * time.Hour
+
+var processorMaintenance = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "voyager_processor_maintenance",
+		Help: "1 while a scheduled maintenance window is in effect for the processor",
+	},
+	[]string{"processor"},
+)
+
+func init() {
+	prometheus.MustRegister(processorMaintenance)
+}
+
+// MaintenanceWindow is scheduled processor downtime from the processor's
+// maintenance section of the config file, for rehearsing runbooks
+type MaintenanceWindow struct {
+	// Schedule is a five field cron expression (minute hour day-of-month
+	// month day-of-week) in UTC, at which the window starts
+	Schedule string `yaml:"schedule" json:"schedule"`
+	// Duration is how long the window lasts, a Go duration or days ("1d")
+	Duration string `yaml:"duration" json:"duration"`
+	// Mode is outage (default) or latency
+	Mode string `yaml:"mode" json:"mode,omitempty"`
+	// LatencyMs is added to every call in latency mode
+	LatencyMs int `yaml:"latency_ms" json:"latency_ms,omitempty"`
+
+	// schedule and duration are Schedule and Duration parsed
+	schedule *cronSchedule
+	duration time.Duration
+}
+
+// validateMaintenance checks a processor's maintenance windows and parses
+// their schedules
+func validateMaintenance(field string, windows []MaintenanceWindow) []FieldViolation {
+	var violations []FieldViolation
+	for i := range windows {
+		w := &windows[i]
+		prefix := fmt.Sprintf("%s[%d].", field, i)
+		schedule, err := parseCronSchedule(w.Schedule)
+		if err != nil {
+			violations = append(violations, FieldViolation{prefix + "schedule", err.Error()})
+		}
+		w.schedule = schedule
+		duration, err := parseDelay(w.Duration)
+		if err == nil && duration <= 0 {
+			err = fmt.Errorf("%q must be positive", w.Duration)
+		}
+		if err != nil {
+			violations = append(violations, FieldViolation{prefix + "duration", err.Error()})
+		}
+		w.duration = duration
+		switch w.Mode {
+		case "", maintenanceOutage:
+			w.Mode = maintenanceOutage
+		case maintenanceLatency:
+			if w.LatencyMs <= 0 {
+				violations = append(violations, FieldViolation{prefix + "latency_ms", "must be positive in latency mode"})
+			}
+		default:
+			violations = append(violations, FieldViolation{prefix + "mode", "must be outage or latency"})
+		}
+	}
+	return violations
+}
+
+// startedAt returns when the occurrence of the window in effect at now
+// started, if one is
+func (w MaintenanceWindow) startedAt(now time.Time) (time.Time, bool) {
+	if w.schedule == nil {
+		return time.Time{}, false
+	}
+	return w.schedule.prev(now, now.Add(-w.duration))
+}
+
+// cronSchedule is a parsed five field cron expression; each field is a
+// bitmask of the values it matches
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny are set for "*": when both day fields are
+	// restricted, cron matches a day that satisfies either
+	domAny, dowAny bool
+}
+
+var (
+	cronMonths   = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCronSchedule parses minute hour day-of-month month day-of-week.
+// Fields take *, values, ranges (1-5), steps (*/15, 0-30/10) and lists;
+// months and weekdays also take names (jan, mon). Sunday is 0 or 7.
+func parseCronSchedule(spec string) (*cronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("%q must have five fields: minute hour day-of-month month day-of-week", spec)
+	}
+	s := &cronSchedule{domAny: fields[2] == "*", dowAny: fields[4] == "*"}
+	for i, f := range []struct {
+		mask     *uint64
+		min, max int
+		names    []string
+	}{
+		{&s.minute, 0, 59, nil},
+		{&s.hour, 0, 23, nil},
+		{&s.dom, 1, 31, nil},
+		{&s.month, 1, 12, cronMonths},
+		{&s.dow, 0, 7, cronWeekdays},
+	} {
+		mask, err := parseCronField(fields[i], f.min, f.max, f.names)
+		if err != nil {
+			return nil, fmt.Errorf("%q: %v", spec, err)
+		}
+		*f.mask = mask
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	return s, nil
+}
+
+// parseCronField parses one comma separated field into a bitmask
+func parseCronField(field string, min, max int, names []string) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, stepped := strings.Cut(part, "/")
+		step := 1
+		if stepped {
+			n, err := strconv.Atoi(stepText)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("%q has an invalid step", part)
+			}
+			step = n
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			loText, hiText, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = parseCronValue(loText, min, max, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = parseCronValue(hiText, min, max, names); err != nil {
+					return 0, err
+				}
+			} else if stepped {
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("%q is an empty range", part)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << v
+		}
+	}
+	return mask, nil
+}
+
+func parseCronValue(s string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if strings.EqualFold(s, name) {
+			return i + min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("%q must be between %d and %d", s, min, max)
+	}
+	return v, nil
+}
+
+// matchesDay reports whether the schedule runs on t's day
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	if s.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// prev returns the latest start at or before t and after after, skipping
+// whole days and hours that don't match
+func (s *cronSchedule) prev(t, after time.Time) (time.Time, bool) {
+	t = t.UTC().Truncate(time.Minute)
+	for t.After(after) {
+		switch {
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).Add(-time.Minute)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(-time.Minute)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(-time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// next returns the first start after t and before before
+func (s *cronSchedule) next(t, before time.Time) (time.Time, bool) {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	for t.Before(before) {
+		switch {
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC).AddDate(0, 0, 1)
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// activeMaintenance is a maintenance window in effect for a processor
+type activeMaintenance struct {
+	window  MaintenanceWindow
+	started time.Time
+}
+
+// maintenanceTracker keeps the windows in effect per processor, so the
+// request path reads a map rather than evaluating schedules
+type maintenanceTracker struct {
+	active atomic.Pointer[map[string]activeMaintenance]
+	// mu serializes check
+	mu sync.Mutex
+}
+
+var maintenance = &maintenanceTracker{}
+
+// effectsFor returns the window in effect for a processor, if any
+func (t *maintenanceTracker) effectsFor(processor string) (MaintenanceWindow, bool) {
+	active := t.active.Load()
+	if active == nil {
+		return MaintenanceWindow{}, false
+	}
+	m, ok := (*active)[processor]
+	return m.window, ok
+}
+
+// check works out the windows in effect at now, logging and emitting an
+// event for each that starts or ends. An outage wins over added latency
+// when windows overlap.
+func (t *maintenanceTracker) check(now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	cfg := currentConfig()
+	active := make(map[string]activeMaintenance)
+	for _, name := range sortedKeys(cfg.Processors) {
+		for _, w := range cfg.Processors[name].Maintenance {
+			started, ok := w.startedAt(now)
+			if !ok {
+				continue
+			}
+			if current, seen := active[name]; seen && (current.window.Mode == maintenanceOutage || w.Mode != maintenanceOutage) {
+				continue
+			}
+			active[name] = activeMaintenance{window: w, started: started}
+		}
+	}
+
+	var previous map[string]activeMaintenance
+	if p := t.active.Load(); p != nil {
+		previous = *p
+	}
+	t.active.Store(&active)
+	for _, name := range sortedKeys(active) {
+		if _, ok := previous[name]; !ok {
+			m := active[name]
+			log.Printf("Maintenance window started for %s: %s until %s", name, m.window.Mode, formatTimestamp(m.started.Add(m.window.duration)))
+			emitEvent("", eventMaintenanceStarted, maintenanceStatusOf(name, m.window, now))
+			processorMaintenance.WithLabelValues(name).Set(1)
+		}
+	}
+	for _, name := range sortedKeys(previous) {
+		if _, ok := active[name]; !ok {
+			log.Printf("Maintenance window ended for %s", name)
+			emitEvent("", eventMaintenanceEnded, maintenanceStatusOf(name, previous[name].window, now))
+			processorMaintenance.WithLabelValues(name).Set(0)
+		}
+	}
+}
+
+// watchMaintenance starts and ends maintenance windows as their schedules
+// come due
+func watchMaintenance() {
+	ticker := time.NewTicker(maintenanceCheckInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		maintenance.check(now)
+	}
+}
+
+// MaintenanceStatus is a configured maintenance window and when it next
+// runs
+type MaintenanceStatus struct {
+	Processor string `json:"processor"`
+	MaintenanceWindow
+	Active    bool   `json:"active"`
+	StartedAt string `json:"started_at,omitempty"`
+	EndsAt    string `json:"ends_at,omitempty"`
+	// NextStart is the next occurrence within a year
+	NextStart string `json:"next_start,omitempty"`
+}
+
+func maintenanceStatusOf(processor string, w MaintenanceWindow, now time.Time) MaintenanceStatus {
+	status := MaintenanceStatus{Processor: processor, MaintenanceWindow: w}
+	if started, ok := w.startedAt(now); ok {
+		status.Active = true
+		status.StartedAt = formatTimestamp(started)
+		status.EndsAt = formatTimestamp(started.Add(w.duration))
+	}
+	if w.schedule != nil {
+		if next, ok := w.schedule.next(now, now.Add(maintenanceLookahead)); ok {
+			status.NextStart = formatTimestamp(next)
+		}
+	}
+	return status
+}
+
+// MaintenanceList is the body of GET /maintenance
+type MaintenanceList struct {
+	Data []MaintenanceStatus `json:"data"`
+}
+
+// handleMaintenanceStatus lists every configured maintenance window, in
+// effect or not (GET /maintenance)
+func handleMaintenanceStatus(w http.ResponseWriter, r *http.Request) {
+	cfg, now := currentConfig(), time.Now()
+	list := MaintenanceList{Data: []MaintenanceStatus{}}
+	for _, name := range sortedKeys(cfg.Processors) {
+		for _, window := range cfg.Processors[name].Maintenance {
+			list.Data = append(list.Data, maintenanceStatusOf(name, window, now))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Merchant is a merchant onboarded through /admin/merchants. Its profile is
+// enforced like a merchants entry of the config file, which it overrides.
+type Merchant struct {
+	MerchantID string `json:"merchant_id"`
+	MerchantConfig
+	// APIKeyPrefix identifies the current key without revealing it
+	APIKeyPrefix string `json:"api_key_prefix,omitempty"`
+	CreatedAt    string `json:"created_at"`
+	UpdatedAt    string `json:"updated_at"`
+
+	// apiKeyHash is the hex SHA-256 of the current key; the key itself is
+	// only ever returned once, when issued
+	apiKeyHash string
+}
+
+// IssuedMerchantKey is returned when a merchant is created or its key
+// rotated. Store the key: it can't be retrieved again.
+type IssuedMerchantKey struct {
+	Merchant
+	APIKey string `json:"api_key"`
+}
+
+// onboardedKeys holds the API keys of onboarded merchants, nil when none
+// has a key
+var onboardedKeys atomic.Pointer[apiKeyStore]
+
+// issueAPIKey gives m a new random key, replacing any previous one
+func issueAPIKey(m *Merchant) string {
+	b := make([]byte, 24)
+	_, _ = rand.Read(b)
+	key := "vg_" + hex.EncodeToString(b)
+	setAPIKey(m, key)
+	return key
+}
+
+// setAPIKey makes key m's API key, replacing any previous one
+func setAPIKey(m *Merchant, key string) {
+	digest := sha256.Sum256([]byte(key))
+	m.apiKeyHash = hex.EncodeToString(digest[:])
+	m.APIKeyPrefix = key[:10]
+}
+
+// syncMerchants loads the onboarded merchants from storage into the
+// merchant registry and the API key store
+func syncMerchants(ctx context.Context) (int, error) {
+	merchants, err := storage.merchants(ctx)
+	if err != nil {
+		return 0, err
+	}
+	profiles := make(map[string]MerchantConfig, len(merchants))
+	keys := &apiKeyStore{keys: make(map[[32]byte]string)}
+	for _, m := range merchants {
+		profiles[m.MerchantID] = m.MerchantConfig
+		var digest [32]byte
+		if b, err := hex.DecodeString(m.apiKeyHash); err == nil && len(b) == len(digest) {
+			copy(digest[:], b)
+			keys.keys[digest] = m.MerchantID
+		}
+	}
+	if violations := configLayers.setOnboarded(profiles); len(violations) > 0 {
+		return 0, fmt.Errorf("onboarded merchants conflict with the config: %s %s", violations[0].Field, violations[0].Message)
+	}
+	if len(keys.keys) == 0 {
+		keys = nil
+	}
+	onboardedKeys.Store(keys)
+	return len(merchants), nil
+}
+
+// getMerchantSyncInterval returns how often other replicas' merchant
+// changes are picked up from a shared database
+func getMerchantSyncInterval() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("MERCHANT_SYNC_INTERVAL_SECONDS", "10"))
+	if err != nil || seconds <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// watchMerchants periodically re-syncs merchants changed by other replicas.
+// The memory backend is private to this process, so it needs no polling.
+func watchMerchants(interval time.Duration) {
+	if storage.name() == storageMemory {
+		return
+	}
+	for range time.Tick(interval) {
+		ctx, cancel := storageContext()
+		if _, err := syncMerchants(ctx); err != nil {
+			log.Printf("Failed to sync merchants: %v", err)
+		}
+		cancel()
+	}
+}
+
+// handleMerchantList lists onboarded merchants (GET /admin/merchants)
+func handleMerchantList(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	merchants, err := storage.merchants(ctx)
+	if err != nil {
+		writeMerchantError(w, r, "list_merchants", "", err)
+		return
+	}
+	if merchants == nil {
+		merchants = []Merchant{}
+	}
+	writeMerchant(w, merchants)
+}
+
+// handleMerchantCreate onboards a merchant and issues its first API key
+// (POST /admin/merchants)
+func handleMerchantCreate(w http.ResponseWriter, r *http.Request) {
+	var m Merchant
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON merchant"}})
+		return
+	}
+	var violations []FieldViolation
+	if !merchantIDPattern.MatchString(m.MerchantID) {
+		violations = append(violations, FieldViolation{"merchant_id", "must be 1-64 characters of letters, digits, '_' or '-'"})
+	}
+	violations = append(violations, currentConfig().validateMerchant("", m.MerchantConfig)...)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+
+	now := formatTimestamp(time.Now())
+	m.CreatedAt, m.UpdatedAt = now, now
+	key := issueAPIKey(&m)
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	if err := storage.createMerchant(ctx, m); err != nil {
+		writeMerchantError(w, r, "create_merchant", m.MerchantID, err)
+		return
+	}
+	resyncMerchants(ctx)
+	log.Printf("Onboarded merchant %s", m.MerchantID)
+	recordMerchantAudit(r, auditMerchantCreated, m.MerchantID, "", merchantStatus(m))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(IssuedMerchantKey{Merchant: m, APIKey: key})
+}
+
+// handleMerchantGet returns one merchant (GET /admin/merchants/{id})
+func handleMerchantGet(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	m, err := storage.merchant(ctx, r.PathValue("id"))
+	if err != nil {
+		writeMerchantError(w, r, "get_merchant", r.PathValue("id"), err)
+		return
+	}
+	writeMerchant(w, m)
+}
+
+// handleMerchantUpdate replaces a merchant's profile: name, limits,
+// routing and webhook URL (PUT /admin/merchants/{id}). Whether it is
+// disabled only changes through /disable and /enable.
+func handleMerchantUpdate(w http.ResponseWriter, r *http.Request) {
+	var profile MerchantConfig
+	if err := json.NewDecoder(r.Body).Decode(&profile); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON merchant profile"}})
+		return
+	}
+	if violations := currentConfig().validateMerchant("", profile); len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	m, ok := changeMerchant(w, r, func(m *Merchant) {
+		profile.Disabled = m.Disabled
+		m.MerchantConfig = profile
+	})
+	if ok {
+		recordMerchantAudit(r, auditMerchantUpdated, m.MerchantID, merchantStatus(m), merchantStatus(m))
+		writeMerchant(w, m)
+	}
+}
+
+// handleMerchantRotateKey issues a new API key; the previous one stops
+// working immediately (POST /admin/merchants/{id}/api-key)
+func handleMerchantRotateKey(w http.ResponseWriter, r *http.Request) {
+	var key string
+	m, ok := changeMerchant(w, r, func(m *Merchant) {
+		key = issueAPIKey(m)
+	})
+	if ok {
+		recordMerchantAudit(r, auditAPIKeyRotated, m.MerchantID, merchantStatus(m), merchantStatus(m))
+		writeMerchant(w, IssuedMerchantKey{Merchant: m, APIKey: key})
+	}
+}
+
+// handleMerchantDisable stops a merchant from authorizing
+// (POST /admin/merchants/{id}/disable)
+func handleMerchantDisable(w http.ResponseWriter, r *http.Request) {
+	var from string
+	m, ok := changeMerchant(w, r, func(m *Merchant) {
+		from = merchantStatus(*m)
+		m.Disabled = true
+	})
+	if ok {
+		log.Printf("Disabled merchant %s", m.MerchantID)
+		recordMerchantAudit(r, auditMerchantDisabled, m.MerchantID, from, merchantStatus(m))
+		writeMerchant(w, m)
+	}
+}
+
+// handleMerchantEnable lets a disabled merchant authorize again
+// (POST /admin/merchants/{id}/enable)
+func handleMerchantEnable(w http.ResponseWriter, r *http.Request) {
+	var from string
+	m, ok := changeMerchant(w, r, func(m *Merchant) {
+		from = merchantStatus(*m)
+		m.Disabled = false
+	})
+	if ok {
+		log.Printf("Enabled merchant %s", m.MerchantID)
+		recordMerchantAudit(r, auditMerchantEnabled, m.MerchantID, from, merchantStatus(m))
+		writeMerchant(w, m)
+	}
+}
+
+// handleMerchantDelete offboards a merchant and revokes its key
+// (DELETE /admin/merchants/{id})
+func handleMerchantDelete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	if err := storage.deleteMerchant(ctx, id); err != nil {
+		writeMerchantError(w, r, "delete_merchant", id, err)
+		return
+	}
+	resyncMerchants(ctx)
+	log.Printf("Deleted merchant %s", id)
+	recordMerchantAudit(r, auditMerchantDeleted, id, "", "deleted")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changeMerchant loads the merchant named in the path, applies change and
+// stores the result, writing the error response and returning false if
+// any step fails
+func changeMerchant(w http.ResponseWriter, r *http.Request, change func(m *Merchant)) (Merchant, bool) {
+	id := r.PathValue("id")
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	m, err := storage.merchant(ctx, id)
+	if err != nil {
+		writeMerchantError(w, r, "get_merchant", id, err)
+		return Merchant{}, false
+	}
+	change(&m)
+	m.UpdatedAt = formatTimestamp(time.Now())
+	if err := storage.updateMerchant(ctx, m); err != nil {
+		writeMerchantError(w, r, "update_merchant", id, err)
+		return Merchant{}, false
+	}
+	resyncMerchants(ctx)
+	return m, true
+}
+
+func writeMerchant(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// resyncMerchants applies a change this replica just stored. The change is
+// already durable, so a failure is only logged; the next sync retries it.
+func resyncMerchants(ctx context.Context) {
+	if _, err := syncMerchants(ctx); err != nil {
+		storageErrorsTotal.WithLabelValues("sync_merchants").Inc()
+		log.Printf("Failed to sync merchants: %v", err)
+	}
+}
+
+// writeMerchantError maps a storage error to a response
+func writeMerchantError(w http.ResponseWriter, r *http.Request, operation, id string, err error) {
+	switch err {
+	case errRecordNotFound:
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Merchant not found", nil)
+	case errDuplicateRecord:
+		writeError(w, r, http.StatusConflict, errCodeDuplicateMerchant, fmt.Sprintf("Merchant %s already exists", id), nil)
+	default:
+		storageErrorsTotal.WithLabelValues(operation).Inc()
+		log.Printf("Failed to %s %s: %v", operation, id, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+	}
+}
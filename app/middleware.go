@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_http_requests_total",
+			Help: "Total number of HTTP requests by route, method and status code",
+		},
+		[]string{"route", "method", "code"},
+	)
+
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "voyager_http_request_duration_seconds",
+			Help:    "HTTP request duration in seconds by route",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"route"},
+	)
+
+	panicsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_panics_total",
+			Help: "Total number of handler panics recovered by route",
+		},
+		[]string{"route"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsTotal)
+	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(panicsTotal)
+}
+
+// middleware wraps a handler with one cross-cutting concern
+type middleware func(http.HandlerFunc) http.HandlerFunc
+
+// chain wraps h in mws; the first middleware is the outermost
+func chain(h http.HandlerFunc, mws ...middleware) http.HandlerFunc {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// statusRecorder remembers the status code written. It passes Flush and
+// Hijack through so SSE and dropped connections still work behind it.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the connection
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// code returns the recorded status, or "0" when nothing was written, as
+// when chaos dropped the connection
+func (w *statusRecorder) code() string {
+	return strconv.Itoa(w.status)
+}
+
+// withMetrics counts requests and observes their duration under the route
+// pattern, which keeps the label set bounded
+func withMetrics(pattern string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rec, ok := w.(*statusRecorder)
+			if !ok {
+				rec = &statusRecorder{ResponseWriter: w}
+			}
+			next(rec, r)
+			httpRequestsTotal.WithLabelValues(pattern, r.Method, rec.code()).Inc()
+			observeWithExemplar(httpRequestDuration.WithLabelValues(pattern), time.Since(start).Seconds(), requestExemplar(r))
+		}
+	}
+}
+
+// metricsHandler serves /metrics, in the OpenMetrics format when the
+// scraper asks for it, which is the only format that carries exemplars
+func metricsHandler() http.Handler {
+	return promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+}
+
+// traceIDFromRequest returns the trace ID of a W3C traceparent header
+// ("00-<trace-id>-<parent-id>-<flags>"), or "" if there is none
+func traceIDFromRequest(r *http.Request) string {
+	_, rest, ok := strings.Cut(r.Header.Get("traceparent"), "-")
+	if !ok {
+		return ""
+	}
+	traceID, rest, ok := strings.Cut(rest, "-")
+	if !ok || !strings.Contains(rest, "-") || len(traceID) != 32 || strings.Trim(traceID, "0") == "" {
+		return ""
+	}
+	var id [16]byte
+	if _, err := hex.Decode(id[:], []byte(traceID)); err != nil {
+		return ""
+	}
+	return traceID
+}
+
+// requestExemplar labels latency observations with the caller's trace ID,
+// or failing that the request ID, so a slow bucket in Grafana leads to the
+// request behind it
+func requestExemplar(r *http.Request) prometheus.Labels {
+	if traceID := traceIDFromRequest(r); traceID != "" {
+		return prometheus.Labels{"trace_id": traceID}
+	}
+	// Exemplar labels must be UTF-8 and are capped at 128 characters in
+	// total; ObserveWithExemplar panics otherwise
+	if id := requestIDFromContext(r.Context()); id != "" && len(id) <= 64 && utf8.ValidString(id) {
+		return prometheus.Labels{"request_id": id}
+	}
+	return nil
+}
+
+// observeWithExemplar records v, attaching the exemplar when there is one
+func observeWithExemplar(obs prometheus.Observer, v float64, exemplar prometheus.Labels) {
+	if eo, ok := obs.(prometheus.ExemplarObserver); ok && len(exemplar) > 0 {
+		eo.ObserveWithExemplar(v, exemplar)
+		return
+	}
+	obs.Observe(v)
+}
+
+// withRecovery turns a panic into a 500 with the standard envelope and logs
+// the stack with the request ID. If the response had already started, the
+// connection is left to the server to abort.
+func withRecovery(pattern string) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			defer func() {
+				err := recover()
+				if err == nil {
+					return
+				}
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				panicsTotal.WithLabelValues(pattern).Inc()
+				log.Printf("panic serving %s %s request_id=%s: %v\n%s", r.Method, r.URL.Path,
+					requestIDFromContext(r.Context()), err, debug.Stack())
+				if rec, ok := w.(*statusRecorder); ok && rec.status != 0 {
+					panic(http.ErrAbortHandler)
+				}
+				writeError(w, r, http.StatusInternalServerError, errCodeInternal, "Internal server error", nil)
+			}()
+			next(w, r)
+		}
+	}
+}
+
+// withAccessLog logs one line per request when ACCESS_LOG=true
+func withAccessLog(next http.HandlerFunc) http.HandlerFunc {
+	if getEnv("ACCESS_LOG", "false") != "true" {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		log.Printf("%s %s %s %s client=%s request_id=%s", r.Method, r.URL.Path, rec.code(),
+			time.Since(start).Round(time.Microsecond), clientIP(r), requestIDFromContext(r.Context()))
+	}
+}
+
+// withTimeout puts a deadline on the request context. Handlers and
+// storage calls honour it; it does not cut off a response mid-write.
+func withTimeout(timeout time.Duration) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+			next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// getRequestTimeout returns REQUEST_TIMEOUT_SECONDS, default 30
+func getRequestTimeout() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("REQUEST_TIMEOUT_SECONDS", "30"))
+	if err != nil || seconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// trackActive counts the request in voyager_active_requests while it runs
+func trackActive(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		activeRequests.Inc()
+		inFlightAuthorizations.Add(1)
+		defer func() {
+			activeRequests.Dec()
+			inFlightAuthorizations.Add(-1)
+		}()
+		next(w, r)
+	}
+}
+
+// withChaosDrop drops the connection when a drop_requests chaos
+// experiment selects the request
+func withChaosDrop(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tenantFromContext(r.Context()).chaosEngine().shouldDrop() {
+			dropConnection(w, r)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+)
+
+// natsPublisher publishes transaction events to NATS subjects named
+// <NATS_SUBJECT_PREFIX>.<event_type>, e.g. voyager.events.authorization.approved,
+// so consumers can subscribe to one lifecycle stage with wildcards
+type natsPublisher struct {
+	conn   *nats.Conn
+	prefix string
+}
+
+// newNATSPublisher connects to NATS_URL
+func newNATSPublisher() (*natsPublisher, error) {
+	url := getEnv("NATS_URL", nats.DefaultURL)
+	conn, err := nats.Connect(url,
+		nats.Name("voyager-gateway"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			log.Printf("NATS disconnected: %v", err)
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Printf("NATS reconnected to %s", c.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := getEnv("NATS_SUBJECT_PREFIX", "voyager.events")
+	log.Printf("Publishing transaction events to NATS at %s under %s.>", url, prefix)
+	return &natsPublisher{conn: conn, prefix: prefix}, nil
+}
+
+// Publish buffers the event in the client; while disconnected the client
+// keeps buffering until its reconnect buffer is full
+func (p *natsPublisher) Publish(ctx context.Context, event TransactionEvent) error {
+	data, err := json.Marshal(event)
+	if err == nil {
+		msg := nats.NewMsg(p.prefix + "." + event.EventType)
+		msg.Data = data
+		msg.Header.Set("Nats-Msg-Id", event.EventID)
+		msg.Header.Set("Transaction-Id", event.TransactionID)
+		err = p.conn.PublishMsg(msg)
+	}
+	recordPublish(sinkNATS, event.EventType, err)
+	return err
+}
+
+// Close flushes pending messages before disconnecting
+func (p *natsPublisher) Close() error {
+	err := p.conn.FlushTimeout(5 * time.Second)
+	p.conn.Close()
+	return err
+}
+
+// Ping round-trips to the server, failing while the client is reconnecting
+func (p *natsPublisher) Ping(ctx context.Context) error {
+	if !p.conn.IsConnected() {
+		return fmt.Errorf("not connected (%s)", p.conn.Status())
+	}
+	return p.conn.FlushWithContext(ctx)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Token types. A vault token stands for a PAN the gateway keeps and sends
+// on; a network token is issued by the card network for one merchant and
+// kept up to date as cards are reissued, so issuers approve it more often.
+const (
+	tokenTypeVault   = "vault_token"
+	tokenTypeNetwork = "network_token"
+)
+
+// networkTokenPrefix marks network tokens, which the vault issues with
+// token_type network_token
+const networkTokenPrefix = "ntok_"
+
+// tokenTypes are the token types and the prefix of their tokens
+var tokenTypes = map[string]string{
+	tokenTypeVault:   vaultTokenPrefix,
+	tokenTypeNetwork: networkTokenPrefix,
+}
+
+// tokenTypeOf returns the type of a token issued by the vault, empty for
+// other card tokens
+func tokenTypeOf(token string) string {
+	switch {
+	case strings.HasPrefix(token, vaultTokenPrefix):
+		return tokenTypeVault
+	case strings.HasPrefix(token, networkTokenPrefix):
+		return tokenTypeNetwork
+	}
+	return ""
+}
+
+// defaultNetworkTokenSupport is the processors that take network tokens
+// unless processors.<name>.network_tokens says otherwise. The others are
+// sent the PAN behind the token.
+var defaultNetworkTokenSupport = map[string]bool{"stripe": true, "adyen": true}
+
+// defaultTokenUplifts are the approval rate points each token type adds,
+// unless token_uplifts overrides them
+var defaultTokenUplifts = map[string]float64{tokenTypeNetwork: 0.03}
+
+var tokenAuthorizationsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_token_authorizations_total",
+		Help: "Total number of authorizations with a vaulted card by token type sent to the processor (network_token or vault_token), processor and status",
+	},
+	[]string{"token_type", "processor", "status"},
+)
+
+var networkTokenFallbacksTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_network_token_fallbacks_total",
+		Help: "Total number of network tokens sent as the PAN to a processor that doesn't take them, by processor",
+	},
+	[]string{"processor"},
+)
+
+func init() {
+	prometheus.MustRegister(tokenAuthorizationsTotal)
+	prometheus.MustRegister(networkTokenFallbacksTotal)
+}
+
+// acceptsNetworkTokens reports whether the processor takes network tokens
+func (c *RuntimeConfig) acceptsNetworkTokens(name string) bool {
+	if p, ok := c.Processors[name]; ok && p.NetworkTokens != nil {
+		return *p.NetworkTokens
+	}
+	return defaultNetworkTokenSupport[name]
+}
+
+// tokenUplift is the approval rate points authorizations sent with
+// tokenType gain
+func (c *RuntimeConfig) tokenUplift(tokenType string) float64 {
+	if uplift, ok := c.TokenUplifts[tokenType]; ok {
+		return uplift
+	}
+	return defaultTokenUplifts[tokenType]
+}
+
+// validateTokenUplifts checks token_uplifts
+func validateTokenUplifts(uplifts map[string]float64) []FieldViolation {
+	var violations []FieldViolation
+	for _, tokenType := range sortedKeys(uplifts) {
+		field := "token_uplifts." + tokenType
+		if _, ok := tokenTypes[tokenType]; !ok {
+			violations = append(violations, FieldViolation{field, fmt.Sprintf("is not a token type; use %s or %s", tokenTypeVault, tokenTypeNetwork)})
+		} else if u := uplifts[tokenType]; u < 0 || u > 1 {
+			violations = append(violations, FieldViolation{field, "must be between 0 and 1"})
+		}
+	}
+	return violations
+}
+
+// processorTokenType is the type of token an authorization reaches
+// processor with: its own, except for a network token the processor
+// doesn't take, whose PAN is sent instead
+func processorTokenType(tokenType, processor string) string {
+	if tokenType == tokenTypeNetwork && !currentConfig().acceptsNetworkTokens(processor) {
+		networkTokenFallbacksTotal.WithLabelValues(processor).Inc()
+		return tokenTypeVault
+	}
+	return tokenType
+}
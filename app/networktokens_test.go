@@ -0,0 +1,123 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestTokenTypeOf(t *testing.T) {
+	cases := []struct {
+		token string
+		want  string
+	}{
+		{"vtok_abc", tokenTypeVault},
+		{"ntok_abc", tokenTypeNetwork},
+		{"tok_visa", ""},
+		{"", ""},
+	}
+	for _, tc := range cases {
+		if got := tokenTypeOf(tc.token); got != tc.want {
+			t.Errorf("tokenTypeOf(%q) = %q, want %q", tc.token, got, tc.want)
+		}
+	}
+}
+
+func TestProcessorTokenType(t *testing.T) {
+	useConfig(t, parseTestConfig(t, `
+processors:
+  adyen: {network_tokens: false}
+  mercadopago: {network_tokens: true}
+`))
+	cases := []struct {
+		tokenType string
+		processor string
+		want      string
+	}{
+		{tokenTypeNetwork, "stripe", tokenTypeNetwork},
+		{tokenTypeNetwork, "adyen", tokenTypeVault},
+		{tokenTypeNetwork, "mercadopago", tokenTypeNetwork},
+		{tokenTypeVault, "stripe", tokenTypeVault},
+		{"", "adyen", ""},
+	}
+	for _, tc := range cases {
+		if got := processorTokenType(tc.tokenType, tc.processor); got != tc.want {
+			t.Errorf("processorTokenType(%q, %s) = %q, want %q", tc.tokenType, tc.processor, got, tc.want)
+		}
+	}
+}
+
+func TestTokenUplift(t *testing.T) {
+	cases := []struct {
+		name      string
+		yaml      string
+		tokenType string
+		want      float64
+	}{
+		{"network default", ``, tokenTypeNetwork, defaultTokenUplifts[tokenTypeNetwork]},
+		{"vault default", ``, tokenTypeVault, 0},
+		{"network overridden", `token_uplifts: {network_token: 0.1}`, tokenTypeNetwork, 0.1},
+		{"vault overridden", `token_uplifts: {vault_token: 0.02}`, tokenTypeVault, 0.02},
+		{"no token", `token_uplifts: {network_token: 0.1}`, "", 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useConfig(t, parseTestConfig(t, tc.yaml))
+			if got := currentConfig().tokenUplift(tc.tokenType); got != tc.want {
+				t.Errorf("tokenUplift(%q) = %g, want %g", tc.tokenType, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateTokenUplifts(t *testing.T) {
+	cases := []struct {
+		name      string
+		uplifts   map[string]float64
+		wantField string
+	}{
+		{"valid", map[string]float64{tokenTypeNetwork: 0.05, tokenTypeVault: 0}, ""},
+		{"unknown type", map[string]float64{"pan": 0.05}, "token_uplifts.pan"},
+		{"negative", map[string]float64{tokenTypeNetwork: -0.1}, "token_uplifts.network_token"},
+		{"over one", map[string]float64{tokenTypeVault: 1.5}, "token_uplifts.vault_token"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			violations := validateTokenUplifts(tc.uplifts)
+			if tc.wantField == "" {
+				if len(violations) > 0 {
+					t.Errorf("violations %v, want none", violations)
+				}
+				return
+			}
+			if len(violations) != 1 || violations[0].Field != tc.wantField {
+				t.Errorf("violations %v, want one on %s", violations, tc.wantField)
+			}
+		})
+	}
+}
+
+// TestTokenUpliftApprovals checks that the uplift is taken off the
+// failure rate of simulated authorizations sent with a token
+func TestTokenUpliftApprovals(t *testing.T) {
+	useConfig(t, parseTestConfig(t, `
+failure_rate: 1
+token_uplifts: {network_token: 1}
+`))
+	p := newSimulatedProcessor("stripe", rng)
+	cases := []struct {
+		tokenType    string
+		wantApproved bool
+	}{
+		{tokenTypeNetwork, true},
+		{tokenTypeVault, false},
+		{"", false},
+	}
+	for _, tc := range cases {
+		result, err := p.outcome(AuthorizationRequest{MerchantID: "merchant_tokens", Amount: 10, Currency: "USD", tokenType: tc.tokenType})
+		if err != nil {
+			t.Fatalf("outcome: %v", err)
+		}
+		if result.Approved != tc.wantApproved {
+			t.Errorf("token type %q: approved %v, want %v", tc.tokenType, result.Approved, tc.wantApproved)
+		}
+	}
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+// The OpenAPI document is generated at startup from the same request and
+// response types the handlers encode, so field names, types and required
+// flags can't drift from the code. Only the route table below is
+// maintained by hand.
+
+// apiOperation describes one method on one path
+type apiOperation struct {
+	Method      string
+	Path        string
+	Summary     string
+	Tag         string
+	Auth        bool
+	Request     interface{}
+	RequestType string
+	Responses   map[int]apiResponse
+}
+
+// apiResponse is one documented status code. A nil Body means no content;
+// a string Body is served as that content type instead of JSON.
+type apiResponse struct {
+	Description string
+	Body        interface{}
+}
+
+// Shared error responses
+var (
+	errValidation   = apiResponse{"Request validation failed", ErrorResponse{}}
+	errUnauthorized = apiResponse{"Missing or invalid API key or signature", ErrorResponse{}}
+	errNotFound     = apiResponse{"Resource not found", ErrorResponse{}}
+	errAdminToken   = apiResponse{"Missing or invalid admin bearer token", ErrorResponse{}}
+	errAdminOff     = apiResponse{"ADMIN_TOKEN is not configured", ErrorResponse{}}
+	errTooLarge     = apiResponse{"Body exceeds MAX_REQUEST_BODY_BYTES", ErrorResponse{}}
+)
+
+type statusBody map[string]string
+
+func apiRoutes() []apiOperation {
+	authorizationResponses := map[int]apiResponse{
+		200: {"Authorization approved", AuthorizationResponse{}},
+		202: {"3DS challenge required; complete it then POST /authorize/confirm", AuthorizationResponse{}},
+		400: errValidation,
+		401: errUnauthorized,
+		402: {"Authorization declined", AuthorizationResponse{}},
+		413: errTooLarge,
+		429: {"Merchant rate limit exceeded", ErrorResponse{}},
+		503: {"Gateway overloaded or draining, or the FX rate feed is down", ErrorResponse{}},
+	}
+
+	return []apiOperation{
+		{Method: "post", Path: "/authorize", Summary: "Authorize a payment", Tag: "payments", Auth: true,
+			Request: AuthorizationRequest{}, Responses: authorizationResponses},
+		{Method: "post", Path: "/authorize/batch", Summary: "Authorize many payments in one call", Tag: "payments", Auth: true,
+			Request: BatchAuthorizationRequest{}, Responses: map[int]apiResponse{
+				200: {"Per-item results in request order plus a summary", BatchAuthorizationResponse{}},
+				400: errValidation, 401: errUnauthorized, 503: authorizationResponses[503],
+			}},
+		{Method: "post", Path: "/authorize/confirm", Summary: "Finalize a 3DS-challenged authorization", Tag: "payments", Auth: true,
+			Request: ConfirmRequest{}, Responses: map[int]apiResponse{
+				200: authorizationResponses[200], 402: authorizationResponses[402],
+				400: errValidation, 404: errNotFound, 413: errTooLarge,
+				409: {"Challenge has not been completed", ErrorResponse{}},
+			}},
+		{Method: "post", Path: "/authorize/{id}/increment", Summary: "Raise the amount of an open authorization", Tag: "payments", Auth: true,
+			Request: IncrementRequest{}, Responses: map[int]apiResponse{
+				200: {"Incremented", AuthorizationIncrement{}},
+				400: errValidation, 401: errUnauthorized, 404: errNotFound,
+				402: {"Issuer declined the increment", ErrorResponse{}},
+				409: {"Authorization expired, or is neither approved nor partially captured", ErrorResponse{}},
+				422: {"Processor doesn't support incremental authorization", ErrorResponse{}},
+			}},
+		{Method: "post", Path: "/3ds/challenge", Summary: "Complete a simulated 3DS challenge", Tag: "payments",
+			Request: ChallengeRequest{}, Responses: map[int]apiResponse{
+				200: {"Challenge completed", statusBody{}},
+				400: errValidation, 404: errNotFound,
+				409: {"Challenge already completed", ErrorResponse{}},
+			}},
+		{Method: "get", Path: "/transactions", Summary: "List transactions, newest first", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"One page of transactions", TransactionList{}}, 400: errValidation, 401: errUnauthorized}},
+		{Method: "get", Path: "/transactions/export", Summary: "Export matching transactions as CSV or NDJSON", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Every matching transaction, newest first; application/x-ndjson with format=ndjson", "text/csv"}, 400: errValidation, 401: errUnauthorized}},
+		{Method: "get", Path: "/transactions/{id}", Summary: "Get a transaction with its captures and refunds", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Transaction", TransactionDetails{}}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "post", Path: "/transactions/{id}/capture", Summary: "Capture an approved authorization, in one part or several", Tag: "payments", Auth: true,
+			Request: CaptureRequest{}, Responses: map[int]apiResponse{
+				200: {"Captured", Transaction{}},
+				400: errValidation, 401: errUnauthorized, 404: errNotFound,
+				409: {"Authorization expired, or transaction is neither approved nor partially captured", ErrorResponse{}},
+			}},
+		{Method: "post", Path: "/transactions/{id}/refund", Summary: "Refund a captured transaction", Tag: "payments", Auth: true,
+			Request: RefundRequest{}, Responses: map[int]apiResponse{
+				201: {"Refunded", Refund{}},
+				400: errValidation, 401: errUnauthorized, 404: errNotFound,
+				409: {"Transaction is not captured", ErrorResponse{}},
+			}},
+		{Method: "get", Path: "/disputes", Summary: "List disputes, oldest first", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Disputes", []Dispute{}}, 400: errValidation, 401: errUnauthorized}},
+		{Method: "get", Path: "/disputes/{id}", Summary: "Get a dispute", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Dispute", Dispute{}}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "post", Path: "/disputes/{id}/evidence", Summary: "Submit evidence for an opened dispute", Tag: "payments", Auth: true,
+			Request: DisputeEvidenceRequest{}, Responses: map[int]apiResponse{
+				200: {"Evidence submitted", Dispute{}},
+				400: errValidation, 401: errUnauthorized, 404: errNotFound,
+				409: {"Dispute is not opened", ErrorResponse{}},
+			}},
+		{Method: "post", Path: "/disputes/{id}/accept", Summary: "Accept an opened dispute", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{
+				200: {"Dispute lost", Dispute{}},
+				401: errUnauthorized, 404: errNotFound,
+				409: {"Dispute is not opened", ErrorResponse{}},
+			}},
+		{Method: "post", Path: "/subscriptions", Summary: "Create a recurring charge", Tag: "payments", Auth: true,
+			Request: SubscriptionRequest{}, Responses: map[int]apiResponse{
+				201: {"Subscription created", Subscription{}},
+				400: errValidation, 401: errUnauthorized,
+			}},
+		{Method: "get", Path: "/subscriptions", Summary: "List subscriptions, oldest first", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Subscriptions", []Subscription{}}, 400: errValidation, 401: errUnauthorized}},
+		{Method: "get", Path: "/subscriptions/{id}", Summary: "Get a subscription", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Subscription", Subscription{}}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "post", Path: "/subscriptions/{id}/pause", Summary: "Pause an active subscription", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{
+				200: {"Paused", Subscription{}}, 401: errUnauthorized, 404: errNotFound,
+				409: {"Subscription is not active", ErrorResponse{}},
+			}},
+		{Method: "post", Path: "/subscriptions/{id}/resume", Summary: "Resume a paused subscription", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{
+				200: {"Resumed", Subscription{}}, 401: errUnauthorized, 404: errNotFound,
+				409: {"Subscription is not paused", ErrorResponse{}},
+			}},
+		{Method: "post", Path: "/subscriptions/{id}/cancel", Summary: "Cancel a subscription", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{
+				200: {"Canceled", Subscription{}}, 401: errUnauthorized, 404: errNotFound,
+				409: {"Subscription is already canceled", ErrorResponse{}},
+			}},
+		{Method: "get", Path: "/subscriptions/{id}/retries", Summary: "List the dunning retries of a subscription's latest failed cycle", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Retries", SubscriptionRetries{}}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "post", Path: "/payment-links", Summary: "Create a payment link with a hosted checkout page", Tag: "payments", Auth: true,
+			Request: PaymentLinkRequest{}, Responses: map[int]apiResponse{
+				201: {"Payment link created", PaymentLink{}},
+				400: errValidation, 401: errUnauthorized,
+			}},
+		{Method: "get", Path: "/payment-links/{id}", Summary: "Get a payment link", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Payment link", PaymentLink{}}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "get", Path: "/pay/{id}", Summary: "Hosted checkout page of a payment link", Tag: "payments",
+			Responses: map[int]apiResponse{200: {"Checkout page", "text/html"}, 404: {"Payment link not found", "text/html"}}},
+		{Method: "post", Path: "/pay/{id}", Summary: "Pay a payment link, as its checkout page does", Tag: "payments",
+			Request: PaymentLinkPayment{}, Responses: map[int]apiResponse{
+				200: {"Payment approved; the link is paid", AuthorizationResponse{}},
+				202: {"3DS challenge required, which the checkout page can't complete; the link stays active", AuthorizationResponse{}},
+				402: authorizationResponses[402], 400: errValidation, 404: errNotFound,
+				409: {"Payment link is paid, expired or being paid", ErrorResponse{}},
+				429: authorizationResponses[429], 503: authorizationResponses[503],
+			}},
+		{Method: "post", Path: "/payouts", Summary: "Push funds to a destination account", Tag: "payments", Auth: true,
+			Request: PayoutRequest{}, Responses: map[int]apiResponse{
+				201: {"Payout created, pending", Payout{}},
+				400: errValidation, 401: errUnauthorized,
+			}},
+		{Method: "get", Path: "/payouts", Summary: "List payouts, oldest first", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Payouts", []Payout{}}, 400: errValidation, 401: errUnauthorized}},
+		{Method: "get", Path: "/payouts/{id}", Summary: "Get a payout", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Payout", Payout{}}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "get", Path: "/merchants/{id}/balance", Summary: "Get a merchant's ledger balances per currency", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Balances", MerchantBalances{}}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "get", Path: "/merchants/{id}/ledger", Summary: "List a merchant's ledger entries, newest first", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Ledger entries", []LedgerEntry{}}, 400: errValidation, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "get", Path: "/graphql", Summary: "Run a read-only GraphQL query passed as query parameters", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"GraphQL result: data and any errors", map[string]interface{}{}}, 400: errValidation, 401: errUnauthorized}},
+		{Method: "post", Path: "/graphql", Summary: "Run a read-only GraphQL query", Tag: "payments", Auth: true,
+			Request: GraphQLRequest{}, Responses: map[int]apiResponse{
+				200: {"GraphQL result: data and any errors", map[string]interface{}{}},
+				400: errValidation, 401: errUnauthorized,
+			}},
+		{Method: "get", Path: "/settlements", Summary: "List settlement batches, newest first", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Settlements without their items", []Settlement{}}, 401: errUnauthorized}},
+		{Method: "get", Path: "/settlements/{id}", Summary: "Get a settlement batch and its items", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"Settlement", Settlement{}}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "get", Path: "/settlements/{id}/reconciliation.csv", Summary: "Download a settlement's reconciliation file", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{200: {"One CSV row per settled transaction", "text/csv"}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "post", Path: "/tokens", Summary: "Tokenize a card", Tag: "vault", Auth: true,
+			Request: TokenizeRequest{}, Responses: map[int]apiResponse{
+				201: {"Card tokenized", TokenResponse{}},
+				400: errValidation, 401: errUnauthorized,
+			}},
+		{Method: "get", Path: "/webhooks", Summary: "List webhook registrations", Tag: "webhooks", Auth: true,
+			Responses: map[int]apiResponse{200: {"Registrations", []WebhookRegistration{}}, 401: errUnauthorized}},
+		{Method: "post", Path: "/webhooks", Summary: "Register a webhook callback URL", Tag: "webhooks", Auth: true,
+			Request: WebhookRegistration{}, Responses: map[int]apiResponse{
+				201: {"Registered", WebhookRegistration{}},
+				400: errValidation, 401: errUnauthorized,
+			}},
+		{Method: "get", Path: "/webhooks/dead-letters", Summary: "List webhook deliveries that exhausted their retries", Tag: "webhooks", Auth: true,
+			Responses: map[int]apiResponse{200: {"Dead letters", []webhookDelivery{}}, 401: errUnauthorized}},
+		{Method: "post", Path: "/webhooks/dead-letters/{id}/retry", Summary: "Re-queue a dead-lettered delivery", Tag: "webhooks", Auth: true,
+			Responses: map[int]apiResponse{202: {"Re-queued", statusBody{}}, 401: errUnauthorized, 404: errNotFound}},
+		{Method: "get", Path: "/events", Summary: "Stream transaction and chaos events (Server-Sent Events)", Tag: "webhooks", Auth: true,
+			Responses: map[int]apiResponse{200: {"Event stream; each data line is a WebhookEvent", "text/event-stream"}, 401: errUnauthorized}},
+		{Method: "get", Path: "/fx/rates", Summary: "FX rates used to convert to a settlement_currency", Tag: "payments", Auth: true,
+			Responses: map[int]apiResponse{
+				200: {"Rate table", FXRates{}}, 401: errUnauthorized,
+				503: {"Rate feed is down (fx_outage chaos)", ErrorResponse{}},
+			}},
+		{Method: "put", Path: "/admin/fx/rates", Summary: "Replace the FX rate table", Tag: "admin",
+			Request: FXRates{}, Responses: map[int]apiResponse{
+				200: {"Rates applied", FXRates{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff,
+			}},
+		{Method: "get", Path: "/admin/chaos", Summary: "List active chaos experiments", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Active experiments", []ChaosExperiment{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "post", Path: "/admin/chaos", Summary: "Start a chaos experiment", Tag: "admin",
+			Request: ChaosExperiment{}, Responses: map[int]apiResponse{201: {"Started", ChaosExperiment{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "delete", Path: "/admin/chaos/{id}", Summary: "Stop a chaos experiment", Tag: "admin",
+			Responses: map[int]apiResponse{204: {"Stopped", nil}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "get", Path: "/admin/blocklist", Summary: "List blocked card tokens, merchants and BIN prefixes", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Blocklist", []BlocklistEntry{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "post", Path: "/admin/blocklist", Summary: "Block a card token, merchant or BIN prefix", Tag: "admin",
+			Request: BlocklistEntry{}, Responses: map[int]apiResponse{
+				201: {"Blocked", BlocklistEntry{}}, 200: {"Already blocked", BlocklistEntry{}},
+				400: errValidation, 401: errAdminToken, 403: errAdminOff,
+			}},
+		{Method: "delete", Path: "/admin/blocklist/{id}", Summary: "Unblock an entry", Tag: "admin",
+			Responses: map[int]apiResponse{204: {"Unblocked", nil}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "post", Path: "/admin/settle", Summary: "Settle every unsettled capture now", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Settlements created", []Settlement{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "get", Path: "/admin/audit", Summary: "Audit trail of state-changing operations, newest first", Tag: "admin",
+			Responses: map[int]apiResponse{
+				200: {"One page of audit entries, or all of them as NDJSON with format=ndjson", AuditLog{}},
+				400: errValidation, 401: errAdminToken, 403: errAdminOff,
+			}},
+		{Method: "post", Path: "/admin/exports/parquet", Summary: "Write transactions to a Parquet file now", Tag: "admin",
+			Request: ParquetExportRequest{}, Responses: map[int]apiResponse{
+				201: {"Export written", ParquetExport{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff,
+				503: {"Parquet export not configured or destination failed", ErrorResponse{}},
+			}},
+		{Method: "get", Path: "/admin/scenario", Summary: "Current scenario phase", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Scenario status", ScenarioStatus{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "post", Path: "/admin/scenario", Summary: "Play back a scenario", Tag: "admin",
+			Request: Scenario{}, RequestType: "application/yaml", Responses: map[int]apiResponse{
+				201: {"Scenario started", ScenarioStatus{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff,
+			}},
+		{Method: "delete", Path: "/admin/scenario", Summary: "Stop the running scenario", Tag: "admin",
+			Responses: map[int]apiResponse{204: {"Stopped", nil}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "post", Path: "/admin/loadgen", Summary: "Start the built-in load generator", Tag: "admin",
+			Request: LoadGenRequest{}, Responses: map[int]apiResponse{
+				201: {"Load generator started", LoadGenStatus{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff,
+			}},
+		{Method: "get", Path: "/admin/loadgen/status", Summary: "Live stats of the running or last load generator run", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Load generator status", LoadGenStatus{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "delete", Path: "/admin/loadgen", Summary: "Stop the load generator", Tag: "admin",
+			Responses: map[int]apiResponse{204: {"Stopped", nil}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "post", Path: "/admin/replay", Summary: "Re-execute a GET /transactions/export file (?format=, ?speed=, ?outcomes=recorded)", Tag: "admin",
+			Request: Transaction{}, RequestType: "application/x-ndjson", Responses: map[int]apiResponse{
+				201: {"Replay started", ReplayStatus{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff,
+			}},
+		{Method: "get", Path: "/admin/replay/status", Summary: "Progress of the running or last replay", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Replay status", ReplayStatus{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "delete", Path: "/admin/replay", Summary: "Stop the replay", Tag: "admin",
+			Responses: map[int]apiResponse{204: {"Stopped", nil}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "get", Path: "/admin/mirror/diffs", Summary: "Mismatches between the primary's and the shadow's answers, with the latest samples", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Mirror diffs", MirrorDiffs{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "delete", Path: "/admin/mirror/diffs", Summary: "Reset the mirror diff counts and samples", Tag: "admin",
+			Responses: map[int]apiResponse{204: {"Reset", nil}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "get", Path: "/admin/tenants", Summary: "List tenants", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Tenants", TenantList{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "post", Path: "/admin/tenants", Summary: "Create a tenant with isolated transactions, rate limits and chaos experiments", Tag: "admin",
+			Request: Tenant{}, Responses: map[int]apiResponse{201: {"Created", Tenant{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "get", Path: "/admin/tenants/{id}", Summary: "Get a tenant", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Tenant", Tenant{}}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "delete", Path: "/admin/tenants/{id}", Summary: "Delete a tenant and everything stored for it", Tag: "admin",
+			Responses: map[int]apiResponse{204: {"Deleted", nil}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "get", Path: "/admin/jobs", Summary: "Background jobs with their schedule and last run", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Jobs", JobList{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "post", Path: "/admin/jobs/{name}/run", Summary: "Run a background job now", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Run finished", JobRun{}}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound,
+				409: {"Job is already running", ErrorResponse{}}}},
+		{Method: "post", Path: "/admin/purge", Summary: "Purge transactions past retention and expired idempotency keys now", Tag: "admin",
+			Request: RetentionPolicy{}, Responses: map[int]apiResponse{200: {"Purged", PurgeResult{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff,
+				503: {"Storage unavailable", ErrorResponse{}}}},
+		{Method: "get", Path: "/admin/snapshot", Summary: "Download transactions, merchants, config overrides and chaos experiments", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Snapshot", Snapshot{}}, 401: errAdminToken, 403: errAdminOff,
+				503: {"Snapshots need the memory backend", ErrorResponse{}}}},
+		{Method: "put", Path: "/admin/snapshot", Summary: "Replace the simulator state with a snapshot", Tag: "admin",
+			Request: Snapshot{}, Responses: map[int]apiResponse{200: {"Restored", SnapshotSummary{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff,
+				503: {"Snapshots need the memory backend", ErrorResponse{}}}},
+		{Method: "post", Path: "/admin/snapshots", Summary: "Save a snapshot to the artifact store", Tag: "admin",
+			Request: SnapshotSaveRequest{}, Responses: map[int]apiResponse{201: {"Saved", SnapshotSummary{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff,
+				503: {"No artifact store, or the upload failed", ErrorResponse{}}}},
+		{Method: "post", Path: "/admin/snapshots/{name}/restore", Summary: "Replace the simulator state with a saved snapshot", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Restored", SnapshotSummary{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff, 404: errNotFound,
+				503: {"No artifact store, or the download failed", ErrorResponse{}}}},
+		{Method: "get", Path: "/admin/drain", Summary: "Drain mode and authorizations still in flight", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Drain status", DrainStatus{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "post", Path: "/admin/drain", Summary: "Refuse new authorizations and fail readiness", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Draining", DrainStatus{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "post", Path: "/admin/undrain", Summary: "Leave drain mode", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Serving", DrainStatus{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "get", Path: "/admin/flags", Summary: "Feature flags in effect and where they come from", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Feature flags", FlagList{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "put", Path: "/admin/flags/{name}", Summary: "Override a feature flag at runtime", Tag: "admin",
+			Request: FeatureFlag{}, Responses: map[int]apiResponse{
+				200: {"Feature flags", FlagList{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff, 404: errNotFound,
+			}},
+		{Method: "delete", Path: "/admin/flags/{name}", Summary: "Drop a feature flag's runtime override", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Feature flags", FlagList{}}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "get", Path: "/admin/config", Summary: "Runtime config overrides and the config in effect", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Config", AdminConfig{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "put", Path: "/admin/config", Summary: "Replace the runtime config overrides", Tag: "admin",
+			Request: RuntimeConfig{}, Responses: map[int]apiResponse{
+				200: {"Overrides applied", AdminConfig{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff,
+			}},
+		{Method: "delete", Path: "/admin/config", Summary: "Clear the runtime config overrides", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Overrides cleared", AdminConfig{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "get", Path: "/admin/merchants", Summary: "List onboarded merchants", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Merchants", []Merchant{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "post", Path: "/admin/merchants", Summary: "Onboard a merchant and issue its API key", Tag: "admin",
+			Request: Merchant{}, Responses: map[int]apiResponse{
+				201: {"Onboarded; api_key is only shown once", IssuedMerchantKey{}}, 400: errValidation,
+				401: errAdminToken, 403: errAdminOff, 409: {"Merchant already exists", ErrorResponse{}},
+			}},
+		{Method: "get", Path: "/admin/merchants/{id}", Summary: "Get a merchant", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Merchant", Merchant{}}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "put", Path: "/admin/merchants/{id}", Summary: "Replace a merchant's profile", Tag: "admin",
+			Request: MerchantConfig{}, Responses: map[int]apiResponse{
+				200: {"Updated", Merchant{}}, 400: errValidation, 401: errAdminToken, 403: errAdminOff, 404: errNotFound,
+			}},
+		{Method: "delete", Path: "/admin/merchants/{id}", Summary: "Offboard a merchant and revoke its key", Tag: "admin",
+			Responses: map[int]apiResponse{204: {"Deleted", nil}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "post", Path: "/admin/merchants/{id}/api-key", Summary: "Rotate a merchant's API key", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"New key; the old one stops working", IssuedMerchantKey{}}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "post", Path: "/admin/merchants/{id}/disable", Summary: "Refuse a merchant's authorizations", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Disabled", Merchant{}}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "post", Path: "/admin/merchants/{id}/enable", Summary: "Re-enable a disabled merchant", Tag: "admin",
+			Responses: map[int]apiResponse{200: {"Enabled", Merchant{}}, 401: errAdminToken, 403: errAdminOff, 404: errNotFound}},
+		{Method: "get", Path: "/health/live", Summary: "Liveness probe", Tag: "operations",
+			Responses: map[int]apiResponse{200: {"Alive", statusBody{}}}},
+		{Method: "get", Path: "/health/ready", Summary: "Readiness probe", Tag: "operations",
+			Responses: map[int]apiResponse{200: {"Ready", HealthResponse{}}, 503: {"Not ready", HealthResponse{}}}},
+		{Method: "get", Path: "/health/startup", Summary: "Startup probe", Tag: "operations",
+			Responses: map[int]apiResponse{200: {"Started", StartupStatus{}}, 503: {"Still starting", StartupStatus{}}}},
+		{Method: "get", Path: "/version", Summary: "Service version", Tag: "operations",
+			Responses: map[int]apiResponse{200: {"Version and any synthetic degradation from BAD_VERSIONS", VersionInfo{}}}},
+		{Method: "get", Path: "/config/status", Summary: "Config file load state and effective config", Tag: "operations",
+			Responses: map[int]apiResponse{200: {"Config status", ConfigStatus{}}}},
+		{Method: "get", Path: "/slo/status", Summary: "Latency SLO burn rates by window", Tag: "operations",
+			Responses: map[int]apiResponse{200: {"SLO status", SLOStatus{}}}},
+		{Method: "get", Path: "/maintenance", Summary: "Scheduled processor maintenance windows and their next start", Tag: "operations",
+			Responses: map[int]apiResponse{200: {"Maintenance windows", MaintenanceList{}}}},
+		{Method: "post", Path: "/reset", Summary: "Reset success rate counters (testing)", Tag: "operations",
+			Responses: map[int]apiResponse{200: {"Reset", statusBody{}}, 401: errAdminToken, 403: errAdminOff}},
+		{Method: "get", Path: "/metrics", Summary: "Prometheus metrics", Tag: "operations",
+			Responses: map[int]apiResponse{200: {"Metrics in the Prometheus text format", "text/plain"}}},
+	}
+}
+
+// openAPIGenerator collects component schemas while walking types
+type openAPIGenerator struct {
+	schemas map[string]interface{}
+}
+
+// schemaRef returns the schema for t, registering named structs as
+// components and referencing them
+func (g *openAPIGenerator) schemaRef(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": g.schemaRef(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schemaRef(t.Elem())}
+	case reflect.Interface:
+		return map[string]interface{}{}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name := componentName(t)
+		if _, ok := g.schemas[name]; !ok {
+			g.schemas[name] = nil // guards against recursive types
+			g.schemas[name] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+	}
+	return map[string]interface{}{}
+}
+
+// structSchema builds an object schema from the exported fields' json tags.
+// Fields without omitempty are required. Embedded structs are flattened, as
+// encoding/json does.
+func (g *openAPIGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Anonymous && f.Type.Kind() == reflect.Struct {
+				walk(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			name, opts, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			properties[name] = g.schemaRef(f.Type)
+			if !strings.Contains(opts, "omitempty") {
+				required = append(required, name)
+			}
+		}
+	}
+	walk(t)
+
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
+
+// componentName exports unexported type names so they read naturally in
+// the document
+func componentName(t reflect.Type) string {
+	r := []rune(t.Name())
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// buildOpenAPI generates the OpenAPI 3 document for apiRoutes
+func buildOpenAPI() map[string]interface{} {
+	g := &openAPIGenerator{schemas: map[string]interface{}{}}
+	paths := map[string]map[string]interface{}{}
+
+	requestIDParam := map[string]interface{}{
+		"name": requestIDHeader, "in": "header", "required": false,
+		"description": "Correlation ID; generated when absent and echoed on every response",
+		"schema":      map[string]interface{}{"type": "string"},
+	}
+
+	for _, op := range apiRoutes() {
+		operation := map[string]interface{}{
+			"summary":     op.Summary,
+			"tags":        []string{op.Tag},
+			"operationId": op.Method + strings.NewReplacer("/", "_", "{", "", "}", "", "-", "_").Replace(op.Path),
+			"parameters":  []interface{}{requestIDParam},
+		}
+		if strings.Contains(op.Path, "{id}") {
+			operation["parameters"] = append(operation["parameters"].([]interface{}), map[string]interface{}{
+				"name": "id", "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+		if op.Auth {
+			// Either an API key or a JWT with the route's scope
+			operation["security"] = []interface{}{
+				map[string]interface{}{"apiKey": []string{}},
+				map[string]interface{}{"bearerJWT": []string{}},
+			}
+		}
+
+		if op.Request != nil {
+			contentType := op.RequestType
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					contentType: map[string]interface{}{"schema": g.schemaRef(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+
+		responses := map[string]interface{}{}
+		for status, resp := range op.Responses {
+			r := map[string]interface{}{
+				"description": resp.Description,
+				"headers": map[string]interface{}{
+					requestIDHeader: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+				},
+			}
+			switch body := resp.Body.(type) {
+			case nil:
+			case string:
+				r["content"] = map[string]interface{}{body: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}}}
+			default:
+				r["content"] = map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": g.schemaRef(reflect.TypeOf(body))},
+				}
+			}
+			responses[strconv.Itoa(status)] = r
+		}
+		operation["responses"] = responses
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]interface{}{}
+		}
+		paths[op.Path][op.Method] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "voyager-gateway",
+			"version": getVersion(),
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"apiKey":    map[string]interface{}{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+				"bearerJWT": map[string]interface{}{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}
+}
+
+var (
+	openAPIOnce sync.Once
+	openAPIJSON []byte
+)
+
+// handleOpenAPI serves the generated OpenAPI document
+func handleOpenAPI(w http.ResponseWriter, r *http.Request) {
+	openAPIOnce.Do(func() {
+		openAPIJSON, _ = json.MarshalIndent(buildOpenAPI(), "", "  ")
+	})
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(openAPIJSON)
+}
+
+const swaggerUIPage = `<!DOCTYPE html>
+<html>
+<head>
+  <title>voyager-gateway API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+  <script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+// handleDocs serves a Swagger UI page for /openapi.json
+func handleDocs(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write([]byte(swaggerUIPage))
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultParquetWindow is how far back an on-demand export reaches when
+// no created_from is given
+const defaultParquetWindow = 24 * time.Hour
+
+var (
+	parquetExportsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_parquet_exports_total",
+			Help: "Total number of Parquet exports by trigger (schedule or admin) and result",
+		},
+		[]string{"trigger", "result"},
+	)
+
+	parquetExportedRows = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "voyager_parquet_exported_rows_total",
+			Help: "Total number of transactions written to Parquet files",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(parquetExportsTotal)
+	prometheus.MustRegister(parquetExportedRows)
+}
+
+// parquetTransaction is one row of a Parquet export. Amounts are in minor
+// units, like the CSV exports.
+type parquetTransaction struct {
+	TransactionID       string    `parquet:"transaction_id"`
+	MerchantID          string    `parquet:"merchant_id,dict"`
+	Status              string    `parquet:"status,dict"`
+	Processor           string    `parquet:"processor,dict"`
+	Currency            string    `parquet:"currency,dict"`
+	AmountMinor         int64     `parquet:"amount_minor"`
+	CapturedAmountMinor int64     `parquet:"captured_amount_minor"`
+	RefundedAmountMinor int64     `parquet:"refunded_amount_minor"`
+	AuthCode            string    `parquet:"auth_code"`
+	ProcessorReference  string    `parquet:"processor_reference"`
+	DeclineReason       string    `parquet:"decline_reason,dict"`
+	CreatedAt           time.Time `parquet:"created_at,timestamp(millisecond:utc)"`
+	UpdatedAt           time.Time `parquet:"updated_at,timestamp(millisecond:utc)"`
+}
+
+func newParquetTransaction(txn Transaction) parquetTransaction {
+	txn = txn.withMinorUnits()
+	created, _ := time.Parse(time.RFC3339, txn.CreatedAt)
+	updated, _ := time.Parse(time.RFC3339, txn.UpdatedAt)
+	return parquetTransaction{
+		TransactionID:       txn.TransactionID,
+		MerchantID:          txn.MerchantID,
+		Status:              txn.Status,
+		Processor:           txn.Processor,
+		Currency:            txn.Currency,
+		AmountMinor:         txn.AmountMinor,
+		CapturedAmountMinor: txn.CapturedAmountMinor,
+		RefundedAmountMinor: txn.RefundedAmountMinor,
+		AuthCode:            txn.AuthCode,
+		ProcessorReference:  txn.ProcessorReference,
+		DeclineReason:       txn.DeclineReason,
+		CreatedAt:           created,
+		UpdatedAt:           updated,
+	}
+}
+
+// ParquetExport describes one written Parquet file
+type ParquetExport struct {
+	// Location is the file's path, or its s3:// or gs:// URL
+	Location    string `json:"location"`
+	Rows        int    `json:"rows"`
+	Bytes       int64  `json:"bytes"`
+	CreatedFrom string `json:"created_from"`
+	CreatedTo   string `json:"created_to"`
+	MerchantID  string `json:"merchant_id,omitempty"`
+	ExportedAt  string `json:"exported_at"`
+}
+
+// ParquetExportRequest is the optional body of POST /admin/exports/parquet
+type ParquetExportRequest struct {
+	CreatedFrom string `json:"created_from,omitempty"`
+	CreatedTo   string `json:"created_to,omitempty"`
+	MerchantID  string `json:"merchant_id,omitempty"`
+}
+
+// parquetExporter writes transactions to Parquet files in the artifact
+// store
+type parquetExporter struct {
+	// interval schedules exports; zero means on demand only
+	interval time.Duration
+
+	// mu serializes exports so scheduled windows follow each other
+	mu sync.Mutex
+}
+
+// parquetExports is nil unless an artifact store is configured
+var parquetExports *parquetExporter
+
+// loadParquetExporter reads the Parquet export settings, returning nil
+// without an artifact store:
+//
+//	PARQUET_EXPORT_INTERVAL  how often to export what was created since the
+//	                         last export, e.g. "1h"; on demand only when unset
+func loadParquetExporter() (*parquetExporter, error) {
+	e := &parquetExporter{}
+	if v := os.Getenv("PARQUET_EXPORT_INTERVAL"); v != "" {
+		interval, err := parseDelay(v)
+		if err != nil || interval < time.Minute {
+			return nil, fmt.Errorf("invalid PARQUET_EXPORT_INTERVAL %q: must be a duration of at least 1m", v)
+		}
+		e.interval = interval
+	}
+	if artifacts == nil {
+		if e.interval > 0 {
+			return nil, fmt.Errorf("PARQUET_EXPORT_INTERVAL needs ARTIFACT_STORE")
+		}
+		return nil, nil
+	}
+	return e, nil
+}
+
+// parquetKey names an export file, partitioned by the UTC date its window
+// starts on so warehouses can prune by date
+func parquetKey(from, to time.Time, merchantID string) string {
+	name := fmt.Sprintf("transactions_%s_%s", from.UTC().Format("20060102T150405Z"), to.UTC().Format("20060102T150405Z"))
+	if merchantID != "" {
+		name += "_" + merchantID
+	}
+	return path.Join("transactions", "date="+from.UTC().Format("2006-01-02"), name+".parquet")
+}
+
+// export writes the transactions created in [from, to], optionally only
+// merchantID's, to one Parquet file in the artifact store
+func (e *parquetExporter) export(ctx context.Context, from, to time.Time, merchantID string) (ParquetExport, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	file, err := os.CreateTemp("", "voyager-export-*.parquet")
+	if err != nil {
+		return ParquetExport{}, err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	writer := parquet.NewGenericWriter[parquetTransaction](file, parquet.Compression(&parquet.Zstd))
+	filter := TransactionFilter{MerchantID: merchantID, CreatedFrom: from, CreatedTo: to, Limit: exportPageSize}
+	rows := 0
+	for {
+		page, err := exportPage(ctx, filter)
+		if err != nil {
+			return ParquetExport{}, fmt.Errorf("reading transactions: %w", err)
+		}
+		batch := make([]parquetTransaction, 0, len(page))
+		for _, txn := range page {
+			batch = append(batch, newParquetTransaction(txn))
+		}
+		if _, err := writer.Write(batch); err != nil {
+			return ParquetExport{}, err
+		}
+		rows += len(page)
+		if len(page) < exportPageSize {
+			break
+		}
+		filter.StartingAfter = page[len(page)-1].TransactionID
+	}
+	if err := writer.Close(); err != nil {
+		return ParquetExport{}, err
+	}
+	size, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return ParquetExport{}, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return ParquetExport{}, err
+	}
+
+	location, err := artifacts.upload(ctx, artifactExport, parquetKey(from, to, merchantID), file, "application/vnd.apache.parquet")
+	if err != nil {
+		return ParquetExport{}, err
+	}
+	parquetExportedRows.Add(float64(rows))
+	return ParquetExport{
+		Location:    location,
+		Rows:        rows,
+		Bytes:       size,
+		CreatedFrom: formatTimestamp(from),
+		CreatedTo:   formatTimestamp(to),
+		MerchantID:  merchantID,
+		ExportedAt:  formatTimestamp(time.Now()),
+	}, nil
+}
+
+// watchParquetExports exports every interval what was created since the
+// previous export. The first window reaches one interval back. Windows
+// end a second before the export, as timestamps have second precision.
+// Only the leader exports; followers skip their windows.
+func watchParquetExports() {
+	e := parquetExports
+	if e == nil || e.interval == 0 {
+		return
+	}
+	from := time.Now().Add(-e.interval).Truncate(time.Second)
+	for {
+		time.Sleep(time.Until(from.Add(e.interval)))
+		to := time.Now().Truncate(time.Second).Add(-time.Second)
+		if !leadership.leading() {
+			from = to.Add(time.Second)
+			continue
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), e.interval)
+		export, err := e.export(ctx, from, to, "")
+		cancel()
+		if err != nil {
+			parquetExportsTotal.WithLabelValues("schedule", "error").Inc()
+			log.Printf("Scheduled Parquet export failed: %v", err)
+			continue
+		}
+		parquetExportsTotal.WithLabelValues("schedule", "success").Inc()
+		log.Printf("Exported %d transactions to %s", export.Rows, export.Location)
+		from = to.Add(time.Second)
+	}
+}
+
+// handleParquetExport writes a Parquet export now (POST
+// /admin/exports/parquet). The body is optional; the window defaults to
+// the last 24 hours.
+func handleParquetExport(w http.ResponseWriter, r *http.Request) {
+	if parquetExports == nil {
+		writeError(w, r, http.StatusServiceUnavailable, errCodeExportUnavailable,
+			"Parquet export needs an artifact store; set ARTIFACT_STORE", nil)
+		return
+	}
+	var req ParquetExportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON export request"}})
+		return
+	}
+
+	now := time.Now().Truncate(time.Second)
+	from, to := now.Add(-defaultParquetWindow), now
+	var violations []FieldViolation
+	for _, bound := range []struct {
+		name, value string
+		dest        *time.Time
+	}{{"created_from", req.CreatedFrom, &from}, {"created_to", req.CreatedTo, &to}} {
+		if bound.value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, bound.value)
+		if err != nil {
+			violations = append(violations, FieldViolation{bound.name, "must be an RFC 3339 timestamp"})
+			continue
+		}
+		*bound.dest = t
+	}
+	if len(violations) == 0 && to.Before(from) {
+		violations = append(violations, FieldViolation{"created_to", "must not be before created_from"})
+	}
+	if req.MerchantID != "" && strings.ContainsAny(req.MerchantID, `/\`) {
+		violations = append(violations, FieldViolation{"merchant_id", "must not contain slashes"})
+	}
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+
+	export, err := parquetExports.export(r.Context(), from, to, req.MerchantID)
+	if err != nil {
+		parquetExportsTotal.WithLabelValues("admin", "error").Inc()
+		log.Printf("Parquet export failed: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeExportUnavailable, "Parquet export failed", nil)
+		return
+	}
+	parquetExportsTotal.WithLabelValues("admin", "success").Inc()
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(export)
+}
@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Payment link statuses. A link is expired once active past its
+// expires_at; that isn't stored.
+const (
+	paymentLinkActive  = "active"
+	paymentLinkPaid    = "paid"
+	paymentLinkExpired = "expired"
+)
+
+// eventPaymentLinkPaid is emitted when a payer completes a payment link
+const eventPaymentLinkPaid = "payment_link.paid"
+
+const (
+	// defaultPaymentLinkTTL is how long a link stays payable by default
+	defaultPaymentLinkTTL = 24 * time.Hour
+	// maxPaymentLinkDescription caps the description shown to the payer
+	maxPaymentLinkDescription = 500
+)
+
+var paymentLinkPaymentsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_payment_link_payments_total",
+		Help: "Total number of payments submitted through payment links by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(paymentLinkPaymentsTotal)
+}
+
+// PaymentLink is a fixed-amount payment a payer completes on the
+// gateway's hosted checkout page at URL
+type PaymentLink struct {
+	LinkID      string  `json:"link_id"`
+	MerchantID  string  `json:"merchant_id"`
+	Status      string  `json:"status"`
+	Amount      float64 `json:"amount"`
+	AmountMinor int64   `json:"amount_minor"`
+	Currency    string  `json:"currency"`
+	Description string  `json:"description,omitempty"`
+	URL         string  `json:"url"`
+	ExpiresAt   string  `json:"expires_at"`
+	// TransactionID is the approved authorization that paid the link
+	TransactionID string `json:"transaction_id,omitempty"`
+	CreatedAt     string `json:"created_at"`
+	UpdatedAt     string `json:"updated_at"`
+}
+
+// PaymentLinkRequest is the body of POST /payment-links
+type PaymentLinkRequest struct {
+	MerchantID  string  `json:"merchant_id"`
+	AmountMinor *int64  `json:"amount_minor,omitempty"`
+	Amount      float64 `json:"amount,omitempty"`
+	Currency    string  `json:"currency"`
+	Description string  `json:"description,omitempty"`
+	// ExpiresAt is when the link stops being payable, RFC 3339; a day
+	// from now by default
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// PaymentLinkPayment is the body the checkout page posts to POST /pay/{id}
+type PaymentLinkPayment struct {
+	CardToken string `json:"card_token"`
+	Country   string `json:"country,omitempty"`
+}
+
+func newPaymentLinkID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "plink_" + hex.EncodeToString(b)
+}
+
+func (l PaymentLink) withMinorUnits() PaymentLink {
+	l.AmountMinor, _ = toMinorUnits(l.Amount, l.Currency)
+	return l
+}
+
+// at returns l as of now, expired if it is still active past expires_at
+func (l PaymentLink) at(now time.Time) PaymentLink {
+	if l.Status == paymentLinkActive && l.ExpiresAt <= formatTimestamp(now) {
+		l.Status = paymentLinkExpired
+	}
+	return l.withMinorUnits()
+}
+
+// validate checks a payment link request, reusing the authorization rules
+// for the merchant, amount and currency
+func (req *PaymentLinkRequest) validate(now time.Time) (time.Time, []FieldViolation) {
+	auth := AuthorizationRequest{
+		MerchantID: req.MerchantID, AmountMinor: req.AmountMinor, Amount: req.Amount, Currency: req.Currency,
+	}
+	// The payer enters the card on the checkout page
+	violations := validateMerchantAmount(&auth)
+	req.Amount, req.AmountMinor, req.Currency = auth.Amount, auth.AmountMinor, auth.Currency
+
+	req.Description = strings.TrimSpace(req.Description)
+	if len(req.Description) > maxPaymentLinkDescription {
+		violations = append(violations, FieldViolation{"description", fmt.Sprintf("must be at most %d characters", maxPaymentLinkDescription)})
+	}
+	expiresAt := now.Add(defaultPaymentLinkTTL)
+	if req.ExpiresAt != "" {
+		t, err := time.Parse(time.RFC3339, req.ExpiresAt)
+		switch {
+		case err != nil:
+			violations = append(violations, FieldViolation{"expires_at", "must be an RFC 3339 timestamp"})
+		case !t.After(now):
+			violations = append(violations, FieldViolation{"expires_at", "must be in the future"})
+		default:
+			expiresAt = t
+		}
+	}
+	return expiresAt, violations
+}
+
+// paymentLinkBaseURL is where payers reach the checkout page:
+// PAYMENT_LINK_BASE_URL, else the scheme and host r was sent to
+func paymentLinkBaseURL(r *http.Request) string {
+	if base := getEnv("PAYMENT_LINK_BASE_URL", ""); base != "" {
+		return strings.TrimRight(base, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+// loadPaymentLink fetches the link named by the {id} path value, writing
+// the error response if it can't. Authenticated merchants only see their
+// own.
+func loadPaymentLink(ctx context.Context, w http.ResponseWriter, r *http.Request) (PaymentLink, bool) {
+	l, err := storage.paymentLink(ctx, r.PathValue("id"))
+	if err == errRecordNotFound {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Payment link not found", nil)
+		return PaymentLink{}, false
+	}
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("get_payment_link").Inc()
+		log.Printf("Failed to load payment link %s: %v", r.PathValue("id"), err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return PaymentLink{}, false
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok && l.MerchantID != merchantID {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Payment link not found", nil)
+		return PaymentLink{}, false
+	}
+	return l.at(time.Now()), true
+}
+
+// handlePaymentLinkCreate creates a payment link (POST /payment-links)
+func handlePaymentLinkCreate(w http.ResponseWriter, r *http.Request) {
+	var req PaymentLinkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON payment link request"}})
+		return
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		req.MerchantID = merchantID
+	}
+	now := time.Now()
+	expiresAt, violations := req.validate(now)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+
+	id := newPaymentLinkID()
+	l := PaymentLink{
+		LinkID:      id,
+		MerchantID:  req.MerchantID,
+		Status:      paymentLinkActive,
+		Amount:      req.Amount,
+		Currency:    req.Currency,
+		Description: req.Description,
+		URL:         paymentLinkBaseURL(r) + "/pay/" + id,
+		ExpiresAt:   formatTimestamp(expiresAt),
+		CreatedAt:   formatTimestamp(now),
+		UpdatedAt:   formatTimestamp(now),
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	if err := storage.createPaymentLink(ctx, l); err != nil {
+		storageErrorsTotal.WithLabelValues("create_payment_link").Inc()
+		log.Printf("Failed to create payment link: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(l.withMinorUnits())
+}
+
+// handlePaymentLinkGet returns a payment link (GET /payment-links/{id})
+func handlePaymentLinkGet(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	l, ok := loadPaymentLink(ctx, w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(l)
+}
+
+// handleCheckoutPage renders the hosted checkout page of a payment link
+// (GET /pay/{id})
+func handleCheckoutPage(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	l, err := storage.paymentLink(ctx, r.PathValue("id"))
+	status := http.StatusOK
+	switch {
+	case err == errRecordNotFound:
+		status = http.StatusNotFound
+	case err != nil:
+		storageErrorsTotal.WithLabelValues("get_payment_link").Inc()
+		log.Printf("Failed to load payment link %s: %v", r.PathValue("id"), err)
+		status = http.StatusServiceUnavailable
+	default:
+		l = l.at(time.Now())
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err = checkoutPage.Execute(w, checkoutPageData{
+		Link:       l,
+		Found:      status == http.StatusOK,
+		Amount:     strconv.FormatFloat(l.Amount, 'f', currencyExponent(l.Currency), 64),
+		TestTokens: []string{"tok_visa", "tok_mastercard", "tok_decline_insufficient_funds", "tok_decline_stolen_card"},
+	})
+	if err != nil {
+		log.Printf("Failed to render checkout page for %s: %v", l.LinkID, err)
+	}
+}
+
+// handleCheckoutPay authorizes the payer's card for a payment link (POST
+// /pay/{id}). It needs no API key: the checkout page can't hold one, so
+// the link stands in for it and fixes the merchant, amount and currency.
+// Only an approved authorization pays the link; after a decline the payer
+// can try another card.
+func handleCheckoutPay(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+	var payment PaymentLinkPayment
+	if err := json.NewDecoder(r.Body).Decode(&payment); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON payment"}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	l, ok := loadPaymentLink(ctx, w, r)
+	if !ok {
+		return
+	}
+	if l.Status != paymentLinkActive {
+		writeError(w, r, http.StatusConflict, errCodeInvalidPaymentLinkState,
+			fmt.Sprintf("Payment link %s is %s", l.LinkID, l.Status), nil)
+		return
+	}
+
+	// Claiming the link first keeps two payers from both paying it
+	txnID := newTransactionID()
+	claimed := l
+	claimed.Status = paymentLinkPaid
+	claimed.TransactionID = txnID
+	claimed.UpdatedAt = formatTimestamp(time.Now())
+	if !updatePaymentLink(ctx, w, r, claimed, paymentLinkActive) {
+		return
+	}
+
+	minor := l.AmountMinor
+	response, rejection := authorize(AuthorizationRequest{
+		MerchantID:    l.MerchantID,
+		AmountMinor:   &minor,
+		Currency:      l.Currency,
+		CardToken:     payment.CardToken,
+		TransactionID: txnID,
+		Country:       payment.Country,
+		exemplar:      requestExemplar(r),
+		origin:        auditOriginOf(r),
+	}, startTime)
+	result := response.Status
+	if rejection != nil {
+		result = "rejected"
+	}
+	paymentLinkPaymentsTotal.WithLabelValues(result).Inc()
+
+	if result != "approved" {
+		// Reopen the link for another attempt
+		l.UpdatedAt = formatTimestamp(time.Now())
+		if err := storage.updatePaymentLink(ctx, l, paymentLinkPaid); err != nil {
+			storageErrorsTotal.WithLabelValues("update_payment_link").Inc()
+			log.Printf("Failed to reopen payment link %s: %v", l.LinkID, err)
+		}
+		if rejection != nil {
+			writeRejection(w, r, rejection)
+			return
+		}
+		writeAuthorizationResponse(w, response)
+		return
+	}
+	emitEvent(l.MerchantID, eventPaymentLinkPaid, claimed.withMinorUnits())
+	writeAuthorizationResponse(w, response)
+}
+
+// updatePaymentLink moves l from status from, writing the error response
+// if it can't
+func updatePaymentLink(ctx context.Context, w http.ResponseWriter, r *http.Request, l PaymentLink, from string) bool {
+	switch err := storage.updatePaymentLink(ctx, l, from); err {
+	case nil:
+		return true
+	case errStatusConflict:
+		writeError(w, r, http.StatusConflict, errCodeInvalidPaymentLinkState,
+			fmt.Sprintf("Payment link %s is no longer %s", l.LinkID, from), nil)
+	default:
+		storageErrorsTotal.WithLabelValues("update_payment_link").Inc()
+		log.Printf("Failed to update payment link %s: %v", l.LinkID, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+	}
+	return false
+}
+
+type checkoutPageData struct {
+	Link       PaymentLink
+	Found      bool
+	Amount     string
+	TestTokens []string
+}
+
+var checkoutPage = template.Must(template.New("checkout").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width, initial-scale=1">
+  <title>{{if .Found}}Pay {{.Amount}} {{.Link.Currency}}{{else}}Payment link not found{{end}}</title>
+  <style>
+    body { font-family: system-ui, sans-serif; max-width: 26rem; margin: 4rem auto; padding: 0 1rem; color: #222; }
+    .amount { font-size: 2rem; font-weight: 600; margin: .5rem 0; }
+    label, input, button { display: block; width: 100%; box-sizing: border-box; }
+    input { padding: .5rem; margin: .25rem 0 1rem; font: inherit; }
+    button { padding: .75rem; font: inherit; font-weight: 600; cursor: pointer; }
+    #result { margin-top: 1rem; }
+    .muted { color: #666; font-size: .9rem; }
+  </style>
+</head>
+<body>
+{{- if not .Found}}
+  <h1>Payment link not found</h1>
+{{- else}}
+  <div class="muted">{{.Link.MerchantID}}</div>
+  <div class="amount">{{.Amount}} {{.Link.Currency}}</div>
+  {{with .Link.Description}}<p>{{.}}</p>{{end}}
+  {{- if eq .Link.Status "active"}}
+  <form id="pay">
+    <label for="card_token">Card token</label>
+    <input id="card_token" name="card_token" list="test_tokens" value="tok_visa" required autocomplete="off">
+    <datalist id="test_tokens">{{range .TestTokens}}<option value="{{.}}">{{end}}</datalist>
+    <button type="submit">Pay {{.Amount}} {{.Link.Currency}}</button>
+  </form>
+  <p class="muted">Expires {{.Link.ExpiresAt}}</p>
+  {{- else}}
+  <p>This payment link is {{.Link.Status}}.</p>
+  {{- end}}
+  <div id="result"></div>
+  <script>
+    const form = document.getElementById("pay");
+    const result = document.getElementById("result");
+    if (form) form.addEventListener("submit", async (e) => {
+      e.preventDefault();
+      const button = form.querySelector("button");
+      button.disabled = true;
+      result.textContent = "Processing…";
+      try {
+        const res = await fetch(location.pathname, {
+          method: "POST",
+          headers: {"Content-Type": "application/json"},
+          body: JSON.stringify({card_token: form.card_token.value}),
+        });
+        const body = await res.json();
+        if (body.status === "approved") {
+          form.remove();
+          result.textContent = "Paid. Transaction " + body.transaction_id + ".";
+        } else if (body.status) {
+          result.textContent = "Payment " + body.status + (body.decline_reason ? ": " + body.decline_reason : "") + ".";
+        } else {
+          result.textContent = body.message || "Payment failed.";
+        }
+      } catch (err) {
+        result.textContent = "Payment failed: " + err.message;
+      }
+      button.disabled = false;
+    });
+  </script>
+{{- end}}
+</body>
+</html>
+`))
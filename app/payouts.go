@@ -0,0 +1,486 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Payout statuses: pending until the payout rail accepts it, then
+// in_transit until the funds arrive (paid) or bounce (failed)
+const (
+	payoutPending   = "pending"
+	payoutInTransit = "in_transit"
+	payoutPaid      = "paid"
+	payoutFailed    = "failed"
+)
+
+// Payout webhook event types
+const (
+	eventPayoutInTransit = "payout.in_transit"
+	eventPayoutPaid      = "payout.paid"
+	eventPayoutFailed    = "payout.failed"
+)
+
+// Payout destination types
+const (
+	destinationBankAccount = "bank_account"
+	destinationCard        = "card"
+	destinationWallet      = "wallet"
+)
+
+// payoutSweepInterval is how often due payouts move on
+const payoutSweepInterval = time.Second
+
+// maxPayoutDescription caps the payout description
+const maxPayoutDescription = 500
+
+// testAccountFailPfx makes a payout to acct_fail_<code> fail with code
+const testAccountFailPfx = "acct_fail_"
+
+var payoutAccountPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// payoutFailure is a way a payout fails, at the stage it fails in: the
+// rail rejects pending payouts, the receiving bank returns in_transit ones
+type payoutFailure struct {
+	Code    string
+	Stage   string
+	Message string
+	Weight  int
+}
+
+var payoutFailures = []payoutFailure{
+	{Code: "invalid_account", Stage: payoutPending, Message: "The destination account does not exist", Weight: 30},
+	{Code: "rail_unavailable", Stage: payoutPending, Message: "The payout rail rejected the submission", Weight: 10},
+	{Code: "account_closed", Stage: payoutInTransit, Message: "The destination account is closed", Weight: 30},
+	{Code: "account_frozen", Stage: payoutInTransit, Message: "The destination account is frozen", Weight: 15},
+	{Code: "name_mismatch", Stage: payoutInTransit, Message: "The account holder name does not match", Weight: 15},
+}
+
+var (
+	payoutsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_payouts_total",
+			Help: "Total number of payout transitions by resulting status",
+		},
+		[]string{"status"},
+	)
+
+	payoutFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_payout_failures_total",
+			Help: "Total number of failed payouts by failure code",
+		},
+		[]string{"code"},
+	)
+
+	payoutDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "voyager_payout_duration_seconds",
+			Help:    "Time from payout creation to paid or failed",
+			Buckets: []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800},
+		},
+		[]string{"status"},
+	)
+
+	payoutsInFlight = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "voyager_payouts_in_flight",
+			Help: "Number of pending and in_transit payouts",
+		},
+		[]string{"status"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(payoutsTotal)
+	prometheus.MustRegister(payoutFailuresTotal)
+	prometheus.MustRegister(payoutDuration)
+	prometheus.MustRegister(payoutsInFlight)
+}
+
+// PayoutDestination is the account a payout pushes funds to
+type PayoutDestination struct {
+	// Type is bank_account, card or wallet
+	Type    string `json:"type"`
+	Account string `json:"account"`
+}
+
+// Payout pushes funds from a merchant to a destination account
+type Payout struct {
+	PayoutID    string            `json:"payout_id"`
+	MerchantID  string            `json:"merchant_id"`
+	Status      string            `json:"status"`
+	Amount      float64           `json:"amount"`
+	AmountMinor int64             `json:"amount_minor"`
+	Currency    string            `json:"currency"`
+	Destination PayoutDestination `json:"destination"`
+	Description string            `json:"description,omitempty"`
+	// ExpectedArrivalAt is set once the payout is in transit
+	ExpectedArrivalAt string `json:"expected_arrival_at,omitempty"`
+	FailureCode       string `json:"failure_code,omitempty"`
+	FailureMessage    string `json:"failure_message,omitempty"`
+	CreatedAt         string `json:"created_at"`
+	UpdatedAt         string `json:"updated_at"`
+
+	// SubmitsAt is when the rail answers a pending payout
+	SubmitsAt string `json:"-"`
+}
+
+// PayoutRequest is the body of POST /payouts
+type PayoutRequest struct {
+	MerchantID  string            `json:"merchant_id"`
+	AmountMinor *int64            `json:"amount_minor,omitempty"`
+	Amount      float64           `json:"amount,omitempty"`
+	Currency    string            `json:"currency"`
+	Destination PayoutDestination `json:"destination"`
+	Description string            `json:"description,omitempty"`
+}
+
+// PayoutFilter narrows a payouts listing. Zero values match everything.
+type PayoutFilter struct {
+	MerchantID string
+	Status     string
+}
+
+func (f PayoutFilter) matches(p Payout) bool {
+	return (f.MerchantID == "" || p.MerchantID == f.MerchantID) &&
+		(f.Status == "" || p.Status == f.Status)
+}
+
+// payoutsByCreation orders payouts by created_at then ID
+func payoutsByCreation(payouts []Payout) {
+	sort.Slice(payouts, func(i, j int) bool {
+		if payouts[i].CreatedAt != payouts[j].CreatedAt {
+			return payouts[i].CreatedAt < payouts[j].CreatedAt
+		}
+		return payouts[i].PayoutID < payouts[j].PayoutID
+	})
+}
+
+func newPayoutID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "po_" + hex.EncodeToString(b)
+}
+
+func (p Payout) withMinorUnits() Payout {
+	p.AmountMinor, _ = toMinorUnits(p.Amount, p.Currency)
+	return p
+}
+
+// payoutLatencyModel is the payout rail's latency profile, separate from
+// the card processors'
+type payoutLatencyModel struct {
+	// submission is how long the rail takes to accept or reject a payout
+	submission latencyDistribution
+	// transit is how long accepted funds take to arrive
+	transit latencyDistribution
+}
+
+// payoutLatencies defaults to a lognormal profile until loadPayoutLatency
+// runs
+var payoutLatencies = payoutLatencyModel{
+	submission: newLognormalLatency(1500, 1000),
+	transit:    newLognormalLatency(30000, 20000),
+}
+
+// loadPayoutLatency reads the payout latency profile:
+//
+//	PAYOUT_LATENCY   submission latency, kind:mean:param in ms (lognormal:1500:1000)
+//	PAYOUT_TRANSIT   transit time, kind:mean:param in ms (lognormal:30000:20000)
+func loadPayoutLatency() (payoutLatencyModel, error) {
+	m := payoutLatencies
+	for _, v := range []struct {
+		name string
+		dist *latencyDistribution
+	}{{"PAYOUT_LATENCY", &m.submission}, {"PAYOUT_TRANSIT", &m.transit}} {
+		spec := os.Getenv(v.name)
+		if spec == "" {
+			continue
+		}
+		dist, err := parseLatencySpec(spec)
+		if err != nil {
+			return m, fmt.Errorf("invalid %s %q: %w", v.name, spec, err)
+		}
+		*v.dist = dist
+	}
+	return m, nil
+}
+
+// getPayoutFailureRate returns the fraction of payouts that fail, split
+// between the stages by the failures' weights
+func getPayoutFailureRate() float64 {
+	rate, err := strconv.ParseFloat(getEnv("PAYOUT_FAILURE_RATE", "0.02"), 64)
+	if err != nil {
+		return 0.02
+	}
+	return rate
+}
+
+// lookupPayoutFailure returns the failure with code
+func lookupPayoutFailure(code string) (payoutFailure, bool) {
+	for _, f := range payoutFailures {
+		if f.Code == code {
+			return f, true
+		}
+	}
+	return payoutFailure{}, false
+}
+
+// payoutFailureAt decides whether p fails at stage: always with its test
+// account's failure, else with the failure rate's share for the stage
+func payoutFailureAt(p Payout, stage string) (payoutFailure, bool) {
+	if code, ok := strings.CutPrefix(p.Destination.Account, testAccountFailPfx); ok {
+		f, _ := lookupPayoutFailure(code)
+		return f, f.Stage == stage
+	}
+	total, stageWeight := 0, 0
+	for _, f := range payoutFailures {
+		total += f.Weight
+		if f.Stage == stage {
+			stageWeight += f.Weight
+		}
+	}
+	rate := getPayoutFailureRate()
+	if rate <= 0 || rng.Float64() >= rate*float64(stageWeight)/float64(total) {
+		return payoutFailure{}, false
+	}
+	pick := rng.Intn(stageWeight)
+	for _, f := range payoutFailures {
+		if f.Stage != stage {
+			continue
+		}
+		if pick < f.Weight {
+			return f, true
+		}
+		pick -= f.Weight
+	}
+	return payoutFailure{}, false
+}
+
+// validate checks a payout request, reusing the authorization rules for
+// the merchant, amount and currency
+func (req *PayoutRequest) validate() []FieldViolation {
+	auth := AuthorizationRequest{
+		MerchantID: req.MerchantID, AmountMinor: req.AmountMinor, Amount: req.Amount, Currency: req.Currency,
+	}
+	violations := validateMerchantAmount(&auth)
+	req.Amount, req.AmountMinor, req.Currency = auth.Amount, auth.AmountMinor, auth.Currency
+
+	switch req.Destination.Type {
+	case destinationBankAccount, destinationCard, destinationWallet:
+	case "":
+		violations = append(violations, FieldViolation{"destination.type", "is required"})
+	default:
+		violations = append(violations, FieldViolation{"destination.type", "must be one of bank_account, card, wallet"})
+	}
+	account := req.Destination.Account
+	switch code, isTest := strings.CutPrefix(account, testAccountFailPfx); {
+	case account == "":
+		violations = append(violations, FieldViolation{"destination.account", "is required"})
+	case !payoutAccountPattern.MatchString(account):
+		violations = append(violations, FieldViolation{"destination.account", "must be 1-64 characters of letters, digits, '_' or '-'"})
+	case isTest:
+		if _, ok := lookupPayoutFailure(code); !ok {
+			violations = append(violations, FieldViolation{"destination.account", fmt.Sprintf("%q is not a payout failure code", code)})
+		}
+	}
+	req.Description = strings.TrimSpace(req.Description)
+	if len(req.Description) > maxPayoutDescription {
+		violations = append(violations, FieldViolation{"description", fmt.Sprintf("must be at most %d characters", maxPayoutDescription)})
+	}
+	return violations
+}
+
+// sweepPayouts moves pending and in_transit payouts on once they are due.
+// The payouts job runs it.
+func sweepPayouts(ctx context.Context, now time.Time) error {
+	for _, status := range []string{payoutPending, payoutInTransit} {
+		payouts, err := storage.payouts(ctx, PayoutFilter{Status: status})
+		if err != nil {
+			storageErrorsTotal.WithLabelValues("list_payouts").Inc()
+			return fmt.Errorf("listing %s payouts: %w", status, err)
+		}
+		payoutsInFlight.WithLabelValues(status).Set(float64(len(payouts)))
+		for _, p := range payouts {
+			due := p.SubmitsAt
+			if status == payoutInTransit {
+				due = p.ExpectedArrivalAt
+			}
+			if due > formatTimestamp(now) {
+				continue
+			}
+			advancePayout(ctx, p, now)
+		}
+	}
+	return nil
+}
+
+// advancePayout moves a due payout to its next status
+func advancePayout(ctx context.Context, p Payout, now time.Time) {
+	from := p.Status
+	eventType := eventPayoutFailed
+	if f, failed := payoutFailureAt(p, from); failed {
+		p.Status, p.FailureCode, p.FailureMessage = payoutFailed, f.Code, f.Message
+	} else if from == payoutPending {
+		p.Status, eventType = payoutInTransit, eventPayoutInTransit
+		p.ExpectedArrivalAt = formatTimestamp(now.Add(payoutLatencies.transit.sample(rng)))
+	} else {
+		p.Status, eventType = payoutPaid, eventPayoutPaid
+	}
+	p.UpdatedAt = formatTimestamp(now)
+
+	switch err := storage.updatePayout(ctx, p, from); err {
+	case nil:
+	case errStatusConflict:
+		// Another replica moved it first
+		return
+	default:
+		storageErrorsTotal.WithLabelValues("update_payout").Inc()
+		log.Printf("Failed to update payout %s: %v", p.PayoutID, err)
+		return
+	}
+	payoutsTotal.WithLabelValues(p.Status).Inc()
+	if p.Status == payoutPaid || p.Status == payoutFailed {
+		if created, err := time.Parse(time.RFC3339, p.CreatedAt); err == nil {
+			payoutDuration.WithLabelValues(p.Status).Observe(now.Sub(created).Seconds())
+		}
+	}
+	if p.Status == payoutFailed {
+		payoutFailuresTotal.WithLabelValues(p.FailureCode).Inc()
+	}
+	recordPayoutEntry(p)
+	emitEvent(p.MerchantID, eventType, p.withMinorUnits())
+}
+
+// handlePayoutCreate starts a payout (POST /payouts). It answers pending
+// right away; the rail moves the payout on asynchronously. A payout larger
+// than the merchant's available balance is created failed.
+func handlePayoutCreate(w http.ResponseWriter, r *http.Request) {
+	var req PayoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON payout request"}})
+		return
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		req.MerchantID = merchantID
+	}
+	if violations := req.validate(); len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+
+	now := time.Now()
+	p := Payout{
+		PayoutID:    newPayoutID(),
+		MerchantID:  req.MerchantID,
+		Status:      payoutPending,
+		Amount:      req.Amount,
+		Currency:    req.Currency,
+		Destination: req.Destination,
+		Description: req.Description,
+		SubmitsAt:   formatTimestamp(now.Add(payoutLatencies.submission.sample(rng))),
+		CreatedAt:   formatTimestamp(now),
+		UpdatedAt:   formatTimestamp(now),
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+
+	payoutBalanceMu.Lock()
+	defer payoutBalanceMu.Unlock()
+	available, err := availableBalance(ctx, p.MerchantID, p.Currency, now)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("ledger_totals").Inc()
+		log.Printf("Failed to load the balance of %s: %v", p.MerchantID, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	if p.withMinorUnits().AmountMinor > available {
+		p.Status, p.FailureCode, p.FailureMessage = payoutFailed, insufficientBalance.Code, insufficientBalance.Message
+		p.SubmitsAt = ""
+	}
+	if err := storage.createPayout(ctx, p); err != nil {
+		storageErrorsTotal.WithLabelValues("create_payout").Inc()
+		log.Printf("Failed to create payout: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	payoutsTotal.WithLabelValues(p.Status).Inc()
+	if p.Status == payoutFailed {
+		payoutFailuresTotal.WithLabelValues(p.FailureCode).Inc()
+		emitEvent(p.MerchantID, eventPayoutFailed, p.withMinorUnits())
+	} else {
+		recordPayoutEntry(p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(p.withMinorUnits())
+}
+
+// handlePayoutList lists payouts, oldest first (GET /payouts). Filters:
+// merchant_id and status. Authenticated merchants only see their own.
+func handlePayoutList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := PayoutFilter{MerchantID: q.Get("merchant_id"), Status: q.Get("status")}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		filter.MerchantID = merchantID
+	}
+	switch filter.Status {
+	case "", payoutPending, payoutInTransit, payoutPaid, payoutFailed:
+	default:
+		writeValidationError(w, r, []FieldViolation{{"status", "must be one of pending, in_transit, paid, failed"}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	payouts, err := storage.payouts(ctx, filter)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_payouts").Inc()
+		log.Printf("Failed to list payouts: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	result := make([]Payout, 0, len(payouts))
+	for _, p := range payouts {
+		result = append(result, p.withMinorUnits())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// handlePayoutGet returns a payout (GET /payouts/{id})
+func handlePayoutGet(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	p, err := storage.payout(ctx, r.PathValue("id"))
+	if err == errRecordNotFound {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Payout not found", nil)
+		return
+	}
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("get_payout").Inc()
+		log.Printf("Failed to load payout %s: %v", r.PathValue("id"), err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok && p.MerchantID != merchantID {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Payout not found", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.withMinorUnits())
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// errProcessorUnavailable is returned when a processor can't be reached.
+// Authorizations that hit it are declined with processor_unavailable.
+var errProcessorUnavailable = errors.New("processor_unavailable")
+
+// ProcessorResult is a processor's answer to an authorization, capture or
+// refund it received
+type ProcessorResult struct {
+	Approved bool
+	// AuthCode is the issuer's approval code for an authorization
+	AuthCode string
+	// Reference is the processor's ID for the payment, needed by real
+	// processors to capture or refund it later
+	Reference string
+	// DeclineReason is set when not approved
+	DeclineReason string
+	Latency       time.Duration
+}
+
+// Processor is a payment processor the gateway can route to. An error
+// means the processor could not be reached or gave no answer; a decline is
+// a result, not an error.
+type Processor interface {
+	Name() string
+	Authorize(ctx context.Context, req AuthorizationRequest) (ProcessorResult, error)
+	Capture(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error)
+	Refund(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error)
+	// HealthCheck reports whether the processor is usable, e.g. that its
+	// credentials are configured
+	HealthCheck(ctx context.Context) error
+}
+
+// asyncAuthorizer is implemented by processors that can answer an
+// authorization through a callback instead of blocking the caller. done
+// runs on another goroutine unless the answer is immediate.
+type asyncAuthorizer interface {
+	AuthorizeAsync(req AuthorizationRequest, done func(ProcessorResult, error))
+}
+
+// incrementalAuthorizer is implemented by processors that can raise an
+// open authorization by amount; see ProcessorConfig.IncrementalAuthorization.
+// ReverseIncrement gives back an approved increment the gateway could not
+// record.
+type incrementalAuthorizer interface {
+	IncrementAuthorization(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error)
+	ReverseIncrement(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error)
+}
+
+// captureReverser is implemented by processors that can take back a
+// capture the gateway could not record, as incrementalAuthorizer reverses
+// increments. The Stripe API processor doesn't: its captures carry the
+// transaction's idempotency key, so a retried one isn't taken twice.
+type captureReverser interface {
+	ReverseCapture(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error)
+}
+
+// refundReverser is implemented by processors that can cancel a refund the
+// gateway could not record. The Stripe API processor doesn't; such refunds
+// are logged for reconciliation.
+type refundReverser interface {
+	ReverseRefund(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error)
+}
+
+// processorRegistry holds the processors available for routing, in
+// registration order
+type processorRegistry struct {
+	mu     sync.RWMutex
+	byName map[string]Processor
+	order  []string
+	// ordered is replaced rather than modified on register, so all can
+	// hand it out without copying
+	ordered []Processor
+}
+
+// processors are the simulated processors unless replaced at startup
+var processors = newProcessorRegistry(
+	newSimulatedProcessor("stripe", rng),
+	newSimulatedProcessor("adyen", rng),
+	newSimulatedProcessor("mercadopago", rng),
+)
+
+func newProcessorRegistry(ps ...Processor) *processorRegistry {
+	r := &processorRegistry{byName: make(map[string]Processor)}
+	for _, p := range ps {
+		r.register(p)
+	}
+	return r
+}
+
+// register adds a processor, replacing any registered under the same name
+func (r *processorRegistry) register(p Processor) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.byName[p.Name()]; !ok {
+		r.order = append(r.order, p.Name())
+	}
+	r.byName[p.Name()] = p
+	ordered := make([]Processor, 0, len(r.order))
+	for _, name := range r.order {
+		ordered = append(ordered, r.byName[name])
+	}
+	r.ordered = ordered
+}
+
+func (r *processorRegistry) get(name string) (Processor, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.byName[name]
+	return p, ok
+}
+
+// names returns the registered processor names in registration order
+func (r *processorRegistry) names() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]string(nil), r.order...)
+}
+
+// all returns the registered processors in registration order. The slice
+// is shared, so callers must not modify it.
+func (r *processorRegistry) all() []Processor {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ordered
+}
+
+// simulatedProcessor fakes a processor: outcomes and latency are drawn from
+// its rng and shaped by FAILURE_RATE, the latency model, test cards and
+// chaos
+type simulatedProcessor struct {
+	name string
+	rng  *rand.Rand
+}
+
+// newSimulatedProcessor returns a simulated processor drawing from rnd,
+// which must be safe for concurrent use, as newRNG's generators are
+func newSimulatedProcessor(name string, rnd *rand.Rand) *simulatedProcessor {
+	return &simulatedProcessor{name: name, rng: rnd}
+}
+
+func (p *simulatedProcessor) Name() string {
+	return p.name
+}
+
+func (p *simulatedProcessor) Authorize(ctx context.Context, req AuthorizationRequest) (ProcessorResult, error) {
+	result, err := p.outcome(req)
+	time.Sleep(result.Latency)
+	return result, err
+}
+
+// AuthorizeAsync draws the outcome straight away and reports it once the
+// simulated latency has passed. The wait is a runtime timer rather than a
+// sleeping goroutine, so tens of thousands of calls in flight cost timers,
+// not stacks.
+func (p *simulatedProcessor) AuthorizeAsync(req AuthorizationRequest, done func(ProcessorResult, error)) {
+	result, err := p.outcome(req)
+	if result.Latency <= 0 {
+		done(result, err)
+		return
+	}
+	simulatedCalls.after(result.Latency, func() { done(result, err) })
+}
+
+// outcome decides an authorization without waiting; Latency is how long
+// the processor would take to answer
+func (p *simulatedProcessor) outcome(req AuthorizationRequest) (ProcessorResult, error) {
+	if forced, success, result, latency := testCardOutcome(req.CardToken); forced {
+		if success {
+			return ProcessorResult{Approved: true, AuthCode: result, Latency: latency}, nil
+		}
+		return ProcessorResult{DeclineReason: result, Latency: latency}, nil
+	}
+
+	fx, err := p.chaosEffects(req.tenant.chaosEngine())
+	if err != nil {
+		return ProcessorResult{}, err
+	}
+	latency := p.drawLatency(fx)
+
+	failureRate := processorFailureRate(p.name, req.MerchantID)
+	if req.tokenType != "" {
+		failureRate = max(0, failureRate-currentConfig().tokenUplift(req.tokenType))
+	}
+	if fx.hasErrorRate {
+		chaosInjectionsTotal.WithLabelValues(chaosErrorRate).Inc()
+		failureRate = fx.errorRate
+	}
+	failureRate, latency = degradation.apply(failureRate, latency)
+	if p.rng.Float64() < failureRate {
+		return ProcessorResult{DeclineReason: drawDeclineReason(p.rng), Latency: latency}, nil
+	}
+
+	authCode := fmt.Sprintf("AUTH%d", p.rng.Intn(999999))
+	return ProcessorResult{Approved: true, AuthCode: authCode, Latency: latency}, nil
+}
+
+// Capture and Refund only fail under an error_rate chaos experiment;
+// FAILURE_RATE models issuer declines, which don't apply to them
+func (p *simulatedProcessor) Capture(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	return p.settle(ctx, "capture_failed")
+}
+
+func (p *simulatedProcessor) Refund(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	return p.settle(ctx, "refund_failed")
+}
+
+// ReverseCapture only fails under an error_rate chaos experiment, like the
+// capture itself
+func (p *simulatedProcessor) ReverseCapture(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	return p.settle(ctx, "reversal_failed")
+}
+
+// ReverseRefund fails like ReverseCapture
+func (p *simulatedProcessor) ReverseRefund(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	return p.settle(ctx, "reversal_failed")
+}
+
+// IncrementAuthorization asks the issuer for more, so unlike a capture it
+// is decided as an authorization of amount would be, with the same
+// failure rate, token uplift, chaos and version degradation
+func (p *simulatedProcessor) IncrementAuthorization(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	result, err := p.outcome(AuthorizationRequest{
+		MerchantID: txn.MerchantID,
+		Amount:     amount,
+		Currency:   txn.Currency,
+		tokenType:  txn.TokenType,
+		tenant:     tenantFromContext(ctx),
+	})
+	time.Sleep(result.Latency)
+	return result, err
+}
+
+// ReverseIncrement only fails under an error_rate chaos experiment, like a
+// capture
+func (p *simulatedProcessor) ReverseIncrement(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	return p.settle(ctx, "reversal_failed")
+}
+
+func (p *simulatedProcessor) settle(ctx context.Context, declineReason string) (ProcessorResult, error) {
+	fx, err := p.chaosEffects(tenantFromContext(ctx).chaosEngine())
+	if err != nil {
+		return ProcessorResult{}, err
+	}
+	latency := p.sleep(fx)
+	if fx.hasErrorRate {
+		chaosInjectionsTotal.WithLabelValues(chaosErrorRate).Inc()
+		if p.rng.Float64() < fx.errorRate {
+			return ProcessorResult{DeclineReason: declineReason, Latency: latency}, nil
+		}
+	}
+	return ProcessorResult{Approved: true, Reference: fmt.Sprintf("REF%d", p.rng.Intn(999999)), Latency: latency}, nil
+}
+
+// processorFailureRate is the merchant's configured failure rate, else the
+// processor's, falling back to the global one
+func processorFailureRate(name, merchantID string) float64 {
+	cfg := currentConfig()
+	if m, ok := cfg.merchantProfile(merchantID); ok && m.FailureRate != nil {
+		return *m.FailureRate
+	}
+	if p, ok := cfg.Processors[name]; ok && p.FailureRate != nil {
+		return *p.FailureRate
+	}
+	return getFailureRate()
+}
+
+// HealthCheck passes when <NAME>_API_KEY is set or SKIP_SECRET_CHECK=true
+func (p *simulatedProcessor) HealthCheck(ctx context.Context) error {
+	name := processorSecretName(p.name)
+	if processorSecrets.value(name) != "" || os.Getenv("SKIP_SECRET_CHECK") == "true" {
+		return nil
+	}
+	return fmt.Errorf("missing %s", name)
+}
+
+// chaosEffects returns the active chaos of engine and maintenance for
+// this processor, or errProcessorUnavailable during an outage
+func (p *simulatedProcessor) chaosEffects(engine *chaosEngine) (chaosEffects, error) {
+	fx := engine.effectsFor(p.name)
+	if fx.outage {
+		chaosInjectionsTotal.WithLabelValues(chaosProcessorOutage).Inc()
+		return fx, errProcessorUnavailable
+	}
+	if window, ok := maintenance.effectsFor(p.name); ok {
+		if window.Mode == maintenanceOutage {
+			return fx, errProcessorUnavailable
+		}
+		fx.maintenanceLatency = time.Duration(window.LatencyMs) * time.Millisecond
+	}
+	return fx, nil
+}
+
+// sleep waits for a latency drawn from drawLatency and returns it
+func (p *simulatedProcessor) sleep(fx chaosEffects) time.Duration {
+	latency := p.drawLatency(fx)
+	time.Sleep(latency)
+	return latency
+}
+
+// drawLatency returns a latency from the latency model plus any chaos
+// and maintenance latency
+func (p *simulatedProcessor) drawLatency(fx chaosEffects) time.Duration {
+	latency := latencies.sample(p.rng, p.name) + fx.maintenanceLatency
+	if fx.extraLatency > 0 {
+		chaosInjectionsTotal.WithLabelValues(chaosLatency).Inc()
+		latency += fx.extraLatency
+	}
+	return latency
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// concurrentCalls is how many simulated processor calls are in flight at
+// once in the benchmarks, the load the timer-based simulation is built for
+const concurrentCalls = 50000
+
+// benchLatency is the simulated latency of every call; fixed so the
+// blocking and timer-based runs wait the same amount
+const benchLatency = 20 * time.Millisecond
+
+type fixedLatency time.Duration
+
+func (d fixedLatency) sample(*rand.Rand) time.Duration { return time.Duration(d) }
+func (d fixedLatency) String() string                  { return time.Duration(d).String() }
+
+func useFixedLatency(b *testing.B) {
+	previous := latencies
+	latencies = &latencyModel{defaultDist: fixedLatency(benchLatency)}
+	b.Cleanup(func() { latencies = previous })
+}
+
+// goroutinePeak samples the goroutine count until stop is closed
+type goroutinePeak struct {
+	peak int64
+	stop chan struct{}
+	done chan struct{}
+}
+
+func watchGoroutines() *goroutinePeak {
+	p := &goroutinePeak{stop: make(chan struct{}), done: make(chan struct{})}
+	go func() {
+		defer close(p.done)
+		ticker := time.NewTicker(time.Millisecond)
+		defer ticker.Stop()
+		for {
+			if n := int64(runtime.NumGoroutine()); n > atomic.LoadInt64(&p.peak) {
+				atomic.StoreInt64(&p.peak, n)
+			}
+			select {
+			case <-p.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return p
+}
+
+func (p *goroutinePeak) report(b *testing.B) {
+	close(p.stop)
+	<-p.done
+	b.ReportMetric(float64(atomic.LoadInt64(&p.peak)), "peak-goroutines")
+}
+
+// BenchmarkSimulatedCallsBlocking is the old shape: a goroutine per call
+// sleeping out the latency
+func BenchmarkSimulatedCallsBlocking(b *testing.B) {
+	useFixedLatency(b)
+	p := newSimulatedProcessor("stripe", rng)
+	req := AuthorizationRequest{MerchantID: "merchant_bench"}
+	peak := watchGoroutines()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(concurrentCalls)
+		for c := 0; c < concurrentCalls; c++ {
+			go func() {
+				defer wg.Done()
+				_, _ = p.Authorize(context.Background(), req)
+			}()
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+	peak.report(b)
+}
+
+// BenchmarkSimulatedCallsTimers makes the same calls through AuthorizeAsync,
+// which waits on a timer instead of a goroutine
+func BenchmarkSimulatedCallsTimers(b *testing.B) {
+	useFixedLatency(b)
+	p := newSimulatedProcessor("stripe", rng)
+	req := AuthorizationRequest{MerchantID: "merchant_bench"}
+	peak := watchGoroutines()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(concurrentCalls)
+		for c := 0; c < concurrentCalls; c++ {
+			p.AuthorizeAsync(req, func(ProcessorResult, error) { wg.Done() })
+		}
+		wg.Wait()
+	}
+	b.StopTimer()
+	peak.report(b)
+}
+
+// batchItems is a full default-sized batch run on the default ten workers
+const batchItems = 100
+
+// BenchmarkBatchWorkersBlocking runs a batch's processor calls on the batch
+// workers the old way, each worker held for the whole call
+func BenchmarkBatchWorkersBlocking(b *testing.B) {
+	useFixedLatency(b)
+	p := newSimulatedProcessor("stripe", rng)
+	req := AuthorizationRequest{MerchantID: "merchant_bench"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(batchItems)
+		for c := 0; c < batchItems; c++ {
+			runBatchTask(func() {
+				_, _ = p.Authorize(context.Background(), req)
+				wg.Done()
+			})
+		}
+		wg.Wait()
+	}
+}
+
+// BenchmarkBatchWorkersTimers runs them as deferred batch items do, the
+// worker handing each call to a timer
+func BenchmarkBatchWorkersTimers(b *testing.B) {
+	useFixedLatency(b)
+	p := newSimulatedProcessor("stripe", rng)
+	req := AuthorizationRequest{MerchantID: "merchant_bench"}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var wg sync.WaitGroup
+		wg.Add(batchItems)
+		for c := 0; c < batchItems; c++ {
+			runBatchTask(func() {
+				p.AuthorizeAsync(req, func(ProcessorResult, error) { wg.Done() })
+			})
+		}
+		wg.Wait()
+	}
+}
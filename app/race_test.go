@@ -0,0 +1,7 @@
+//go:build race
+
+package main
+
+// raceEnabled is set under the race detector, which instruments memory
+// accesses with allocations of its own
+const raceEnabled = true
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+var rateLimitedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_rate_limited_total",
+		Help: "Total number of requests rejected by the per-merchant rate limiter",
+	},
+	[]string{"merchant_id"},
+)
+
+var rateLimitUntrackedTotal = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Name: "voyager_rate_limit_untracked_total",
+		Help: "Total number of requests let through unlimited because every rate limit bucket was in use",
+	},
+)
+
+func init() {
+	prometheus.MustRegister(rateLimitedTotal)
+	prometheus.MustRegister(rateLimitUntrackedTotal)
+}
+
+// rateLimit is a token bucket configuration: tokens refill at RPS per second
+// up to Burst
+type rateLimit struct {
+	RPS   float64 `yaml:"rps" json:"rps"`
+	Burst int     `yaml:"burst" json:"burst"`
+}
+
+// tokenBucket tracks the remaining tokens for one merchant
+type tokenBucket struct {
+	mu       sync.Mutex
+	limit    rateLimit
+	tokens   float64
+	lastFill time.Time
+}
+
+// take consumes a token if one is available. When the bucket is empty it
+// returns how long until the next token is refilled.
+func (b *tokenBucket) take(now time.Time) (bool, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	elapsed := now.Sub(b.lastFill).Seconds()
+	b.tokens = math.Min(float64(b.limit.Burst), b.tokens+elapsed*b.limit.RPS)
+	b.lastFill = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - b.tokens) / b.limit.RPS * float64(time.Second))
+	return false, wait
+}
+
+// Rate limit keys, chosen by RATE_LIMIT_KEY
+const (
+	rateLimitKeyMerchant   = "merchant"
+	rateLimitKeyMerchantIP = "merchant_ip"
+)
+
+// rateLimitPerClient gives each client IP of a merchant its own bucket, so
+// one noisy client can't use up the merchant's whole limit
+var rateLimitPerClient bool
+
+// maxRateLimitBuckets caps the buckets a limiter holds, so requests with
+// made-up merchant IDs can't grow it without bound. A new key finding the
+// cap reached first drops the idle buckets, at most once per
+// rateLimitEvictInterval; if none are idle it goes unlimited rather than
+// share a bucket a flood of keys could drain for everyone.
+const maxRateLimitBuckets = 100000
+
+// rateLimitEvictInterval spaces out the sweeps new keys trigger when the
+// buckets are full, each of which walks all of them
+const rateLimitEvictInterval = time.Second
+
+// rateLimitSweepInterval is how often the buckets that have refilled
+// completely, which behave exactly like new ones, are dropped
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter holds one token bucket per merchant, or per merchant and
+// client IP
+type rateLimiter struct {
+	mu           sync.Mutex
+	defaultLimit rateLimit
+	overrides    map[string]rateLimit
+	buckets      map[string]*tokenBucket
+	// lastEviction is when a new key last dropped idle buckets to make
+	// room for itself
+	lastEviction time.Time
+	// scope keeps a tenant's buckets in Redis apart from everyone else's,
+	// empty for the default namespace
+	scope string
+}
+
+// merchantLimiter holds the limiter in effect, nil when rate limiting is
+// disabled. A config reload swaps it, which resets every bucket.
+var merchantLimiter atomic.Pointer[rateLimiter]
+
+// envRateLimiter is the limiter configured by the environment, restored
+// when a config file stops setting rate_limits
+var envRateLimiter *rateLimiter
+
+func currentRateLimiter() *rateLimiter {
+	return merchantLimiter.Load()
+}
+
+func setRateLimiter(l *rateLimiter) {
+	merchantLimiter.Store(l)
+}
+
+// newRateLimiter returns nil when neither the default nor any override
+// limits anything
+func newRateLimiter(defaultLimit rateLimit, overrides map[string]rateLimit) *rateLimiter {
+	if defaultLimit.RPS == 0 && len(overrides) == 0 {
+		return nil
+	}
+	return &rateLimiter{
+		defaultLimit: defaultLimit,
+		overrides:    overrides,
+		buckets:      make(map[string]*tokenBucket),
+	}
+}
+
+// defaultBurst lets a merchant burst to twice its rate
+func defaultBurst(rps float64) int {
+	return int(math.Ceil(rps * 2))
+}
+
+// loadRateLimiter reads the default limit from RATE_LIMIT_RPS and
+// RATE_LIMIT_BURST, and per-merchant overrides from RATE_LIMITS as a comma
+// separated list of merchant_id=rps:burst. A default RPS of 0 disables the
+// limiter for merchants without an override. RATE_LIMIT_KEY=merchant_ip
+// keys the buckets by client IP too.
+func loadRateLimiter() (*rateLimiter, error) {
+	switch key := getEnv("RATE_LIMIT_KEY", rateLimitKeyMerchant); key {
+	case rateLimitKeyMerchant, rateLimitKeyMerchantIP:
+		rateLimitPerClient = key == rateLimitKeyMerchantIP
+	default:
+		return nil, fmt.Errorf("invalid RATE_LIMIT_KEY %q, expected %s or %s", key, rateLimitKeyMerchant, rateLimitKeyMerchantIP)
+	}
+
+	rps, err := strconv.ParseFloat(getEnv("RATE_LIMIT_RPS", "1000"), 64)
+	if err != nil || rps < 0 {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_RPS %q", os.Getenv("RATE_LIMIT_RPS"))
+	}
+	// A bucket holding less than one token never lets a request through
+	burst, err := strconv.Atoi(getEnv("RATE_LIMIT_BURST", strconv.Itoa(defaultBurst(rps))))
+	if err != nil || burst < 0 || (rps > 0 && burst < 1) {
+		return nil, fmt.Errorf("invalid RATE_LIMIT_BURST %q", os.Getenv("RATE_LIMIT_BURST"))
+	}
+
+	overrides := make(map[string]rateLimit)
+	for _, entry := range strings.Split(os.Getenv("RATE_LIMITS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		merchantID, spec, ok := strings.Cut(entry, "=")
+		if !ok || merchantID == "" {
+			return nil, fmt.Errorf("invalid RATE_LIMITS entry %q, expected merchant_id=rps:burst", entry)
+		}
+		limit, err := parseRateLimit(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RATE_LIMITS entry for %s: %w", merchantID, err)
+		}
+		overrides[merchantID] = limit
+	}
+	return newRateLimiter(rateLimit{RPS: rps, Burst: burst}, overrides), nil
+}
+
+// parseRateLimit parses "rps:burst"; burst defaults to twice the rate
+func parseRateLimit(spec string) (rateLimit, error) {
+	rpsStr, burstStr, hasBurst := strings.Cut(spec, ":")
+	rps, err := strconv.ParseFloat(rpsStr, 64)
+	if err != nil || rps <= 0 {
+		return rateLimit{}, fmt.Errorf("rps must be a positive number")
+	}
+	burst := defaultBurst(rps)
+	if hasBurst {
+		burst, err = strconv.Atoi(burstStr)
+		if err != nil || burst < 1 {
+			return rateLimit{}, fmt.Errorf("burst must be a positive integer")
+		}
+	}
+	return rateLimit{RPS: rps, Burst: burst}, nil
+}
+
+// allow reports whether a merchant may make another request from clientIP,
+// and if not, how long it should wait before retrying. The client only
+// counts with RATE_LIMIT_KEY=merchant_ip; the merchant's limit applies to
+// each of its clients then. With Redis the buckets are shared by every
+// replica, and while Redis fails each replica uses its own.
+func (l *rateLimiter) allow(merchantID, clientIP string) (bool, time.Duration) {
+	key := merchantID
+	if rateLimitPerClient && clientIP != "" {
+		key = merchantID + "|" + clientIP
+	}
+	if client := sharedRedis.Load(); client != nil {
+		if allowed, wait, ok := l.allowShared(client, merchantID, key); ok {
+			return allowed, wait
+		}
+	}
+	l.mu.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		limit := l.limitFor(merchantID)
+		if limit.RPS == 0 {
+			l.mu.Unlock()
+			return true, 0
+		}
+		now := time.Now()
+		if len(l.buckets) >= maxRateLimitBuckets && now.Sub(l.lastEviction) >= rateLimitEvictInterval {
+			l.lastEviction = now
+			l.dropIdleLocked(now)
+		}
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.mu.Unlock()
+			rateLimitUntrackedTotal.Inc()
+			return true, 0
+		}
+		bucket = &tokenBucket{limit: limit, tokens: float64(limit.Burst), lastFill: now}
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+
+	allowed, wait := bucket.take(time.Now())
+	if !allowed {
+		rateLimitedTotal.WithLabelValues(merchantLabel(merchantID)).Inc()
+	}
+	return allowed, wait
+}
+
+// limitFor returns the merchant's override, else the default limit
+func (l *rateLimiter) limitFor(merchantID string) rateLimit {
+	if limit, ok := l.overrides[merchantID]; ok {
+		return limit
+	}
+	return l.defaultLimit
+}
+
+// allowShared takes a token from the bucket in Redis, reporting false when
+// Redis failed
+func (l *rateLimiter) allowShared(client *redis.Client, merchantID, key string) (allowed bool, wait time.Duration, ok bool) {
+	limit := l.limitFor(merchantID)
+	if limit.RPS == 0 {
+		return true, 0, true
+	}
+	scope := l.scope
+	if scope == "" {
+		scope = defaultTenant
+	}
+	allowed, wait, err := takeSharedToken(client, scope+":"+key, limit, time.Now())
+	if err != nil {
+		redisFallback("rate_limit", err)
+		return false, 0, false
+	}
+	if !allowed {
+		rateLimitedTotal.WithLabelValues(merchantLabel(merchantID)).Inc()
+	}
+	return allowed, wait, true
+}
+
+// dropIdleBuckets forgets the buckets that have refilled completely, which
+// behave exactly like new ones, and returns how many it dropped
+func (l *rateLimiter) dropIdleBuckets(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.dropIdleLocked(now)
+}
+
+// dropIdleLocked is dropIdleBuckets for callers holding l.mu
+func (l *rateLimiter) dropIdleLocked(now time.Time) int {
+	dropped := 0
+	for key, bucket := range l.buckets {
+		bucket.mu.Lock()
+		full := bucket.tokens+now.Sub(bucket.lastFill).Seconds()*bucket.limit.RPS >= float64(bucket.limit.Burst)
+		bucket.mu.Unlock()
+		if full {
+			delete(l.buckets, key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// sweepRateLimits drops the idle buckets of the limiter in effect and of
+// each tenant's. The rate_limits job runs it on every replica, since the
+// buckets are in memory.
+func sweepRateLimits(ctx context.Context, now time.Time) error {
+	dropped := 0
+	for _, l := range append(tenants.rateLimiters(), currentRateLimiter()) {
+		if l != nil {
+			dropped += l.dropIdleBuckets(now)
+		}
+	}
+	if dropped > 0 {
+		log.Printf("Dropped %d idle rate limit buckets", dropped)
+	}
+	return nil
+}
+
+// retryAfterSeconds rounds a wait up to the whole seconds Retry-After expects
+func retryAfterSeconds(wait time.Duration) string {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
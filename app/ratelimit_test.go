@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterAllow(t *testing.T) {
+	cases := []struct {
+		name      string
+		limit     rateLimit
+		overrides map[string]rateLimit
+		merchant  string
+		requests  int
+		wantAllow int
+	}{
+		{"within burst", rateLimit{RPS: 1, Burst: 3}, nil, "m1", 3, 3},
+		{"over burst", rateLimit{RPS: 1, Burst: 3}, nil, "m1", 5, 3},
+		{"override", rateLimit{RPS: 1, Burst: 1}, map[string]rateLimit{"m1": {RPS: 1, Burst: 4}}, "m1", 6, 4},
+		{"unlimited default", rateLimit{}, map[string]rateLimit{"m2": {RPS: 1, Burst: 1}}, "m1", 10, 10},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newRateLimiter(tc.limit, tc.overrides)
+			allowed := 0
+			for i := 0; i < tc.requests; i++ {
+				if ok, _ := l.allow(tc.merchant, ""); ok {
+					allowed++
+				}
+			}
+			if allowed != tc.wantAllow {
+				t.Errorf("allowed %d of %d requests, want %d", allowed, tc.requests, tc.wantAllow)
+			}
+		})
+	}
+}
+
+// TestRateLimiterOverflow checks that a new key finding every bucket taken
+// gets one once idle buckets are dropped, and is let through rather than
+// throttled with other new keys when none are idle
+func TestRateLimiterOverflow(t *testing.T) {
+	cases := []struct {
+		name string
+		// fillerRPS is the limit of the buckets filling the limiter; at a
+		// million a second they have refilled by the time the new key comes
+		fillerRPS   float64
+		wantAllow   int
+		wantBuckets int
+	}{
+		{"idle buckets dropped", 1e6, 2, 1},
+		{"no idle buckets", 1, 10, maxRateLimitBuckets},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := newRateLimiter(rateLimit{RPS: tc.fillerRPS, Burst: 2}, map[string]rateLimit{"merchant_new": {RPS: 1, Burst: 2}})
+			for i := 0; i < maxRateLimitBuckets; i++ {
+				l.allow("filler_"+strconv.Itoa(i), "")
+			}
+			if len(l.buckets) != maxRateLimitBuckets {
+				t.Fatalf("got %d buckets, want %d", len(l.buckets), maxRateLimitBuckets)
+			}
+			time.Sleep(time.Millisecond)
+
+			allowed := 0
+			for i := 0; i < 10; i++ {
+				if ok, _ := l.allow("merchant_new", ""); ok {
+					allowed++
+				}
+			}
+			if allowed != tc.wantAllow {
+				t.Errorf("allowed %d of 10 requests from the new key, want %d", allowed, tc.wantAllow)
+			}
+			if len(l.buckets) != tc.wantBuckets {
+				t.Errorf("got %d buckets, want %d", len(l.buckets), tc.wantBuckets)
+			}
+		})
+	}
+}
+
+func TestLoadRateLimiterBurst(t *testing.T) {
+	cases := []struct {
+		rps, burst string
+		wantErr    bool
+	}{
+		{"10", "5", false},
+		{"10", "0", true},
+		{"0", "0", false},
+		{"10", "-1", true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.rps+":"+tc.burst, func(t *testing.T) {
+			t.Setenv("RATE_LIMIT_RPS", tc.rps)
+			t.Setenv("RATE_LIMIT_BURST", tc.burst)
+			if _, err := loadRateLimiter(); (err != nil) != tc.wantErr {
+				t.Errorf("error %v, want error %t", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Readiness states. A degraded replica is still ready: only its
+// non-critical dependencies are failing.
+const (
+	readinessReady    = "ready"
+	readinessDegraded = "degraded"
+	readinessNotReady = "not_ready"
+)
+
+var dependencyUp = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "voyager_dependency_up",
+		Help: "Whether a dependency answered the last readiness probe (1) or not (0)",
+	},
+	[]string{"dependency"},
+)
+
+func init() {
+	prometheus.MustRegister(dependencyUp)
+}
+
+// DependencyStatus is the outcome of probing one dependency
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	Critical  bool    `json:"critical"`
+	LatencyMs float64 `json:"latency_ms"`
+	Detail    string  `json:"detail,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// dependency is something the readiness probe pings
+type dependency struct {
+	name     string
+	detail   string
+	critical bool
+	ping     func(ctx context.Context) error
+}
+
+// getReadinessTimeout returns how long each dependency has to answer
+func getReadinessTimeout() time.Duration {
+	ms, err := strconv.Atoi(getEnv("READINESS_TIMEOUT_MS", "1000"))
+	if err != nil || ms <= 0 {
+		return time.Second
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// getReadinessCritical returns the dependencies named in
+// READINESS_CRITICAL, which fail readiness on top of storage
+func getReadinessCritical() map[string]bool {
+	critical := make(map[string]bool)
+	for _, name := range strings.Split(getEnv("READINESS_CRITICAL", ""), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			critical[name] = true
+		}
+	}
+	return critical
+}
+
+// readinessDependencies lists the configured dependencies. Storage is
+// always critical; the event sink, artifact store, Redis and processors
+// degrade the replica unless READINESS_CRITICAL names them, since events
+// are queued, uploads retried, shared state falls back to local state and
+// routing works around a failing processor.
+func readinessDependencies() []dependency {
+	critical := getReadinessCritical()
+	deps := []dependency{{name: "storage", detail: storage.name(), critical: true, ping: storage.ping}}
+	if eventSink != nil {
+		deps = append(deps, dependency{name: "event_sink", detail: eventSink.sink, ping: eventSink.publisher.Ping})
+	}
+	if artifacts != nil {
+		deps = append(deps, dependency{name: "artifacts", detail: artifacts.describe(), ping: artifacts.store.ping})
+	}
+	if client := sharedRedis.Load(); client != nil {
+		deps = append(deps, dependency{name: "redis", detail: client.Options().Addr, ping: func(ctx context.Context) error {
+			return client.Ping(ctx).Err()
+		}})
+	}
+	for _, p := range processors.all() {
+		deps = append(deps, dependency{name: "processor_" + p.Name(), ping: p.HealthCheck})
+	}
+	for i := range deps {
+		deps[i].critical = deps[i].critical || critical[deps[i].name]
+	}
+	return deps
+}
+
+// probeDependencies pings every dependency at once, each with its own
+// timeout, so one hanging dependency can't stall the probe past it
+func probeDependencies(ctx context.Context, deps []dependency) map[string]DependencyStatus {
+	timeout := getReadinessTimeout()
+	results := make(map[string]DependencyStatus, len(deps))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, dep := range deps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pingCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			start := time.Now()
+			err := dep.ping(pingCtx)
+			status := DependencyStatus{
+				Status:    "ok",
+				Critical:  dep.critical,
+				LatencyMs: math.Round(float64(time.Since(start).Microseconds())/10) / 100,
+				Detail:    dep.detail,
+			}
+			up := 1.0
+			if err != nil {
+				status.Status = "unavailable"
+				status.Error = err.Error()
+				up = 0
+			}
+			dependencyUp.WithLabelValues(dep.name).Set(up)
+
+			mu.Lock()
+			results[dep.name] = status
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+	return results
+}
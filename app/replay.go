@@ -0,0 +1,481 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Replay limits
+const (
+	// maxReplayBytes caps the uploaded export
+	maxReplayBytes = 64 << 20
+	// maxReplaySpeed is the most a replay can be accelerated
+	maxReplaySpeed = 1000
+	// replayMaxInFlight is how many replayed authorizations may await a
+	// result; further ones wait, so a replay falls behind rather than
+	// piling up
+	replayMaxInFlight = 1000
+	// defaultReplayCardToken is used for every replayed transaction, since
+	// exports carry no card
+	defaultReplayCardToken = "4111111111111111"
+)
+
+// Replay outcome modes
+const (
+	// replaySimulated lets the current simulation decide each outcome
+	replaySimulated = "simulated"
+	// replayRecorded pins each transaction to its recorded processor and
+	// outcome
+	replayRecorded = "recorded"
+)
+
+var replayRequestsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_replay_requests_total",
+		Help: "Total number of authorizations re-executed by POST /admin/replay, by outcome",
+	},
+	[]string{"outcome"},
+)
+
+func init() {
+	prometheus.MustRegister(replayRequestsTotal)
+}
+
+// replayItem is one exported transaction to re-execute
+type replayItem struct {
+	at          time.Time
+	merchantID  string
+	amountMinor int64
+	currency    string
+	// processor and declineReason are as recorded, and outcome is the
+	// recorded authorization status: approved for a transaction since
+	// captured, refunded or expired
+	processor     string
+	outcome       string
+	declineReason string
+}
+
+// parseReplay reads a GET /transactions/export file, oldest first
+func parseReplay(format string, data []byte) ([]replayItem, []FieldViolation) {
+	var items []replayItem
+	var violations []FieldViolation
+	add := func(line int, txn Transaction) {
+		at, err := time.Parse(time.RFC3339, txn.CreatedAt)
+		switch {
+		case err != nil:
+			violations = append(violations, FieldViolation{fmt.Sprintf("line %d: created_at", line), "must be an RFC 3339 timestamp"})
+		case txn.MerchantID == "":
+			violations = append(violations, FieldViolation{fmt.Sprintf("line %d: merchant_id", line), "is required"})
+		case txn.AmountMinor <= 0:
+			violations = append(violations, FieldViolation{fmt.Sprintf("line %d: amount_minor", line), "must be positive"})
+		default:
+			outcome := txn.Status
+			switch outcome {
+			case statusPartiallyCaptured, statusCaptured, statusPartiallyRefunded, statusRefunded, statusExpired:
+				outcome = "approved"
+			}
+			items = append(items, replayItem{
+				at: at, merchantID: txn.MerchantID, amountMinor: txn.AmountMinor, currency: txn.Currency,
+				processor: txn.Processor, outcome: outcome, declineReason: txn.DeclineReason,
+			})
+		}
+	}
+
+	if format == "csv" {
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, []FieldViolation{{"body", "must be a CSV export: " + err.Error()}}
+		}
+		if len(rows) == 0 {
+			return nil, []FieldViolation{{"body", "must have a header row"}}
+		}
+		column := make(map[string]int, len(rows[0]))
+		for i, name := range rows[0] {
+			column[name] = i
+		}
+		for _, required := range []string{"merchant_id", "amount_minor", "currency", "created_at"} {
+			if _, ok := column[required]; !ok {
+				violations = append(violations, FieldViolation{"body", fmt.Sprintf("is missing the %s column", required)})
+			}
+		}
+		if len(violations) > 0 {
+			return nil, violations
+		}
+		field := func(row []string, name string) string {
+			if i, ok := column[name]; ok && i < len(row) {
+				return row[i]
+			}
+			return ""
+		}
+		for i, row := range rows[1:] {
+			amountMinor, _ := strconv.ParseInt(field(row, "amount_minor"), 10, 64)
+			add(i+2, Transaction{
+				MerchantID: field(row, "merchant_id"), AmountMinor: amountMinor, Currency: field(row, "currency"),
+				Processor: field(row, "processor"), Status: field(row, "status"),
+				DeclineReason: field(row, "decline_reason"), CreatedAt: field(row, "created_at"),
+			})
+		}
+	} else {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		scanner.Buffer(make([]byte, 64*1024), 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var txn Transaction
+			if err := json.Unmarshal(scanner.Bytes(), &txn); err != nil {
+				violations = append(violations, FieldViolation{fmt.Sprintf("line %d", line), "must be a JSON transaction"})
+				continue
+			}
+			add(line, txn)
+		}
+		if err := scanner.Err(); err != nil {
+			violations = append(violations, FieldViolation{"body", "must be an NDJSON export: " + err.Error()})
+		}
+	}
+	if len(violations) > 0 {
+		return nil, violations
+	}
+	if len(items) == 0 {
+		return nil, []FieldViolation{{"body", "must contain at least one transaction"}}
+	}
+	// Exports are newest first
+	sort.SliceStable(items, func(i, j int) bool { return items[i].at.Before(items[j].at) })
+	return items, nil
+}
+
+// recordedOutcome is the processor answer a recorded transaction got, nil
+// for ones that never reached a processor's decision
+func (item replayItem) recordedOutcome() *ProcessorResult {
+	switch item.outcome {
+	case "approved":
+		return &ProcessorResult{Approved: true, AuthCode: "AUTHREPLAY"}
+	case "declined":
+		if item.declineReason != "" {
+			return &ProcessorResult{DeclineReason: item.declineReason}
+		}
+	}
+	return nil
+}
+
+// ReplayStatus is the running or last replay
+type ReplayStatus struct {
+	Running bool   `json:"running"`
+	Format  string `json:"format,omitempty"`
+	// Speed is how much faster than recorded the replay runs; 0 sends
+	// every transaction as fast as the gateway takes them
+	Speed    float64 `json:"speed"`
+	Outcomes string  `json:"outcomes,omitempty"`
+	// RecordedSeconds is the time the transactions originally spanned
+	RecordedSeconds float64 `json:"recorded_seconds"`
+	StartedAt       string  `json:"started_at,omitempty"`
+	ElapsedSeconds  float64 `json:"elapsed_seconds"`
+	Total           int     `json:"total"`
+	Sent            int64   `json:"sent"`
+	Completed       int64   `json:"completed"`
+	InFlight        int64   `json:"in_flight"`
+	Approved        int64   `json:"approved"`
+	Declined        int64   `json:"declined"`
+	RequiresAction  int64   `json:"requires_action"`
+	Rejected        int64   `json:"rejected"`
+	// Matched is how many completed with the status they were recorded
+	// with
+	Matched    int64            `json:"matched"`
+	Rejections map[string]int64 `json:"rejections,omitempty"`
+}
+
+// replayRun is one replay of an export
+type replayRun struct {
+	items     []replayItem
+	format    string
+	speed     float64
+	outcomes  string
+	cardToken string
+	startedAt time.Time
+	stop      chan struct{}
+	slots     chan struct{}
+
+	sent      atomic.Int64
+	completed atomic.Int64
+
+	mu             sync.Mutex
+	endedAt        time.Time
+	approved       int64
+	declined       int64
+	requiresAction int64
+	matched        int64
+	rejections     map[string]int64
+}
+
+// replayer runs at most one replay at a time and keeps the last one for
+// its stats
+type replayer struct {
+	mu  sync.Mutex
+	run *replayRun
+}
+
+var replays = &replayer{}
+
+// start replaces any running replay with one of items
+func (p *replayer) start(run *replayRun) ReplayStatus {
+	p.mu.Lock()
+	if p.run != nil {
+		p.run.end()
+	}
+	p.run = run
+	p.mu.Unlock()
+
+	go run.drive()
+	log.Printf("Replay started: %d transactions, speed %g, %s outcomes", len(run.items), run.speed, run.outcomes)
+	return run.status()
+}
+
+// halt stops the running replay, reporting false if none is running
+func (p *replayer) halt() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.run == nil || !p.run.end() {
+		return false
+	}
+	log.Printf("Replay stopped after %d of %d transactions", p.run.sent.Load(), len(p.run.items))
+	return true
+}
+
+func (p *replayer) status() ReplayStatus {
+	p.mu.Lock()
+	run := p.run
+	p.mu.Unlock()
+	if run == nil {
+		return ReplayStatus{}
+	}
+	return run.status()
+}
+
+// end stops sending, reporting false if the replay had already ended
+func (run *replayRun) end() bool {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	if !run.endedAt.IsZero() {
+		return false
+	}
+	run.endedAt = time.Now()
+	close(run.stop)
+	return true
+}
+
+// drive sends each transaction once its recorded offset from the first,
+// divided by speed, has passed
+func (run *replayRun) drive() {
+	first := run.items[0].at
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for _, item := range run.items {
+		if run.speed > 0 {
+			due := run.startedAt.Add(time.Duration(float64(item.at.Sub(first)) / run.speed))
+			if wait := time.Until(due); wait > 0 {
+				timer.Reset(wait)
+				select {
+				case <-run.stop:
+					return
+				case <-timer.C:
+				}
+			}
+		}
+		select {
+		case <-run.stop:
+			return
+		case run.slots <- struct{}{}:
+		}
+		run.send(item)
+	}
+	if run.end() {
+		log.Printf("Replay finished: %d transactions in %s", len(run.items), time.Since(run.startedAt).Round(time.Millisecond))
+	}
+}
+
+// send re-executes one transaction through the same path as POST
+// /authorize, under a new transaction ID
+func (run *replayRun) send(item replayItem) {
+	minor := item.amountMinor
+	req := AuthorizationRequest{
+		MerchantID:  item.merchantID,
+		AmountMinor: &minor,
+		Currency:    item.currency,
+		CardToken:   run.cardToken,
+		origin:      auditOrigin{actor: actorReplay},
+	}
+	if run.outcomes == replayRecorded {
+		if _, ok := processors.get(item.processor); ok {
+			req.processor = item.processor
+		}
+		req.forced = item.recordedOutcome()
+	}
+	run.sent.Add(1)
+	go authorizeDeferred(req, time.Now(), func(response AuthorizationResponse, rejection *authorizationRejection) {
+		<-run.slots
+		run.record(item, response, rejection)
+	})
+}
+
+// record counts a completed replayed authorization
+func (run *replayRun) record(item replayItem, response AuthorizationResponse, rejection *authorizationRejection) {
+	outcome := "rejected"
+	if rejection == nil {
+		outcome = response.Status
+	}
+	replayRequestsTotal.WithLabelValues(outcome).Inc()
+
+	run.mu.Lock()
+	defer run.mu.Unlock()
+	switch outcome {
+	case "approved":
+		run.approved++
+	case "requires_action":
+		run.requiresAction++
+	case "rejected":
+		run.rejections[rejection.Code]++
+	default:
+		run.declined++
+	}
+	if outcome == item.outcome {
+		run.matched++
+	}
+	run.completed.Add(1)
+}
+
+func (run *replayRun) status() ReplayStatus {
+	run.mu.Lock()
+	defer run.mu.Unlock()
+
+	end := time.Now()
+	if !run.endedAt.IsZero() {
+		end = run.endedAt
+	}
+	s := ReplayStatus{
+		Running:         run.endedAt.IsZero(),
+		Format:          run.format,
+		Speed:           run.speed,
+		Outcomes:        run.outcomes,
+		RecordedSeconds: run.items[len(run.items)-1].at.Sub(run.items[0].at).Seconds(),
+		StartedAt:       run.startedAt.UTC().Format(time.RFC3339),
+		ElapsedSeconds:  math.Round(end.Sub(run.startedAt).Seconds()*10) / 10,
+		Total:           len(run.items),
+		Sent:            run.sent.Load(),
+		Completed:       run.completed.Load(),
+		Approved:        run.approved,
+		Declined:        run.declined,
+		RequiresAction:  run.requiresAction,
+		Matched:         run.matched,
+		Rejections:      make(map[string]int64, len(run.rejections)),
+	}
+	s.InFlight = s.Sent - s.Completed
+	for code, n := range run.rejections {
+		s.Rejections[code] = n
+		s.Rejected += n
+	}
+	return s
+}
+
+// handleReplayStart re-executes an uploaded GET /transactions/export file,
+// replacing any replay in progress (POST /admin/replay). The format comes
+// from ?format= or the Content-Type; ?speed= paces the transactions at
+// their recorded timing (1) or faster, and without it they are sent as fast
+// as the gateway takes them. ?outcomes=recorded pins each one to its
+// recorded processor and outcome.
+func handleReplayStart(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var violations []FieldViolation
+	format := query.Get("format")
+	if format == "" {
+		format = "ndjson"
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = "csv"
+		}
+	}
+	if format != "csv" && format != "ndjson" {
+		violations = append(violations, FieldViolation{"format", "must be csv or ndjson"})
+	}
+	var speed float64
+	if s := query.Get("speed"); s != "" {
+		var err error
+		if speed, err = strconv.ParseFloat(s, 64); err != nil || speed <= 0 || speed > maxReplaySpeed {
+			violations = append(violations, FieldViolation{"speed", fmt.Sprintf("must be between 0 (exclusive) and %d", maxReplaySpeed)})
+		}
+	}
+	outcomes := query.Get("outcomes")
+	if outcomes == "" {
+		outcomes = replaySimulated
+	}
+	if outcomes != replaySimulated && outcomes != replayRecorded {
+		violations = append(violations, FieldViolation{"outcomes", "must be simulated or recorded"})
+	}
+	cardToken := query.Get("card_token")
+	if cardToken == "" {
+		cardToken = defaultReplayCardToken
+	}
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxReplayBytes+1))
+	if err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "could not be read"}})
+		return
+	}
+	if len(data) > maxReplayBytes {
+		writeValidationError(w, r, []FieldViolation{{"body", fmt.Sprintf("must be at most %d bytes", maxReplayBytes)}})
+		return
+	}
+	items, violations := parseReplay(format, data)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+
+	status := replays.start(&replayRun{
+		items:      items,
+		format:     format,
+		speed:      speed,
+		outcomes:   outcomes,
+		cardToken:  cardToken,
+		startedAt:  time.Now(),
+		stop:       make(chan struct{}),
+		slots:      make(chan struct{}, replayMaxInFlight),
+		rejections: make(map[string]int64),
+	})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+// handleReplayStatus reports the running or last replay
+// (GET /admin/replay/status)
+func handleReplayStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(replays.status())
+}
+
+// handleReplayStop stops the running replay (DELETE /admin/replay)
+func handleReplayStop(w http.ResponseWriter, r *http.Request) {
+	if !replays.halt() {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "No replay is running", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Errors returned by repositories. Handlers map them to responses, so
+// implementations must return these rather than driver errors.
+var (
+	errRecordNotFound  = errors.New("not found")
+	errDuplicateRecord = errors.New("already exists")
+	errStatusConflict  = errors.New("status changed concurrently")
+)
+
+// statusProcessing marks a transaction created but not yet decided by a
+// processor
+const statusProcessing = "processing"
+
+// TransactionRepository is the only way handlers read and write
+// transactions. New backends implement it; tests can substitute a fake.
+type TransactionRepository interface {
+	// Create stores a new transaction, or returns errDuplicateRecord if the
+	// ID is taken
+	Create(ctx context.Context, txn Transaction) error
+	// Get returns errRecordNotFound for unknown IDs
+	Get(ctx context.Context, id string) (Transaction, error)
+	// List returns transactions matching filter, newest first
+	List(ctx context.Context, filter TransactionFilter) ([]Transaction, error)
+	// UpdateStatus replaces the stored transaction's status and outcome
+	// fields with txn's, provided its status is still one of from.
+	// Otherwise it returns errStatusConflict, or errRecordNotFound.
+	UpdateStatus(ctx context.Context, txn Transaction, from ...string) error
+}
+
+// TransactionFilter narrows a List. Zero values match everything.
+type TransactionFilter struct {
+	MerchantID string
+	Status     string
+	// CreatedFrom and CreatedTo bound created_at, inclusive
+	CreatedFrom time.Time
+	CreatedTo   time.Time
+	// StartingAfter is the ID of the last transaction of the previous page
+	StartingAfter string
+	Limit         int
+}
+
+// matches reports whether txn passes the filter's field conditions;
+// pagination is applied separately
+func (f TransactionFilter) matches(txn Transaction) bool {
+	if f.MerchantID != "" && txn.MerchantID != f.MerchantID {
+		return false
+	}
+	if f.Status != "" && txn.Status != f.Status {
+		return false
+	}
+	if !f.CreatedFrom.IsZero() && txn.CreatedAt < formatTimestamp(f.CreatedFrom) {
+		return false
+	}
+	if !f.CreatedTo.IsZero() && txn.CreatedAt > formatTimestamp(f.CreatedTo) {
+		return false
+	}
+	return true
+}
+
+// formatTimestamp is the stored form of every timestamp. Being fixed width
+// in UTC, it sorts chronologically as a string. The form only changes once
+// a second, so the last one formatted is reused.
+func formatTimestamp(t time.Time) string {
+	t = t.UTC()
+	if last := lastTimestamp.Load(); last != nil && last.unix == t.Unix() {
+		return last.text
+	}
+	text := t.Format(time.RFC3339)
+	lastTimestamp.Store(&formattedTimestamp{unix: t.Unix(), text: text})
+	return text
+}
+
+type formattedTimestamp struct {
+	unix int64
+	text string
+}
+
+var lastTimestamp atomic.Pointer[formattedTimestamp]
+
+// newestFirst orders transactions by created_at then ID, both descending,
+// which is the order List pages through
+func newestFirst(txns []Transaction) {
+	sort.Slice(txns, func(i, j int) bool {
+		if txns[i].CreatedAt != txns[j].CreatedAt {
+			return txns[i].CreatedAt > txns[j].CreatedAt
+		}
+		return txns[i].TransactionID > txns[j].TransactionID
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var retentionPurgedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_retention_purged_total",
+		Help: "Total number of records deleted by retention by record (transaction, refund, dispute, subscription, payout, audit_entry or idempotency_key) and reason (age or count for transactions, transaction for the refunds and disputes deleted with theirs, limits for the rest past either limit, expired for idempotency keys)",
+	},
+	[]string{"record", "reason"},
+)
+
+func init() {
+	prometheus.MustRegister(retentionPurgedTotal)
+}
+
+// RetentionPolicy bounds the transactions kept in memory, and the closed
+// subscriptions and payouts and audit entries with them. Zero fields
+// don't limit anything.
+type RetentionPolicy struct {
+	// OlderThanHours purges transactions created longer ago
+	OlderThanHours int `json:"older_than_hours,omitempty"`
+	// Keep purges all but each store's newest Keep transactions
+	Keep int `json:"keep,omitempty"`
+}
+
+// transactionRetention is the policy the retention job enforces
+var transactionRetention RetentionPolicy
+
+// loadRetentionPolicy reads TRANSACTION_RETENTION_HOURS and
+// TRANSACTION_RETENTION_MAX, both 0 (keep everything) by default
+func loadRetentionPolicy() (RetentionPolicy, error) {
+	var policy RetentionPolicy
+	for _, setting := range []struct {
+		env  string
+		dest *int
+	}{
+		{"TRANSACTION_RETENTION_HOURS", &policy.OlderThanHours},
+		{"TRANSACTION_RETENTION_MAX", &policy.Keep},
+	} {
+		n, err := strconv.Atoi(getEnv(setting.env, "0"))
+		if err != nil || n < 0 {
+			return policy, fmt.Errorf("invalid %s, expected a number of at least 0", setting.env)
+		}
+		*setting.dest = n
+	}
+	return policy, nil
+}
+
+func (p RetentionPolicy) describe() string {
+	switch {
+	case p.OlderThanHours > 0 && p.Keep > 0:
+		return fmt.Sprintf("transactions older than %dh or beyond the newest %d", p.OlderThanHours, p.Keep)
+	case p.OlderThanHours > 0:
+		return fmt.Sprintf("transactions older than %dh", p.OlderThanHours)
+	case p.Keep > 0:
+		return fmt.Sprintf("transactions beyond the newest %d", p.Keep)
+	}
+	return "no transactions"
+}
+
+// PurgeResult counts the records a purge deleted
+type PurgeResult struct {
+	TransactionsByAge   int   `json:"transactions_by_age"`
+	TransactionsByCount int   `json:"transactions_by_count"`
+	Refunds             int   `json:"refunds"`
+	Disputes            int   `json:"disputes"`
+	Subscriptions       int   `json:"subscriptions"`
+	Payouts             int   `json:"payouts"`
+	AuditEntries        int   `json:"audit_entries"`
+	IdempotencyKeys     int64 `json:"idempotency_keys"`
+}
+
+// purge applies policy to the in-memory stores, the tenants' and the
+// default one unless STORAGE_BACKEND is a database, which is sized by
+// whoever runs it. Expired idempotency keys are purged from every store.
+func purge(ctx context.Context, now time.Time, policy RetentionPolicy) (PurgeResult, error) {
+	var result PurgeResult
+	var cutoff time.Time
+	if policy.OlderThanHours > 0 {
+		cutoff = now.Add(-time.Duration(policy.OlderThanHours) * time.Hour)
+	}
+	if !cutoff.IsZero() || policy.Keep > 0 {
+		stores := tenants.stores()
+		if _, ok := storage.(*memoryStore); ok {
+			stores = append(stores, storage)
+		}
+		for _, store := range stores {
+			byAge, byCount, refunds, disputes := store.(*memoryStore).purgeTransactions(cutoff, policy.Keep)
+			result.TransactionsByAge += byAge
+			result.TransactionsByCount += byCount
+			result.Refunds += refunds
+			result.Disputes += disputes
+			subscriptions, payouts, audit := store.(*memoryStore).purgeRecords(cutoff, policy.Keep)
+			result.Subscriptions += subscriptions
+			result.Payouts += payouts
+			result.AuditEntries += audit
+		}
+	}
+	retentionPurgedTotal.WithLabelValues("transaction", "age").Add(float64(result.TransactionsByAge))
+	retentionPurgedTotal.WithLabelValues("transaction", "count").Add(float64(result.TransactionsByCount))
+	retentionPurgedTotal.WithLabelValues("refund", "transaction").Add(float64(result.Refunds))
+	retentionPurgedTotal.WithLabelValues("dispute", "transaction").Add(float64(result.Disputes))
+	retentionPurgedTotal.WithLabelValues("subscription", "limits").Add(float64(result.Subscriptions))
+	retentionPurgedTotal.WithLabelValues("payout", "limits").Add(float64(result.Payouts))
+	retentionPurgedTotal.WithLabelValues("audit_entry", "limits").Add(float64(result.AuditEntries))
+
+	keys, err := purgeIdempotencyRecords(ctx, now)
+	result.IdempotencyKeys = keys
+	retentionPurgedTotal.WithLabelValues("idempotency_key", "expired").Add(float64(keys))
+	return result, err
+}
+
+// enforceRetention purges what transactionRetention no longer keeps. The
+// retention job runs it.
+func enforceRetention(ctx context.Context, now time.Time) error {
+	result, err := purge(ctx, now, transactionRetention)
+	result.log("Retention")
+	return err
+}
+
+func (r PurgeResult) log(prefix string) {
+	if r.TransactionsByAge+r.TransactionsByCount+r.Subscriptions+r.Payouts+r.AuditEntries+int(r.IdempotencyKeys) == 0 {
+		return
+	}
+	log.Printf("%s: purged %d transactions by age, %d by count, %d refunds, %d disputes, %d subscriptions, %d payouts, %d audit entries and %d expired idempotency keys",
+		prefix, r.TransactionsByAge, r.TransactionsByCount, r.Refunds, r.Disputes, r.Subscriptions, r.Payouts, r.AuditEntries, r.IdempotencyKeys)
+}
+
+// handlePurge purges now (POST /admin/purge). The optional body's fields
+// replace those of the configured policy.
+func handlePurge(w http.ResponseWriter, r *http.Request) {
+	var req RetentionPolicy
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON retention policy"}})
+		return
+	}
+	var violations []FieldViolation
+	if req.OlderThanHours < 0 {
+		violations = append(violations, FieldViolation{"older_than_hours", "must be at least 0"})
+	}
+	if req.Keep < 0 {
+		violations = append(violations, FieldViolation{"keep", "must be at least 0"})
+	}
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	policy := transactionRetention
+	if req.OlderThanHours > 0 {
+		policy.OlderThanHours = req.OlderThanHours
+	}
+	if req.Keep > 0 {
+		policy.Keep = req.Keep
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	result, err := purge(ctx, time.Now(), policy)
+	result.log("Purge via admin API")
+	if err != nil {
+		log.Printf("Purge failed: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditDataPurged, ResourceType: "store", ResourceID: storage.name()})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
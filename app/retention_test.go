@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// TestPurgeByAge checks that the age limit reaches the records kept
+// alongside transactions, and spares those still live
+func TestPurgeByAge(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore()
+	now := time.Now()
+	old, recent := formatTimestamp(now.Add(-48*time.Hour)), formatTimestamp(now)
+
+	for _, txn := range []Transaction{
+		{TransactionID: "txn_decided", Status: statusCaptured, CreatedAt: old},
+		{TransactionID: "txn_disputed", Status: statusCaptured, CreatedAt: old},
+	} {
+		if err := s.Create(ctx, txn); err != nil {
+			t.Fatal(err)
+		}
+		s.settledIn[txn.TransactionID] = "stl_1"
+	}
+	for _, d := range []Dispute{
+		{DisputeID: "dp_lost", TransactionID: "txn_decided", Status: disputeLost, CreatedAt: old},
+		{DisputeID: "dp_open", TransactionID: "txn_disputed", Status: disputeOpened, CreatedAt: old},
+	} {
+		if err := s.createDispute(ctx, d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, sub := range []Subscription{
+		{SubscriptionID: "sub_canceled_old", Status: subscriptionCanceled, UpdatedAt: old},
+		{SubscriptionID: "sub_active_old", Status: subscriptionActive, UpdatedAt: old},
+		{SubscriptionID: "sub_canceled_recent", Status: subscriptionCanceled, UpdatedAt: recent},
+	} {
+		if err := s.createSubscription(ctx, sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, p := range []Payout{
+		{PayoutID: "po_paid_old", Status: payoutPaid, UpdatedAt: old},
+		{PayoutID: "po_pending_old", Status: payoutPending, UpdatedAt: old},
+		{PayoutID: "po_failed_recent", Status: payoutFailed, UpdatedAt: recent},
+	} {
+		if err := s.createPayout(ctx, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, e := range []AuditEntry{{AuditID: "aud_old", CreatedAt: old}, {AuditID: "aud_recent", CreatedAt: recent}} {
+		if err := s.createAuditEntry(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.ledger = append(s.ledger, LedgerEntry{EntryID: "le_old", CreatedAt: old})
+
+	cutoff := now.Add(-24 * time.Hour)
+	if byAge, _, _, disputes := s.purgeTransactions(cutoff, 0); byAge != 1 || disputes != 1 {
+		t.Errorf("purged %d transactions and %d disputes, want 1 and 1", byAge, disputes)
+	}
+	if subscriptions, payouts, audit := s.purgeRecords(cutoff, 0); subscriptions != 1 || payouts != 1 || audit != 1 {
+		t.Errorf("purged %d subscriptions, %d payouts and %d audit entries, want 1 of each", subscriptions, payouts, audit)
+	}
+
+	if _, ok := s.transactions["txn_disputed"]; !ok {
+		t.Error("purged a transaction with an undecided dispute")
+	}
+	if _, ok := s.disputesByID["dp_open"]; !ok {
+		t.Error("purged an undecided dispute")
+	}
+	if _, ok := s.disputesByID["dp_lost"]; ok {
+		t.Error("kept the dispute of a purged transaction")
+	}
+	for _, id := range []string{"sub_active_old", "sub_canceled_recent"} {
+		if _, ok := s.subscriptionsByID[id]; !ok {
+			t.Errorf("purged %s", id)
+		}
+	}
+	for _, id := range []string{"po_pending_old", "po_failed_recent"} {
+		if _, ok := s.payoutsByID[id]; !ok {
+			t.Errorf("purged %s", id)
+		}
+	}
+	if len(s.audit) != 1 || s.audit[0].AuditID != "aud_recent" {
+		t.Errorf("audit trail %v, want only aud_recent", s.audit)
+	}
+	if len(s.ledger) != 1 {
+		t.Errorf("%d ledger entries, want the 1 kept", len(s.ledger))
+	}
+}
+
+// TestPurgeByCount checks that the count limit keeps the newest closed
+// records and audit entries
+func TestPurgeByCount(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryStore()
+	now := time.Now()
+	for i, id := range []string{"sub_1", "sub_2", "sub_3"} {
+		at := formatTimestamp(now.Add(time.Duration(i) * time.Minute))
+		if err := s.createSubscription(ctx, Subscription{SubscriptionID: id, Status: subscriptionCanceled, UpdatedAt: at}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.createAuditEntry(ctx, AuditEntry{AuditID: "aud_" + id, CreatedAt: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if subscriptions, _, audit := s.purgeRecords(time.Time{}, 2); subscriptions != 1 || audit != 1 {
+		t.Errorf("purged %d subscriptions and %d audit entries, want 1 and 1", subscriptions, audit)
+	}
+	if _, ok := s.subscriptionsByID["sub_1"]; ok {
+		t.Error("kept the oldest subscription")
+	}
+	if len(s.audit) != 2 || s.audit[0].AuditID != "aud_sub_2" {
+		t.Errorf("audit trail %v, want the newest 2", s.audit)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Risk decisions, from least to most severe
+const (
+	riskApprove   = "approve"
+	riskReview    = "review"
+	riskChallenge = "challenge"
+	riskDecline   = "decline"
+)
+
+var riskSeverity = map[string]int{riskApprove: 0, riskReview: 1, riskChallenge: 2, riskDecline: 3}
+
+var (
+	riskDecisionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_risk_decisions_total",
+			Help: "Total number of authorizations scored by the risk engine by decision",
+		},
+		[]string{"decision"},
+	)
+
+	riskRulesMatchedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_risk_rules_matched_total",
+			Help: "Total number of authorizations each risk rule matched",
+		},
+		[]string{"rule"},
+	)
+
+	riskScore = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "voyager_risk_score",
+			Help:    "Risk scores computed by the risk engine",
+			Buckets: prometheus.LinearBuckets(10, 10, 10),
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(riskDecisionsTotal)
+	prometheus.MustRegister(riskRulesMatchedTotal)
+	prometheus.MustRegister(riskScore)
+}
+
+var (
+	countryPattern   = regexp.MustCompile(`^[A-Z]{2}$`)
+	binPrefixPattern = regexp.MustCompile(`^[0-9]{1,8}$`)
+)
+
+// RiskConfig is the risk section of the config file. Each authorization's
+// risk_score is the sum of the scores of the rules it matches, capped at
+// 100; the thresholds turn the score into a decision.
+type RiskConfig struct {
+	// Thresholds are inclusive; unset ones never trigger
+	ReviewThreshold    *int       `yaml:"review_threshold" json:"review_threshold,omitempty"`
+	ChallengeThreshold *int       `yaml:"challenge_threshold" json:"challenge_threshold,omitempty"`
+	DeclineThreshold   *int       `yaml:"decline_threshold" json:"decline_threshold,omitempty"`
+	Rules              []RiskRule `yaml:"rules" json:"rules"`
+}
+
+// RiskRule adds Score to authorizations matching every condition it sets
+type RiskRule struct {
+	Name  string `yaml:"name" json:"name"`
+	Score int    `yaml:"score" json:"score"`
+	// Above and Below match amounts strictly greater or smaller, in the
+	// authorization currency
+	Above      *float64 `yaml:"above" json:"above,omitempty"`
+	Below      *float64 `yaml:"below" json:"below,omitempty"`
+	Currencies []string `yaml:"currencies" json:"currencies,omitempty"`
+	Merchants  []string `yaml:"merchants" json:"merchants,omitempty"`
+	// Countries match the request's country, else the card's issuer
+	// country
+	Countries []string `yaml:"countries" json:"countries,omitempty"`
+	// BINPrefixes match the leading digits of the card token
+	BINPrefixes []string `yaml:"bin_prefixes" json:"bin_prefixes,omitempty"`
+	// HoursUTC matches authorizations made in the window
+	HoursUTC *HourRange `yaml:"hours_utc" json:"hours_utc,omitempty"`
+	// AVSResults and CVVResults match the simulated card verification
+	// results; an authorization without the check matches neither
+	AVSResults []string `yaml:"avs_results" json:"avs_results,omitempty"`
+	CVVResults []string `yaml:"cvv_results" json:"cvv_results,omitempty"`
+	// Action, if set, forces at least this decision whatever the score
+	Action string `yaml:"action" json:"action,omitempty"`
+}
+
+// HourRange is a window of UTC hours, From inclusive and To exclusive. It
+// wraps around midnight when From is greater than To, e.g. 22 to 6.
+type HourRange struct {
+	From int `yaml:"from" json:"from"`
+	To   int `yaml:"to" json:"to"`
+}
+
+func (h HourRange) contains(hour int) bool {
+	if h.From <= h.To {
+		return hour >= h.From && hour < h.To
+	}
+	return hour >= h.From || hour < h.To
+}
+
+type riskThreshold struct {
+	decision string
+	field    string
+	value    *int
+}
+
+func (c *RiskConfig) thresholds() []riskThreshold {
+	return []riskThreshold{
+		{riskReview, "review_threshold", c.ReviewThreshold},
+		{riskChallenge, "challenge_threshold", c.ChallengeThreshold},
+		{riskDecline, "decline_threshold", c.DeclineThreshold},
+	}
+}
+
+// riskAssessment is the risk engine's verdict on one authorization
+type riskAssessment struct {
+	Score    int
+	Decision string
+	Rules    []string
+}
+
+func (r RiskRule) matches(req AuthorizationRequest, hour int) bool {
+	if r.Above != nil && req.Amount <= *r.Above {
+		return false
+	}
+	if r.Below != nil && req.Amount >= *r.Below {
+		return false
+	}
+	if len(r.Currencies) > 0 && !slices.Contains(r.Currencies, req.Currency) {
+		return false
+	}
+	if len(r.Merchants) > 0 && !slices.Contains(r.Merchants, req.MerchantID) {
+		return false
+	}
+	if len(r.Countries) > 0 && !slices.Contains(r.Countries, req.country()) {
+		return false
+	}
+	if len(r.BINPrefixes) > 0 {
+		bin := tokenBIN(req.CardToken)
+		matched := false
+		for _, prefix := range r.BINPrefixes {
+			matched = matched || strings.HasPrefix(bin, prefix)
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.HoursUTC != nil && !r.HoursUTC.contains(hour) {
+		return false
+	}
+	if len(r.AVSResults) > 0 && !slices.Contains(r.AVSResults, req.avsResult) {
+		return false
+	}
+	if len(r.CVVResults) > 0 && !slices.Contains(r.CVVResults, req.cvvResult) {
+		return false
+	}
+	return true
+}
+
+// assessRisk scores req against the configured rules. It returns nil when
+// the risk engine isn't configured.
+func assessRisk(req AuthorizationRequest, now time.Time) *riskAssessment {
+	cfg := currentConfig().Risk
+	if cfg == nil {
+		return nil
+	}
+	assessment := &riskAssessment{Decision: riskApprove}
+	hour := now.UTC().Hour()
+	for _, rule := range cfg.Rules {
+		if !rule.matches(req, hour) {
+			continue
+		}
+		riskRulesMatchedTotal.WithLabelValues(rule.Name).Inc()
+		assessment.Score += rule.Score
+		assessment.Rules = append(assessment.Rules, rule.Name)
+		assessment.escalate(rule.Action)
+	}
+	if assessment.Score > 100 {
+		assessment.Score = 100
+	}
+	for _, t := range cfg.thresholds() {
+		if t.value != nil && assessment.Score >= *t.value {
+			assessment.escalate(t.decision)
+		}
+	}
+	riskScore.Observe(float64(assessment.Score))
+	riskDecisionsTotal.WithLabelValues(assessment.Decision).Inc()
+	return assessment
+}
+
+// escalate raises the decision to decision if that is more severe
+func (a *riskAssessment) escalate(decision string) {
+	if riskSeverity[decision] > riskSeverity[a.Decision] {
+		a.Decision = decision
+	}
+}
+
+// setRisk copies the risk assessment into the response
+func (r *AuthorizationResponse) setRisk(a *riskAssessment) {
+	if a == nil {
+		return
+	}
+	score := a.Score
+	r.RiskScore = &score
+	r.RiskDecision = a.Decision
+	r.RiskRules = a.Rules
+}
+
+// validateRisk checks the risk section of the config. Currencies and
+// countries are normalized to upper case.
+func validateRisk(c *RiskConfig) []FieldViolation {
+	if c == nil {
+		return nil
+	}
+	var violations []FieldViolation
+	for _, t := range c.thresholds() {
+		if t.value != nil && (*t.value < 0 || *t.value > 100) {
+			violations = append(violations, FieldViolation{"risk." + t.field, "must be between 0 and 100"})
+		}
+	}
+	seen := make(map[string]bool, len(c.Rules))
+	for i, r := range c.Rules {
+		prefix := fmt.Sprintf("risk.rules[%d]", i)
+		if !testDeclineReasonPattern.MatchString(r.Name) {
+			violations = append(violations, FieldViolation{prefix + ".name", "must be lowercase letters, digits and '_', starting with a letter"})
+		} else if seen[r.Name] {
+			violations = append(violations, FieldViolation{prefix + ".name", "is used by another rule"})
+		}
+		seen[r.Name] = true
+		if r.Score < 0 || r.Score > 100 {
+			violations = append(violations, FieldViolation{prefix + ".score", "must be between 0 and 100"})
+		}
+		if r.Above != nil && *r.Above < 0 {
+			violations = append(violations, FieldViolation{prefix + ".above", "must not be negative"})
+		}
+		if r.Below != nil && *r.Below <= 0 {
+			violations = append(violations, FieldViolation{prefix + ".below", "must be a positive number"})
+		}
+		for j, currency := range r.Currencies {
+			r.Currencies[j] = strings.ToUpper(currency)
+			if !iso4217Currencies[r.Currencies[j]] {
+				violations = append(violations, FieldViolation{prefix + ".currencies", fmt.Sprintf("%q is not a valid ISO 4217 currency code", currency)})
+			}
+		}
+		for j, country := range r.Countries {
+			r.Countries[j] = strings.ToUpper(country)
+			if !countryPattern.MatchString(r.Countries[j]) {
+				violations = append(violations, FieldViolation{prefix + ".countries", fmt.Sprintf("%q is not an ISO 3166 alpha-2 country code", country)})
+			}
+		}
+		for _, bin := range r.BINPrefixes {
+			if !binPrefixPattern.MatchString(bin) {
+				violations = append(violations, FieldViolation{prefix + ".bin_prefixes", fmt.Sprintf("%q must be 1-8 digits", bin)})
+			}
+		}
+		if h := r.HoursUTC; h != nil && (h.From < 0 || h.From > 23 || h.To < 0 || h.To > 23 || h.From == h.To) {
+			violations = append(violations, FieldViolation{prefix + ".hours_utc", "from and to must be different hours between 0 and 23"})
+		}
+		violations = append(violations, validateVerificationCodes(prefix+".avs_results", r.AVSResults, defaultAVSResults)...)
+		violations = append(violations, validateVerificationCodes(prefix+".cvv_results", r.CVVResults, defaultCVVResults)...)
+		if _, ok := riskSeverity[r.Action]; r.Action != "" && (!ok || r.Action == riskApprove) {
+			violations = append(violations, FieldViolation{prefix + ".action", "must be review, challenge or decline"})
+		}
+	}
+	return violations
+}
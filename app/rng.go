@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// lockedSource makes a rand.Source safe for concurrent use so one seeded
+// generator can be shared by every request
+type lockedSource struct {
+	mu  sync.Mutex
+	src rand.Source64
+}
+
+func (s *lockedSource) Int63() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Int63()
+}
+
+func (s *lockedSource) Uint64() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.src.Uint64()
+}
+
+func (s *lockedSource) Seed(seed int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.src.Seed(seed)
+}
+
+// newRNG returns a concurrency-safe generator seeded with seed
+func newRNG(seed int64) *rand.Rand {
+	return rand.New(&lockedSource{src: rand.NewSource(seed).(rand.Source64)})
+}
+
+// rng drives every simulated decision: processor selection, latency jitter,
+// decline reasons and 3DS outcomes. It is seeded once, from
+// DETERMINISTIC_SEED when set, so runs replaying the same request sequence
+// are reproducible, and handed to the simulated processors rather than
+// reseeded.
+var rng = newRNG(startupSeed())
+
+// startupSeed returns DETERMINISTIC_SEED, or the time when it is unset or
+// invalid; main refuses to start on an invalid one
+func startupSeed() int64 {
+	if seed, seeded, err := loadSeed(); err == nil && seeded {
+		return seed
+	}
+	return time.Now().UnixNano()
+}
+
+// loadSeed returns DETERMINISTIC_SEED, if set
+func loadSeed() (int64, bool, error) {
+	raw := os.Getenv("DETERMINISTIC_SEED")
+	if raw == "" {
+		return 0, false, nil
+	}
+	seed, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("invalid DETERMINISTIC_SEED %q: %w", raw, err)
+	}
+	return seed, true, nil
+}
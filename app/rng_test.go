@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+// TestSimulatedProcessorSeeded checks that simulated processors handed
+// generators with the same seed decide the same way
+func TestSimulatedProcessorSeeded(t *testing.T) {
+	useConfig(t, parseTestConfig(t, `failure_rate: 0.5`))
+	a := newSimulatedProcessor("stripe", newRNG(42))
+	b := newSimulatedProcessor("stripe", newRNG(42))
+	req := AuthorizationRequest{MerchantID: "merchant_seeded", Amount: 10, Currency: "USD", CardToken: "tok_visa"}
+	for i := 0; i < 20; i++ {
+		got, errA := a.outcome(req)
+		want, errB := b.outcome(req)
+		if errA != nil || errB != nil {
+			t.Fatalf("outcome %d: %v, %v", i, errA, errB)
+		}
+		if got != want {
+			t.Fatalf("outcome %d: %+v, want %+v from the same seed", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	credentialReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_credential_reloads_total",
+			Help: "Total number of credential reloads by result",
+		},
+		[]string{"result"},
+	)
+
+	retiredCredentialUsesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_retired_credential_uses_total",
+			Help: "Total number of requests authenticated with an API key or signing secret rotated out but still in its grace period, by kind",
+		},
+		[]string{"kind"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(credentialReloadsTotal)
+	prometheus.MustRegister(retiredCredentialUsesTotal)
+}
+
+// retiredCredential is an API key's merchant or a signing secret that was
+// rotated out but keeps working until the grace period ends
+type retiredCredential struct {
+	value string
+	until time.Time
+}
+
+// getCredentialGracePeriod returns how long rotated-out API keys and
+// signing secrets keep working; zero retires them immediately
+func getCredentialGracePeriod() time.Duration {
+	grace, err := parseDelay(getEnv("CREDENTIAL_GRACE_PERIOD", "15m"))
+	if err != nil || grace < 0 {
+		return 15 * time.Minute
+	}
+	return grace
+}
+
+// getCredentialPollInterval returns how often API_KEYS_FILE and
+// SIGNING_SECRETS_FILE are checked for changes
+func getCredentialPollInterval() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("CREDENTIAL_POLL_INTERVAL_SECONDS", "5"))
+	if err != nil || seconds <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// credentialsMu serializes reloads so two never retire each other's keys
+var credentialsMu sync.Mutex
+
+// reloadCredentials re-reads the processor secrets, API keys and signing
+// secrets. Keys and secrets that were replaced or removed keep working for
+// CREDENTIAL_GRACE_PERIOD so clients can switch over. Invalid files are
+// rejected and the previous credentials stay in effect.
+func reloadCredentials(ctx context.Context) error {
+	credentialsMu.Lock()
+	defer credentialsMu.Unlock()
+
+	if processorSecrets != nil {
+		processorSecrets.refresh(ctx)
+	}
+
+	keys, err := loadAPIKeys()
+	if err != nil {
+		credentialReloadsTotal.WithLabelValues("error").Inc()
+		return err
+	}
+	secrets, err := loadSigningSecrets()
+	if err != nil {
+		credentialReloadsTotal.WithLabelValues("error").Inc()
+		return err
+	}
+	previousKeys := apiKeys.Load()
+	if keys == nil && previousKeys != nil {
+		credentialReloadsTotal.WithLabelValues("error").Inc()
+		return fmt.Errorf("no API keys left, which would disable authentication")
+	}
+
+	until := time.Now().Add(getCredentialGracePeriod())
+	if keys != nil {
+		keys.retire(previousKeys, until)
+		apiKeys.Store(keys)
+	}
+	signing := &signingSecretStore{secrets: secrets}
+	signing.retire(signingSecrets.Load(), until)
+	signingSecrets.Store(signing)
+
+	credentialReloadsTotal.WithLabelValues("success").Inc()
+	retiredKeys := 0
+	if keys != nil {
+		retiredKeys = len(keys.retired)
+	}
+	log.Printf("Reloaded credentials: %d API keys (%d in grace period), %d signing secrets (%d in grace period)",
+		keys.count(), retiredKeys, len(signing.secrets), len(signing.retired))
+	return nil
+}
+
+// watchCredentials reloads the credentials on SIGHUP and whenever a poll
+// sees API_KEYS_FILE or SIGNING_SECRETS_FILE change
+func watchCredentials(interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	paths := []string{os.Getenv("API_KEYS_FILE"), os.Getenv("SIGNING_SECRETS_FILE")}
+	checksums := make([]string, len(paths))
+	for i, path := range paths {
+		checksums[i] = fileChecksum(path)
+	}
+
+	for {
+		select {
+		case <-hup:
+			log.Printf("Received SIGHUP, reloading credentials")
+		case <-ticker.C:
+			changed := false
+			for i, path := range paths {
+				if sum := fileChecksum(path); sum != checksums[i] {
+					checksums[i] = sum
+					changed = true
+				}
+			}
+			if !changed {
+				continue
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := reloadCredentials(ctx); err != nil {
+			log.Printf("Credential reload failed, keeping previous credentials: %v", err)
+		}
+		cancel()
+	}
+}
+
+// fileChecksum returns the SHA-256 of a file's content, or "" when the
+// path is unset or unreadable
+func fileChecksum(path string) string {
+	if path == "" {
+		return ""
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+)
+
+// streamingRoutes hold their connection open, so they are exempt from the
+// request timeout, HTTP_WRITE_TIMEOUT and response compression
+var streamingRoutes = map[string]bool{
+	"GET /events":              true,
+	"GET /debug/pprof/profile": true,
+	"GET /debug/pprof/trace":   true,
+}
+
+// exportRoutes may outlast the request timeout and HTTP_WRITE_TIMEOUT too,
+// but are compressed
+var exportRoutes = map[string]bool{
+	"GET /transactions/export": true,
+	// GET /admin/audit streams the whole trail with format=ndjson
+	"GET /admin/audit": true,
+}
+
+// publicMux serves PORT. It is not http.DefaultServeMux, which
+// net/http/pprof and expvar register themselves on.
+var publicMux = http.NewServeMux()
+
+// adminMux serves ADMIN_PORT, the internal listener for operators: health,
+// metrics, admin and debug endpoints
+var adminMux = http.NewServeMux()
+
+// route registers h on the public listener for a method and path pattern
+// such as "POST /transactions/{id}/capture" behind the stack every route
+// shares, then mws, which are specific to the route
+func route(pattern string, h http.HandlerFunc, mws ...middleware) {
+	handle(publicMux, pattern, h, mws...)
+}
+
+// adminRoute registers h on the admin listener, like route
+func adminRoute(pattern string, h http.HandlerFunc, mws ...middleware) {
+	handle(adminMux, pattern, h, mws...)
+}
+
+// routeGroup names the listener a mux serves, "public" or "admin"
+func routeGroup(mux *http.ServeMux) string {
+	if mux == adminMux {
+		return "admin"
+	}
+	return "public"
+}
+
+func handle(mux *http.ServeMux, pattern string, h http.HandlerFunc, mws ...middleware) {
+	stack := []middleware{withRequestID, withAccessLog, withMetrics(pattern), withIPFilter(routeGroup(mux)), withRecovery(pattern), withTenant}
+	if !streamingRoutes[pattern] {
+		stack = append(stack, withCompression(pattern))
+	}
+	if !streamingRoutes[pattern] && !exportRoutes[pattern] {
+		stack = append(stack, withTimeout(getRequestTimeout()))
+	} else {
+		stack = append(stack, withoutWriteDeadline)
+	}
+	mux.HandleFunc(pattern, chain(h, append(stack, mws...)...))
+}
+
+// newRouter serves mux, answering requests that match no route with the
+// standard error envelope; ServeMux itself replies in plain text. Public
+// routes are served under /tenants/{id} too.
+func newRouter(mux *http.ServeMux) http.Handler {
+	unmatched := chain(func(w http.ResponseWriter, r *http.Request) {
+		mux.ServeHTTP(&muxErrorWriter{ResponseWriter: w, r: r}, r)
+	}, withRequestID, withAccessLog, withMetrics("unmatched"), withIPFilter(routeGroup(mux)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mux == publicMux {
+			r = stripTenantPrefix(r)
+		}
+		if _, pattern := mux.Handler(r); pattern == "" {
+			unmatched(w, r)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// muxErrorWriter replaces the mux's plain-text 404 and 405 with the error
+// envelope. Any other status passes through untouched.
+type muxErrorWriter struct {
+	http.ResponseWriter
+	r        *http.Request
+	replaced bool
+}
+
+func (w *muxErrorWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNotFound:
+		handleNotFound(w.ResponseWriter, w.r)
+	case http.StatusMethodNotAllowed:
+		handleMethodNotAllowed(w.ResponseWriter, w.r)
+	default:
+		w.ResponseWriter.WriteHeader(status)
+		return
+	}
+	w.replaced = true
+}
+
+func (w *muxErrorWriter) Write(b []byte) (int, error) {
+	if w.replaced {
+		return len(b), nil
+	}
+	return w.ResponseWriter.Write(b)
+}
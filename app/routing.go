@@ -0,0 +1,201 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Routing modes
+const (
+	routingWeighted = "weighted"
+	routingCost     = "cost"
+)
+
+const (
+	// successWindow is how many recent authorizations per processor the
+	// observed success rate is computed over
+	successWindow = 100
+	// minSuccessSamples is how many a processor needs before its observed
+	// rate replaces the one its failure rate implies
+	minSuccessSamples = 20
+)
+
+var (
+	processorSuccessRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "voyager_processor_success_rate",
+			Help: "Share of a processor's last 100 authorizations that were approved",
+		},
+		[]string{"processor"},
+	)
+
+	processorLatencyP99 = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "voyager_processor_latency_p99_seconds",
+			Help: "99th percentile latency of a processor's last 100 authorizations",
+		},
+		[]string{"processor"},
+	)
+
+	costRoutingFallbacksTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "voyager_cost_routing_fallbacks_total",
+			Help: "Total number of cost-routed authorizations for which no processor met min_success_rate",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(processorSuccessRate)
+	prometheus.MustRegister(processorLatencyP99)
+	prometheus.MustRegister(costRoutingFallbacksTotal)
+}
+
+// RoutingConfig is the routing section of the config file
+type RoutingConfig struct {
+	// Mode is weighted (the default: random, by processor weight) or cost
+	Mode string `yaml:"mode" json:"mode,omitempty"`
+	// MinSuccessRate (0-1) is the success rate a processor needs to be
+	// picked in cost mode
+	MinSuccessRate float64 `yaml:"min_success_rate" json:"min_success_rate,omitempty"`
+}
+
+// validateRouting checks the routing section of the config
+func validateRouting(r *RoutingConfig) []FieldViolation {
+	if r == nil {
+		return nil
+	}
+	var violations []FieldViolation
+	switch r.Mode {
+	case "", routingWeighted, routingCost:
+	default:
+		violations = append(violations, FieldViolation{"routing.mode", "must be weighted or cost"})
+	}
+	if r.MinSuccessRate < 0 || r.MinSuccessRate > 1 {
+		violations = append(violations, FieldViolation{"routing.min_success_rate", "must be between 0 and 1"})
+	}
+	return violations
+}
+
+// costRouting reports whether processors are picked by expected cost
+func (c *RuntimeConfig) costRouting() bool {
+	return c.Routing != nil && c.Routing.Mode == routingCost
+}
+
+// successTracker keeps the outcomes of each processor's last
+// successWindow authorizations
+type successTracker struct {
+	mu      sync.Mutex
+	windows map[string]*outcomeWindow
+}
+
+// outcomeWindow is a ring of a processor's most recent outcomes
+type outcomeWindow struct {
+	approved  [successWindow]bool
+	latencies [successWindow]time.Duration
+	n, next   int
+}
+
+var processorOutcomes = &successTracker{windows: make(map[string]*outcomeWindow)}
+
+// record adds an authorization outcome for processor, with how long the
+// processor took to answer
+func (t *successTracker) record(processor string, approved bool, latency time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	window := t.windows[processor]
+	if window == nil {
+		window = &outcomeWindow{}
+		t.windows[processor] = window
+	}
+	window.approved[window.next] = approved
+	window.latencies[window.next] = latency
+	window.next = (window.next + 1) % successWindow
+	window.n = min(window.n+1, successWindow)
+	processorSuccessRate.WithLabelValues(processor).Set(approvalShare(window.approved[:window.n]))
+	processorLatencyP99.WithLabelValues(processor).Set(window.p99().Seconds())
+	if sharedRedis.Load() != nil {
+		sharedOutcomes.add(processor, approved)
+	}
+}
+
+// rate returns the processor's observed success rate, or false until it
+// has minSuccessSamples outcomes. With Redis, it is the rate every
+// replica's outcomes add up to, unless that is stale.
+func (t *successTracker) rate(processor string) (float64, bool) {
+	if sharedRedis.Load() != nil {
+		if rate, ok := sharedOutcomes.rate(processor, time.Now()); ok {
+			return rate, true
+		}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	window := t.windows[processor]
+	if window == nil || window.n < minSuccessSamples {
+		return 0, false
+	}
+	return approvalShare(window.approved[:window.n]), true
+}
+
+// p99 is the 99th percentile latency of the window, sorted on a copy kept
+// on the stack
+func (w *outcomeWindow) p99() time.Duration {
+	sorted := w.latencies
+	slices.Sort(sorted[:w.n])
+	return sorted[(99*w.n+99)/100-1]
+}
+
+func approvalShare(window []bool) float64 {
+	approved := 0
+	for _, ok := range window {
+		if ok {
+			approved++
+		}
+	}
+	return float64(approved) / float64(len(window))
+}
+
+// expectedSuccessRate is a processor's observed success rate, or the one
+// its failure rate implies while there are too few observations
+func expectedSuccessRate(processor, merchantID string) float64 {
+	if rate, ok := processorOutcomes.rate(processor); ok {
+		return rate
+	}
+	return 1 - processorFailureRate(processor, merchantID)
+}
+
+// cheapestProcessor picks, among candidates meeting min_success_rate, the
+// one with the lowest expected cost per approved authorization: its fee
+// divided by its success rate. When none meets the constraint it picks the
+// most successful one. Ties go to the first candidate.
+func cheapestProcessor(cfg *RuntimeConfig, candidates []Processor, req AuthorizationRequest) Processor {
+	var best, mostSuccessful Processor
+	var bestCost, bestRate float64
+	for _, p := range candidates {
+		if cfg.processorWeight(p.Name()) <= 0 {
+			continue
+		}
+		rate := expectedSuccessRate(p.Name(), req.MerchantID)
+		if mostSuccessful == nil || rate > bestRate {
+			mostSuccessful, bestRate = p, rate
+		}
+		if rate <= 0 || rate < cfg.Routing.MinSuccessRate {
+			continue
+		}
+		cost := float64(cfg.processorFees(p.Name()).fee(*req.AmountMinor, req.Currency)) / rate
+		if best == nil || cost < bestCost {
+			best, bestCost = p, cost
+		}
+	}
+	if best == nil {
+		costRoutingFallbacksTotal.Inc()
+		if mostSuccessful == nil {
+			return candidates[0]
+		}
+		return mostSuccessful
+	}
+	return best
+}
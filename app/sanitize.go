@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// sensitiveFields are the JSON fields whose values are always masked when
+// they leave the gateway in logs, audit entries, events or error messages
+var sensitiveFields = map[string]bool{
+	"card_token": true,
+	"auth_code":  true,
+	"pan":        true,
+	"cvv":        true,
+	"cvc":        true,
+}
+
+var (
+	// panCandidate matches runs of 12 to 19 digits, optionally grouped with
+	// single spaces or dashes the way cards are commonly written
+	panCandidate = regexp.MustCompile(`[0-9](?:[ -]?[0-9]){11,18}`)
+
+	// sensitiveAssignment matches a sensitive field followed by its value,
+	// as in card_token=tok_x, "auth_code":"A1B2C3" or pan: 4111...
+	sensitiveAssignment = regexp.MustCompile(`(?i)\b(card_token|auth_code|pan|cvv|cvc)("?\s*[:=]\s*"?)([^\s"',;&}]+)`)
+)
+
+// maskSecret masks a card token, auth code or PAN, keeping its length.
+// Long values keep their first 6 and last 4 characters, short ones only
+// their last 4, and values too short to hide anything are masked entirely.
+func maskSecret(s string) string {
+	switch n := len(s); {
+	case n >= 14:
+		return s[:6] + strings.Repeat("*", n-10) + s[n-4:]
+	case n >= 8:
+		return strings.Repeat("*", n-4) + s[n-4:]
+	default:
+		return strings.Repeat("*", n)
+	}
+}
+
+// maskPAN masks the digits of a PAN written with or without separators,
+// keeping the first 6 and last 4 and the separators themselves
+func maskPAN(s string) string {
+	digits := 0
+	for i := 0; i < len(s); i++ {
+		if s[i] >= '0' && s[i] <= '9' {
+			digits++
+		}
+	}
+	masked := []byte(s)
+	seen := 0
+	for i := range masked {
+		if masked[i] < '0' || masked[i] > '9' {
+			continue
+		}
+		if seen >= 6 && seen < digits-4 {
+			masked[i] = '*'
+		}
+		seen++
+	}
+	return string(masked)
+}
+
+// sanitizeText masks the PAN-like numbers in free text, those of 12 to 19
+// digits passing the Luhn check, and the values of sensitive fields
+// written as key=value or "key": "value"
+func sanitizeText(s string) string {
+	if s == "" {
+		return s
+	}
+	// Matching first spares the common text with nothing to mask the
+	// allocations of replacing
+	if sensitiveAssignment.MatchString(s) {
+		s = sensitiveAssignment.ReplaceAllStringFunc(s, func(m string) string {
+			parts := sensitiveAssignment.FindStringSubmatch(m)
+			return parts[1] + parts[2] + maskSecret(parts[3])
+		})
+	}
+	if !panCandidate.MatchString(s) {
+		return s
+	}
+	matches := panCandidate.FindAllStringIndex(s, -1)
+	var out strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[0], m[1]
+		// Part of a longer number, e.g. a timestamp in nanoseconds
+		if (start > 0 && isDigit(s[start-1])) || (end < len(s) && isDigit(s[end])) {
+			continue
+		}
+		candidate := s[start:end]
+		if !luhnValid(normalizePAN(candidate)) {
+			continue
+		}
+		out.WriteString(s[last:start])
+		out.WriteString(maskPAN(candidate))
+		last = end
+	}
+	out.WriteString(s[last:])
+	return out.String()
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+// sanitizeJSON masks a JSON document: the values of sensitiveFields, and
+// PAN-like numbers in every other string. Field order is kept. Documents
+// that don't parse are sanitized as text.
+func sanitizeJSON(data []byte) []byte {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var out bytes.Buffer
+	if err := sanitizeJSONValue(dec, &out, false); err != nil {
+		return []byte(sanitizeText(string(data)))
+	}
+	return out.Bytes()
+}
+
+// sanitizeJSONValue copies the next value from dec to out, masking it
+// entirely when it belongs to a sensitive field
+func sanitizeJSONValue(dec *json.Decoder, out *bytes.Buffer, sensitive bool) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '{' {
+			out.WriteByte('{')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				name, _ := key.(string)
+				writeJSONString(out, sanitizeText(name))
+				out.WriteByte(':')
+				if err := sanitizeJSONValue(dec, out, sensitive || sensitiveFields[name]); err != nil {
+					return err
+				}
+			}
+			out.WriteByte('}')
+		} else {
+			out.WriteByte('[')
+			for i := 0; dec.More(); i++ {
+				if i > 0 {
+					out.WriteByte(',')
+				}
+				if err := sanitizeJSONValue(dec, out, sensitive); err != nil {
+					return err
+				}
+			}
+			out.WriteByte(']')
+		}
+		// The closing delimiter
+		_, err = dec.Token()
+		return err
+	case string:
+		if sensitive {
+			writeJSONString(out, maskSecret(t))
+		} else {
+			writeJSONString(out, sanitizeText(t))
+		}
+	case json.Number:
+		if sensitive {
+			writeJSONString(out, maskSecret(t.String()))
+		} else {
+			out.WriteString(t.String())
+		}
+	case bool:
+		if t {
+			out.WriteString("true")
+		} else {
+			out.WriteString("false")
+		}
+	case nil:
+		out.WriteString("null")
+	}
+	return nil
+}
+
+func writeJSONString(out *bytes.Buffer, s string) {
+	b, _ := json.Marshal(s)
+	out.Write(b)
+}
+
+// sanitizingWriter masks what is written through it as text; the standard
+// logger writes through one so no log line carries card data
+type sanitizingWriter struct{ w io.Writer }
+
+func (s sanitizingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(s.w, sanitizeText(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
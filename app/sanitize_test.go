@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testPAN is a Luhn-valid card number planted in values that must never
+// come out unmasked
+const testPAN = "4111111111111111"
+
+// testSecret is planted in sensitive fields, which are masked whatever
+// their value looks like
+const testSecret = "secret_value_planted_by_tests"
+
+// notSensitive lists the fields whose names look like card data but are
+// safe to send as they are
+var notSensitive = map[string]string{
+	"challenge_token": "a one-time 3DS reference the merchant needs to confirm the challenge",
+	"token_type":      "vault_token or network_token, not the token itself",
+	"network_tokens":  "whether a processor takes network tokens",
+	"token_uplifts":   "approval rate points per token type",
+	"cvv_present":     "whether the payer entered a CVV, not the CVV itself",
+	"cvv_result":      "the simulated CVV check's result code",
+	"cvv_results":     "CVV result codes and their weights",
+}
+
+// emittedTypes are the values that leave the gateway as event data, in
+// webhook payloads and in error details. A new event payload belongs here.
+var emittedTypes = []interface{}{
+	AuthorizationResponse{},
+	Transaction{},
+	Refund{},
+	AuthorizationIncrement{},
+	Dispute{},
+	Payout{},
+	PaymentLink{},
+	Subscription{},
+	SubscriptionCharge{},
+	ChaosExperiment{},
+	RuntimeConfig{},
+	AuditEntry{},
+	BlocklistEntry{},
+}
+
+func TestMaskSecret(t *testing.T) {
+	cases := map[string]string{
+		"4111111111111111":     "411111******1111",
+		"tok_4242424242424242": "tok_42**********4242",
+		"tok_approve":          "*******rove",
+		"A1B2C3":               "******",
+		"":                     "",
+	}
+	for in, want := range cases {
+		if got := maskSecret(in); got != want {
+			t.Errorf("maskSecret(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSanitizeTextMasksPANs(t *testing.T) {
+	cases := map[string]string{
+		"card 4111111111111111 declined":    "card 411111******1111 declined",
+		"card 4111 1111 1111 1111 declined": "card 4111 11** **** 1111 declined",
+		"card 4111-1111-1111-1111 declined": "card 4111-11**-****-1111 declined",
+		"token tok_5555555555554444":        "token tok_555555******4444",
+		"amex 378282246310005":              "amex 378282*****0005",
+		// Not Luhn-valid, or part of a longer number
+		"order 4111111111111112":       "order 4111111111111112",
+		"ts 1700000000000000000000000": "ts 1700000000000000000000000",
+		"card_token=tok_visa_debit":    "card_token=tok_vi****ebit",
+		`{"auth_code":"A1B2C3"}`:       `{"auth_code":"******"}`,
+		"pan: 4000056655665556":        "pan: 400005******5556",
+		"company=acme":                 "company=acme",
+	}
+	for in, want := range cases {
+		if got := sanitizeText(in); got != want {
+			t.Errorf("sanitizeText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestSanitizeJSONKeepsOrder(t *testing.T) {
+	in := `{"transaction_id":"txn_1","auth_code":"A1B2C3","amount":10.50,"nested":[{"card_token":"tok_approve","note":"pan 4111111111111111"}],"ok":true,"none":null}`
+	want := `{"transaction_id":"txn_1","auth_code":"******","amount":10.50,"nested":[{"card_token":"*******rove","note":"pan 411111******1111"}],"ok":true,"none":null}`
+	if got := string(sanitizeJSON([]byte(in))); got != want {
+		t.Errorf("sanitizeJSON = %s, want %s", got, want)
+	}
+}
+
+// TestSensitiveFieldsAreClassified fails when an emitted type gains a field
+// named like card data without it being masked or explicitly allowed
+func TestSensitiveFieldsAreClassified(t *testing.T) {
+	for _, v := range emittedTypes {
+		for _, name := range jsonFieldNames(reflect.TypeOf(v), 0) {
+			if !looksSensitive(name) || sensitiveFields[name] {
+				continue
+			}
+			if _, ok := notSensitive[name]; !ok {
+				t.Errorf("%T has field %q that looks like card data; add it to sensitiveFields or notSensitive", v, name)
+			}
+		}
+	}
+}
+
+// TestEmittedTypesDoNotLeak plants card data in every string field of the
+// emitted types and checks none of it survives an event or error response
+func TestEmittedTypesDoNotLeak(t *testing.T) {
+	for _, v := range emittedTypes {
+		value := reflect.New(reflect.TypeOf(v)).Elem()
+		plant(value, "", 0)
+
+		body, err := json.Marshal(WebhookEvent{ID: "evt_test", Type: "test", Data: value.Interface()})
+		if err != nil {
+			t.Fatalf("marshalling %T: %v", v, err)
+		}
+		assertNoLeak(t, "event with "+value.Type().Name(), string(body))
+
+		rec := httptest.NewRecorder()
+		writeError(rec, httptest.NewRequest(http.MethodGet, "/", nil), http.StatusBadRequest,
+			errCodeValidation, "bad card "+testPAN, value.Interface())
+		assertNoLeak(t, "error with "+value.Type().Name(), rec.Body.String())
+	}
+}
+
+func TestLogsAreMasked(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.New(sanitizingWriter{&buf}, "", 0)
+	logger.Printf("authorizing card_token=%s pan %s", testSecret, testPAN)
+	assertNoLeak(t, "log line", buf.String())
+}
+
+func assertNoLeak(t *testing.T, what, out string) {
+	t.Helper()
+	for _, secret := range []string{testPAN, testSecret} {
+		if strings.Contains(out, secret) {
+			t.Errorf("%s leaks %q: %s", what, secret, out)
+		}
+	}
+}
+
+func looksSensitive(name string) bool {
+	for _, part := range []string{"token", "auth_code", "pan", "cvv", "cvc", "card_number"} {
+		if strings.Contains(name, part) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonFieldNames lists the JSON names of a type's fields, nested ones
+// included
+func jsonFieldNames(typ reflect.Type, depth int) []string {
+	for typ.Kind() == reflect.Pointer || typ.Kind() == reflect.Slice || typ.Kind() == reflect.Map {
+		typ = typ.Elem()
+	}
+	if typ.Kind() != reflect.Struct || depth > 4 {
+		return nil
+	}
+	var names []string
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		if name := jsonName(field); name != "" {
+			names = append(names, name)
+		}
+		names = append(names, jsonFieldNames(field.Type, depth+1)...)
+	}
+	return names
+}
+
+func jsonName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// plant fills every string reachable from v with testPAN, or testSecret
+// for sensitive fields
+func plant(v reflect.Value, name string, depth int) {
+	if depth > 4 || !v.CanSet() {
+		return
+	}
+	switch v.Kind() {
+	case reflect.String:
+		if sensitiveFields[name] {
+			v.SetString(testSecret)
+		} else {
+			v.SetString(testPAN)
+		}
+	case reflect.Pointer:
+		elem := reflect.New(v.Type().Elem())
+		plant(elem.Elem(), name, depth+1)
+		v.Set(elem)
+	case reflect.Slice:
+		s := reflect.MakeSlice(v.Type(), 1, 1)
+		plant(s.Index(0), name, depth+1)
+		v.Set(s)
+	case reflect.Map:
+		if v.Type().Key().Kind() != reflect.String {
+			return
+		}
+		m := reflect.MakeMap(v.Type())
+		elem := reflect.New(v.Type().Elem()).Elem()
+		plant(elem, name, depth+1)
+		m.SetMapIndex(reflect.ValueOf(testPAN).Convert(v.Type().Key()), elem)
+		v.Set(m)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if field := v.Type().Field(i); field.IsExported() {
+				plant(v.Field(i), jsonName(field), depth+1)
+			}
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/yaml.v3"
+)
+
+// scenarioSource tags the chaos experiments started by the scenario player
+// so a phase change can clear them without touching ones started by hand
+const scenarioSource = "scenario"
+
+// maxScenarioBytes bounds scenario uploads through /admin/scenario
+const maxScenarioBytes = 1 << 20
+
+var scenarioPhaseInfo = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Name: "voyager_scenario_phase_info",
+		Help: "Set to 1 for the scenario phase currently being played back",
+	},
+	[]string{"scenario", "phase"},
+)
+
+func init() {
+	prometheus.MustRegister(scenarioPhaseInfo)
+}
+
+// ScenarioFault is a chaos experiment applied for the length of a phase
+type ScenarioFault struct {
+	Type       string  `yaml:"type" json:"type"`
+	Processor  string  `yaml:"processor" json:"processor,omitempty"`
+	LatencyMs  int     `yaml:"latency_ms" json:"latency_ms,omitempty"`
+	ErrorRate  float64 `yaml:"error_rate" json:"error_rate,omitempty"`
+	Percentage float64 `yaml:"percentage" json:"percentage,omitempty"`
+}
+
+// ScenarioPhase is one time slice of a scenario
+type ScenarioPhase struct {
+	Name     string          `yaml:"name" json:"name"`
+	Duration string          `yaml:"duration" json:"duration"`
+	Faults   []ScenarioFault `yaml:"faults" json:"faults,omitempty"`
+
+	duration time.Duration
+}
+
+// Scenario is a sequence of phases played back in order, e.g.
+//
+//	name: adyen-incident
+//	loop: false
+//	phases:
+//	  - name: normal
+//	    duration: 5m
+//	  - name: adyen-outage
+//	    duration: 5m
+//	    faults:
+//	      - type: processor_outage
+//	        processor: adyen
+//	  - name: latency-spike
+//	    duration: 5m
+//	    faults:
+//	      - type: latency
+//	        latency_ms: 800
+type Scenario struct {
+	Name   string          `yaml:"name" json:"name"`
+	Loop   bool            `yaml:"loop" json:"loop"`
+	Phases []ScenarioPhase `yaml:"phases" json:"phases"`
+}
+
+// ScenarioStatus describes the scenario being played back
+type ScenarioStatus struct {
+	Running        bool   `json:"running"`
+	Scenario       string `json:"scenario,omitempty"`
+	Phase          string `json:"phase,omitempty"`
+	PhaseIndex     int    `json:"phase_index"`
+	Phases         int    `json:"phases"`
+	Loop           bool   `json:"loop"`
+	PhaseStartedAt string `json:"phase_started_at,omitempty"`
+	PhaseEndsAt    string `json:"phase_ends_at,omitempty"`
+}
+
+// parseScenario decodes and validates a YAML scenario
+func parseScenario(data []byte) (*Scenario, []FieldViolation) {
+	var s Scenario
+	if err := yaml.Unmarshal(data, &s); err != nil {
+		return nil, []FieldViolation{{"body", fmt.Sprintf("must be a valid YAML scenario: %v", err)}}
+	}
+
+	var violations []FieldViolation
+	if s.Name == "" {
+		violations = append(violations, FieldViolation{"name", "is required"})
+	}
+	if len(s.Phases) == 0 {
+		violations = append(violations, FieldViolation{"phases", "must contain at least one phase"})
+	}
+
+	now := time.Now()
+	for i := range s.Phases {
+		phase := &s.Phases[i]
+		field := fmt.Sprintf("phases[%d]", i)
+		if phase.Name == "" {
+			phase.Name = fmt.Sprintf("phase-%d", i+1)
+		}
+
+		d, err := time.ParseDuration(phase.Duration)
+		if err != nil || d <= 0 || d > maxChaosTTL {
+			violations = append(violations, FieldViolation{field + ".duration", fmt.Sprintf("must be a duration between 1s and %s", maxChaosTTL)})
+			continue
+		}
+		phase.duration = d
+
+		for j, fault := range phase.Faults {
+			e := fault.experiment(d)
+			for _, v := range e.validate(now) {
+				v.Field = fmt.Sprintf("%s.faults[%d].%s", field, j, v.Field)
+				violations = append(violations, v)
+			}
+		}
+	}
+
+	if len(violations) > 0 {
+		return nil, violations
+	}
+	return &s, nil
+}
+
+// experiment converts a fault into a chaos experiment lasting d
+func (f ScenarioFault) experiment(d time.Duration) *ChaosExperiment {
+	return &ChaosExperiment{
+		Type:       f.Type,
+		Processor:  f.Processor,
+		LatencyMs:  f.LatencyMs,
+		ErrorRate:  f.ErrorRate,
+		Percentage: f.Percentage,
+		TTLSeconds: int(math.Ceil(d.Seconds())),
+		Source:     scenarioSource,
+	}
+}
+
+// loadScenario reads the scenario named by SCENARIO_FILE, if set
+func loadScenario() (*Scenario, error) {
+	path := os.Getenv("SCENARIO_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SCENARIO_FILE: %w", err)
+	}
+	s, violations := parseScenario(data)
+	if len(violations) > 0 {
+		return nil, fmt.Errorf("invalid scenario in %s: %s %s", path, violations[0].Field, violations[0].Message)
+	}
+	return s, nil
+}
+
+// scenarioPlayer plays back at most one scenario at a time
+type scenarioPlayer struct {
+	mu             sync.Mutex
+	scenario       *Scenario
+	phaseIndex     int
+	phaseStartedAt time.Time
+	stop           chan struct{}
+}
+
+var scenarios = &scenarioPlayer{}
+
+// start replaces any running scenario with s
+func (p *scenarioPlayer) start(s *Scenario) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.stopLocked()
+	p.scenario = s
+	p.phaseIndex = 0
+	p.phaseStartedAt = time.Now()
+	p.stop = make(chan struct{})
+	go p.run(s, p.stop)
+
+	log.Printf("Scenario %q started: %d phases, loop=%t", s.Name, len(s.Phases), s.Loop)
+}
+
+// halt stops the running scenario and clears its faults
+func (p *scenarioPlayer) halt() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.scenario == nil {
+		return false
+	}
+	log.Printf("Scenario %q stopped", p.scenario.Name)
+	p.stopLocked()
+	return true
+}
+
+func (p *scenarioPlayer) stopLocked() {
+	if p.stop != nil {
+		close(p.stop)
+		p.stop = nil
+	}
+	p.scenario = nil
+	chaos.removeBySource(scenarioSource)
+	scenarioPhaseInfo.Reset()
+}
+
+// run steps through the phases until the scenario ends or is stopped
+func (p *scenarioPlayer) run(s *Scenario, stop chan struct{}) {
+	for {
+		for i, phase := range s.Phases {
+			if !p.enterPhase(s, i, stop) {
+				return
+			}
+
+			timer := time.NewTimer(phase.duration)
+			select {
+			case <-stop:
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+		}
+		if !s.Loop {
+			break
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop == stop {
+		log.Printf("Scenario %q finished", s.Name)
+		p.stopLocked()
+	}
+}
+
+// enterPhase swaps the previous phase's faults for those of phase i. It
+// returns false if the scenario was stopped in the meantime.
+func (p *scenarioPlayer) enterPhase(s *Scenario, i int, stop chan struct{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stop != stop {
+		return false
+	}
+
+	phase := s.Phases[i]
+	chaos.removeBySource(scenarioSource)
+	now := time.Now()
+	for _, fault := range phase.Faults {
+		e := fault.experiment(phase.duration)
+		e.validate(now)
+		chaos.add(e)
+	}
+
+	p.phaseIndex = i
+	p.phaseStartedAt = now
+	scenarioPhaseInfo.Reset()
+	scenarioPhaseInfo.WithLabelValues(s.Name, phase.Name).Set(1)
+
+	log.Printf("Scenario %q entered phase %d/%d %q for %s", s.Name, i+1, len(s.Phases), phase.Name, phase.duration)
+	return true
+}
+
+// status reports the current scenario and phase
+func (p *scenarioPlayer) status() ScenarioStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.scenario == nil {
+		return ScenarioStatus{}
+	}
+	phase := p.scenario.Phases[p.phaseIndex]
+	return ScenarioStatus{
+		Running:        true,
+		Scenario:       p.scenario.Name,
+		Phase:          phase.Name,
+		PhaseIndex:     p.phaseIndex,
+		Phases:         len(p.scenario.Phases),
+		Loop:           p.scenario.Loop,
+		PhaseStartedAt: p.phaseStartedAt.UTC().Format(time.RFC3339),
+		PhaseEndsAt:    p.phaseStartedAt.Add(phase.duration).UTC().Format(time.RFC3339),
+	}
+}
+
+// handleScenarioStatus reports the scenario being played back
+// (GET /admin/scenario)
+func handleScenarioStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(scenarios.status())
+}
+
+// handleScenarioStart replaces the scenario with the YAML body
+// (POST /admin/scenario)
+func handleScenarioStart(w http.ResponseWriter, r *http.Request) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxScenarioBytes))
+	if err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "could not be read"}})
+		return
+	}
+	s, violations := parseScenario(data)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	scenarios.start(s)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(scenarios.status())
+}
+
+// handleScenarioStop stops the scenario (DELETE /admin/scenario)
+func handleScenarioStop(w http.ResponseWriter, r *http.Request) {
+	if !scenarios.halt() {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "No scenario is running", nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
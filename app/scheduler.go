@@ -0,0 +1,115 @@
+package main
+
+import (
+	"container/heap"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// callScheduler runs callbacks once their delay has passed. One goroutine
+// tracks every deadline with a single timer and hands due callbacks to a
+// fixed set of workers, so any number of pending simulated processor calls
+// costs heap entries rather than goroutines or runtime timers.
+type callScheduler struct {
+	mu      sync.Mutex
+	pending callQueue
+	// next is the deadline the dispatcher is sleeping until; a sooner one
+	// wakes it
+	next  time.Time
+	wake  chan struct{}
+	ready chan func()
+}
+
+type scheduledCall struct {
+	at time.Time
+	fn func()
+}
+
+// callQueue is a min-heap of calls by deadline
+type callQueue []scheduledCall
+
+func (q callQueue) Len() int            { return len(q) }
+func (q callQueue) Less(i, j int) bool  { return q[i].at.Before(q[j].at) }
+func (q callQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *callQueue) Push(x interface{}) { *q = append(*q, x.(scheduledCall)) }
+func (q *callQueue) Pop() interface{} {
+	old := *q
+	call := old[len(old)-1]
+	old[len(old)-1] = scheduledCall{}
+	*q = old[:len(old)-1]
+	return call
+}
+
+// simulatedCalls completes the simulated processor calls batches defer.
+// Completions write to storage, so there are at least as many workers as
+// run batch items.
+var simulatedCalls = newCallScheduler(max(getBatchWorkers(), 4*runtime.GOMAXPROCS(0)))
+
+func newCallScheduler(workers int) *callScheduler {
+	s := &callScheduler{wake: make(chan struct{}, 1), ready: make(chan func(), workers)}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for fn := range s.ready {
+				fn()
+			}
+		}()
+	}
+	go s.dispatch()
+	return s
+}
+
+// after runs fn on a scheduler worker once d has passed
+func (s *callScheduler) after(d time.Duration, fn func()) {
+	at := time.Now().Add(d)
+	s.mu.Lock()
+	heap.Push(&s.pending, scheduledCall{at: at, fn: fn})
+	sooner := s.next.IsZero() || at.Before(s.next)
+	if sooner {
+		s.next = at
+	}
+	s.mu.Unlock()
+	if sooner {
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (s *callScheduler) dispatch() {
+	timer := time.NewTimer(time.Hour)
+	var due []func()
+	for {
+		now := time.Now()
+		s.mu.Lock()
+		for len(s.pending) > 0 && !s.pending[0].at.After(now) {
+			due = append(due, heap.Pop(&s.pending).(scheduledCall).fn)
+		}
+		wait := time.Hour
+		s.next = time.Time{}
+		if len(s.pending) > 0 {
+			s.next = s.pending[0].at
+			wait = s.next.Sub(now)
+		}
+		s.mu.Unlock()
+
+		for i, fn := range due {
+			s.ready <- fn
+			due[i] = nil
+		}
+		due = due[:0]
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
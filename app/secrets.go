@@ -0,0 +1,379 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Where a secret's current value came from
+const (
+	secretSourceEnv   = "env"
+	secretSourceFile  = "file"
+	secretSourceVault = "vault"
+)
+
+var (
+	secretRefreshesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_secret_refreshes_total",
+			Help: "Total number of secret reads from files or Vault by source and result",
+		},
+		[]string{"source", "result"},
+	)
+
+	secretLastRefresh = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "voyager_secret_last_refresh_timestamp_seconds",
+			Help: "Unix time a secret was last read successfully",
+		},
+		[]string{"name"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(secretRefreshesTotal)
+	prometheus.MustRegister(secretLastRefresh)
+}
+
+// processorSecretName is the secret holding a processor's API key, e.g.
+// STRIPE_API_KEY
+func processorSecretName(processor string) string {
+	return strings.ToUpper(processor) + "_API_KEY"
+}
+
+// secret is the current value of one managed secret
+type secret struct {
+	value  string
+	source string
+	// refreshedAt is when the value was last read successfully
+	refreshedAt time.Time
+	// err is why the last read failed, if it did; value is then the one
+	// read before
+	err error
+}
+
+// secretStore holds the processor API keys, read from Vault, mounted files
+// or the environment and re-read periodically so rotated keys are picked up
+// without a restart
+type secretStore struct {
+	mu      sync.RWMutex
+	secrets map[string]*secret
+	names   []string
+	// validators reject values a secret must never take, e.g. live keys
+	validators map[string]func(string) error
+
+	dir      string
+	vault    *vaultClient
+	interval time.Duration
+	// maxAge is how long a file or Vault secret may go without a
+	// successful read before readiness fails
+	maxAge time.Duration
+}
+
+// processorSecrets is nil until main loads it; until then values come
+// straight from the environment
+var processorSecrets *secretStore
+
+// loadSecretStore reads where secrets come from and reads them once:
+//
+//	SECRETS_DIR               directory of files named like the secrets, e.g. a
+//	                          mounted Kubernetes Secret; <NAME>_FILE points at
+//	                          one secret's file instead
+//	VAULT_ADDR                Vault server; with VAULT_SECRET_PATH (e.g.
+//	                          secret/data/voyager-gateway, KV v1 or v2) and
+//	                          VAULT_TOKEN or VAULT_TOKEN_FILE
+//	VAULT_NAMESPACE           Vault Enterprise namespace, optional
+//	SECRETS_REFRESH_INTERVAL  how often files and Vault are re-read, default 1m
+//	SECRETS_MAX_AGE           how stale a secret may get before readiness
+//	                          fails, default 5m
+//
+// Vault wins over files, which win over environment variables.
+func loadSecretStore(names []string) (*secretStore, error) {
+	s := &secretStore{
+		secrets:    make(map[string]*secret),
+		names:      names,
+		validators: make(map[string]func(string) error),
+		dir:        os.Getenv("SECRETS_DIR"),
+	}
+	var err error
+	if s.interval, err = parseDelay(getEnv("SECRETS_REFRESH_INTERVAL", "1m")); err != nil || s.interval < time.Second {
+		return nil, fmt.Errorf("invalid SECRETS_REFRESH_INTERVAL %q: must be a duration of at least 1s", os.Getenv("SECRETS_REFRESH_INTERVAL"))
+	}
+	if s.maxAge, err = parseDelay(getEnv("SECRETS_MAX_AGE", "5m")); err != nil || s.maxAge < s.interval {
+		return nil, fmt.Errorf("invalid SECRETS_MAX_AGE %q: must be a duration no shorter than SECRETS_REFRESH_INTERVAL", os.Getenv("SECRETS_MAX_AGE"))
+	}
+	if s.dir != "" {
+		if info, err := os.Stat(s.dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("SECRETS_DIR %q is not a directory", s.dir)
+		}
+	}
+	if s.vault, err = loadVaultClient(); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		s.secrets[name] = &secret{}
+	}
+	s.refresh(context.Background())
+	return s, nil
+}
+
+// describe summarizes where each secret came from, for logs
+func (s *secretStore) describe() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	parts := make([]string, 0, len(s.names))
+	for _, name := range s.names {
+		source := s.secrets[name].source
+		if source == "" {
+			source = "unset"
+		}
+		parts = append(parts, name+" ("+source+")")
+	}
+	return strings.Join(parts, ", ")
+}
+
+// value returns a secret's current value, or "" when it is unset
+func (s *secretStore) value(name string) string {
+	if s == nil {
+		return os.Getenv(name)
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if sec, ok := s.secrets[name]; ok {
+		return sec.value
+	}
+	return os.Getenv(name)
+}
+
+// validate makes refreshes reject values of name that fail check, keeping
+// the previous value instead
+func (s *secretStore) validate(name string, check func(string) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.validators[name] = check
+}
+
+// refresh re-reads every secret. A secret that can't be read keeps its
+// previous value and records the error until a read succeeds.
+func (s *secretStore) refresh(ctx context.Context) {
+	var vaultData map[string]string
+	var vaultErr error
+	if s.vault != nil {
+		vaultData, vaultErr = s.vault.read(ctx)
+		result := "success"
+		if vaultErr != nil {
+			result = "error"
+		}
+		secretRefreshesTotal.WithLabelValues(secretSourceVault, result).Inc()
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, name := range s.names {
+		sec := s.secrets[name]
+		value, source, err := s.read(name, sec.source, vaultData, vaultErr)
+		if err == nil && value != "" {
+			if check := s.validators[name]; check != nil {
+				err = check(value)
+			}
+		}
+		if err != nil {
+			if sec.err == nil {
+				log.Printf("Failed to refresh secret %s, keeping the previous value: %v", name, err)
+			}
+			sec.err = err
+			continue
+		}
+		if sec.value != "" && value != sec.value {
+			log.Printf("Secret %s rotated (%s)", name, source)
+		} else if sec.err != nil {
+			log.Printf("Secret %s readable again (%s)", name, source)
+		}
+		sec.value, sec.source, sec.err = value, source, nil
+		if value != "" {
+			sec.refreshedAt = now
+			secretLastRefresh.WithLabelValues(name).Set(float64(now.Unix()))
+		}
+	}
+}
+
+// read resolves one secret: Vault, then its file, then the environment.
+// While Vault is unreachable, secrets that came from it, or that were never
+// read, report the error.
+func (s *secretStore) read(name, previous string, vaultData map[string]string, vaultErr error) (string, string, error) {
+	if vaultErr != nil && (previous == secretSourceVault || previous == "") {
+		return "", "", vaultErr
+	}
+	if value, ok := vaultData[name]; ok && value != "" {
+		return value, secretSourceVault, nil
+	}
+
+	path := os.Getenv(name + "_FILE")
+	if path == "" && s.dir != "" {
+		candidate := filepath.Join(s.dir, name)
+		if _, err := os.Stat(candidate); err == nil {
+			path = candidate
+		}
+	}
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err == nil && strings.TrimSpace(string(b)) == "" {
+			err = fmt.Errorf("%s is empty", path)
+		}
+		if err != nil {
+			secretRefreshesTotal.WithLabelValues(secretSourceFile, "error").Inc()
+			return "", "", err
+		}
+		secretRefreshesTotal.WithLabelValues(secretSourceFile, "success").Inc()
+		return strings.TrimSpace(string(b)), secretSourceFile, nil
+	}
+
+	if value := os.Getenv(name); value != "" {
+		return value, secretSourceEnv, nil
+	}
+	return "", "", nil
+}
+
+// check reports the secrets that are unset, or that came from a file or
+// Vault and haven't been read successfully within maxAge. Environment
+// variables can't change, so they never go stale.
+func (s *secretStore) check() error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var problems []string
+	for _, name := range s.names {
+		sec := s.secrets[name]
+		switch {
+		case sec.value == "" && sec.err != nil:
+			problems = append(problems, fmt.Sprintf("%s unreadable: %v", name, sec.err))
+		case sec.value == "":
+			problems = append(problems, name+" missing")
+		case sec.source != secretSourceEnv && time.Since(sec.refreshedAt) > s.maxAge:
+			problems = append(problems, fmt.Sprintf("%s stale, last read %s ago: %v",
+				name, time.Since(sec.refreshedAt).Truncate(time.Second), sec.err))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// watchSecrets re-reads the secrets every SECRETS_REFRESH_INTERVAL
+func watchSecrets() {
+	s := processorSecrets
+	if s == nil {
+		return
+	}
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), s.interval)
+		s.refresh(ctx)
+		cancel()
+	}
+}
+
+// vaultClient reads one KV secret from Vault over its HTTP API
+type vaultClient struct {
+	addr      string
+	path      string
+	namespace string
+	token     string
+	tokenFile string
+	client    *http.Client
+}
+
+// loadVaultClient returns nil unless VAULT_ADDR is set
+func loadVaultClient() (*vaultClient, error) {
+	addr := strings.TrimRight(os.Getenv("VAULT_ADDR"), "/")
+	if addr == "" {
+		return nil, nil
+	}
+	v := &vaultClient{
+		addr:      addr,
+		path:      strings.Trim(os.Getenv("VAULT_SECRET_PATH"), "/"),
+		namespace: os.Getenv("VAULT_NAMESPACE"),
+		token:     os.Getenv("VAULT_TOKEN"),
+		tokenFile: os.Getenv("VAULT_TOKEN_FILE"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+	if v.path == "" {
+		return nil, fmt.Errorf("VAULT_SECRET_PATH is required with VAULT_ADDR")
+	}
+	if v.token == "" && v.tokenFile == "" {
+		return nil, fmt.Errorf("VAULT_TOKEN or VAULT_TOKEN_FILE is required with VAULT_ADDR")
+	}
+	return v, nil
+}
+
+// read returns the secret's string fields. The token file, e.g. a Vault
+// Agent sink, is re-read every time so renewed tokens are used.
+func (v *vaultClient) read(ctx context.Context) (map[string]string, error) {
+	token := v.token
+	if v.tokenFile != "" {
+		b, err := os.ReadFile(v.tokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading VAULT_TOKEN_FILE: %w", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.addr+"/v1/"+v.path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if v.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.namespace)
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s from Vault: %w", v.path, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(io.Discard, resp.Body)
+		return nil, fmt.Errorf("reading %s from Vault: status %d", v.path, resp.StatusCode)
+	}
+
+	// KV v2 nests the fields under data.data next to data.metadata; KV v1
+	// has them directly under data
+	var body struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("decoding %s from Vault: %w", v.path, err)
+	}
+	var v2 struct {
+		Data     map[string]interface{} `json:"data"`
+		Metadata json.RawMessage        `json:"metadata"`
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(body.Data, &v2); err == nil && v2.Metadata != nil && v2.Data != nil {
+		fields = v2.Data
+	} else if err := json.Unmarshal(body.Data, &fields); err != nil {
+		return nil, fmt.Errorf("decoding %s from Vault: %w", v.path, err)
+	}
+	values := make(map[string]string, len(fields))
+	for name, value := range fields {
+		if s, ok := value.(string); ok {
+			values[name] = s
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Seed is a fixture of merchants, vaulted cards and historical
+// transactions preloaded at startup from SEED_FILE, so dashboards and
+// query endpoints have something to show right after a deploy. It is YAML
+// or JSON.
+type Seed struct {
+	Merchants    []SeedMerchant    `yaml:"merchants"`
+	Tokens       []SeedToken       `yaml:"tokens"`
+	Transactions []SeedTransaction `yaml:"transactions"`
+}
+
+// SeedMerchant is a merchant onboarded with a known API key, so demo
+// scripts can authenticate as it
+type SeedMerchant struct {
+	MerchantID     string `yaml:"merchant_id"`
+	APIKey         string `yaml:"api_key"`
+	MerchantConfig `yaml:",inline"`
+}
+
+// SeedToken is a card vaulted under a known token. A token starting with
+// ntok_ is a network token.
+type SeedToken struct {
+	Token string `yaml:"token"`
+	// MerchantID, when set, is the only merchant the token resolves for
+	MerchantID string `yaml:"merchant_id"`
+	PAN        string `yaml:"pan"`
+	ExpMonth   int    `yaml:"exp_month"`
+	ExpYear    int    `yaml:"exp_year"`
+}
+
+// SeedTransaction is a past transaction. Captured and refunded amounts
+// follow from the status, except a partial refund's.
+type SeedTransaction struct {
+	// TransactionID defaults to txn_seed_<n>, n counting from 1 in file
+	// order, so reloading the file doesn't duplicate it
+	TransactionID string `yaml:"transaction_id"`
+	MerchantID    string `yaml:"merchant_id"`
+	// Status defaults to approved
+	Status         string  `yaml:"status"`
+	Amount         float64 `yaml:"amount"`
+	Currency       string  `yaml:"currency"`
+	Processor      string  `yaml:"processor"`
+	AuthCode       string  `yaml:"auth_code"`
+	DeclineReason  string  `yaml:"decline_reason"`
+	RefundedAmount float64 `yaml:"refunded_amount"`
+	// CreatedAt is an RFC 3339 timestamp. Age, a duration such as 36h,
+	// dates the transaction relative to startup instead, so the fixture
+	// stays recent; without either it is created now.
+	CreatedAt string `yaml:"created_at"`
+	Age       string `yaml:"age"`
+}
+
+// seedStatuses are the statuses a seeded transaction may have
+var seedStatuses = map[string]bool{
+	"approved": true, "declined": true,
+	statusCaptured: true, statusPartiallyRefunded: true, statusRefunded: true,
+}
+
+// SeedResult counts what a seed loaded; records already stored are
+// skipped, not replaced
+type SeedResult struct {
+	Merchants    int
+	Tokens       int
+	Transactions int
+	Skipped      int
+}
+
+// parseSeed decodes and validates a fixture, returning the merchants and
+// transactions to store and the tokens to vault
+func parseSeed(data []byte, now time.Time) ([]Merchant, []Transaction, []SeedToken, []FieldViolation) {
+	var seed Seed
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	if err := dec.Decode(&seed); err != nil {
+		return nil, nil, nil, []FieldViolation{{"seed", fmt.Sprintf("must be valid YAML or JSON: %v", err)}}
+	}
+
+	var violations []FieldViolation
+	cfg := currentConfig()
+	merchants := make([]Merchant, 0, len(seed.Merchants))
+	for i, sm := range seed.Merchants {
+		field := fmt.Sprintf("merchants[%d]", i)
+		if !merchantIDPattern.MatchString(sm.MerchantID) {
+			violations = append(violations, FieldViolation{field + ".merchant_id", "must be 1-64 characters of letters, digits, '_' or '-'"})
+		}
+		if len(sm.APIKey) < 16 {
+			violations = append(violations, FieldViolation{field + ".api_key", "must be at least 16 characters"})
+			continue
+		}
+		violations = append(violations, cfg.validateMerchant(field+".", sm.MerchantConfig)...)
+		m := Merchant{MerchantID: sm.MerchantID, MerchantConfig: sm.MerchantConfig}
+		m.CreatedAt = formatTimestamp(now)
+		m.UpdatedAt = m.CreatedAt
+		setAPIKey(&m, sm.APIKey)
+		merchants = append(merchants, m)
+	}
+
+	for i := range seed.Tokens {
+		t := &seed.Tokens[i]
+		field := fmt.Sprintf("tokens[%d]", i)
+		tokenType := tokenTypeOf(t.Token)
+		if suffix := strings.TrimPrefix(t.Token, tokenTypes[tokenType]); tokenType == "" || !merchantIDPattern.MatchString(suffix) {
+			violations = append(violations, FieldViolation{field + ".token", "must be " + vaultTokenPrefix + " or " + networkTokenPrefix + " followed by 1-64 letters, digits, '_' or '-'"})
+		}
+		req := TokenizeRequest{MerchantID: t.MerchantID, PAN: t.PAN, ExpMonth: t.ExpMonth, ExpYear: t.ExpYear}
+		for _, v := range validateTokenizeRequest(&req, now) {
+			violations = append(violations, FieldViolation{field + "." + v.Field, v.Message})
+		}
+		t.PAN, t.ExpYear = req.PAN, req.ExpYear
+	}
+
+	txns := make([]Transaction, 0, len(seed.Transactions))
+	for i, st := range seed.Transactions {
+		field := fmt.Sprintf("transactions[%d]", i)
+		txn, txnViolations := st.transaction(i, now)
+		for _, v := range txnViolations {
+			violations = append(violations, FieldViolation{field + "." + v.Field, v.Message})
+		}
+		txns = append(txns, txn)
+	}
+	if len(violations) > 0 {
+		return nil, nil, nil, violations
+	}
+	return merchants, txns, seed.Tokens, nil
+}
+
+// transaction validates the i-th seeded transaction and builds it
+func (st SeedTransaction) transaction(i int, now time.Time) (Transaction, []FieldViolation) {
+	var violations []FieldViolation
+	txn := Transaction{
+		TransactionID: st.TransactionID,
+		MerchantID:    st.MerchantID,
+		Status:        st.Status,
+		Currency:      strings.ToUpper(st.Currency),
+		Processor:     st.Processor,
+		AuthCode:      st.AuthCode,
+		DeclineReason: st.DeclineReason,
+	}
+	if txn.TransactionID == "" {
+		txn.TransactionID = fmt.Sprintf("txn_seed_%d", i+1)
+	}
+	if txn.Status == "" {
+		txn.Status = "approved"
+	}
+	if !merchantIDPattern.MatchString(st.MerchantID) {
+		violations = append(violations, FieldViolation{"merchant_id", "must be 1-64 characters of letters, digits, '_' or '-'"})
+	}
+	if !seedStatuses[txn.Status] {
+		violations = append(violations, FieldViolation{"status", "must be one of approved, declined, captured, partially_refunded, refunded"})
+	}
+	if !iso4217Currencies[txn.Currency] {
+		violations = append(violations, FieldViolation{"currency", "must be a valid ISO 4217 currency code"})
+	}
+	if _, ok := toMinorUnits(st.Amount, txn.Currency); st.Amount <= 0 || !ok {
+		violations = append(violations, FieldViolation{"amount", "must be positive, in the currency's minor unit"})
+	}
+	if txn.Processor != "" && !isKnownProcessor(txn.Processor) {
+		violations = append(violations, FieldViolation{"processor", fmt.Sprintf("must be one of %s", strings.Join(processors.names(), ", "))})
+	}
+
+	txn.Amount = st.Amount
+	switch txn.Status {
+	case statusCaptured:
+		txn.CapturedAmount = st.Amount
+	case statusRefunded:
+		txn.CapturedAmount, txn.RefundedAmount = st.Amount, st.Amount
+	case statusPartiallyRefunded:
+		txn.CapturedAmount, txn.RefundedAmount = st.Amount, st.RefundedAmount
+		if st.RefundedAmount <= 0 || st.RefundedAmount >= st.Amount {
+			violations = append(violations, FieldViolation{"refunded_amount", "must be between 0 and amount, exclusive, for partially_refunded"})
+		}
+	}
+
+	created := now
+	switch {
+	case st.CreatedAt != "" && st.Age != "":
+		violations = append(violations, FieldViolation{"age", "must not be set with created_at"})
+	case st.CreatedAt != "":
+		t, err := time.Parse(time.RFC3339, st.CreatedAt)
+		if err != nil {
+			violations = append(violations, FieldViolation{"created_at", "must be an RFC 3339 timestamp"})
+		}
+		created = t
+	case st.Age != "":
+		age, err := time.ParseDuration(st.Age)
+		if err != nil || age < 0 {
+			violations = append(violations, FieldViolation{"age", "must be a duration such as 36h"})
+		}
+		created = now.Add(-age)
+	}
+	txn.CreatedAt = formatTimestamp(created)
+	txn.UpdatedAt = txn.CreatedAt
+	return txn, violations
+}
+
+// loadSeedFile preloads SEED_FILE, if set, into the default namespace. Records
+// whose ID is already stored are left as they are, so the file can be
+// loaded on every start of a replica sharing a database.
+func loadSeedFile(ctx context.Context) (*SeedResult, error) {
+	path := os.Getenv("SEED_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading SEED_FILE: %w", err)
+	}
+	now := time.Now()
+	merchants, txns, tokens, violations := parseSeed(data, now)
+	if len(violations) > 0 {
+		return nil, fmt.Errorf("invalid seed in %s: %s %s", path, violations[0].Field, violations[0].Message)
+	}
+
+	result := &SeedResult{}
+	for _, m := range merchants {
+		err := storage.createMerchant(ctx, m)
+		switch {
+		case errors.Is(err, errDuplicateRecord):
+			result.Skipped++
+		case err != nil:
+			return nil, fmt.Errorf("seeding merchant %s: %w", m.MerchantID, err)
+		default:
+			result.Merchants++
+		}
+	}
+	for _, txn := range txns {
+		err := storage.Create(ctx, txn)
+		switch {
+		case errors.Is(err, errDuplicateRecord):
+			result.Skipped++
+		case err != nil:
+			return nil, fmt.Errorf("seeding transaction %s: %w", txn.TransactionID, err)
+		default:
+			result.Transactions++
+		}
+	}
+	for _, t := range tokens {
+		card := CardMetadata{Brand: cardBrand(t.PAN), Last4: t.PAN[len(t.PAN)-4:], ExpMonth: t.ExpMonth, ExpYear: t.ExpYear}
+		vault.put(t.Token, t.MerchantID, card, now.UTC())
+		result.Tokens++
+	}
+	return result, nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+)
+
+var (
+	oversizeBodiesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_oversize_bodies_total",
+			Help: "Total number of requests rejected with 413 because their body exceeded MAX_REQUEST_BODY_BYTES",
+		},
+		[]string{"route"},
+	)
+
+	httpConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "voyager_http_connections",
+			Help: "Number of open client connections by listener",
+		},
+		[]string{"listener"},
+	)
+
+	httpConnectionsAcceptedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_http_connections_accepted_total",
+			Help: "Total number of client connections accepted by listener",
+		},
+		[]string{"listener"},
+	)
+
+	httpRequestsByProtocolTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_http_requests_by_protocol_total",
+			Help: "Total number of requests by listener and HTTP protocol version",
+		},
+		[]string{"listener", "protocol"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(oversizeBodiesTotal)
+	prometheus.MustRegister(httpConnections)
+	prometheus.MustRegister(httpConnectionsAcceptedTotal)
+	prometheus.MustRegister(httpRequestsByProtocolTotal)
+}
+
+// http2Enabled is HTTP2_ENABLED; the TLS listener only offers h2 with it
+var http2Enabled = true
+
+// serverSettings are the connection timeouts, size limits and protocol
+// settings both listeners are served with
+type serverSettings struct {
+	readHeaderTimeout    time.Duration
+	readTimeout          time.Duration
+	writeTimeout         time.Duration
+	idleTimeout          time.Duration
+	maxHeaderBytes       int
+	keepAlives           bool
+	tcpKeepAlive         time.Duration
+	http2                bool
+	maxConcurrentStreams uint32
+}
+
+// loadServerSettings reads the settings:
+//
+//	HTTP_READ_HEADER_TIMEOUT       time to read the request headers, default 5s
+//	HTTP_READ_TIMEOUT              time to read the whole request, default 30s
+//	HTTP_WRITE_TIMEOUT             time to write the response, default 60s;
+//	                               /events, exports and pprof streams are exempt
+//	HTTP_IDLE_TIMEOUT              how long keep-alive connections wait for the
+//	                               next request, default 120s
+//	HTTP_MAX_HEADER_BYTES          largest request header block, default 65536
+//	HTTP_KEEP_ALIVES_ENABLED       reuse connections across requests, default true
+//	TCP_KEEP_ALIVE_PERIOD          TCP keep-alive probe interval, default 15s
+//	HTTP2_ENABLED                  serve HTTP/2, over TLS or as h2c, default true
+//	HTTP2_MAX_CONCURRENT_STREAMS   requests in flight per HTTP/2 connection,
+//	                               default 250
+//
+// A timeout or period of 0 disables it.
+func loadServerSettings() (serverSettings, error) {
+	var settings serverSettings
+	for _, t := range []struct {
+		key  string
+		def  string
+		dest *time.Duration
+	}{
+		{"HTTP_READ_HEADER_TIMEOUT", "5s", &settings.readHeaderTimeout},
+		{"HTTP_READ_TIMEOUT", "30s", &settings.readTimeout},
+		{"HTTP_WRITE_TIMEOUT", "60s", &settings.writeTimeout},
+		{"HTTP_IDLE_TIMEOUT", "120s", &settings.idleTimeout},
+		{"TCP_KEEP_ALIVE_PERIOD", "15s", &settings.tcpKeepAlive},
+	} {
+		d, err := time.ParseDuration(getEnv(t.key, t.def))
+		if err != nil || d < 0 {
+			return serverSettings{}, fmt.Errorf("invalid %s %q", t.key, os.Getenv(t.key))
+		}
+		*t.dest = d
+	}
+	maxHeaderBytes, err := strconv.Atoi(getEnv("HTTP_MAX_HEADER_BYTES", "65536"))
+	if err != nil || maxHeaderBytes < 1024 {
+		return serverSettings{}, fmt.Errorf("invalid HTTP_MAX_HEADER_BYTES %q: must be at least 1024", os.Getenv("HTTP_MAX_HEADER_BYTES"))
+	}
+	settings.maxHeaderBytes = maxHeaderBytes
+	streams, err := strconv.ParseUint(getEnv("HTTP2_MAX_CONCURRENT_STREAMS", "250"), 10, 32)
+	if err != nil || streams == 0 {
+		return serverSettings{}, fmt.Errorf("invalid HTTP2_MAX_CONCURRENT_STREAMS %q", os.Getenv("HTTP2_MAX_CONCURRENT_STREAMS"))
+	}
+	settings.maxConcurrentStreams = uint32(streams)
+	settings.keepAlives = getEnv("HTTP_KEEP_ALIVES_ENABLED", "true") == "true"
+	settings.http2 = getEnv("HTTP2_ENABLED", "true") == "true"
+	http2Enabled = settings.http2
+	return settings, nil
+}
+
+// newServer returns a server for addr with the settings applied. With
+// HTTP/2 on it speaks h2 over TLS and h2c, by prior knowledge or Upgrade,
+// in cleartext, since load balancers and load generators often use h2c
+// inside the cluster. listener labels the request metrics.
+func newServer(addr string, h http.Handler, settings serverSettings, listener string) *http.Server {
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           countProtocols(listener, h),
+		ReadHeaderTimeout: settings.readHeaderTimeout,
+		ReadTimeout:       settings.readTimeout,
+		WriteTimeout:      settings.writeTimeout,
+		IdleTimeout:       settings.idleTimeout,
+		MaxHeaderBytes:    settings.maxHeaderBytes,
+	}
+	srv.SetKeepAlivesEnabled(settings.keepAlives)
+	if !settings.http2 {
+		// A non-nil map without h2 keeps ServeTLS from adding it
+		srv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		return srv
+	}
+	h2 := &http2.Server{MaxConcurrentStreams: settings.maxConcurrentStreams, IdleTimeout: settings.idleTimeout}
+	_ = http2.ConfigureServer(srv, h2)
+	srv.Handler = h2c.NewHandler(srv.Handler, h2)
+	return srv
+}
+
+// listen opens a TCP listener for srv with TCP_KEEP_ALIVE_PERIOD applied.
+// listener labels the connection metrics.
+func listen(srv *http.Server, settings serverSettings, listener string) (net.Listener, error) {
+	lc := net.ListenConfig{KeepAlive: settings.tcpKeepAlive}
+	if settings.tcpKeepAlive == 0 {
+		lc.KeepAlive = -1
+	}
+	ln, err := lc.Listen(context.Background(), "tcp", srv.Addr)
+	if err != nil {
+		return nil, err
+	}
+	return &countingListener{Listener: ln, name: listener}, nil
+}
+
+// countingListener counts the connections it accepts and those still open.
+// It counts at the socket rather than through http.Server.ConnState, which
+// never reports h2c connections closed since they are hijacked.
+type countingListener struct {
+	net.Listener
+	name string
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	httpConnectionsAcceptedTotal.WithLabelValues(l.name).Inc()
+	httpConnections.WithLabelValues(l.name).Inc()
+	return &countedConn{Conn: c, listener: l.name}, nil
+}
+
+type countedConn struct {
+	net.Conn
+	listener string
+	once     sync.Once
+}
+
+func (c *countedConn) Close() error {
+	c.once.Do(func() { httpConnections.WithLabelValues(c.listener).Dec() })
+	return c.Conn.Close()
+}
+
+// countProtocols counts requests by protocol version, which shows whether
+// clients actually negotiated HTTP/2
+func countProtocols(listener string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		protocol := "HTTP/1.1"
+		switch {
+		case r.ProtoMajor == 2:
+			protocol = "HTTP/2.0"
+		case r.ProtoMajor == 1 && r.ProtoMinor == 0:
+			protocol = "HTTP/1.0"
+		}
+		httpRequestsByProtocolTotal.WithLabelValues(listener, protocol).Inc()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// withoutWriteDeadline lifts HTTP_WRITE_TIMEOUT for routes that stream,
+// which would otherwise be cut off mid-response
+func withoutWriteDeadline(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+		next(w, r)
+	}
+}
+
+// getMaxRequestBodyBytes returns MAX_REQUEST_BODY_BYTES, default 64 KiB,
+// which is far more than any authorization needs
+func getMaxRequestBodyBytes() int64 {
+	n, err := strconv.ParseInt(getEnv("MAX_REQUEST_BODY_BYTES", "65536"), 10, 64)
+	if err != nil || n <= 0 {
+		return 65536
+	}
+	return n
+}
+
+// limitRequestBody rejects bodies over MAX_REQUEST_BODY_BYTES with 413
+// before anything reads them. The body is buffered, so signature checks
+// and idempotency fingerprints that read it again see the same bytes.
+func limitRequestBody(pattern string) middleware {
+	return limitBodyTo(pattern, getMaxRequestBodyBytes)
+}
+
+// limitBodyTo is limitRequestBody with the limit maxBytes returns
+func limitBodyTo(pattern string, maxBytes func() int64) middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			limit := maxBytes()
+			if r.ContentLength > limit {
+				rejectOversizeBody(w, r, pattern, limit)
+				return
+			}
+			body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+			if err != nil {
+				writeValidationError(w, r, []FieldViolation{{"body", "could not be read"}})
+				return
+			}
+			if int64(len(body)) > limit {
+				rejectOversizeBody(w, r, pattern, limit)
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			next(w, r)
+		}
+	}
+}
+
+func rejectOversizeBody(w http.ResponseWriter, r *http.Request, pattern string, limit int64) {
+	oversizeBodiesTotal.WithLabelValues(pattern).Inc()
+	// The rest of the body isn't read, so the connection can't be reused
+	w.Header().Set("Connection", "close")
+	writeError(w, r, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge,
+		fmt.Sprintf("Request body exceeds %d bytes", limit), map[string]int64{"max_bytes": limit})
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	settlementBatchesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_settlement_batches_total",
+			Help: "Total number of settlement batches created by processor",
+		},
+		[]string{"processor"},
+	)
+
+	settledTransactionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_settled_transactions_total",
+			Help: "Total number of transactions settled by processor",
+		},
+		[]string{"processor"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(settlementBatchesTotal)
+	prometheus.MustRegister(settledTransactionsTotal)
+}
+
+// Settlement is a batch of captured transactions one processor pays out to
+// one merchant in one currency. Net is gross minus refunds and fees.
+type Settlement struct {
+	SettlementID     string           `json:"settlement_id"`
+	Processor        string           `json:"processor"`
+	MerchantID       string           `json:"merchant_id"`
+	Currency         string           `json:"currency"`
+	TransactionCount int              `json:"transaction_count"`
+	GrossAmount      float64          `json:"gross_amount"`
+	RefundedAmount   float64          `json:"refunded_amount"`
+	FeeAmount        float64          `json:"fee_amount"`
+	NetAmount        float64          `json:"net_amount"`
+	CreatedAt        string           `json:"created_at"`
+	Items            []SettlementItem `json:"items,omitempty"`
+
+	GrossAmountMinor    int64 `json:"gross_amount_minor"`
+	RefundedAmountMinor int64 `json:"refunded_amount_minor"`
+	FeeAmountMinor      int64 `json:"fee_amount_minor"`
+	NetAmountMinor      int64 `json:"net_amount_minor"`
+}
+
+// SettlementItem is one transaction of a settlement batch
+type SettlementItem struct {
+	TransactionID      string  `json:"transaction_id"`
+	ProcessorReference string  `json:"processor_reference,omitempty"`
+	CapturedAmount     float64 `json:"captured_amount"`
+	RefundedAmount     float64 `json:"refunded_amount"`
+	FeeAmount          float64 `json:"fee_amount"`
+	NetAmount          float64 `json:"net_amount"`
+
+	CapturedAmountMinor int64 `json:"captured_amount_minor"`
+	RefundedAmountMinor int64 `json:"refunded_amount_minor"`
+	FeeAmountMinor      int64 `json:"fee_amount_minor"`
+	NetAmountMinor      int64 `json:"net_amount_minor"`
+}
+
+// SettlementFilter narrows a settlements listing. Zero values match
+// everything.
+type SettlementFilter struct {
+	MerchantID string
+	Processor  string
+}
+
+func (f SettlementFilter) matches(s Settlement) bool {
+	return (f.MerchantID == "" || s.MerchantID == f.MerchantID) &&
+		(f.Processor == "" || s.Processor == f.Processor)
+}
+
+// newestSettlementsFirst orders settlements by created_at then ID,
+// descending
+func newestSettlementsFirst(settlements []Settlement) {
+	sort.Slice(settlements, func(i, j int) bool {
+		if settlements[i].CreatedAt != settlements[j].CreatedAt {
+			return settlements[i].CreatedAt > settlements[j].CreatedAt
+		}
+		return settlements[i].SettlementID > settlements[j].SettlementID
+	})
+}
+
+// withMinorUnits returns s with its amounts, and its items', also set in
+// minor units
+func (s Settlement) withMinorUnits() Settlement {
+	s.GrossAmountMinor, _ = toMinorUnits(s.GrossAmount, s.Currency)
+	s.RefundedAmountMinor, _ = toMinorUnits(s.RefundedAmount, s.Currency)
+	s.FeeAmountMinor, _ = toMinorUnits(s.FeeAmount, s.Currency)
+	s.NetAmountMinor, _ = toMinorUnits(s.NetAmount, s.Currency)
+	items := make([]SettlementItem, len(s.Items))
+	for i, item := range s.Items {
+		item.CapturedAmountMinor, _ = toMinorUnits(item.CapturedAmount, s.Currency)
+		item.RefundedAmountMinor, _ = toMinorUnits(item.RefundedAmount, s.Currency)
+		item.FeeAmountMinor, _ = toMinorUnits(item.FeeAmount, s.Currency)
+		item.NetAmountMinor, _ = toMinorUnits(item.NetAmount, s.Currency)
+		items[i] = item
+	}
+	if s.Items != nil {
+		s.Items = items
+	}
+	return s
+}
+
+// getSettlementHour returns the UTC hour of the nightly settlement run
+// (SETTLEMENT_HOUR_UTC, default 0); "off" disables it
+func getSettlementHour() (int, bool) {
+	value := getEnv("SETTLEMENT_HOUR_UTC", "0")
+	if value == "off" {
+		return 0, false
+	}
+	hour, err := strconv.Atoi(value)
+	if err != nil || hour < 0 || hour > 23 {
+		return 0, true
+	}
+	return hour, true
+}
+
+// settleMu keeps two settlement runs in this replica from racing
+var settleMu sync.Mutex
+
+// settle batches every captured transaction not settled yet, per
+// processor, merchant and currency. Refunds made after a transaction is
+// settled are not in any batch.
+func settle(ctx context.Context, now time.Time) ([]Settlement, error) {
+	settleMu.Lock()
+	defer settleMu.Unlock()
+
+	txns, err := storage.unsettledTransactions(ctx)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_unsettled").Inc()
+		return nil, err
+	}
+	cfg := currentConfig()
+	batches := map[string]*Settlement{}
+	var keys []string
+	for _, txn := range txns {
+		key := txn.Processor + "\x00" + txn.MerchantID + "\x00" + txn.Currency
+		batch, ok := batches[key]
+		if !ok {
+			batch = &Settlement{
+				SettlementID: newSettlementID(),
+				Processor:    txn.Processor,
+				MerchantID:   txn.MerchantID,
+				Currency:     txn.Currency,
+				CreatedAt:    formatTimestamp(now),
+			}
+			batches[key] = batch
+			keys = append(keys, key)
+		}
+		captured, _ := toMinorUnits(txn.CapturedAmount, txn.Currency)
+		refunded, _ := toMinorUnits(txn.RefundedAmount, txn.Currency)
+		fee := cfg.processorFees(txn.Processor).fee(captured, txn.Currency)
+		batch.Items = append(batch.Items, SettlementItem{
+			TransactionID:      txn.TransactionID,
+			ProcessorReference: txn.ProcessorReference,
+			CapturedAmount:     txn.CapturedAmount,
+			RefundedAmount:     txn.RefundedAmount,
+			FeeAmount:          fromMinorUnits(fee, txn.Currency),
+			NetAmount:          fromMinorUnits(captured-refunded-fee, txn.Currency),
+		})
+	}
+
+	sort.Strings(keys)
+	settlements := []Settlement{}
+	for _, key := range keys {
+		batch := batches[key]
+		var gross, refunded, fees, net int64
+		for _, item := range batch.withMinorUnits().Items {
+			gross += item.CapturedAmountMinor
+			refunded += item.RefundedAmountMinor
+			fees += item.FeeAmountMinor
+			net += item.NetAmountMinor
+		}
+		batch.TransactionCount = len(batch.Items)
+		batch.GrossAmount = fromMinorUnits(gross, batch.Currency)
+		batch.RefundedAmount = fromMinorUnits(refunded, batch.Currency)
+		batch.FeeAmount = fromMinorUnits(fees, batch.Currency)
+		batch.NetAmount = fromMinorUnits(net, batch.Currency)
+
+		switch err := storage.createSettlement(ctx, *batch); err {
+		case nil:
+		case errDuplicateRecord:
+			// Another replica settled some of these transactions first
+			continue
+		default:
+			storageErrorsTotal.WithLabelValues("create_settlement").Inc()
+			return settlements, err
+		}
+		settlementBatchesTotal.WithLabelValues(batch.Processor).Inc()
+		settledTransactionsTotal.WithLabelValues(batch.Processor).Add(float64(batch.TransactionCount))
+		log.Printf("Settlement %s: %d transactions, %s %.2f net via %s for %s",
+			batch.SettlementID, batch.TransactionCount, batch.Currency, batch.NetAmount, batch.Processor, batch.MerchantID)
+		settlements = append(settlements, batch.withMinorUnits())
+		go archiveSettlement(batch.withMinorUnits())
+	}
+	return settlements, nil
+}
+
+// archiveSettlement writes a settlement's reconciliation file to the
+// artifact store, if there is one
+func archiveSettlement(s Settlement) {
+	if artifacts == nil {
+		return
+	}
+	var body bytes.Buffer
+	if err := writeReconciliation(&body, s); err != nil {
+		log.Printf("Failed to write reconciliation file for %s: %v", s.SettlementID, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	key := path.Join("settlements", "date="+s.CreatedAt[:len("2006-01-02")], s.SettlementID+".csv")
+	if _, err := artifacts.upload(ctx, artifactSettlement, key, bytes.NewReader(body.Bytes()), "text/csv"); err != nil {
+		log.Printf("Failed to archive settlement %s: %v", s.SettlementID, err)
+	}
+}
+
+func newSettlementID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "stl_" + hex.EncodeToString(b)
+}
+
+// handleSettle settles every unsettled capture now (POST /admin/settle)
+func handleSettle(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	settlements, err := settle(ctx, time.Now())
+	if err != nil {
+		log.Printf("Settlement failed: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(settlements)
+}
+
+// handleSettlementList lists settlement batches without their items,
+// newest first (GET /settlements). Filters: merchant_id and processor.
+// Authenticated merchants only see their own.
+func handleSettlementList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := SettlementFilter{MerchantID: q.Get("merchant_id"), Processor: q.Get("processor")}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		filter.MerchantID = merchantID
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	settlements, err := storage.settlements(ctx, filter)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_settlements").Inc()
+		log.Printf("Failed to list settlements: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	result := make([]Settlement, 0, len(settlements))
+	for _, s := range settlements {
+		s.Items = nil
+		result = append(result, s.withMinorUnits())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// loadSettlement fetches a settlement visible to the caller, writing the
+// error response and returning false when there is none
+func loadSettlement(w http.ResponseWriter, r *http.Request) (Settlement, bool) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	s, err := storage.settlement(ctx, r.PathValue("id"))
+	if err == errRecordNotFound {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Settlement not found", nil)
+		return Settlement{}, false
+	}
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("get_settlement").Inc()
+		log.Printf("Failed to load settlement %s: %v", r.PathValue("id"), err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return Settlement{}, false
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok && s.MerchantID != merchantID {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Settlement not found", nil)
+		return Settlement{}, false
+	}
+	return s.withMinorUnits(), true
+}
+
+// handleSettlementGet returns a settlement with its items (GET
+// /settlements/{id})
+func handleSettlementGet(w http.ResponseWriter, r *http.Request) {
+	s, ok := loadSettlement(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s)
+}
+
+// reconciliationHeader are the columns of a reconciliation file
+var reconciliationHeader = []string{
+	"settlement_id", "processor", "merchant_id", "transaction_id", "processor_reference", "currency",
+	"captured_amount_minor", "refunded_amount_minor", "fee_amount_minor", "net_amount_minor", "settled_at",
+}
+
+// handleSettlementReconciliation downloads a settlement as a CSV
+// reconciliation file, one row per transaction (GET
+// /settlements/{id}/reconciliation.csv)
+func handleSettlementReconciliation(w http.ResponseWriter, r *http.Request) {
+	s, ok := loadSettlement(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.csv"`, s.SettlementID))
+	_ = writeReconciliation(w, s)
+}
+
+// writeReconciliation writes a settlement with minor units as a CSV
+// reconciliation file
+func writeReconciliation(w io.Writer, s Settlement) error {
+	out := csv.NewWriter(w)
+	_ = out.Write(reconciliationHeader)
+	for _, item := range s.Items {
+		_ = out.Write([]string{
+			s.SettlementID, s.Processor, s.MerchantID, item.TransactionID, item.ProcessorReference, s.Currency,
+			strconv.FormatInt(item.CapturedAmountMinor, 10), strconv.FormatInt(item.RefundedAmountMinor, 10),
+			strconv.FormatInt(item.FeeAmountMinor, 10), strconv.FormatInt(item.NetAmountMinor, 10), s.CreatedAt,
+		})
+	}
+	out.Flush()
+	return out.Error()
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// headerShadowRequest marks mirrored requests, so a shadow configured to
+// mirror too doesn't mirror them again
+const headerShadowRequest = "X-Shadow-Request"
+
+// Shadow comparison results
+const (
+	shadowMatch    = "match"
+	shadowMismatch = "mismatch"
+	shadowError    = "error"
+	shadowDropped  = "dropped"
+)
+
+var (
+	shadowRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_shadow_requests_total",
+			Help: "Total number of /authorize requests mirrored to SHADOW_URL, by whether the shadow's answer matched",
+		},
+		[]string{"result"},
+	)
+
+	shadowStatusTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_shadow_status_total",
+			Help: "Total number of mirrored requests by the primary's and the shadow's status codes",
+		},
+		[]string{"primary", "shadow"},
+	)
+
+	shadowDiffsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_shadow_diffs_total",
+			Help: "Total number of mirrored requests whose answer differed from the primary's, by field",
+		},
+		[]string{"field"},
+	)
+
+	shadowDurationSeconds = prometheus.NewHistogramVec(
+		latencyHistogramOpts("voyager_shadow_duration_seconds", "Duration of mirrored requests on the primary and on the shadow"),
+		[]string{"side"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(shadowRequestsTotal)
+	prometheus.MustRegister(shadowStatusTotal)
+	prometheus.MustRegister(shadowDiffsTotal)
+	prometheus.MustRegister(shadowDurationSeconds)
+}
+
+// shadowMirror copies a share of /authorize traffic to another gateway,
+// such as a new version, after the primary has answered. The shadow's
+// answer is only compared, never returned.
+type shadowMirror struct {
+	url         string
+	percentage  float64
+	maxInFlight int64
+	client      *http.Client
+	inFlight    atomic.Int64
+}
+
+// shadowTraffic is nil unless SHADOW_URL is set
+var shadowTraffic *shadowMirror
+
+// loadShadowMirror reads SHADOW_URL, the base URL of the gateway to mirror
+// to, SHADOW_PERCENTAGE (default 10), SHADOW_TIMEOUT_MS (default 2000) and
+// SHADOW_MAX_IN_FLIGHT (default 100). SHADOW_DIFF_SAMPLES (default 100)
+// differing answers are kept for /admin/mirror/diffs.
+func loadShadowMirror() (*shadowMirror, error) {
+	base := strings.TrimRight(getEnv("SHADOW_URL", ""), "/")
+	if base == "" {
+		return nil, nil
+	}
+	if _, err := url.ParseRequestURI(base); err != nil {
+		return nil, fmt.Errorf("invalid SHADOW_URL: %w", err)
+	}
+	percentage, err := strconv.ParseFloat(getEnv("SHADOW_PERCENTAGE", "10"), 64)
+	if err != nil || percentage <= 0 || percentage > 100 {
+		return nil, fmt.Errorf("SHADOW_PERCENTAGE must be between 0 (exclusive) and 100")
+	}
+	timeoutMs, err := strconv.Atoi(getEnv("SHADOW_TIMEOUT_MS", "2000"))
+	if err != nil || timeoutMs <= 0 {
+		timeoutMs = 2000
+	}
+	maxInFlight, err := strconv.ParseInt(getEnv("SHADOW_MAX_IN_FLIGHT", "100"), 10, 64)
+	if err != nil || maxInFlight <= 0 {
+		maxInFlight = 100
+	}
+	samples, err := strconv.Atoi(getEnv("SHADOW_DIFF_SAMPLES", "100"))
+	if err != nil || samples < 0 {
+		samples = 100
+	}
+	mirrorDiffs.reset(samples)
+	return &shadowMirror{
+		url:         base + "/authorize",
+		percentage:  percentage,
+		maxInFlight: maxInFlight,
+		client:      &http.Client{Timeout: time.Duration(timeoutMs) * time.Millisecond},
+	}, nil
+}
+
+// sample reports whether to mirror r, buffering its body so it can be
+// sent again
+func (s *shadowMirror) sample(r *http.Request) ([]byte, bool) {
+	if s == nil || r.Header.Get(headerShadowRequest) != "" || rng.Float64()*100 >= s.percentage {
+		return nil, false
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	return body, err == nil
+}
+
+// ShadowAnswer is the part of an /authorize answer compared between the
+// primary and the shadow
+type ShadowAnswer struct {
+	StatusCode    int    `json:"status_code"`
+	Status        string `json:"status,omitempty"`
+	DeclineReason string `json:"decline_reason,omitempty"`
+	AmountMinor   int64  `json:"amount_minor,omitempty"`
+	// Code is the error code of a rejected request
+	Code string `json:"code,omitempty"`
+}
+
+// primaryAnswer is the primary's answer to a mirrored request
+func primaryAnswer(response AuthorizationResponse, rejection *authorizationRejection) ShadowAnswer {
+	if rejection != nil {
+		return ShadowAnswer{StatusCode: rejection.Status, Code: rejection.Code}
+	}
+	return ShadowAnswer{
+		StatusCode:    authorizationStatusCode(response.Status),
+		Status:        response.Status,
+		DeclineReason: response.DeclineReason,
+		AmountMinor:   response.AmountMinor,
+	}
+}
+
+// diff lists the fields in which the shadow's answer differs
+func (a ShadowAnswer) diff(shadow ShadowAnswer) []string {
+	var fields []string
+	for _, f := range []struct {
+		name  string
+		equal bool
+	}{
+		{"status_code", a.StatusCode == shadow.StatusCode},
+		{"status", a.Status == shadow.Status},
+		{"decline_reason", a.DeclineReason == shadow.DeclineReason},
+		{"amount_minor", a.AmountMinor == shadow.AmountMinor},
+		{"code", a.Code == shadow.Code},
+	} {
+		if !f.equal {
+			fields = append(fields, f.name)
+		}
+	}
+	return fields
+}
+
+// ShadowDiff is a mirrored request the shadow answered differently
+type ShadowDiff struct {
+	RequestID string       `json:"request_id"`
+	At        string       `json:"at"`
+	Fields    []string     `json:"fields"`
+	Primary   ShadowAnswer `json:"primary"`
+	Shadow    ShadowAnswer `json:"shadow"`
+	PrimaryMs float64      `json:"primary_ms"`
+	ShadowMs  float64      `json:"shadow_ms"`
+}
+
+// MirrorDiffs is the body of GET /admin/mirror/diffs
+type MirrorDiffs struct {
+	Enabled   bool   `json:"enabled"`
+	ShadowURL string `json:"shadow_url,omitempty"`
+	// Compared counts the mirrored requests the shadow answered
+	Compared   int64            `json:"compared"`
+	Mismatched int64            `json:"mismatched"`
+	ByField    map[string]int64 `json:"mismatches_by_field"`
+	// Diffs are the latest mismatches, newest first
+	Diffs []ShadowDiff `json:"diffs"`
+}
+
+// diffLog counts compared answers and keeps the latest mismatches
+type diffLog struct {
+	mu         sync.Mutex
+	compared   int64
+	mismatched int64
+	byField    map[string]int64
+	samples    []ShadowDiff
+	// next is where the next sample goes once samples is full
+	next int
+	max  int
+}
+
+var mirrorDiffs = &diffLog{byField: make(map[string]int64), max: 100}
+
+// reset clears the counts and samples, keeping up to max samples from now
+func (l *diffLog) reset(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compared, l.mismatched, l.next, l.max = 0, 0, 0, max
+	l.byField = make(map[string]int64)
+	l.samples = nil
+}
+
+func (l *diffLog) record(d ShadowDiff) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.compared++
+	if len(d.Fields) == 0 {
+		return
+	}
+	l.mismatched++
+	for _, field := range d.Fields {
+		l.byField[field]++
+	}
+	if l.max == 0 {
+		return
+	}
+	if len(l.samples) < l.max {
+		l.samples = append(l.samples, d)
+		return
+	}
+	l.samples[l.next] = d
+	l.next = (l.next + 1) % l.max
+}
+
+func (l *diffLog) snapshot() MirrorDiffs {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	diffs := MirrorDiffs{
+		Compared:   l.compared,
+		Mismatched: l.mismatched,
+		ByField:    make(map[string]int64, len(l.byField)),
+		Diffs:      make([]ShadowDiff, 0, len(l.samples)),
+	}
+	for field, n := range l.byField {
+		diffs.ByField[field] = n
+	}
+	// The oldest sample is at next once the ring has wrapped
+	for i := len(l.samples) - 1; i >= 0; i-- {
+		diffs.Diffs = append(diffs.Diffs, l.samples[(l.next+i)%len(l.samples)])
+	}
+	return diffs
+}
+
+// mirror sends a copy of a request the primary gave primary after
+// primaryDuration, and diffs the shadow's answer. Past
+// SHADOW_MAX_IN_FLIGHT mirrored requests awaiting the shadow, it is dropped
+// rather than queued.
+func (s *shadowMirror) mirror(header http.Header, body []byte, requestID string, primary ShadowAnswer, primaryDuration time.Duration) {
+	if s.inFlight.Add(1) > s.maxInFlight {
+		s.inFlight.Add(-1)
+		shadowRequestsTotal.WithLabelValues(shadowDropped).Inc()
+		return
+	}
+	defer s.inFlight.Add(-1)
+
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		shadowRequestsTotal.WithLabelValues(shadowError).Inc()
+		return
+	}
+	req.Header = header
+	req.Header.Set(headerShadowRequest, "true")
+	start := time.Now()
+	resp, err := s.client.Do(req)
+	if err != nil {
+		shadowRequestsTotal.WithLabelValues(shadowError).Inc()
+		log.Printf("Shadow request failed: %v", err)
+		return
+	}
+	var shadow ShadowAnswer
+	_ = json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&shadow)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	shadow.StatusCode = resp.StatusCode
+	shadowDuration := time.Since(start)
+	shadowDurationSeconds.WithLabelValues("shadow").Observe(shadowDuration.Seconds())
+	shadowDurationSeconds.WithLabelValues("primary").Observe(primaryDuration.Seconds())
+	shadowStatusTotal.WithLabelValues(strconv.Itoa(primary.StatusCode), strconv.Itoa(shadow.StatusCode)).Inc()
+
+	fields := primary.diff(shadow)
+	result := shadowMatch
+	if len(fields) > 0 {
+		result = shadowMismatch
+	}
+	shadowRequestsTotal.WithLabelValues(result).Inc()
+	for _, field := range fields {
+		shadowDiffsTotal.WithLabelValues(field).Inc()
+	}
+	mirrorDiffs.record(ShadowDiff{
+		RequestID: requestID,
+		At:        formatTimestamp(start),
+		Fields:    fields,
+		Primary:   primary,
+		Shadow:    shadow,
+		PrimaryMs: float64(primaryDuration.Microseconds()) / 1000,
+		ShadowMs:  float64(shadowDuration.Microseconds()) / 1000,
+	})
+}
+
+// handleMirrorDiffs reports how the shadow's answers differ from the
+// primary's, with the latest mismatches (GET /admin/mirror/diffs)
+func handleMirrorDiffs(w http.ResponseWriter, r *http.Request) {
+	diffs := mirrorDiffs.snapshot()
+	if shadowTraffic != nil {
+		diffs.Enabled, diffs.ShadowURL = true, shadowTraffic.url
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(diffs)
+}
+
+// handleMirrorDiffsReset clears the counts and samples, e.g. after
+// redeploying the shadow (DELETE /admin/mirror/diffs)
+func handleMirrorDiffsReset(w http.ResponseWriter, r *http.Request) {
+	mirrorDiffs.mu.Lock()
+	max := mirrorDiffs.max
+	mirrorDiffs.mu.Unlock()
+	mirrorDiffs.reset(max)
+	w.WriteHeader(http.StatusNoContent)
+}
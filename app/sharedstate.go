@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// Cache backends, chosen by CACHE_BACKEND
+const (
+	cacheMemory = "memory"
+	cacheRedis  = "redis"
+)
+
+// redisTimeout bounds each Redis call, so a slow Redis delays a request by
+// at most this much before the replica falls back to its own state
+const redisTimeout = 200 * time.Millisecond
+
+// sharedOutcomesInterval is how often outcomes are pushed to Redis and the
+// shared success rates read back
+const sharedOutcomesInterval = time.Second
+
+var redisFallbacksTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_redis_fallbacks_total",
+		Help: "Total number of times a subsystem fell back to local state because Redis failed",
+	},
+	[]string{"subsystem"},
+)
+
+func init() {
+	prometheus.MustRegister(redisFallbacksTotal)
+}
+
+// sharedRedis is the Redis client holding the state replicas share, nil
+// when each replica keeps its own
+var sharedRedis atomic.Pointer[redis.Client]
+
+// loadSharedRedis reads REDIS_URL, the Redis that shared caches,
+// idempotency records, rate limit buckets and success rates live in.
+// CACHE_BACKEND=memory keeps them local anyway; CACHE_BACKEND=redis without
+// REDIS_URL uses redis://localhost:6379/0.
+func loadSharedRedis() (*redis.Client, error) {
+	url := getEnv("REDIS_URL", "")
+	backend := cacheMemory
+	if url != "" {
+		backend = cacheRedis
+	}
+	switch backend = getEnv("CACHE_BACKEND", backend); backend {
+	case cacheMemory:
+		return nil, nil
+	case cacheRedis:
+	default:
+		return nil, fmt.Errorf("invalid CACHE_BACKEND %q, expected %s or %s", backend, cacheMemory, cacheRedis)
+	}
+	if url == "" {
+		url = "redis://localhost:6379/0"
+	}
+	opts, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, fmt.Errorf("invalid REDIS_URL: %w", err)
+	}
+	return redis.NewClient(opts), nil
+}
+
+// redisErrorLog throttles Redis error logs to one per subsystem every 10
+// seconds, so an outage doesn't log once per request
+var redisErrorLog = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: make(map[string]time.Time)}
+
+// redisFallback records that subsystem used its local state because of err
+func redisFallback(subsystem string, err error) {
+	redisFallbacksTotal.WithLabelValues(subsystem).Inc()
+	logRedisError(subsystem, err)
+}
+
+func logRedisError(subsystem string, err error) {
+	redisErrorLog.Lock()
+	defer redisErrorLog.Unlock()
+	if now := time.Now(); now.Sub(redisErrorLog.last[subsystem]) >= 10*time.Second {
+		redisErrorLog.last[subsystem] = now
+		log.Printf("Redis failed for %s: %v", subsystem, err)
+	}
+}
+
+// takeTokenScript is the token bucket of rateLimiter.allow run atomically
+// in Redis. The bucket expires once it would have refilled anyway.
+var takeTokenScript = redis.NewScript(`
+local rate, burst, now = tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3])
+local bucket = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens, ts = tonumber(bucket[1]), tonumber(bucket[2])
+if tokens == nil then
+  tokens, ts = burst, now
+end
+if now < ts then
+  now = ts
+end
+tokens = math.min(burst, tokens + (now - ts) / 1000 * rate)
+local allowed, wait = 0, 0
+if tokens >= 1 then
+  tokens, allowed = tokens - 1, 1
+else
+  wait = math.ceil((1 - tokens) / rate * 1000)
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil(burst / rate * 1000) + 1000)
+return {allowed, wait}
+`)
+
+// takeSharedToken takes a token from the bucket key shares with every
+// replica
+func takeSharedToken(client *redis.Client, key string, limit rateLimit, now time.Time) (bool, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	result, err := takeTokenScript.Run(ctx, client, []string{"voyager:ratelimit:" + key},
+		limit.RPS, limit.Burst, now.UnixMilli()).Int64Slice()
+	if err != nil {
+		return false, 0, err
+	}
+	return result[0] == 1, time.Duration(result[1]) * time.Millisecond, nil
+}
+
+// sharedIdempotencyRecord looks key up among the idempotency records
+// replicas share. It reports false when Redis has none or fails, and the
+// replica's own store decides.
+func sharedIdempotencyRecord(ctx context.Context, key string) (idempotencyRecord, bool) {
+	client := sharedRedis.Load()
+	if client == nil {
+		return idempotencyRecord{}, false
+	}
+	ctx, cancel := context.WithTimeout(ctx, redisTimeout)
+	defer cancel()
+	var rec idempotencyRecord
+	data, err := client.Get(ctx, "voyager:idempotency:"+key).Bytes()
+	if err == nil {
+		err = json.Unmarshal(data, &rec)
+	}
+	if err != nil {
+		if err != redis.Nil {
+			redisFallback("idempotency", err)
+		}
+		return idempotencyRecord{}, false
+	}
+	return rec, true
+}
+
+// shareIdempotencyRecord stores rec for the other replicas until the key's
+// TTL runs out
+func shareIdempotencyRecord(key string, rec idempotencyRecord) {
+	client := sharedRedis.Load()
+	if client == nil {
+		return
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	if err := client.Set(ctx, "voyager:idempotency:"+key, data, getIdempotencyKeyTTL()).Err(); err != nil {
+		redisFallback("idempotency", err)
+	}
+}
+
+// sharedOutcomeWindows pools every replica's processor outcomes in Redis,
+// one list of the last successWindow per processor. Outcomes are pushed
+// and the pooled success rates read back every sharedOutcomesInterval.
+type sharedOutcomeWindows struct {
+	mu sync.Mutex
+	// pending are the outcomes not pushed yet, "1" for approved
+	pending map[string][]interface{}
+	rates   map[string]sharedRate
+}
+
+// sharedRate is a processor's success rate over the pooled window
+type sharedRate struct {
+	rate    float64
+	samples int
+	at      time.Time
+}
+
+var sharedOutcomes = &sharedOutcomeWindows{
+	pending: make(map[string][]interface{}),
+	rates:   make(map[string]sharedRate),
+}
+
+func (s *sharedOutcomeWindows) add(processor string, approved bool) {
+	outcome := "0"
+	if approved {
+		outcome = "1"
+	}
+	s.mu.Lock()
+	s.pending[processor] = append(s.pending[processor], outcome)
+	s.mu.Unlock()
+}
+
+// rate returns the pooled success rate, or false when it is stale, because
+// Redis failed, or has fewer than minSuccessSamples outcomes
+func (s *sharedOutcomeWindows) rate(processor string, now time.Time) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r, ok := s.rates[processor]
+	if !ok || r.samples < minSuccessSamples || now.Sub(r.at) > 3*sharedOutcomesInterval {
+		return 0, false
+	}
+	return r.rate, true
+}
+
+// sync pushes the pending outcomes and reads every processor's window back
+func (s *sharedOutcomeWindows) sync(client *redis.Client) error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = make(map[string][]interface{})
+	s.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+	pipe := client.Pipeline()
+	windows := make(map[string]*redis.StringSliceCmd)
+	for _, p := range processors.all() {
+		key := "voyager:outcomes:" + p.Name()
+		if outcomes := pending[p.Name()]; len(outcomes) > 0 {
+			pipe.RPush(ctx, key, outcomes...)
+			pipe.LTrim(ctx, key, -successWindow, -1)
+		}
+		windows[p.Name()] = pipe.LRange(ctx, key, 0, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	rates := make(map[string]sharedRate, len(windows))
+	for processor, cmd := range windows {
+		window := cmd.Val()
+		if len(window) == 0 {
+			continue
+		}
+		approved := 0
+		for _, outcome := range window {
+			if n, _ := strconv.Atoi(outcome); n == 1 {
+				approved++
+			}
+		}
+		rates[processor] = sharedRate{rate: float64(approved) / float64(len(window)), samples: len(window), at: now}
+	}
+	s.mu.Lock()
+	s.rates = rates
+	s.mu.Unlock()
+	return nil
+}
+
+// watchSharedOutcomes syncs the pooled success rates while Redis is set
+func watchSharedOutcomes() {
+	for range time.Tick(sharedOutcomesInterval) {
+		client := sharedRedis.Load()
+		if client == nil {
+			continue
+		}
+		if err := sharedOutcomes.sync(client); err != nil {
+			redisFallback("success_rates", err)
+		}
+	}
+}
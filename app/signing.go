@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Signed requests carry a hex HMAC-SHA256 of "<timestamp>.<body>" keyed with
+// the merchant's signing secret, plus the unix timestamp used to compute it.
+const (
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+)
+
+var signatureVerificationsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_signature_verifications_total",
+		Help: "Total number of request signature verifications by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(signatureVerificationsTotal)
+}
+
+// signingSecretStore maps merchant IDs to their HMAC signing secret
+type signingSecretStore struct {
+	secrets map[string]string
+	// retired are secrets rotated out that still verify until their grace
+	// period ends
+	retired map[string]retiredCredential
+}
+
+// signingSecrets holds the merchants' signing secrets
+var signingSecrets atomic.Pointer[signingSecretStore]
+
+// secretFor returns the secret a merchant signs with
+func secretFor(merchantID string) (string, bool) {
+	store := signingSecrets.Load()
+	if store == nil {
+		return "", false
+	}
+	secret, ok := store.secrets[merchantID]
+	return secret, ok
+}
+
+// retire keeps the secrets of previous that were replaced or removed, and
+// those still in their grace period, verifying until until
+func (s *signingSecretStore) retire(previous *signingSecretStore, until time.Time) {
+	if previous == nil {
+		return
+	}
+	s.retired = make(map[string]retiredCredential)
+	now := time.Now()
+	for merchantID, r := range previous.retired {
+		if s.secrets[merchantID] != r.value && now.Before(r.until) {
+			s.retired[merchantID] = r
+		}
+	}
+	if !until.After(now) {
+		return
+	}
+	for merchantID, secret := range previous.secrets {
+		if s.secrets[merchantID] != secret {
+			s.retired[merchantID] = retiredCredential{value: secret, until: until}
+		}
+	}
+}
+
+// loadSigningSecrets reads SIGNING_SECRETS (comma separated
+// merchant_id=secret pairs) and SIGNING_SECRETS_FILE (JSON object of
+// merchant_id to secret)
+func loadSigningSecrets() (map[string]string, error) {
+	secrets := make(map[string]string)
+
+	for _, pair := range strings.Split(os.Getenv("SIGNING_SECRETS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		merchantID, secret, ok := strings.Cut(pair, "=")
+		if !ok || merchantID == "" || secret == "" {
+			return nil, fmt.Errorf("invalid SIGNING_SECRETS entry for %q, expected merchant_id=secret", merchantID)
+		}
+		secrets[merchantID] = secret
+	}
+
+	if path := os.Getenv("SIGNING_SECRETS_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading SIGNING_SECRETS_FILE: %w", err)
+		}
+		var entries map[string]string
+		if err := json.Unmarshal(data, &entries); err != nil {
+			return nil, fmt.Errorf("parsing SIGNING_SECRETS_FILE: %w", err)
+		}
+		for merchantID, secret := range entries {
+			if merchantID == "" || secret == "" {
+				return nil, fmt.Errorf("SIGNING_SECRETS_FILE contains an empty merchant_id or secret")
+			}
+			secrets[merchantID] = secret
+		}
+	}
+
+	return secrets, nil
+}
+
+// getSignatureTolerance returns how far a signature timestamp may drift
+// from the server clock before the request is treated as a replay
+func getSignatureTolerance() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("SIGNATURE_TOLERANCE_SECONDS", "300"))
+	if err != nil || seconds <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// computeSignature returns the hex HMAC-SHA256 of "<timestamp>.<body>"
+func computeSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// seenSignatures remembers signatures seen inside the tolerance window so
+// a captured request can't be resubmitted while its timestamp is still
+// valid. It is shared, so with CACHE_BACKEND=redis a request replayed to
+// another replica is caught too.
+var seenSignatures = newTTLCache[bool]("signatures", 1000000, true)
+
+// markSignatureSeen records a signature and reports whether it was already
+// used
+func markSignatureSeen(signature string, expiresAt time.Time) bool {
+	return !seenSignatures.add(signature, true, max(time.Until(expiresAt), time.Second))
+}
+
+// requireSignature verifies the X-Signature header against the merchant's
+// signing secret. Unsigned requests pass through unless
+// REQUIRE_SIGNATURE=true; a signature that is present must always verify.
+func requireSignature(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		signature := r.Header.Get(signatureHeader)
+		if signature == "" {
+			if getEnv("REQUIRE_SIGNATURE", "false") == "true" {
+				signatureVerificationsTotal.WithLabelValues("missing").Inc()
+				writeError(w, r, http.StatusUnauthorized, errCodeInvalidSignature, "Missing request signature", nil)
+				return
+			}
+			next(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeValidationError(w, r, []FieldViolation{{"body", "could not be read"}})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		timestamp := r.Header.Get(signatureTimestampHeader)
+		unix, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			signatureVerificationsTotal.WithLabelValues("invalid_timestamp").Inc()
+			writeError(w, r, http.StatusUnauthorized, errCodeInvalidSignature, "Missing or invalid signature timestamp", nil)
+			return
+		}
+		tolerance := getSignatureTolerance()
+		signedAt := time.Unix(unix, 0)
+		if math.Abs(time.Since(signedAt).Seconds()) > tolerance.Seconds() {
+			signatureVerificationsTotal.WithLabelValues("expired").Inc()
+			writeError(w, r, http.StatusUnauthorized, errCodeInvalidSignature, "Signature timestamp outside tolerance", nil)
+			return
+		}
+
+		merchantID, ok := merchantFromContext(r.Context())
+		if !ok {
+			var payload struct {
+				MerchantID string `json:"merchant_id"`
+			}
+			_ = json.Unmarshal(body, &payload)
+			merchantID = payload.MerchantID
+		}
+		store := signingSecrets.Load()
+		if store == nil {
+			store = &signingSecretStore{}
+		}
+		secret, ok := store.secrets[merchantID]
+		retired, inGrace := store.retired[merchantID]
+		inGrace = inGrace && time.Now().Before(retired.until)
+		if !ok && !inGrace {
+			signatureVerificationsTotal.WithLabelValues("unknown_merchant").Inc()
+			writeError(w, r, http.StatusUnauthorized, errCodeInvalidSignature, "No signing secret configured for merchant", nil)
+			return
+		}
+
+		// During a rotation the previous secret verifies too
+		signature = strings.ToLower(signature)
+		expected := computeSignature(secret, timestamp, body)
+		if !ok || !hmac.Equal([]byte(expected), []byte(signature)) {
+			if !inGrace {
+				signatureVerificationsTotal.WithLabelValues("invalid").Inc()
+				writeError(w, r, http.StatusUnauthorized, errCodeInvalidSignature, "Invalid request signature", nil)
+				return
+			}
+			expected = computeSignature(retired.value, timestamp, body)
+			if !hmac.Equal([]byte(expected), []byte(signature)) {
+				signatureVerificationsTotal.WithLabelValues("invalid").Inc()
+				writeError(w, r, http.StatusUnauthorized, errCodeInvalidSignature, "Invalid request signature", nil)
+				return
+			}
+			retiredCredentialUsesTotal.WithLabelValues("signing_secret").Inc()
+		}
+
+		if markSignatureSeen(expected, signedAt.Add(tolerance)) {
+			signatureVerificationsTotal.WithLabelValues("replayed").Inc()
+			writeError(w, r, http.StatusUnauthorized, errCodeInvalidSignature, "Request signature already used", nil)
+			return
+		}
+
+		signatureVerificationsTotal.WithLabelValues("valid").Inc()
+		next(w, r)
+	}
+}
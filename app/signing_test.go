@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSigningSecrets(t *testing.T) {
+	cases := []struct {
+		name    string
+		env     string
+		file    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"env", "m1=s1,m2=s2", "", map[string]string{"m1": "s1", "m2": "s2"}, false},
+		{"file", "", `{"m1": "s1"}`, map[string]string{"m1": "s1"}, false},
+		{"file wins over env", "m1=s1", `{"m1": "s2"}`, map[string]string{"m1": "s2"}, false},
+		{"empty env secret", "m1=", "", nil, true},
+		{"empty env merchant", "=s1", "", nil, true},
+		{"empty file secret", "", `{"m1": ""}`, nil, true},
+		{"empty file merchant", "", `{"": "s1"}`, nil, true},
+		{"invalid file", "", `["m1"]`, nil, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("SIGNING_SECRETS", tc.env)
+			t.Setenv("SIGNING_SECRETS_FILE", "")
+			if tc.file != "" {
+				path := filepath.Join(t.TempDir(), "secrets.json")
+				if err := os.WriteFile(path, []byte(tc.file), 0o600); err != nil {
+					t.Fatal(err)
+				}
+				t.Setenv("SIGNING_SECRETS_FILE", path)
+			}
+			got, err := loadSigningSecrets()
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("loadSigningSecrets: %v, want error %v", err, tc.wantErr)
+			}
+			if tc.wantErr {
+				return
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for merchantID, secret := range tc.want {
+				if got[merchantID] != secret {
+					t.Errorf("secret for %s: got %q, want %q", merchantID, got[merchantID], secret)
+				}
+			}
+		})
+	}
+}
+
+// serveSigned sends body to a handler behind requireSignature, signed
+// with secret at signedAt unless secret is empty, and returns the status
+func serveSigned(body, secret string, signedAt time.Time) int {
+	r := httptest.NewRequest(http.MethodPost, "/authorize", strings.NewReader(body))
+	if secret != "" {
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+		r.Header.Set(signatureTimestampHeader, timestamp)
+		r.Header.Set(signatureHeader, computeSignature(secret, timestamp, []byte(body)))
+	}
+	w := httptest.NewRecorder()
+	requireSignature(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})(w, r)
+	return w.Code
+}
+
+func TestRequireSignature(t *testing.T) {
+	t.Setenv("REQUIRE_SIGNATURE", "false")
+	defer signingSecrets.Store(signingSecrets.Load())
+	signingSecrets.Store(&signingSecretStore{secrets: map[string]string{"merchant_signed": "s3cret"}})
+
+	now := time.Now()
+	cases := []struct {
+		name     string
+		body     string
+		secret   string
+		signedAt time.Time
+		want     int
+	}{
+		{"valid", `{"merchant_id":"merchant_signed","n":1}`, "s3cret", now, http.StatusOK},
+		{"wrong secret", `{"merchant_id":"merchant_signed","n":2}`, "other", now, http.StatusUnauthorized},
+		{"unknown merchant", `{"merchant_id":"merchant_other","n":3}`, "s3cret", now, http.StatusUnauthorized},
+		{"stale", `{"merchant_id":"merchant_signed","n":4}`, "s3cret", now.Add(-time.Hour), http.StatusUnauthorized},
+		{"unsigned", `{"merchant_id":"merchant_signed","n":5}`, "", now, http.StatusOK},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := serveSigned(tc.body, tc.secret, tc.signedAt); got != tc.want {
+				t.Errorf("status %d, want %d", got, tc.want)
+			}
+		})
+	}
+
+	t.Run("replayed", func(t *testing.T) {
+		body := `{"merchant_id":"merchant_signed","n":6}`
+		if got := serveSigned(body, "s3cret", now); got != http.StatusOK {
+			t.Fatalf("first request: status %d, want 200", got)
+		}
+		if got := serveSigned(body, "s3cret", now); got != http.StatusUnauthorized {
+			t.Errorf("replayed request: status %d, want 401", got)
+		}
+	})
+
+	t.Run("replayed while Redis is down", func(t *testing.T) {
+		useRedisDown(t)
+		body := `{"merchant_id":"merchant_signed","n":7}`
+		if got := serveSigned(body, "s3cret", now); got != http.StatusOK {
+			t.Fatalf("first request: status %d, want 200", got)
+		}
+		if got := serveSigned(body, "s3cret", now); got != http.StatusUnauthorized {
+			t.Errorf("replayed request: status %d, want 401", got)
+		}
+	})
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sloBucket is how finely authorizations are counted; burn rates include
+// the current, partial bucket
+const sloBucket = time.Minute
+
+// sloWindows are the windows burn rates are computed over, from the
+// multi-window alerts in the Google SRE workbook
+var sloWindows = []struct {
+	name     string
+	duration time.Duration
+}{
+	{"5m", 5 * time.Minute},
+	{"30m", 30 * time.Minute},
+	{"1h", time.Hour},
+	{"2h", 2 * time.Hour},
+	{"6h", 6 * time.Hour},
+	{"1d", 24 * time.Hour},
+	{"3d", 72 * time.Hour},
+}
+
+// sloAlerts fire when both windows burn faster than threshold: the long
+// window shows the budget is really being spent, the short one that it
+// still is. At 14.4 a 30-day budget lasts about two days.
+var sloAlerts = []struct {
+	severity    string
+	longWindow  string
+	shortWindow string
+	threshold   float64
+}{
+	{"page", "1h", "5m", 14.4},
+	{"page", "6h", "30m", 6},
+	{"ticket", "1d", "2h", 3},
+	{"ticket", "3d", "6h", 1},
+}
+
+// sloCount is the authorizations finished in one bucket, slow ones being
+// those over the latency threshold
+type sloCount struct {
+	bucket int64
+	total  int64
+	slow   int64
+}
+
+// latencySLO tracks how many authorizations meet the latency objective,
+// over a ring of buckets spanning the longest window
+type latencySLO struct {
+	threshold time.Duration
+	objective float64
+
+	mu     sync.Mutex
+	counts []sloCount
+}
+
+var authorizationSLO = loadLatencySLO()
+
+// loadLatencySLO reads SLO_LATENCY_MS and SLO_OBJECTIVE, the share of
+// authorizations that must finish within it
+func loadLatencySLO() *latencySLO {
+	ms, err := strconv.Atoi(getEnv("SLO_LATENCY_MS", "250"))
+	if err != nil || ms <= 0 {
+		ms = 250
+	}
+	objective, err := strconv.ParseFloat(getEnv("SLO_OBJECTIVE", "0.99"), 64)
+	if err != nil || objective <= 0 || objective >= 1 {
+		objective = 0.99
+	}
+	longest := sloWindows[len(sloWindows)-1].duration
+	return &latencySLO{
+		threshold: time.Duration(ms) * time.Millisecond,
+		objective: objective,
+		counts:    make([]sloCount, longest/sloBucket),
+	}
+}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "voyager_slo_objective_ratio",
+			Help: "Share of authorizations that must finish within the latency SLO threshold",
+		},
+		func() float64 { return authorizationSLO.objective },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "voyager_slo_latency_threshold_seconds",
+			Help: "Latency an authorization must finish within to meet the SLO",
+		},
+		func() float64 { return authorizationSLO.threshold.Seconds() },
+	))
+	for _, window := range sloWindows {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "voyager_slo_burn_rate",
+				Help:        "Rate the latency SLO's error budget is being spent over the window; 1 spends it exactly",
+				ConstLabels: prometheus.Labels{"window": window.name},
+			},
+			func() float64 { return authorizationSLO.burnRate(window.duration, time.Now()) },
+		))
+	}
+	for _, alert := range sloAlerts {
+		prometheus.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "voyager_slo_alert_firing",
+				Help:        "1 while both windows of a multi-window burn-rate alert exceed its threshold",
+				ConstLabels: prometheus.Labels{"severity": alert.severity, "long_window": alert.longWindow, "short_window": alert.shortWindow},
+			},
+			func() float64 {
+				if authorizationSLO.firing(alert.longWindow, alert.shortWindow, alert.threshold, time.Now()) {
+					return 1
+				}
+				return 0
+			},
+		))
+	}
+}
+
+// record counts an authorization that took duration
+func (s *latencySLO) record(duration time.Duration, now time.Time) {
+	bucket := now.UnixNano() / int64(sloBucket)
+	s.mu.Lock()
+	c := &s.counts[bucket%int64(len(s.counts))]
+	if c.bucket != bucket {
+		*c = sloCount{bucket: bucket}
+	}
+	c.total++
+	if duration > s.threshold {
+		c.slow++
+	}
+	s.mu.Unlock()
+}
+
+// window sums the buckets that fall in the last d
+func (s *latencySLO) window(d time.Duration, now time.Time) (total, slow int64) {
+	current := now.UnixNano() / int64(sloBucket)
+	oldest := current - int64(d/sloBucket) + 1
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.counts {
+		if c.bucket >= oldest && c.bucket <= current {
+			total += c.total
+			slow += c.slow
+		}
+	}
+	return total, slow
+}
+
+// firing reports whether both windows burn faster than threshold
+func (s *latencySLO) firing(longWindow, shortWindow string, threshold float64, now time.Time) bool {
+	return s.burnRate(sloWindowDuration(longWindow), now) > threshold &&
+		s.burnRate(sloWindowDuration(shortWindow), now) > threshold
+}
+
+func sloWindowDuration(name string) time.Duration {
+	for _, window := range sloWindows {
+		if window.name == name {
+			return window.duration
+		}
+	}
+	return 0
+}
+
+// burnRate is the share of slow authorizations over the share the
+// objective allows; 0 with no traffic
+func (s *latencySLO) burnRate(d time.Duration, now time.Time) float64 {
+	total, slow := s.window(d, now)
+	if total == 0 {
+		return 0
+	}
+	return float64(slow) / float64(total) / (1 - s.objective)
+}
+
+// SLOWindow is the latency SLO over one window
+type SLOWindow struct {
+	Window         string  `json:"window"`
+	Authorizations int64   `json:"authorizations"`
+	Slow           int64   `json:"slow"`
+	GoodRatio      float64 `json:"good_ratio"`
+	BurnRate       float64 `json:"burn_rate"`
+}
+
+// SLOAlert is a multi-window burn-rate alert
+type SLOAlert struct {
+	Severity    string  `json:"severity"`
+	LongWindow  string  `json:"long_window"`
+	ShortWindow string  `json:"short_window"`
+	Threshold   float64 `json:"threshold"`
+	Firing      bool    `json:"firing"`
+}
+
+// SLOStatus is the latency SLO and how fast its error budget is burning
+type SLOStatus struct {
+	LatencyThresholdMs int64       `json:"latency_threshold_ms"`
+	Objective          float64     `json:"objective"`
+	Windows            []SLOWindow `json:"windows"`
+	Alerts             []SLOAlert  `json:"alerts"`
+}
+
+func (s *latencySLO) status(now time.Time) SLOStatus {
+	status := SLOStatus{
+		LatencyThresholdMs: s.threshold.Milliseconds(),
+		Objective:          s.objective,
+		Windows:            make([]SLOWindow, 0, len(sloWindows)),
+		Alerts:             make([]SLOAlert, 0, len(sloAlerts)),
+	}
+	for _, window := range sloWindows {
+		total, slow := s.window(window.duration, now)
+		w := SLOWindow{Window: window.name, Authorizations: total, Slow: slow, GoodRatio: 1}
+		if total > 0 {
+			w.GoodRatio = float64(total-slow) / float64(total)
+			w.BurnRate = math.Round(float64(slow)/float64(total)/(1-s.objective)*1000) / 1000
+		}
+		status.Windows = append(status.Windows, w)
+	}
+	for _, alert := range sloAlerts {
+		status.Alerts = append(status.Alerts, SLOAlert{
+			Severity:    alert.severity,
+			LongWindow:  alert.longWindow,
+			ShortWindow: alert.shortWindow,
+			Threshold:   alert.threshold,
+			Firing:      s.firing(alert.longWindow, alert.shortWindow, alert.threshold, now),
+		})
+	}
+	return status
+}
+
+// handleSLOStatus reports the latency SLO's burn rates (GET /slo/status)
+func handleSLOStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(authorizationSLO.status(time.Now()))
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// snapshotVersion is the format of the snapshots written, the only one
+// restored
+const snapshotVersion = 1
+
+// errSnapshotsUnsupported is returned when the transactions aren't held in
+// memory, so there's nothing a snapshot could safely replace
+var errSnapshotsUnsupported = errors.New("snapshots need STORAGE_BACKEND=memory")
+
+// Snapshot is the simulator's state in the default namespace: what a demo
+// environment is reset to. Tenants aren't included.
+type Snapshot struct {
+	Version   int    `json:"version"`
+	CreatedAt string `json:"created_at"`
+	// Transactions are oldest first
+	Transactions []Transaction      `json:"transactions"`
+	Refunds      []Refund           `json:"refunds"`
+	Captures     []Capture          `json:"captures"`
+	Merchants    []SnapshotMerchant `json:"merchants"`
+	// ConfigOverrides are those set through PUT /admin/config; without
+	// them, restoring clears the overrides
+	ConfigOverrides *RuntimeConfig `json:"config_overrides,omitempty"`
+	// ChaosExperiments resume with the time they had left when the
+	// snapshot was taken
+	ChaosExperiments []ChaosExperiment `json:"chaos_experiments"`
+}
+
+// SnapshotMerchant is an onboarded merchant with the hash of its API key,
+// so the key keeps working after a restore
+type SnapshotMerchant struct {
+	Merchant
+	APIKeyHash string `json:"api_key_hash,omitempty"`
+}
+
+// SnapshotSummary counts what a snapshot holds. It is the body returned
+// when one is saved or restored.
+type SnapshotSummary struct {
+	Name             string `json:"name,omitempty"`
+	Location         string `json:"location,omitempty"`
+	CreatedAt        string `json:"created_at"`
+	Transactions     int    `json:"transactions"`
+	Refunds          int    `json:"refunds"`
+	Merchants        int    `json:"merchants"`
+	ChaosExperiments int    `json:"chaos_experiments"`
+}
+
+// SnapshotSaveRequest is the optional body of POST /admin/snapshots
+type SnapshotSaveRequest struct {
+	// Name defaults to the time the snapshot is taken, e.g.
+	// 20260102T150405Z
+	Name string `json:"name,omitempty"`
+}
+
+func (s *Snapshot) summary() SnapshotSummary {
+	return SnapshotSummary{
+		CreatedAt:        s.CreatedAt,
+		Transactions:     len(s.Transactions),
+		Refunds:          len(s.Refunds),
+		Merchants:        len(s.Merchants),
+		ChaosExperiments: len(s.ChaosExperiments),
+	}
+}
+
+// snapshotKey is where the snapshot called name is kept in the artifact
+// store
+func snapshotKey(name string) string {
+	return path.Join("snapshots", name+".json")
+}
+
+// takeSnapshot captures the state of the default namespace
+func takeSnapshot(now time.Time) (*Snapshot, error) {
+	store, ok := storage.(*memoryStore)
+	if !ok {
+		return nil, errSnapshotsUnsupported
+	}
+	txns, refunds, captures, merchants := store.dump()
+	snap := &Snapshot{
+		Version:          snapshotVersion,
+		CreatedAt:        formatTimestamp(now),
+		Transactions:     txns,
+		Refunds:          refunds,
+		Captures:         captures,
+		Merchants:        make([]SnapshotMerchant, 0, len(merchants)),
+		ConfigOverrides:  configLayers.adminOverrides(),
+		ChaosExperiments: chaos.active(),
+	}
+	for _, m := range merchants {
+		snap.Merchants = append(snap.Merchants, SnapshotMerchant{Merchant: m, APIKeyHash: m.apiKeyHash})
+	}
+	return snap, nil
+}
+
+// restoreSnapshot replaces the state of the default namespace, held in
+// store, with snap.
+// Nothing changes when the snapshot is invalid. Idempotency keys and the
+// records derived from transactions, such as settlements, start over
+// empty; the audit trail is kept.
+func restoreSnapshot(ctx context.Context, store *memoryStore, snap *Snapshot, now time.Time) []FieldViolation {
+	if snap.Version != snapshotVersion {
+		return []FieldViolation{{"version", fmt.Sprintf("must be %d", snapshotVersion)}}
+	}
+	taken, err := time.Parse(time.RFC3339, snap.CreatedAt)
+	if err != nil {
+		return []FieldViolation{{"created_at", "must be an RFC 3339 timestamp"}}
+	}
+
+	var violations []FieldViolation
+	experiments := make([]*ChaosExperiment, 0, len(snap.ChaosExperiments))
+	for i, e := range snap.ChaosExperiments {
+		expires, err := time.Parse(time.RFC3339, e.ExpiresAt)
+		if err != nil {
+			violations = append(violations, FieldViolation{fmt.Sprintf("chaos_experiments[%d].expires_at", i), "must be an RFC 3339 timestamp"})
+			continue
+		}
+		left := expires.Sub(taken)
+		if left <= 0 {
+			continue
+		}
+		e.TTLSeconds = int(math.Ceil(left.Seconds()))
+		for _, v := range e.validate(now) {
+			violations = append(violations, FieldViolation{fmt.Sprintf("chaos_experiments[%d].%s", i, v.Field), v.Message})
+		}
+		experiments = append(experiments, &e)
+	}
+	if len(violations) > 0 {
+		return violations
+	}
+
+	overrides := snap.ConfigOverrides
+	if overrides == nil {
+		overrides = &RuntimeConfig{}
+	}
+	var previous RuntimeConfig
+	_, adminViolations := configLayers.updateAdmin(func(current *RuntimeConfig) {
+		previous, *current = *current, *overrides
+	})
+	for _, v := range adminViolations {
+		violations = append(violations, FieldViolation{"config_overrides." + v.Field, v.Message})
+	}
+	if len(violations) > 0 {
+		return violations
+	}
+
+	merchants := make([]Merchant, 0, len(snap.Merchants))
+	for _, m := range snap.Merchants {
+		m.Merchant.apiKeyHash = m.APIKeyHash
+		merchants = append(merchants, m.Merchant)
+	}
+	before, beforeRefunds, beforeCaptures, beforeMerchants := store.dump()
+	store.restore(snap.Transactions, snap.Refunds, snap.Captures, merchants)
+	if _, err := syncMerchants(ctx); err != nil {
+		// The merchants conflict with the config; put everything back
+		store.restore(before, beforeRefunds, beforeCaptures, beforeMerchants)
+		_, _ = configLayers.updateAdmin(func(current *RuntimeConfig) { *current = previous })
+		_, _ = syncMerchants(ctx)
+		return []FieldViolation{{"merchants", err.Error()}}
+	}
+	chaos.replace(experiments)
+	return nil
+}
+
+// loadStartupSnapshot restores SNAPSHOT_FILE, a snapshot on local disk,
+// or SNAPSHOT_NAME, one saved to the artifact store, and returns its
+// summary. It returns nil when neither is set.
+func loadStartupSnapshot() (*SnapshotSummary, error) {
+	file, name := os.Getenv("SNAPSHOT_FILE"), os.Getenv("SNAPSHOT_NAME")
+	if file == "" && name == "" {
+		return nil, nil
+	}
+	store, ok := storage.(*memoryStore)
+	if !ok {
+		return nil, errSnapshotsUnsupported
+	}
+	var body io.ReadCloser
+	var err error
+	switch {
+	case file != "" && name != "":
+		return nil, fmt.Errorf("set SNAPSHOT_FILE or SNAPSHOT_NAME, not both")
+	case file != "":
+		body, err = os.Open(file)
+	case name != "":
+		if artifacts == nil {
+			return nil, fmt.Errorf("SNAPSHOT_NAME needs an artifact store; set ARTIFACT_STORE")
+		}
+		ctx, cancel := storageContext()
+		defer cancel()
+		body, err = artifacts.download(ctx, snapshotKey(name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	var snap Snapshot
+	if err := json.NewDecoder(body).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("decoding snapshot: %w", err)
+	}
+	ctx, cancel := storageContext()
+	defer cancel()
+	if violations := restoreSnapshot(ctx, store, &snap, time.Now()); len(violations) > 0 {
+		return nil, fmt.Errorf("%s %s", violations[0].Field, violations[0].Message)
+	}
+	summary := snap.summary()
+	summary.Name = name
+	return &summary, nil
+}
+
+// handleSnapshotGet downloads the current state as a snapshot (GET
+// /admin/snapshot)
+func handleSnapshotGet(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	snap, err := takeSnapshot(now)
+	if err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, errCodeSnapshotUnavailable, "Snapshots need STORAGE_BACKEND=memory", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="snapshot-`+now.UTC().Format("20060102T150405Z")+`.json"`)
+	_ = json.NewEncoder(w).Encode(snap)
+}
+
+// handleSnapshotSave saves the current state to the artifact store (POST
+// /admin/snapshots)
+func handleSnapshotSave(w http.ResponseWriter, r *http.Request) {
+	if artifacts == nil {
+		writeError(w, r, http.StatusServiceUnavailable, errCodeSnapshotUnavailable,
+			"Saving snapshots needs an artifact store; set ARTIFACT_STORE", nil)
+		return
+	}
+	var req SnapshotSaveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON snapshot request"}})
+		return
+	}
+	if req.Name != "" && !merchantIDPattern.MatchString(req.Name) {
+		writeValidationError(w, r, []FieldViolation{{"name", "must be 1-64 characters of letters, digits, '_' or '-'"}})
+		return
+	}
+
+	now := time.Now()
+	snap, err := takeSnapshot(now)
+	if err != nil {
+		writeError(w, r, http.StatusServiceUnavailable, errCodeSnapshotUnavailable, "Snapshots need STORAGE_BACKEND=memory", nil)
+		return
+	}
+	if req.Name == "" {
+		req.Name = now.UTC().Format("20060102T150405Z")
+	}
+	body, _ := json.Marshal(snap)
+	location, err := artifacts.upload(r.Context(), artifactSnapshot, snapshotKey(req.Name), bytes.NewReader(body), "application/json")
+	if err != nil {
+		log.Printf("Snapshot failed: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeSnapshotUnavailable, "Snapshot upload failed", nil)
+		return
+	}
+	summary := snap.summary()
+	summary.Name, summary.Location = req.Name, location
+	log.Printf("Snapshot %s saved via admin API to %s: %d transactions, %d merchants", req.Name, location, summary.Transactions, summary.Merchants)
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditSnapshotSaved, ResourceType: "snapshot", ResourceID: req.Name})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(summary)
+}
+
+// handleSnapshotRestore replaces the current state with the snapshot in
+// the body (PUT /admin/snapshot)
+func handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
+	var snap Snapshot
+	if err := json.NewDecoder(r.Body).Decode(&snap); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON snapshot"}})
+		return
+	}
+	restoreAndRespond(w, r, &snap, "")
+}
+
+// handleSnapshotRestoreSaved replaces the current state with a snapshot
+// saved to the artifact store (POST /admin/snapshots/{name}/restore)
+func handleSnapshotRestoreSaved(w http.ResponseWriter, r *http.Request) {
+	if artifacts == nil {
+		writeError(w, r, http.StatusServiceUnavailable, errCodeSnapshotUnavailable,
+			"Saved snapshots need an artifact store; set ARTIFACT_STORE", nil)
+		return
+	}
+	name := r.PathValue("name")
+	if !merchantIDPattern.MatchString(name) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Snapshot not found", nil)
+		return
+	}
+	body, err := artifacts.download(r.Context(), snapshotKey(name))
+	if errors.Is(err, errArtifactNotFound) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Snapshot not found", nil)
+		return
+	}
+	if err != nil {
+		log.Printf("Snapshot %s download failed: %v", name, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeSnapshotUnavailable, "Snapshot download failed", nil)
+		return
+	}
+	defer body.Close()
+	var snap Snapshot
+	if err := json.NewDecoder(body).Decode(&snap); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "saved snapshot is not valid JSON"}})
+		return
+	}
+	restoreAndRespond(w, r, &snap, name)
+}
+
+func restoreAndRespond(w http.ResponseWriter, r *http.Request, snap *Snapshot, name string) {
+	store, ok := storage.(*memoryStore)
+	if !ok {
+		writeError(w, r, http.StatusServiceUnavailable, errCodeSnapshotUnavailable, "Snapshots need STORAGE_BACKEND=memory", nil)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	if violations := restoreSnapshot(ctx, store, snap, time.Now()); len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	summary := snap.summary()
+	summary.Name = name
+	log.Printf("Snapshot of %s restored via admin API: %d transactions, %d merchants, %d chaos experiments",
+		snap.CreatedAt, summary.Transactions, summary.Merchants, summary.ChaosExperiments)
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditSnapshotRestored, ResourceType: "snapshot", ResourceID: name})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Startup stages, in the order main completes them
+const (
+	startupProcessors = "processors_registered"
+	startupConfig     = "config_loaded"
+	startupStorage    = "storage_migrated"
+	startupWarmup     = "warmup"
+)
+
+// warmupConcurrency is how many warmup transactions run at once
+const warmupConcurrency = 10
+
+// StartupStage is one step the gateway takes before it can serve
+type StartupStage struct {
+	Name   string `json:"name"`
+	Done   bool   `json:"done"`
+	Detail string `json:"detail,omitempty"`
+	// ElapsedMs is how long after the process started the stage completed
+	ElapsedMs int64 `json:"elapsed_ms,omitempty"`
+}
+
+// StartupStatus is the body of GET /health/startup
+type StartupStatus struct {
+	Status string         `json:"status"`
+	Stages []StartupStage `json:"stages"`
+}
+
+// startupTracker records which startup stages have completed
+type startupTracker struct {
+	mu     sync.Mutex
+	stages []StartupStage
+}
+
+var startup = newStartupTracker(startupProcessors, startupConfig, startupStorage, startupWarmup)
+
+func newStartupTracker(names ...string) *startupTracker {
+	t := &startupTracker{}
+	for _, name := range names {
+		t.stages = append(t.stages, StartupStage{Name: name})
+	}
+	return t
+}
+
+// complete marks a stage done, logging once every stage is
+func (t *startupTracker) complete(name, detail string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i := range t.stages {
+		if t.stages[i].Name == name {
+			t.stages[i] = StartupStage{Name: name, Done: true, Detail: detail, ElapsedMs: time.Since(startTime).Milliseconds()}
+		}
+	}
+	if t.doneLocked() {
+		log.Printf("Startup complete in %s", time.Since(startTime).Round(time.Millisecond))
+	}
+}
+
+// done reports whether every stage has completed
+func (t *startupTracker) done() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.doneLocked()
+}
+
+func (t *startupTracker) doneLocked() bool {
+	for _, stage := range t.stages {
+		if !stage.Done {
+			return false
+		}
+	}
+	return true
+}
+
+func (t *startupTracker) status() StartupStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status := StartupStatus{Status: "started", Stages: append([]StartupStage(nil), t.stages...)}
+	if !t.doneLocked() {
+		status.Status = "starting"
+	}
+	return status
+}
+
+// getWarmupTransactions returns how many transactions to run before the
+// startup probe passes
+func getWarmupTransactions() int {
+	n, err := strconv.Atoi(getEnv("WARMUP_TRANSACTIONS", "0"))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// getWarmupTimeout returns how long warmup may take before startup
+// completes without it
+func getWarmupTimeout() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("WARMUP_TIMEOUT_SECONDS", "60"))
+	if err != nil || seconds <= 0 {
+		return time.Minute
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// runWarmup sends WARMUP_TRANSACTIONS tok_approve authorizations to the
+// processors in turn, opening their connections and filling the encoder
+// pools before real traffic arrives. Warmup transactions go straight to
+// the processors, so they aren't stored, counted or published.
+func runWarmup() {
+	n := getWarmupTransactions()
+	procs := processors.all()
+	if n == 0 || len(procs) == 0 {
+		startup.complete(startupWarmup, "skipped")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), getWarmupTimeout())
+	defer cancel()
+	jobs := make(chan int)
+	var sent, failed atomic.Int64
+	var wg sync.WaitGroup
+	for w := 0; w < min(n, warmupConcurrency); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := warmupTransaction(ctx, procs[i%len(procs)], i); err != nil {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+send:
+	for i := 0; i < n; i++ {
+		select {
+		case jobs <- i:
+			sent.Add(1)
+		case <-ctx.Done():
+			break send
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	detail := strconv.FormatInt(sent.Load(), 10) + " transactions"
+	if failed.Load() > 0 || sent.Load() < int64(n) {
+		detail += ", " + strconv.FormatInt(failed.Load(), 10) + " failed"
+		if ctx.Err() != nil {
+			detail += ", timed out"
+		}
+		log.Printf("Warmup incomplete: %s", detail)
+	}
+	startup.complete(startupWarmup, detail)
+}
+
+// warmupTransaction authorizes one warmup transaction with p and encodes
+// the response as the handler would
+func warmupTransaction(ctx context.Context, p Processor, i int) error {
+	amountMinor := int64(100)
+	req := AuthorizationRequest{
+		TransactionID: "txn_warmup_" + strconv.Itoa(i),
+		MerchantID:    "warmup",
+		Amount:        1,
+		AmountMinor:   &amountMinor,
+		Currency:      "USD",
+		CardToken:     testTokenApprove,
+	}
+	result, err := p.Authorize(ctx, req)
+	if err != nil {
+		return err
+	}
+	return encodeJSON(io.Discard, AuthorizationResponse{
+		TransactionID:  req.TransactionID,
+		Status:         "approved",
+		Processor:      p.Name(),
+		ProcessedAt:    formatTimestamp(time.Now()),
+		AuthCode:       result.AuthCode,
+		Amount:         req.Amount,
+		AmountMinor:    amountMinor,
+		Currency:       req.Currency,
+		ProcessingTime: float64(result.Latency.Milliseconds()),
+	})
+}
+
+// handleHealthStartup fails until every startup stage, warmup included,
+// has completed (GET /health/startup). Kubernetes holds off liveness and
+// readiness probes until it passes.
+func handleHealthStartup(w http.ResponseWriter, r *http.Request) {
+	status := startup.status()
+	w.Header().Set("Content-Type", "application/json")
+	if status.Status != "started" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,1005 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Storage backends selectable with STORAGE_BACKEND
+const (
+	storageMemory   = "memory"
+	storageSQLite   = "sqlite"
+	storagePostgres = "postgres"
+)
+
+// Transaction statuses after authorization
+const (
+	// statusPartiallyCaptured transactions were captured in part and take
+	// further captures; see ProcessorConfig.MultiCapture
+	statusPartiallyCaptured = "partially_captured"
+	statusCaptured          = "captured"
+	statusPartiallyRefunded = "partially_refunded"
+	statusRefunded          = "refunded"
+	// statusExpired authorizations weren't captured within
+	// AUTHORIZATION_EXPIRY_HOURS; see expiry.go
+	statusExpired = "expired"
+)
+
+var storageErrorsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_storage_errors_total",
+		Help: "Total number of failed storage operations by operation",
+	},
+	[]string{"operation"},
+)
+
+func init() {
+	prometheus.MustRegister(storageErrorsTotal)
+}
+
+// Transaction is the stored state of an authorization and of everything
+// that happened to it afterwards
+type Transaction struct {
+	TransactionID string  `json:"transaction_id"`
+	MerchantID    string  `json:"merchant_id"`
+	Status        string  `json:"status"`
+	Amount        float64 `json:"amount"`
+	Currency      string  `json:"currency"`
+	Processor     string  `json:"processor,omitempty"`
+	AuthCode      string  `json:"auth_code,omitempty"`
+	// ProcessorReference is the processor's own ID for the payment
+	ProcessorReference string  `json:"processor_reference,omitempty"`
+	DeclineReason      string  `json:"decline_reason,omitempty"`
+	CapturedAmount     float64 `json:"captured_amount"`
+	RefundedAmount     float64 `json:"refunded_amount"`
+	CreatedAt          string  `json:"created_at"`
+	UpdatedAt          string  `json:"updated_at"`
+	// TokenType is the token type the processor got the card as, so
+	// increments draw with the same approval uplift
+	TokenType string `json:"token_type,omitempty"`
+
+	// The amounts in minor units, derived from the decimal ones when the
+	// transaction is returned; see withMinorUnits
+	AmountMinor         int64 `json:"amount_minor"`
+	CapturedAmountMinor int64 `json:"captured_amount_minor"`
+	RefundedAmountMinor int64 `json:"refunded_amount_minor"`
+}
+
+// Refund is one refund against a captured transaction
+type Refund struct {
+	RefundID      string  `json:"refund_id"`
+	TransactionID string  `json:"transaction_id"`
+	Status        string  `json:"status"`
+	Amount        float64 `json:"amount"`
+	AmountMinor   int64   `json:"amount_minor"`
+	Currency      string  `json:"currency"`
+	Processor     string  `json:"processor,omitempty"`
+	Reason        string  `json:"reason,omitempty"`
+	CreatedAt     string  `json:"created_at"`
+}
+
+// Capture is one capture of an authorization. Processors supporting
+// multi-capture take several, up to the authorized amount.
+type Capture struct {
+	CaptureID     string  `json:"capture_id"`
+	TransactionID string  `json:"transaction_id"`
+	Amount        float64 `json:"amount"`
+	AmountMinor   int64   `json:"amount_minor"`
+	Currency      string  `json:"currency"`
+	Processor     string  `json:"processor,omitempty"`
+	// Final captures close the authorization, releasing what's left of it
+	Final     bool   `json:"final"`
+	CreatedAt string `json:"created_at"`
+}
+
+// idempotencyRecord is the stored response to a request sent with an
+// Idempotency-Key, replayed when the same key is sent again
+type idempotencyRecord struct {
+	MerchantID  string
+	Key         string
+	RequestHash string
+	StatusCode  int
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// transactionStore is a storage backend: the transaction repository plus
+// refunds and idempotency keys, which live in the same database so they can
+// be written together
+type transactionStore interface {
+	TransactionRepository
+	// name is the backend name reported by /health/ready
+	name() string
+	// saveRefund records a refund and applies txn, the refunded
+	// transaction, as UpdateStatus(txn, from) would, provided its refunded
+	// amount is still previous; otherwise it returns errStatusConflict
+	saveRefund(ctx context.Context, refund Refund, txn Transaction, from string, previous float64) error
+	// refunds lists a transaction's refunds, oldest first
+	refunds(ctx context.Context, transactionID string) ([]Refund, error)
+	// saveCapture records a capture and applies txn, the captured
+	// transaction, as UpdateStatus(txn, from) would, provided its captured
+	// amount is still previous and its authorized amount still txn.Amount;
+	// otherwise it returns errStatusConflict
+	saveCapture(ctx context.Context, capture Capture, txn Transaction, from string, previous float64) error
+	// captures lists a transaction's captures, oldest first
+	captures(ctx context.Context, transactionID string) ([]Capture, error)
+	// incrementAmount raises the authorized amount of txn to txn.Amount,
+	// provided it is still previous and its status one of from; otherwise
+	// it returns errStatusConflict, or errRecordNotFound
+	incrementAmount(ctx context.Context, txn Transaction, previous float64, from ...string) error
+	// idempotencyRecord returns errRecordNotFound for unknown keys
+	idempotencyRecord(ctx context.Context, merchantID, key string) (idempotencyRecord, error)
+	// saveIdempotencyRecord inserts or replaces a record
+	saveIdempotencyRecord(ctx context.Context, rec idempotencyRecord) error
+	// purgeIdempotencyRecords deletes the records created before cutoff and
+	// returns how many it deleted
+	purgeIdempotencyRecords(ctx context.Context, cutoff time.Time) (int64, error)
+	// merchants lists onboarded merchants ordered by ID
+	merchants(ctx context.Context) ([]Merchant, error)
+	// merchant returns errRecordNotFound for unknown IDs
+	merchant(ctx context.Context, id string) (Merchant, error)
+	// createMerchant returns errDuplicateRecord if the ID is taken
+	createMerchant(ctx context.Context, m Merchant) error
+	// updateMerchant replaces a merchant, or returns errRecordNotFound
+	updateMerchant(ctx context.Context, m Merchant) error
+	// deleteMerchant returns errRecordNotFound for unknown IDs
+	deleteMerchant(ctx context.Context, id string) error
+	// createDispute stores a new dispute
+	createDispute(ctx context.Context, d Dispute) error
+	// dispute returns errRecordNotFound for unknown IDs
+	dispute(ctx context.Context, id string) (Dispute, error)
+	// disputes lists the disputes matching filter, oldest first
+	disputes(ctx context.Context, filter DisputeFilter) ([]Dispute, error)
+	// updateDispute replaces the stored dispute's status, evidence and
+	// timestamps with d's, provided its status is still from. Otherwise it
+	// returns errStatusConflict, or errRecordNotFound.
+	updateDispute(ctx context.Context, d Dispute, from string) error
+	// unsettledTransactions lists the captured, partially refunded and
+	// refunded transactions that are in no settlement, oldest first
+	unsettledTransactions(ctx context.Context) ([]Transaction, error)
+	// createSettlement stores a settlement with its items, or returns
+	// errDuplicateRecord if one of its transactions is already settled
+	createSettlement(ctx context.Context, s Settlement) error
+	// settlements lists the settlements matching filter without their
+	// items, newest first
+	settlements(ctx context.Context, filter SettlementFilter) ([]Settlement, error)
+	// settlement returns a settlement with its items, or errRecordNotFound
+	settlement(ctx context.Context, id string) (Settlement, error)
+	// createSubscription stores a new subscription
+	createSubscription(ctx context.Context, s Subscription) error
+	// subscription returns errRecordNotFound for unknown IDs
+	subscription(ctx context.Context, id string) (Subscription, error)
+	// subscriptions lists the subscriptions matching filter, oldest first
+	subscriptions(ctx context.Context, filter SubscriptionFilter) ([]Subscription, error)
+	// updateSubscription replaces the stored subscription with s, provided
+	// nobody updated it since s was read. Otherwise it returns
+	// errStatusConflict, or errRecordNotFound.
+	updateSubscription(ctx context.Context, s Subscription) error
+	// createPaymentLink stores a new payment link
+	createPaymentLink(ctx context.Context, l PaymentLink) error
+	// paymentLink returns errRecordNotFound for unknown IDs
+	paymentLink(ctx context.Context, id string) (PaymentLink, error)
+	// updatePaymentLink replaces the stored link's status and transaction
+	// ID, provided its status is still from. Otherwise it returns
+	// errStatusConflict, or errRecordNotFound.
+	updatePaymentLink(ctx context.Context, l PaymentLink, from string) error
+	// createPayout stores a new payout
+	createPayout(ctx context.Context, p Payout) error
+	// payout returns errRecordNotFound for unknown IDs
+	payout(ctx context.Context, id string) (Payout, error)
+	// payouts lists the payouts matching filter, oldest first
+	payouts(ctx context.Context, filter PayoutFilter) ([]Payout, error)
+	// updatePayout replaces the stored payout's status, arrival and
+	// failure, provided its status is still from. Otherwise it returns
+	// errStatusConflict, or errRecordNotFound.
+	updatePayout(ctx context.Context, p Payout, from string) error
+	// createLedgerEntry stores a ledger entry with its lines, or returns
+	// errDuplicateRecord if one with its type and reference ID exists
+	createLedgerEntry(ctx context.Context, e LedgerEntry) error
+	// ledgerEntries lists up to filter.Limit matching entries, newest first
+	ledgerEntries(ctx context.Context, filter LedgerFilter) ([]LedgerEntry, error)
+	// ledgerTotals sums the lines of matching entries per currency and
+	// account; filter.Limit is ignored
+	ledgerTotals(ctx context.Context, filter LedgerFilter) ([]LedgerAccountTotal, error)
+	// createAuditEntry appends an entry to the audit trail
+	createAuditEntry(ctx context.Context, e AuditEntry) error
+	// auditEntries lists up to filter.Limit matching audit entries, newest
+	// first
+	auditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error)
+	ping(ctx context.Context) error
+	close() error
+}
+
+// storage is set up by loadStorage and never nil afterwards
+var storage transactionStore = newMemoryStore()
+
+// loadStorage opens the store named by STORAGE_BACKEND (default memory)
+// and applies any pending migrations
+func loadStorage() (transactionStore, error) {
+	switch backend := getEnv("STORAGE_BACKEND", storageMemory); backend {
+	case storageMemory:
+		return newMemoryStore(), nil
+	case storageSQLite, storagePostgres:
+		return openSQLStore(backend)
+	default:
+		return nil, fmt.Errorf("unknown STORAGE_BACKEND %q, expected memory, sqlite or postgres", backend)
+	}
+}
+
+// getIdempotencyKeyTTL returns how long a stored idempotent response is
+// replayed before the key may be reused
+func getIdempotencyKeyTTL() time.Duration {
+	hours, err := strconv.Atoi(getEnv("IDEMPOTENCY_KEY_TTL_HOURS", "24"))
+	if err != nil || hours <= 0 {
+		return 24 * time.Hour
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// memoryStore keeps everything in maps; state is lost on restart
+type memoryStore struct {
+	mu              sync.RWMutex
+	transactions    map[string]Transaction
+	refundsByTxn    map[string][]Refund
+	capturesByTxn   map[string][]Capture
+	idempotency     map[string]idempotencyRecord
+	merchantsByID   map[string]Merchant
+	disputesByID    map[string]Dispute
+	settlementsByID map[string]Settlement
+	// settledIn maps settled transaction IDs to their settlement
+	settledIn         map[string]string
+	subscriptionsByID map[string]Subscription
+	paymentLinksByID  map[string]PaymentLink
+	payoutsByID       map[string]Payout
+	ledger            []LedgerEntry
+	// ledgerKeys holds the type and reference ID of every ledger entry
+	ledgerKeys map[string]bool
+	// audit is in the order entries were recorded
+	audit []AuditEntry
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		transactions:      make(map[string]Transaction),
+		refundsByTxn:      make(map[string][]Refund),
+		capturesByTxn:     make(map[string][]Capture),
+		idempotency:       make(map[string]idempotencyRecord),
+		merchantsByID:     make(map[string]Merchant),
+		disputesByID:      make(map[string]Dispute),
+		settlementsByID:   make(map[string]Settlement),
+		settledIn:         make(map[string]string),
+		subscriptionsByID: make(map[string]Subscription),
+		paymentLinksByID:  make(map[string]PaymentLink),
+		payoutsByID:       make(map[string]Payout),
+		ledgerKeys:        make(map[string]bool),
+	}
+}
+
+func (s *memoryStore) name() string {
+	return storageMemory
+}
+
+func (s *memoryStore) Create(ctx context.Context, txn Transaction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.transactions[txn.TransactionID]; ok {
+		return errDuplicateRecord
+	}
+	s.transactions[txn.TransactionID] = txn
+	return nil
+}
+
+func (s *memoryStore) Get(ctx context.Context, id string) (Transaction, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	txn, ok := s.transactions[id]
+	if !ok {
+		return Transaction{}, errRecordNotFound
+	}
+	return txn, nil
+}
+
+func (s *memoryStore) List(ctx context.Context, filter TransactionFilter) ([]Transaction, error) {
+	s.mu.RLock()
+	var cursor Transaction
+	if filter.StartingAfter != "" {
+		var ok bool
+		if cursor, ok = s.transactions[filter.StartingAfter]; !ok {
+			s.mu.RUnlock()
+			return nil, errRecordNotFound
+		}
+	}
+	var txns []Transaction
+	for _, txn := range s.transactions {
+		if !filter.matches(txn) {
+			continue
+		}
+		if filter.StartingAfter != "" && (txn.CreatedAt > cursor.CreatedAt ||
+			(txn.CreatedAt == cursor.CreatedAt && txn.TransactionID >= cursor.TransactionID)) {
+			continue
+		}
+		txns = append(txns, txn)
+	}
+	s.mu.RUnlock()
+
+	newestFirst(txns)
+	if filter.Limit > 0 && len(txns) > filter.Limit {
+		txns = txns[:filter.Limit]
+	}
+	return txns, nil
+}
+
+func (s *memoryStore) UpdateStatus(ctx context.Context, txn Transaction, from ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.updateLocked(txn, from)
+}
+
+// updateLocked applies an UpdateStatus with s.mu held
+func (s *memoryStore) updateLocked(txn Transaction, from []string) error {
+	existing, ok := s.transactions[txn.TransactionID]
+	if !ok {
+		return errRecordNotFound
+	}
+	if !containsString(from, existing.Status) {
+		return errStatusConflict
+	}
+	// Identity and creation time never change
+	txn.MerchantID = existing.MerchantID
+	txn.Amount = existing.Amount
+	txn.Currency = existing.Currency
+	txn.CreatedAt = existing.CreatedAt
+	s.transactions[txn.TransactionID] = txn
+	return nil
+}
+
+func (s *memoryStore) saveRefund(ctx context.Context, refund Refund, txn Transaction, from string, previous float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.transactions[txn.TransactionID]; ok && existing.RefundedAmount != previous {
+		return errStatusConflict
+	}
+	if err := s.updateLocked(txn, []string{from}); err != nil {
+		return err
+	}
+	s.refundsByTxn[refund.TransactionID] = append(s.refundsByTxn[refund.TransactionID], refund)
+	return nil
+}
+
+func (s *memoryStore) refunds(ctx context.Context, transactionID string) ([]Refund, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Refund(nil), s.refundsByTxn[transactionID]...), nil
+}
+
+func (s *memoryStore) saveCapture(ctx context.Context, capture Capture, txn Transaction, from string, previous float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if existing, ok := s.transactions[txn.TransactionID]; ok && (existing.CapturedAmount != previous || existing.Amount != txn.Amount) {
+		return errStatusConflict
+	}
+	if err := s.updateLocked(txn, []string{from}); err != nil {
+		return err
+	}
+	s.capturesByTxn[capture.TransactionID] = append(s.capturesByTxn[capture.TransactionID], capture)
+	return nil
+}
+
+func (s *memoryStore) captures(ctx context.Context, transactionID string) ([]Capture, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Capture(nil), s.capturesByTxn[transactionID]...), nil
+}
+
+func (s *memoryStore) incrementAmount(ctx context.Context, txn Transaction, previous float64, from ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.transactions[txn.TransactionID]
+	if !ok {
+		return errRecordNotFound
+	}
+	if existing.Amount != previous || !containsString(from, existing.Status) {
+		return errStatusConflict
+	}
+	existing.Amount = txn.Amount
+	existing.UpdatedAt = txn.UpdatedAt
+	s.transactions[txn.TransactionID] = existing
+	return nil
+}
+
+func (s *memoryStore) idempotencyRecord(ctx context.Context, merchantID, key string) (idempotencyRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	rec, ok := s.idempotency[merchantID+"\x00"+key]
+	if !ok {
+		return idempotencyRecord{}, errRecordNotFound
+	}
+	return rec, nil
+}
+
+func (s *memoryStore) saveIdempotencyRecord(ctx context.Context, rec idempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.idempotency[rec.MerchantID+"\x00"+rec.Key] = rec
+	return nil
+}
+
+func (s *memoryStore) purgeIdempotencyRecords(ctx context.Context, cutoff time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var purged int64
+	for key, rec := range s.idempotency {
+		if rec.CreatedAt.Before(cutoff) {
+			delete(s.idempotency, key)
+			purged++
+		}
+	}
+	return purged, nil
+}
+
+// purgeTransactions deletes the transactions created before cutoff, unless
+// cutoff is zero, and those beyond the newest keep, unless keep is 0,
+// along with their refunds and disputes. Captures not settled yet are
+// kept, so the next settlement still pays them out, as are transactions
+// with a dispute not decided yet.
+func (s *memoryStore) purgeTransactions(cutoff time.Time, keep int) (byAge, byCount, refunds, disputes int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	txns := make([]Transaction, 0, len(s.transactions))
+	for _, txn := range s.transactions {
+		txns = append(txns, txn)
+	}
+	newestFirst(txns)
+	disputesByTxn := make(map[string][]Dispute)
+	for _, d := range s.disputesByID {
+		disputesByTxn[d.TransactionID] = append(disputesByTxn[d.TransactionID], d)
+	}
+	before := formatTimestamp(cutoff)
+	for i, txn := range txns {
+		switch txn.Status {
+		case statusPartiallyCaptured:
+			continue
+		case statusCaptured, statusPartiallyRefunded, statusRefunded:
+			if _, settled := s.settledIn[txn.TransactionID]; !settled {
+				continue
+			}
+		}
+		if slices.ContainsFunc(disputesByTxn[txn.TransactionID], func(d Dispute) bool {
+			return d.Status != disputeWon && d.Status != disputeLost
+		}) {
+			continue
+		}
+		switch {
+		case !cutoff.IsZero() && txn.CreatedAt < before:
+			byAge++
+		case keep > 0 && i >= keep:
+			byCount++
+		default:
+			continue
+		}
+		refunds += len(s.refundsByTxn[txn.TransactionID])
+		for _, d := range disputesByTxn[txn.TransactionID] {
+			delete(s.disputesByID, d.DisputeID)
+			disputes++
+		}
+		delete(s.transactions, txn.TransactionID)
+		delete(s.refundsByTxn, txn.TransactionID)
+		delete(s.capturesByTxn, txn.TransactionID)
+		delete(s.settledIn, txn.TransactionID)
+	}
+	return byAge, byCount, refunds, disputes
+}
+
+// purgeRecords applies the same limits to the canceled subscriptions and
+// the paid or failed payouts, by when they closed, and to the audit
+// trail. Live subscriptions and payouts are kept whatever their age. The
+// ledger is kept whole: balances are the sums of its entries.
+func (s *memoryStore) purgeRecords(cutoff time.Time, keep int) (subscriptions, payouts, audit int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var before string
+	if !cutoff.IsZero() {
+		before = formatTimestamp(cutoff)
+	}
+	subscriptions = purgeClosed(s.subscriptionsByID, func(sub Subscription) (bool, string) {
+		return sub.Status == subscriptionCanceled, sub.UpdatedAt
+	}, before, keep)
+	payouts = purgeClosed(s.payoutsByID, func(p Payout) (bool, string) {
+		return p.Status == payoutPaid || p.Status == payoutFailed, p.UpdatedAt
+	}, before, keep)
+
+	// Entries are in the order they were recorded, so the old ones lead
+	for audit < len(s.audit) && before != "" && s.audit[audit].CreatedAt < before {
+		audit++
+	}
+	if keep > 0 && len(s.audit)-audit > keep {
+		audit = len(s.audit) - keep
+	}
+	if audit > 0 {
+		s.audit = slices.Clone(s.audit[audit:])
+	}
+	return subscriptions, payouts, audit
+}
+
+// purgeClosed deletes the records of byID that closed reports as closed,
+// with when they closed, if that was before before, unless it is empty, or
+// they are beyond the newest keep closed ones, unless keep is 0. It
+// returns how many it deleted.
+func purgeClosed[T any](byID map[string]T, closed func(T) (bool, string), before string, keep int) int {
+	type closedRecord struct{ id, at string }
+	var records []closedRecord
+	for id, r := range byID {
+		if ok, at := closed(r); ok {
+			records = append(records, closedRecord{id, at})
+		}
+	}
+	slices.SortFunc(records, func(a, b closedRecord) int {
+		if a.at != b.at {
+			return strings.Compare(b.at, a.at)
+		}
+		return strings.Compare(b.id, a.id)
+	})
+	purged := 0
+	for i, r := range records {
+		if (before != "" && r.at < before) || (keep > 0 && i >= keep) {
+			delete(byID, r.id)
+			purged++
+		}
+	}
+	return purged
+}
+
+// dump returns the transactions oldest first, their refunds and captures
+// and the merchants, for a snapshot
+func (s *memoryStore) dump() ([]Transaction, []Refund, []Capture, []Merchant) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	txns := make([]Transaction, 0, len(s.transactions))
+	for _, txn := range s.transactions {
+		txns = append(txns, txn)
+	}
+	newestFirst(txns)
+	slices.Reverse(txns)
+	refunds, captures := []Refund{}, []Capture{}
+	for _, txn := range txns {
+		refunds = append(refunds, s.refundsByTxn[txn.TransactionID]...)
+		captures = append(captures, s.capturesByTxn[txn.TransactionID]...)
+	}
+	merchants := make([]Merchant, 0, len(s.merchantsByID))
+	for _, id := range sortedKeys(s.merchantsByID) {
+		merchants = append(merchants, s.merchantsByID[id])
+	}
+	return txns, refunds, captures, merchants
+}
+
+// restore replaces everything but the audit trail with the given
+// transactions, refunds, captures and merchants. Idempotency keys and the records
+// derived from transactions, such as settlements and the ledger, start
+// over empty.
+func (s *memoryStore) restore(txns []Transaction, refunds []Refund, captures []Capture, merchants []Merchant) {
+	fresh := newMemoryStore()
+	for _, txn := range txns {
+		fresh.transactions[txn.TransactionID] = txn
+	}
+	for _, refund := range refunds {
+		fresh.refundsByTxn[refund.TransactionID] = append(fresh.refundsByTxn[refund.TransactionID], refund)
+	}
+	for _, capture := range captures {
+		fresh.capturesByTxn[capture.TransactionID] = append(fresh.capturesByTxn[capture.TransactionID], capture)
+	}
+	for _, m := range merchants {
+		fresh.merchantsByID[m.MerchantID] = m
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.transactions = fresh.transactions
+	s.refundsByTxn = fresh.refundsByTxn
+	s.capturesByTxn = fresh.capturesByTxn
+	s.idempotency = fresh.idempotency
+	s.merchantsByID = fresh.merchantsByID
+	s.disputesByID = fresh.disputesByID
+	s.settlementsByID = fresh.settlementsByID
+	s.settledIn = fresh.settledIn
+	s.subscriptionsByID = fresh.subscriptionsByID
+	s.paymentLinksByID = fresh.paymentLinksByID
+	s.payoutsByID = fresh.payoutsByID
+	s.ledger = nil
+	s.ledgerKeys = fresh.ledgerKeys
+}
+
+func (s *memoryStore) merchants(ctx context.Context) ([]Merchant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	merchants := make([]Merchant, 0, len(s.merchantsByID))
+	for _, id := range sortedKeys(s.merchantsByID) {
+		merchants = append(merchants, s.merchantsByID[id])
+	}
+	return merchants, nil
+}
+
+func (s *memoryStore) merchant(ctx context.Context, id string) (Merchant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	m, ok := s.merchantsByID[id]
+	if !ok {
+		return Merchant{}, errRecordNotFound
+	}
+	return m, nil
+}
+
+func (s *memoryStore) createMerchant(ctx context.Context, m Merchant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.merchantsByID[m.MerchantID]; ok {
+		return errDuplicateRecord
+	}
+	s.merchantsByID[m.MerchantID] = m
+	return nil
+}
+
+func (s *memoryStore) updateMerchant(ctx context.Context, m Merchant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.merchantsByID[m.MerchantID]; !ok {
+		return errRecordNotFound
+	}
+	s.merchantsByID[m.MerchantID] = m
+	return nil
+}
+
+func (s *memoryStore) deleteMerchant(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.merchantsByID[id]; !ok {
+		return errRecordNotFound
+	}
+	delete(s.merchantsByID, id)
+	return nil
+}
+
+func (s *memoryStore) createDispute(ctx context.Context, d Dispute) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.disputesByID[d.DisputeID]; ok {
+		return errDuplicateRecord
+	}
+	s.disputesByID[d.DisputeID] = d
+	return nil
+}
+
+func (s *memoryStore) dispute(ctx context.Context, id string) (Dispute, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	d, ok := s.disputesByID[id]
+	if !ok {
+		return Dispute{}, errRecordNotFound
+	}
+	return d, nil
+}
+
+func (s *memoryStore) disputes(ctx context.Context, filter DisputeFilter) ([]Dispute, error) {
+	s.mu.RLock()
+	var disputes []Dispute
+	for _, d := range s.disputesByID {
+		if filter.matches(d) {
+			disputes = append(disputes, d)
+		}
+	}
+	s.mu.RUnlock()
+	oldestFirst(disputes)
+	return disputes, nil
+}
+
+func (s *memoryStore) updateDispute(ctx context.Context, d Dispute, from string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.disputesByID[d.DisputeID]
+	if !ok {
+		return errRecordNotFound
+	}
+	if existing.Status != from {
+		return errStatusConflict
+	}
+	existing.Status = d.Status
+	existing.Evidence = d.Evidence
+	existing.ResolvesAt = d.ResolvesAt
+	existing.UpdatedAt = d.UpdatedAt
+	s.disputesByID[d.DisputeID] = existing
+	return nil
+}
+
+func (s *memoryStore) unsettledTransactions(ctx context.Context) ([]Transaction, error) {
+	s.mu.RLock()
+	var txns []Transaction
+	for id, txn := range s.transactions {
+		switch txn.Status {
+		case statusCaptured, statusPartiallyRefunded, statusRefunded:
+			if _, settled := s.settledIn[id]; !settled {
+				txns = append(txns, txn)
+			}
+		}
+	}
+	s.mu.RUnlock()
+	newestFirst(txns)
+	slices.Reverse(txns)
+	return txns, nil
+}
+
+func (s *memoryStore) createSettlement(ctx context.Context, settlement Settlement) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, item := range settlement.Items {
+		if _, settled := s.settledIn[item.TransactionID]; settled {
+			return errDuplicateRecord
+		}
+	}
+	for _, item := range settlement.Items {
+		s.settledIn[item.TransactionID] = settlement.SettlementID
+	}
+	s.settlementsByID[settlement.SettlementID] = settlement
+	return nil
+}
+
+func (s *memoryStore) settlements(ctx context.Context, filter SettlementFilter) ([]Settlement, error) {
+	s.mu.RLock()
+	var settlements []Settlement
+	for _, settlement := range s.settlementsByID {
+		if filter.matches(settlement) {
+			settlement.Items = nil
+			settlements = append(settlements, settlement)
+		}
+	}
+	s.mu.RUnlock()
+	newestSettlementsFirst(settlements)
+	return settlements, nil
+}
+
+func (s *memoryStore) settlement(ctx context.Context, id string) (Settlement, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	settlement, ok := s.settlementsByID[id]
+	if !ok {
+		return Settlement{}, errRecordNotFound
+	}
+	return settlement, nil
+}
+
+func (s *memoryStore) createSubscription(ctx context.Context, sub Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.subscriptionsByID[sub.SubscriptionID]; ok {
+		return errDuplicateRecord
+	}
+	sub.Retries = slices.Clone(sub.Retries)
+	s.subscriptionsByID[sub.SubscriptionID] = sub
+	return nil
+}
+
+func (s *memoryStore) subscription(ctx context.Context, id string) (Subscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sub, ok := s.subscriptionsByID[id]
+	if !ok {
+		return Subscription{}, errRecordNotFound
+	}
+	sub.Retries = slices.Clone(sub.Retries)
+	return sub, nil
+}
+
+func (s *memoryStore) subscriptions(ctx context.Context, filter SubscriptionFilter) ([]Subscription, error) {
+	s.mu.RLock()
+	var subs []Subscription
+	for _, sub := range s.subscriptionsByID {
+		if filter.matches(sub) {
+			sub.Retries = slices.Clone(sub.Retries)
+			subs = append(subs, sub)
+		}
+	}
+	s.mu.RUnlock()
+	subscriptionsByCreation(subs)
+	return subs, nil
+}
+
+func (s *memoryStore) updateSubscription(ctx context.Context, sub Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.subscriptionsByID[sub.SubscriptionID]
+	if !ok {
+		return errRecordNotFound
+	}
+	if existing.version != sub.version {
+		return errStatusConflict
+	}
+	sub.version++
+	sub.Retries = slices.Clone(sub.Retries)
+	s.subscriptionsByID[sub.SubscriptionID] = sub
+	return nil
+}
+
+func (s *memoryStore) createPaymentLink(ctx context.Context, l PaymentLink) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.paymentLinksByID[l.LinkID]; ok {
+		return errDuplicateRecord
+	}
+	s.paymentLinksByID[l.LinkID] = l
+	return nil
+}
+
+func (s *memoryStore) paymentLink(ctx context.Context, id string) (PaymentLink, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	l, ok := s.paymentLinksByID[id]
+	if !ok {
+		return PaymentLink{}, errRecordNotFound
+	}
+	return l, nil
+}
+
+func (s *memoryStore) updatePaymentLink(ctx context.Context, l PaymentLink, from string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.paymentLinksByID[l.LinkID]
+	if !ok {
+		return errRecordNotFound
+	}
+	if existing.Status != from {
+		return errStatusConflict
+	}
+	existing.Status = l.Status
+	existing.TransactionID = l.TransactionID
+	existing.UpdatedAt = l.UpdatedAt
+	s.paymentLinksByID[l.LinkID] = existing
+	return nil
+}
+
+func (s *memoryStore) createPayout(ctx context.Context, p Payout) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.payoutsByID[p.PayoutID]; ok {
+		return errDuplicateRecord
+	}
+	s.payoutsByID[p.PayoutID] = p
+	return nil
+}
+
+func (s *memoryStore) payout(ctx context.Context, id string) (Payout, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.payoutsByID[id]
+	if !ok {
+		return Payout{}, errRecordNotFound
+	}
+	return p, nil
+}
+
+func (s *memoryStore) payouts(ctx context.Context, filter PayoutFilter) ([]Payout, error) {
+	s.mu.RLock()
+	var payouts []Payout
+	for _, p := range s.payoutsByID {
+		if filter.matches(p) {
+			payouts = append(payouts, p)
+		}
+	}
+	s.mu.RUnlock()
+	payoutsByCreation(payouts)
+	return payouts, nil
+}
+
+func (s *memoryStore) updatePayout(ctx context.Context, p Payout, from string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	existing, ok := s.payoutsByID[p.PayoutID]
+	if !ok {
+		return errRecordNotFound
+	}
+	if existing.Status != from {
+		return errStatusConflict
+	}
+	existing.Status = p.Status
+	existing.ExpectedArrivalAt = p.ExpectedArrivalAt
+	existing.FailureCode = p.FailureCode
+	existing.FailureMessage = p.FailureMessage
+	existing.UpdatedAt = p.UpdatedAt
+	s.payoutsByID[p.PayoutID] = existing
+	return nil
+}
+
+func (s *memoryStore) createLedgerEntry(ctx context.Context, e LedgerEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := e.Type + ":" + e.ReferenceID
+	if s.ledgerKeys[key] {
+		return errDuplicateRecord
+	}
+	s.ledgerKeys[key] = true
+	s.ledger = append(s.ledger, e)
+	return nil
+}
+
+func (s *memoryStore) ledgerEntries(ctx context.Context, filter LedgerFilter) ([]LedgerEntry, error) {
+	s.mu.RLock()
+	var entries []LedgerEntry
+	for _, e := range s.ledger {
+		if filter.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	s.mu.RUnlock()
+	newestEntriesFirst(entries)
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) ledgerTotals(ctx context.Context, filter LedgerFilter) ([]LedgerAccountTotal, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	index := map[[2]string]int{}
+	var totals []LedgerAccountTotal
+	for _, e := range s.ledger {
+		if !filter.matches(e) {
+			continue
+		}
+		for _, l := range e.Lines {
+			key := [2]string{e.Currency, l.Account}
+			i, ok := index[key]
+			if !ok {
+				i = len(totals)
+				index[key] = i
+				totals = append(totals, LedgerAccountTotal{Currency: e.Currency, Account: l.Account})
+			}
+			totals[i].DebitMinor += l.DebitMinor
+			totals[i].CreditMinor += l.CreditMinor
+		}
+	}
+	return totals, nil
+}
+
+func (s *memoryStore) createAuditEntry(ctx context.Context, e AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *memoryStore) auditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []AuditEntry
+	for i := len(s.audit) - 1; i >= 0; i-- {
+		if filter.Limit > 0 && len(entries) == filter.Limit {
+			break
+		}
+		if filter.matches(s.audit[i]) {
+			entries = append(entries, s.audit[i])
+		}
+	}
+	return entries, nil
+}
+
+func containsString(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *memoryStore) close() error {
+	return nil
+}
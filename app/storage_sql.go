@@ -0,0 +1,1349 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// migrations are applied in order, each in its own transaction, and
+// recorded in schema_migrations. Never edit a released migration; append a
+// new one. The SQL must run unchanged on both SQLite and Postgres.
+var migrations = [][]string{
+	{
+		`CREATE TABLE transactions (
+			id              TEXT PRIMARY KEY,
+			merchant_id     TEXT NOT NULL,
+			status          TEXT NOT NULL,
+			amount          DOUBLE PRECISION NOT NULL,
+			currency        TEXT NOT NULL,
+			processor       TEXT NOT NULL DEFAULT '',
+			auth_code       TEXT NOT NULL DEFAULT '',
+			decline_reason  TEXT NOT NULL DEFAULT '',
+			captured_amount DOUBLE PRECISION NOT NULL DEFAULT 0,
+			refunded_amount DOUBLE PRECISION NOT NULL DEFAULT 0,
+			created_at      TEXT NOT NULL,
+			updated_at      TEXT NOT NULL
+		)`,
+		`CREATE INDEX transactions_merchant_created ON transactions (merchant_id, created_at)`,
+	},
+	{
+		`CREATE TABLE refunds (
+			id             TEXT PRIMARY KEY,
+			transaction_id TEXT NOT NULL REFERENCES transactions (id),
+			status         TEXT NOT NULL,
+			amount         DOUBLE PRECISION NOT NULL,
+			currency       TEXT NOT NULL,
+			processor      TEXT NOT NULL DEFAULT '',
+			reason         TEXT NOT NULL DEFAULT '',
+			created_at     TEXT NOT NULL
+		)`,
+		`CREATE INDEX refunds_transaction ON refunds (transaction_id, created_at)`,
+	},
+	{
+		`CREATE TABLE idempotency_keys (
+			merchant_id     TEXT NOT NULL,
+			idempotency_key TEXT NOT NULL,
+			request_hash    TEXT NOT NULL,
+			status_code     INTEGER NOT NULL,
+			response_body   TEXT NOT NULL,
+			created_at      TEXT NOT NULL,
+			PRIMARY KEY (merchant_id, idempotency_key)
+		)`,
+	},
+	{
+		`ALTER TABLE transactions ADD COLUMN processor_reference TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		`CREATE TABLE merchants (
+			id             TEXT PRIMARY KEY,
+			profile        TEXT NOT NULL,
+			api_key_hash   TEXT NOT NULL DEFAULT '',
+			api_key_prefix TEXT NOT NULL DEFAULT '',
+			created_at     TEXT NOT NULL,
+			updated_at     TEXT NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE disputes (
+			id              TEXT PRIMARY KEY,
+			transaction_id  TEXT NOT NULL REFERENCES transactions (id),
+			merchant_id     TEXT NOT NULL,
+			status          TEXT NOT NULL,
+			reason          TEXT NOT NULL,
+			amount          DOUBLE PRECISION NOT NULL,
+			currency        TEXT NOT NULL,
+			evidence        TEXT NOT NULL DEFAULT '',
+			evidence_due_by TEXT NOT NULL,
+			resolves_at     TEXT NOT NULL DEFAULT '',
+			created_at      TEXT NOT NULL,
+			updated_at      TEXT NOT NULL
+		)`,
+		`CREATE INDEX disputes_status ON disputes (status, created_at)`,
+	},
+	{
+		`CREATE TABLE settlements (
+			id                TEXT PRIMARY KEY,
+			processor         TEXT NOT NULL,
+			merchant_id       TEXT NOT NULL,
+			currency          TEXT NOT NULL,
+			transaction_count INTEGER NOT NULL,
+			gross_amount      DOUBLE PRECISION NOT NULL,
+			refunded_amount   DOUBLE PRECISION NOT NULL,
+			fee_amount        DOUBLE PRECISION NOT NULL,
+			net_amount        DOUBLE PRECISION NOT NULL,
+			created_at        TEXT NOT NULL
+		)`,
+		`CREATE INDEX settlements_merchant_created ON settlements (merchant_id, created_at)`,
+		// The primary key keeps a transaction from being settled twice
+		`CREATE TABLE settlement_items (
+			transaction_id      TEXT PRIMARY KEY REFERENCES transactions (id),
+			settlement_id       TEXT NOT NULL REFERENCES settlements (id),
+			processor_reference TEXT NOT NULL,
+			captured_amount     DOUBLE PRECISION NOT NULL,
+			refunded_amount     DOUBLE PRECISION NOT NULL,
+			fee_amount          DOUBLE PRECISION NOT NULL,
+			net_amount          DOUBLE PRECISION NOT NULL
+		)`,
+		`CREATE INDEX settlement_items_settlement ON settlement_items (settlement_id)`,
+	},
+	{
+		`CREATE TABLE subscriptions (
+			id                  TEXT PRIMARY KEY,
+			merchant_id         TEXT NOT NULL,
+			status              TEXT NOT NULL,
+			amount              DOUBLE PRECISION NOT NULL,
+			currency            TEXT NOT NULL,
+			card_token          TEXT NOT NULL,
+			billing_interval    TEXT NOT NULL,
+			interval_count      INTEGER NOT NULL,
+			cycle               INTEGER NOT NULL,
+			next_charge_at      TEXT NOT NULL,
+			last_transaction_id TEXT NOT NULL DEFAULT '',
+			last_charge_status  TEXT NOT NULL DEFAULT '',
+			failed_cycles       INTEGER NOT NULL,
+			version             INTEGER NOT NULL,
+			created_at          TEXT NOT NULL,
+			updated_at          TEXT NOT NULL
+		)`,
+		`CREATE INDEX subscriptions_due ON subscriptions (status, next_charge_at)`,
+	},
+	{
+		`ALTER TABLE subscriptions ADD COLUMN next_retry_at TEXT NOT NULL DEFAULT ''`,
+		`ALTER TABLE subscriptions ADD COLUMN retries TEXT NOT NULL DEFAULT '[]'`,
+		`ALTER TABLE subscriptions ADD COLUMN retries_cycle INTEGER NOT NULL DEFAULT 0`,
+		`CREATE INDEX subscriptions_retry_due ON subscriptions (status, next_retry_at)`,
+	},
+	{
+		`CREATE TABLE payment_links (
+			id             TEXT PRIMARY KEY,
+			merchant_id    TEXT NOT NULL,
+			status         TEXT NOT NULL,
+			amount         DOUBLE PRECISION NOT NULL,
+			currency       TEXT NOT NULL,
+			description    TEXT NOT NULL DEFAULT '',
+			url            TEXT NOT NULL,
+			expires_at     TEXT NOT NULL,
+			transaction_id TEXT NOT NULL DEFAULT '',
+			created_at     TEXT NOT NULL,
+			updated_at     TEXT NOT NULL
+		)`,
+	},
+	{
+		`CREATE TABLE payouts (
+			id                  TEXT PRIMARY KEY,
+			merchant_id         TEXT NOT NULL,
+			status              TEXT NOT NULL,
+			amount              DOUBLE PRECISION NOT NULL,
+			currency            TEXT NOT NULL,
+			destination_type    TEXT NOT NULL,
+			destination_account TEXT NOT NULL,
+			description         TEXT NOT NULL DEFAULT '',
+			submits_at          TEXT NOT NULL,
+			expected_arrival_at TEXT NOT NULL DEFAULT '',
+			failure_code        TEXT NOT NULL DEFAULT '',
+			failure_message     TEXT NOT NULL DEFAULT '',
+			created_at          TEXT NOT NULL,
+			updated_at          TEXT NOT NULL
+		)`,
+		`CREATE INDEX payouts_status ON payouts (status, created_at)`,
+	},
+	{
+		`CREATE TABLE ledger_entries (
+			id           TEXT PRIMARY KEY,
+			merchant_id  TEXT NOT NULL,
+			currency     TEXT NOT NULL,
+			entry_type   TEXT NOT NULL,
+			reference_id TEXT NOT NULL,
+			created_at   TEXT NOT NULL,
+			UNIQUE (entry_type, reference_id)
+		)`,
+		`CREATE INDEX ledger_entries_merchant ON ledger_entries (merchant_id, created_at)`,
+		`CREATE TABLE ledger_lines (
+			entry_id     TEXT NOT NULL REFERENCES ledger_entries (id),
+			line         INTEGER NOT NULL,
+			account      TEXT NOT NULL,
+			debit_minor  BIGINT NOT NULL,
+			credit_minor BIGINT NOT NULL,
+			PRIMARY KEY (entry_id, line)
+		)`,
+	},
+	{
+		`CREATE TABLE audit_entries (
+			id            TEXT PRIMARY KEY,
+			action        TEXT NOT NULL,
+			actor         TEXT NOT NULL,
+			resource_type TEXT NOT NULL,
+			resource_id   TEXT NOT NULL,
+			merchant_id   TEXT NOT NULL DEFAULT '',
+			request_id    TEXT NOT NULL DEFAULT '',
+			before_status TEXT NOT NULL DEFAULT '',
+			after_status  TEXT NOT NULL DEFAULT '',
+			created_at    TEXT NOT NULL
+		)`,
+		`CREATE INDEX audit_entries_resource ON audit_entries (resource_id)`,
+		`CREATE INDEX audit_entries_merchant ON audit_entries (merchant_id, id)`,
+	},
+	{
+		`ALTER TABLE audit_entries ADD COLUMN client_ip TEXT NOT NULL DEFAULT ''`,
+	},
+	{
+		`CREATE TABLE captures (
+			id             TEXT PRIMARY KEY,
+			transaction_id TEXT NOT NULL REFERENCES transactions (id),
+			amount         DOUBLE PRECISION NOT NULL,
+			currency       TEXT NOT NULL,
+			processor      TEXT NOT NULL DEFAULT '',
+			final          BOOLEAN NOT NULL,
+			created_at     TEXT NOT NULL
+		)`,
+		`CREATE INDEX captures_transaction ON captures (transaction_id, created_at)`,
+	},
+	{
+		`ALTER TABLE transactions ADD COLUMN token_type TEXT NOT NULL DEFAULT ''`,
+	},
+}
+
+// sqlStore keeps state in SQLite or Postgres through database/sql
+type sqlStore struct {
+	backend string
+	db      *sql.DB
+}
+
+// openSQLStore connects to SQLITE_PATH or DATABASE_URL, configures the
+// connection pool and migrates the schema
+func openSQLStore(backend string) (*sqlStore, error) {
+	var driver, dsn string
+	maxOpen := 10
+	switch backend {
+	case storageSQLite:
+		// SQLite allows a single writer; one connection avoids "database is
+		// locked" errors under concurrent authorizations
+		driver, maxOpen = "sqlite3", 1
+		path := getEnv("SQLITE_PATH", "voyager.db")
+		dsn = "file:" + path + "?_busy_timeout=5000&_journal_mode=WAL&_foreign_keys=on"
+	case storagePostgres:
+		driver = "pgx"
+		dsn = os.Getenv("DATABASE_URL")
+		if dsn == "" {
+			return nil, fmt.Errorf("DATABASE_URL is required for STORAGE_BACKEND=postgres")
+		}
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(getDBMaxOpenConns(maxOpen))
+	db.SetMaxIdleConns(getDBMaxIdleConns())
+	db.SetConnMaxLifetime(getDBConnMaxLifetime())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("connecting to %s: %w", backend, err)
+	}
+
+	s := &sqlStore{backend: backend, db: db}
+	applied, err := s.migrate(ctx)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("migrating %s schema: %w", backend, err)
+	}
+	log.Printf("Applied %d %s schema migrations, now at version %d", applied, backend, len(migrations))
+	return s, nil
+}
+
+// getDBMaxOpenConns returns the connection pool size
+func getDBMaxOpenConns(defaultValue int) int {
+	n, err := strconv.Atoi(getEnv("DB_MAX_OPEN_CONNS", strconv.Itoa(defaultValue)))
+	if err != nil || n <= 0 {
+		return defaultValue
+	}
+	return n
+}
+
+// getDBMaxIdleConns returns how many pooled connections are kept open
+// while idle
+func getDBMaxIdleConns() int {
+	n, err := strconv.Atoi(getEnv("DB_MAX_IDLE_CONNS", "5"))
+	if err != nil || n < 0 {
+		return 5
+	}
+	return n
+}
+
+// getDBConnMaxLifetime returns how long a connection is reused before it
+// is replaced, so failovers and credential rotations are picked up
+func getDBConnMaxLifetime() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("DB_CONN_MAX_LIFETIME_SECONDS", "300"))
+	if err != nil || seconds <= 0 {
+		return 5 * time.Minute
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// migrate applies the migrations newer than the recorded schema version
+func (s *sqlStore) migrate(ctx context.Context) (int, error) {
+	_, err := s.db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TEXT NOT NULL
+	)`)
+	if err != nil {
+		return 0, err
+	}
+
+	var current int
+	if err := s.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current); err != nil {
+		return 0, err
+	}
+	if current > len(migrations) {
+		return 0, fmt.Errorf("database is at schema version %d but this build only knows %d", current, len(migrations))
+	}
+
+	for version := current + 1; version <= len(migrations); version++ {
+		tx, err := s.db.BeginTx(ctx, nil)
+		if err != nil {
+			return 0, err
+		}
+		for _, stmt := range migrations[version-1] {
+			if _, err := tx.ExecContext(ctx, stmt); err != nil {
+				tx.Rollback()
+				return 0, fmt.Errorf("migration %d: %w", version, err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)`),
+			version, time.Now().UTC().Format(time.RFC3339)); err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, err
+		}
+	}
+	return len(migrations) - current, nil
+}
+
+// rebind turns ? placeholders into Postgres' $1, $2, ...
+func (s *sqlStore) rebind(query string) string {
+	if s.backend != storagePostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func (s *sqlStore) name() string {
+	return s.backend
+}
+
+const transactionColumns = `id, merchant_id, status, amount, currency, processor, auth_code,
+	decline_reason, captured_amount, refunded_amount, created_at, updated_at, processor_reference, token_type`
+
+// scanner is satisfied by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanTransaction(row scanner) (Transaction, error) {
+	var txn Transaction
+	err := row.Scan(&txn.TransactionID, &txn.MerchantID, &txn.Status, &txn.Amount, &txn.Currency,
+		&txn.Processor, &txn.AuthCode, &txn.DeclineReason, &txn.CapturedAmount, &txn.RefundedAmount,
+		&txn.CreatedAt, &txn.UpdatedAt, &txn.ProcessorReference, &txn.TokenType)
+	return txn, err
+}
+
+func (s *sqlStore) Create(ctx context.Context, txn Transaction) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO transactions (`+transactionColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`),
+		txn.TransactionID, txn.MerchantID, txn.Status, txn.Amount, txn.Currency, txn.Processor,
+		txn.AuthCode, txn.DeclineReason, txn.CapturedAmount, txn.RefundedAmount, txn.CreatedAt, txn.UpdatedAt,
+		txn.ProcessorReference, txn.TokenType)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errDuplicateRecord
+	}
+	return nil
+}
+
+func (s *sqlStore) Get(ctx context.Context, id string) (Transaction, error) {
+	txn, err := scanTransaction(s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT `+transactionColumns+` FROM transactions WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Transaction{}, errRecordNotFound
+	}
+	return txn, err
+}
+
+func (s *sqlStore) List(ctx context.Context, filter TransactionFilter) ([]Transaction, error) {
+	var where []string
+	var args []interface{}
+	if filter.MerchantID != "" {
+		where = append(where, "merchant_id = ?")
+		args = append(args, filter.MerchantID)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if !filter.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, formatTimestamp(filter.CreatedFrom))
+	}
+	if !filter.CreatedTo.IsZero() {
+		where = append(where, "created_at <= ?")
+		args = append(args, formatTimestamp(filter.CreatedTo))
+	}
+	if filter.StartingAfter != "" {
+		cursor, err := s.Get(ctx, filter.StartingAfter)
+		if err != nil {
+			return nil, err
+		}
+		where = append(where, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, cursor.CreatedAt, cursor.CreatedAt, cursor.TransactionID)
+	}
+
+	query := `SELECT ` + transactionColumns + ` FROM transactions`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var txns []Transaction
+	for rows.Next() {
+		txn, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		txns = append(txns, txn)
+	}
+	return txns, rows.Err()
+}
+
+// sqlConn is satisfied by both *sql.DB and *sql.Tx
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func (s *sqlStore) UpdateStatus(ctx context.Context, txn Transaction, from ...string) error {
+	return s.updateStatus(ctx, s.db, txn, from, "")
+}
+
+// updateStatus runs UpdateStatus on c, which may be a database
+// transaction. guard, when set, is one more condition the row must meet,
+// such as "captured_amount = ?", with its arguments in guardArgs.
+func (s *sqlStore) updateStatus(ctx context.Context, c sqlConn, txn Transaction, from []string, guard string, guardArgs ...interface{}) error {
+	if len(from) == 0 {
+		return errStatusConflict
+	}
+	args := []interface{}{txn.Status, txn.Processor, txn.AuthCode, txn.ProcessorReference, txn.DeclineReason,
+		txn.CapturedAmount, txn.RefundedAmount, txn.UpdatedAt, txn.TokenType, txn.TransactionID}
+	for _, status := range from {
+		args = append(args, status)
+	}
+	if guard != "" {
+		guard = " AND " + guard
+		args = append(args, guardArgs...)
+	}
+	res, err := c.ExecContext(ctx, s.rebind(`UPDATE transactions SET status = ?, processor = ?,
+		auth_code = ?, processor_reference = ?, decline_reason = ?, captured_amount = ?, refunded_amount = ?, updated_at = ?,
+		token_type = ?
+		WHERE id = ? AND status IN (?`+strings.Repeat(", ?", len(from)-1)+`)`+guard), args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+
+	// Nothing matched: tell a missing transaction from a changed status
+	var status string
+	err = c.QueryRowContext(ctx, s.rebind(`SELECT status FROM transactions WHERE id = ?`), txn.TransactionID).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errRecordNotFound
+	}
+	if err != nil {
+		return err
+	}
+	return errStatusConflict
+}
+
+func (s *sqlStore) incrementAmount(ctx context.Context, txn Transaction, previous float64, from ...string) error {
+	if len(from) == 0 {
+		return errStatusConflict
+	}
+	args := []interface{}{txn.Amount, txn.UpdatedAt, txn.TransactionID, previous}
+	for _, status := range from {
+		args = append(args, status)
+	}
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE transactions SET amount = ?, updated_at = ?
+		WHERE id = ? AND amount = ? AND status IN (?`+strings.Repeat(", ?", len(from)-1)+`)`), args...)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	if _, err := s.Get(ctx, txn.TransactionID); err != nil {
+		return err
+	}
+	return errStatusConflict
+}
+
+func (s *sqlStore) saveRefund(ctx context.Context, refund Refund, txn Transaction, from string, previous float64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.updateStatus(ctx, tx, txn, []string{from}, "refunded_amount = ?", previous); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO refunds
+		(id, transaction_id, status, amount, currency, processor, reason, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`),
+		refund.RefundID, refund.TransactionID, refund.Status, refund.Amount, refund.Currency,
+		refund.Processor, refund.Reason, refund.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) refunds(ctx context.Context, transactionID string) ([]Refund, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT id, transaction_id, status, amount, currency,
+		processor, reason, created_at FROM refunds WHERE transaction_id = ? ORDER BY created_at, id`), transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var refunds []Refund
+	for rows.Next() {
+		var r Refund
+		if err := rows.Scan(&r.RefundID, &r.TransactionID, &r.Status, &r.Amount, &r.Currency,
+			&r.Processor, &r.Reason, &r.CreatedAt); err != nil {
+			return nil, err
+		}
+		refunds = append(refunds, r)
+	}
+	return refunds, rows.Err()
+}
+
+func (s *sqlStore) saveCapture(ctx context.Context, capture Capture, txn Transaction, from string, previous float64) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.updateStatus(ctx, tx, txn, []string{from}, "captured_amount = ? AND amount = ?", previous, txn.Amount); err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO captures
+		(id, transaction_id, amount, currency, processor, final, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`),
+		capture.CaptureID, capture.TransactionID, capture.Amount, capture.Currency,
+		capture.Processor, capture.Final, capture.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) captures(ctx context.Context, transactionID string) ([]Capture, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT id, transaction_id, amount, currency,
+		processor, final, created_at FROM captures WHERE transaction_id = ? ORDER BY created_at, id`), transactionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var captures []Capture
+	for rows.Next() {
+		var c Capture
+		if err := rows.Scan(&c.CaptureID, &c.TransactionID, &c.Amount, &c.Currency,
+			&c.Processor, &c.Final, &c.CreatedAt); err != nil {
+			return nil, err
+		}
+		captures = append(captures, c)
+	}
+	return captures, rows.Err()
+}
+
+func (s *sqlStore) idempotencyRecord(ctx context.Context, merchantID, key string) (idempotencyRecord, error) {
+	rec := idempotencyRecord{MerchantID: merchantID, Key: key}
+	var body, createdAt string
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT request_hash, status_code, response_body, created_at
+		FROM idempotency_keys WHERE merchant_id = ? AND idempotency_key = ?`), merchantID, key).Scan(
+		&rec.RequestHash, &rec.StatusCode, &body, &createdAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return idempotencyRecord{}, errRecordNotFound
+	}
+	if err != nil {
+		return idempotencyRecord{}, err
+	}
+	rec.Body = []byte(body)
+	rec.CreatedAt, err = time.Parse(time.RFC3339Nano, createdAt)
+	return rec, err
+}
+
+func (s *sqlStore) saveIdempotencyRecord(ctx context.Context, rec idempotencyRecord) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO idempotency_keys
+		(merchant_id, idempotency_key, request_hash, status_code, response_body, created_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (merchant_id, idempotency_key) DO UPDATE SET
+			request_hash = excluded.request_hash, status_code = excluded.status_code,
+			response_body = excluded.response_body, created_at = excluded.created_at`),
+		rec.MerchantID, rec.Key, rec.RequestHash, rec.StatusCode, string(rec.Body),
+		rec.CreatedAt.UTC().Format(time.RFC3339Nano))
+	return err
+}
+
+func (s *sqlStore) purgeIdempotencyRecords(ctx context.Context, cutoff time.Time) (int64, error) {
+	result, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM idempotency_keys WHERE created_at < ?`),
+		cutoff.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const merchantColumns = `id, profile, api_key_hash, api_key_prefix, created_at, updated_at`
+
+// scanMerchant reads a row of merchantColumns. The profile is stored as
+// JSON so new profile fields need no migration.
+func scanMerchant(row scanner) (Merchant, error) {
+	var m Merchant
+	var profile string
+	if err := row.Scan(&m.MerchantID, &profile, &m.apiKeyHash, &m.APIKeyPrefix, &m.CreatedAt, &m.UpdatedAt); err != nil {
+		return Merchant{}, err
+	}
+	if err := json.Unmarshal([]byte(profile), &m.MerchantConfig); err != nil {
+		return Merchant{}, fmt.Errorf("decoding profile of merchant %s: %w", m.MerchantID, err)
+	}
+	return m, nil
+}
+
+func (s *sqlStore) merchants(ctx context.Context) ([]Merchant, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+merchantColumns+` FROM merchants ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var merchants []Merchant
+	for rows.Next() {
+		m, err := scanMerchant(rows)
+		if err != nil {
+			return nil, err
+		}
+		merchants = append(merchants, m)
+	}
+	return merchants, rows.Err()
+}
+
+func (s *sqlStore) merchant(ctx context.Context, id string) (Merchant, error) {
+	m, err := scanMerchant(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+merchantColumns+` FROM merchants WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Merchant{}, errRecordNotFound
+	}
+	return m, err
+}
+
+func (s *sqlStore) createMerchant(ctx context.Context, m Merchant) error {
+	profile, err := json.Marshal(m.MerchantConfig)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO merchants (`+merchantColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (id) DO NOTHING`),
+		m.MerchantID, string(profile), m.apiKeyHash, m.APIKeyPrefix, m.CreatedAt, m.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errDuplicateRecord
+	}
+	return nil
+}
+
+func (s *sqlStore) updateMerchant(ctx context.Context, m Merchant) error {
+	profile, err := json.Marshal(m.MerchantConfig)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE merchants SET profile = ?, api_key_hash = ?, api_key_prefix = ?,
+		updated_at = ? WHERE id = ?`), string(profile), m.apiKeyHash, m.APIKeyPrefix, m.UpdatedAt, m.MerchantID)
+	return rowAffected(res, err)
+}
+
+func (s *sqlStore) deleteMerchant(ctx context.Context, id string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`DELETE FROM merchants WHERE id = ?`), id)
+	return rowAffected(res, err)
+}
+
+const disputeColumns = `id, transaction_id, merchant_id, status, reason, amount, currency, evidence,
+	evidence_due_by, resolves_at, created_at, updated_at`
+
+func scanDispute(row scanner) (Dispute, error) {
+	var d Dispute
+	err := row.Scan(&d.DisputeID, &d.TransactionID, &d.MerchantID, &d.Status, &d.Reason, &d.Amount, &d.Currency,
+		&d.Evidence, &d.EvidenceDueBy, &d.ResolvesAt, &d.CreatedAt, &d.UpdatedAt)
+	return d, err
+}
+
+func (s *sqlStore) createDispute(ctx context.Context, d Dispute) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO disputes (`+disputeColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		d.DisputeID, d.TransactionID, d.MerchantID, d.Status, d.Reason, d.Amount, d.Currency,
+		d.Evidence, d.EvidenceDueBy, d.ResolvesAt, d.CreatedAt, d.UpdatedAt)
+	return err
+}
+
+func (s *sqlStore) dispute(ctx context.Context, id string) (Dispute, error) {
+	d, err := scanDispute(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+disputeColumns+` FROM disputes WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Dispute{}, errRecordNotFound
+	}
+	return d, err
+}
+
+func (s *sqlStore) disputes(ctx context.Context, filter DisputeFilter) ([]Dispute, error) {
+	var where []string
+	var args []interface{}
+	if filter.MerchantID != "" {
+		where = append(where, "merchant_id = ?")
+		args = append(args, filter.MerchantID)
+	}
+	if filter.TransactionID != "" {
+		where = append(where, "transaction_id = ?")
+		args = append(args, filter.TransactionID)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	query := `SELECT ` + disputeColumns + ` FROM disputes`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query+" ORDER BY created_at, id"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var disputes []Dispute
+	for rows.Next() {
+		d, err := scanDispute(rows)
+		if err != nil {
+			return nil, err
+		}
+		disputes = append(disputes, d)
+	}
+	return disputes, rows.Err()
+}
+
+func (s *sqlStore) updateDispute(ctx context.Context, d Dispute, from string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE disputes SET status = ?, evidence = ?, resolves_at = ?,
+		updated_at = ? WHERE id = ? AND status = ?`), d.Status, d.Evidence, d.ResolvesAt, d.UpdatedAt, d.DisputeID, from)
+	if err := rowAffected(res, err); err != errRecordNotFound {
+		return err
+	}
+	if _, err := s.dispute(ctx, d.DisputeID); err != nil {
+		return err
+	}
+	return errStatusConflict
+}
+
+func (s *sqlStore) unsettledTransactions(ctx context.Context) ([]Transaction, error) {
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT `+transactionColumns+` FROM transactions
+		WHERE status IN (?, ?, ?) AND id NOT IN (SELECT transaction_id FROM settlement_items)
+		ORDER BY created_at, id`), statusCaptured, statusPartiallyRefunded, statusRefunded)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var txns []Transaction
+	for rows.Next() {
+		txn, err := scanTransaction(rows)
+		if err != nil {
+			return nil, err
+		}
+		txns = append(txns, txn)
+	}
+	return txns, rows.Err()
+}
+
+const settlementColumns = `id, processor, merchant_id, currency, transaction_count, gross_amount,
+	refunded_amount, fee_amount, net_amount, created_at`
+
+func scanSettlement(row scanner) (Settlement, error) {
+	var st Settlement
+	err := row.Scan(&st.SettlementID, &st.Processor, &st.MerchantID, &st.Currency, &st.TransactionCount,
+		&st.GrossAmount, &st.RefundedAmount, &st.FeeAmount, &st.NetAmount, &st.CreatedAt)
+	return st, err
+}
+
+func (s *sqlStore) createSettlement(ctx context.Context, st Settlement) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, s.rebind(`INSERT INTO settlements (`+settlementColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		st.SettlementID, st.Processor, st.MerchantID, st.Currency, st.TransactionCount,
+		st.GrossAmount, st.RefundedAmount, st.FeeAmount, st.NetAmount, st.CreatedAt)
+	if err != nil {
+		return err
+	}
+	for _, item := range st.Items {
+		res, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO settlement_items (transaction_id, settlement_id,
+			processor_reference, captured_amount, refunded_amount, fee_amount, net_amount)
+			VALUES (?, ?, ?, ?, ?, ?, ?) ON CONFLICT (transaction_id) DO NOTHING`),
+			item.TransactionID, st.SettlementID, item.ProcessorReference, item.CapturedAmount,
+			item.RefundedAmount, item.FeeAmount, item.NetAmount)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err == nil && n == 0 {
+			return errDuplicateRecord
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) settlements(ctx context.Context, filter SettlementFilter) ([]Settlement, error) {
+	var where []string
+	var args []interface{}
+	if filter.MerchantID != "" {
+		where = append(where, "merchant_id = ?")
+		args = append(args, filter.MerchantID)
+	}
+	if filter.Processor != "" {
+		where = append(where, "processor = ?")
+		args = append(args, filter.Processor)
+	}
+	query := `SELECT ` + settlementColumns + ` FROM settlements`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query+" ORDER BY created_at DESC, id DESC"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var settlements []Settlement
+	for rows.Next() {
+		st, err := scanSettlement(rows)
+		if err != nil {
+			return nil, err
+		}
+		settlements = append(settlements, st)
+	}
+	return settlements, rows.Err()
+}
+
+func (s *sqlStore) settlement(ctx context.Context, id string) (Settlement, error) {
+	st, err := scanSettlement(s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT `+settlementColumns+` FROM settlements WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Settlement{}, errRecordNotFound
+	}
+	if err != nil {
+		return Settlement{}, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT transaction_id, processor_reference, captured_amount,
+		refunded_amount, fee_amount, net_amount FROM settlement_items WHERE settlement_id = ? ORDER BY transaction_id`), id)
+	if err != nil {
+		return Settlement{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var item SettlementItem
+		if err := rows.Scan(&item.TransactionID, &item.ProcessorReference, &item.CapturedAmount,
+			&item.RefundedAmount, &item.FeeAmount, &item.NetAmount); err != nil {
+			return Settlement{}, err
+		}
+		st.Items = append(st.Items, item)
+	}
+	return st, rows.Err()
+}
+
+const subscriptionColumns = `id, merchant_id, status, amount, currency, card_token, billing_interval,
+	interval_count, cycle, next_charge_at, last_transaction_id, last_charge_status, failed_cycles, version,
+	created_at, updated_at, next_retry_at, retries, retries_cycle`
+
+func scanSubscription(row scanner) (Subscription, error) {
+	var sub Subscription
+	var retries string
+	err := row.Scan(&sub.SubscriptionID, &sub.MerchantID, &sub.Status, &sub.Amount, &sub.Currency, &sub.CardToken,
+		&sub.Interval, &sub.IntervalCount, &sub.Cycle, &sub.NextChargeAt, &sub.LastTransactionID,
+		&sub.LastChargeStatus, &sub.FailedCycles, &sub.version, &sub.CreatedAt, &sub.UpdatedAt, &sub.NextRetryAt,
+		&retries, &sub.RetriesCycle)
+	if err != nil {
+		return sub, err
+	}
+	return sub, json.Unmarshal([]byte(retries), &sub.Retries)
+}
+
+func (s *sqlStore) createSubscription(ctx context.Context, sub Subscription) error {
+	retries, err := json.Marshal(sub.Retries)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, s.rebind(`INSERT INTO subscriptions (`+subscriptionColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		sub.SubscriptionID, sub.MerchantID, sub.Status, sub.Amount, sub.Currency, sub.CardToken, sub.Interval,
+		sub.IntervalCount, sub.Cycle, sub.NextChargeAt, sub.LastTransactionID, sub.LastChargeStatus,
+		sub.FailedCycles, sub.version, sub.CreatedAt, sub.UpdatedAt, sub.NextRetryAt, string(retries), sub.RetriesCycle)
+	return err
+}
+
+func (s *sqlStore) subscription(ctx context.Context, id string) (Subscription, error) {
+	sub, err := scanSubscription(s.db.QueryRowContext(ctx,
+		s.rebind(`SELECT `+subscriptionColumns+` FROM subscriptions WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Subscription{}, errRecordNotFound
+	}
+	return sub, err
+}
+
+func (s *sqlStore) subscriptions(ctx context.Context, filter SubscriptionFilter) ([]Subscription, error) {
+	var where []string
+	var args []interface{}
+	if filter.MerchantID != "" {
+		where = append(where, "merchant_id = ?")
+		args = append(args, filter.MerchantID)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	if filter.DueBy != "" {
+		where = append(where, "next_charge_at <= ?")
+		args = append(args, filter.DueBy)
+	}
+	if filter.RetryDueBy != "" {
+		where = append(where, "next_retry_at <> '' AND next_retry_at <= ?")
+		args = append(args, filter.RetryDueBy)
+	}
+	query := `SELECT ` + subscriptionColumns + ` FROM subscriptions`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query+" ORDER BY created_at, id"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []Subscription
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *sqlStore) updateSubscription(ctx context.Context, sub Subscription) error {
+	retries, err := json.Marshal(sub.Retries)
+	if err != nil {
+		return err
+	}
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE subscriptions SET status = ?, cycle = ?, next_charge_at = ?,
+		last_transaction_id = ?, last_charge_status = ?, failed_cycles = ?, version = version + 1, updated_at = ?,
+		next_retry_at = ?, retries = ?, retries_cycle = ?
+		WHERE id = ? AND version = ?`),
+		sub.Status, sub.Cycle, sub.NextChargeAt, sub.LastTransactionID, sub.LastChargeStatus, sub.FailedCycles,
+		sub.UpdatedAt, sub.NextRetryAt, string(retries), sub.RetriesCycle, sub.SubscriptionID, sub.version)
+	if err := rowAffected(res, err); err != errRecordNotFound {
+		return err
+	}
+	if _, err := s.subscription(ctx, sub.SubscriptionID); err != nil {
+		return err
+	}
+	return errStatusConflict
+}
+
+const paymentLinkColumns = `id, merchant_id, status, amount, currency, description, url, expires_at,
+	transaction_id, created_at, updated_at`
+
+func (s *sqlStore) createPaymentLink(ctx context.Context, l PaymentLink) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO payment_links (`+paymentLinkColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		l.LinkID, l.MerchantID, l.Status, l.Amount, l.Currency, l.Description, l.URL, l.ExpiresAt,
+		l.TransactionID, l.CreatedAt, l.UpdatedAt)
+	return err
+}
+
+func (s *sqlStore) paymentLink(ctx context.Context, id string) (PaymentLink, error) {
+	var l PaymentLink
+	err := s.db.QueryRowContext(ctx, s.rebind(`SELECT `+paymentLinkColumns+` FROM payment_links WHERE id = ?`), id).
+		Scan(&l.LinkID, &l.MerchantID, &l.Status, &l.Amount, &l.Currency, &l.Description, &l.URL, &l.ExpiresAt,
+			&l.TransactionID, &l.CreatedAt, &l.UpdatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return PaymentLink{}, errRecordNotFound
+	}
+	return l, err
+}
+
+func (s *sqlStore) updatePaymentLink(ctx context.Context, l PaymentLink, from string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE payment_links SET status = ?, transaction_id = ?, updated_at = ?
+		WHERE id = ? AND status = ?`), l.Status, l.TransactionID, l.UpdatedAt, l.LinkID, from)
+	if err := rowAffected(res, err); err != errRecordNotFound {
+		return err
+	}
+	if _, err := s.paymentLink(ctx, l.LinkID); err != nil {
+		return err
+	}
+	return errStatusConflict
+}
+
+const payoutColumns = `id, merchant_id, status, amount, currency, destination_type, destination_account,
+	description, submits_at, expected_arrival_at, failure_code, failure_message, created_at, updated_at`
+
+func scanPayout(row scanner) (Payout, error) {
+	var p Payout
+	err := row.Scan(&p.PayoutID, &p.MerchantID, &p.Status, &p.Amount, &p.Currency, &p.Destination.Type,
+		&p.Destination.Account, &p.Description, &p.SubmitsAt, &p.ExpectedArrivalAt, &p.FailureCode,
+		&p.FailureMessage, &p.CreatedAt, &p.UpdatedAt)
+	return p, err
+}
+
+func (s *sqlStore) createPayout(ctx context.Context, p Payout) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO payouts (`+payoutColumns+`)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		p.PayoutID, p.MerchantID, p.Status, p.Amount, p.Currency, p.Destination.Type, p.Destination.Account,
+		p.Description, p.SubmitsAt, p.ExpectedArrivalAt, p.FailureCode, p.FailureMessage, p.CreatedAt, p.UpdatedAt)
+	return err
+}
+
+func (s *sqlStore) payout(ctx context.Context, id string) (Payout, error) {
+	p, err := scanPayout(s.db.QueryRowContext(ctx, s.rebind(`SELECT `+payoutColumns+` FROM payouts WHERE id = ?`), id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Payout{}, errRecordNotFound
+	}
+	return p, err
+}
+
+func (s *sqlStore) payouts(ctx context.Context, filter PayoutFilter) ([]Payout, error) {
+	var where []string
+	var args []interface{}
+	if filter.MerchantID != "" {
+		where = append(where, "merchant_id = ?")
+		args = append(args, filter.MerchantID)
+	}
+	if filter.Status != "" {
+		where = append(where, "status = ?")
+		args = append(args, filter.Status)
+	}
+	query := `SELECT ` + payoutColumns + ` FROM payouts`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query+" ORDER BY created_at, id"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var payouts []Payout
+	for rows.Next() {
+		p, err := scanPayout(rows)
+		if err != nil {
+			return nil, err
+		}
+		payouts = append(payouts, p)
+	}
+	return payouts, rows.Err()
+}
+
+func (s *sqlStore) updatePayout(ctx context.Context, p Payout, from string) error {
+	res, err := s.db.ExecContext(ctx, s.rebind(`UPDATE payouts SET status = ?, expected_arrival_at = ?,
+		failure_code = ?, failure_message = ?, updated_at = ? WHERE id = ? AND status = ?`),
+		p.Status, p.ExpectedArrivalAt, p.FailureCode, p.FailureMessage, p.UpdatedAt, p.PayoutID, from)
+	if err := rowAffected(res, err); err != errRecordNotFound {
+		return err
+	}
+	if _, err := s.payout(ctx, p.PayoutID); err != nil {
+		return err
+	}
+	return errStatusConflict
+}
+
+func (s *sqlStore) createLedgerEntry(ctx context.Context, e LedgerEntry) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO ledger_entries (id, merchant_id, currency, entry_type,
+		reference_id, created_at) VALUES (?, ?, ?, ?, ?, ?) ON CONFLICT (entry_type, reference_id) DO NOTHING`),
+		e.EntryID, e.MerchantID, e.Currency, e.Type, e.ReferenceID, e.CreatedAt)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return errDuplicateRecord
+	}
+	for i, l := range e.Lines {
+		_, err := tx.ExecContext(ctx, s.rebind(`INSERT INTO ledger_lines (entry_id, line, account, debit_minor,
+			credit_minor) VALUES (?, ?, ?, ?, ?)`), e.EntryID, i, l.Account, l.DebitMinor, l.CreditMinor)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ledgerWhere returns the WHERE clause, if any, selecting the
+// ledger_entries aliased e that match filter
+func ledgerWhere(filter LedgerFilter) (string, []interface{}) {
+	var where []string
+	var args []interface{}
+	if filter.MerchantID != "" {
+		where = append(where, "e.merchant_id = ?")
+		args = append(args, filter.MerchantID)
+	}
+	if filter.Currency != "" {
+		where = append(where, "e.currency = ?")
+		args = append(args, filter.Currency)
+	}
+	if filter.ReferenceID != "" {
+		where = append(where, "e.reference_id = ?")
+		args = append(args, filter.ReferenceID)
+	}
+	if len(filter.Types) > 0 {
+		where = append(where, "e.entry_type IN (?"+strings.Repeat(", ?", len(filter.Types)-1)+")")
+		for _, t := range filter.Types {
+			args = append(args, t)
+		}
+	}
+	if !filter.CreatedFrom.IsZero() {
+		where = append(where, "e.created_at >= ?")
+		args = append(args, formatTimestamp(filter.CreatedFrom))
+	}
+	if !filter.CreatedTo.IsZero() {
+		where = append(where, "e.created_at <= ?")
+		args = append(args, formatTimestamp(filter.CreatedTo))
+	}
+	if len(where) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(where, " AND "), args
+}
+
+func (s *sqlStore) ledgerEntries(ctx context.Context, filter LedgerFilter) ([]LedgerEntry, error) {
+	where, args := ledgerWhere(filter)
+	query := `SELECT e.id, e.merchant_id, e.currency, e.entry_type, e.reference_id, e.created_at
+		FROM ledger_entries e` + where + " ORDER BY e.created_at DESC, e.id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	var entries []LedgerEntry
+	index := map[string]int{}
+	for rows.Next() {
+		var e LedgerEntry
+		if err := rows.Scan(&e.EntryID, &e.MerchantID, &e.Currency, &e.Type, &e.ReferenceID, &e.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[e.EntryID] = len(entries)
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(entries) == 0 {
+		return entries, err
+	}
+
+	ids := make([]string, 0, len(entries))
+	placeholders := make([]string, 0, len(entries))
+	for _, e := range entries {
+		ids = append(ids, e.EntryID)
+		placeholders = append(placeholders, "?")
+	}
+	lineArgs := make([]interface{}, len(ids))
+	for i, id := range ids {
+		lineArgs[i] = id
+	}
+	lines, err := s.db.QueryContext(ctx, s.rebind(`SELECT entry_id, account, debit_minor, credit_minor FROM ledger_lines
+		WHERE entry_id IN (`+strings.Join(placeholders, ", ")+`) ORDER BY entry_id, line`), lineArgs...)
+	if err != nil {
+		return nil, err
+	}
+	defer lines.Close()
+	for lines.Next() {
+		var id string
+		var l LedgerLine
+		if err := lines.Scan(&id, &l.Account, &l.DebitMinor, &l.CreditMinor); err != nil {
+			return nil, err
+		}
+		e := &entries[index[id]]
+		e.Lines = append(e.Lines, l)
+	}
+	return entries, lines.Err()
+}
+
+func (s *sqlStore) ledgerTotals(ctx context.Context, filter LedgerFilter) ([]LedgerAccountTotal, error) {
+	where, args := ledgerWhere(filter)
+	rows, err := s.db.QueryContext(ctx, s.rebind(`SELECT e.currency, l.account, SUM(l.debit_minor), SUM(l.credit_minor)
+		FROM ledger_lines l JOIN ledger_entries e ON e.id = l.entry_id`+where+`
+		GROUP BY e.currency, l.account ORDER BY e.currency, l.account`), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var totals []LedgerAccountTotal
+	for rows.Next() {
+		var t LedgerAccountTotal
+		if err := rows.Scan(&t.Currency, &t.Account, &t.DebitMinor, &t.CreditMinor); err != nil {
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
+
+func (s *sqlStore) createAuditEntry(ctx context.Context, e AuditEntry) error {
+	_, err := s.db.ExecContext(ctx, s.rebind(`INSERT INTO audit_entries (id, action, actor, resource_type,
+		resource_id, merchant_id, request_id, client_ip, before_status, after_status, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		e.AuditID, e.Action, e.Actor, e.ResourceType, e.ResourceID, e.MerchantID, e.RequestID, e.ClientIP,
+		e.BeforeStatus, e.AfterStatus, e.CreatedAt)
+	return err
+}
+
+func (s *sqlStore) auditEntries(ctx context.Context, filter AuditFilter) ([]AuditEntry, error) {
+	var where []string
+	var args []interface{}
+	for _, c := range []struct{ column, value string }{
+		{"action", filter.Action}, {"actor", filter.Actor}, {"resource_id", filter.ResourceID},
+		{"merchant_id", filter.MerchantID}, {"request_id", filter.RequestID},
+	} {
+		if c.value != "" {
+			where = append(where, c.column+" = ?")
+			args = append(args, c.value)
+		}
+	}
+	if !filter.CreatedFrom.IsZero() {
+		where = append(where, "created_at >= ?")
+		args = append(args, formatTimestamp(filter.CreatedFrom))
+	}
+	if !filter.CreatedTo.IsZero() {
+		where = append(where, "created_at <= ?")
+		args = append(args, formatTimestamp(filter.CreatedTo))
+	}
+	if filter.StartingAfter != "" {
+		where = append(where, "id < ?")
+		args = append(args, filter.StartingAfter)
+	}
+	query := `SELECT id, action, actor, resource_type, resource_id, merchant_id, request_id, client_ip,
+		before_status, after_status, created_at FROM audit_entries`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	rows, err := s.db.QueryContext(ctx, s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.AuditID, &e.Action, &e.Actor, &e.ResourceType, &e.ResourceID, &e.MerchantID,
+			&e.RequestID, &e.ClientIP, &e.BeforeStatus, &e.AfterStatus, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// rowAffected turns a statement that matched no row into errRecordNotFound
+func rowAffected(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return errRecordNotFound
+	}
+	return nil
+}
+
+func (s *sqlStore) ping(ctx context.Context) error {
+	return s.db.PingContext(ctx)
+}
+
+func (s *sqlStore) close() error {
+	return s.db.Close()
+}
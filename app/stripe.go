@@ -0,0 +1,343 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// stripeZeroDecimal and stripeThreeDecimal are the currencies Stripe does
+// not count in hundredths; every other currency uses cents
+var (
+	stripeZeroDecimal = map[string]bool{
+		"BIF": true, "CLP": true, "DJF": true, "GNF": true, "JPY": true, "KMF": true,
+		"KRW": true, "MGA": true, "PYG": true, "RWF": true, "UGX": true, "VND": true,
+		"VUV": true, "XAF": true, "XOF": true, "XPF": true,
+	}
+	stripeThreeDecimal = map[string]bool{
+		"BHD": true, "JOD": true, "KWD": true, "OMR": true, "TND": true,
+	}
+)
+
+// stripeTestPaymentMethods stand in for card tokens Stripe has never seen:
+// test card tokens keep their forced outcome, vaulted cards keep their brand
+var stripeTestPaymentMethods = map[string]string{
+	testTokenApprove:     "pm_card_visa",
+	testTokenFraud:       "pm_card_visa_chargeDeclinedFraudulent",
+	testToken3DSRequired: "pm_card_threeDSecure2Required",
+	testTokenDeclinePfx + "insufficient_funds": "pm_card_visa_chargeDeclinedInsufficientFunds",
+	testTokenDeclinePfx + "expired_card":       "pm_card_visa_chargeDeclinedExpiredCard",
+	testTokenDeclinePfx + "incorrect_cvc":      "pm_card_visa_chargeDeclinedIncorrectCvc",
+	"visa":                                     "pm_card_visa",
+	"mastercard":                               "pm_card_mastercard",
+	"amex":                                     "pm_card_amex",
+	"discover":                                 "pm_card_discover",
+	"jcb":                                      "pm_card_jcb",
+	"diners":                                   "pm_card_diners",
+}
+
+// stripeDeclineReasons maps Stripe decline codes onto ours where they differ
+var stripeDeclineReasons = map[string]string{
+	"generic_decline": "card_declined",
+	"fraudulent":      "fraud_suspected",
+	"stolen_card":     "fraud_suspected",
+	"lost_card":       "fraud_suspected",
+}
+
+// stripeProcessor authorizes against the Stripe API in test mode. Each
+// authorization becomes a manually captured PaymentIntent, so capture and
+// refund map directly onto Stripe's.
+type stripeProcessor struct {
+	baseURL string
+	client  *http.Client
+}
+
+// loadStripeProcessor returns nil unless STRIPE_API_KEY is set. Live keys
+// are refused: the gateway is a test harness and must never move real money.
+func loadStripeProcessor() (*stripeProcessor, error) {
+	key := processorSecrets.value("STRIPE_API_KEY")
+	if key == "" {
+		return nil, nil
+	}
+	if err := checkStripeTestKey(key); err != nil {
+		return nil, err
+	}
+	// A rotated key must be a test mode key too
+	if processorSecrets != nil {
+		processorSecrets.validate("STRIPE_API_KEY", checkStripeTestKey)
+	}
+	baseURL := strings.TrimRight(getEnv("STRIPE_API_BASE", "https://api.stripe.com"), "/")
+	if _, err := url.ParseRequestURI(baseURL); err != nil {
+		return nil, fmt.Errorf("invalid STRIPE_API_BASE: %w", err)
+	}
+	return &stripeProcessor{
+		baseURL: baseURL,
+		client:  &http.Client{Timeout: getStripeTimeout()},
+	}, nil
+}
+
+// checkStripeTestKey refuses live keys
+func checkStripeTestKey(key string) error {
+	if !strings.HasPrefix(key, "sk_test_") && !strings.HasPrefix(key, "rk_test_") {
+		return fmt.Errorf("STRIPE_API_KEY must be a test mode key (sk_test_ or rk_test_)")
+	}
+	return nil
+}
+
+// apiKey is the current STRIPE_API_KEY, which may have been rotated since
+// startup
+func (p *stripeProcessor) apiKey() string {
+	return processorSecrets.value("STRIPE_API_KEY")
+}
+
+// getStripeTimeout bounds each call to the Stripe API
+func getStripeTimeout() time.Duration {
+	ms, err := strconv.Atoi(getEnv("STRIPE_TIMEOUT_MS", "10000"))
+	if err != nil || ms <= 0 {
+		return 10 * time.Second
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (p *stripeProcessor) Name() string {
+	return "stripe"
+}
+
+// stripePaymentIntent holds the PaymentIntent fields the adapter reads
+type stripePaymentIntent struct {
+	ID           string `json:"id"`
+	Status       string `json:"status"`
+	LatestCharge *struct {
+		ID                string `json:"id"`
+		AuthorizationCode string `json:"authorization_code"`
+	} `json:"latest_charge"`
+}
+
+// stripeError is the "error" object of a failed API call
+type stripeError struct {
+	Type        string `json:"type"`
+	Code        string `json:"code"`
+	DeclineCode string `json:"decline_code"`
+	Message     string `json:"message"`
+}
+
+func (p *stripeProcessor) Authorize(ctx context.Context, req AuthorizationRequest) (ProcessorResult, error) {
+	if req.tenant.chaosEngine().effectsFor(p.Name()).outage {
+		chaosInjectionsTotal.WithLabelValues(chaosProcessorOutage).Inc()
+		return ProcessorResult{}, errProcessorUnavailable
+	}
+	if window, ok := maintenance.effectsFor(p.Name()); ok && window.Mode == maintenanceOutage {
+		return ProcessorResult{}, errProcessorUnavailable
+	}
+
+	form := url.Values{
+		"amount":                   {stripeAmount(req.Amount, req.Currency)},
+		"currency":                 {strings.ToLower(req.Currency)},
+		"payment_method":           {stripePaymentMethod(req)},
+		"payment_method_types[]":   {"card"},
+		"capture_method":           {"manual"},
+		"confirm":                  {"true"},
+		"expand[]":                 {"latest_charge"},
+		"metadata[transaction_id]": {req.TransactionID},
+		"metadata[merchant_id]":    {req.MerchantID},
+	}
+	var intent stripePaymentIntent
+	result, err := p.call(ctx, "/v1/payment_intents", "authorize_"+req.TransactionID, form, &intent)
+	if err != nil || result.DeclineReason != "" {
+		return result, err
+	}
+
+	switch intent.Status {
+	case "requires_capture", "succeeded":
+		result.Approved = true
+		result.Reference = intent.ID
+		if intent.LatestCharge != nil {
+			result.AuthCode = intent.LatestCharge.AuthorizationCode
+			if result.AuthCode == "" {
+				result.AuthCode = intent.LatestCharge.ID
+			}
+		}
+	case "requires_action":
+		// The gateway runs its own 3DS simulation; a Stripe-hosted
+		// challenge can't be completed through it
+		result.DeclineReason = "authentication_required"
+	default:
+		result.DeclineReason = "card_declined"
+	}
+	return result, nil
+}
+
+// isStripeAPI reports whether p calls the Stripe API rather than
+// simulating it
+func isStripeAPI(p Processor) bool {
+	_, ok := p.(*stripeProcessor)
+	return ok
+}
+
+func (p *stripeProcessor) Capture(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	if txn.ProcessorReference == "" {
+		return ProcessorResult{DeclineReason: "unknown_payment"}, nil
+	}
+	form := url.Values{"amount_to_capture": {stripeAmount(amount, txn.Currency)}}
+	var intent stripePaymentIntent
+	result, err := p.call(ctx, "/v1/payment_intents/"+url.PathEscape(txn.ProcessorReference)+"/capture",
+		"capture_"+txn.TransactionID, form, &intent)
+	if err != nil || result.DeclineReason != "" {
+		return result, err
+	}
+	if intent.Status != "succeeded" {
+		result.DeclineReason = "capture_failed"
+		return result, nil
+	}
+	result.Approved = true
+	result.Reference = intent.ID
+	return result, nil
+}
+
+func (p *stripeProcessor) Refund(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	if txn.ProcessorReference == "" {
+		return ProcessorResult{DeclineReason: "unknown_payment"}, nil
+	}
+	form := url.Values{
+		"payment_intent": {txn.ProcessorReference},
+		"amount":         {stripeAmount(amount, txn.Currency)},
+	}
+	var refund struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+	}
+	// Partial refunds may repeat the same amount, so no idempotency key
+	result, err := p.call(ctx, "/v1/refunds", "", form, &refund)
+	if err != nil || result.DeclineReason != "" {
+		return result, err
+	}
+	if refund.Status != "succeeded" && refund.Status != "pending" {
+		result.DeclineReason = "refund_failed"
+		return result, nil
+	}
+	result.Approved = true
+	result.Reference = refund.ID
+	return result, nil
+}
+
+// HealthCheck reads the account balance, which any valid key may do
+func (p *stripeProcessor) HealthCheck(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.baseURL+"/v1/balance", nil)
+	if err != nil {
+		return err
+	}
+	req.SetBasicAuth(p.apiKey(), "")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("stripe returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// call POSTs form to path and decodes a success into out. Card errors and
+// other rejections come back as a declined result; auth failures, rate
+// limits, 5xx and network errors are errors.
+func (p *stripeProcessor) call(ctx context.Context, path, idempotencyKey string, form url.Values, out interface{}) (ProcessorResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		return ProcessorResult{}, err
+	}
+	req.SetBasicAuth(p.apiKey(), "")
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if idempotencyKey != "" {
+		req.Header.Set("Idempotency-Key", idempotencyKey)
+	}
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	result := ProcessorResult{Latency: time.Since(start)}
+	if err != nil {
+		return result, fmt.Errorf("%w: %v", errProcessorUnavailable, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return result, fmt.Errorf("%w: %v", errProcessorUnavailable, err)
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		if err := json.Unmarshal(body, out); err != nil {
+			return result, fmt.Errorf("decoding stripe response: %w", err)
+		}
+		return result, nil
+	case resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden,
+		resp.StatusCode == http.StatusTooManyRequests, resp.StatusCode >= 500:
+		return result, fmt.Errorf("%w: stripe returned %d", errProcessorUnavailable, resp.StatusCode)
+	}
+
+	var envelope struct {
+		Error stripeError `json:"error"`
+	}
+	_ = json.Unmarshal(body, &envelope)
+	result.DeclineReason = stripeDeclineReason(envelope.Error)
+	return result, nil
+}
+
+// stripeDeclineReason prefers the issuer's decline code over Stripe's
+// error code, translated to our reasons where they differ
+func stripeDeclineReason(e stripeError) string {
+	reason := e.DeclineCode
+	if reason == "" {
+		reason = e.Code
+	}
+	if reason == "" {
+		return "card_declined"
+	}
+	if mapped, ok := stripeDeclineReasons[reason]; ok {
+		return mapped
+	}
+	return reason
+}
+
+// stripeAmount converts an amount to Stripe's integer minor units.
+// Three-decimal currencies must be sent as a multiple of ten.
+func stripeAmount(amount float64, currency string) string {
+	currency = strings.ToUpper(currency)
+	switch {
+	case stripeZeroDecimal[currency]:
+		return strconv.FormatInt(int64(math.Round(amount)), 10)
+	case stripeThreeDecimal[currency]:
+		return strconv.FormatInt(int64(math.Round(amount*100))*10, 10)
+	default:
+		return strconv.FormatInt(int64(math.Round(amount*100)), 10)
+	}
+}
+
+// stripePaymentMethod picks the PaymentMethod to confirm with. Stripe IDs
+// pass through; our test and vault tokens become Stripe test cards.
+func stripePaymentMethod(req AuthorizationRequest) string {
+	if req.card != nil {
+		if pm, ok := stripeTestPaymentMethods[req.card.Brand]; ok {
+			return pm
+		}
+		return "pm_card_visa"
+	}
+	if pm, ok := stripeTestPaymentMethods[req.CardToken]; ok {
+		return pm
+	}
+	if strings.HasPrefix(req.CardToken, testTokenDeclinePfx) {
+		return "pm_card_visa_chargeDeclined"
+	}
+	if isTestCardToken(req.CardToken) {
+		return "pm_card_visa"
+	}
+	return req.CardToken
+}
@@ -0,0 +1,504 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Subscription statuses
+const (
+	subscriptionActive   = "active"
+	subscriptionPaused   = "paused"
+	subscriptionCanceled = "canceled"
+)
+
+// Subscription billing intervals
+const (
+	intervalMinute = "minute"
+	intervalHour   = "hour"
+	intervalDay    = "day"
+	intervalWeek   = "week"
+	intervalMonth  = "month"
+	intervalYear   = "year"
+)
+
+// Subscription webhook event types, one per charged cycle
+const (
+	eventSubscriptionChargeSucceeded = "subscription.charge_succeeded"
+	eventSubscriptionChargeFailed    = "subscription.charge_failed"
+)
+
+// subscriptionSweepInterval is how often due subscriptions are charged
+const subscriptionSweepInterval = time.Second
+
+var subscriptionChargesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_subscription_charges_total",
+		Help: "Total number of subscription cycles charged by result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(subscriptionChargesTotal)
+}
+
+// Subscription charges a card every IntervalCount Intervals
+type Subscription struct {
+	SubscriptionID string  `json:"subscription_id"`
+	MerchantID     string  `json:"merchant_id"`
+	Status         string  `json:"status"`
+	Amount         float64 `json:"amount"`
+	AmountMinor    int64   `json:"amount_minor"`
+	Currency       string  `json:"currency"`
+	CardToken      string  `json:"card_token"`
+	Interval       string  `json:"interval"`
+	IntervalCount  int     `json:"interval_count"`
+	// Cycle is the number of cycles charged so far
+	Cycle        int    `json:"cycle"`
+	NextChargeAt string `json:"next_charge_at"`
+	// LastTransactionID and LastChargeStatus describe the latest cycle:
+	// approved, declined, requires_action or rejected
+	LastTransactionID string `json:"last_transaction_id,omitempty"`
+	LastChargeStatus  string `json:"last_charge_status,omitempty"`
+	// FailedCycles counts consecutive cycles that weren't approved
+	FailedCycles int `json:"failed_cycles"`
+	// NextRetryAt is when the failed cycle is retried next, if it is
+	NextRetryAt string `json:"next_retry_at,omitempty"`
+	CreatedAt   string `json:"created_at"`
+	UpdatedAt   string `json:"updated_at"`
+
+	// Retries are the dunning retries of cycle RetriesCycle, the latest
+	// failed one; see GET /subscriptions/{id}/retries
+	Retries      []DunningRetry `json:"-"`
+	RetriesCycle int            `json:"-"`
+
+	// version guards updates against concurrent writers
+	version int64
+}
+
+// SubscriptionRequest is the body of POST /subscriptions
+type SubscriptionRequest struct {
+	MerchantID    string  `json:"merchant_id"`
+	AmountMinor   *int64  `json:"amount_minor,omitempty"`
+	Amount        float64 `json:"amount,omitempty"`
+	Currency      string  `json:"currency"`
+	CardToken     string  `json:"card_token"`
+	Interval      string  `json:"interval"`
+	IntervalCount int     `json:"interval_count,omitempty"`
+	// StartAt is when the first cycle is charged, RFC 3339; now by default
+	StartAt string `json:"start_at,omitempty"`
+}
+
+// SubscriptionCharge is the payload of the subscription charge events
+type SubscriptionCharge struct {
+	Subscription  Subscription           `json:"subscription"`
+	Authorization *AuthorizationResponse `json:"authorization,omitempty"`
+	// Error is set when the gateway rejected the cycle's authorization
+	Error *ErrorResponse `json:"error,omitempty"`
+	// Retry is set on the dunning retry events
+	Retry *DunningRetry `json:"retry,omitempty"`
+}
+
+// SubscriptionFilter narrows a subscriptions listing. Zero values match
+// everything.
+type SubscriptionFilter struct {
+	MerchantID string
+	Status     string
+	// DueBy matches subscriptions whose next charge is at or before it
+	DueBy string
+	// RetryDueBy matches subscriptions with a retry due at or before it
+	RetryDueBy string
+}
+
+func (f SubscriptionFilter) matches(s Subscription) bool {
+	return (f.MerchantID == "" || s.MerchantID == f.MerchantID) &&
+		(f.Status == "" || s.Status == f.Status) &&
+		(f.DueBy == "" || s.NextChargeAt <= f.DueBy) &&
+		(f.RetryDueBy == "" || (s.NextRetryAt != "" && s.NextRetryAt <= f.RetryDueBy))
+}
+
+// subscriptionsByCreation orders subscriptions by created_at then ID
+func subscriptionsByCreation(subs []Subscription) {
+	sort.Slice(subs, func(i, j int) bool {
+		if subs[i].CreatedAt != subs[j].CreatedAt {
+			return subs[i].CreatedAt < subs[j].CreatedAt
+		}
+		return subs[i].SubscriptionID < subs[j].SubscriptionID
+	})
+}
+
+func newSubscriptionID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "sub_" + hex.EncodeToString(b)
+}
+
+func (s Subscription) withMinorUnits() Subscription {
+	s.AmountMinor, _ = toMinorUnits(s.Amount, s.Currency)
+	return s
+}
+
+// after returns the charge time one interval after t
+func (s Subscription) after(t time.Time) time.Time {
+	n := s.IntervalCount
+	switch s.Interval {
+	case intervalMinute:
+		return t.Add(time.Duration(n) * time.Minute)
+	case intervalHour:
+		return t.Add(time.Duration(n) * time.Hour)
+	case intervalDay:
+		return t.AddDate(0, 0, n)
+	case intervalWeek:
+		return t.AddDate(0, 0, 7*n)
+	case intervalMonth:
+		return t.AddDate(0, n, 0)
+	default:
+		return t.AddDate(n, 0, 0)
+	}
+}
+
+// validate checks a subscription request, reusing the authorization rules
+// for the merchant, amount, currency and card token
+func (req *SubscriptionRequest) validate(now time.Time) (time.Time, []FieldViolation) {
+	auth := AuthorizationRequest{
+		MerchantID: req.MerchantID, AmountMinor: req.AmountMinor, Amount: req.Amount,
+		Currency: req.Currency, CardToken: req.CardToken,
+	}
+	violations := validateAuthorizationRequest(&auth)
+	req.Amount, req.AmountMinor, req.Currency = auth.Amount, auth.AmountMinor, auth.Currency
+
+	switch req.Interval {
+	case intervalMinute, intervalHour, intervalDay, intervalWeek, intervalMonth, intervalYear:
+	case "":
+		violations = append(violations, FieldViolation{"interval", "is required"})
+	default:
+		violations = append(violations, FieldViolation{"interval", "must be one of minute, hour, day, week, month, year"})
+	}
+	if req.IntervalCount == 0 {
+		req.IntervalCount = 1
+	}
+	if req.IntervalCount < 1 || req.IntervalCount > 365 {
+		violations = append(violations, FieldViolation{"interval_count", "must be between 1 and 365"})
+	}
+	start := now
+	if req.StartAt != "" {
+		t, err := time.Parse(time.RFC3339, req.StartAt)
+		if err != nil {
+			violations = append(violations, FieldViolation{"start_at", "must be an RFC 3339 timestamp"})
+		} else if t.After(now) {
+			start = t
+		}
+	}
+	return start, violations
+}
+
+// sweepSubscriptions charges the subscriptions that are due and runs the
+// due dunning retries. The subscriptions job runs it.
+func sweepSubscriptions(ctx context.Context, now time.Time) error {
+	due := formatTimestamp(now)
+	charges, err := dueSubscriptions(ctx, SubscriptionFilter{Status: subscriptionActive, DueBy: due})
+	if err != nil {
+		return err
+	}
+	for _, s := range charges {
+		chargeSubscription(s, time.Now())
+	}
+	retries, err := dueSubscriptions(ctx, SubscriptionFilter{Status: subscriptionActive, RetryDueBy: due})
+	if err != nil {
+		return err
+	}
+	for _, s := range retries {
+		retrySubscription(s, time.Now())
+	}
+	return nil
+}
+
+func dueSubscriptions(ctx context.Context, filter SubscriptionFilter) ([]Subscription, error) {
+	subs, err := storage.subscriptions(ctx, filter)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_subscriptions").Inc()
+		return nil, fmt.Errorf("listing due subscriptions: %w", err)
+	}
+	return subs, nil
+}
+
+// chargeSubscription claims a due cycle of s and authorizes it. Cycles
+// missed while no gateway was running are skipped, not charged late in a
+// burst.
+func chargeSubscription(s Subscription, now time.Time) {
+	ctx, cancel := storageContext()
+	defer cancel()
+
+	due, err := time.Parse(time.RFC3339, s.NextChargeAt)
+	if err != nil {
+		due = now
+	}
+	next := s.after(due)
+	for !next.After(now) {
+		next = s.after(next)
+	}
+	s.Cycle++
+	s.NextChargeAt = formatTimestamp(next)
+	s.LastTransactionID = newTransactionID()
+	s.UpdatedAt = formatTimestamp(now)
+	// Claiming the cycle first keeps another replica from charging it too
+	if err := storage.updateSubscription(ctx, s); err != nil {
+		if err != errStatusConflict {
+			storageErrorsTotal.WithLabelValues("update_subscription").Inc()
+			log.Printf("Failed to claim subscription %s: %v", s.SubscriptionID, err)
+		}
+		return
+	}
+	s.version++
+
+	response, charge := authorizeSubscription(s, s.LastTransactionID)
+	status := chargeStatus(response, charge)
+	subscriptionChargesTotal.WithLabelValues(status).Inc()
+
+	eventType := eventSubscriptionChargeSucceeded
+	apply := func(stored *Subscription) {
+		stored.LastChargeStatus = status
+		if status == "approved" {
+			stored.FailedCycles = 0
+			stored.cancelRetries()
+			return
+		}
+		stored.FailedCycles = s.FailedCycles + 1
+		failed := &response
+		if charge.Error != nil {
+			failed = nil
+		}
+		stored.planRetries(failed, now)
+	}
+	apply(&s)
+	if status != "approved" {
+		eventType = eventSubscriptionChargeFailed
+	}
+
+	if err := recordSubscriptionCharge(ctx, s, apply); err != nil {
+		storageErrorsTotal.WithLabelValues("update_subscription").Inc()
+		log.Printf("Failed to record charge of subscription %s: %v", s.SubscriptionID, err)
+	}
+	charge.Subscription = s.withMinorUnits()
+	emitEvent(s.MerchantID, eventType, charge)
+}
+
+// authorizeSubscription authorizes s's amount as transaction txnID
+func authorizeSubscription(s Subscription, txnID string) (AuthorizationResponse, SubscriptionCharge) {
+	minor := s.withMinorUnits().AmountMinor
+	response, rejection := authorize(AuthorizationRequest{
+		MerchantID:    s.MerchantID,
+		AmountMinor:   &minor,
+		Currency:      s.Currency,
+		CardToken:     s.CardToken,
+		TransactionID: txnID,
+	}, time.Now())
+	if rejection != nil {
+		return response, SubscriptionCharge{
+			Error: &ErrorResponse{Code: rejection.Code, Message: rejection.Message, Details: rejection.Details},
+		}
+	}
+	return response, SubscriptionCharge{Authorization: &response}
+}
+
+// chargeStatus is the authorization's status, or "rejected" if the gateway
+// refused it
+func chargeStatus(response AuthorizationResponse, charge SubscriptionCharge) string {
+	if charge.Error != nil {
+		return "rejected"
+	}
+	return response.Status
+}
+
+// recordSubscriptionCharge stores s after apply recorded a charge outcome
+// on it. If the merchant paused or canceled the subscription meanwhile,
+// apply is replayed on the stored one.
+func recordSubscriptionCharge(ctx context.Context, s Subscription, apply func(*Subscription)) error {
+	for {
+		err := storage.updateSubscription(ctx, s)
+		if err != errStatusConflict {
+			return err
+		}
+		stored, err := storage.subscription(ctx, s.SubscriptionID)
+		if err != nil {
+			return err
+		}
+		apply(&stored)
+		stored.UpdatedAt = s.UpdatedAt
+		s = stored
+	}
+}
+
+// loadSubscription fetches a subscription visible to the caller, writing
+// the error response and returning false when there is none
+func loadSubscription(ctx context.Context, w http.ResponseWriter, r *http.Request) (Subscription, bool) {
+	s, err := storage.subscription(ctx, r.PathValue("id"))
+	if err == errRecordNotFound {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Subscription not found", nil)
+		return Subscription{}, false
+	}
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("get_subscription").Inc()
+		log.Printf("Failed to load subscription %s: %v", r.PathValue("id"), err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return Subscription{}, false
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok && s.MerchantID != merchantID {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Subscription not found", nil)
+		return Subscription{}, false
+	}
+	return s, true
+}
+
+// handleSubscriptionCreate starts a subscription (POST /subscriptions)
+func handleSubscriptionCreate(w http.ResponseWriter, r *http.Request) {
+	var req SubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON subscription request"}})
+		return
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		req.MerchantID = merchantID
+	}
+	now := time.Now()
+	start, violations := req.validate(now)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+
+	s := Subscription{
+		SubscriptionID: newSubscriptionID(),
+		MerchantID:     req.MerchantID,
+		Status:         subscriptionActive,
+		Amount:         req.Amount,
+		Currency:       req.Currency,
+		CardToken:      req.CardToken,
+		Interval:       req.Interval,
+		IntervalCount:  req.IntervalCount,
+		NextChargeAt:   formatTimestamp(start),
+		CreatedAt:      formatTimestamp(now),
+		UpdatedAt:      formatTimestamp(now),
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	if err := storage.createSubscription(ctx, s); err != nil {
+		storageErrorsTotal.WithLabelValues("create_subscription").Inc()
+		log.Printf("Failed to create subscription: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(s.withMinorUnits())
+}
+
+// handleSubscriptionList lists subscriptions, oldest first (GET
+// /subscriptions). Filters: merchant_id and status. Authenticated merchants
+// only see their own.
+func handleSubscriptionList(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter := SubscriptionFilter{MerchantID: q.Get("merchant_id"), Status: q.Get("status")}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		filter.MerchantID = merchantID
+	}
+	switch filter.Status {
+	case "", subscriptionActive, subscriptionPaused, subscriptionCanceled:
+	default:
+		writeValidationError(w, r, []FieldViolation{{"status", "must be one of active, paused, canceled"}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	subs, err := storage.subscriptions(ctx, filter)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_subscriptions").Inc()
+		log.Printf("Failed to list subscriptions: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	result := make([]Subscription, 0, len(subs))
+	for _, s := range subs {
+		result = append(result, s.withMinorUnits())
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(result)
+}
+
+// handleSubscriptionGet returns a subscription (GET /subscriptions/{id})
+func handleSubscriptionGet(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	s, ok := loadSubscription(ctx, w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.withMinorUnits())
+}
+
+// handleSubscriptionPause stops charging an active subscription (POST
+// /subscriptions/{id}/pause)
+func handleSubscriptionPause(w http.ResponseWriter, r *http.Request) {
+	changeSubscriptionStatus(w, r, subscriptionPaused, subscriptionActive)
+}
+
+// handleSubscriptionResume charges a paused subscription again from its
+// next cycle, or right away if that is past (POST
+// /subscriptions/{id}/resume)
+func handleSubscriptionResume(w http.ResponseWriter, r *http.Request) {
+	changeSubscriptionStatus(w, r, subscriptionActive, subscriptionPaused)
+}
+
+// handleSubscriptionCancel ends a subscription for good (POST
+// /subscriptions/{id}/cancel)
+func handleSubscriptionCancel(w http.ResponseWriter, r *http.Request) {
+	changeSubscriptionStatus(w, r, subscriptionCanceled, subscriptionActive, subscriptionPaused)
+}
+
+// changeSubscriptionStatus moves a subscription in one of the from
+// statuses to status
+func changeSubscriptionStatus(w http.ResponseWriter, r *http.Request, status string, from ...string) {
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	s, ok := loadSubscription(ctx, w, r)
+	if !ok {
+		return
+	}
+	if !containsString(from, s.Status) {
+		writeError(w, r, http.StatusConflict, errCodeInvalidSubscriptionState,
+			fmt.Sprintf("Subscription %s is %s", s.SubscriptionID, s.Status), nil)
+		return
+	}
+	now := time.Now()
+	s.Status = status
+	s.UpdatedAt = formatTimestamp(now)
+	if status == subscriptionCanceled {
+		s.cancelRetries()
+	}
+	switch err := storage.updateSubscription(ctx, s); err {
+	case nil:
+	case errStatusConflict:
+		writeError(w, r, http.StatusConflict, errCodeInvalidSubscriptionState,
+			fmt.Sprintf("Subscription %s changed concurrently; retry", s.SubscriptionID), nil)
+		return
+	default:
+		storageErrorsTotal.WithLabelValues("update_subscription").Inc()
+		log.Printf("Failed to update subscription %s: %v", s.SubscriptionID, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(s.withMinorUnits())
+}
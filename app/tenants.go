@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// tenantHeader selects the tenant a request belongs to. A /tenants/{id}
+// path prefix sets it too.
+const tenantHeader = "X-Tenant-ID"
+
+// defaultTenant labels the metrics of requests without a tenant; it can't
+// be created
+const defaultTenant = "default"
+
+// maxTenants bounds the tenants, whose IDs label metrics
+const maxTenants = 100
+
+func init() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "voyager_tenants",
+			Help: "Number of tenants created via /admin/tenants",
+		},
+		func() float64 { return float64(tenants.count()) },
+	))
+}
+
+// Tenant is a team sharing the deployment. Its authorizations and
+// transactions are stored apart from everyone else's, rate limited by
+// buckets of their own, and only see its own chaos experiments.
+type Tenant struct {
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+	// RateLimit is the tenant's per-merchant limit as rps:burst. Unset,
+	// the tenant gets the limits in effect when it was created.
+	RateLimit string `json:"rate_limit,omitempty"`
+	CreatedAt string `json:"created_at"`
+}
+
+// tenant is a Tenant with its isolated state. A nil *tenant is the
+// default namespace, the one requests without a tenant use.
+type tenant struct {
+	Tenant
+	store *memoryStore
+	// limiter is nil when the tenant isn't rate limited
+	limiter *rateLimiter
+	chaos   *chaosEngine
+}
+
+// transactions returns the store holding the tenant's transactions
+func (t *tenant) transactions() transactionStore {
+	if t == nil {
+		return storage
+	}
+	return t.store
+}
+
+// rateLimiter returns the limiter in effect for the tenant, nil when its
+// requests aren't limited
+func (t *tenant) rateLimiter() *rateLimiter {
+	if t == nil {
+		return currentRateLimiter()
+	}
+	return t.limiter
+}
+
+// chaosEngine returns the experiments affecting the tenant's requests
+func (t *tenant) chaosEngine() *chaosEngine {
+	if t == nil {
+		return chaos
+	}
+	return t.chaos
+}
+
+// label is the tenant label of the tenant's metrics
+func (t *tenant) label() string {
+	if t == nil {
+		return defaultTenant
+	}
+	return t.ID
+}
+
+// tenantRegistry holds the tenants by ID
+type tenantRegistry struct {
+	mu      sync.RWMutex
+	tenants map[string]*tenant
+}
+
+var tenants = &tenantRegistry{tenants: make(map[string]*tenant)}
+
+func (r *tenantRegistry) get(id string) (*tenant, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.tenants[id]
+	return t, ok
+}
+
+// stores returns every tenant's transaction store
+func (r *tenantRegistry) stores() []transactionStore {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	stores := make([]transactionStore, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		stores = append(stores, t.store)
+	}
+	return stores
+}
+
+// rateLimiters returns the limiters of the tenants that have their own
+func (r *tenantRegistry) rateLimiters() []*rateLimiter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	limiters := make([]*rateLimiter, 0, len(r.tenants))
+	for _, t := range r.tenants {
+		if t.limiter != nil {
+			limiters = append(limiters, t.limiter)
+		}
+	}
+	return limiters
+}
+
+func (r *tenantRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.tenants)
+}
+
+// list returns the tenants sorted by ID
+func (r *tenantRegistry) list() []Tenant {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]Tenant, 0, len(r.tenants))
+	for _, id := range sortedKeys(r.tenants) {
+		list = append(list, r.tenants[id].Tenant)
+	}
+	return list
+}
+
+// add registers t unless its ID is taken or maxTenants is reached
+func (r *tenantRegistry) add(t *tenant) *FieldViolation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tenants[t.ID]; ok {
+		return &FieldViolation{"id", "is already taken by another tenant"}
+	}
+	if len(r.tenants) >= maxTenants {
+		return &FieldViolation{"id", fmt.Sprintf("exceeds the limit of %d tenants", maxTenants)}
+	}
+	r.tenants[t.ID] = t
+	return nil
+}
+
+func (r *tenantRegistry) remove(id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tenants[id]; !ok {
+		return false
+	}
+	delete(r.tenants, id)
+	return true
+}
+
+// newTenant validates a tenant definition and sets up its state
+func newTenant(def Tenant, now time.Time) (*tenant, []FieldViolation) {
+	var violations []FieldViolation
+	if !merchantIDPattern.MatchString(def.ID) {
+		violations = append(violations, FieldViolation{"id", "must be 1-64 characters of letters, digits, '_' or '-'"})
+	} else if def.ID == defaultTenant {
+		violations = append(violations, FieldViolation{"id", "is reserved for requests without a tenant"})
+	}
+	t := &tenant{store: newMemoryStore(), chaos: &chaosEngine{}}
+	if def.RateLimit != "" {
+		limit, err := parseRateLimit(def.RateLimit)
+		if err != nil {
+			violations = append(violations, FieldViolation{"rate_limit", err.Error()})
+		}
+		t.limiter = newRateLimiter(limit, nil)
+	} else if limiter := currentRateLimiter(); limiter != nil {
+		t.limiter = newRateLimiter(limiter.defaultLimit, limiter.overrides)
+	}
+	if t.limiter != nil {
+		t.limiter.scope = def.ID
+	}
+	if len(violations) > 0 {
+		return nil, violations
+	}
+	def.CreatedAt = formatTimestamp(now)
+	t.Tenant = def
+	return t, nil
+}
+
+type tenantContextKey struct{}
+
+// tenantFromContext returns the request's tenant, nil for the default
+// namespace
+func tenantFromContext(ctx context.Context) *tenant {
+	t, _ := ctx.Value(tenantContextKey{}).(*tenant)
+	return t
+}
+
+// tenantStore returns the transaction store of the request's tenant
+func tenantStore(ctx context.Context) transactionStore {
+	return tenantFromContext(ctx).transactions()
+}
+
+// withTenant resolves X-Tenant-ID, rejecting tenants that don't exist.
+// Requests without it stay in the default namespace.
+func withTenant(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(tenantHeader)
+		if id == "" {
+			next(w, r)
+			return
+		}
+		t, ok := tenants.get(id)
+		if !ok {
+			writeError(w, r, http.StatusNotFound, errCodeNotFound, "Tenant not found", nil)
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), tenantContextKey{}, t)))
+	}
+}
+
+// stripTenantPrefix turns /tenants/{id}/authorize into /authorize with
+// X-Tenant-ID: {id}, for clients that can't set headers
+func stripTenantPrefix(r *http.Request) *http.Request {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/tenants/")
+	if !ok {
+		return r
+	}
+	id, path, _ := strings.Cut(rest, "/")
+	r = r.Clone(r.Context())
+	r.Header.Set(tenantHeader, id)
+	r.URL.Path, r.URL.RawPath = "/"+path, ""
+	return r
+}
+
+// TenantList is the body of GET /admin/tenants
+type TenantList struct {
+	Data []Tenant `json:"data"`
+}
+
+// handleTenantList lists the tenants (GET /admin/tenants)
+func handleTenantList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(TenantList{Data: tenants.list()})
+}
+
+// handleTenantGet returns a tenant (GET /admin/tenants/{id})
+func handleTenantGet(w http.ResponseWriter, r *http.Request) {
+	t, ok := tenants.get(r.PathValue("id"))
+	if !ok {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Tenant not found", nil)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(t.Tenant)
+}
+
+// handleTenantCreate creates a tenant with empty stores (POST /admin/tenants)
+func handleTenantCreate(w http.ResponseWriter, r *http.Request) {
+	var def Tenant
+	if err := json.NewDecoder(r.Body).Decode(&def); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON tenant"}})
+		return
+	}
+	t, violations := newTenant(def, time.Now())
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	if violation := tenants.add(t); violation != nil {
+		writeValidationError(w, r, []FieldViolation{*violation})
+		return
+	}
+	log.Printf("Tenant %s created via admin API", t.ID)
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditTenantCreated, ResourceType: "tenant", ResourceID: t.ID})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(t.Tenant)
+}
+
+// handleTenantDelete deletes a tenant with its transactions, rate limit
+// buckets, chaos experiments and metrics (DELETE /admin/tenants/{id})
+func handleTenantDelete(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if !tenants.remove(id) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Tenant not found", nil)
+		return
+	}
+	authorizationTotal.DeletePartialMatch(prometheus.Labels{"tenant": id})
+	authorizationDuration.DeletePartialMatch(prometheus.Labels{"tenant": id})
+	log.Printf("Tenant %s deleted via admin API", id)
+	recordAudit(auditOriginOf(r), AuditEntry{Action: auditTenantDeleted, ResourceType: "tenant", ResourceID: id})
+	w.WriteHeader(http.StatusNoContent)
+}
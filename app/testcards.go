@@ -0,0 +1,186 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Magic card tokens that force an outcome regardless of FAILURE_RATE, so
+// integration suites can assert on every path deterministically:
+//
+//	tok_approve                  always approved
+//	tok_decline_<reason>         declined with <reason>, e.g. tok_decline_insufficient_funds
+//	tok_timeout                  declined with processor_timeout after TEST_TIMEOUT_LATENCY_MS
+//	tok_fraud                    declined with fraud_suspected
+//	tok_3ds_required             always challenged with 3DS
+const (
+	testTokenApprove     = "tok_approve"
+	testTokenDeclinePfx  = "tok_decline_"
+	testTokenTimeout     = "tok_timeout"
+	testTokenFraud       = "tok_fraud"
+	testToken3DSRequired = "tok_3ds_required"
+)
+
+var testDeclineReasonPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+
+var testCardsUsedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_test_cards_used_total",
+		Help: "Total number of authorizations that used a magic test card token",
+	},
+	[]string{"token"},
+)
+
+func init() {
+	prometheus.MustRegister(testCardsUsedTotal)
+}
+
+// testCardsEnabled reports whether magic tokens are honoured
+func testCardsEnabled() bool {
+	return getEnv("TEST_CARDS_ENABLED", "true") == "true"
+}
+
+// isTestCardToken reports whether a token is one of the magic test tokens
+func isTestCardToken(token string) bool {
+	if !testCardsEnabled() {
+		return false
+	}
+	switch token {
+	case testTokenApprove, testTokenTimeout, testTokenFraud, testToken3DSRequired:
+		return true
+	}
+	reason, ok := strings.CutPrefix(token, testTokenDeclinePfx)
+	return ok && testDeclineReasonPattern.MatchString(reason)
+}
+
+// getTestTimeoutLatency returns how long tok_timeout waits before declining
+func getTestTimeoutLatency() time.Duration {
+	ms, err := strconv.Atoi(getEnv("TEST_TIMEOUT_LATENCY_MS", "1000"))
+	if err != nil || ms < 0 {
+		return time.Second
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// testCardOutcome returns the forced processor outcome for a magic token.
+// The result is an auth code on success and a decline reason otherwise;
+// the caller waits out the latency.
+func testCardOutcome(token string) (forced bool, success bool, result string, latency time.Duration) {
+	if !isTestCardToken(token) || token == testToken3DSRequired {
+		return false, false, "", 0
+	}
+	testCardsUsedTotal.WithLabelValues(testCardLabel(token)).Inc()
+
+	switch token {
+	case testTokenApprove:
+		return true, true, "AUTHTEST00", 0
+	case testTokenTimeout:
+		return true, false, "processor_timeout", getTestTimeoutLatency()
+	case testTokenFraud:
+		return true, false, "fraud_suspected", 0
+	default:
+		return true, false, strings.TrimPrefix(token, testTokenDeclinePfx), 0
+	}
+}
+
+// forcesChallenge reports whether a token always triggers 3DS
+func forcesChallenge(token string) bool {
+	if token == testToken3DSRequired && isTestCardToken(token) {
+		testCardsUsedTotal.WithLabelValues(token).Inc()
+		return true
+	}
+	return false
+}
+
+// testCardLabel keeps the metric label set bounded for tok_decline_<reason>
+func testCardLabel(token string) string {
+	if strings.HasPrefix(token, testTokenDeclinePfx) {
+		return testTokenDeclinePfx + "*"
+	}
+	return token
+}
+
+// Test headers steer a single /authorize request while
+// TEST_HEADERS_ENABLED=true, without touching the global config:
+//
+//	X-Force-Processor: <name>          routed to <name>, skipping routing
+//	X-Force-Outcome: approve           approved without calling the processor
+//	X-Force-Outcome: decline:<reason>  declined with <reason>
+//	X-Force-Outcome: timeout           declined with processor_timeout after TEST_TIMEOUT_LATENCY_MS
+//
+// Honored headers are echoed on the response.
+const (
+	headerForceProcessor = "X-Force-Processor"
+	headerForceOutcome   = "X-Force-Outcome"
+)
+
+var testHeadersUsedTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_test_headers_used_total",
+		Help: "Total number of authorizations steered by a test header",
+	},
+	[]string{"header"},
+)
+
+func init() {
+	prometheus.MustRegister(testHeadersUsedTotal)
+}
+
+// testHeadersEnabled reports whether X-Force-* headers are honoured. They
+// are off by default: anyone able to reach /authorize could steer it.
+func testHeadersEnabled() bool {
+	return getEnv("TEST_HEADERS_ENABLED", "false") == "true"
+}
+
+// applyTestHeaders pins req to the processor and outcome its test headers
+// ask for, echoing them on w
+func applyTestHeaders(w http.ResponseWriter, r *http.Request, req *AuthorizationRequest) []FieldViolation {
+	processor, outcome := r.Header.Get(headerForceProcessor), r.Header.Get(headerForceOutcome)
+	var violations []FieldViolation
+	if processor != "" && !isKnownProcessor(processor) {
+		violations = append(violations, FieldViolation{headerForceProcessor, fmt.Sprintf("must be one of %s", strings.Join(processors.names(), ", "))})
+	}
+	var forced *ProcessorResult
+	if outcome != "" {
+		var ok bool
+		if forced, ok = parseForcedOutcome(outcome); !ok {
+			violations = append(violations, FieldViolation{headerForceOutcome, "must be approve, decline:<reason> or timeout"})
+		}
+	}
+	if len(violations) > 0 {
+		return violations
+	}
+
+	if processor != "" {
+		req.processor = processor
+		w.Header().Set(headerForceProcessor, processor)
+		testHeadersUsedTotal.WithLabelValues(headerForceProcessor).Inc()
+	}
+	if forced != nil {
+		req.forced = forced
+		w.Header().Set(headerForceOutcome, outcome)
+		testHeadersUsedTotal.WithLabelValues(headerForceOutcome).Inc()
+	}
+	return nil
+}
+
+// parseForcedOutcome returns the processor answer X-Force-Outcome asks for
+func parseForcedOutcome(outcome string) (*ProcessorResult, bool) {
+	switch outcome {
+	case "approve":
+		return &ProcessorResult{Approved: true, AuthCode: "AUTHTEST00"}, true
+	case "timeout":
+		return &ProcessorResult{DeclineReason: "processor_timeout", Latency: getTestTimeoutLatency()}, true
+	}
+	reason, ok := strings.CutPrefix(outcome, "decline:")
+	if !ok || !testDeclineReasonPattern.MatchString(reason) {
+		return nil, false
+	}
+	return &ProcessorResult{DeclineReason: reason}, true
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// 3DS challenge states
+const (
+	challengePending       = "pending"
+	challengeAuthenticated = "authenticated"
+	challengeFailed        = "failed"
+)
+
+var threeDSChallengesTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_3ds_challenges_total",
+		Help: "Total number of 3DS challenges by lifecycle result",
+	},
+	[]string{"result"},
+)
+
+func init() {
+	prometheus.MustRegister(threeDSChallengesTotal)
+}
+
+// challengeRates holds per-merchant overrides of THREEDS_CHALLENGE_RATE
+var challengeRates = map[string]float64{}
+
+// loadChallengeRates reads THREEDS_CHALLENGE_RATES, a comma separated list
+// of merchant_id=probability pairs
+func loadChallengeRates() error {
+	for _, pair := range strings.Split(os.Getenv("THREEDS_CHALLENGE_RATES"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		merchantID, rateStr, ok := strings.Cut(pair, "=")
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if !ok || merchantID == "" || err != nil || rate < 0 || rate > 1 {
+			return fmt.Errorf("invalid THREEDS_CHALLENGE_RATES entry %q, expected merchant_id=probability", pair)
+		}
+		challengeRates[merchantID] = rate
+	}
+	return nil
+}
+
+// getChallengeRate returns the probability that a merchant's authorization
+// is challenged
+func getChallengeRate(merchantID string) float64 {
+	if rate, ok := challengeRates[merchantID]; ok {
+		return rate
+	}
+	rate, err := strconv.ParseFloat(getEnv("THREEDS_CHALLENGE_RATE", "0"), 64)
+	if err != nil {
+		return 0
+	}
+	return rate
+}
+
+// getChallengeFailureRate returns the probability that a challenge completed
+// without an explicit outcome fails
+func getChallengeFailureRate() float64 {
+	rate, err := strconv.ParseFloat(getEnv("THREEDS_FAILURE_RATE", "0.1"), 64)
+	if err != nil {
+		return 0.1
+	}
+	return rate
+}
+
+// getChallengeTTL returns how long a challenge stays open before it expires
+func getChallengeTTL() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("THREEDS_CHALLENGE_TTL_SECONDS", "600"))
+	if err != nil || seconds <= 0 {
+		return 10 * time.Minute
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// pendingChallenge is an authorization parked until its 3DS challenge is
+// completed and the payment confirmed
+type pendingChallenge struct {
+	Request   AuthorizationRequest
+	Status    string
+	ExpiresAt time.Time
+}
+
+// challengeStore keeps open challenges keyed by challenge token
+type challengeStore struct {
+	mu         sync.Mutex
+	challenges map[string]*pendingChallenge
+	lastPrune  int64
+}
+
+var challenges = &challengeStore{challenges: make(map[string]*pendingChallenge)}
+
+// maybeRequireChallenge decides whether an authorization needs a 3DS
+// challenge and, if so, parks it and returns the challenge token
+func maybeRequireChallenge(req AuthorizationRequest) (string, bool) {
+	if forcesChallenge(req.CardToken) {
+		return challenges.open(req), true
+	}
+	if rule, ok := currentConfig().matchAmountRule("", req.Amount); ok && rule.Outcome == amountRuleRequiresAction {
+		amountRulesMatchedTotal.WithLabelValues("any", rule.Outcome).Inc()
+		return challenges.open(req), true
+	}
+	rate := getChallengeRate(req.MerchantID)
+	if rate <= 0 || rng.Float64() >= rate {
+		return "", false
+	}
+	return challenges.open(req), true
+}
+
+func newChallengeToken() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return "3ds_" + hex.EncodeToString(b)
+}
+
+// open parks an authorization behind a new challenge
+func (s *challengeStore) open(req AuthorizationRequest) string {
+	s.pruneExpired()
+	req.challenged = true
+
+	token := newChallengeToken()
+	s.mu.Lock()
+	s.challenges[token] = &pendingChallenge{
+		Request:   req,
+		Status:    challengePending,
+		ExpiresAt: time.Now().Add(getChallengeTTL()),
+	}
+	s.mu.Unlock()
+
+	threeDSChallengesTotal.WithLabelValues("issued").Inc()
+	return token
+}
+
+// pruneExpired drops expired challenges, at most once per second
+func (s *challengeStore) pruneExpired() {
+	now := time.Now()
+	last := atomic.LoadInt64(&s.lastPrune)
+	if now.UnixNano()-last < int64(time.Second) || !atomic.CompareAndSwapInt64(&s.lastPrune, last, now.UnixNano()) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for token, c := range s.challenges {
+		if now.After(c.ExpiresAt) {
+			delete(s.challenges, token)
+			threeDSChallengesTotal.WithLabelValues("expired").Inc()
+		}
+	}
+}
+
+// complete records the cardholder's challenge result
+func (s *challengeStore) complete(token string, authenticated bool) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.challenges[token]
+	if !ok || time.Now().After(c.ExpiresAt) {
+		return "", errChallengeNotFound
+	}
+	if c.Status != challengePending {
+		return c.Status, errChallengeState
+	}
+
+	c.Status = challengeFailed
+	if authenticated {
+		c.Status = challengeAuthenticated
+	}
+	threeDSChallengesTotal.WithLabelValues(c.Status).Inc()
+	return c.Status, nil
+}
+
+// take removes a completed challenge so its authorization can be finalized
+// exactly once. Challenges still pending are left in place.
+func (s *challengeStore) take(token, merchantID string) (*pendingChallenge, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c, ok := s.challenges[token]
+	if !ok || time.Now().After(c.ExpiresAt) || (merchantID != "" && c.Request.MerchantID != merchantID) {
+		return nil, errChallengeNotFound
+	}
+	if c.Status == challengePending {
+		return nil, errChallengeState
+	}
+	delete(s.challenges, token)
+	return c, nil
+}
+
+var (
+	errChallengeNotFound = errors.New("challenge not found or expired")
+	errChallengeState    = errors.New("challenge is not in the expected state")
+)
+
+// ChallengeRequest completes a simulated 3DS challenge. Outcome may be
+// "success" or "failure"; when omitted it is drawn from THREEDS_FAILURE_RATE.
+type ChallengeRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	Outcome        string `json:"outcome,omitempty"`
+}
+
+// handleThreeDSChallenge simulates the issuer's challenge page
+func handleThreeDSChallenge(w http.ResponseWriter, r *http.Request) {
+	var req ChallengeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChallengeToken == "" {
+		writeValidationError(w, r, []FieldViolation{{"challenge_token", "is required"}})
+		return
+	}
+
+	var authenticated bool
+	switch req.Outcome {
+	case "success":
+		authenticated = true
+	case "failure":
+		authenticated = false
+	case "":
+		authenticated = rng.Float64() >= getChallengeFailureRate()
+	default:
+		writeValidationError(w, r, []FieldViolation{{"outcome", "must be \"success\" or \"failure\""}})
+		return
+	}
+
+	status, err := challenges.complete(req.ChallengeToken, authenticated)
+	switch err {
+	case nil:
+	case errChallengeNotFound:
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Challenge not found or expired", nil)
+		return
+	default:
+		writeError(w, r, http.StatusConflict, errCodeInvalidChallengeState,
+			fmt.Sprintf("Challenge already %s", status), nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"challenge_token": req.ChallengeToken,
+		"status":          status,
+	})
+}
+
+// ConfirmRequest finalizes an authorization after its 3DS challenge
+type ConfirmRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+}
+
+// handleAuthorizationConfirm sends an authenticated authorization to the
+// processor, or declines it if the challenge failed
+func handleAuthorizationConfirm(w http.ResponseWriter, r *http.Request) {
+	startTime := time.Now()
+
+	var req ConfirmRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.ChallengeToken == "" {
+		writeValidationError(w, r, []FieldViolation{{"challenge_token", "is required"}})
+		return
+	}
+
+	merchantID, _ := merchantFromContext(r.Context())
+	challenge, err := challenges.take(req.ChallengeToken, merchantID)
+	switch err {
+	case nil:
+	case errChallengeNotFound:
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Challenge not found or expired", nil)
+		return
+	default:
+		writeError(w, r, http.StatusConflict, errCodeInvalidChallengeState, "Challenge has not been completed", nil)
+		return
+	}
+
+	var response AuthorizationResponse
+	if challenge.Status == challengeFailed {
+		response = declineWithoutProcessor(challenge.Request, "authentication_failed")
+	} else {
+		challenge.Request.exemplar = requestExemplar(r)
+		response = processAuthorization(challenge.Request, startTime)
+	}
+	recordAuthorizationAudit(auditOriginOf(r), auditAuthorizationConfirmed, challenge.Request.MerchantID, response, "requires_action")
+	writeAuthorizationResponse(w, response)
+}
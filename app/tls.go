@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	tlsReloadsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_tls_reloads_total",
+			Help: "Total number of TLS certificate loads by result",
+		},
+		[]string{"result"},
+	)
+
+	tlsCertExpiry = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "voyager_tls_cert_expiry_timestamp_seconds",
+			Help: "Unix time at which the serving certificate expires",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tlsReloadsTotal)
+	prometheus.MustRegister(tlsCertExpiry)
+}
+
+// tlsFiles serves the public listener's certificate and, in mTLS mode, the
+// CA bundle client certificates are verified against. It is nil when
+// TLS_CERT_FILE is unset and the listener speaks plain HTTP.
+var tlsFiles *tlsReloader
+
+// tlsReloader reloads the certificate, key and client CA files when their
+// content changes, so rotated certificates are served without a restart.
+// Connections already established keep the certificate they negotiated.
+type tlsReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu       sync.Mutex
+	checksum string
+	current  atomic.Pointer[tlsMaterial]
+}
+
+type tlsMaterial struct {
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// loadTLS reads TLS_CERT_FILE, TLS_KEY_FILE and the optional
+// TLS_CLIENT_CA_FILE and starts watching them. It returns nil if TLS is
+// not configured.
+func loadTLS() (*tlsReloader, error) {
+	t := &tlsReloader{
+		certFile:     os.Getenv("TLS_CERT_FILE"),
+		keyFile:      os.Getenv("TLS_KEY_FILE"),
+		clientCAFile: os.Getenv("TLS_CLIENT_CA_FILE"),
+	}
+	if t.certFile == "" && t.keyFile == "" {
+		if t.clientCAFile != "" {
+			return nil, fmt.Errorf("TLS_CLIENT_CA_FILE requires TLS_CERT_FILE and TLS_KEY_FILE")
+		}
+		return nil, nil
+	}
+	if t.certFile == "" || t.keyFile == "" {
+		return nil, fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if err := t.reload(); err != nil {
+		return nil, err
+	}
+	go t.watch(getTLSPollInterval())
+	return t, nil
+}
+
+// getTLSPollInterval returns how often the certificate files are checked
+// for changes
+func getTLSPollInterval() time.Duration {
+	seconds, err := strconv.Atoi(getEnv("TLS_POLL_INTERVAL_SECONDS", "30"))
+	if err != nil || seconds <= 0 {
+		return 30 * time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// mutual reports whether clients must present a certificate signed by
+// TLS_CLIENT_CA_FILE on the routes that require one
+func (t *tlsReloader) mutual() bool {
+	return t != nil && t.clientCAFile != ""
+}
+
+// reload reads the files and swaps them in unless their content is
+// unchanged. On error the previous certificate stays in use.
+func (t *tlsReloader) reload() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	files := []string{t.certFile, t.keyFile}
+	if t.clientCAFile != "" {
+		files = append(files, t.clientCAFile)
+	}
+	contents := make([][]byte, len(files))
+	digest := sha256.New()
+	for i, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			tlsReloadsTotal.WithLabelValues("error").Inc()
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+		contents[i] = data
+		digest.Write(data)
+	}
+	checksum := fmt.Sprintf("%x", digest.Sum(nil))
+	if checksum == t.checksum {
+		return nil
+	}
+
+	cert, err := tls.X509KeyPair(contents[0], contents[1])
+	if err != nil {
+		tlsReloadsTotal.WithLabelValues("invalid").Inc()
+		return fmt.Errorf("loading %s and %s: %w", t.certFile, t.keyFile, err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		tlsReloadsTotal.WithLabelValues("invalid").Inc()
+		return fmt.Errorf("parsing %s: %w", t.certFile, err)
+	}
+	material := &tlsMaterial{cert: &cert}
+	if t.clientCAFile != "" {
+		material.clientCAs = x509.NewCertPool()
+		if !material.clientCAs.AppendCertsFromPEM(contents[2]) {
+			tlsReloadsTotal.WithLabelValues("invalid").Inc()
+			return fmt.Errorf("no PEM certificates in %s", t.clientCAFile)
+		}
+	}
+
+	t.current.Store(material)
+	t.checksum = checksum
+	tlsCertExpiry.Set(float64(leaf.NotAfter.Unix()))
+	tlsReloadsTotal.WithLabelValues("success").Inc()
+	log.Printf("Loaded TLS certificate %s (expires %s)", leaf.Subject.CommonName, leaf.NotAfter.UTC().Format(time.RFC3339))
+	return nil
+}
+
+// watch polls the files like configWatcher does, which also catches
+// Kubernetes secret updates that swap a symlink
+func (t *tlsReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := t.reload(); err != nil {
+			log.Printf("TLS reload failed, keeping previous certificate: %v", err)
+		}
+	}
+}
+
+// config returns the listener's TLS configuration. Each handshake picks up
+// the material loaded last. In mTLS mode client certificates are verified
+// when presented; requireClientCert decides which routes need one.
+func (t *tlsReloader) config() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			material := t.current.Load()
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*material.cert},
+				NextProtos:   []string{"http/1.1"},
+			}
+			if http2Enabled {
+				cfg.NextProtos = []string{"h2", "http/1.1"}
+			}
+			if material.clientCAs != nil {
+				cfg.ClientCAs = material.clientCAs
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			}
+			return cfg, nil
+		},
+	}
+}
+
+// requireClientCert rejects requests without a verified client certificate
+// when TLS_CLIENT_CA_FILE is set, and lets everything through otherwise
+func requireClientCert(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tlsFiles.mutual() && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			authFailuresTotal.WithLabelValues("missing_client_cert").Inc()
+			writeError(w, r, http.StatusUnauthorized, errCodeUnauthorized, "A client certificate signed by the configured CA is required", nil)
+			return
+		}
+		next(w, r)
+	}
+}
@@ -0,0 +1,600 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// storageTimeout bounds each storage call made while serving a request
+const storageTimeout = 5 * time.Second
+
+// storageContext bounds a background storage write by storageTimeout. The
+// in-memory store never blocks, so its writes skip the deadline and the
+// timer behind it, several of which every authorization would otherwise
+// allocate.
+func storageContext() (context.Context, context.CancelFunc) {
+	if _, ok := storage.(*memoryStore); ok {
+		return context.Background(), func() {}
+	}
+	return context.WithTimeout(context.Background(), storageTimeout)
+}
+
+var unrecordedSettlementsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_unrecorded_settlements_total",
+		Help: "Total number of captures and refunds the processor took but the gateway could not record, by processor, operation and result (reversed or unreversed)",
+	},
+	[]string{"processor", "operation", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(unrecordedSettlementsTotal)
+}
+
+// maxSaveAttempts bounds how often a capture or refund is stored again on
+// top of concurrent ones before giving up with 409
+const maxSaveAttempts = 5
+
+// CaptureRequest is the body of POST /transactions/{id}/capture. The
+// amount, in minor units or legacy decimal form, defaults to the full
+// authorized amount.
+type CaptureRequest struct {
+	AmountMinor *int64  `json:"amount_minor,omitempty"`
+	Amount      float64 `json:"amount,omitempty"`
+	// FinalCapture false leaves the rest of the authorization open for
+	// more captures, if the processor supports multi-capture. It defaults
+	// to true.
+	FinalCapture *bool `json:"final_capture,omitempty"`
+}
+
+// RefundRequest is the body of POST /transactions/{id}/refund. The amount
+// defaults to everything captured and not yet refunded.
+type RefundRequest struct {
+	AmountMinor *int64  `json:"amount_minor,omitempty"`
+	Amount      float64 `json:"amount,omitempty"`
+	Reason      string  `json:"reason,omitempty"`
+}
+
+// TransactionDetails is returned by GET /transactions/{id}
+type TransactionDetails struct {
+	Transaction
+	Captures []Capture `json:"captures"`
+	Refunds  []Refund  `json:"refunds"`
+}
+
+// createTransaction records an authorization before it is processed. The
+// insert is what rejects a reused transaction_id, so two concurrent
+// requests with the same ID can't both reach a processor.
+func createTransaction(req AuthorizationRequest) *authorizationRejection {
+	ctx, cancel := storageContext()
+	defer cancel()
+
+	now := formatTimestamp(time.Now())
+	err := req.tenant.transactions().Create(ctx, Transaction{
+		TransactionID: req.TransactionID,
+		MerchantID:    req.MerchantID,
+		Status:        statusProcessing,
+		Amount:        req.Amount,
+		Currency:      req.Currency,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	})
+	switch err {
+	case nil:
+		return nil
+	case errDuplicateRecord:
+		return &authorizationRejection{
+			Status: http.StatusConflict, Code: errCodeDuplicateTransaction,
+			Message: fmt.Sprintf("Transaction %s was already processed", req.TransactionID),
+		}
+	default:
+		storageErrorsTotal.WithLabelValues("create_transaction").Inc()
+		log.Printf("Failed to create transaction %s: %v", req.TransactionID, err)
+		return &authorizationRejection{
+			Status: http.StatusServiceUnavailable, Code: errCodeStorageUnavailable, Message: "Storage unavailable",
+		}
+	}
+}
+
+// saveAuthorization stores the outcome of an authorization in the tenant's
+// store. A storage failure is logged rather than failing a payment the
+// processor already decided on.
+func saveAuthorization(t *tenant, response AuthorizationResponse) {
+	txn := Transaction{
+		TransactionID:      response.TransactionID,
+		Status:             response.Status,
+		Processor:          response.Processor,
+		AuthCode:           response.AuthCode,
+		DeclineReason:      response.DeclineReason,
+		ProcessorReference: response.ProcessorReference,
+		UpdatedAt:          formatTimestamp(time.Now()),
+		TokenType:          response.TokenType,
+	}
+
+	ctx, cancel := storageContext()
+	defer cancel()
+	if err := t.transactions().UpdateStatus(ctx, txn, statusProcessing, "requires_action"); err != nil {
+		storageErrorsTotal.WithLabelValues("update_transaction").Inc()
+		log.Printf("Failed to save transaction %s: %v", txn.TransactionID, err)
+	}
+}
+
+func newCaptureID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "cap_" + hex.EncodeToString(b)
+}
+
+func newRefundID() string {
+	b := make([]byte, 12)
+	_, _ = rand.Read(b)
+	return "re_" + hex.EncodeToString(b)
+}
+
+// TransactionList is one page of GET /transactions. Pass the last
+// transaction_id as starting_after to fetch the next page.
+type TransactionList struct {
+	Data    []Transaction `json:"data"`
+	HasMore bool          `json:"has_more"`
+}
+
+// Page sizes for GET /transactions
+const (
+	defaultTransactionPageSize = 50
+	maxTransactionPageSize     = 500
+)
+
+// parseTransactionFilter reads the GET /transactions query parameters
+func parseTransactionFilter(r *http.Request) (TransactionFilter, []FieldViolation) {
+	q := r.URL.Query()
+	filter := TransactionFilter{
+		MerchantID:    q.Get("merchant_id"),
+		Status:        q.Get("status"),
+		StartingAfter: q.Get("starting_after"),
+		Limit:         defaultTransactionPageSize,
+	}
+	var violations []FieldViolation
+
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		filter.MerchantID = merchantID
+	}
+	for _, param := range []struct {
+		name string
+		dest *time.Time
+	}{{"created_from", &filter.CreatedFrom}, {"created_to", &filter.CreatedTo}} {
+		if v := q.Get(param.name); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				violations = append(violations, FieldViolation{param.name, "must be an RFC 3339 timestamp"})
+			}
+			*param.dest = t
+		}
+	}
+	if v := q.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxTransactionPageSize {
+			violations = append(violations, FieldViolation{"limit", fmt.Sprintf("must be between 1 and %d", maxTransactionPageSize)})
+		}
+		filter.Limit = n
+	}
+	return filter, violations
+}
+
+// handleTransactionList lists transactions newest first (GET /transactions),
+// filtered by merchant_id, status and created_from/created_to
+func handleTransactionList(w http.ResponseWriter, r *http.Request) {
+	filter, violations := parseTransactionFilter(r)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+
+	// One extra row tells whether another page follows
+	pageSize := filter.Limit
+	filter.Limit++
+	txns, err := tenantStore(ctx).List(ctx, filter)
+	if err == errRecordNotFound {
+		writeValidationError(w, r, []FieldViolation{{"starting_after", "must be the ID of a listed transaction"}})
+		return
+	}
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_transactions").Inc()
+		log.Printf("Failed to list transactions: %v", err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+
+	list := TransactionList{Data: txns, HasMore: len(txns) > pageSize}
+	if list.HasMore {
+		list.Data = txns[:pageSize]
+	}
+	if list.Data == nil {
+		list.Data = []Transaction{}
+	}
+	for i := range list.Data {
+		list.Data[i] = list.Data[i].withMinorUnits()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// loadTransaction fetches a transaction visible to the caller, writing the
+// error response and returning false when there is none
+func loadTransaction(ctx context.Context, w http.ResponseWriter, r *http.Request, id string) (Transaction, bool) {
+	txn, err := tenantStore(ctx).Get(ctx, id)
+	if err == errRecordNotFound {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Transaction not found", nil)
+		return Transaction{}, false
+	}
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("get_transaction").Inc()
+		log.Printf("Failed to load transaction %s: %v", id, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return Transaction{}, false
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok && txn.MerchantID != merchantID {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Transaction not found", nil)
+		return Transaction{}, false
+	}
+	return txn, true
+}
+
+// handleTransactionGet returns a transaction with its captures and refunds
+// (GET /transactions/{id}). Authenticated merchants only see their own.
+func handleTransactionGet(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+
+	txn, ok := loadTransaction(ctx, w, r, id)
+	if !ok {
+		return
+	}
+	captures, err := tenantStore(ctx).captures(ctx, id)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_captures").Inc()
+		log.Printf("Failed to load captures of %s: %v", id, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	refunds, err := tenantStore(ctx).refunds(ctx, id)
+	if err != nil {
+		storageErrorsTotal.WithLabelValues("list_refunds").Inc()
+		log.Printf("Failed to load refunds of %s: %v", id, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+		return
+	}
+	if captures == nil {
+		captures = []Capture{}
+	}
+	for i := range captures {
+		captures[i].AmountMinor, _ = toMinorUnits(captures[i].Amount, captures[i].Currency)
+	}
+	if refunds == nil {
+		refunds = []Refund{}
+	}
+	for i := range refunds {
+		refunds[i].AmountMinor, _ = toMinorUnits(refunds[i].Amount, refunds[i].Currency)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(TransactionDetails{Transaction: txn.withMinorUnits(), Captures: captures, Refunds: refunds})
+}
+
+// handleTransactionCapture captures an approved authorization, in full or
+// for a lower amount (POST /transactions/{id}/capture). With a processor
+// supporting multi-capture, captures that aren't final leave the
+// transaction partially_captured, open for more up to the authorized
+// amount.
+func handleTransactionCapture(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req CaptureRequest
+	if err := decodeOptionalBody(r, &req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON capture request"}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	txn, ok := loadTransaction(ctx, w, r, id)
+	if !ok {
+		return
+	}
+	if !authorizationOpen(ctx, w, r, txn) {
+		return
+	}
+	if txn.Status != "approved" && txn.Status != statusPartiallyCaptured {
+		writeError(w, r, http.StatusConflict, errCodeInvalidTransactionState,
+			fmt.Sprintf("Only approved or partially captured transactions can be captured; this one is %s", txn.Status), nil)
+		return
+	}
+
+	final := req.FinalCapture == nil || *req.FinalCapture
+	if !final && !currentConfig().multiCapture(txn.Processor) {
+		writeValidationError(w, r, []FieldViolation{{"final_capture", fmt.Sprintf("must be true: processor %s doesn't support multiple captures", txn.Processor)}})
+		return
+	}
+	remaining := roundAmount(txn.Amount-txn.CapturedAmount, txn.Currency)
+	amount, _, violations := resolveAmount("amount", req.AmountMinor, req.Amount, txn.Currency, true)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		writeValidationError(w, r, []FieldViolation{{"amount", fmt.Sprintf("must not exceed the uncaptured amount %g", remaining)}})
+		return
+	}
+
+	if !callProcessor(w, r, txn, "capture", func(ctx context.Context, p Processor) (ProcessorResult, error) {
+		return p.Capture(ctx, txn, amount)
+	}) {
+		return
+	}
+
+	now := formatTimestamp(time.Now())
+	capture := Capture{
+		CaptureID:     newCaptureID(),
+		TransactionID: txn.TransactionID,
+		Amount:        amount,
+		Currency:      txn.Currency,
+		Processor:     txn.Processor,
+		CreatedAt:     now,
+	}
+	capture.AmountMinor, _ = toMinorUnits(amount, txn.Currency)
+	// The store only takes the capture on top of the captured and
+	// authorized amounts it was computed from. When another capture or an
+	// increment got in first, it is applied again on top of that, as long
+	// as it still fits; one that no longer does is reversed at the
+	// processor, so a retry doesn't capture twice.
+	var from string
+	current := txn
+	for attempt := 1; ; attempt++ {
+		from = current.Status
+		captured := current
+		captured.CapturedAmount = roundAmount(current.CapturedAmount+amount, current.Currency)
+		// Capturing the whole authorization closes it, as processors do
+		capture.Final = final || captured.CapturedAmount >= captured.Amount
+		captured.Status = statusPartiallyCaptured
+		if capture.Final {
+			captured.Status = statusCaptured
+		}
+		captured.UpdatedAt = now
+		err := tenantStore(ctx).saveCapture(ctx, capture, captured, from, current.CapturedAmount)
+		if err == nil {
+			txn = captured
+			break
+		}
+		if err == errStatusConflict && attempt < maxSaveAttempts {
+			var latest Transaction
+			if latest, err = tenantStore(ctx).Get(ctx, id); err == nil {
+				if (latest.Status == "approved" || latest.Status == statusPartiallyCaptured) &&
+					amount <= roundAmount(latest.Amount-latest.CapturedAmount, latest.Currency) {
+					current = latest
+					continue
+				}
+				err = errStatusConflict
+			}
+		}
+		reverseSettlement(r, "capture", txn, amount)
+		writeUpdateError(w, r, "capture", id, err)
+		return
+	}
+	txn = txn.withMinorUnits()
+	recordTransactionAudit(auditOriginOf(r), auditTransactionCaptured, txn, from)
+	recordCaptureEntries(txn, capture)
+	emitEvent(txn.MerchantID, eventCaptureCompleted, txn)
+	if capture.Final {
+		maybeDispute(txn)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(txn)
+}
+
+// handleTransactionRefund refunds part or all of a captured transaction
+// (POST /transactions/{id}/refund)
+func handleTransactionRefund(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	var req RefundRequest
+	if err := decodeOptionalBody(r, &req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON refund request"}})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), storageTimeout)
+	defer cancel()
+	txn, ok := loadTransaction(ctx, w, r, id)
+	if !ok {
+		return
+	}
+	if txn.Status != statusCaptured && txn.Status != statusPartiallyRefunded {
+		writeError(w, r, http.StatusConflict, errCodeInvalidTransactionState,
+			fmt.Sprintf("Only captured transactions can be refunded; this one is %s", txn.Status), nil)
+		return
+	}
+
+	remaining := roundAmount(txn.CapturedAmount-txn.RefundedAmount, txn.Currency)
+	amount, _, violations := resolveAmount("amount", req.AmountMinor, req.Amount, txn.Currency, true)
+	if len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+	if amount == 0 {
+		amount = remaining
+	}
+	if amount > remaining {
+		writeValidationError(w, r, []FieldViolation{{"amount", fmt.Sprintf("must not exceed the refundable amount %g", remaining)}})
+		return
+	}
+
+	if !callProcessor(w, r, txn, "refund", func(ctx context.Context, p Processor) (ProcessorResult, error) {
+		return p.Refund(ctx, txn, amount)
+	}) {
+		return
+	}
+
+	now := formatTimestamp(time.Now())
+	refund := Refund{
+		RefundID:      newRefundID(),
+		TransactionID: txn.TransactionID,
+		Status:        "succeeded",
+		Amount:        amount,
+		Currency:      txn.Currency,
+		Processor:     txn.Processor,
+		Reason:        req.Reason,
+		CreatedAt:     now,
+	}
+	refund.AmountMinor, _ = toMinorUnits(amount, txn.Currency)
+	// As with captures, a refund that lost a race to another one is applied
+	// again on top of it while it still fits, and reversed at the processor
+	// once it doesn't
+	var from string
+	current := txn
+	for attempt := 1; ; attempt++ {
+		from = current.Status
+		refunded := current
+		refunded.RefundedAmount = roundAmount(current.RefundedAmount+amount, current.Currency)
+		refunded.Status = statusPartiallyRefunded
+		if refunded.RefundedAmount >= refunded.CapturedAmount {
+			refunded.Status = statusRefunded
+		}
+		refunded.UpdatedAt = now
+		err := tenantStore(ctx).saveRefund(ctx, refund, refunded, from, current.RefundedAmount)
+		if err == nil {
+			txn = refunded
+			break
+		}
+		if err == errStatusConflict && attempt < maxSaveAttempts {
+			var latest Transaction
+			if latest, err = tenantStore(ctx).Get(ctx, id); err == nil {
+				if (latest.Status == statusCaptured || latest.Status == statusPartiallyRefunded) &&
+					amount <= roundAmount(latest.CapturedAmount-latest.RefundedAmount, latest.Currency) {
+					current = latest
+					continue
+				}
+				err = errStatusConflict
+			}
+		}
+		reverseSettlement(r, "refund", txn, amount)
+		writeUpdateError(w, r, "refund", id, err)
+		return
+	}
+	recordTransactionAudit(auditOriginOf(r), auditTransactionRefunded, txn, from)
+	recordRefundEntry(txn.MerchantID, refund)
+	emitEvent(txn.MerchantID, eventRefundCompleted, refund)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(refund)
+}
+
+// callProcessor sends a capture or refund to the processor that authorized
+// txn, writing the error response and returning false unless it succeeds.
+// The call gets the request timeout rather than the storage deadline.
+func callProcessor(w http.ResponseWriter, r *http.Request, txn Transaction, operation string,
+	call func(context.Context, Processor) (ProcessorResult, error)) bool {
+	p, ok := processors.get(txn.Processor)
+	if !ok {
+		writeError(w, r, http.StatusServiceUnavailable, errCodeProcessorUnavailable,
+			fmt.Sprintf("Processor %s is not configured", txn.Processor), nil)
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), getRequestTimeout())
+	defer cancel()
+	result, err := call(ctx, p)
+	if err != nil {
+		writeError(w, r, http.StatusBadGateway, errCodeProcessorUnavailable,
+			fmt.Sprintf("Processor %s could not process the %s: %v", txn.Processor, operation, err), nil)
+		return false
+	}
+	if !result.Approved {
+		writeError(w, r, http.StatusPaymentRequired, errCodeProcessorDeclined,
+			fmt.Sprintf("Processor %s declined the %s", txn.Processor, operation),
+			map[string]string{"decline_reason": result.DeclineReason})
+		return false
+	}
+	return true
+}
+
+// reverseSettlement takes back a capture or refund of amount the processor
+// took on txn but the gateway could not record. It runs past the request's
+// cancellation, since the client gets its answer either way.
+func reverseSettlement(r *http.Request, operation string, txn Transaction, amount float64) {
+	p, _ := processors.get(txn.Processor)
+	var reverse func(context.Context, Transaction, float64) (ProcessorResult, error)
+	switch operation {
+	case "capture":
+		if reverser, ok := p.(captureReverser); ok {
+			reverse = reverser.ReverseCapture
+		}
+	case "refund":
+		if reverser, ok := p.(refundReverser); ok {
+			reverse = reverser.ReverseRefund
+		}
+	}
+	if reverse == nil {
+		unrecordedSettlement(txn, operation, amount, fmt.Errorf("processor %s can't reverse a %s", txn.Processor, operation))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), getRequestTimeout())
+	defer cancel()
+	result, err := reverse(ctx, txn, amount)
+	if err == nil && !result.Approved {
+		err = fmt.Errorf("declined: %s", result.DeclineReason)
+	}
+	unrecordedSettlement(txn, operation, amount, err)
+}
+
+// unrecordedSettlement counts a capture or refund that could not be
+// recorded, logging it for reconciliation unless err is nil because it was
+// reversed
+func unrecordedSettlement(txn Transaction, operation string, amount float64, err error) {
+	if err != nil {
+		unrecordedSettlementsTotal.WithLabelValues(txn.Processor, operation, "unreversed").Inc()
+		log.Printf("Failed to reverse an unrecorded %s of %g on %s: %v", operation, amount, txn.TransactionID, err)
+		return
+	}
+	unrecordedSettlementsTotal.WithLabelValues(txn.Processor, operation, "reversed").Inc()
+}
+
+// writeUpdateError responds to a capture or refund that could not be
+// stored, typically because the transaction changed status meanwhile
+func writeUpdateError(w http.ResponseWriter, r *http.Request, operation, id string, err error) {
+	switch err {
+	case errStatusConflict:
+		writeError(w, r, http.StatusConflict, errCodeInvalidTransactionState,
+			fmt.Sprintf("Transaction %s changed status during the %s; retrieve it and retry", id, operation), nil)
+	case errRecordNotFound:
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Transaction not found", nil)
+	default:
+		storageErrorsTotal.WithLabelValues("save_" + operation).Inc()
+		log.Printf("Failed to save %s of %s: %v", operation, id, err)
+		writeError(w, r, http.StatusServiceUnavailable, errCodeStorageUnavailable, "Storage unavailable", nil)
+	}
+}
+
+// decodeOptionalBody decodes a JSON body into v, accepting an empty body
+func decodeOptionalBody(r *http.Request, v interface{}) error {
+	err := json.NewDecoder(r.Body).Decode(v)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,452 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// parseTestConfig parses yaml in the config file's format
+func parseTestConfig(t *testing.T, yaml string) *RuntimeConfig {
+	t.Helper()
+	cfg, violations := parseRuntimeConfig([]byte(yaml))
+	if len(violations) > 0 {
+		t.Fatalf("invalid config: %v", violations)
+	}
+	return cfg
+}
+
+// useConfig puts cfg in effect as the config file for the test, registers
+// replacements in place of the processors of the same name and makes
+// simulated calls take no time, restoring all of it afterwards
+func useConfig(t *testing.T, cfg *RuntimeConfig, replacements ...Processor) {
+	t.Helper()
+	previous, _ := configLayers.fileAndAdmin()
+	previousLatencies := latencies
+	t.Cleanup(func() {
+		_ = configLayers.setFile(previous)
+		latencies = previousLatencies
+	})
+	if violations := configLayers.setFile(cfg); len(violations) > 0 {
+		t.Fatalf("invalid config: %v", violations)
+	}
+	latencies = &latencyModel{defaultDist: fixedLatency(0)}
+	for _, p := range replacements {
+		useProcessor(t, p)
+	}
+}
+
+// useMultiCapture stores a config letting stripe, the processor of
+// openAuthorization, take several captures
+func useMultiCapture(t *testing.T, replacements ...Processor) {
+	t.Helper()
+	useConfig(t, parseTestConfig(t, `
+failure_rate: 0
+processors:
+  stripe: {multi_capture: true, failure_rate: 0}
+`), replacements...)
+}
+
+// useMemoryStore swaps storage for an empty in-memory store for the test
+func useMemoryStore(t *testing.T) {
+	t.Helper()
+	previous := storage
+	t.Cleanup(func() { storage = previous })
+	storage = newMemoryStore()
+}
+
+// faultyStore makes the compare-and-swap saves of a transaction store
+// conflict and its lookups fail
+type faultyStore struct {
+	transactionStore
+	// conflicts makes every capture, refund and increment conflict
+	conflicts bool
+	// getsLeft is how many lookups succeed before the rest fail; negative
+	// never fails them
+	getsLeft int
+}
+
+// errStorageDown is what faultyStore fails lookups with
+var errStorageDown = errors.New("storage down")
+
+func (s *faultyStore) Get(ctx context.Context, id string) (Transaction, error) {
+	if s.getsLeft == 0 {
+		return Transaction{}, errStorageDown
+	}
+	s.getsLeft--
+	return s.transactionStore.Get(ctx, id)
+}
+
+func (s *faultyStore) incrementAmount(ctx context.Context, txn Transaction, previous float64, from ...string) error {
+	if s.conflicts {
+		return errStatusConflict
+	}
+	return s.transactionStore.incrementAmount(ctx, txn, previous, from...)
+}
+
+func (s *faultyStore) saveCapture(ctx context.Context, capture Capture, txn Transaction, from string, previous float64) error {
+	if s.conflicts {
+		return errStatusConflict
+	}
+	return s.transactionStore.saveCapture(ctx, capture, txn, from, previous)
+}
+
+func (s *faultyStore) saveRefund(ctx context.Context, refund Refund, txn Transaction, from string, previous float64) error {
+	if s.conflicts {
+		return errStatusConflict
+	}
+	return s.transactionStore.saveRefund(ctx, refund, txn, from, previous)
+}
+
+// openAuthorization stores an approved stripe authorization of amount USD
+func openAuthorization(t *testing.T, id string, amount float64) Transaction {
+	t.Helper()
+	now := formatTimestamp(time.Now())
+	txn := Transaction{
+		TransactionID: id,
+		MerchantID:    "merchant_capture",
+		Status:        "approved",
+		Amount:        amount,
+		Currency:      "USD",
+		Processor:     "stripe",
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	if err := storage.Create(context.Background(), txn); err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+// serveCapture posts body to POST /transactions/{id}/capture
+func serveCapture(id, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/transactions/"+id+"/capture", strings.NewReader(body))
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	handleTransactionCapture(w, r)
+	return w
+}
+
+func TestHandleTransactionCapture(t *testing.T) {
+	useMultiCapture(t)
+	cases := []struct {
+		name         string
+		bodies       []string
+		wantStatuses []int
+		wantStatus   string
+		wantCaptured float64
+	}{
+		{"full by default", []string{``}, []int{200}, statusCaptured, 100},
+		{"partial final", []string{`{"amount": 40}`}, []int{200}, statusCaptured, 40},
+		{"partial then rest", []string{`{"amount": 40, "final_capture": false}`, `{}`}, []int{200, 200}, statusCaptured, 100},
+		{"partial captures summing up close it", []string{`{"amount": 60, "final_capture": false}`, `{"amount": 40, "final_capture": false}`},
+			[]int{200, 200}, statusCaptured, 100},
+		{"over the uncaptured amount", []string{`{"amount": 70, "final_capture": false}`, `{"amount": 40}`},
+			[]int{200, 400}, statusPartiallyCaptured, 70},
+		{"after the final capture", []string{`{"amount": 30}`, `{"amount": 30}`}, []int{200, 409}, statusCaptured, 30},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useMemoryStore(t)
+			txn := openAuthorization(t, "txn_capture", 100)
+			for i, body := range tc.bodies {
+				if w := serveCapture(txn.TransactionID, body); w.Code != tc.wantStatuses[i] {
+					t.Fatalf("capture %d (%s): status %d, want %d: %s", i, body, w.Code, tc.wantStatuses[i], w.Body)
+				}
+			}
+			got, err := storage.Get(context.Background(), txn.TransactionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tc.wantStatus || got.CapturedAmount != tc.wantCaptured {
+				t.Errorf("got %s with %g captured, want %s with %g", got.Status, got.CapturedAmount, tc.wantStatus, tc.wantCaptured)
+			}
+		})
+	}
+}
+
+// TestConcurrentPartialCaptures checks that partial captures racing for
+// the same authorization never capture more than it holds, and that
+// every accepted capture is recorded
+func TestConcurrentPartialCaptures(t *testing.T) {
+	useMultiCapture(t)
+	useMemoryStore(t)
+	txn := openAuthorization(t, "txn_concurrent", 100)
+
+	const captures = 8
+	var wg sync.WaitGroup
+	statuses := make([]int, captures)
+	for i := 0; i < captures; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = serveCapture(txn.TransactionID, `{"amount": 30, "final_capture": false}`).Code
+		}(i)
+	}
+	wg.Wait()
+
+	accepted := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusOK:
+			accepted++
+		case http.StatusConflict, http.StatusBadRequest:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("accepted %d captures of 30 against 100, want 3 (statuses %v)", accepted, statuses)
+	}
+	got, err := storage.Get(context.Background(), txn.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.CapturedAmount != 90 || got.Status != statusPartiallyCaptured {
+		t.Errorf("got %s with %g captured, want %s with 90", got.Status, got.CapturedAmount, statusPartiallyCaptured)
+	}
+	recorded, err := storage.captures(context.Background(), txn.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != accepted {
+		t.Errorf("recorded %d captures, want %d", len(recorded), accepted)
+	}
+}
+
+// TestSaveCaptureConflicts checks the compare-and-swap a capture is stored
+// with, which is what keeps concurrent captures and increments apart
+func TestSaveCaptureConflicts(t *testing.T) {
+	cases := []struct {
+		name     string
+		previous float64
+		amount   float64
+		wantErr  error
+	}{
+		{"unchanged", 0, 100, nil},
+		{"captured meanwhile", 20, 100, errStatusConflict},
+		{"incremented meanwhile", 0, 80, errStatusConflict},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useMemoryStore(t)
+			txn := openAuthorization(t, "txn_cas", 100)
+			txn.Amount = tc.amount
+			txn.CapturedAmount = tc.previous + 10
+			txn.Status = statusPartiallyCaptured
+			capture := Capture{CaptureID: "cap_cas", TransactionID: txn.TransactionID, Amount: 10, Currency: "USD"}
+			if err := storage.saveCapture(context.Background(), capture, txn, "approved", tc.previous); err != tc.wantErr {
+				t.Fatalf("saveCapture: %v, want %v", err, tc.wantErr)
+			}
+			got, _ := storage.Get(context.Background(), txn.TransactionID)
+			wantCaptured := 0.0
+			if tc.wantErr == nil {
+				wantCaptured = 10
+			}
+			if got.CapturedAmount != wantCaptured {
+				t.Errorf("captured %g, want %g", got.CapturedAmount, wantCaptured)
+			}
+		})
+	}
+}
+
+// settlingProcessor records the captures and refunds it was asked to
+// reverse
+type settlingProcessor struct {
+	*simulatedProcessor
+	reversedCaptures []Transaction
+	reversedRefunds  []Transaction
+}
+
+func (p *settlingProcessor) ReverseCapture(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	p.reversedCaptures = append(p.reversedCaptures, txn)
+	return ProcessorResult{Approved: true}, nil
+}
+
+func (p *settlingProcessor) ReverseRefund(ctx context.Context, txn Transaction, amount float64) (ProcessorResult, error) {
+	p.reversedRefunds = append(p.reversedRefunds, txn)
+	return ProcessorResult{Approved: true}, nil
+}
+
+// TestCaptureReversed checks that a capture the processor took is reversed,
+// on the authorization it was taken on, when it can't be recorded
+func TestCaptureReversed(t *testing.T) {
+	cases := []struct {
+		name       string
+		getsLeft   int
+		wantStatus int
+	}{
+		{"conflicts on every attempt", -1, http.StatusConflict},
+		{"reload failing after a conflict", 1, http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			p := &settlingProcessor{simulatedProcessor: newSimulatedProcessor("stripe", rng)}
+			useMultiCapture(t, p)
+			useMemoryStore(t)
+			txn := openAuthorization(t, "txn_capture_reversed", 100)
+			storage = &faultyStore{transactionStore: storage, conflicts: true, getsLeft: tc.getsLeft}
+
+			if w := serveCapture(txn.TransactionID, `{"amount": 40, "final_capture": false}`); w.Code != tc.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if len(p.reversedCaptures) != 1 {
+				t.Fatalf("reversed %d captures, want 1", len(p.reversedCaptures))
+			}
+			if reversed := p.reversedCaptures[0]; reversed.TransactionID != txn.TransactionID || reversed.CapturedAmount != 0 {
+				t.Errorf("reversed on %s with %g captured, want %s with 0",
+					reversed.TransactionID, reversed.CapturedAmount, txn.TransactionID)
+			}
+		})
+	}
+}
+
+// capturedTransaction stores a stripe transaction captured in full for
+// amount USD
+func capturedTransaction(t *testing.T, id string, amount float64) Transaction {
+	t.Helper()
+	txn := openAuthorization(t, id, amount)
+	txn.Status = statusCaptured
+	txn.CapturedAmount = amount
+	if err := storage.UpdateStatus(context.Background(), txn, "approved"); err != nil {
+		t.Fatal(err)
+	}
+	return txn
+}
+
+// serveRefund posts body to POST /transactions/{id}/refund
+func serveRefund(id, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/transactions/"+id+"/refund", strings.NewReader(body))
+	r.SetPathValue("id", id)
+	w := httptest.NewRecorder()
+	handleTransactionRefund(w, r)
+	return w
+}
+
+func TestHandleTransactionRefund(t *testing.T) {
+	cases := []struct {
+		name         string
+		bodies       []string
+		wantStatuses []int
+		wantStatus   string
+		wantRefunded float64
+	}{
+		{"full by default", []string{``}, []int{201}, statusRefunded, 100},
+		{"partial", []string{`{"amount": 40}`}, []int{201}, statusPartiallyRefunded, 40},
+		{"partial then rest", []string{`{"amount": 40}`, `{}`}, []int{201, 201}, statusRefunded, 100},
+		{"over the refundable amount", []string{`{"amount": 70}`, `{"amount": 40}`}, []int{201, 400}, statusPartiallyRefunded, 70},
+		{"after a full refund", []string{``, `{"amount": 1}`}, []int{201, 409}, statusRefunded, 100},
+		{"negative amount", []string{`{"amount": -5}`}, []int{400}, statusCaptured, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useMemoryStore(t)
+			txn := capturedTransaction(t, "txn_refund", 100)
+			for i, body := range tc.bodies {
+				if w := serveRefund(txn.TransactionID, body); w.Code != tc.wantStatuses[i] {
+					t.Fatalf("refund %d (%s): status %d, want %d: %s", i, body, w.Code, tc.wantStatuses[i], w.Body)
+				}
+			}
+			got, err := storage.Get(context.Background(), txn.TransactionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tc.wantStatus || got.RefundedAmount != tc.wantRefunded {
+				t.Errorf("got %s with %g refunded, want %s with %g", got.Status, got.RefundedAmount, tc.wantStatus, tc.wantRefunded)
+			}
+		})
+	}
+}
+
+// TestConcurrentRefunds checks that refunds racing for the same
+// transaction never refund more than was captured
+func TestConcurrentRefunds(t *testing.T) {
+	useMemoryStore(t)
+	txn := capturedTransaction(t, "txn_concurrent_refund", 100)
+
+	const refunds = 8
+	var wg sync.WaitGroup
+	statuses := make([]int, refunds)
+	for i := 0; i < refunds; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = serveRefund(txn.TransactionID, `{"amount": 30}`).Code
+		}(i)
+	}
+	wg.Wait()
+
+	accepted := 0
+	for _, status := range statuses {
+		switch status {
+		case http.StatusCreated:
+			accepted++
+		case http.StatusConflict, http.StatusBadRequest:
+		default:
+			t.Errorf("unexpected status %d", status)
+		}
+	}
+	if accepted != 3 {
+		t.Errorf("accepted %d refunds of 30 against 100, want 3 (statuses %v)", accepted, statuses)
+	}
+	got, err := storage.Get(context.Background(), txn.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.RefundedAmount != 90 || got.Status != statusPartiallyRefunded {
+		t.Errorf("got %s with %g refunded, want %s with 90", got.Status, got.RefundedAmount, statusPartiallyRefunded)
+	}
+	recorded, err := storage.refunds(context.Background(), txn.TransactionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recorded) != accepted {
+		t.Errorf("recorded %d refunds, want %d", len(recorded), accepted)
+	}
+}
+
+// TestRefundReversed checks that a refund the processor made is reversed,
+// on the transaction it was made on, when every save conflicts or the
+// reload fails
+func TestRefundReversed(t *testing.T) {
+	cases := []struct {
+		name       string
+		getsLeft   int
+		wantStatus int
+	}{
+		{"conflicts on every attempt", -1, http.StatusConflict},
+		{"reload failing after a conflict", 1, http.StatusServiceUnavailable},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			useMemoryStore(t)
+			p := &settlingProcessor{simulatedProcessor: newSimulatedProcessor("stripe", rng)}
+			useProcessor(t, p)
+			txn := capturedTransaction(t, "txn_refund_reversed", 100)
+			storage = &faultyStore{transactionStore: storage, conflicts: true, getsLeft: tc.getsLeft}
+
+			if w := serveRefund(txn.TransactionID, `{"amount": 30}`); w.Code != tc.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tc.wantStatus, w.Body)
+			}
+			if len(p.reversedRefunds) != 1 {
+				t.Fatalf("reversed %d refunds, want 1", len(p.reversedRefunds))
+			}
+			if reversed := p.reversedRefunds[0]; reversed.TransactionID != txn.TransactionID || reversed.RefundedAmount != 0 {
+				t.Errorf("reversed on %s with %g refunded, want %s with 0",
+					reversed.TransactionID, reversed.RefundedAmount, txn.TransactionID)
+			}
+			recorded, err := storage.refunds(context.Background(), txn.TransactionID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(recorded) != 0 {
+				t.Errorf("%d refunds recorded, want none", len(recorded))
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var validationFailuresTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_validation_failures_total",
+		Help: "Total number of field-level validation violations on incoming requests",
+	},
+	[]string{"field"},
+)
+
+func init() {
+	prometheus.MustRegister(validationFailuresTotal)
+}
+
+var (
+	merchantIDPattern    = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	transactionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,128}$`)
+)
+
+// iso4217Currencies lists the active ISO 4217 currency codes accepted for
+// payments. Precious metal, testing and bond-market units are excluded.
+var iso4217Currencies = map[string]bool{
+	"AED": true, "AFN": true, "ALL": true, "AMD": true, "ANG": true, "AOA": true, "ARS": true, "AUD": true,
+	"AWG": true, "AZN": true, "BAM": true, "BBD": true, "BDT": true, "BGN": true, "BHD": true, "BIF": true,
+	"BMD": true, "BND": true, "BOB": true, "BOV": true, "BRL": true, "BSD": true, "BTN": true, "BWP": true,
+	"BYN": true, "BZD": true, "CAD": true, "CDF": true, "CHE": true, "CHF": true, "CHW": true, "CLF": true,
+	"CLP": true, "CNY": true, "COP": true, "COU": true, "CRC": true, "CUP": true, "CVE": true, "CZK": true,
+	"DJF": true, "DKK": true, "DOP": true, "DZD": true, "EGP": true, "ERN": true, "ETB": true, "EUR": true,
+	"FJD": true, "FKP": true, "GBP": true, "GEL": true, "GHS": true, "GIP": true, "GMD": true, "GNF": true,
+	"GTQ": true, "GYD": true, "HKD": true, "HNL": true, "HTG": true, "HUF": true, "IDR": true, "ILS": true,
+	"INR": true, "IQD": true, "IRR": true, "ISK": true, "JMD": true, "JOD": true, "JPY": true, "KES": true,
+	"KGS": true, "KHR": true, "KMF": true, "KPW": true, "KRW": true, "KWD": true, "KYD": true, "KZT": true,
+	"LAK": true, "LBP": true, "LKR": true, "LRD": true, "LSL": true, "LYD": true, "MAD": true, "MDL": true,
+	"MGA": true, "MKD": true, "MMK": true, "MNT": true, "MOP": true, "MRU": true, "MUR": true, "MVR": true,
+	"MWK": true, "MXN": true, "MXV": true, "MYR": true, "MZN": true, "NAD": true, "NGN": true, "NIO": true,
+	"NOK": true, "NPR": true, "NZD": true, "OMR": true, "PAB": true, "PEN": true, "PGK": true, "PHP": true,
+	"PKR": true, "PLN": true, "PYG": true, "QAR": true, "RON": true, "RSD": true, "RUB": true, "RWF": true,
+	"SAR": true, "SBD": true, "SCR": true, "SDG": true, "SEK": true, "SGD": true, "SHP": true, "SLE": true,
+	"SOS": true, "SRD": true, "SSP": true, "STN": true, "SVC": true, "SYP": true, "SZL": true, "THB": true,
+	"TJS": true, "TMT": true, "TND": true, "TOP": true, "TRY": true, "TTD": true, "TWD": true, "TZS": true,
+	"UAH": true, "UGX": true, "USD": true, "USN": true, "UYI": true, "UYU": true, "UYW": true, "UZS": true,
+	"VED": true, "VES": true, "VND": true, "VUV": true, "WST": true, "XAF": true, "XCD": true, "XCG": true,
+	"XOF": true, "XPF": true, "YER": true, "ZAR": true, "ZMW": true, "ZWG": true,
+}
+
+// FieldViolation describes why a single request field was rejected
+type FieldViolation struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validateAuthorizationRequest checks an authorization payload and returns
+// every violation found. The currency is normalized to upper case and the
+// amount is set in both decimal and minor unit form.
+func validateAuthorizationRequest(req *AuthorizationRequest) []FieldViolation {
+	var violations []FieldViolation
+
+	if req.MerchantID == "" {
+		violations = append(violations, FieldViolation{"merchant_id", "is required"})
+	} else if !merchantIDPattern.MatchString(req.MerchantID) {
+		violations = append(violations, FieldViolation{"merchant_id", "must be 1-64 characters of letters, digits, '_' or '-'"})
+	} else if !currentConfig().isRegisteredMerchant(req.MerchantID) {
+		violations = append(violations, FieldViolation{"merchant_id", "is not a registered merchant"})
+	}
+
+	req.Currency = strings.ToUpper(req.Currency)
+	if req.Currency == "" {
+		violations = append(violations, FieldViolation{"currency", "is required"})
+	} else if !iso4217Currencies[req.Currency] {
+		violations = append(violations, FieldViolation{"currency", "must be a valid ISO 4217 currency code"})
+	}
+
+	req.Country = strings.ToUpper(req.Country)
+	if req.Country != "" && !countryPattern.MatchString(req.Country) {
+		violations = append(violations, FieldViolation{"country", "must be an ISO 3166 alpha-2 country code"})
+	}
+	violations = append(violations, validateBillingZip(req)...)
+
+	req.SettlementCurrency = strings.ToUpper(req.SettlementCurrency)
+	if req.SettlementCurrency != "" && req.SettlementCurrency != req.Currency {
+		if !iso4217Currencies[req.SettlementCurrency] {
+			violations = append(violations, FieldViolation{"settlement_currency", "must be a valid ISO 4217 currency code"})
+		} else if !fxFeed.supports(req.SettlementCurrency) {
+			violations = append(violations, FieldViolation{"settlement_currency", "has no FX rate"})
+		} else if iso4217Currencies[req.Currency] && !fxFeed.supports(req.Currency) {
+			violations = append(violations, FieldViolation{"currency", "has no FX rate to convert to settlement_currency"})
+		}
+	}
+
+	amount, minor, amountViolations := resolveAmount("amount", req.AmountMinor, req.Amount, req.Currency, false)
+	if len(amountViolations) == 0 {
+		req.Amount, req.AmountMinor = amount, &minor
+	}
+	violations = append(violations, amountViolations...)
+
+	if profile, ok := currentConfig().merchantProfile(req.MerchantID); ok {
+		violations = append(violations, validateMerchantProfile(req, profile)...)
+	}
+
+	if strings.TrimSpace(req.CardToken) == "" {
+		violations = append(violations, FieldViolation{"card_token", "is required"})
+	}
+
+	if req.TransactionID != "" && !transactionIDPattern.MatchString(req.TransactionID) {
+		violations = append(violations, FieldViolation{"transaction_id", "must be 1-128 characters of letters, digits, '_', '.', ':' or '-'"})
+	}
+
+	return violations
+}
+
+// validateMerchantAmount checks the merchant, amount and currency of a
+// request that moves money without a card, such as a payment link
+func validateMerchantAmount(req *AuthorizationRequest) []FieldViolation {
+	return slices.DeleteFunc(validateAuthorizationRequest(req), func(v FieldViolation) bool {
+		return v.Field == "card_token"
+	})
+}
+
+// validateMerchantProfile checks a well-formed request against the limits
+// in the merchant's profile
+func validateMerchantProfile(req *AuthorizationRequest, profile MerchantConfig) []FieldViolation {
+	var violations []FieldViolation
+	if profile.MaxAmount != nil && req.Amount > *profile.MaxAmount {
+		violations = append(violations, FieldViolation{"amount", fmt.Sprintf("must not exceed %g for this merchant", *profile.MaxAmount)})
+	}
+	if len(profile.Currencies) > 0 && iso4217Currencies[req.Currency] && !slices.Contains(profile.Currencies, req.Currency) {
+		violations = append(violations, FieldViolation{"currency", "is not enabled for this merchant"})
+	}
+	return violations
+}
+
+// writeValidationError responds with 400 and the violations as error details
+func writeValidationError(w http.ResponseWriter, r *http.Request, violations []FieldViolation) {
+	recordValidationFailures(violations)
+	writeError(w, r, http.StatusBadRequest, errCodeValidation, "Request validation failed", violations)
+}
+
+// recordValidationFailures counts violations by field
+func recordValidationFailures(violations []FieldViolation) {
+	for _, v := range violations {
+		validationFailuresTotal.WithLabelValues(v.Field).Inc()
+	}
+}
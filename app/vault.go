@@ -0,0 +1,280 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// vaultTokenPrefix marks vault tokens issued by the vault, and
+// networkTokenPrefix its network tokens. Other card tokens are treated as
+// opaque processor tokens unless TOKEN_VAULT_STRICT=true.
+const vaultTokenPrefix = "vtok_"
+
+var (
+	tokensCreatedTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_tokens_created_total",
+			Help: "Total number of cards tokenized by brand and token type",
+		},
+		[]string{"brand", "token_type"},
+	)
+
+	tokenLookupsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_token_lookups_total",
+			Help: "Total number of card token resolutions during authorization by result",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(tokensCreatedTotal)
+	prometheus.MustRegister(tokenLookupsTotal)
+}
+
+// CardMetadata is the non-sensitive card data kept for a token. The PAN
+// itself is never stored.
+type CardMetadata struct {
+	Brand    string `json:"brand"`
+	Last4    string `json:"last4"`
+	ExpMonth int    `json:"exp_month"`
+	ExpYear  int    `json:"exp_year"`
+}
+
+// TokenizeRequest is the body of POST /tokens
+type TokenizeRequest struct {
+	MerchantID string `json:"merchant_id,omitempty"`
+	PAN        string `json:"pan"`
+	ExpMonth   int    `json:"exp_month"`
+	ExpYear    int    `json:"exp_year"`
+	// TokenType is vault_token (the default) or network_token
+	TokenType string `json:"token_type,omitempty"`
+}
+
+// TokenResponse describes a vaulted card
+type TokenResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+	CreatedAt string `json:"created_at"`
+	CardMetadata
+}
+
+// vaultEntry is a vaulted card, JSON encoded when the vault is in Redis
+type vaultEntry struct {
+	MerchantID string       `json:"merchant_id,omitempty"`
+	Card       CardMetadata `json:"card"`
+	CreatedAt  time.Time    `json:"created_at"`
+}
+
+// tokenVault maps opaque tokens to card metadata. It is a shared cache, so
+// with CACHE_BACKEND=redis a token resolves on every replica.
+type tokenVault struct {
+	entries *ttlCache[vaultEntry]
+	ttl     time.Duration
+}
+
+var vault = loadTokenVault()
+
+// loadTokenVault reads TOKEN_VAULT_TTL_HOURS, how long tokens resolve (0,
+// the default, for ever), and TOKEN_VAULT_MAX_TOKENS (default 1000000),
+// past which the least recently used tokens are forgotten
+func loadTokenVault() *tokenVault {
+	hours, err := strconv.Atoi(getEnv("TOKEN_VAULT_TTL_HOURS", "0"))
+	if err != nil || hours < 0 {
+		hours = 0
+	}
+	maxTokens, err := strconv.Atoi(getEnv("TOKEN_VAULT_MAX_TOKENS", "1000000"))
+	if err != nil || maxTokens <= 0 {
+		maxTokens = 1000000
+	}
+	return &tokenVault{
+		entries: newTTLCache[vaultEntry]("token_vault", maxTokens, true),
+		ttl:     time.Duration(hours) * time.Hour,
+	}
+}
+
+// luhnValid reports whether a digit string passes the Luhn checksum
+func luhnValid(digits string) bool {
+	sum := 0
+	double := false
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// cardBrand derives the card network from the leading digits of a PAN
+func cardBrand(pan string) string {
+	prefix := func(n int) int {
+		if len(pan) < n {
+			return -1
+		}
+		v := 0
+		for _, c := range pan[:n] {
+			v = v*10 + int(c-'0')
+		}
+		return v
+	}
+
+	switch {
+	case strings.HasPrefix(pan, "4"):
+		return "visa"
+	case prefix(2) >= 51 && prefix(2) <= 55, prefix(4) >= 2221 && prefix(4) <= 2720:
+		return "mastercard"
+	case strings.HasPrefix(pan, "34"), strings.HasPrefix(pan, "37"):
+		return "amex"
+	case strings.HasPrefix(pan, "6011"), strings.HasPrefix(pan, "65"), prefix(3) >= 644 && prefix(3) <= 649:
+		return "discover"
+	case prefix(4) >= 3528 && prefix(4) <= 3589:
+		return "jcb"
+	case strings.HasPrefix(pan, "36"), strings.HasPrefix(pan, "38"), prefix(3) >= 300 && prefix(3) <= 305:
+		return "diners"
+	default:
+		return "unknown"
+	}
+}
+
+// panSeparators are the spaces and dashes cards are commonly typed with
+var panSeparators = strings.NewReplacer(" ", "", "-", "")
+
+// normalizePAN strips the separators
+func normalizePAN(pan string) string {
+	return panSeparators.Replace(pan)
+}
+
+// validateTokenizeRequest checks the PAN and expiry. Violation messages
+// never echo the PAN back.
+func validateTokenizeRequest(req *TokenizeRequest, now time.Time) []FieldViolation {
+	var violations []FieldViolation
+
+	req.PAN = normalizePAN(req.PAN)
+	allDigits := req.PAN != "" && strings.Trim(req.PAN, "0123456789") == ""
+	if !allDigits || len(req.PAN) < 12 || len(req.PAN) > 19 {
+		violations = append(violations, FieldViolation{"pan", "must be 12-19 digits"})
+	} else if !luhnValid(req.PAN) {
+		violations = append(violations, FieldViolation{"pan", "failed Luhn check"})
+	}
+
+	if req.ExpMonth < 1 || req.ExpMonth > 12 {
+		violations = append(violations, FieldViolation{"exp_month", "must be between 1 and 12"})
+	}
+	if req.ExpYear < 100 {
+		req.ExpYear += 2000
+	}
+	if req.ExpYear < now.Year() || (req.ExpYear == now.Year() && req.ExpMonth < int(now.Month())) {
+		violations = append(violations, FieldViolation{"exp_year", "card is expired"})
+	}
+
+	if req.MerchantID != "" && !merchantIDPattern.MatchString(req.MerchantID) {
+		violations = append(violations, FieldViolation{"merchant_id", "must be 1-64 characters of letters, digits, '_' or '-'"})
+	}
+	if req.TokenType == "" {
+		req.TokenType = tokenTypeVault
+	}
+	if _, ok := tokenTypes[req.TokenType]; !ok {
+		violations = append(violations, FieldViolation{"token_type", fmt.Sprintf("must be %s or %s", tokenTypeVault, tokenTypeNetwork)})
+	}
+
+	return violations
+}
+
+// store vaults a validated card and returns its new token of tokenType
+func (v *tokenVault) store(merchantID, tokenType string, card CardMetadata) (string, time.Time) {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	token := tokenTypes[tokenType] + hex.EncodeToString(b)
+	createdAt := time.Now().UTC()
+	v.put(token, merchantID, card, createdAt)
+	return token, createdAt
+}
+
+// put vaults card under token, replacing any card already there
+func (v *tokenVault) put(token, merchantID string, card CardMetadata, createdAt time.Time) {
+	v.entries.set(token, vaultEntry{MerchantID: merchantID, Card: card, CreatedAt: createdAt}, v.ttl)
+}
+
+// resolve returns the card behind a vault token. Tokens issued to a
+// merchant only resolve for that merchant.
+func (v *tokenVault) resolve(token, merchantID string) (CardMetadata, bool) {
+	entry, ok := v.entries.get(token)
+	if !ok || (entry.MerchantID != "" && entry.MerchantID != merchantID) {
+		return CardMetadata{}, false
+	}
+	return entry.Card, true
+}
+
+// resolveCardToken checks an authorization's card token against the vault.
+// It returns the card metadata for vaulted tokens, and false when the token
+// must be declined as unknown. Magic test tokens always pass.
+func resolveCardToken(req AuthorizationRequest) (*CardMetadata, bool) {
+	if isTestCardToken(req.CardToken) {
+		return nil, true
+	}
+	if tokenTypeOf(req.CardToken) == "" {
+		if getEnv("TOKEN_VAULT_STRICT", "false") == "true" {
+			tokenLookupsTotal.WithLabelValues("unknown").Inc()
+			return nil, false
+		}
+		tokenLookupsTotal.WithLabelValues("external").Inc()
+		return nil, true
+	}
+
+	card, ok := vault.resolve(req.CardToken, req.MerchantID)
+	if !ok {
+		tokenLookupsTotal.WithLabelValues("unknown").Inc()
+		return nil, false
+	}
+	tokenLookupsTotal.WithLabelValues("found").Inc()
+	return &card, true
+}
+
+// handleTokens tokenizes a card (POST /tokens)
+func handleTokens(w http.ResponseWriter, r *http.Request) {
+	var req TokenizeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON tokenization request"}})
+		return
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		req.MerchantID = merchantID
+	}
+	if violations := validateTokenizeRequest(&req, time.Now()); len(violations) > 0 {
+		writeValidationError(w, r, violations)
+		return
+	}
+
+	card := CardMetadata{
+		Brand:    cardBrand(req.PAN),
+		Last4:    req.PAN[len(req.PAN)-4:],
+		ExpMonth: req.ExpMonth,
+		ExpYear:  req.ExpYear,
+	}
+	token, createdAt := vault.store(req.MerchantID, req.TokenType, card)
+	tokensCreatedTotal.WithLabelValues(card.Brand, req.TokenType).Inc()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(TokenResponse{
+		Token:        token,
+		TokenType:    req.TokenType,
+		CreatedAt:    createdAt.Format(time.RFC3339),
+		CardMetadata: card,
+	})
+}
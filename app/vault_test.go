@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestTokenVaultRedisDown checks that a card vaulted while Redis is down
+// still resolves on the replica that vaulted it
+func TestTokenVaultRedisDown(t *testing.T) {
+	useRedisDown(t)
+	cases := []struct {
+		name      string
+		tokenType string
+	}{
+		{"vault token", tokenTypeVault},
+		{"network token", tokenTypeNetwork},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			body := `{"merchant_id": "merchant_vault", "pan": "4242424242424242", "exp_month": 12, "exp_year": 2099, "token_type": "` + tc.tokenType + `"}`
+			w := httptest.NewRecorder()
+			handleTokens(w, httptest.NewRequest(http.MethodPost, "/tokens", strings.NewReader(body)))
+			if w.Code != http.StatusCreated {
+				t.Fatalf("status %d, want 201: %s", w.Code, w.Body)
+			}
+			var resp TokenResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+			card, ok := vault.resolve(resp.Token, "merchant_vault")
+			if !ok || card.Last4 != "4242" {
+				t.Errorf("resolve: %+v, %v, want the vaulted card", card, ok)
+			}
+			if _, ok := vault.resolve(resp.Token, "merchant_other"); ok {
+				t.Error("resolved for another merchant")
+			}
+		})
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// AVS results, for an authorization sent with a billing_zip. There being
+// no street address to check, they say whether the ZIP matched the one the
+// issuer has on file.
+const (
+	avsZipMatch    = "Z"
+	avsNoMatch     = "N"
+	avsUnavailable = "U"
+)
+
+// CVV results, for an authorization sent with cvv_present: matched, didn't
+// match, not processed, or the issuer doesn't check CVVs
+const (
+	cvvMatch        = "M"
+	cvvNoMatch      = "N"
+	cvvNotProcessed = "P"
+	cvvUnavailable  = "U"
+)
+
+// defaultAVSResults and defaultCVVResults weigh the simulated results
+// unless card_verification overrides them
+var (
+	defaultAVSResults = map[string]float64{avsZipMatch: 90, avsNoMatch: 7, avsUnavailable: 3}
+	defaultCVVResults = map[string]float64{cvvMatch: 94, cvvNoMatch: 4, cvvNotProcessed: 1, cvvUnavailable: 1}
+)
+
+// billingZipPattern accepts postal codes the world over: 3-10 letters,
+// digits, spaces or hyphens
+var billingZipPattern = regexp.MustCompile(`^[A-Za-z0-9 -]{3,10}$`)
+
+var cardVerificationResultsTotal = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "voyager_card_verification_results_total",
+		Help: "Total number of simulated card verification results by check (avs or cvv) and result code",
+	},
+	[]string{"check", "result"},
+)
+
+func init() {
+	prometheus.MustRegister(cardVerificationResultsTotal)
+}
+
+// CardVerificationConfig weighs the simulated AVS and CVV results. Either
+// map, when set, replaces the defaults for its check; a result left out
+// is never returned.
+type CardVerificationConfig struct {
+	AVSResults map[string]float64 `yaml:"avs_results" json:"avs_results,omitempty"`
+	CVVResults map[string]float64 `yaml:"cvv_results" json:"cvv_results,omitempty"`
+}
+
+// avsResults is the AVS result distribution in effect
+func (c *RuntimeConfig) avsResults() map[string]float64 {
+	if v := c.CardVerification; v != nil && len(v.AVSResults) > 0 {
+		return v.AVSResults
+	}
+	return defaultAVSResults
+}
+
+// cvvResults is the CVV result distribution in effect
+func (c *RuntimeConfig) cvvResults() map[string]float64 {
+	if v := c.CardVerification; v != nil && len(v.CVVResults) > 0 {
+		return v.CVVResults
+	}
+	return defaultCVVResults
+}
+
+// verifyCard draws the AVS result of an authorization with a billing ZIP
+// and the CVV result of one with a CVV, leaving the others unset
+func verifyCard(req *AuthorizationRequest) {
+	cfg := currentConfig()
+	if req.BillingZip != "" {
+		req.avsResult = drawVerificationResult(cfg.avsResults())
+		cardVerificationResultsTotal.WithLabelValues("avs", req.avsResult).Inc()
+	}
+	if req.CVVPresent {
+		req.cvvResult = drawVerificationResult(cfg.cvvResults())
+		cardVerificationResultsTotal.WithLabelValues("cvv", req.cvvResult).Inc()
+	}
+}
+
+// drawVerificationResult picks a result code by weight. Codes are walked
+// in order so DETERMINISTIC_SEED runs draw the same results.
+func drawVerificationResult(weights map[string]float64) string {
+	codes := sortedKeys(weights)
+	total := 0.0
+	for _, code := range codes {
+		total += weights[code]
+	}
+	pick := rng.Float64() * total
+	for _, code := range codes {
+		if pick < weights[code] {
+			return code
+		}
+		pick -= weights[code]
+	}
+	return codes[len(codes)-1]
+}
+
+// declinesOnAVSMismatch reports whether the merchant's profile asks for
+// authorizations whose billing ZIP didn't match to be declined
+func (c *RuntimeConfig) declinesOnAVSMismatch(merchantID string) bool {
+	m, ok := c.merchantProfile(merchantID)
+	return ok && m.DeclineOnAVSMismatch
+}
+
+// validateBillingZip checks the billing_zip of an authorization,
+// normalizing it to upper case
+func validateBillingZip(req *AuthorizationRequest) []FieldViolation {
+	req.BillingZip = strings.ToUpper(strings.TrimSpace(req.BillingZip))
+	if req.BillingZip != "" && !billingZipPattern.MatchString(req.BillingZip) {
+		return []FieldViolation{{"billing_zip", "must be 3-10 letters, digits, spaces or hyphens"}}
+	}
+	return nil
+}
+
+// validateCardVerification checks the card_verification section
+func validateCardVerification(c *CardVerificationConfig) []FieldViolation {
+	if c == nil {
+		return nil
+	}
+	var violations []FieldViolation
+	violations = append(violations, validateVerificationResults("card_verification.avs_results", c.AVSResults, defaultAVSResults)...)
+	violations = append(violations, validateVerificationResults("card_verification.cvv_results", c.CVVResults, defaultCVVResults)...)
+	return violations
+}
+
+// validateVerificationResults checks one result distribution against the
+// codes of its check, those in defaults
+func validateVerificationResults(field string, weights, defaults map[string]float64) []FieldViolation {
+	if len(weights) == 0 {
+		return nil
+	}
+	var violations []FieldViolation
+	total := 0.0
+	for _, code := range sortedKeys(weights) {
+		if _, ok := defaults[code]; !ok {
+			violations = append(violations, FieldViolation{field + "." + code, fmt.Sprintf("is not a result code; use %s", strings.Join(sortedKeys(defaults), ", "))})
+		} else if weights[code] < 0 {
+			violations = append(violations, FieldViolation{field + "." + code, "must not be negative"})
+		}
+		total += weights[code]
+	}
+	if len(violations) == 0 && total <= 0 {
+		violations = append(violations, FieldViolation{field, "needs at least one positive weight"})
+	}
+	return violations
+}
+
+// normalizeVerificationCodes upper-cases the result codes risk rules
+// match, so avs_results: [n] matches N. It runs on a freshly decoded
+// config, whose slices no other config shares.
+func normalizeVerificationCodes(c *RiskConfig) {
+	if c == nil {
+		return
+	}
+	for _, r := range c.Rules {
+		for i, code := range r.AVSResults {
+			r.AVSResults[i] = strings.ToUpper(code)
+		}
+		for i, code := range r.CVVResults {
+			r.CVVResults[i] = strings.ToUpper(code)
+		}
+	}
+}
+
+// validateVerificationCodes checks the result codes a risk rule matches
+func validateVerificationCodes(field string, codes []string, defaults map[string]float64) []FieldViolation {
+	var violations []FieldViolation
+	for _, code := range codes {
+		if _, ok := defaults[code]; !ok {
+			violations = append(violations, FieldViolation{field, fmt.Sprintf("%q is not a result code; use %s", code, strings.Join(sortedKeys(defaults), ", "))})
+		}
+	}
+	return violations
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDrawVerificationResult(t *testing.T) {
+	cases := []struct {
+		name    string
+		weights map[string]float64
+		want    string
+	}{
+		{"only code", map[string]float64{avsNoMatch: 1}, avsNoMatch},
+		{"others weigh nothing", map[string]float64{avsZipMatch: 0, avsNoMatch: 0, avsUnavailable: 5}, avsUnavailable},
+		{"first code", map[string]float64{cvvMatch: 3, cvvNoMatch: 0}, cvvMatch},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for i := 0; i < 100; i++ {
+				if got := drawVerificationResult(tc.weights); got != tc.want {
+					t.Fatalf("drew %q, want %q", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateVerificationResults(t *testing.T) {
+	const field = "card_verification.avs_results"
+	cases := []struct {
+		name    string
+		weights map[string]float64
+		want    []FieldViolation
+	}{
+		{"unset", nil, nil},
+		{"valid", map[string]float64{avsZipMatch: 1, avsNoMatch: 0}, nil},
+		{"unknown code", map[string]float64{"Y": 1},
+			[]FieldViolation{{field + ".Y", "is not a result code; use N, U, Z"}}},
+		{"negative weight", map[string]float64{avsZipMatch: 1, avsNoMatch: -1},
+			[]FieldViolation{{field + ".N", "must not be negative"}}},
+		{"all zero", map[string]float64{avsZipMatch: 0, avsNoMatch: 0},
+			[]FieldViolation{{field, "needs at least one positive weight"}}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := validateVerificationResults(field, tc.weights, defaultAVSResults)
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %v, want %v", got, tc.want)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Errorf("got %v, want %v", got[i], tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+// TestAVSMismatchDeclines checks that only merchants asking for it have
+// ZIP mismatches declined, before any processor is called
+func TestAVSMismatchDeclines(t *testing.T) {
+	useConfig(t, parseTestConfig(t, `
+card_verification:
+  avs_results: {N: 1}
+merchants:
+  merchant_strict: {decline_on_avs_mismatch: true}
+  merchant_loose: {}
+`))
+
+	cases := []struct {
+		name        string
+		merchantID  string
+		billingZip  string
+		wantDecline bool
+	}{
+		{"mismatch declined", "merchant_strict", "94107", true},
+		{"mismatch allowed", "merchant_loose", "94107", false},
+		{"no billing zip", "merchant_strict", "", false},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			amountMinor := int64(1000)
+			req := AuthorizationRequest{
+				MerchantID:    tc.merchantID,
+				AmountMinor:   &amountMinor,
+				Amount:        10,
+				Currency:      "USD",
+				CardToken:     "tok_approve",
+				TransactionID: "txn_avs_" + tc.merchantID,
+				BillingZip:    tc.billingZip,
+			}
+			response, _, pending := decideAuthorization(req, time.Now())
+			declined := response.DeclineReason == "avs_mismatch"
+			if declined != tc.wantDecline {
+				t.Fatalf("declined with avs_mismatch = %v, want %v (response %+v)", declined, tc.wantDecline, response)
+			}
+			if declined && (pending || response.Processor != "") {
+				t.Errorf("avs_mismatch decline went to processor %q (pending %v)", response.Processor, pending)
+			}
+			if declined && response.AVSResult != avsNoMatch {
+				t.Errorf("avs_result %q, want %q", response.AVSResult, avsNoMatch)
+			}
+		})
+	}
+}
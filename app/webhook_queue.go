@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	webhookQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "voyager_webhook_queue_depth",
+			Help: "Number of webhook deliveries waiting for their next attempt",
+		},
+	)
+
+	webhookDeadLetters = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "voyager_webhook_dead_letters",
+			Help: "Number of webhook deliveries in the dead-letter list",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(webhookQueueDepth)
+	prometheus.MustRegister(webhookDeadLetters)
+}
+
+// webhookDelivery tracks one event on its way to a merchant callback
+type webhookDelivery struct {
+	ID        string       `json:"id"`
+	URL       string       `json:"url"`
+	Event     WebhookEvent `json:"event"`
+	Attempts  int          `json:"attempts"`
+	LastError string       `json:"last_error,omitempty"`
+	FailedAt  string       `json:"failed_at,omitempty"`
+	body      []byte
+}
+
+// webhookQueue schedules delivery attempts on the job scheduler and keeps
+// deliveries that ran out of attempts in a dead-letter list until they
+// are replayed
+type webhookQueue struct {
+	// pending counts the deliveries waiting for their next attempt, until a
+	// worker takes them
+	pending     atomic.Int64
+	mu          sync.Mutex
+	deadLetters []*webhookDelivery
+	due         chan *webhookDelivery
+	// backlog holds the due deliveries that found due full, in order, and
+	// handingOff is set while a goroutine feeds them to due
+	backlog    []*webhookDelivery
+	handingOff bool
+}
+
+// webhookDueBuffer is how many due deliveries can wait for a free worker
+// before the rest queue in the backlog
+const webhookDueBuffer = 256
+
+var webhookDeliveries = newWebhookQueue()
+
+func newWebhookQueue() *webhookQueue {
+	return &webhookQueue{due: make(chan *webhookDelivery, webhookDueBuffer)}
+}
+
+// getWebhookWorkers returns how many deliveries may be in flight at once
+func getWebhookWorkers() int {
+	workers, err := strconv.Atoi(getEnv("WEBHOOK_WORKERS", "4"))
+	if err != nil || workers < 1 {
+		return 4
+	}
+	return workers
+}
+
+// getWebhookMaxBackoff caps the delay between two attempts
+func getWebhookMaxBackoff() time.Duration {
+	ms, err := strconv.Atoi(getEnv("WEBHOOK_MAX_BACKOFF_MS", "60000"))
+	if err != nil || ms <= 0 {
+		return time.Minute
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// getWebhookDeadLetterLimit returns how many dead letters are kept before
+// the oldest are discarded
+func getWebhookDeadLetterLimit() int {
+	limit, err := strconv.Atoi(getEnv("WEBHOOK_DEAD_LETTER_LIMIT", "1000"))
+	if err != nil || limit < 1 {
+		return 1000
+	}
+	return limit
+}
+
+// webhookBackoff returns the jittered delay before the next attempt after
+// the given number of failed attempts. The exponential delay is halved and
+// the other half randomized so retries from a burst of failures spread out.
+// Delivery timing is inherently nondeterministic, so this deliberately uses
+// the global source rather than the seeded simulation rng.
+func webhookBackoff(attempts int) time.Duration {
+	delay := getWebhookInitialBackoff()
+	maxBackoff := getWebhookMaxBackoff()
+	for i := 1; i < attempts && delay < maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)))
+}
+
+// start launches the delivery workers
+func (q *webhookQueue) start(workers int) {
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+}
+
+// enqueue schedules a delivery for its next attempt, handed to a worker
+// once one is free
+func (q *webhookQueue) enqueue(d *webhookDelivery, at time.Time) {
+	webhookQueueDepth.Set(float64(q.pending.Add(1)))
+	jobs.after(time.Until(at), func() { q.handOver(d) })
+}
+
+// handOver passes a due delivery to the workers. It runs on a scheduler
+// worker, which every other delayed call waits on, so when the workers are
+// busy and the buffer is full the delivery joins the backlog instead, which
+// one goroutine hands over as workers free up.
+func (q *webhookQueue) handOver(d *webhookDelivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.handingOff {
+		select {
+		case q.due <- d:
+			return
+		default:
+		}
+		q.handingOff = true
+		go q.handOff()
+	}
+	q.backlog = append(q.backlog, d)
+}
+
+// handOff feeds the backlog to the workers, blocking until each is taken,
+// and exits once it is empty
+func (q *webhookQueue) handOff() {
+	for {
+		q.mu.Lock()
+		if len(q.backlog) == 0 {
+			q.handingOff = false
+			q.mu.Unlock()
+			return
+		}
+		d := q.backlog[0]
+		q.backlog[0] = nil
+		q.backlog = q.backlog[1:]
+		q.mu.Unlock()
+		q.due <- d
+	}
+}
+
+// worker performs delivery attempts and reschedules or dead-letters failures
+func (q *webhookQueue) worker() {
+	for d := range q.due {
+		webhookQueueDepth.Set(float64(q.pending.Add(-1)))
+		d.Attempts++
+		err := postWebhook(d.URL, d.Event, d.body)
+		if err == nil {
+			webhookDeliveriesTotal.WithLabelValues(d.Event.Type, "delivered").Inc()
+			continue
+		}
+
+		d.LastError = err.Error()
+		if d.Attempts >= getWebhookMaxAttempts() {
+			webhookDeliveriesTotal.WithLabelValues(d.Event.Type, "exhausted").Inc()
+			log.Printf("Webhook %s to %s dead-lettered after %d attempts: %v", d.ID, d.URL, d.Attempts, err)
+			q.deadLetter(d)
+			continue
+		}
+
+		webhookDeliveriesTotal.WithLabelValues(d.Event.Type, "retry").Inc()
+		q.enqueue(d, time.Now().Add(webhookBackoff(d.Attempts)))
+	}
+}
+
+// deadLetter stores a delivery that exhausted its attempts
+func (q *webhookQueue) deadLetter(d *webhookDelivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	d.FailedAt = time.Now().UTC().Format(time.RFC3339)
+	q.deadLetters = append(q.deadLetters, d)
+	if limit := getWebhookDeadLetterLimit(); len(q.deadLetters) > limit {
+		q.deadLetters = q.deadLetters[len(q.deadLetters)-limit:]
+	}
+	webhookDeadLetters.Set(float64(len(q.deadLetters)))
+}
+
+// listDeadLetters returns dead letters, optionally for a single merchant
+func (q *webhookQueue) listDeadLetters(merchantID string) []webhookDelivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	letters := make([]webhookDelivery, 0, len(q.deadLetters))
+	for _, d := range q.deadLetters {
+		if merchantID == "" || d.Event.MerchantID == merchantID {
+			letters = append(letters, *d)
+		}
+	}
+	return letters
+}
+
+// retryDeadLetter moves a dead letter back into the queue with a fresh
+// attempt budget
+func (q *webhookQueue) retryDeadLetter(id, merchantID string) bool {
+	q.mu.Lock()
+	var found *webhookDelivery
+	for i, d := range q.deadLetters {
+		if d.ID == id && (merchantID == "" || d.Event.MerchantID == merchantID) {
+			found = d
+			q.deadLetters = append(q.deadLetters[:i], q.deadLetters[i+1:]...)
+			break
+		}
+	}
+	webhookDeadLetters.Set(float64(len(q.deadLetters)))
+	q.mu.Unlock()
+
+	if found == nil {
+		return false
+	}
+	found.Attempts = 0
+	found.LastError = ""
+	found.FailedAt = ""
+	q.enqueue(found, time.Now())
+	return true
+}
+
+// handleDeadLetterList lists dead letters (GET /webhooks/dead-letters)
+func handleDeadLetterList(w http.ResponseWriter, r *http.Request) {
+	merchantID, _ := merchantFromContext(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(webhookDeliveries.listDeadLetters(merchantID))
+}
+
+// handleDeadLetterRetry replays one dead letter
+// (POST /webhooks/dead-letters/{id}/retry)
+func handleDeadLetterRetry(w http.ResponseWriter, r *http.Request) {
+	merchantID, _ := merchantFromContext(r.Context())
+	id := r.PathValue("id")
+	if !webhookDeliveries.retryDeadLetter(id, merchantID) {
+		writeError(w, r, http.StatusNotFound, errCodeNotFound, "Dead letter not found", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"id":     id,
+		"status": "requeued",
+	})
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// TestWebhookQueueHandOverDoesNotBlock checks that due deliveries finding
+// every worker busy and the buffer full don't hold up the scheduler's
+// other delayed calls, stay pending until a worker takes them, and are
+// all handed over once workers free up
+func TestWebhookQueueHandOverDoesNotBlock(t *testing.T) {
+	cases := []struct {
+		name  string
+		extra int
+	}{
+		{"buffer just full", 0},
+		{"more than the scheduler workers past it", 8},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			// No workers, so nothing takes deliveries off the buffer
+			q := newWebhookQueue()
+			total := webhookDueBuffer + tc.extra
+			for i := 0; i < total; i++ {
+				q.enqueue(&webhookDelivery{ID: fmt.Sprintf("wh_%d", i)}, time.Now())
+			}
+
+			done := make(chan struct{})
+			jobs.after(0, func() { close(done) })
+			select {
+			case <-done:
+			case <-time.After(5 * time.Second):
+				t.Fatal("a delayed call was held up by webhook deliveries")
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for len(q.due) < webhookDueBuffer && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if len(q.due) != webhookDueBuffer {
+				t.Errorf("%d deliveries buffered, want %d", len(q.due), webhookDueBuffer)
+			}
+			if pending := q.pending.Load(); pending != int64(total) {
+				t.Errorf("%d deliveries pending, want all %d until a worker takes them", pending, total)
+			}
+
+			// Take every delivery, the backlog's as room frees up, so none
+			// is handed over after the test
+			for taken := 0; taken < total; taken++ {
+				select {
+				case <-q.due:
+				case <-time.After(5 * time.Second):
+					t.Fatalf("took %d deliveries of %d", taken, total)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Webhook event types emitted over the transaction lifecycle
+const (
+	eventAuthorizationApproved    = "authorization.approved"
+	eventAuthorizationDeclined    = "authorization.declined"
+	eventAuthorizationExpired     = "authorization.expired"
+	eventAuthorizationIncremented = "authorization.incremented"
+	eventCaptureCompleted         = "capture.completed"
+	eventRefundCompleted          = "refund.completed"
+)
+
+// Headers sent with every webhook delivery. The signature uses the same
+// scheme as inbound request signing so merchants can share verification code.
+const (
+	webhookSignatureHeader = "X-Webhook-Signature"
+	webhookTimestampHeader = "X-Webhook-Timestamp"
+	webhookEventHeader     = "X-Webhook-Event"
+	webhookIDHeader        = "X-Webhook-ID"
+)
+
+var (
+	webhookDeliveriesTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "voyager_webhook_deliveries_total",
+			Help: "Total number of webhook delivery attempts by event type and result",
+		},
+		[]string{"event", "result"},
+	)
+
+	webhookDeliveryDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "voyager_webhook_delivery_duration_seconds",
+			Help:    "Webhook delivery attempt duration in seconds",
+			Buckets: []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1.0, 2.5, 5.0},
+		},
+		[]string{"event"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(webhookDeliveriesTotal)
+	prometheus.MustRegister(webhookDeliveryDuration)
+}
+
+// WebhookEvent is the payload POSTed to merchant callback URLs
+type WebhookEvent struct {
+	ID         string      `json:"id"`
+	Type       string      `json:"type"`
+	MerchantID string      `json:"merchant_id"`
+	CreatedAt  string      `json:"created_at"`
+	Data       interface{} `json:"data"`
+}
+
+// MarshalJSON masks card data in the event's data, so webhook payloads,
+// the /events stream and the delivery listings never carry it
+func (e WebhookEvent) MarshalJSON() ([]byte, error) {
+	type plain WebhookEvent
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(struct {
+		plain
+		Data json.RawMessage `json:"data"`
+	}{plain(e), sanitizeJSON(data)})
+}
+
+// WebhookRegistration binds a merchant to its callback URL
+type WebhookRegistration struct {
+	MerchantID string `json:"merchant_id"`
+	URL        string `json:"url"`
+}
+
+// webhookRegistry holds the callback URL for each merchant
+type webhookRegistry struct {
+	mu   sync.RWMutex
+	urls map[string]string
+}
+
+var webhooks = &webhookRegistry{urls: make(map[string]string)}
+
+var webhookClient = &http.Client{Timeout: getWebhookTimeout()}
+
+// loadWebhookURLs registers callbacks from WEBHOOK_URLS, a comma separated
+// list of merchant_id=url pairs
+func loadWebhookURLs() error {
+	for _, pair := range strings.Split(os.Getenv("WEBHOOK_URLS"), ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		merchantID, callbackURL, ok := strings.Cut(pair, "=")
+		if !ok || merchantID == "" {
+			return fmt.Errorf("invalid WEBHOOK_URLS entry %q, expected merchant_id=url", pair)
+		}
+		if err := validateWebhookURL(callbackURL); err != nil {
+			return fmt.Errorf("invalid WEBHOOK_URLS entry for %s: %w", merchantID, err)
+		}
+		webhooks.set(merchantID, callbackURL)
+	}
+	return nil
+}
+
+func validateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("url scheme must be http or https")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("url must include a host")
+	}
+	return nil
+}
+
+func (reg *webhookRegistry) set(merchantID, callbackURL string) {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	reg.urls[merchantID] = callbackURL
+}
+
+// get returns the merchant's registered URL, falling back to the
+// webhook_url in its merchant profile
+func (reg *webhookRegistry) get(merchantID string) (string, bool) {
+	reg.mu.RLock()
+	callbackURL, ok := reg.urls[merchantID]
+	reg.mu.RUnlock()
+	if ok {
+		return callbackURL, true
+	}
+	if m, found := currentConfig().merchantProfile(merchantID); found && m.WebhookURL != "" {
+		return m.WebhookURL, true
+	}
+	return "", false
+}
+
+func (reg *webhookRegistry) list() []WebhookRegistration {
+	reg.mu.RLock()
+	defer reg.mu.RUnlock()
+	registrations := make([]WebhookRegistration, 0, len(reg.urls))
+	for merchantID, callbackURL := range reg.urls {
+		registrations = append(registrations, WebhookRegistration{MerchantID: merchantID, URL: callbackURL})
+	}
+	for merchantID, m := range currentConfig().Merchants {
+		if _, registered := reg.urls[merchantID]; !registered && m.WebhookURL != "" {
+			registrations = append(registrations, WebhookRegistration{MerchantID: merchantID, URL: m.WebhookURL})
+		}
+	}
+	return registrations
+}
+
+// getWebhookMaxAttempts returns how many times a delivery is tried
+func getWebhookMaxAttempts() int {
+	attempts, err := strconv.Atoi(getEnv("WEBHOOK_MAX_ATTEMPTS", "5"))
+	if err != nil || attempts < 1 {
+		return 5
+	}
+	return attempts
+}
+
+// getWebhookInitialBackoff returns the base delay before the first retry;
+// it doubles after every failed attempt up to WEBHOOK_MAX_BACKOFF_MS
+func getWebhookInitialBackoff() time.Duration {
+	ms, err := strconv.Atoi(getEnv("WEBHOOK_INITIAL_BACKOFF_MS", "500"))
+	if err != nil || ms < 0 {
+		return 500 * time.Millisecond
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// getWebhookTimeout returns the per-attempt HTTP timeout
+func getWebhookTimeout() time.Duration {
+	ms, err := strconv.Atoi(getEnv("WEBHOOK_TIMEOUT_MS", "5000"))
+	if err != nil || ms <= 0 {
+		return 5 * time.Second
+	}
+	return time.Duration(ms) * time.Millisecond
+}
+
+// webhookSecret returns the secret used to sign a merchant's webhooks,
+// falling back to WEBHOOK_SIGNING_SECRET for merchants without their own
+func webhookSecret(merchantID string) string {
+	if secret, ok := secretFor(merchantID); ok {
+		return secret
+	}
+	return os.Getenv("WEBHOOK_SIGNING_SECRET")
+}
+
+// deliverWebhook queues an event for delivery to the merchant's callback
+// URL. It is a no-op for merchants without a registered URL.
+func deliverWebhook(event WebhookEvent) {
+	callbackURL, ok := webhooks.get(event.MerchantID)
+	if !ok {
+		return
+	}
+
+	body, err := json.Marshal(event)
+	if err != nil {
+		log.Printf("Failed to encode webhook %s: %v", event.ID, err)
+		return
+	}
+
+	webhookDeliveries.enqueue(&webhookDelivery{
+		ID:    event.ID,
+		URL:   callbackURL,
+		Event: event,
+		body:  body,
+	}, time.Now())
+}
+
+// postWebhook makes a single signed delivery attempt
+func postWebhook(callbackURL string, event WebhookEvent, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookEventHeader, event.Type)
+	req.Header.Set(webhookIDHeader, event.ID)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	if secret := webhookSecret(event.MerchantID); secret != "" {
+		req.Header.Set(webhookSignatureHeader, computeSignature(secret, timestamp, body))
+	}
+
+	start := time.Now()
+	resp, err := webhookClient.Do(req)
+	webhookDeliveryDuration.WithLabelValues(event.Type).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// handleWebhookList lists merchant callback URLs (GET /webhooks);
+// authenticated merchants only see their own
+func handleWebhookList(w http.ResponseWriter, r *http.Request) {
+	registrations := webhooks.list()
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		registrations = []WebhookRegistration{}
+		if callbackURL, found := webhooks.get(merchantID); found {
+			registrations = append(registrations, WebhookRegistration{MerchantID: merchantID, URL: callbackURL})
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(registrations)
+}
+
+// handleWebhookRegister registers a merchant callback URL (POST /webhooks)
+func handleWebhookRegister(w http.ResponseWriter, r *http.Request) {
+	var reg WebhookRegistration
+	if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"body", "must be a valid JSON webhook registration"}})
+		return
+	}
+	if merchantID, ok := merchantFromContext(r.Context()); ok {
+		reg.MerchantID = merchantID
+	}
+	if reg.MerchantID == "" {
+		writeValidationError(w, r, []FieldViolation{{"merchant_id", "is required"}})
+		return
+	}
+	if err := validateWebhookURL(reg.URL); err != nil {
+		writeValidationError(w, r, []FieldViolation{{"url", err.Error()}})
+		return
+	}
+
+	webhooks.set(reg.MerchantID, reg.URL)
+	log.Printf("Registered webhook for merchant %s", reg.MerchantID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(reg)
+}
@@ -51,7 +51,7 @@ wait_for_health() {
     attempt=0
     
     while [ $attempt -lt $max_attempts ]; do
-        if curl -s http://localhost:8080/health/ready > /dev/null 2>&1; then
+        if curl -s http://localhost:8081/health/ready > /dev/null 2>&1; then
             echo -e "${GREEN}✅ Service is healthy${NC}"
             return 0
         fi
@@ -74,15 +74,15 @@ show_status() {
     echo ""
     echo "🌐 Endpoints:"
     echo "  • Voyager Gateway: http://localhost:8080"
-    echo "  • Health Check:    http://localhost:8080/health/ready"
-    echo "  • Metrics:         http://localhost:8080/metrics"
+    echo "  • Health Check:    http://localhost:8081/health/ready"
+    echo "  • Metrics:         http://localhost:8081/metrics"
     echo "  • Prometheus:      http://localhost:9090"
     echo "  • Grafana:         http://localhost:3000 (admin/admin)"
     echo ""
     
     # Show health status
     echo "📈 Health Check:"
-    curl -s http://localhost:8080/health/ready | jq . 2>/dev/null || echo "Service not responding"
+    curl -s http://localhost:8081/health/ready | jq . 2>/dev/null || echo "Service not responding"
     echo ""
 }
 
@@ -97,7 +97,7 @@ test_authorization() {
             "amount": 99.99,
             "currency": "USD",
             "card_token": "tok_test_123",
-            "transaction_id": "txn_test_001"
+            "transaction_id": "txn_test_'"$(date +%s)"'"
         }')
     
     echo "Response:"
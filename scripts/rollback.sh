@@ -73,7 +73,7 @@ kubectl argo rollouts get rollout $ROLLOUT_NAME -n $NAMESPACE
 
 echo ""
 echo "🔍 Verifying service health..."
-kubectl exec -n $NAMESPACE deploy/$ROLLOUT_NAME -- wget -qO- http://localhost:8080/health/ready | jq . 2>/dev/null || echo "Health check endpoint response received"
+kubectl exec -n $NAMESPACE deploy/$ROLLOUT_NAME -- wget -qO- http://localhost:8081/health/ready | jq . 2>/dev/null || echo "Health check endpoint response received"
 
 echo ""
 echo -e "${GREEN}Rollback complete. Monitor the dashboard for stabilization.${NC}"
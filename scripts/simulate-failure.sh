@@ -12,6 +12,8 @@ BLUE='\033[0;34m'
 NC='\033[0m'
 
 BASE_URL="${BASE_URL:-http://localhost:8080}"
+ADMIN_URL="${ADMIN_URL:-http://localhost:8081}"
+ADMIN_TOKEN="${ADMIN_TOKEN:-local-admin-token}"
 
 echo ""
 echo "╔═══════════════════════════════════════════════════════════╗"
@@ -93,7 +95,7 @@ reset_to_normal() {
     echo ""
     
     # Reset metrics
-    curl -s -X POST "$BASE_URL/reset" > /dev/null 2>&1 || true
+    curl -s -X POST -H "Authorization: Bearer $ADMIN_TOKEN" "$ADMIN_URL/reset" > /dev/null 2>&1 || true
     echo "Metrics reset."
 }
 
@@ -104,7 +106,7 @@ simulate_bad_deployment() {
     echo ""
     echo "In a real Kubernetes environment with Argo Rollouts:"
     echo ""
-    echo "1. A new version with FAILURE_RATE=0.5 would be deployed"
+    echo "1. A new version listed in BAD_VERSIONS would be deployed and degrade"
     echo "2. Canary analysis would detect the high error rate"
     echo "3. Rollout would be automatically aborted"
     echo "4. Traffic would be shifted back to the stable version"
@@ -125,11 +127,11 @@ simulate_bad_deployment() {
     # For local docker demonstration
     echo "For local Docker demonstration, running degraded version..."
     docker-compose stop voyager-gateway
-    FAILURE_RATE=0.5 APP_VERSION=2.0.0-bad docker-compose up -d voyager-gateway
+    BAD_VERSIONS=2.0.0-bad APP_VERSION=2.0.0-bad docker-compose up -d voyager-gateway
     
     echo ""
     echo "Bad version deployed. Check metrics at:"
-    echo "  http://localhost:8080/health/ready"
+    echo "  $ADMIN_URL/health/ready"
     echo "  http://localhost:3000/d/voyager-gateway"
     echo ""
     echo -e "${YELLOW}Note: In production, Argo Rollouts would automatically rollback.${NC}"